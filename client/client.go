@@ -0,0 +1,589 @@
+// Package client connects Go programs to a can-server over its cannelloni
+// TCP protocol: it performs the handshake, sends and receives frames and
+// measures link round-trip time with the gateway ping op. AutoConn keeps a
+// connection up across server restarts and network outages.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+)
+
+// Frame is a CAN frame as carried by the gateway: classic, or CAN FD
+// (Flags with can.CANFD_FDF) on connections that negotiated it.
+type Frame = can.Frame
+
+// ErrClosed is returned by operations on a closed connection.
+var ErrClosed = errors.New("client: connection closed")
+
+// ErrFilterRejected is returned by SetFilter when the server refused the
+// filter; the previous one stays in force.
+var ErrFilterRejected = errors.New("client: filter rejected by server")
+
+// ErrFDUnavailable is returned when sending a CAN FD frame on a connection
+// without FD (see WithFD).
+var ErrFDUnavailable = errors.New("client: CAN FD not negotiated")
+
+const (
+	defaultHandshakeTimeout = 3 * time.Second
+	defaultRecvBuffer       = 1024
+)
+
+// Option configures a Conn.
+type Option func(*Conn)
+
+// WithHandshakeTimeout bounds the cannelloni handshake (default 3s).
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(c *Conn) {
+		if d > 0 {
+			c.handshakeTimeout = d
+		}
+	}
+}
+
+// WithPingInterval pings the server every d in the background so RTT stays
+// current for link-quality display. 0 (default) only pings on demand.
+func WithPingInterval(d time.Duration) Option {
+	return func(c *Conn) { c.pingInterval = d }
+}
+
+// WithRecvBuffer sets how many received frames are buffered for Frames
+// before the connection stops reading (default 1024).
+func WithRecvBuffer(n int) Option {
+	return func(c *Conn) {
+		if n > 0 {
+			c.recvBuffer = n
+		}
+	}
+}
+
+// WithTLS connects over TLS with cfg, e.g. to present a client certificate
+// to a server started with -tls-client-ca.
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *Conn) { c.tlsConfig = cfg }
+}
+
+// WithCompression asks the server to compress the frames it sends with
+// DEFLATE, for slow links. The server may refuse (OpCompress
+// CompressUnavailable) or turn compression off later when the traffic does
+// not compress; frames arrive the same either way and Compressed tells
+// which applies.
+func WithCompression() Option {
+	return func(c *Conn) { c.compress = true }
+}
+
+// WithErrorFrames subscribes to the CAN error frames the server reports
+// (servers run with -can-err-filter; feature "errframes"). They arrive on
+// Frames with CAN_ERR_FLAG set; ErrorFrames tells whether the server
+// accepted the subscription.
+func WithErrorFrames() Option {
+	return func(c *Conn) { c.errFrames = true }
+}
+
+// WithFlowControl subscribes to the server's flow-control hints (feature
+// "flow"): the fill level of its backend TX queue, reported whenever it
+// changes. SendContext then waits while the queue is nearly full instead of
+// having frames dropped, and Flow reports the current hint for finer
+// pacing. FlowControl tells whether the server accepted the subscription.
+func WithFlowControl() Option {
+	return func(c *Conn) { c.flow = true }
+}
+
+// WithFD asks the server for CAN FD frames (feature "fd") in both
+// directions. FD frames may be sent once FD reports the server accepted;
+// until then Send refuses them with ErrFDUnavailable.
+func WithFD() Option {
+	return func(c *Conn) { c.fd = true }
+}
+
+// WithPacketFraming speaks cannelloni DATA packet framing, for servers run
+// with -packet-framing.
+func WithPacketFraming() Option {
+	return func(c *Conn) { c.packets = true }
+}
+
+// FlowLevel is the fill level of the server's backend TX queue.
+type FlowLevel uint8
+
+const (
+	FlowOK   FlowLevel = cnl.FlowOK   // send freely
+	FlowSlow FlowLevel = cnl.FlowSlow // queue half full: slow down
+	FlowStop FlowLevel = cnl.FlowStop // queue nearly full: hold frames back
+)
+
+func (l FlowLevel) String() string {
+	switch l {
+	case FlowSlow:
+		return "slow"
+	case FlowStop:
+		return "stop"
+	}
+	return "ok"
+}
+
+// Identity is what a server reports about itself (see Conn.Identify).
+type Identity struct {
+	Version string // server version
+	Backend string // backend kind, e.g. socketcan
+	Bus     string // bus name: instance, virtual bus or interface; may be empty
+}
+
+// FlowState is the last flow-control hint received from the server.
+type FlowState struct {
+	Level    FlowLevel
+	Depth    int // frames queued when the hint was sent (saturates at 65535)
+	Capacity int // queue capacity (saturates at 65535)
+}
+
+type pendingPing struct {
+	sent time.Time
+	done chan time.Duration // receives the RTT when the pong arrives
+}
+
+// Conn is a client connection to a can-server. Send, Ping and RTT are safe
+// for concurrent use.
+type Conn struct {
+	conn  net.Conn
+	codec cnl.Codec
+
+	handshakeTimeout time.Duration
+	pingInterval     time.Duration
+	recvBuffer       int
+	tlsConfig        *tls.Config
+	compress         bool
+	errFrames        bool
+	flow             bool
+	fd               bool
+	packets          bool
+
+	wmu    sync.Mutex
+	enc    *cnl.PacketEncoder // packet framing; guarded by wmu
+	frames chan Frame
+	done   chan struct{}
+	once   sync.Once
+	errMu  sync.Mutex
+	err    error
+
+	pingMu  sync.Mutex
+	pingSeq uint16
+	pending map[uint16]*pendingPing
+	rtt     atomic.Int64
+
+	compressed atomic.Bool
+	errsOn     atomic.Bool
+	fdOn       atomic.Bool
+
+	filterMu  sync.Mutex
+	filterAck chan byte // answers to OpFilter commits
+
+	identMu  sync.Mutex
+	identBuf cnl.Ident      // answer being received, owned by readLoop
+	identAns chan cnl.Ident // complete OpIdent answers
+
+	flowMu    sync.Mutex
+	flowOn    bool          // server sends flow hints
+	flowState FlowState     // last hint
+	flowWake  chan struct{} // closed and replaced on every hint
+}
+
+// Dial connects to addr and completes the cannelloni handshake.
+func Dial(ctx context.Context, addr string, opts ...Option) (*Conn, error) {
+	c := &Conn{
+		handshakeTimeout: defaultHandshakeTimeout,
+		recvBuffer:       defaultRecvBuffer,
+		done:             make(chan struct{}),
+		pending:          make(map[uint16]*pendingPing),
+		filterAck:        make(chan byte, 1),
+		identAns:         make(chan cnl.Ident, 1),
+		flowWake:         make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.tlsConfig != nil {
+		tc := tls.Client(conn, c.tlsConfig)
+		hctx, cancel := context.WithTimeout(ctx, c.handshakeTimeout)
+		err := tc.HandshakeContext(hctx)
+		cancel()
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	if err := cnl.Handshake(ctx, conn, c.handshakeTimeout); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	c.conn = conn
+	c.frames = make(chan Frame, c.recvBuffer)
+	if c.packets {
+		c.enc = &cnl.PacketEncoder{}
+	}
+	go c.readLoop()
+	if c.compress {
+		if err := c.write(cnl.Compress(cnl.CompressDeflate)); err != nil {
+			return nil, err
+		}
+	}
+	if c.errFrames {
+		if err := c.write(cnl.ErrFrames(cnl.ErrFramesOn)); err != nil {
+			return nil, err
+		}
+	}
+	if c.flow {
+		if err := c.write(cnl.Flow(cnl.FlowOn)); err != nil {
+			return nil, err
+		}
+	}
+	if c.fd {
+		if err := c.write(cnl.FD(cnl.FDOn)); err != nil {
+			return nil, err
+		}
+	}
+	if c.pingInterval > 0 {
+		go c.pingLoop()
+	}
+	return c, nil
+}
+
+// Send writes one frame to the server.
+func (c *Conn) Send(fr Frame) error {
+	return c.write(fr)
+}
+
+// SendContext writes one frame to the server, first waiting while the
+// server reports its backend TX queue nearly full (FlowStop). Without flow
+// hints (see WithFlowControl) it is Send. It returns ctx.Err() if ctx ends
+// while waiting.
+func (c *Conn) SendContext(ctx context.Context, fr Frame) error {
+	for {
+		c.flowMu.Lock()
+		stop, wake := c.flowOn && c.flowState.Level == FlowStop, c.flowWake
+		c.flowMu.Unlock()
+		if !stop {
+			return c.write(fr)
+		}
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.done:
+			return c.Err()
+		}
+	}
+}
+
+func (c *Conn) write(frames ...Frame) error {
+	select {
+	case <-c.done:
+		return c.Err()
+	default:
+	}
+	if !c.fdOn.Load() {
+		for i := range frames {
+			if frames[i].IsFD() {
+				return ErrFDUnavailable
+			}
+		}
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var buf []byte
+	if c.enc != nil {
+		var b bytes.Buffer
+		_, _ = c.enc.EncodeTo(&b, frames)
+		buf = b.Bytes()
+	} else {
+		buf = c.codec.Encode(frames)
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
+
+// Frames returns the frames received from the server, including gateway
+// control messages other than ping, filter and flow-control answers. The
+// channel is closed when the connection ends; Err then tells why.
+func (c *Conn) Frames() <-chan Frame { return c.frames }
+
+// Err returns the error that ended the connection (ErrClosed after Close),
+// or nil while it is open.
+func (c *Conn) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	c.fail(ErrClosed)
+	return nil
+}
+
+func (c *Conn) fail(err error) {
+	c.once.Do(func() {
+		c.errMu.Lock()
+		c.err = err
+		c.errMu.Unlock()
+		close(c.done)
+		_ = c.conn.Close()
+	})
+}
+
+func (c *Conn) readLoop() {
+	defer close(c.frames)
+	r := bufio.NewReader(c.conn)
+	// src is r, or a DEFLATE reader over it while the server compresses.
+	// bufio.Reader is an io.ByteReader, so inflating never reads past the
+	// end of the compressed stream.
+	var src io.Reader = r
+	// dc decodes FD frames once the server answered FDOn.
+	dc := new(cnl.Codec)
+	decode := dc.Decode
+	if c.packets {
+		pd := cnl.NewPacketDecoder(cnl.SourceTCP)
+		dc, decode = pd.Codec(), pd.Decode
+	}
+	for {
+		fr, err := decode(src)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if code, ok := cnl.ParseCompress(&fr); ok {
+			switch {
+			case code == cnl.CompressDeflate && src == io.Reader(r):
+				src = flate.NewReader(r)
+				c.compressed.Store(true)
+			case code == cnl.CompressOff && src != io.Reader(r):
+				// The final block follows; the stream is plain after it.
+				if _, err := io.Copy(io.Discard, src); err != nil {
+					c.fail(err)
+					return
+				}
+				src = r
+				c.compressed.Store(false)
+			}
+		}
+		if code, ok := cnl.ParseErrFrames(&fr); ok {
+			c.errsOn.Store(code == cnl.ErrFramesOn)
+		}
+		if code, ok := cnl.ParseFD(&fr); ok {
+			dc.FD = code == cnl.FDOn
+			c.fdOn.Store(dc.FD)
+		}
+		if seq, ok := cnl.ParsePong(&fr); ok {
+			c.pong(seq)
+			continue
+		}
+		if code, level, depth, capacity, ok := cnl.ParseFlow(&fr); ok {
+			c.setFlow(code == cnl.FlowHint, FlowState{Level: FlowLevel(level), Depth: depth, Capacity: capacity})
+			continue
+		}
+		if code, _, ok := cnl.ParseFilter(&fr); ok {
+			select {
+			case c.filterAck <- code:
+			default: // nobody waiting
+			}
+			continue
+		}
+		if _, _, ok := cnl.ParseIdent(&fr); ok {
+			if c.identBuf.Add(&fr) {
+				select {
+				case c.identAns <- c.identBuf:
+				default: // nobody waiting
+				}
+				c.identBuf = cnl.Ident{}
+			}
+			continue
+		}
+		select {
+		case c.frames <- fr:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Ping measures the round-trip time to the server. The server answers
+// pings ahead of its batching, so the result reflects the link and the
+// server's scheduling, not -flush-interval.
+func (c *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	c.pingMu.Lock()
+	c.pingSeq++
+	seq := c.pingSeq
+	p := &pendingPing{sent: time.Now(), done: make(chan time.Duration, 1)}
+	c.pending[seq] = p
+	c.pingMu.Unlock()
+	defer func() {
+		c.pingMu.Lock()
+		delete(c.pending, seq)
+		c.pingMu.Unlock()
+	}()
+	if err := c.write(cnl.Ping(seq, c.RTT())); err != nil {
+		return 0, err
+	}
+	select {
+	case d := <-p.done:
+		return d, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-c.done:
+		return 0, c.Err()
+	}
+}
+
+func (c *Conn) pong(seq uint16) {
+	c.pingMu.Lock()
+	defer c.pingMu.Unlock()
+	p, ok := c.pending[seq]
+	if !ok {
+		return // late answer to an abandoned ping
+	}
+	d := time.Since(p.sent)
+	c.rtt.Store(int64(d))
+	delete(c.pending, seq)
+	p.done <- d
+}
+
+// SetFilter makes the server send only the frames whose IDs match ids, a
+// filter list such as "0x100-0x1FF,0x18FF0000/0x1FFF0000" (empty: all
+// IDs), and with changeOnly only those whose payload differs from the last
+// one it sent with the same ID. The server applies the filter before
+// queueing, so rejected frames cost neither bandwidth nor queue space. It
+// replaces the previous filter and returns once the server applied it;
+// servers without the "filter" feature never answer, so bound ctx.
+func (c *Conn) SetFilter(ctx context.Context, ids string, changeOnly bool) error {
+	if len(ids) > cnl.MaxFilterText {
+		return fmt.Errorf("client: filter list longer than %d bytes", cnl.MaxFilterText)
+	}
+	if _, err := filter.New(ids, ""); err != nil {
+		return fmt.Errorf("client: %w", err)
+	}
+	var flags byte
+	if changeOnly {
+		flags |= cnl.FilterChangeOnly
+	}
+	c.filterMu.Lock()
+	defer c.filterMu.Unlock()
+	select {
+	case <-c.filterAck: // late answer to an abandoned call
+	default:
+	}
+	if err := c.write(cnl.FilterMessages(ids, flags)...); err != nil {
+		return err
+	}
+	select {
+	case code := <-c.filterAck:
+		if code != cnl.FilterOK {
+			return ErrFilterRejected
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return c.Err()
+	}
+}
+
+// Identify asks the server for its version, backend and bus name (feature
+// "ident"). Servers without the feature never answer, so bound ctx.
+func (c *Conn) Identify(ctx context.Context) (Identity, error) {
+	c.identMu.Lock()
+	defer c.identMu.Unlock()
+	select {
+	case <-c.identAns: // late answer to an abandoned call
+	default:
+	}
+	if err := c.write(cnl.IdentRequest()); err != nil {
+		return Identity{}, err
+	}
+	select {
+	case id := <-c.identAns:
+		return Identity{Version: id.Version, Backend: id.Backend, Bus: id.Bus}, nil
+	case <-ctx.Done():
+		return Identity{}, ctx.Err()
+	case <-c.done:
+		return Identity{}, c.Err()
+	}
+}
+
+// Compressed reports whether the server currently compresses the frames it
+// sends (see WithCompression).
+func (c *Conn) Compressed() bool { return c.compressed.Load() }
+
+// ErrorFrames reports whether the server sends error frames on this
+// connection (see WithErrorFrames).
+func (c *Conn) ErrorFrames() bool { return c.errsOn.Load() }
+
+// FD reports whether CAN FD frames are carried on this connection (see
+// WithFD).
+func (c *Conn) FD() bool { return c.fdOn.Load() }
+
+// FlowControl reports whether the server sends flow-control hints on this
+// connection (see WithFlowControl).
+func (c *Conn) FlowControl() bool {
+	c.flowMu.Lock()
+	defer c.flowMu.Unlock()
+	return c.flowOn
+}
+
+// Flow returns the last flow-control hint; the zero FlowState (FlowOK)
+// without hints.
+func (c *Conn) Flow() FlowState {
+	c.flowMu.Lock()
+	defer c.flowMu.Unlock()
+	return c.flowState
+}
+
+// setFlow records a flow-control answer and wakes SendContext waiters.
+func (c *Conn) setFlow(on bool, st FlowState) {
+	c.flowMu.Lock()
+	defer c.flowMu.Unlock()
+	if !on {
+		st = FlowState{}
+	}
+	c.flowOn, c.flowState = on, st
+	close(c.flowWake)
+	c.flowWake = make(chan struct{})
+}
+
+// RTT returns the last measured round-trip time, 0 before the first ping.
+func (c *Conn) RTT() time.Duration { return time.Duration(c.rtt.Load()) }
+
+func (c *Conn) pingLoop() {
+	t := time.NewTicker(c.pingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			ctx, cancel := context.WithTimeout(context.Background(), c.pingInterval)
+			_, _ = c.Ping(ctx)
+			cancel()
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+func TestPingAndFrames(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h := hub.New()
+	srv := server.NewServer(
+		server.WithHub(h),
+		server.WithCodec(&cnl.Codec{}),
+		server.WithSend(func(fr can.Frame) error { h.Broadcast(fr); return nil }),
+		server.WithListenAddr("127.0.0.1:0"),
+		// A long flush interval shows pongs are not batched.
+		server.WithFlushInterval(time.Second),
+	)
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+
+	c, err := Dial(ctx, srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		rtt, err := c.Ping(ctx)
+		if err != nil {
+			t.Fatalf("ping %d: %v", i, err)
+		}
+		if rtt <= 0 || rtt > 500*time.Millisecond {
+			t.Fatalf("ping %d: rtt %v", i, rtt)
+		}
+	}
+	// The second ping carried the first measurement to the server.
+	if cl := srv.Clients(); len(cl) != 1 || cl[0].RTT <= 0 {
+		t.Fatalf("server client info: %+v", cl)
+	}
+
+	if err := c.Send(Frame{CANID: 0x123, Len: 1}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case fr := <-c.Frames():
+		if fr.CANID != 0x123 {
+			t.Fatalf("unexpected frame %+v", fr)
+		}
+	case <-ctx.Done():
+		t.Fatal("echoed frame not received")
+	}
+	_ = c.Close()
+	if _, err := c.Ping(ctx); err != ErrClosed {
+		t.Fatalf("ping after close: %v", err)
+	}
+}
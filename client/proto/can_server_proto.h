@@ -0,0 +1,238 @@
+/* Code generated by go generate (internal/cnl/gen); DO NOT EDIT. */
+
+/*
+ * Wire protocol of can-server (cannelloni over TCP), revision 9.
+ *
+ * A connection starts with both sides sending HELLO. After it each frame is
+ * a 4-byte big-endian CAN ID carrying the SocketCAN flag bits, a length byte
+ * (LEN_MASK bits) and that many payload bytes. Frames with CAN ID
+ * CONTROL_ID are gateway control messages of 8 bytes, the op code first;
+ * the layouts below give their fields. Optional extensions are advertised
+ * in the mDNS "features" TXT record (FEATURES), the revision in "proto".
+ *
+ * After an OP_COMPRESS COMPRESS_DEFLATE answer the server -> client bytes
+ * are a raw DEFLATE stream (RFC 1951) until an OP_COMPRESS COMPRESS_OFF
+ * message and the final block; the stream is plain again after it.
+ *
+ * OP_FILTER pushes a receive filter: FILTER_BEGIN, the ID list (syntax of
+ * the server -rx-allow flag) in FILTER_TEXT chunks, then FILTER_COMMIT.
+ *
+ * OP_FLOW FLOW_ON subscribes to flow hints: the server answers FLOW_HINT
+ * with the backend TX queue state and sends another whenever the level
+ * changes. Clients hold frames at FLOW_STOP and slow down at FLOW_SLOW.
+ *
+ * LEN_FD in the length byte marks a CAN FD frame: a flags byte (CANFD_*)
+ * follows the length byte, then up to MAX_FD_LEN payload bytes. It is
+ * only valid after OP_FD FD_ON; a server closes a connection sending it
+ * without.
+ *
+ * OP_IDENT IDENT_QUERY asks who the server is: it answers with its version,
+ * backend and bus name in IDENT_VERSION, IDENT_BACKEND and IDENT_BUS text
+ * chunks (empty fields are left out), then IDENT_END.
+ *
+ * OP_RTR RTR_ON makes remote requests (CAN_RTR_FLAG) carry the requested
+ * length and no payload, as in cannelloni. The server decodes them so
+ * from the request on and sends them so after its RTR_ON answer; send no
+ * remote request in between.
+ */
+#ifndef CAN_SERVER_PROTO_H
+#define CAN_SERVER_PROTO_H
+
+#define CNL_PROTOCOL_REVISION 9
+#define CNL_HELLO "CANNELLONIv1"
+#define CNL_HELLO_SIZE 12
+
+/* Frame layout */
+#define CNL_CAN_EFF_FLAG 0x80000000u /* extended (29-bit) identifier */
+#define CNL_CAN_RTR_FLAG 0x40000000u /* remote transmission request */
+#define CNL_CAN_ERR_FLAG 0x20000000u /* error frame */
+#define CNL_CAN_SFF_MASK 0x7FFu /* standard identifier bits */
+#define CNL_CAN_EFF_MASK 0x1FFFFFFFu /* extended identifier bits */
+#define CNL_LEN_MASK 0x7Fu /* payload length bits of the length byte */
+#define CNL_LEN_FD 0x80u /* length byte flag: CAN FD frame, flags byte follows (after OP_FD) */
+#define CNL_CANFD_BRS 0x01u /* FD flags byte: bit rate switch */
+#define CNL_CANFD_ESI 0x02u /* FD flags byte: error state indicator */
+#define CNL_MAX_DLC 8u /* largest payload length */
+#define CNL_MAX_FD_LEN 64u /* largest payload length of a CAN FD frame */
+#define CNL_MAX_FRAME_SIZE 13u /* largest wire size of one frame */
+#define CNL_MAX_FD_FRAME_SIZE 70u /* largest wire size of one CAN FD frame */
+#define CNL_CONTROL_ID 0xFFFFFFFFu /* CAN ID of gateway control messages */
+
+/* Control ops (control message byte 0) */
+#define CNL_OP_TX_ACK_ENABLE 0x01u /* client -> server: enable TX acks; echoed as confirmation */
+#define CNL_OP_TX_ACK 0x02u /* server -> client: outcome of one submitted frame */
+#define CNL_OP_HISTORY 0x03u /* client -> server: replay the last N seconds */
+#define CNL_OP_HISTORY_BEGIN 0x04u /* server -> client: replay starts */
+#define CNL_OP_HISTORY_END 0x05u /* server -> client: replay ended */
+#define CNL_OP_SESSION 0x06u /* both ways: open or resume a session */
+#define CNL_OP_PING 0x07u /* client -> server: ask for an immediate pong */
+#define CNL_OP_PONG 0x08u /* server -> client: answer to OP_PING */
+#define CNL_OP_COMPRESS 0x09u /* both ways: negotiate server -> client compression */
+#define CNL_OP_FILTER 0x0Au /* both ways: push a receive filter to the server */
+#define CNL_OP_ERR_FRAMES 0x0Bu /* both ways: subscribe to CAN error frames */
+#define CNL_OP_FLOW 0x0Cu /* both ways: subscribe to flow-control hints */
+#define CNL_OP_FD 0x0Du /* both ways: negotiate CAN FD frames */
+#define CNL_OP_IDENT 0x0Eu /* both ways: ask for and answer the gateway identification */
+#define CNL_OP_RTR 0x0Fu /* both ways: negotiate remote requests without payload */
+
+/* TX ack status (OP_TX_ACK byte 1) */
+#define CNL_ACK_OK 0x00u /* written to the backend */
+#define CNL_ACK_OVERFLOW 0x01u /* backend TX queue full, frame dropped */
+#define CNL_ACK_DENIED 0x02u /* rejected by a TX filter or role */
+#define CNL_ACK_ERROR 0x03u /* backend write failed */
+#define CNL_ACK_INHIBITED 0x04u /* TX inhibited */
+
+/* History status (OP_HISTORY_BEGIN byte 1) */
+#define CNL_HISTORY_OK 0x00u /* replay follows */
+#define CNL_HISTORY_UNAVAILABLE 0x01u /* capture disabled on the server */
+
+/* Session status (OP_SESSION byte 1, server -> client) */
+#define CNL_SESSION_NEW 0x00u /* fresh session */
+#define CNL_SESSION_RESUMED 0x01u /* state restored; missed frames follow as a replay */
+#define CNL_SESSION_UNAVAILABLE 0x02u /* sessions disabled on the server */
+#define CNL_SESSION_TOKEN_MASK 0xFFFFFFFFFFFFull /* session tokens are 48 bits */
+
+/* Compression (OP_COMPRESS byte 1) */
+#define CNL_COMPRESS_OFF 0x00u /* server -> client: compression ended, plain stream follows the final block */
+#define CNL_COMPRESS_DEFLATE 0x01u /* client: request DEFLATE; server: DEFLATE stream follows */
+#define CNL_COMPRESS_UNAVAILABLE 0x02u /* server -> client: compression disabled */
+
+/* Error frame codes (OP_ERR_FRAMES byte 1) */
+#define CNL_ERR_FRAMES_OFF 0x00u /* client: stop; server: error frames are not sent */
+#define CNL_ERR_FRAMES_ON 0x01u /* client: subscribe; server: error frames follow */
+#define CNL_ERR_FRAMES_UNAVAILABLE 0x02u /* server: the backend reports no error frames */
+
+/* Flow codes (OP_FLOW byte 1) */
+#define CNL_FLOW_OFF 0x00u /* client: stop; server: hints are not sent */
+#define CNL_FLOW_ON 0x01u /* client: subscribe */
+#define CNL_FLOW_UNAVAILABLE 0x02u /* server: the backend has no TX queue to report */
+#define CNL_FLOW_HINT 0x03u /* server: level, queue depth and capacity follow */
+
+/* FD codes (OP_FD byte 1) */
+#define CNL_FD_OFF 0x00u /* client: classic frames only; server: no FD frames either way */
+#define CNL_FD_ON 0x01u /* client: request FD; server: FD frames may follow both ways */
+#define CNL_FD_UNAVAILABLE 0x02u /* server: the backend carries no CAN FD frames */
+
+/* RTR codes (OP_RTR byte 1) */
+#define CNL_RTR_OFF 0x00u /* remote requests carry their length in payload bytes */
+#define CNL_RTR_ON 0x01u /* remote requests carry no payload, as in cannelloni */
+
+/* Ident codes (OP_IDENT byte 1) */
+#define CNL_IDENT_QUERY 0x00u /* client: ask for the identification */
+#define CNL_IDENT_VERSION 0x01u /* server: next bytes of the server version, NUL padded */
+#define CNL_IDENT_BACKEND 0x02u /* server: next bytes of the backend kind, NUL padded */
+#define CNL_IDENT_BUS 0x03u /* server: next bytes of the bus name, NUL padded */
+#define CNL_IDENT_END 0x04u /* server: the answer is complete */
+#define CNL_MAX_IDENT_TEXT 64u /* longest identification field, in bytes */
+
+/* Flow levels (FLOW_HINT byte 2) */
+#define CNL_FLOW_OK 0x00u /* send freely */
+#define CNL_FLOW_SLOW 0x01u /* backend TX queue filling; slow down */
+#define CNL_FLOW_STOP 0x02u /* queue nearly full; hold frames until the level drops */
+
+/* Filter codes (OP_FILTER byte 1) */
+#define CNL_FILTER_BEGIN 0x00u /* client: start a filter; byte 2 holds the flags */
+#define CNL_FILTER_TEXT 0x01u /* client: next bytes of the ID list, NUL padded */
+#define CNL_FILTER_COMMIT 0x02u /* client: apply the filter */
+#define CNL_FILTER_OK 0x03u /* server: filter applied */
+#define CNL_FILTER_INVALID 0x04u /* server: list rejected; the previous filter stays */
+#define CNL_FILTER_CHANGE_ONLY 0x01u /* flag: only frames whose payload changed */
+#define CNL_MAX_FILTER_TEXT 1024u /* longest ID list, in bytes */
+
+/* Control message layouts: byte offset and size of each field in the
+ * 8 data bytes; multi-byte fields are big-endian. */
+#define CNL_TX_ACK_OP_OFF 0
+#define CNL_TX_ACK_OP_SIZE 1
+#define CNL_TX_ACK_STATUS_OFF 1
+#define CNL_TX_ACK_STATUS_SIZE 1
+#define CNL_TX_ACK_SEQ_OFF 2
+#define CNL_TX_ACK_SEQ_SIZE 2
+#define CNL_TX_ACK_CAN_ID_OFF 4
+#define CNL_TX_ACK_CAN_ID_SIZE 4
+#define CNL_HISTORY_REQUEST_OP_OFF 0
+#define CNL_HISTORY_REQUEST_OP_SIZE 1
+#define CNL_HISTORY_REQUEST_SECONDS_OFF 1
+#define CNL_HISTORY_REQUEST_SECONDS_SIZE 2
+#define CNL_HISTORY_MARKER_OP_OFF 0
+#define CNL_HISTORY_MARKER_OP_SIZE 1
+#define CNL_HISTORY_MARKER_STATUS_OFF 1
+#define CNL_HISTORY_MARKER_STATUS_SIZE 1
+#define CNL_HISTORY_MARKER_COUNT_OFF 2
+#define CNL_HISTORY_MARKER_COUNT_SIZE 2
+#define CNL_SESSION_OP_OFF 0
+#define CNL_SESSION_OP_SIZE 1
+#define CNL_SESSION_STATUS_OFF 1
+#define CNL_SESSION_STATUS_SIZE 1
+#define CNL_SESSION_TOKEN_OFF 2
+#define CNL_SESSION_TOKEN_SIZE 6
+#define CNL_PING_OP_OFF 0
+#define CNL_PING_OP_SIZE 1
+#define CNL_PING_SEQ_OFF 2
+#define CNL_PING_SEQ_SIZE 2
+#define CNL_PING_RTT_US_OFF 4
+#define CNL_PING_RTT_US_SIZE 4
+#define CNL_PONG_OP_OFF 0
+#define CNL_PONG_OP_SIZE 1
+#define CNL_PONG_SEQ_OFF 2
+#define CNL_PONG_SEQ_SIZE 2
+#define CNL_PONG_RTT_US_OFF 4
+#define CNL_PONG_RTT_US_SIZE 4
+#define CNL_COMPRESS_OP_OFF 0
+#define CNL_COMPRESS_OP_SIZE 1
+#define CNL_COMPRESS_CODE_OFF 1
+#define CNL_COMPRESS_CODE_SIZE 1
+#define CNL_FILTER_BEGIN_OP_OFF 0
+#define CNL_FILTER_BEGIN_OP_SIZE 1
+#define CNL_FILTER_BEGIN_CODE_OFF 1
+#define CNL_FILTER_BEGIN_CODE_SIZE 1
+#define CNL_FILTER_BEGIN_FLAGS_OFF 2
+#define CNL_FILTER_BEGIN_FLAGS_SIZE 1
+#define CNL_FILTER_TEXT_OP_OFF 0
+#define CNL_FILTER_TEXT_OP_SIZE 1
+#define CNL_FILTER_TEXT_CODE_OFF 1
+#define CNL_FILTER_TEXT_CODE_SIZE 1
+#define CNL_FILTER_TEXT_TEXT_OFF 2
+#define CNL_FILTER_TEXT_TEXT_SIZE 6
+#define CNL_ERR_FRAMES_OP_OFF 0
+#define CNL_ERR_FRAMES_OP_SIZE 1
+#define CNL_ERR_FRAMES_CODE_OFF 1
+#define CNL_ERR_FRAMES_CODE_SIZE 1
+#define CNL_FLOW_OP_OFF 0
+#define CNL_FLOW_OP_SIZE 1
+#define CNL_FLOW_CODE_OFF 1
+#define CNL_FLOW_CODE_SIZE 1
+#define CNL_FLOW_LEVEL_OFF 2
+#define CNL_FLOW_LEVEL_SIZE 1
+#define CNL_FLOW_DEPTH_OFF 4
+#define CNL_FLOW_DEPTH_SIZE 2
+#define CNL_FLOW_CAPACITY_OFF 6
+#define CNL_FLOW_CAPACITY_SIZE 2
+#define CNL_FD_OP_OFF 0
+#define CNL_FD_OP_SIZE 1
+#define CNL_FD_CODE_OFF 1
+#define CNL_FD_CODE_SIZE 1
+#define CNL_IDENT_TEXT_OP_OFF 0
+#define CNL_IDENT_TEXT_OP_SIZE 1
+#define CNL_IDENT_TEXT_CODE_OFF 1
+#define CNL_IDENT_TEXT_CODE_SIZE 1
+#define CNL_IDENT_TEXT_TEXT_OFF 2
+#define CNL_IDENT_TEXT_TEXT_SIZE 6
+#define CNL_RTR_OP_OFF 0
+#define CNL_RTR_OP_SIZE 1
+#define CNL_RTR_CODE_OFF 1
+#define CNL_RTR_CODE_SIZE 1
+
+/* Extensions advertised in the mDNS "features" TXT record */
+#define CNL_FEATURE_TXACK "txack"
+#define CNL_FEATURE_PING "ping"
+#define CNL_FEATURE_HISTORY "history"
+#define CNL_FEATURE_SESSION "session"
+#define CNL_FEATURE_COMPRESS "compress"
+#define CNL_FEATURE_FILTER "filter"
+#define CNL_FEATURE_ERRFRAMES "errframes"
+#define CNL_FEATURE_FLOW "flow"
+#define CNL_FEATURE_FD "fd"
+#define CNL_FEATURE_IDENT "ident"
+#define CNL_FEATURE_RTR "rtr"
+
+#endif /* CAN_SERVER_PROTO_H */
@@ -0,0 +1,372 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+)
+
+// ErrTxBufferFull is returned by AutoConn.Send when the server is
+// unreachable and the outage buffer is full; the frame is not sent.
+var ErrTxBufferFull = errors.New("client: tx buffer full while disconnected")
+
+const (
+	defaultBackoffMin = 100 * time.Millisecond
+	defaultBackoffMax = 10 * time.Second
+	defaultTxBuffer   = 256
+)
+
+// AutoOption configures an AutoConn.
+type AutoOption func(*AutoConn)
+
+// WithBackoff sets the first and the longest delay between reconnect
+// attempts (default 100ms doubling up to 10s).
+func WithBackoff(min, max time.Duration) AutoOption {
+	return func(a *AutoConn) {
+		if min > 0 {
+			a.backoffMin = min
+		}
+		if max >= a.backoffMin {
+			a.backoffMax = max
+		}
+	}
+}
+
+// WithTxBuffer sets how many frames Send queues while the server is
+// unreachable (default 256). 0 makes Send fail at once during outages.
+func WithTxBuffer(n int) AutoOption {
+	return func(a *AutoConn) {
+		if n >= 0 {
+			a.txBuffer = n
+		}
+	}
+}
+
+// WithConnOptions passes opts to every Dial.
+func WithConnOptions(opts ...Option) AutoOption {
+	return func(a *AutoConn) { a.connOpts = append(a.connOpts, opts...) }
+}
+
+// WithOnConnect runs fn on every new connection before buffered frames are
+// flushed and frames are delivered, to re-apply per-connection state the
+// server does not keep. An error drops the connection and backs off.
+func WithOnConnect(fn func(*Conn) error) AutoOption {
+	return func(a *AutoConn) { a.onConnect = fn }
+}
+
+// WithServerFilter pushes the subscriptions' ID lists down to the server
+// (Conn.SetFilter) on every connection and whenever a subscription is added
+// or closed, so frames no subscription wants stay on the server. With
+// changeOnly the server also sends only frames whose payload changed.
+// Subscriptions keep filtering locally, so a server without the "filter"
+// feature still delivers the right frames, only more traffic.
+func WithServerFilter(changeOnly bool) AutoOption {
+	return func(a *AutoConn) {
+		a.filterPush = true
+		a.changeOnly = changeOnly
+	}
+}
+
+// AutoConn is a connection to a can-server that survives outages: it
+// redials with exponential backoff, queues frames sent while disconnected
+// (bounded, see WithTxBuffer) and flushes them in order on reconnect, and
+// keeps its subscriptions across connections. Methods are safe for
+// concurrent use.
+type AutoConn struct {
+	addr       string
+	connOpts   []Option
+	backoffMin time.Duration
+	backoffMax time.Duration
+	txBuffer   int
+	onConnect  func(*Conn) error
+	filterPush bool
+	changeOnly bool
+
+	cancel context.CancelFunc
+	done   chan struct{} // closed when run returns
+
+	mu      sync.Mutex
+	conn    *Conn // nil while disconnected
+	pending []Frame
+	closed  bool
+
+	subMu  sync.RWMutex
+	subs   map[*Subscription]struct{}
+	pushMu sync.Mutex // orders filter pushes
+
+	connects  atomic.Uint64
+	txDropped atomic.Uint64
+}
+
+// DialAuto returns a connection to addr that is kept up until ctx is
+// cancelled or Close is called. It does not wait for the first connection:
+// frames sent before it are buffered like during an outage.
+func DialAuto(ctx context.Context, addr string, opts ...AutoOption) *AutoConn {
+	a := &AutoConn{
+		addr:       addr,
+		backoffMin: defaultBackoffMin,
+		backoffMax: defaultBackoffMax,
+		txBuffer:   defaultTxBuffer,
+		done:       make(chan struct{}),
+		subs:       make(map[*Subscription]struct{}),
+	}
+	for _, o := range opts {
+		o(a)
+	}
+	ctx, a.cancel = context.WithCancel(ctx)
+	go a.run(ctx)
+	return a
+}
+
+func (a *AutoConn) run(ctx context.Context) {
+	defer close(a.done)
+	defer a.shutdown()
+	backoff := a.backoffMin
+	for {
+		c, err := Dial(ctx, a.addr, a.connOpts...)
+		if err == nil && a.onConnect != nil {
+			if err = a.onConnect(c); err != nil {
+				_ = c.Close()
+			}
+		}
+		if err == nil && a.attach(c) {
+			start := time.Now()
+			stop := context.AfterFunc(ctx, func() { _ = c.Close() })
+			// The filter answer arrives behind the bus frames, so it is
+			// pushed while pump drains them.
+			go a.pushFilter(c)
+			a.pump(c)
+			stop()
+			a.detach(c)
+			// Only a connection that held resets the backoff, so a server
+			// dropping clients right after the handshake is not hammered.
+			if time.Since(start) >= a.backoffMax {
+				backoff = a.backoffMin
+			}
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+		backoff = min(2*backoff, a.backoffMax)
+	}
+}
+
+// attach makes c the current connection after flushing the frames queued
+// while disconnected. It reports false if c failed meanwhile.
+func (a *AutoConn) attach(c *Conn) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		_ = c.Close()
+		return false
+	}
+	if len(a.pending) > 0 {
+		if err := c.write(a.pending...); err != nil {
+			_ = c.Close() // a refused flush (e.g. FD frames) leaves c open
+			return false
+		}
+		a.pending = a.pending[:0]
+	}
+	a.conn = c
+	a.connects.Add(1)
+	return true
+}
+
+func (a *AutoConn) detach(c *Conn) {
+	a.mu.Lock()
+	if a.conn == c {
+		a.conn = nil
+	}
+	a.mu.Unlock()
+}
+
+// pump delivers the frames of c to the subscriptions until c ends.
+func (a *AutoConn) pump(c *Conn) {
+	for fr := range c.Frames() {
+		a.subMu.RLock()
+		for s := range a.subs {
+			s.deliver(&fr)
+		}
+		a.subMu.RUnlock()
+	}
+}
+
+// shutdown closes the last connection and every subscription.
+func (a *AutoConn) shutdown() {
+	a.mu.Lock()
+	a.closed = true
+	if a.conn != nil {
+		_ = a.conn.Close()
+		a.conn = nil
+	}
+	a.mu.Unlock()
+	a.subMu.Lock()
+	for s := range a.subs {
+		close(s.ch)
+	}
+	a.subs = nil
+	a.subMu.Unlock()
+}
+
+// Send writes fr to the server, or queues it while the server is
+// unreachable. A frame whose write fails is queued too and sent again on
+// the next connection, so a frame cut off by an outage may arrive twice.
+// It returns ErrTxBufferFull when the queue is full and ErrClosed after
+// Close.
+func (a *AutoConn) Send(fr Frame) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return ErrClosed
+	}
+	if a.conn != nil {
+		if err := a.conn.Send(fr); err == nil {
+			return nil
+		}
+		a.conn = nil
+	}
+	if len(a.pending) >= a.txBuffer {
+		a.txDropped.Add(1)
+		return ErrTxBufferFull
+	}
+	a.pending = append(a.pending, fr)
+	return nil
+}
+
+// Conn returns the current connection, or nil while disconnected. Use it
+// for Ping and RTT; frames should go through the AutoConn.
+func (a *AutoConn) Conn() *Conn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.conn
+}
+
+// AutoStats is a snapshot of the AutoConn counters.
+type AutoStats struct {
+	Connected bool
+	Connects  uint64 // successful connections, the first one included
+	TxQueued  int    // frames waiting for the next connection
+	TxDropped uint64 // frames refused with ErrTxBufferFull
+}
+
+// Stats returns the connection counters.
+func (a *AutoConn) Stats() AutoStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return AutoStats{Connected: a.conn != nil, Connects: a.connects.Load(), TxQueued: len(a.pending), TxDropped: a.txDropped.Load()}
+}
+
+// Close stops reconnecting, closes the connection and every subscription.
+// Frames still queued are discarded.
+func (a *AutoConn) Close() error {
+	a.cancel()
+	<-a.done
+	return nil
+}
+
+// Subscription receives the frames matching its ID list from every
+// connection of an AutoConn.
+type Subscription struct {
+	a       *AutoConn
+	ids     string
+	f       *filter.Filter
+	ch      chan Frame
+	dropped atomic.Uint64
+}
+
+// Subscribe returns a subscription to the received frames whose IDs match
+// ids, a filter list such as "0x100-0x1FF,0x18FF0000/0x1FFF0000" (empty:
+// all frames). buf frames are buffered; frames arriving while it is full
+// are dropped and counted.
+func (a *AutoConn) Subscribe(ids string, buf int) (*Subscription, error) {
+	f, err := filter.New(ids, "")
+	if err != nil {
+		return nil, err
+	}
+	s := &Subscription{a: a, ids: ids, f: f, ch: make(chan Frame, max(buf, 1))}
+	a.subMu.Lock()
+	if a.subs == nil {
+		a.subMu.Unlock()
+		return nil, ErrClosed
+	}
+	a.subs[s] = struct{}{}
+	a.subMu.Unlock()
+	if c := a.Conn(); c != nil {
+		a.pushFilter(c)
+	}
+	return s, nil
+}
+
+// serverFilter returns the ID list covering every subscription, "" when
+// one of them takes all frames.
+func (a *AutoConn) serverFilter() string {
+	a.subMu.RLock()
+	defer a.subMu.RUnlock()
+	lists := make([]string, 0, len(a.subs))
+	for s := range a.subs {
+		if s.f == nil {
+			return ""
+		}
+		lists = append(lists, s.ids)
+	}
+	sort.Strings(lists)
+	return strings.Join(lists, ",")
+}
+
+// pushFilter sends the subscription filter to c (WithServerFilter). When the
+// server refuses it, e.g. for a list over cnl.MaxFilterText, the filter is
+// cleared so no subscription misses frames; errors only cost traffic.
+func (a *AutoConn) pushFilter(c *Conn) {
+	if !a.filterPush {
+		return
+	}
+	a.pushMu.Lock()
+	defer a.pushMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), c.handshakeTimeout)
+	defer cancel()
+	if err := c.SetFilter(ctx, a.serverFilter(), a.changeOnly); err != nil && ctx.Err() == nil {
+		_ = c.SetFilter(ctx, "", a.changeOnly)
+	}
+}
+
+func (s *Subscription) deliver(fr *Frame) {
+	if !s.f.Allow(fr) {
+		return
+	}
+	select {
+	case s.ch <- *fr:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Frames returns the subscribed frames. The channel is closed by Close or
+// when the AutoConn is closed.
+func (s *Subscription) Frames() <-chan Frame { return s.ch }
+
+// Dropped returns how many frames did not fit the subscription buffer.
+func (s *Subscription) Dropped() uint64 { return s.dropped.Load() }
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.a.subMu.Lock()
+	_, ok := s.a.subs[s]
+	if ok {
+		delete(s.a.subs, s)
+		close(s.ch)
+	}
+	s.a.subMu.Unlock()
+	if c := s.a.Conn(); ok && c != nil {
+		s.a.pushFilter(c)
+	}
+}
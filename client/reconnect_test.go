@@ -0,0 +1,217 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAutoConnReconnects(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h := hub.New()
+	srv := server.NewServer(
+		server.WithHub(h),
+		server.WithCodec(&cnl.Codec{}),
+		server.WithSend(func(fr can.Frame) error { h.Broadcast(fr); return nil }),
+		server.WithListenAddr("127.0.0.1:0"),
+	)
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+	addr := srv.Addr()
+
+	connects := 0
+	a := DialAuto(ctx, addr, WithBackoff(10*time.Millisecond, 50*time.Millisecond), WithTxBuffer(2),
+		WithOnConnect(func(*Conn) error { connects++; return nil }))
+	defer a.Close()
+	sub, err := a.Subscribe("0x100-0x1FF", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := func(want uint32) {
+		t.Helper()
+		select {
+		case fr := <-sub.Frames():
+			if fr.CANID != want {
+				t.Fatalf("got %#x want %#x", fr.CANID, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("frame %#x not received", want)
+		}
+	}
+	waitFor(t, "connect", func() bool { return a.Stats().Connected })
+	_ = a.Send(Frame{CANID: 0x321, Len: 1}) // echoed, outside the subscription
+	_ = a.Send(Frame{CANID: 0x123, Len: 1})
+	recv(0x123)
+
+	// Outage: frames are queued up to the buffer size.
+	_ = srv.Shutdown(ctx)
+	waitFor(t, "disconnect", func() bool { return !a.Stats().Connected })
+	for _, id := range []uint32{0x124, 0x125} {
+		if err := a.Send(Frame{CANID: id, Len: 1}); err != nil {
+			t.Fatalf("send %#x while down: %v", id, err)
+		}
+	}
+	if err := a.Send(Frame{CANID: 0x126, Len: 1}); err != ErrTxBufferFull {
+		t.Fatalf("send over buffer: %v", err)
+	}
+
+	// The server comes back on the same address: the queue is flushed in
+	// order and the subscription keeps receiving.
+	srv.SetListenAddr(addr)
+	go func() { _ = srv.Serve(ctx) }()
+	recv(0x124)
+	recv(0x125)
+	st := a.Stats()
+	if st.Connects != 2 || connects != 2 || st.TxQueued != 0 || st.TxDropped != 1 {
+		t.Fatalf("stats = %+v, onConnect ran %d times", st, connects)
+	}
+
+	_ = a.Close()
+	if _, ok := <-sub.Frames(); ok {
+		t.Fatal("subscription open after Close")
+	}
+	if err := a.Send(Frame{CANID: 0x123}); err != ErrClosed {
+		t.Fatalf("send after close: %v", err)
+	}
+}
+
+func TestAutoConnAttachClosesOnFlushError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h := hub.New()
+	srv := server.NewServer(server.WithHub(h), server.WithCodec(&cnl.Codec{}), server.WithListenAddr("127.0.0.1:0"))
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+	c, err := Dial(ctx, srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An FD frame queued during an outage cannot go out on a connection
+	// without FD.
+	a := &AutoConn{pending: []Frame{{CANID: 0x100, Len: 12, Flags: can.CANFD_FDF}}}
+	if a.attach(c) {
+		t.Fatal("attached despite the failed flush")
+	}
+	if c.Err() == nil {
+		t.Fatal("connection left open after the failed flush")
+	}
+}
+
+func TestServerFilter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h := hub.New()
+	srv := server.NewServer(
+		server.WithHub(h),
+		server.WithCodec(&cnl.Codec{}),
+		server.WithSend(func(fr can.Frame) error { return nil }),
+		server.WithListenAddr("127.0.0.1:0"),
+	)
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+
+	c, err := Dial(ctx, srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.SetFilter(ctx, "0x100-", false); err == nil {
+		t.Fatal("invalid list accepted")
+	}
+	if err := c.SetFilter(ctx, "0x100-0x1FF", true); err != nil {
+		t.Fatal(err)
+	}
+	before := metrics.Snap().ClientFiltered
+	for _, fr := range []Frame{
+		{CANID: 0x050, Len: 1, Data: [64]byte{1}}, // outside the list
+		{CANID: 0x100, Len: 1, Data: [64]byte{1}},
+		{CANID: 0x100, Len: 1, Data: [64]byte{1}}, // unchanged
+		{CANID: 0x100, Len: 1, Data: [64]byte{2}},
+	} {
+		h.Broadcast(fr)
+	}
+	for _, want := range []byte{1, 2} {
+		select {
+		case fr := <-c.Frames():
+			if fr.CANID != 0x100 || fr.Data[0] != want {
+				t.Fatalf("got %v, want 0x100 with %d", fr, want)
+			}
+		case <-ctx.Done():
+			t.Fatal("filtered frame not received")
+		}
+	}
+	if n := metrics.Snap().ClientFiltered - before; n != 2 {
+		t.Fatalf("server withheld %d frames, want 2", n)
+	}
+
+	// An AutoConn pushes the union of its subscriptions.
+	a := DialAuto(ctx, srv.Addr(), WithServerFilter(false))
+	defer a.Close()
+	waitFor(t, "connect", func() bool { return a.Stats().Connected })
+	sub, err := a.Subscribe("0x200", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before = metrics.Snap().ClientFiltered
+	h.Broadcast(Frame{CANID: 0x300, Len: 1})
+	h.Broadcast(Frame{CANID: 0x200, Len: 1})
+	select {
+	case fr := <-sub.Frames():
+		if fr.CANID != 0x200 {
+			t.Fatalf("got %v", fr)
+		}
+	case <-ctx.Done():
+		t.Fatal("subscribed frame not received")
+	}
+	// 0x300 is withheld from both connections, 0x200 from the first.
+	if n := metrics.Snap().ClientFiltered - before; n != 3 {
+		t.Fatalf("server withheld %d frames, want 3", n)
+	}
+}
+
+func TestServerFilterOnBusyBus(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h := hub.New()
+	srv := server.NewServer(server.WithHub(h), server.WithCodec(&cnl.Codec{}), server.WithListenAddr("127.0.0.1:0"))
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+	// The bus fills the receive buffer before the filter answer arrives.
+	go func() {
+		for ctx.Err() == nil {
+			h.Broadcast(Frame{CANID: 0x300, Len: 1})
+			time.Sleep(50 * time.Microsecond)
+		}
+	}()
+	a := DialAuto(ctx, srv.Addr(), WithServerFilter(false), WithConnOptions(WithRecvBuffer(1), WithHandshakeTimeout(time.Minute)))
+	defer a.Close()
+	sub, err := a.Subscribe("0x200", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "connect", func() bool { return a.Stats().Connected })
+	h.Broadcast(Frame{CANID: 0x200, Len: 1})
+	select {
+	case <-sub.Frames():
+	case <-ctx.Done():
+		t.Fatal("subscribed frame not received")
+	}
+}
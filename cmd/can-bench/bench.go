@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/logging"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+// benchCANID tags frames produced by the harness so receivers can ignore
+// unrelated bus traffic when running against a live (v)can interface.
+const benchCANID = 0x0BE5C000 | can.CAN_EFF_FLAG
+
+const (
+	handshakeTimeout = 3 * time.Second
+	maxSamples       = 2_000_000 // bound on stored latency samples
+	pacingTick       = time.Millisecond
+)
+
+type benchConfig struct {
+	addr      string
+	clients   int
+	rate      int
+	duration  time.Duration
+	drain     time.Duration
+	hubBuffer int
+	hubPolicy string
+}
+
+// startLoopbackServer runs an in-process gateway whose backend echoes every
+// transmitted frame back through the hub. Returns the bound address.
+func startLoopbackServer(ctx context.Context, cfg benchConfig) (string, error) {
+	policy, err := hub.ParsePolicy(cfg.hubPolicy)
+	if err != nil {
+		return "", err
+	}
+	h, err := hub.NewWithOptions(hub.WithOutBufSize(cfg.hubBuffer), hub.WithPolicy(policy))
+	if err != nil {
+		return "", err
+	}
+	srv := server.NewServer(
+		server.WithHub(h),
+		server.WithCodec(&cnl.Codec{}),
+		server.WithSend(func(fr can.Frame) error { h.Broadcast(fr); return nil }),
+		server.WithListenAddr("127.0.0.1:0"),
+		server.WithLogger(logging.L()),
+	)
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Serve(ctx) }()
+	select {
+	case <-srv.Ready():
+		return srv.Addr(), nil
+	case err := <-errCh:
+		return "", err
+	case <-time.After(time.Second):
+		return "", errors.New("loopback server not ready")
+	}
+}
+
+func dial(ctx context.Context, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: handshakeTimeout}
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", addr, err)
+	}
+	if err := cnl.Handshake(ctx, c, handshakeTimeout); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// receive decodes frames from c until it is closed, recording latency for
+// frames stamped by the sender.
+func receive(c net.Conn, rec *latencyRecorder) {
+	codec := &cnl.Codec{}
+	r := bufio.NewReader(c)
+	for {
+		fr, err := codec.Decode(r)
+		if err != nil {
+			return
+		}
+		if fr.CANID != benchCANID || fr.Len != 8 {
+			continue
+		}
+		sentAt := int64(binary.BigEndian.Uint64(fr.Data[:8]))
+		rec.Observe(time.Duration(time.Now().UnixNano() - sentAt))
+	}
+}
+
+// send writes stamped frames to c at cfg.rate until the duration elapses.
+func send(ctx context.Context, c net.Conn, cfg benchConfig, sent, errs *atomic.Uint64) {
+	codec := &cnl.Codec{}
+	w := bufio.NewWriter(c)
+	t := time.NewTicker(pacingTick)
+	defer t.Stop()
+	start := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			elapsed := now.Sub(start)
+			if elapsed >= cfg.duration {
+				return
+			}
+			due := uint64(elapsed.Seconds() * float64(cfg.rate))
+			for sent.Load() < due {
+				fr := can.Frame{CANID: benchCANID, Len: 8}
+				binary.BigEndian.PutUint64(fr.Data[:8], uint64(time.Now().UnixNano()))
+				if _, err := codec.EncodeTo(w, []can.Frame{fr}); err != nil {
+					errs.Add(1)
+					return
+				}
+				sent.Add(1)
+			}
+			if err := w.Flush(); err != nil {
+				errs.Add(1)
+				return
+			}
+		}
+	}
+}
+
+// runBench connects the sender and receivers, drives traffic and returns the summary.
+func runBench(ctx context.Context, cfg benchConfig) (summary, error) {
+	addr := cfg.addr
+	if addr == "" {
+		a, err := startLoopbackServer(ctx, cfg)
+		if err != nil {
+			return summary{}, err
+		}
+		addr = a
+	}
+	expect := cfg.rate * int(cfg.duration/time.Second+1) * cfg.clients
+	rec := newLatencyRecorder(expect, maxSamples)
+	conns := make([]net.Conn, 0, cfg.clients)
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.clients; i++ {
+		c, err := dial(ctx, addr)
+		if err != nil {
+			return summary{}, err
+		}
+		conns = append(conns, c)
+		wg.Add(1)
+		go func() { defer wg.Done(); receive(c, rec) }()
+	}
+	// The sender has its own connection; frames echoed back to it are discarded.
+	tx, err := dial(ctx, addr)
+	if err != nil {
+		return summary{}, err
+	}
+	defer tx.Close()
+	go func() { _, _ = io.Copy(io.Discard, tx) }()
+	// Give the server a moment to register all clients with the hub.
+	time.Sleep(50 * time.Millisecond)
+
+	var sent, sendErrs atomic.Uint64
+	send(ctx, tx, cfg, &sent, &sendErrs)
+	time.Sleep(cfg.drain)
+	for _, c := range conns {
+		_ = c.Close()
+	}
+	wg.Wait()
+	s := rec.Summarize(sent.Load(), cfg.clients)
+	s.Rate = cfg.rate
+	s.Duration = cfg.duration
+	s.SendErrors = sendErrs.Load()
+	return s, nil
+}
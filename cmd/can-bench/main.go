@@ -0,0 +1,74 @@
+// Command can-bench measures end-to-end latency and drop rate through the
+// gateway. It connects N receiving clients plus one sender, drives stamped
+// frames at a target rate and reports p50/p99 latency, so performance changes
+// to the hub and writer paths can be compared release over release.
+//
+// Without -addr an in-process gateway with a loopback backend is started.
+// With -addr the target must echo transmitted frames back to clients, e.g.
+// can-server -backend loopback, or a vcan setup with a reflecting peer.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/logging"
+)
+
+func main() {
+	var cfg benchConfig
+	flag.StringVar(&cfg.addr, "addr", "", "Target gateway address (empty starts an in-process loopback gateway)")
+	flag.IntVar(&cfg.clients, "clients", 4, "Number of receiving clients")
+	flag.IntVar(&cfg.rate, "rate", 1000, "Target send rate (frames/s)")
+	flag.DurationVar(&cfg.duration, "duration", 5*time.Second, "Send duration")
+	flag.DurationVar(&cfg.drain, "drain", 250*time.Millisecond, "Time to wait for in-flight frames after sending stops")
+	flag.IntVar(&cfg.hubBuffer, "hub-buffer", 512, "Per-client hub buffer for the in-process gateway")
+	flag.StringVar(&cfg.hubPolicy, "hub-policy", "drop", "Backpressure policy for the in-process gateway: drop|kick|drop-oldest|coalesce")
+	jsonOut := flag.Bool("json", false, "Emit the summary as JSON")
+	maxP99 := flag.Duration("max-p99", 0, "Fail (exit 1) if p99 latency exceeds this value (0 disables)")
+	maxDrop := flag.Float64("max-drop", -1, "Fail (exit 1) if drop rate (0..1) exceeds this value (<0 disables)")
+	flag.Parse()
+
+	if cfg.clients <= 0 || cfg.rate <= 0 || cfg.duration <= 0 {
+		fmt.Fprintln(os.Stderr, "clients, rate and duration must be > 0")
+		os.Exit(2)
+	}
+	// Keep the in-process gateway quiet so the report stays readable.
+	logging.Set(logging.New("text", slog.LevelWarn, os.Stderr))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s, err := runBench(ctx, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bench error: %v\n", err)
+		os.Exit(2)
+	}
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(s)
+	} else {
+		fmt.Printf("clients=%d rate=%d/s duration=%s\n", s.Clients, s.Rate, s.Duration)
+		fmt.Printf("sent=%d expected=%d received=%d drop_rate=%.4f send_errors=%d\n", s.Sent, s.Expected, s.Received, s.DropRate, s.SendErrors)
+		fmt.Printf("latency p50=%s p99=%s max=%s\n", s.P50, s.P99, s.Max)
+	}
+	failed := false
+	if *maxP99 > 0 && s.P99 > *maxP99 {
+		fmt.Fprintf(os.Stderr, "regression: p99 %s > %s\n", s.P99, *maxP99)
+		failed = true
+	}
+	if *maxDrop >= 0 && s.DropRate > *maxDrop {
+		fmt.Fprintf(os.Stderr, "regression: drop rate %.4f > %.4f\n", s.DropRate, *maxDrop)
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
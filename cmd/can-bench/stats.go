@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyRecorder collects end-to-end latency samples from many receivers.
+// Samples beyond maxSamples are counted but not stored to bound memory on
+// long runs.
+type latencyRecorder struct {
+	mu         sync.Mutex
+	samples    []time.Duration
+	maxSamples int
+	received   uint64
+}
+
+func newLatencyRecorder(capHint, maxSamples int) *latencyRecorder {
+	if capHint > maxSamples {
+		capHint = maxSamples
+	}
+	return &latencyRecorder{samples: make([]time.Duration, 0, capHint), maxSamples: maxSamples}
+}
+
+// Observe records a single latency sample.
+func (r *latencyRecorder) Observe(d time.Duration) {
+	r.mu.Lock()
+	r.received++
+	if len(r.samples) < r.maxSamples {
+		r.samples = append(r.samples, d)
+	}
+	r.mu.Unlock()
+}
+
+// summary is the aggregated result of a benchmark run.
+type summary struct {
+	Clients    int           `json:"clients"`
+	Rate       int           `json:"rate"`
+	Duration   time.Duration `json:"duration_ns"`
+	Sent       uint64        `json:"sent"`
+	Expected   uint64        `json:"expected"`
+	Received   uint64        `json:"received"`
+	DropRate   float64       `json:"drop_rate"`
+	P50        time.Duration `json:"p50_ns"`
+	P99        time.Duration `json:"p99_ns"`
+	Max        time.Duration `json:"max_ns"`
+	SendErrors uint64        `json:"send_errors"`
+}
+
+// Summarize computes percentiles and drop rate given the number of frames sent
+// and receivers expected to observe each one.
+func (r *latencyRecorder) Summarize(sent uint64, clients int) summary {
+	r.mu.Lock()
+	samples := append([]time.Duration(nil), r.samples...)
+	received := r.received
+	r.mu.Unlock()
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	s := summary{
+		Clients:  clients,
+		Sent:     sent,
+		Expected: sent * uint64(clients),
+		Received: received,
+		P50:      percentile(samples, 0.50),
+		P99:      percentile(samples, 0.99),
+	}
+	if len(samples) > 0 {
+		s.Max = samples[len(samples)-1]
+	}
+	if s.Expected > 0 && received < s.Expected {
+		s.DropRate = float64(s.Expected-received) / float64(s.Expected)
+	}
+	return s
+}
+
+// percentile returns the q-th percentile (0..1) of sorted samples using the
+// nearest-rank method. Returns 0 for an empty slice.
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(q*float64(len(sorted))+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	var s []time.Duration
+	for i := 1; i <= 100; i++ {
+		s = append(s, time.Duration(i)*time.Millisecond)
+	}
+	if got := percentile(s, 0.50); got != 50*time.Millisecond {
+		t.Fatalf("p50 got %v", got)
+	}
+	if got := percentile(s, 0.99); got != 99*time.Millisecond {
+		t.Fatalf("p99 got %v", got)
+	}
+	if got := percentile(nil, 0.99); got != 0 {
+		t.Fatalf("empty percentile got %v", got)
+	}
+}
+
+func TestSummarizeDropRate(t *testing.T) {
+	r := newLatencyRecorder(4, 4)
+	for i := 0; i < 6; i++ { // more than maxSamples: counted, not stored
+		r.Observe(time.Millisecond)
+	}
+	s := r.Summarize(4, 2) // expected 8
+	if s.Received != 6 || s.Expected != 8 {
+		t.Fatalf("unexpected counts %+v", s)
+	}
+	if s.DropRate != 0.25 {
+		t.Fatalf("drop rate got %v want 0.25", s.DropRate)
+	}
+}
+
+// TestRunBenchLoopback drives a short run through the in-process gateway.
+func TestRunBenchLoopback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := runBench(ctx, benchConfig{clients: 2, rate: 500, duration: 200 * time.Millisecond, drain: 100 * time.Millisecond, hubBuffer: 512, hubPolicy: "drop"})
+	if err != nil {
+		t.Fatalf("runBench: %v", err)
+	}
+	if s.Sent == 0 || s.Received == 0 {
+		t.Fatalf("expected traffic, got %+v", s)
+	}
+	if s.P50 <= 0 || s.P99 < s.P50 {
+		t.Fatalf("unexpected latency summary %+v", s)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/kstaniek/go-ampio-server/internal/access"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/secret"
+)
+
+// loadAuthToken resolves the admin API token from -auth-token or -token-file.
+// Returns an unset Value when neither is configured (admin API open).
+func loadAuthToken(cfg *appConfig) (*secret.Value, error) {
+	switch {
+	case cfg.tokenFile != "":
+		v, err := secret.FromFile(cfg.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("token-file: %w", err)
+		}
+		return v, nil
+	case cfg.authToken != "":
+		return secret.Literal(cfg.authToken), nil
+	default:
+		return &secret.Value{}, nil
+	}
+}
+
+// loadAccess builds the API identity table: the admin token tok plus the
+// identities of -access-file. With neither the admin API is open.
+func loadAccess(cfg *appConfig, tok *secret.Value) (*access.Table, error) {
+	t := access.NewTable(tok)
+	if cfg.accessFile != "" {
+		if err := t.LoadFile(cfg.accessFile); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// clientAccess returns the role rules of TCP clients (-client-role and
+// -client-roles).
+func (c *appConfig) clientAccess() (*access.Nets, error) {
+	def := access.Write
+	if c.clientRole != "" {
+		r, err := access.ParseRole(c.clientRole)
+		if err != nil {
+			return nil, fmt.Errorf("client-role: %w", err)
+		}
+		def = r
+	}
+	n, err := access.ParseNets(c.clientRoles, def)
+	if err != nil {
+		return nil, fmt.Errorf("client-roles: %w", err)
+	}
+	return n, nil
+}
+
+// serverTLS builds the TLS settings of the client listener from -tls-cert,
+// -tls-key and -tls-client-ca (nil when TLS is off). With a client CA,
+// clients must present a certificate it signed.
+func (c *appConfig) serverTLS() (*tls.Config, error) {
+	if c.tlsCert == "" && c.tlsKey == "" {
+		if c.tlsClientCA != "" {
+			return nil, fmt.Errorf("tls-client-ca requires tls-cert and tls-key")
+		}
+		return nil, nil
+	}
+	if c.tlsCert == "" || c.tlsKey == "" {
+		return nil, fmt.Errorf("tls-cert and tls-key must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(c.tlsCert, c.tlsKey)
+	if err != nil {
+		return nil, fmt.Errorf("tls-cert: %w", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.tlsClientCA != "" {
+		pem, err := os.ReadFile(c.tlsClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("tls-client-ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls-client-ca: no certificates in %s", c.tlsClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// registerAdmin mounts an admin API endpoint on the metrics HTTP server,
+// reachable by identities whose role grants p.
+func registerAdmin(acl *access.Table, p access.Perm, pattern string, h http.Handler) {
+	metrics.Handle(pattern, acl.Require(p, h))
+}
+
+// registerAdminRW is registerAdmin for endpoints that read with GET and
+// change state with the other methods.
+func registerAdminRW(acl *access.Table, read, write access.Perm, pattern string, h http.Handler) {
+	metrics.Handle(pattern, acl.RequireMethod(read, write, h))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/access"
+	"github.com/kstaniek/go-ampio-server/internal/secret"
+)
+
+func TestRequireToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	h := access.NewTable(secret.Literal("abc")).Require(access.View, ok)
+	for _, tc := range []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer nope", http.StatusUnauthorized},
+		{"Bearer abc", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/events", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Fatalf("auth %q: got %d want %d", tc.auth, rec.Code, tc.want)
+		}
+	}
+	// Unset token leaves the endpoint open.
+	rec := httptest.NewRecorder()
+	access.NewTable(&secret.Value{}).Require(access.Manage, ok).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("open endpoint got %d", rec.Code)
+	}
+}
+
+func TestClientAccess(t *testing.T) {
+	c := &appConfig{clientRole: "read", clientRoles: "10.0.0.0/8=write"}
+	n, err := c.clientAccess()
+	if err != nil {
+		t.Fatalf("clientAccess: %v", err)
+	}
+	if id := n.Identify(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}); id.Role != access.Write {
+		t.Fatalf("10.1.2.3: %+v", id)
+	}
+	if id := n.Identify(&net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 1}); id.Role != access.Read {
+		t.Fatalf("192.168.1.2: %+v", id)
+	}
+	for _, bad := range []*appConfig{{clientRole: "root"}, {clientRoles: "10.0.0.0/8"}, {clientRoles: "x=read"}} {
+		if _, err := bad.clientAccess(); err == nil {
+			t.Fatalf("%+v: want error", bad)
+		}
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	if tc, err := (&appConfig{}).serverTLS(); tc != nil || err != nil {
+		t.Fatalf("no TLS: %v, %v", tc, err)
+	}
+	dir := t.TempDir()
+	for _, bad := range []*appConfig{
+		{tlsClientCA: "ca.pem"},
+		{tlsCert: "cert.pem"},
+		{tlsCert: filepath.Join(dir, "cert.pem"), tlsKey: filepath.Join(dir, "key.pem")},
+	} {
+		if _, err := bad.serverTLS(); err == nil {
+			t.Fatalf("%+v: want error", bad)
+		}
+	}
+}
+
+func TestApplyEnvOverrides_FileVariants(t *testing.T) {
+	dir := t.TempDir()
+	listenFile := filepath.Join(dir, "listen")
+	_ = os.WriteFile(listenFile, []byte(":21000\n"), 0o600)
+	t.Setenv("CAN_SERVER_LISTEN_FILE", listenFile)
+	t.Setenv("CAN_SERVER_AUTH_TOKEN_FILE", filepath.Join(dir, "token"))
+	c := &appConfig{listenAddr: ":20000"}
+	if err := applyEnvOverrides(c, map[string]struct{}{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.listenAddr != ":21000" {
+		t.Fatalf("listen from file got %q", c.listenAddr)
+	}
+	if c.tokenFile == "" || c.authToken != "" {
+		t.Fatalf("token file should stay file-backed, got file=%q tok=%q", c.tokenFile, c.authToken)
+	}
+	t.Setenv("CAN_SERVER_BAUD_FILE", filepath.Join(dir, "missing"))
+	if err := applyEnvOverrides(&appConfig{}, map[string]struct{}{}); err == nil {
+		t.Fatalf("expected error for unreadable _FILE")
+	}
+}
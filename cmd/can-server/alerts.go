@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/alert"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// alertWebhookTimeout bounds one webhook delivery.
+const alertWebhookTimeout = 5 * time.Second
+
+// alertRules loads the -alerts rule file (nil when none is configured).
+func (c *appConfig) alertRules() ([]*alert.Rule, error) {
+	if c.alerts == "" {
+		return nil, nil
+	}
+	rules, err := alert.Load(c.alerts)
+	if err != nil {
+		return nil, fmt.Errorf("alerts: %w", err)
+	}
+	return rules, nil
+}
+
+func (c *appConfig) validateAlerts() error {
+	if _, err := c.alertRules(); err != nil {
+		return err
+	}
+	if c.alertCooldown < 0 {
+		return fmt.Errorf("alert-cooldown must be >= 0")
+	}
+	if c.alertWebhook != "" {
+		u, err := url.Parse(c.alertWebhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("alert-webhook: want an http(s) URL (got %q)", c.alertWebhook)
+		}
+	}
+	return nil
+}
+
+// startAlerts evaluates the -alerts rules against the frames of every
+// instance. Fired alerts are logged as alert_fired warnings (so they reach
+// /api/events) and posted to -alert-webhook when set.
+func startAlerts(ctx context.Context, cfg *appConfig, insts []*instance, l *slog.Logger, wg *sync.WaitGroup) error {
+	rules, err := cfg.alertRules()
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+	var hook *alert.Webhook
+	if cfg.alertWebhook != "" {
+		hook = alert.NewWebhook(cfg.alertWebhook, alertWebhookTimeout, l)
+		wg.Add(1)
+		go func() { defer wg.Done(); hook.Run(ctx) }()
+	}
+	dec, _ := cfg.ampioDecoder() // validated with the config
+	eng := alert.NewEngine(rules, cfg.alertCooldown, dec, func(ev alert.Event) {
+		metrics.IncAlert(ev.Rule)
+		args := []any{"rule", ev.Rule, "frame", ev.Frame, "value", ev.Value, "reason", ev.Reason}
+		if ev.Instance != "" {
+			args = append(args, "instance", ev.Instance)
+		}
+		if ev.Note != "" {
+			args = append(args, "note", ev.Note)
+		}
+		l.Warn("alert_fired", args...)
+		if hook != nil {
+			hook.Send(ev)
+		}
+	})
+	var note func(*can.Frame) string
+	if cfg.notes != nil {
+		note = cfg.notes.Annotate
+	}
+	for _, in := range insts {
+		name := in.name
+		watchHub(ctx, in.hub, wg, func(fr *can.Frame) { eng.Observe(name, fr, note) })
+	}
+	l.Info("alerts_enabled", "rules", len(rules), "cooldown", cfg.alertCooldown, "webhook", hook != nil)
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/ampio"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// ampioEvent is the JSON payload of a decoded Ampio broadcast on MQTT.
+type ampioEvent struct {
+	ampio.Event
+	Instance string    `json:"instance,omitempty"`
+	Time     time.Time `json:"ts"`
+}
+
+// ampioOutputs parses -ampio-events: where decoded broadcasts go.
+func (c *appConfig) ampioOutputs() (log, publish bool, err error) {
+	if c.ampioEvents == "" {
+		return false, false, nil
+	}
+	for _, o := range strings.Split(c.ampioEvents, ",") {
+		switch strings.TrimSpace(o) {
+		case "log":
+			log = true
+		case "mqtt":
+			publish = true
+		default:
+			return false, false, fmt.Errorf("ampio-events: unknown output %q (want log, mqtt or both)", o)
+		}
+	}
+	return log, publish, nil
+}
+
+// ampioDecoder builds the broadcast decoder for -ampio-prefix.
+func (c *appConfig) ampioDecoder() (ampio.Decoder, error) {
+	if c.ampioPrefix == "" {
+		return ampio.Decoder{Prefix: ampio.DefaultPrefix}, nil
+	}
+	v, err := strconv.ParseUint(c.ampioPrefix, 0, 8)
+	if err != nil || v == 0 {
+		return ampio.Decoder{}, fmt.Errorf("ampio-prefix: want a non-zero byte, e.g. 0x1D (got %q)", c.ampioPrefix)
+	}
+	return ampio.Decoder{Prefix: uint8(v)}, nil
+}
+
+func (c *appConfig) validateAmpio() error {
+	_, publish, err := c.ampioOutputs()
+	if err != nil {
+		return err
+	}
+	if _, err := c.ampioDecoder(); err != nil {
+		return err
+	}
+	if !publish {
+		return nil
+	}
+	if c.mqtt == "" {
+		return fmt.Errorf("ampio-events mqtt needs -mqtt")
+	}
+	if c.ampioTopic == "" || strings.ContainsAny(c.ampioTopic, "+#") {
+		return fmt.Errorf("ampio-topic: want a topic without wildcards (got %q)", c.ampioTopic)
+	}
+	for _, p := range mqttPlaceholder.FindAllString(c.ampioTopic, -1) {
+		if p != "{module}" && p != "{kind}" && p != "{instance}" {
+			return fmt.Errorf("ampio-topic: unknown placeholder %s (want {module}, {kind} or {instance})", p)
+		}
+	}
+	return nil
+}
+
+// ampioTopic expands the -ampio-topic template for ev; tmpl has {instance}
+// already replaced.
+func ampioTopic(tmpl string, ev *ampio.Event) string {
+	return strings.NewReplacer("{module}", ev.Module.String(), "{kind}", string(ev.Kind)).Replace(tmpl)
+}
+
+// startAmpioLog logs the decoded Ampio broadcasts of every instance as
+// ampio_state. Modules repeat their broadcasts, so only changes are logged:
+// the first broadcast of each module and kind, then any that differs from
+// the previous one.
+func startAmpioLog(ctx context.Context, cfg *appConfig, insts []*instance, l *slog.Logger, wg *sync.WaitGroup) error {
+	log, _, err := cfg.ampioOutputs()
+	if err != nil || !log {
+		return err
+	}
+	d, err := cfg.ampioDecoder()
+	if err != nil {
+		return err
+	}
+	type key struct {
+		module ampio.Address
+		kind   ampio.Kind
+	}
+	for _, in := range insts {
+		il := l
+		if in.name != "" {
+			il = l.With("instance", in.name)
+		}
+		last := map[key]ampio.Event{}
+		watchHub(ctx, in.hub, wg, func(fr *can.Frame) {
+			ev, ok := d.Decode(fr)
+			if !ok {
+				return
+			}
+			k := key{ev.Module, ev.Kind}
+			if prev, seen := last[k]; seen && prev.Equal(ev) {
+				return
+			}
+			last[k] = ev
+			il.Info("ampio_state", "event", ev)
+		})
+	}
+	l.Info("ampio_log_enabled", "prefix", fmt.Sprintf("0x%02X", d.Prefix))
+	return nil
+}
+
+// startAmpioDevices gives every instance a table of the Ampio modules seen on
+// its bus, listed at /api/devices.
+func startAmpioDevices(ctx context.Context, cfg *appConfig, insts []*instance, l *slog.Logger, wg *sync.WaitGroup) error {
+	if !cfg.ampioDevices {
+		return nil
+	}
+	d, err := cfg.ampioDecoder()
+	if err != nil {
+		return err
+	}
+	for _, in := range insts {
+		tbl := ampio.NewDevices(d)
+		in.devices = tbl
+		watchHub(ctx, in.hub, wg, func(fr *can.Frame) { tbl.Observe(fr, time.Now()) })
+	}
+	l.Info("ampio_devices_enabled", "prefix", fmt.Sprintf("0x%02X", d.Prefix))
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/ampio"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+func TestValidateAmpio(t *testing.T) {
+	ok := appConfig{ampioEvents: "log,mqtt", ampioPrefix: "0x1D", ampioTopic: "ampio/{instance}/{module}/{kind}", mqtt: "tcp://broker.lan"}
+	for _, tc := range []struct {
+		name string
+		mod  func(*appConfig)
+		ok   bool
+	}{
+		{"valid", func(*appConfig) {}, true},
+		{"off", func(c *appConfig) { c.ampioEvents, c.mqtt, c.ampioTopic = "", "", "#" }, true},
+		{"log without mqtt", func(c *appConfig) { c.ampioEvents, c.mqtt = "log", "" }, true},
+		{"mqtt without broker", func(c *appConfig) { c.mqtt = "" }, false},
+		{"unknown output", func(c *appConfig) { c.ampioEvents = "log,syslog" }, false},
+		{"bad prefix", func(c *appConfig) { c.ampioPrefix = "0x100" }, false},
+		{"zero prefix", func(c *appConfig) { c.ampioPrefix = "0" }, false},
+		{"wildcard topic", func(c *appConfig) { c.ampioTopic = "ampio/+/{kind}" }, false},
+		{"unknown placeholder", func(c *appConfig) { c.ampioTopic = "ampio/{id}" }, false},
+	} {
+		c := ok
+		tc.mod(&c)
+		if err := c.validateAmpio(); (err == nil) != tc.ok {
+			t.Fatalf("%s: err=%v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestAmpioTopic(t *testing.T) {
+	ev := ampio.Event{Module: 0x123, Kind: ampio.KindTemperature}
+	if got := ampioTopic("ampio/main/{module}/{kind}", &ev); got != "ampio/main/000123/temperature" {
+		t.Fatalf("topic %q", got)
+	}
+}
+
+// lineWriter hands each log line to a channel.
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestStartAmpioLog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() { cancel(); wg.Wait() }()
+	lines := make(lineWriter, 16)
+	in := &instance{name: "main", hub: hub.New()}
+	cfg := &appConfig{ampioEvents: "log", ampioPrefix: "0x1D"}
+	if err := startAmpioLog(ctx, cfg, []*instance{in}, slog.New(slog.NewTextHandler(lines, nil)), &wg); err != nil {
+		t.Fatal(err)
+	}
+	if l := <-lines; !strings.Contains(l, "msg=ampio_log_enabled prefix=0x1D") {
+		t.Fatalf("log %q", l)
+	}
+	temp := func(lo byte) can.Frame {
+		return can.Frame{CANID: 0x1D000123 | can.CAN_EFF_FLAG, Len: 4, Data: [64]byte{0xFE, 0x05, lo, 0x00}}
+	}
+	// The repeated broadcast is not logged again; the change is.
+	for _, fr := range []can.Frame{temp(0xEB), temp(0xEB), {CANID: 0x123, Len: 1}, temp(0xEC)} {
+		in.hub.Broadcast(fr)
+	}
+	for _, want := range []string{"event.temperatures=[23.5]", "event.temperatures=[23.6]"} {
+		select {
+		case l := <-lines:
+			if !strings.Contains(l, "msg=ampio_state instance=main event.module=000123 event.kind=temperature "+want) {
+				t.Fatalf("log %q, want %s", l, want)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("no log with %s", want)
+		}
+	}
+	select {
+	case l := <-lines:
+		t.Fatalf("unexpected log %q", l)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStartAmpioDevices(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() { cancel(); wg.Wait() }()
+	in := &instance{name: "main", hub: hub.New()}
+	cfg := &appConfig{ampioDevices: true, ampioPrefix: "0x1D"}
+	if err := startAmpioDevices(ctx, cfg, []*instance{in}, slog.New(slog.DiscardHandler), &wg); err != nil {
+		t.Fatal(err)
+	}
+	in.hub.Broadcast(can.Frame{CANID: 0x1D000123 | can.CAN_EFF_FLAG, Len: 3, Data: [64]byte{0xFE, 0x00, 0x0A}})
+	deadline := time.Now().Add(3 * time.Second)
+	for in.devices.Len() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if devs := in.devices.List(); len(devs) != 1 || devs[0].Module != 0x123 || devs[0].DeviceType != 0x0A {
+		t.Fatalf("devices %+v", devs)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/annotate"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+// frameLogBuffer is the hub buffer of in-process frame subscribers (debug
+// frame log, alerts, history store); frames beyond it are dropped like for
+// any slow client.
+const frameLogBuffer = 256
+
+// annotations builds the -annotate pipeline (nil when none is configured).
+func (c *appConfig) annotations() (*annotate.Pipeline, error) {
+	p, err := annotate.New(c.annotate)
+	if err != nil {
+		return nil, fmt.Errorf("annotate: %w", err)
+	}
+	return p, nil
+}
+
+// logAnnotations builds the decoders selected by -annotate-log.
+func (c *appConfig) logAnnotations() (*annotate.Pipeline, error) {
+	p, err := c.annotations()
+	if err != nil {
+		return nil, err
+	}
+	sel, err := p.Select(c.annotateLog)
+	if err != nil {
+		return nil, fmt.Errorf("annotate-log: %w", err)
+	}
+	return sel, nil
+}
+
+// logNotes selects the -annotate-log decoders from the shared pipeline.
+func (c *appConfig) logNotes() *annotate.Pipeline {
+	sel, _ := c.notes.Select(c.annotateLog) // validated with the config
+	return sel
+}
+
+// watchHub subscribes to h and calls fn with every frame until ctx is done
+// or the hub closes the subscription. The subscriber has frameLogBuffer
+// slots; the hub policy applies when fn cannot keep up.
+func watchHub(ctx context.Context, h *hub.Hub, wg *sync.WaitGroup, fn func(*can.Frame)) {
+	cl := &hub.Client{Out: make(chan can.Frame, frameLogBuffer), Closed: make(chan struct{})}
+	h.Add(cl)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer h.Remove(cl)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-cl.Closed:
+				return
+			case fr := <-cl.Out:
+				fn(&fr)
+			}
+		}
+	}()
+}
+
+// startFrameLog logs every bus frame of h with its annotation at debug
+// level. It is only started for -annotate-log, and frames are formatted
+// only while debug logging is enabled.
+func startFrameLog(ctx context.Context, h *hub.Hub, notes *annotate.Pipeline, l *slog.Logger, wg *sync.WaitGroup) {
+	watchHub(ctx, h, wg, func(fr *can.Frame) {
+		if !l.Enabled(ctx, slog.LevelDebug) {
+			return
+		}
+		if note := notes.Annotate(fr); note != "" {
+			l.Debug("frame_rx", "frame", fr.String(), "note", note)
+		} else {
+			l.Debug("frame_rx", "frame", fr.String())
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/arbiter"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/normalize"
+)
+
+func (c *appConfig) validateArbitration() error {
+	if c.arbID == "" {
+		return nil
+	}
+	id, err := arbiter.ParseID(c.arbID)
+	if err != nil {
+		return err
+	}
+	if c.arbPriority < 0 || c.arbPriority > 255 {
+		return fmt.Errorf("arbitration-priority must be 0-255 (got %d)", c.arbPriority)
+	}
+	if c.arbInterval <= 0 {
+		return fmt.Errorf("arbitration-interval must be > 0")
+	}
+	// Heartbeats are matched on the hub, after the backend normalization.
+	n, err := c.normalization()
+	if err != nil {
+		return err
+	}
+	if n.EFF == normalize.EFFForce && id&can.CAN_EFF_FLAG == 0 {
+		return fmt.Errorf("arbitration-id %s: -normalize-eff force marks every bus ID extended, so a standard heartbeat ID never matches; use %08X", c.arbID, id)
+	}
+	rx, tx, err := c.filters()
+	if err != nil {
+		return err
+	}
+	beat := can.Frame{CANID: id}
+	if (rx != nil && !rx.Allow(&beat)) || (tx != nil && !tx.Allow(&beat)) {
+		return fmt.Errorf("arbitration-id %s: the backend RX and TX filters must pass it", c.arbID)
+	}
+	return nil
+}
+
+// initArbitration sets up the active/standby election of -arbitration-id:
+// heartbeats are read from the hub tap, so it runs before the backend
+// starts broadcasting. It returns nil when arbitration is off.
+func (in *instance) initArbitration(l *slog.Logger) *arbiter.Arbiter {
+	if in.cfg.arbID == "" {
+		return nil
+	}
+	id, _ := arbiter.ParseID(in.cfg.arbID) // validated at startup
+	arb := arbiter.New(arbiter.Config{
+		ID:       id,
+		Priority: uint8(in.cfg.arbPriority),
+		Interval: in.cfg.arbInterval,
+		Logger:   l,
+	})
+	prev := in.hub.Tap
+	in.hub.Tap = func(fr can.Frame) {
+		arb.Observe(fr)
+		if prev != nil {
+			prev(fr)
+		}
+	}
+	l.Info("arbitration_enabled", "id", in.cfg.arbID, "priority", in.cfg.arbPriority,
+		"interval", in.cfg.arbInterval, "node", fmt.Sprintf("%08x", arb.Node()))
+	return arb
+}
+
+// runArbitration sends the heartbeats on send, the backend path that is not
+// gated by the election.
+func (in *instance) runArbitration(ctx context.Context, send func(can.Frame) error, wg *sync.WaitGroup) {
+	if in.arbiter == nil {
+		return
+	}
+	wg.Add(1)
+	go func() { defer wg.Done(); in.arbiter.Run(ctx, send) }()
+}
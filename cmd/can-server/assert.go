@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/capture"
+)
+
+// runAssert records the backend traffic of a single-instance config and
+// compares it against the golden candump log cfg.assertGolden: frames must
+// appear in the same order within cfg.assertTolerance of their golden
+// offset. It prints a diff report and returns the process exit code
+// (0 = the recording matches).
+func runAssert(ctx context.Context, w io.Writer, cfg *appConfig, l *slog.Logger) int {
+	golden, err := readCandumpFile(cfg.assertGolden)
+	if err != nil {
+		fmt.Fprintf(w, "FAIL golden: %v\n", err)
+		return 1
+	}
+	insts, err := cfg.instanceConfigs()
+	if err != nil {
+		fmt.Fprintf(w, "FAIL configuration: %v\n", err)
+		return 1
+	}
+	if len(insts) != 1 {
+		fmt.Fprintf(w, "FAIL configuration: assert records one backend (have %d instances)\n", len(insts))
+		return 1
+	}
+	d := cfg.assertFor
+	if d == 0 {
+		d = golden[len(golden)-1].Time.Sub(golden[0].Time) + cfg.assertTolerance
+	}
+	fmt.Fprintf(w, "# assert golden=%s (%d frames) backend=%s duration=%s tolerance=%s\n",
+		cfg.assertGolden, len(golden), backendTarget(insts[0]), d, cfg.assertTolerance)
+	recs, err := compareCapture(ctx, insts[0], d, l)
+	if err != nil {
+		fmt.Fprintf(w, "FAIL backend open: %v\n", err)
+		fmt.Fprintln(w, "# assert FAIL")
+		return 1
+	}
+	if cfg.assertRecord != "" {
+		if err := writeRecording(cfg.assertRecord, insts[0], recs); err != nil {
+			fmt.Fprintf(w, "FAIL record: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(w, "# recorded %d frames to %s\n", len(recs), cfg.assertRecord)
+	}
+	want, got := alignRecords(golden, recs)
+	diff := capture.Compare(want, got, cfg.assertTolerance)
+	if diff.Matched > 0 {
+		fmt.Fprintf(w, "matched %d/%d frames, timing offset min=%s mean=%s max=%s\n",
+			diff.Matched, len(golden), diff.SkewMin, diff.SkewMean, diff.SkewMax)
+	} else {
+		fmt.Fprintf(w, "matched 0/%d frames\n", len(golden))
+	}
+	writeOffsets(w, "MISSING", diff.OnlyA)
+	writeOffsets(w, "UNEXPECTED", diff.OnlyB)
+	if len(diff.OnlyA) > 0 || len(diff.OnlyB) > 0 {
+		fmt.Fprintf(w, "# assert FAIL (%d missing, %d unexpected)\n", len(diff.OnlyA), len(diff.OnlyB))
+		return 1
+	}
+	fmt.Fprintln(w, "# assert PASS")
+	return 0
+}
+
+// readCandumpFile reads a candump log with at least one frame.
+func readCandumpFile(path string) ([]capture.Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	recs, err := capture.ReadCandump(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(recs) == 0 {
+		return nil, fmt.Errorf("%s: no frames", path)
+	}
+	return recs, nil
+}
+
+// writeRecording saves recs as a candump log, e.g. to create or refresh a
+// golden file.
+func writeRecording(path string, cfg *appConfig, recs []capture.Record) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	ifaces := cfg.canIfaces()
+	if kind, _ := splitBackend(cfg.backend); kind != "socketcan" {
+		ifaces = []string{"can0"}
+	}
+	if err := capture.WriteCandumpIfaces(f, ifaces, recs, nil); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// alignRecords rebases both captures to offsets from a common start: the
+// first golden frame and the first recorded frame identical to it (or the
+// first recorded frame when none is). Timing is then compared by offset,
+// since the golden file was captured at another time.
+func alignRecords(golden, recs []capture.Record) (want, got []capture.Record) {
+	if len(recs) == 0 {
+		return rebase(golden, golden[0].Time), nil
+	}
+	start := recs[0].Time
+	for _, rec := range recs {
+		if rec.Frame == golden[0].Frame {
+			start = rec.Time
+			break
+		}
+	}
+	return rebase(golden, golden[0].Time), rebase(recs, start)
+}
+
+// rebase returns recs with times relative to start (as offsets from the
+// zero time).
+func rebase(recs []capture.Record, start time.Time) []capture.Record {
+	out := make([]capture.Record, len(recs))
+	for i, rec := range recs {
+		out[i] = capture.Record{Time: time.Time{}.Add(rec.Time.Sub(start)), Frame: rec.Frame}
+	}
+	return out
+}
+
+// writeOffsets lists frames of one diff side with their offset from the
+// aligned start, oldest first.
+func writeOffsets(w io.Writer, kind string, recs []capture.Record) {
+	for i, rec := range recs {
+		if i == compareMaxListed {
+			fmt.Fprintf(w, "%s ... %d more\n", kind, len(recs)-i)
+			return
+		}
+		fmt.Fprintf(w, "%s %+.6fs %s\n", kind, rec.Time.Sub(time.Time{}).Seconds(), rec.Frame)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/serial"
+)
+
+func TestAssertGolden(t *testing.T) {
+	frame := serTestWireEnvelope([]byte{0, 0, 0x01, 0x23, 0xAA, 0x01})
+	openSerialPort = func(string, int, time.Duration) (serial.Port, error) {
+		return &fakeSerialPort{reads: [][]byte{frame}}, nil
+	}
+	defer func() { openSerialPort = serial.Open }()
+
+	dir := t.TempDir()
+	golden := filepath.Join(dir, "golden.log")
+	rec := filepath.Join(dir, "rec.log")
+	c := baseInstanceConfig()
+	c.backend = "serial"
+	c.assertGolden = golden
+	c.assertFor = 100 * time.Millisecond
+	c.assertTolerance = time.Second
+	c.assertRecord = rec
+
+	for _, tc := range []struct {
+		golden string
+		code   int
+		want   []string
+	}{
+		{"(1600000000.000000) can0 00000123#AA01\n", 0, []string{"matched 1/1 frames", "# recorded 1 frames", "# assert PASS"}},
+		{"(1600000000.000000) can0 00000123#AA01\n(1600000000.050000) can0 124#01\n", 1, []string{"MISSING +0.050000s 124#01", "# assert FAIL (1 missing, 0 unexpected)"}},
+		{"(1600000000.000000) can0 7FF#\n", 1, []string{"matched 0/1", "UNEXPECTED", "# assert FAIL (1 missing, 1 unexpected)"}},
+	} {
+		if err := os.WriteFile(golden, []byte(tc.golden), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if code := runAssert(context.Background(), &out, &c, testLogger()); code != tc.code {
+			t.Fatalf("exit %d, want %d, report:\n%s", code, tc.code, out.String())
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(out.String(), want) {
+				t.Fatalf("report missing %q:\n%s", want, out.String())
+			}
+		}
+	}
+	if b, err := os.ReadFile(rec); err != nil || !strings.HasSuffix(string(b), " can0 00000123#AA01\n") {
+		t.Fatalf("recording = %q, %v", b, err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/audit"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/normalize"
+)
+
+// minCounterAudit is the shortest -counter-audit interval; the checks read
+// every counter of the process.
+const minCounterAudit = time.Second
+
+// validateCounterAudit checks -counter-audit and its tolerance.
+func (c *appConfig) validateCounterAudit() error {
+	if c.counterAudit < 0 {
+		return fmt.Errorf("counter-audit must be >= 0")
+	}
+	if c.counterAudit > 0 && c.counterAudit < minCounterAudit {
+		return fmt.Errorf("counter-audit must be 0 or >= %v", minCounterAudit)
+	}
+	if c.counterAuditTol < 0 {
+		return fmt.Errorf("counter-audit-tolerance must be >= 0")
+	}
+	return nil
+}
+
+// backendTxErrors are the errors_total labels of client frames a backend
+// failed to write or dropped from its TX queue.
+var backendTxErrors = []string{
+	metrics.ErrSerialWrite, metrics.ErrSerialOverflow, metrics.ErrSerialRTR,
+	metrics.ErrSocketCANWrite, metrics.ErrSocketCANOver, metrics.ErrSocketCANNoBuf,
+	metrics.ErrUDPWrite, metrics.ErrUDPOverflow,
+	metrics.ErrSLCANWrite, metrics.ErrSLCANOverflow,
+	metrics.ErrReplayWrite, metrics.ErrReplayOverflow,
+	metrics.ErrUpstreamTx,
+}
+
+// auditChecks relates the process frame counters of the client TX and
+// backend RX paths. Frames of other sources (cyclic TX, the admin API,
+// bridges, emulated responses) only add to the leaving side, which a check
+// tolerates.
+func auditChecks(insts []*instance, vbs []*virtualBus) []audit.Check {
+	return []audit.Check{
+		{
+			Name: "client_tx",
+			In:   func() uint64 { return metrics.Snap().TCPRx },
+			Out: func() uint64 {
+				s := metrics.Snap()
+				n := s.SerialTx + s.SocketCANTx + s.UDPTx + s.ReplayTx + s.UpstreamTx + s.TxDryRun + // written
+					metrics.ErrorsOf(backendTxErrors...) + s.Filtered + s.Invalid + s.Blocked + s.AccessDenied + // rejected
+					s.TxInhibited + s.TxDeduped + s.StandbyDropped + s.PressureDrops + s.Emulated
+				for _, in := range insts {
+					if kind, _ := splitBackend(in.cfg.backend); kind == "loopback" {
+						n += in.hub.Stats().Frames // loopback writes are broadcasts
+					}
+				}
+				for _, vb := range vbs {
+					bs := vb.Stats()
+					n += bs.TxDenied + bs.TxLimited
+				}
+				return n
+			},
+		},
+		{
+			Name: "backend_rx",
+			In: func() uint64 {
+				s := metrics.Snap()
+				return s.SerialRx + s.SocketCANRx + s.UDPRx + s.ReplayRx + s.UpstreamRx
+			},
+			Out: func() uint64 {
+				s := metrics.Snap()
+				n := s.Invalid + metrics.NormalizedOf(normalize.ChangeErr) // rewritten frames still reach the hub
+				for _, in := range insts {
+					hs := in.hub.Stats()
+					n += hs.Frames + hs.Denied
+				}
+				return n
+			},
+		},
+	}
+}
+
+// startCounterAudit runs the counter audit of -counter-audit.
+func startCounterAudit(ctx context.Context, cfg *appConfig, insts []*instance, vbs []*virtualBus, l *slog.Logger, wg *sync.WaitGroup) {
+	if cfg.counterAudit <= 0 {
+		return
+	}
+	a := audit.New(audit.Config{
+		Interval:  cfg.counterAudit,
+		Tolerance: uint64(cfg.counterAuditTol),
+		Checks:    auditChecks(insts, vbs),
+		Logger:    l,
+	})
+	l.Info("counter_audit", "interval", cfg.counterAudit, "tolerance", cfg.counterAuditTol)
+	wg.Add(1)
+	go func() { defer wg.Done(); a.Run(ctx) }()
+}
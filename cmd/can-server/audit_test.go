@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/audit"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/normalize"
+)
+
+func TestAuditChecksLoopback(t *testing.T) {
+	in := &instance{cfg: &appConfig{backend: "loopback"}, hub: hub.New()}
+	a := audit.New(audit.Config{
+		Interval:  time.Second,
+		Tolerance: 2,
+		Checks:    auditChecks([]*instance{in}, nil),
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	// Client frames echoed by the loopback backend are accounted.
+	for range 5 {
+		metrics.IncTCPRx()
+		in.hub.Broadcast(can.Frame{CANID: 0x123, Len: 1})
+	}
+	if d := a.Sample(); d != nil {
+		t.Fatalf("balanced counters reported: %+v", d)
+	}
+	// Client frames that vanish without a counter are not.
+	for range 5 {
+		metrics.IncTCPRx()
+	}
+	d := a.Sample()
+	if len(d) != 1 || d[0].Check != "client_tx" || d[0].Missing != 5 {
+		t.Fatalf("divergence: %+v", d)
+	}
+}
+
+func TestAuditChecksUnrelatedCounters(t *testing.T) {
+	in := &instance{cfg: &appConfig{backend: "serial:/dev/ttyUSB0"}, hub: hub.New()}
+	a := audit.New(audit.Config{
+		Interval: time.Second,
+		Checks:   auditChecks([]*instance{in}, nil),
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	a.Sample()
+	// Bus frames rewritten by the EFF normalization and lost before the hub.
+	for range 3 {
+		metrics.IncSerialRx()
+		metrics.IncNormalized(normalize.ChangeEFF)
+	}
+	// Client frames lost while other subsystems fail.
+	for range 3 {
+		metrics.IncTCPRx()
+		metrics.IncError(metrics.ErrTCPWrite)
+	}
+	d := a.Sample()
+	if len(d) != 2 || d[0].Missing != 3 || d[1].Missing != 3 {
+		t.Fatalf("divergence: %+v", d)
+	}
+	// Counted drops balance both paths.
+	metrics.IncError(metrics.ErrSerialOverflow)
+	metrics.IncNormalized(normalize.ChangeErr)
+	for range 2 {
+		metrics.IncSerialTx()
+		in.hub.Broadcast(can.Frame{CANID: 0x123 | can.CAN_EFF_FLAG})
+	}
+	if d := a.Sample(); d != nil {
+		t.Fatalf("balanced counters reported: %+v", d)
+	}
+}
@@ -4,21 +4,365 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"strings"
 	"sync"
 
+	"github.com/kstaniek/go-ampio-server/internal/annotate"
 	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/dedup"
+	"github.com/kstaniek/go-ampio-server/internal/emulate"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
 	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/normalize"
+	"github.com/kstaniek/go-ampio-server/internal/transform"
+	"github.com/kstaniek/go-ampio-server/internal/transport"
+	"github.com/kstaniek/go-ampio-server/internal/validate"
 )
 
+// backendCannelloniUDP is the backend kind for a remote cannelloni UDP peer,
+// given as cannelloni-udp:<host>:<port>.
+const backendCannelloniUDP = "cannelloni-udp"
+
+// splitBackend separates the backend kind from its optional argument
+// ("cannelloni-udp:host:port" -> "cannelloni-udp", "host:port").
+func splitBackend(b string) (kind, arg string) {
+	kind, arg, _ = strings.Cut(b, ":")
+	return kind, arg
+}
+
+// backendTx is the transmit side of an opened backend.
+type backendTx struct {
+	// send queues a frame without blocking; overflow is reported immediately.
+	send func(can.Frame) error
+	// sendWait blocks until the device write completed. Nil when send
+	// itself is synchronous.
+	sendWait func(context.Context, can.Frame) error
+	// queue reports the depth and capacity of the device TX queue for
+	// flow-control hints. Nil when the backend has no queue.
+	queue func() (depth, capacity int)
+}
+
+// wait transmits fr and reports the device write outcome.
+func (t backendTx) wait(ctx context.Context, fr can.Frame) error {
+	if t.sendWait == nil {
+		return t.send(fr)
+	}
+	return t.sendWait(ctx, fr)
+}
+
+// guard returns a backendTx that runs check before both send paths. check
+// may reject the frame with an error, or return send=false to drop it
+// silently (reported as success). after, if non-nil, runs with the frame
+// after each successful send.
+func (t backendTx) guard(check func(*can.Frame) (send bool, err error), after func(*can.Frame)) backendTx {
+	wrap := func(send func(can.Frame) error) func(can.Frame) error {
+		return func(fr can.Frame) error {
+			if check != nil {
+				if ok, err := check(&fr); !ok {
+					return err
+				}
+			}
+			err := send(fr)
+			if err == nil && after != nil {
+				after(&fr)
+			}
+			return err
+		}
+	}
+	out := backendTx{send: wrap(t.send), queue: t.queue}
+	out.sendWait = func(ctx context.Context, fr can.Frame) error {
+		return wrap(func(fr can.Frame) error { return t.wait(ctx, fr) })(fr)
+	}
+	return out
+}
+
+// filters builds the backend RX and TX filters (nil when unset).
+func (c *appConfig) filters() (rx, tx *filter.Filter, err error) {
+	if rx, err = filter.New(c.rxAllow, c.rxDeny); err != nil {
+		return nil, nil, fmt.Errorf("rx filter: %w", err)
+	}
+	if tx, err = filter.New(c.txAllow, c.txDeny); err != nil {
+		return nil, nil, fmt.Errorf("tx filter: %w", err)
+	}
+	return rx, tx, nil
+}
+
+// transforms builds the backend RX and TX payload transforms (nil when unset).
+func (c *appConfig) transforms() (rx, tx *transform.Set, err error) {
+	if rx, err = transform.Parse(c.rxTransform); err != nil {
+		return nil, nil, fmt.Errorf("rx-transform: %w", err)
+	}
+	if tx, err = transform.Parse(c.txTransform); err != nil {
+		return nil, nil, fmt.Errorf("tx-transform: %w", err)
+	}
+	return rx, tx, nil
+}
+
 // initBackend selects the backend, starts its RX loop and returns a frame sender and cleanup.
 // It returns an error instead of exiting the process to allow graceful handling by the caller.
-func initBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *slog.Logger, wg *sync.WaitGroup) (func(can.Frame) error, func(), error) {
-	switch cfg.backend {
+// Configured RX filters are installed on the hub and TX filters wrap the sender,
+// so they apply regardless of backend or client behavior.
+func initBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *slog.Logger, wg *sync.WaitGroup) (backendTx, func(), error) {
+	rx, tx, err := cfg.filters()
+	if err != nil {
+		return backendTx{}, func() {}, err
+	}
+	if rx != nil {
+		if prev := h.Filter; prev != nil {
+			h.Filter = func(fr *can.Frame) bool { return rx.Allow(fr) && prev(fr) }
+		} else {
+			h.Filter = rx.Allow
+		}
+		l.Info("backend_rx_filter", "filter", rx.String())
+	}
+	rxT, txT, err := cfg.transforms()
+	if err != nil {
+		return backendTx{}, func() {}, err
+	}
+	if rxT != nil {
+		h.Rewrite = func(fr *can.Frame) {
+			if rxT.Apply(fr) {
+				metrics.IncTransformed(metrics.FilterRX)
+			}
+		}
+		l.Info("backend_rx_transform", "rules", rxT.String())
+	}
+	dd, err := cfg.deduper()
+	if err != nil {
+		return backendTx{}, func() {}, err
+	}
+	em, err := cfg.emulator()
+	if err != nil {
+		return backendTx{}, func() {}, err
+	}
+	if err := waitDevice(ctx, cfg, l); err != nil {
+		return backendTx{}, func() {}, err
+	}
+	open := openBackend
+	if cfg.rxWatchdog > 0 {
+		open = watchBackend
+	}
+	btx, cleanup, err := open(ctx, cfg, h, l, wg)
+	if err == nil && cfg.txDryRun {
+		l.Warn("backend_tx_dry_run", "backend", cfg.backend)
+		btx = dryRunTx(l, cfg.logNotes())
+	}
+	if err == nil && em != nil {
+		l.Info("backend_emulate", "file", cfg.emulate, "rules", em.Len())
+		btx = emulateTx(btx, em, h)
+	}
+	if err == nil && txT != nil {
+		l.Info("backend_tx_transform", "rules", txT.String())
+		btx = btx.guard(func(fr *can.Frame) (bool, error) {
+			if txT.Apply(fr) {
+				metrics.IncTransformed(metrics.FilterTX)
+			}
+			return true, nil
+		}, nil)
+	}
+	if err == nil && cfg.txPriorityIDs != "" {
+		l.Info("backend_tx_priority", "ids", cfg.txPriorityIDs, "queue", transport.PriorityQueueSize)
+	}
+	if err != nil {
+		return btx, cleanup, err
+	}
+	if tx != nil {
+		l.Info("backend_tx_filter", "filter", tx.String())
+	}
+	if dd != nil {
+		l.Info("backend_tx_dedup", "window", cfg.txDedupWindow, "ids", cfg.txDedupIDs)
+	}
+	if tx != nil || dd != nil {
+		btx = btx.guard(func(fr *can.Frame) (bool, error) {
+			if !tx.Allow(fr) {
+				metrics.IncFiltered(metrics.FilterTX)
+				return false, filter.ErrDenied
+			}
+			if dd != nil && dd.Suppress(fr) {
+				metrics.IncDedupSuppressed()
+				return false, nil
+			}
+			return true, nil
+		}, func(fr *can.Frame) {
+			if dd != nil {
+				dd.Record(fr)
+			}
+		})
+	}
+	// Outermost stage: frames are normalized, and invalid ones rejected,
+	// before filters, dedup, emulation or the device see them.
+	norm, _ := cfg.normalization() // validated at startup
+	if !norm.Identity() {
+		l.Info("backend_normalize", "config", norm.String())
+	}
+	return btx.guard(func(fr *can.Frame) (bool, error) {
+		norm.Rewrite(fr)
+		err := validate.Frame(validate.TX, fr)
+		return err == nil, err
+	}, nil), cleanup, nil
+}
+
+// dryRunTx replaces the backend transmit path for -tx-dry-run: client frames
+// pass every TX stage (filters, dedup, inhibit, acks, counters) but are only
+// logged, never written to the device. notes adds -annotate-log annotations.
+func dryRunTx(l *slog.Logger, notes *annotate.Pipeline) backendTx {
+	return backendTx{send: func(fr can.Frame) error {
+		metrics.IncTxDryRun()
+		if note := notes.Annotate(&fr); note != "" {
+			l.Info("tx_dry_run", "frame", fr.String(), "note", note)
+		} else {
+			l.Info("tx_dry_run", "frame", fr.String())
+		}
+		return nil
+	}}
+}
+
+// emulateTx answers client queries matching a rule of em as the emulated
+// device would: the responses are broadcast like backend RX frames and the
+// query itself never reaches the device. Other frames pass through.
+func emulateTx(t backendTx, em *emulate.Emulator, h *hub.Hub) backendTx {
+	return t.guard(func(fr *can.Frame) (bool, error) {
+		return !em.Handle(fr, func(resp can.Frame) {
+			metrics.IncEmulated()
+			h.Broadcast(resp)
+		}), nil
+	}, nil)
+}
+
+// emulator loads the -emulate rule file (nil when disabled).
+func (c *appConfig) emulator() (*emulate.Emulator, error) {
+	if c.emulate == "" {
+		return nil, nil
+	}
+	em, err := emulate.Load(c.emulate)
+	if err != nil {
+		return nil, fmt.Errorf("emulate: %w", err)
+	}
+	return em, nil
+}
+
+// deduper builds the TX dedup stage (nil when disabled).
+func (c *appConfig) deduper() (*dedup.Deduper, error) {
+	if c.txDedupWindow <= 0 {
+		return nil, nil
+	}
+	ids, err := filter.New(c.txDedupIDs, "")
+	if err != nil {
+		return nil, fmt.Errorf("tx-dedup-ids: %w", err)
+	}
+	var match func(*can.Frame) bool
+	if ids != nil {
+		match = ids.Allow
+	}
+	return dedup.New(c.txDedupWindow, match), nil
+}
+
+// txOptions configures the backend TX queue; frames matching
+// -tx-priority-ids get a priority queue drained before bulk traffic.
+func (c *appConfig) txOptions() ([]transport.Option, error) {
+	ids, err := filter.New(c.txPriorityIDs, "")
+	if err != nil {
+		return nil, fmt.Errorf("tx-priority-ids: %w", err)
+	}
+	if ids == nil {
+		return nil, nil
+	}
+	return []transport.Option{transport.WithPriority(ids.Allow)}, nil
+}
+
+// normalization is the -normalize-* configuration of the backend. Without
+// -normalize-eff, serial IDs are marked extended (its wire has 29-bit IDs
+// only) and other backends keep what they report.
+func (c *appConfig) normalization() (normalize.Config, error) {
+	var n normalize.Config
+	eff := c.normalizeEFF
+	if eff == "" {
+		eff = normalize.EFFKeep.String()
+		if kind, _ := splitBackend(c.backend); kind == "serial" {
+			eff = normalize.EFFForce.String()
+		}
+	}
+	var err error
+	if n.EFF, err = normalize.ParseEFF(eff); err != nil {
+		return n, fmt.Errorf("normalize-eff: %w", err)
+	}
+	switch c.normalizeFlags {
+	case "", "preserve":
+	case "strip":
+		n.StripFlags = true
+	default:
+		return n, fmt.Errorf("normalize-flags: unknown mode %q (want preserve|strip)", c.normalizeFlags)
+	}
+	n.StripErr = c.normalizeStripErr
+	return n, nil
+}
+
+// normalized returns broadcast behind the backend's normalization stage,
+// or broadcast itself when normalization changes nothing.
+func normalized(cfg *appConfig, broadcast func(can.Frame)) func(can.Frame) {
+	n, _ := cfg.normalization() // validated at startup
+	if n.Identity() {
+		return broadcast
+	}
+	return func(fr can.Frame) {
+		if n.Frame(&fr) {
+			broadcast(fr)
+		}
+	}
+}
+
+// txQueued reports whether client frames reach the device through a TX
+// queue, whose fill level clients may follow with flow-control hints.
+func (c *appConfig) txQueued() bool {
+	kind, _ := splitBackend(c.backend)
+	return kind != "loopback" && !c.txDryRun
+}
+
+// carriesFD reports whether the backend carries CAN FD frames, which
+// clients may then negotiate. Only loopback does: every bus backend speaks
+// classic CAN.
+func (c *appConfig) carriesFD() bool {
+	kind, _ := splitBackend(c.backend)
+	return kind == "loopback"
+}
+
+// identity is what the instance answers OpIdent queries with. The bus name
+// is the instance name, or the SocketCAN interface of a single bus.
+func (c *appConfig) identity() cnl.Ident {
+	kind, _ := splitBackend(c.backend)
+	bus := c.name
+	if bus == "" && kind == "socketcan" {
+		bus = c.canIf
+	}
+	return cnl.Ident{Version: version, Backend: kind, Bus: bus}
+}
+
+// errMask is the -can-err-filter class mask; 0 keeps error frames off.
+func (c *appConfig) errMask() uint32 {
+	mask, _ := can.ParseErrMask(c.canErrFilter) // validated at startup
+	return mask
+}
+
+func openBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *slog.Logger, wg *sync.WaitGroup) (backendTx, func(), error) {
+	kind, _ := splitBackend(cfg.backend)
+	switch kind {
 	case "serial":
 		return initSerialBackend(ctx, cfg, h, l, wg)
+	case "slcan":
+		return initSLCANBackend(ctx, cfg, h, l, wg)
 	case "socketcan":
 		return initSocketCANBackend(ctx, cfg, h, l, wg)
+	case "loopback":
+		return initLoopbackBackend(ctx, cfg, h, l, wg)
+	case "replay":
+		return initReplayBackend(ctx, cfg, h, l, wg)
+	case backendCannelloniUDP:
+		return initCannelloniUDPBackend(ctx, cfg, h, l, wg)
+	case backendCannelloniTCP:
+		return initCannelloniTCPBackend(ctx, cfg, h, l, wg)
 	default:
-		return nil, func() {}, fmt.Errorf("unknown backend %q (use serial|socketcan)", cfg.backend)
+		return backendTx{}, func() {}, fmt.Errorf("unknown backend %q (use serial|slcan|socketcan|loopback|replay|cannelloni-udp:host:port|cannelloni-tcp:host:port)", cfg.backend)
 	}
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/client"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/transport"
+)
+
+// backendCannelloniTCP is the backend kind relaying an upstream cannelloni
+// TCP server, given as cannelloni-tcp:<host>:<port>.
+const backendCannelloniTCP = "cannelloni-tcp"
+
+// upstreamRxBuffer is how many upstream frames wait for the hub before
+// further ones are dropped and counted.
+const upstreamRxBuffer = 4096
+
+// upstreamStatePoll is how often the relay notices connection changes.
+var upstreamStatePoll = time.Second
+
+var errUpstreamTxOverflow = fmt.Errorf("cannelloni-tcp: %w", transport.ErrTxOverflow)
+
+// initCannelloniTCPBackend connects out to a cannelloni TCP server, e.g. a
+// central can-server, and treats it as the CAN device: its frames are
+// broadcast to local clients and client frames are forwarded to it. The
+// connection is redialled with backoff; frames sent while it is down wait
+// in a bounded buffer (-upstream-tx-buffer) and go out on reconnect.
+func initCannelloniTCPBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *slog.Logger, wg *sync.WaitGroup) (backendTx, func(), error) {
+	_, remote := splitBackend(cfg.backend)
+	var connOpts []client.Option
+	if cfg.upstreamCompression {
+		connOpts = append(connOpts, client.WithCompression())
+	}
+	if cfg.upstreamPacketFraming {
+		connOpts = append(connOpts, client.WithPacketFraming())
+	}
+	ac := client.DialAuto(ctx, remote, client.WithTxBuffer(cfg.upstreamTxBuffer), client.WithConnOptions(connOpts...))
+	sub, err := ac.Subscribe("", upstreamRxBuffer)
+	if err != nil {
+		_ = ac.Close()
+		return backendTx{}, func() {}, fmt.Errorf("cannelloni-tcp %s: %w", remote, err)
+	}
+	l.Info("cannelloni_tcp_open", "upstream", remote, "tx_buffer", cfg.upstreamTxBuffer, "ping", cfg.upstreamPing,
+		"compression", cfg.upstreamCompression, "packet_framing", cfg.upstreamPacketFraming)
+	metrics.SetUpstreamConnected(remote, false)
+
+	send := func(fr can.Frame) error {
+		if err := ac.Send(fr); err != nil {
+			if errors.Is(err, client.ErrTxBufferFull) {
+				return errUpstreamTxOverflow
+			}
+			return err
+		}
+		return nil
+	}
+	txOpts, _ := cfg.txOptions() // validated at startup
+	tw := transport.NewAsyncTx(ctx, txQueueSize, send, transport.Hooks{
+		OnError: func(err error) { metrics.IncError(metrics.ErrUpstreamTx) },
+		OnAfter: func() { metrics.IncUpstreamTx() },
+		OnDrop: func() error {
+			metrics.IncError(metrics.ErrUpstreamTx)
+			return errUpstreamTxOverflow
+		},
+	}, txOpts...)
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer l.Info("cannelloni_tcp_rx_end")
+		broadcast := normalized(cfg, h.Broadcast)
+		// The upstream connection is the read loop of the relay: it is
+		// alive while connected (-upstream-ping drops a dead one).
+		beat := rxLoopBeat(ctx)
+		var idle <-chan time.Time
+		if d := beat.readTimeout(); d > 0 {
+			t := time.NewTicker(d)
+			defer t.Stop()
+			idle = t.C
+		}
+		for {
+			select {
+			case fr, ok := <-sub.Frames():
+				if !ok {
+					return
+				}
+				beat.beat()
+				if cnl.IsControl(&fr) {
+					continue // answers to our own control messages
+				}
+				metrics.IncUpstreamRx()
+				broadcast(fr)
+			case <-idle:
+				if ac.Stats().Connected {
+					beat.beat()
+				}
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		watchUpstream(ctx, remote, ac, sub, cfg.upstreamPing, l)
+	}()
+	return backendTx{send: tw.SendFrame, sendWait: tw.SendFrameWait, queue: tw.Queue}, func() {
+		tw.Close()
+		_ = ac.Close()
+		metrics.SetUpstreamConnected(remote, false)
+	}, nil
+}
+
+// watchUpstream logs and exports connection changes, counts upstream
+// frames the relay queue dropped and, with ping > 0, closes a connection
+// whose ping is not answered within ping so it is redialled instead of
+// waiting for TCP to notice a dead link.
+func watchUpstream(ctx context.Context, remote string, ac *client.AutoConn, sub *client.Subscription, ping time.Duration, l *slog.Logger) {
+	state := time.NewTicker(upstreamStatePoll)
+	defer state.Stop()
+	var pings <-chan time.Time
+	if ping > 0 {
+		t := time.NewTicker(ping)
+		defer t.Stop()
+		pings = t.C
+	}
+	var (
+		up      bool
+		dropped uint64
+		since   = time.Now()
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-state.C:
+			if d := sub.Dropped(); d > dropped {
+				metrics.AddUpstreamRxDropped(d - dropped)
+				dropped = d
+			}
+			st := ac.Stats()
+			if st.Connected == up {
+				continue
+			}
+			up = st.Connected
+			metrics.SetUpstreamConnected(remote, up)
+			if up {
+				l.Info("upstream_connected", "upstream", remote, "connects", st.Connects, "down_for", time.Since(since).Round(time.Millisecond), "tx_queued", st.TxQueued)
+			} else {
+				l.Warn("upstream_disconnected", "upstream", remote, "up_for", time.Since(since).Round(time.Millisecond))
+			}
+			since = time.Now()
+		case <-pings:
+			c := ac.Conn()
+			if c == nil {
+				continue
+			}
+			pctx, cancel := context.WithTimeout(ctx, ping)
+			_, err := c.Ping(pctx)
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				metrics.IncError(metrics.ErrUpstreamPing)
+				l.Warn("upstream_ping_timeout", "upstream", remote, "timeout", ping, "error", err)
+				_ = c.Close()
+			}
+		}
+	}
+}
+
+// validateCannelloniTCP checks a cannelloni-tcp backend argument and the
+// -upstream-* settings.
+func (c *appConfig) validateCannelloniTCP(arg string) error {
+	if _, _, err := net.SplitHostPort(arg); err != nil {
+		return fmt.Errorf("invalid backend %s: want cannelloni-tcp:host:port", c.backend)
+	}
+	if c.upstreamTxBuffer < 0 {
+		return fmt.Errorf("upstream-tx-buffer must be >= 0")
+	}
+	if c.upstreamPing < 0 {
+		return fmt.Errorf("upstream-ping must be >= 0")
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+func TestInitCannelloniTCPBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Upstream: a gateway whose bus is a channel.
+	up := hub.New()
+	upTx := make(chan can.Frame, 4)
+	srv := server.NewServer(
+		server.WithHub(up),
+		server.WithCodec(&cnl.Codec{}),
+		server.WithSend(func(fr can.Frame) error { upTx <- fr; return nil }),
+		server.WithListenAddr("127.0.0.1:0"),
+	)
+	go func() { _ = srv.Serve(ctx) }()
+	select {
+	case <-srv.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("upstream not ready")
+	}
+
+	h := hub.New()
+	c := &hub.Client{Out: make(chan can.Frame, 4), Closed: make(chan struct{})}
+	h.Add(c)
+	cfg := &appConfig{backend: "cannelloni-tcp:" + srv.Addr(), upstreamTxBuffer: 16}
+	var wg sync.WaitGroup
+	tx, cleanup, err := initCannelloniTCPBackend(ctx, cfg, h, testLogger(), &wg)
+	if err != nil {
+		t.Fatalf("initCannelloniTCPBackend: %v", err)
+	}
+	defer func() { cancel(); cleanup(); wg.Wait() }()
+
+	// TX: sent before the connection is up, the frame waits and goes out on
+	// connect.
+	out := can.Frame{CANID: 0x101, Len: 2, Data: [64]byte{0xAA, 0xBB}}
+	if err := tx.send(out); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	select {
+	case fr := <-upTx:
+		if fr != out {
+			t.Fatalf("upstream got %+v", fr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the upstream to receive")
+	}
+
+	// RX: upstream bus frames reach local clients.
+	in := can.Frame{CANID: 0x202, Len: 1, Data: [64]byte{7}}
+	up.Broadcast(in)
+	select {
+	case fr := <-c.Out:
+		if fr != in {
+			t.Fatalf("unexpected frame: %+v", fr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for frame")
+	}
+}
+
+func TestValidateCannelloniTCPBackend(t *testing.T) {
+	c := &appConfig{logFormat: "text", logLevel: "info", hubPolicy: "drop", hubBuffer: 1, baud: 1,
+		serialReadTO: time.Second, handshakeTO: time.Second, clientReadTO: time.Second}
+	for _, tc := range []struct {
+		backend  string
+		txBuffer int
+		ok       bool
+	}{
+		{"cannelloni-tcp:central.lan:20000", 256, true},
+		{"cannelloni-tcp:[::1]:20000", 0, true},
+		{"cannelloni-tcp:central.lan", 256, false},
+		{"cannelloni-tcp", 256, false},
+		{"cannelloni-tcp:central.lan:20000", -1, false},
+	} {
+		c.backend, c.upstreamTxBuffer = tc.backend, tc.txBuffer
+		if err := c.validate(); (err == nil) != tc.ok {
+			t.Fatalf("%s tx-buffer %d: validate err=%v, want ok=%v", tc.backend, tc.txBuffer, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/rxpipe"
+	"github.com/kstaniek/go-ampio-server/internal/transport"
+)
+
+var errUDPTxOverflow = fmt.Errorf("cannelloni udp: %w", transport.ErrTxOverflow)
+
+// initCannelloniUDPBackend treats a remote cannelloni UDP endpoint as the CAN
+// device: datagrams from the peer are broadcast to local TCP clients and
+// client frames are sent to the peer, one DATA packet per frame.
+func initCannelloniUDPBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *slog.Logger, wg *sync.WaitGroup) (backendTx, func(), error) {
+	_, remote := splitBackend(cfg.backend)
+	raddr, err := net.ResolveUDPAddr("udp", remote)
+	if err != nil {
+		return backendTx{}, func() {}, fmt.Errorf("cannelloni-udp remote %s: %w", remote, err)
+	}
+	laddr, err := net.ResolveUDPAddr("udp", cfg.udpLocal)
+	if err != nil {
+		return backendTx{}, func() {}, fmt.Errorf("cannelloni-udp local %s: %w", cfg.udpLocal, err)
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return backendTx{}, func() {}, fmt.Errorf("cannelloni-udp listen %s: %w", cfg.udpLocal, err)
+	}
+	l.Info("cannelloni_udp_open", "remote", raddr.String(), "local", conn.LocalAddr().String())
+
+	// Cannelloni sends remote requests without payload.
+	codec := &cnl.Codec{RTR: true}
+	var seq uint8 // only touched by the AsyncTx worker goroutine
+	send := func(fr can.Frame) error {
+		seq++
+		_, err := conn.WriteToUDP(codec.EncodePacket(seq, []can.Frame{fr}), raddr)
+		return err
+	}
+	txOpts, _ := cfg.txOptions() // validated at startup
+	tw := transport.NewAsyncTx(ctx, txQueueSize, send, transport.Hooks{
+		OnError: func(err error) { metrics.IncError(metrics.ErrUDPWrite) },
+		OnAfter: func() { metrics.IncUDPTx() },
+		OnDrop: func() error {
+			metrics.IncError(metrics.ErrUDPOverflow)
+			return errUDPTxOverflow
+		},
+	}, txOpts...)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer l.Info("cannelloni_udp_rx_end")
+		buf := make([]byte, 64*1024)
+		var seqs cnl.SeqTracker // only touched by the decode stage
+		decode := func(b []byte, emit func(can.Frame)) {
+			seq, err := codec.DecodePacket(b, func(fr can.Frame) {
+				metrics.IncUDPRx()
+				emit(fr)
+			})
+			if err != nil {
+				metrics.IncMalformed()
+				l.Warn("cannelloni_udp_bad_packet", "error", err, "from", raddr.String(), "bytes", len(b))
+				return
+			}
+			if n := seqs.Lost(seq); n > 0 {
+				metrics.AddCannelloniLost(cnl.SourceUDP, n)
+				l.Debug("cannelloni_udp_packets_lost", "lost", n, "seq", seq)
+			}
+		}
+		broadcast := normalized(cfg, h.Broadcast)
+		var pipe *rxpipe.Pipeline
+		if cfg.rxPipeline > 0 {
+			pipe = rxpipe.New(cfg.rxPipeline, decode, broadcast)
+			defer pipe.Close()
+		}
+		beat := rxLoopBeat(ctx)
+		backoff := rxBackoffMin
+		for {
+			if d := beat.readTimeout(); d > 0 {
+				_ = conn.SetReadDeadline(time.Now().Add(d))
+			}
+			n, from, err := conn.ReadFromUDP(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && ctx.Err() == nil {
+				beat.beat() // a quiet bus
+				continue
+			}
+			if err != nil {
+				if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+					return
+				}
+				metrics.IncError(metrics.ErrUDPRead)
+				l.Warn("cannelloni_udp_read_error", "error", err, "backoff", backoff)
+				sleepFn(backoff)
+				backoff *= 2
+				if backoff > rxBackoffMax {
+					backoff = rxBackoffMax
+				}
+				continue
+			}
+			beat.beat()
+			backoff = rxBackoffMin
+			if !from.IP.Equal(raddr.IP) {
+				l.Debug("cannelloni_udp_foreign_packet", "from", from.String())
+				continue
+			}
+			if pipe != nil {
+				pipe.Raw(append([]byte(nil), buf[:n]...))
+			} else {
+				decode(buf[:n], broadcast)
+			}
+		}
+	}()
+	return backendTx{send: tw.SendFrame, sendWait: tw.SendFrameWait, queue: tw.Queue}, func() { _ = conn.Close(); tw.Close() }, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+func TestInitCannelloniUDPBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	h := hub.New()
+	c := &hub.Client{Out: make(chan can.Frame, 4), Closed: make(chan struct{})}
+	h.Add(c)
+	cfg := &appConfig{backend: "cannelloni-udp:" + peer.LocalAddr().String(), udpLocal: "127.0.0.1:0"}
+	var wg sync.WaitGroup
+	tx, cleanup, err := initCannelloniUDPBackend(ctx, cfg, h, testLogger(), &wg)
+	if err != nil {
+		t.Fatalf("initCannelloniUDPBackend: %v", err)
+	}
+	defer func() { cancel(); cleanup(); wg.Wait() }()
+
+	// TX: a client frame reaches the peer as a DATA packet.
+	codec := &cnl.Codec{}
+	out := can.Frame{CANID: 0x101, Len: 2, Data: [64]byte{0xAA, 0xBB}}
+	if err := tx.send(out); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	buf := make([]byte, 2048)
+	_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, gw, err := peer.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("peer read: %v", err)
+	}
+	var got []can.Frame
+	if _, err := codec.DecodePacket(buf[:n], func(fr can.Frame) { got = append(got, fr) }); err != nil || len(got) != 1 || got[0] != out {
+		t.Fatalf("peer got %+v err=%v", got, err)
+	}
+
+	// RX: a packet from the peer is broadcast to hub clients.
+	in := can.Frame{CANID: 0x202, Len: 1, Data: [64]byte{7}}
+	if _, err := peer.WriteToUDP(codec.EncodePacket(1, []can.Frame{in}), gw); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case fr := <-c.Out:
+		if fr != in {
+			t.Fatalf("unexpected frame: %+v", fr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for frame")
+	}
+}
+
+func TestValidateCannelloniUDPBackend(t *testing.T) {
+	c := &appConfig{logFormat: "text", logLevel: "info", hubPolicy: "drop", hubBuffer: 1, baud: 1,
+		serialReadTO: time.Second, handshakeTO: time.Second, clientReadTO: time.Second, udpLocal: ":20000"}
+	for backend, ok := range map[string]bool{
+		"cannelloni-udp:10.0.0.2:20000": true,
+		"cannelloni-udp:[::1]:20000":    true,
+		"cannelloni-udp:10.0.0.2":       false,
+		"cannelloni-udp":                false,
+		"serial:foo":                    false,
+	} {
+		c.backend = backend
+		if err := c.validate(); (err == nil) != ok {
+			t.Fatalf("%s: validate err=%v, want ok=%v", backend, err, ok)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/validate"
+)
+
+func TestInitBackendFilters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := hub.New()
+	c := &hub.Client{Out: make(chan can.Frame, 4), Closed: make(chan struct{})}
+	h.Add(c)
+	cfg := &appConfig{backend: "loopback", txAllow: "0x100-0x1FF", txDeny: "0x180", rxDeny: "0x1F0"}
+	var wg sync.WaitGroup
+	tx, cleanup, err := initBackend(ctx, cfg, h, testLogger(), &wg)
+	if err != nil {
+		t.Fatalf("initBackend: %v", err)
+	}
+	defer cleanup()
+
+	for id, wantErr := range map[uint32]error{0x200: filter.ErrDenied, 0x180: filter.ErrDenied, 0x1F0: nil, 0x101: nil} {
+		if err := tx.send(can.Frame{CANID: id}); !errors.Is(err, wantErr) {
+			t.Fatalf("send 0x%X: got %v want %v", id, err, wantErr)
+		}
+	}
+	// Invalid frames are rejected before the filters.
+	if err := tx.send(can.Frame{CANID: 0x101, Len: 9}); !errors.Is(err, validate.ErrInvalid) {
+		t.Fatalf("send DLC 9: got %v want %v", err, validate.ErrInvalid)
+	}
+	// 0x1F0 passed TX but is dropped on the RX path; only 0x101 reaches clients.
+	if got := len(c.Out); got != 1 {
+		t.Fatalf("expected 1 frame delivered, got %d", got)
+	}
+	if fr := <-c.Out; fr.CANID != 0x101 {
+		t.Fatalf("unexpected frame 0x%X", fr.CANID)
+	}
+	if st := h.Stats(); st.Denied != 1 {
+		t.Fatalf("expected 1 RX denial, got %+v", st)
+	}
+}
+
+func TestInitBackendDedup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := hub.New()
+	c := &hub.Client{Out: make(chan can.Frame, 8), Closed: make(chan struct{})}
+	h.Add(c)
+	cfg := &appConfig{backend: "loopback", txDedupWindow: time.Minute, txDedupIDs: "0x100-0x1FF"}
+	var wg sync.WaitGroup
+	tx, cleanup, err := initBackend(ctx, cfg, h, testLogger(), &wg)
+	if err != nil {
+		t.Fatalf("initBackend: %v", err)
+	}
+	defer cleanup()
+	for _, id := range []uint32{0x101, 0x101, 0x300, 0x300} {
+		if err := tx.wait(ctx, can.Frame{CANID: id, Len: 1}); err != nil {
+			t.Fatalf("send 0x%X: %v", id, err)
+		}
+	}
+	// The repeated 0x101 is collapsed; 0x300 is outside the dedup IDs.
+	if got := len(c.Out); got != 3 {
+		t.Fatalf("expected 3 frames on the bus, got %d", got)
+	}
+}
+
+func TestInitBackendDryRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := hub.New()
+	c := &hub.Client{Out: make(chan can.Frame, 4), Closed: make(chan struct{})}
+	h.Add(c)
+	cfg := &appConfig{backend: "loopback", txDryRun: true, txDeny: "0x200"}
+	var wg sync.WaitGroup
+	tx, cleanup, err := initBackend(ctx, cfg, h, testLogger(), &wg)
+	if err != nil {
+		t.Fatalf("initBackend: %v", err)
+	}
+	defer cleanup()
+	if err := tx.wait(ctx, can.Frame{CANID: 0x101, Len: 1}); err != nil {
+		t.Fatalf("dry-run send: %v", err)
+	}
+	// Filters still apply in dry-run mode.
+	if err := tx.send(can.Frame{CANID: 0x200}); !errors.Is(err, filter.ErrDenied) {
+		t.Fatalf("expected denial, got %v", err)
+	}
+	// The loopback backend would echo written frames; nothing was written.
+	if got := len(c.Out); got != 0 {
+		t.Fatalf("expected no frames on the bus, got %d", got)
+	}
+}
+
+func TestInitBackendEmulate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rules := filepath.Join(t.TempDir(), "devices.rules")
+	if err := os.WriteFile(rules, []byte("1D000123#0A -> 1D000124#0A$1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h := hub.New()
+	c := &hub.Client{Out: make(chan can.Frame, 4), Closed: make(chan struct{})}
+	h.Add(c)
+	cfg := &appConfig{backend: "loopback", emulate: rules}
+	var wg sync.WaitGroup
+	tx, cleanup, err := initBackend(ctx, cfg, h, testLogger(), &wg)
+	if err != nil {
+		t.Fatalf("initBackend: %v", err)
+	}
+	defer cleanup()
+	for _, s := range []string{"1D000123#0A07", "100#01"} {
+		fr, _ := can.ParseFrame(s)
+		if err := tx.wait(ctx, fr); err != nil {
+			t.Fatalf("send %s: %v", s, err)
+		}
+	}
+	// The query is answered by the emulated device instead of the bus; the
+	// other frame reaches the (loopback) bus.
+	for _, want := range []string{"1D000124#0A07", "100#01"} {
+		if fr := <-c.Out; fr.String() != want {
+			t.Fatalf("got %s, want %s", fr, want)
+		}
+	}
+	if got := len(c.Out); got != 0 {
+		t.Fatalf("unexpected extra frames: %d", got)
+	}
+}
+
+func TestInitBackendTransforms(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := hub.New()
+	c := &hub.Client{Out: make(chan can.Frame, 4), Closed: make(chan struct{})}
+	h.Add(c)
+	cfg := &appConfig{backend: "loopback", txTransform: "0x100 = swap 0 2", rxTransform: "0x100-0x1FF = set 2 FF"}
+	var wg sync.WaitGroup
+	tx, cleanup, err := initBackend(ctx, cfg, h, testLogger(), &wg)
+	if err != nil {
+		t.Fatalf("initBackend: %v", err)
+	}
+	defer cleanup()
+	for _, s := range []string{"100#0102", "200#0102"} {
+		fr, _ := can.ParseFrame(s)
+		if err := tx.wait(ctx, fr); err != nil {
+			t.Fatalf("send %s: %v", s, err)
+		}
+	}
+	// The loopback bus sees the TX transform; clients also see the RX one.
+	for _, want := range []string{"100#0201FF", "200#0102"} {
+		if fr := <-c.Out; fr.String() != want {
+			t.Fatalf("got %s, want %s", fr, want)
+		}
+	}
+}
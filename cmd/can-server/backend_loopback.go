@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+// initLoopbackBackend sets up a device-less backend that broadcasts every
+// transmitted frame back to all hub clients. Intended for benchmarks and
+// integration tests where no CAN hardware (or vcan) is available.
+func initLoopbackBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *slog.Logger, wg *sync.WaitGroup) (backendTx, func(), error) {
+	l.Info("loopback_open")
+	send := func(fr can.Frame) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		h.Broadcast(fr)
+		return nil
+	}
+	return backendTx{send: send}, func() {}, nil
+}
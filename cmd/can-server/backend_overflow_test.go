@@ -35,7 +35,7 @@ func TestSerialBackendTxOverflow(t *testing.T) {
 	h := hub.New()
 	cfg := &appConfig{backend: "serial", serialDev: "fake", baud: 115200, serialReadTO: 10 * time.Millisecond}
 	var wg sync.WaitGroup
-	send, cleanup, err := initSerialBackend(ctx, cfg, h, testLogger(), &wg)
+	tx, cleanup, err := initSerialBackend(ctx, cfg, h, testLogger(), &wg)
 	if err != nil {
 		t.Fatalf("initSerialBackend: %v", err)
 	}
@@ -45,7 +45,7 @@ func TestSerialBackendTxOverflow(t *testing.T) {
 	var overflowErr error
 	for i := 0; i < txQueueSize+2; i++ {
 		fr := can.Frame{CANID: uint32(i)}
-		err := send(fr)
+		err := tx.send(fr)
 		if err != nil && overflowErr == nil {
 			overflowErr = err
 		}
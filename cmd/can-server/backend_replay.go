@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/capture"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/transport"
+)
+
+var errReplayTxOverflow = fmt.Errorf("replay: %w", transport.ErrTxOverflow)
+
+// validateReplay checks the -replay-* settings.
+func (c *appConfig) validateReplay() error {
+	kind, _ := splitBackend(c.backend)
+	if kind != "replay" {
+		if c.replayFile != "" || c.replayTxFile != "" || c.replayLoop {
+			return fmt.Errorf("replay-file, replay-loop and replay-tx-file require the replay backend")
+		}
+		return nil
+	}
+	if c.replayFile == "" {
+		return fmt.Errorf("backend replay requires replay-file")
+	}
+	if !(c.replaySpeed >= 0) { // also NaN
+		return fmt.Errorf("replay-speed must be >= 0")
+	}
+	if c.replayTxPath() == c.replayFile {
+		return fmt.Errorf("replay-tx-file must differ from replay-file")
+	}
+	return nil
+}
+
+// replayTxPath is the file client frames are captured to in replay mode:
+// -replay-tx-file, or the replay log with a .tx suffix.
+func (c *appConfig) replayTxPath() string {
+	if c.replayTxFile != "" {
+		return c.replayTxFile
+	}
+	return c.replayFile + ".tx"
+}
+
+// initReplayBackend plays a candump log to the hub as if the frames came
+// from the bus, spaced by their original timestamps divided by
+// -replay-speed (0 sends them back to back), once or with -replay-loop
+// over and over. Client frames reach no bus: they are appended to the
+// replay TX file in candump format, so a test run records what the clients
+// answered.
+func initReplayBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *slog.Logger, wg *sync.WaitGroup) (backendTx, func(), error) {
+	recs, err := readCandumpFile(cfg.replayFile)
+	if err != nil {
+		return backendTx{}, func() {}, fmt.Errorf("replay-file: %w", err)
+	}
+	txPath := cfg.replayTxPath()
+	f, err := os.OpenFile(txPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return backendTx{}, func() {}, fmt.Errorf("replay tx file: %w", err)
+	}
+	l.Info("replay_open", "file", cfg.replayFile, "frames", len(recs), "span", recs[len(recs)-1].Time.Sub(recs[0].Time),
+		"speed", cfg.replaySpeed, "loop", cfg.replayLoop, "tx_file", txPath)
+
+	send := func(fr can.Frame) error {
+		return capture.WriteCandump(f, "can0", []capture.Record{{Time: time.Now(), Frame: fr}})
+	}
+	txOpts, _ := cfg.txOptions() // validated at startup
+	tw := transport.NewAsyncTx(ctx, txQueueSize, send, transport.Hooks{
+		OnError: func(err error) { metrics.IncError(metrics.ErrReplayWrite) },
+		OnAfter: func() { metrics.IncReplayTx() },
+		OnDrop: func() error {
+			metrics.IncError(metrics.ErrReplayOverflow)
+			return errReplayTxOverflow
+		},
+	}, txOpts...)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		broadcast := normalized(cfg, h.Broadcast)
+		for pass := 1; ; pass++ {
+			if !replayRecords(ctx, recs, cfg.replaySpeed, broadcast) {
+				return
+			}
+			if !cfg.replayLoop {
+				l.Info("replay_end", "frames", len(recs))
+				return
+			}
+			l.Debug("replay_loop", "pass", pass)
+		}
+	}()
+	return backendTx{send: tw.SendFrame, sendWait: tw.SendFrameWait, queue: tw.Queue}, func() { tw.Close(); _ = f.Close() }, nil
+}
+
+// replayRecords broadcasts recs in order, each after the gap to its
+// predecessor divided by speed; speed 0 sends them without gaps. Gaps are
+// taken between neighbours, so a clock step backwards in the log delays
+// nothing. It reports false when ctx ended first.
+func replayRecords(ctx context.Context, recs []capture.Record, speed float64, broadcast func(can.Frame)) bool {
+	t := time.NewTimer(0)
+	defer t.Stop()
+	<-t.C
+	due := time.Now()
+	for i := range recs {
+		if speed > 0 && i > 0 {
+			if gap := recs[i].Time.Sub(recs[i-1].Time); gap > 0 {
+				due = due.Add(time.Duration(float64(gap) / speed))
+			}
+			if d := time.Until(due); d > 0 {
+				t.Reset(d)
+				select {
+				case <-ctx.Done():
+					return false
+				case <-t.C:
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		metrics.IncReplayRx()
+		broadcast(recs[i].Frame)
+	}
+	return true
+}
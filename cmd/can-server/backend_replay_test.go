@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/capture"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+const replayTestLog = `# recorded on the test bench
+(1700000000.000000) can0 101#AA
+(1700000000.500000) can0 102#BB
+(1700000001.000000) can0 103#CC
+`
+
+func TestInitReplayBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "bus.log")
+	if err := os.WriteFile(logPath, []byte(replayTestLog), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := hub.New()
+	c := &hub.Client{Out: make(chan can.Frame, 16), Closed: make(chan struct{})}
+	h.Add(c)
+	// 1s of log at 20x: the pass takes ~50ms, the loop repeats it.
+	cfg := &appConfig{backend: "replay", replayFile: logPath, replaySpeed: 20, replayLoop: true}
+	var wg sync.WaitGroup
+	tx, cleanup, err := initReplayBackend(ctx, cfg, h, testLogger(), &wg)
+	if err != nil {
+		t.Fatalf("initReplayBackend: %v", err)
+	}
+	start := time.Now()
+	for i := range 6 {
+		select {
+		case fr := <-c.Out:
+			if want := uint32(0x101 + i%3); fr.CANID != want {
+				t.Fatalf("frame %d: id %X, want %X", i, fr.CANID, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for frame %d", i)
+		}
+		if i == 2 && time.Since(start) < 40*time.Millisecond {
+			t.Fatalf("first pass took %v, want the log spacing", time.Since(start))
+		}
+	}
+
+	// TX: client frames are captured to <replay-file>.tx.
+	out := can.Frame{CANID: 0x7FF, Len: 2, Data: [64]byte{1, 2}}
+	if err := tx.wait(ctx, out); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	cancel()
+	cleanup()
+	wg.Wait()
+	f, err := os.Open(logPath + ".tx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	recs, err := capture.ReadCandump(f)
+	if err != nil || len(recs) != 1 || recs[0].Frame != out {
+		t.Fatalf("tx file: %+v err=%v", recs, err)
+	}
+}
+
+func TestReplayRecordsOnce(t *testing.T) {
+	recs := []capture.Record{
+		{Time: time.Unix(100, 0), Frame: can.Frame{CANID: 1}},
+		{Time: time.Unix(50, 0), Frame: can.Frame{CANID: 2}}, // clock stepped back
+		{Time: time.Unix(50, 0), Frame: can.Frame{CANID: 3}},
+	}
+	var got []uint32
+	start := time.Now()
+	if !replayRecords(context.Background(), recs, 1, func(fr can.Frame) { got = append(got, fr.CANID) }) {
+		t.Fatal("replay cancelled")
+	}
+	if len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Fatalf("got %v", got)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("backwards step delayed the replay by %v", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if replayRecords(ctx, recs, 0, func(can.Frame) {}) {
+		t.Fatal("cancelled replay reported done")
+	}
+}
+
+func TestValidateReplay(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  appConfig
+		ok   bool
+	}{
+		{"replay", appConfig{backend: "replay", replayFile: "bus.log", replaySpeed: 1}, true},
+		{"as fast as possible", appConfig{backend: "replay", replayFile: "bus.log", replayLoop: true}, true},
+		{"no file", appConfig{backend: "replay", replaySpeed: 1}, false},
+		{"negative speed", appConfig{backend: "replay", replayFile: "bus.log", replaySpeed: -1}, false},
+		{"tx over the log", appConfig{backend: "replay", replayFile: "bus.log", replayTxFile: "bus.log"}, false},
+		{"other backend", appConfig{backend: "socketcan", replayFile: "bus.log"}, false},
+		{"unused", appConfig{backend: "socketcan", replaySpeed: 1}, true},
+	} {
+		if err := tc.cfg.validateReplay(); (err == nil) != tc.ok {
+			t.Fatalf("%s: err=%v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/kstaniek/go-ampio-server/internal/can"
 	"github.com/kstaniek/go-ampio-server/internal/hub"
 	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/rxpipe"
 	"github.com/kstaniek/go-ampio-server/internal/serial"
 )
 
@@ -24,20 +25,47 @@ var sleepFn = time.Sleep
 var openSerialPort = serial.Open
 
 // initSerialBackend sets up the serial backend, launching the RX loop.
-func initSerialBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *slog.Logger, wg *sync.WaitGroup) (func(can.Frame) error, func(), error) {
+func initSerialBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *slog.Logger, wg *sync.WaitGroup) (backendTx, func(), error) {
 	sp, err := openSerialPort(cfg.serialDev, cfg.baud, cfg.serialReadTO)
 	if err != nil {
-		return nil, func() {}, fmt.Errorf("open serial: %w", err)
+		return backendTx{}, func() {}, fmt.Errorf("open serial: %w", err)
 	}
 	l.Info("serial_open", "device", cfg.serialDev, "baud", cfg.baud)
-	serCodec := serial.Codec{}
-	w := serial.NewTXWriter(ctx, sp, serCodec, txQueueSize)
+	serCodec := serial.Codec{NoChecksum: cfg.serialNoChecksum}
+	metrics.SetSerialChecksumDisabled(cfg.serialNoChecksum)
+	if cfg.serialNoChecksum {
+		l.Warn("serial_checksum_disabled", "device", cfg.serialDev)
+	}
+	txOpts, _ := cfg.txOptions() // validated at startup
+	w := serial.NewTXWriter(ctx, sp, serCodec, txQueueSize, txOpts...)
+	startSerialRX(ctx, cfg, sp, serCodec.DecodeStream, h, l, wg)
+	return backendTx{send: w.SendFrame, sendWait: w.SendFrameWait, queue: w.Queue}, func() { _ = sp.Close(); w.Close() }, nil
+}
+
+// startSerialRX launches the RX loop of a serial link: chunks read from sp
+// are decoded by decodeStream (partial frames stay buffered for the next
+// read) and broadcast on h.
+func startSerialRX(ctx context.Context, cfg *appConfig, sp serial.Port, decodeStream func(*bytes.Buffer, func(can.Frame)) error, h *hub.Hub, l *slog.Logger, wg *sync.WaitGroup) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		defer l.Info("serial_rx_end")
 		buf := make([]byte, serialReadBufSize)
 		acc := bytes.NewBuffer(nil)
+		decode := func(b []byte, emit func(can.Frame)) {
+			acc.Write(b)
+			_ = decodeStream(acc, emit)
+			if acc.Len() == 0 && acc.Cap() > largeBufferReclaimThreshold {
+				acc = bytes.NewBuffer(nil)
+			}
+		}
+		broadcast := normalized(cfg, h.Broadcast)
+		var pipe *rxpipe.Pipeline
+		if cfg.rxPipeline > 0 {
+			pipe = rxpipe.New(cfg.rxPipeline, decode, broadcast)
+			defer pipe.Close()
+		}
+		beat := rxLoopBeat(ctx) // reads return at the serial read timeout
 		backoff := rxBackoffMin
 		for {
 			select {
@@ -46,11 +74,14 @@ func initSerialBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *slog.
 			default:
 			}
 			n, err := sp.Read(buf)
+			if n > 0 || err == nil || errors.Is(err, io.EOF) {
+				beat.beat()
+			}
 			if n > 0 {
-				acc.Write(buf[:n])
-				_ = serCodec.DecodeStream(acc, func(fr can.Frame) { h.Broadcast(fr) })
-				if acc.Len() == 0 && acc.Cap() > largeBufferReclaimThreshold {
-					acc = bytes.NewBuffer(nil)
+				if pipe != nil {
+					pipe.Raw(append([]byte(nil), buf[:n]...))
+				} else {
+					decode(buf[:n], broadcast)
 				}
 				backoff = rxBackoffMin
 			}
@@ -75,5 +106,4 @@ func initSerialBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *slog.
 			}
 		}
 	}()
-	return w.SendFrame, func() { _ = sp.Close(); w.Close() }, nil
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/slcan"
+)
+
+// initSLCANBackend sets up the SLCAN (LAWICEL) backend on the -serial
+// device: it opens the CAN channel at -slcan-bitrate and launches the RX
+// loop. The channel is closed again on cleanup.
+func initSLCANBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *slog.Logger, wg *sync.WaitGroup) (backendTx, func(), error) {
+	sp, err := openSerialPort(cfg.serialDev, cfg.baud, cfg.serialReadTO)
+	if err != nil {
+		return backendTx{}, func() {}, fmt.Errorf("open serial: %w", err)
+	}
+	if err := slcan.Open(sp, cfg.slcanBitrate); err != nil {
+		_ = sp.Close()
+		return backendTx{}, func() {}, fmt.Errorf("slcan open channel: %w", err)
+	}
+	l.Info("slcan_open", "device", cfg.serialDev, "baud", cfg.baud, "bitrate", cfg.slcanBitrate)
+	txOpts, _ := cfg.txOptions() // validated at startup
+	w := slcan.NewTXWriter(ctx, sp, txQueueSize, txOpts...)
+	startSerialRX(ctx, cfg, sp, slcan.DecodeStream, h, l, wg)
+	return backendTx{send: w.SendFrame, sendWait: w.SendFrameWait, queue: w.Queue}, func() {
+		w.Close()
+		_ = slcan.Close(sp)
+		_ = sp.Close()
+	}, nil
+}
@@ -4,31 +4,111 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
+	"time"
 
 	"github.com/kstaniek/go-ampio-server/internal/can"
 	"github.com/kstaniek/go-ampio-server/internal/hub"
 	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/rxpipe"
 	"github.com/kstaniek/go-ampio-server/internal/socketcan"
 )
 
 // openSocketCANDevice is a hook for tests (overridden in unit tests).
-var openSocketCANDevice = func(iface string) (socketcan.Dev, error) { return socketcan.Open(iface) }
+var openSocketCANDevice = func(iface string, opts ...socketcan.Option) (socketcan.Dev, error) {
+	return socketcan.Open(iface, opts...)
+}
+
+// Link hooks for tests (overridden in unit tests).
+var (
+	setCANTxQueueLen = socketcan.SetTxQueueLen
+	canTxQueueLen    = socketcan.TxQueueLen
+	canTxDropped     = socketcan.TxDropped
+)
 
-// initSocketCANBackend sets up the SocketCAN backend, launching the RX loop.
-func initSocketCANBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *slog.Logger, wg *sync.WaitGroup) (func(can.Frame) error, func(), error) {
-	dev, err := openSocketCANDevice(cfg.canIf)
+// initSocketCANBackend sets up the SocketCAN backend, launching an RX loop
+// per interface of -can-if. Frames of all interfaces are merged into the
+// hub, tagged with the interface index; client frames are transmitted on the
+// interfaces -can-tx-route selects.
+func initSocketCANBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *slog.Logger, wg *sync.WaitGroup) (backendTx, func(), error) {
+	ifaces := cfg.canIfaces()
+	var (
+		txs      []backendTx
+		cleanups []func()
+	)
+	cleanup := func() {
+		for _, c := range cleanups {
+			c()
+		}
+	}
+	for i, iface := range ifaces {
+		tx, c, err := openSocketCANIface(ctx, cfg, iface, uint8(i), h, l, wg)
+		if err != nil {
+			cleanup()
+			return backendTx{}, func() {}, err
+		}
+		txs = append(txs, tx)
+		cleanups = append(cleanups, c)
+	}
+	if len(txs) == 1 {
+		return txs[0], cleanup, nil
+	}
+	rt, _ := parseTxRoute(cfg.canTxRoute, ifaces) // validated at startup
+	l.Info("socketcan_tx_route", "ifaces", cfg.canIf, "route", cfg.canTxRoute)
+	return routedTx(txs, rt), cleanup, nil
+}
+
+// openSocketCANIface opens one interface of the SocketCAN backend and starts
+// its RX loop; received frames carry idx in Frame.Iface.
+func openSocketCANIface(ctx context.Context, cfg *appConfig, iface string, idx uint8, h *hub.Hub, l *slog.Logger, wg *sync.WaitGroup) (backendTx, func(), error) {
+	if cfg.canTxQueueLen > 0 {
+		// Without CAP_NET_ADMIN the interface keeps its queue; the gauge shows which.
+		if err := setCANTxQueueLen(iface, cfg.canTxQueueLen); err != nil {
+			l.Warn("socketcan_txqueuelen_error", "if", iface, "want", cfg.canTxQueueLen, "error", err)
+		}
+	}
+	beat := rxLoopBeat(ctx)
+	dev, err := openSocketCANDevice(iface, socketcan.WithLoopback(cfg.canLoopback), socketcan.WithRecvOwnMsgs(cfg.canRecvOwn),
+		socketcan.WithBusyPoll(cfg.canBusyPoll), socketcan.WithSpin(cfg.canSpin), socketcan.WithTxWait(cfg.canTxWait),
+		socketcan.WithErrFilter(cfg.errMask()), socketcan.WithReadTimeout(beat.readTimeout()))
 	if err != nil {
-		return nil, func() {}, fmt.Errorf("socketcan open %s: %w", cfg.canIf, err)
+		return backendTx{}, func() {}, fmt.Errorf("socketcan open %s: %w", iface, err)
+	}
+	l.Info("socketcan_open", "if", iface, "loopback", cfg.canLoopback, "recv_own", cfg.canRecvOwn,
+		"busy_poll", cfg.canBusyPoll, "spin", cfg.canSpin, "tx_wait", cfg.canTxWait, "err_filter", fmt.Sprintf("0x%X", cfg.errMask()))
+	if n, err := canTxQueueLen(iface); err == nil {
+		metrics.SetSocketCANTxQueueLen(iface, n)
+		l.Info("socketcan_txqueuelen", "if", iface, "txqueuelen", n)
+	}
+	if cfg.canTxDropPoll > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watchCANTxDrops(ctx, iface, cfg.canTxDropPoll, l)
+		}()
+	}
+	txOpts, _ := cfg.txOptions() // validated at startup
+	tw := socketcan.NewTXWriter(ctx, dev, txQueueSize, txOpts...)
+	read := func(fr *can.Frame) (bool, error) { return false, dev.ReadFrame(fr) }
+	if or, ok := dev.(interface {
+		ReadFrameOwn(*can.Frame) (bool, error)
+	}); ok {
+		read = or.ReadFrameOwn
 	}
-	l.Info("socketcan_open", "if", cfg.canIf)
-	tw := socketcan.NewTXWriter(ctx, dev, txQueueSize)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		defer l.Info("socketcan_rx_end")
+		defer l.Info("socketcan_rx_end", "if", iface)
+		broadcast := normalized(cfg, h.Broadcast)
+		if cfg.rxPipeline > 0 {
+			// Reads return whole frames: the read stage also decodes.
+			pipe := rxpipe.New(cfg.rxPipeline, nil, broadcast)
+			defer pipe.Close()
+			broadcast = pipe.Frame
+		}
 		backoff := rxBackoffMin
 		for {
 			select {
@@ -37,12 +117,19 @@ func initSocketCANBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *sl
 			default:
 			}
 			var fr can.Frame
-			if err := dev.ReadFrame(&fr); err != nil {
+			own, err := read(&fr)
+			if err == nil || errors.Is(err, socketcan.ErrReadTimeout) {
+				beat.beat()
+			}
+			if errors.Is(err, socketcan.ErrReadTimeout) {
+				continue // a quiet bus
+			}
+			if err != nil {
 				if ctx.Err() != nil { // shutting down
 					return
 				}
 				metrics.IncError(metrics.ErrSocketCANRead)
-				l.Warn("socketcan_read_error", "error", err, "backoff", backoff)
+				l.Warn("socketcan_read_error", "if", iface, "error", err, "backoff", backoff)
 				sleepFn(backoff)
 				backoff *= 2
 				if backoff > rxBackoffMax {
@@ -50,10 +137,55 @@ func initSocketCANBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *sl
 				}
 				continue
 			}
-			metrics.IncSocketCANRx()
-			h.Broadcast(fr)
+			// Own transmissions are counted apart so RX reflects genuine bus traffic.
+			if own {
+				metrics.IncSocketCANRxOwn()
+			} else {
+				metrics.IncSocketCANRx()
+			}
+			if fr.CANID&can.CAN_ERR_FLAG != 0 {
+				classes := can.ErrClasses(fr.CANID)
+				for _, c := range classes {
+					metrics.IncCANErrorFrame(c)
+				}
+				l.Debug("socketcan_error_frame", "classes", classes, "data", fmt.Sprintf("% X", fr.Data[:fr.Len]))
+			}
+			fr.Iface = idx
+			broadcast(fr)
 			backoff = rxBackoffMin
 		}
 	}()
-	return tw.SendFrame, func() { _ = dev.Close(); tw.Close() }, nil
+	return backendTx{send: tw.SendFrame, sendWait: tw.SendFrameWait, queue: tw.Queue}, func() { _ = dev.Close(); tw.Close() }, nil
+}
+
+// watchCANTxDrops samples the kernel TX drop counter of iface every
+// interval and adds the increase to socketcan_kernel_tx_dropped_total.
+// These frames were accepted by the socket, so nothing else sees them lost.
+func watchCANTxDrops(ctx context.Context, iface string, every time.Duration, l *slog.Logger) {
+	last, err := canTxDropped(iface)
+	if err != nil {
+		l.Debug("socketcan_tx_drops_unavailable", "if", iface, "error", err)
+		return
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		n, err := canTxDropped(iface)
+		if err != nil {
+			continue // interface gone for now; the RX loop reports it
+		}
+		if n < last { // counters reset, e.g. the interface was recreated
+			last = 0
+		}
+		if d := n - last; d > 0 {
+			metrics.AddSocketCANKernelTxDrops(d)
+			l.Warn("socketcan_kernel_tx_drops", "if", iface, "dropped", d, "total", n)
+		}
+		last = n
+	}
 }
@@ -2,17 +2,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"io"
 	"log/slog"
+	"slices"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
 	"github.com/kstaniek/go-ampio-server/internal/hub"
 	"github.com/kstaniek/go-ampio-server/internal/metrics"
 	"github.com/kstaniek/go-ampio-server/internal/serial"
 	"github.com/kstaniek/go-ampio-server/internal/socketcan"
+	"github.com/kstaniek/go-ampio-server/internal/transport"
 )
 
 // fakeSerialPort implements serial.Port for tests.
@@ -73,7 +77,7 @@ func TestInitSerialBackendBasic(t *testing.T) {
 
 	cfg := &appConfig{backend: "serial", serialDev: "fake", baud: 115200, serialReadTO: 50 * time.Millisecond}
 	var wg sync.WaitGroup
-	send, cleanup, err := initSerialBackend(ctx, cfg, h, testLogger(), &wg)
+	tx, cleanup, err := initSerialBackend(ctx, cfg, h, testLogger(), &wg)
 	if err != nil {
 		t.Fatalf("initSerialBackend: %v", err)
 	}
@@ -90,7 +94,7 @@ func TestInitSerialBackendBasic(t *testing.T) {
 	}
 
 	// send path sanity (should not error)
-	if err := send(frame); err != nil {
+	if err := tx.send(frame); err != nil {
 		t.Fatalf("send frame: %v", err)
 	}
 
@@ -100,6 +104,73 @@ func TestInitSerialBackendBasic(t *testing.T) {
 	}
 }
 
+// TestInitSerialBackendPipeline runs the serial RX loop with -rx-pipeline:
+// a frame split across reads is decoded on the decode stage and broadcast,
+// and the stages stop with the loop.
+func TestInitSerialBackendPipeline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	enc := serTestWireEnvelope([]byte{0, 0, 0x01, 0x23, 0x42, 0x43})
+	openSerialPort = func(name string, baud int, to time.Duration) (serial.Port, error) {
+		return &fakeSerialPort{reads: [][]byte{enc[:3], enc[3:]}}, nil
+	}
+	defer func() { openSerialPort = serial.Open }()
+
+	h := hub.New()
+	c := &hub.Client{Out: make(chan can.Frame, 1), Closed: make(chan struct{})}
+	h.Add(c)
+	cfg := &appConfig{backend: "serial", serialDev: "fake", baud: 115200, serialReadTO: 50 * time.Millisecond, rxPipeline: 4}
+	var wg sync.WaitGroup
+	_, cleanup, err := initSerialBackend(ctx, cfg, h, testLogger(), &wg)
+	if err != nil {
+		t.Fatalf("initSerialBackend: %v", err)
+	}
+	select {
+	case fr := <-c.Out:
+		if fr.CANID&can.CAN_EFF_MASK != 0x123 || fr.Len != 2 || fr.Data[1] != 0x43 {
+			t.Fatalf("unexpected frame: %+v", fr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for frame")
+	}
+	cancel()
+	cleanup()
+	wg.Wait()
+}
+
+func TestInitSLCANBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	openSerialPort = func(name string, baud int, to time.Duration) (serial.Port, error) {
+		return &fakeSerialPort{reads: [][]byte{[]byte("\r\rT012"), []byte("345672AB01\r")}}, nil
+	}
+	defer func() { openSerialPort = serial.Open }()
+
+	h := hub.New()
+	c := &hub.Client{Out: make(chan can.Frame, 1), Closed: make(chan struct{})}
+	h.Add(c)
+	cfg := &appConfig{backend: "slcan", serialDev: "fake", baud: 115200, serialReadTO: 50 * time.Millisecond, slcanBitrate: 500000}
+	var wg sync.WaitGroup
+	tx, cleanup, err := initSLCANBackend(ctx, cfg, h, testLogger(), &wg)
+	if err != nil {
+		t.Fatalf("initSLCANBackend: %v", err)
+	}
+	select {
+	case fr := <-c.Out:
+		if fr.CANID != 0x01234567|can.CAN_EFF_FLAG || fr.Len != 2 || fr.Data[0] != 0xAB {
+			t.Fatalf("unexpected frame: %+v", fr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for frame")
+	}
+	if err := tx.send(can.Frame{CANID: 0x123, Len: 12}); !errors.Is(err, transport.ErrUnsupported) {
+		t.Fatalf("FD frame: %v", err)
+	}
+	cancel()
+	cleanup()
+	wg.Wait()
+}
+
 // TestInitSocketCANBackendBasic ensures a frame is broadcast and metrics increment.
 // testLogger returns a no-op slog.Logger for tests.
 func testLogger() *slog.Logger { return slog.New(slog.NewTextHandler(io.Discard, nil)) }
@@ -150,11 +221,13 @@ func TestInitSocketCANBackendBasic(t *testing.T) {
 	frame := can.Frame{CANID: 0x555, Len: 3}
 	frame.Data[0], frame.Data[1], frame.Data[2] = 0x01, 0x02, 0x03
 
-	openSocketCANDevice = func(iface string) (socketcan.Dev, error) {
+	openSocketCANDevice = func(string, ...socketcan.Option) (socketcan.Dev, error) {
 		return &fakeSocketDev{frames: []can.Frame{frame}, errAfter: true}, nil
 	}
 	defer func() {
-		openSocketCANDevice = func(iface string) (socketcan.Dev, error) { return socketcan.Open(iface) }
+		openSocketCANDevice = func(iface string, opts ...socketcan.Option) (socketcan.Dev, error) {
+			return socketcan.Open(iface, opts...)
+		}
 	}()
 
 	h := hub.New()
@@ -162,7 +235,7 @@ func TestInitSocketCANBackendBasic(t *testing.T) {
 	h.Add(c)
 	cfg := &appConfig{backend: "socketcan", canIf: "vcan0"}
 	var wg sync.WaitGroup
-	send, cleanup, err := initSocketCANBackend(ctx, cfg, h, testLogger(), &wg)
+	tx, cleanup, err := initSocketCANBackend(ctx, cfg, h, testLogger(), &wg)
 	if err != nil {
 		t.Fatalf("initSocketCANBackend: %v", err)
 	}
@@ -177,7 +250,7 @@ func TestInitSocketCANBackendBasic(t *testing.T) {
 		t.Fatal("timeout waiting for socketcan frame")
 	}
 
-	if err := send(frame); err != nil {
+	if err := tx.send(frame); err != nil {
 		t.Fatalf("send frame: %v", err)
 	}
 	// Allow read error path to trigger once.
@@ -190,3 +263,155 @@ func TestInitSocketCANBackendBasic(t *testing.T) {
 		t.Fatalf("expected at least one error increment (read error after frame)")
 	}
 }
+
+// ownSocketDev reports every frame as looped back from this socket.
+type ownSocketDev struct{ fakeSocketDev }
+
+func (d *ownSocketDev) ReadFrameOwn(fr *can.Frame) (bool, error) { return true, d.ReadFrame(fr) }
+
+func TestInitSocketCANBackendOwnFrames(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	openSocketCANDevice = func(string, ...socketcan.Option) (socketcan.Dev, error) {
+		return &ownSocketDev{fakeSocketDev{frames: []can.Frame{{CANID: 0x123, Len: 1}}}}, nil
+	}
+	defer func() {
+		openSocketCANDevice = func(iface string, opts ...socketcan.Option) (socketcan.Dev, error) {
+			return socketcan.Open(iface, opts...)
+		}
+	}()
+
+	h := hub.New()
+	c := &hub.Client{Out: make(chan can.Frame, 1), Closed: make(chan struct{})}
+	h.Add(c)
+	before := metrics.Snap()
+	var wg sync.WaitGroup
+	_, cleanup, err := initSocketCANBackend(ctx, &appConfig{backend: "socketcan", canIf: "vcan0"}, h, testLogger(), &wg)
+	if err != nil {
+		t.Fatalf("initSocketCANBackend: %v", err)
+	}
+	defer cleanup()
+	select {
+	case <-c.Out: // own frames still reach clients
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("timeout waiting for own frame")
+	}
+	after := metrics.Snap()
+	if after.SocketCANOwn-before.SocketCANOwn != 1 || after.SocketCANRx != before.SocketCANRx {
+		t.Fatalf("own=%d rx=%d, want own frame counted apart", after.SocketCANOwn-before.SocketCANOwn, after.SocketCANRx-before.SocketCANRx)
+	}
+}
+
+// writeSocketDev records written frames; reads yield its frames once.
+type writeSocketDev struct {
+	fakeSocketDev
+	mu      sync.Mutex
+	written []uint32
+}
+
+func (d *writeSocketDev) WriteFrame(fr can.Frame) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.written = append(d.written, fr.CANID)
+	return nil
+}
+
+func (d *writeSocketDev) sent() []uint32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.written)
+}
+
+func TestInitSocketCANBackendMultiIface(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	devs := map[string]*writeSocketDev{
+		"vcan0": {fakeSocketDev: fakeSocketDev{frames: []can.Frame{{CANID: 0x10, Len: 1}}}},
+		"vcan1": {fakeSocketDev: fakeSocketDev{frames: []can.Frame{{CANID: 0x11, Len: 1}}}},
+	}
+	openSocketCANDevice = func(iface string, _ ...socketcan.Option) (socketcan.Dev, error) {
+		return devs[iface], nil
+	}
+	defer func() {
+		openSocketCANDevice = func(iface string, opts ...socketcan.Option) (socketcan.Dev, error) {
+			return socketcan.Open(iface, opts...)
+		}
+	}()
+
+	h := hub.New()
+	c := &hub.Client{Out: make(chan can.Frame, 2), Closed: make(chan struct{})}
+	h.Add(c)
+	cfg := &appConfig{backend: "socketcan", canIf: "vcan0,vcan1", canTxRoute: "0x100-0x1FF=vcan1"}
+	var wg sync.WaitGroup
+	tx, cleanup, err := initSocketCANBackend(ctx, cfg, h, testLogger(), &wg)
+	if err != nil {
+		t.Fatalf("initSocketCANBackend: %v", err)
+	}
+	defer cleanup()
+
+	for range 2 {
+		select {
+		case fr := <-c.Out:
+			if want := uint8(fr.CANID - 0x10); fr.Iface != want {
+				t.Fatalf("frame %03X tagged with interface %d, want %d", fr.CANID, fr.Iface, want)
+			}
+		case <-time.After(200 * time.Millisecond):
+			t.Fatal("timeout waiting for socketcan frames")
+		}
+	}
+	for _, id := range []uint32{0x150, 0x200} {
+		if err := tx.wait(ctx, can.Frame{CANID: id, Len: 1}); err != nil {
+			t.Fatalf("send %03X: %v", id, err)
+		}
+	}
+	if got := devs["vcan0"].sent(); !slices.Equal(got, []uint32{0x200}) {
+		t.Fatalf("vcan0 sent %X, want the unrouted frame only", got)
+	}
+	if got := devs["vcan1"].sent(); !slices.Equal(got, []uint32{0x150, 0x200}) {
+		t.Fatalf("vcan1 sent %X, want both frames", got)
+	}
+}
+
+func TestWatchCANTxDrops(t *testing.T) {
+	var mu sync.Mutex
+	counts := []uint64{5, 5, 9, 2} // the last one is a counter reset
+	canTxDropped = func(string) (uint64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		n := counts[0]
+		if len(counts) > 1 {
+			counts = counts[1:]
+		}
+		return n, nil
+	}
+	defer func() { canTxDropped = socketcan.TxDropped }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	before := metrics.Snap()
+	done := make(chan struct{})
+	go func() { watchCANTxDrops(ctx, "vcan0", time.Millisecond, testLogger()); close(done) }()
+	deadline := time.Now().Add(time.Second)
+	for metrics.Snap().SocketCANKDrop-before.SocketCANKDrop < 6 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	if d := metrics.Snap().SocketCANKDrop - before.SocketCANKDrop; d != 6 {
+		t.Fatalf("kernel tx drops = %d, want 6 (4 + 2 after the reset)", d)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	for _, tc := range []struct {
+		cfg  appConfig
+		want cnl.Ident
+	}{
+		{appConfig{backend: "socketcan", canIf: "can1"}, cnl.Ident{Version: version, Backend: "socketcan", Bus: "can1"}},
+		{appConfig{backend: "socketcan", canIf: "can1", name: "upstairs"}, cnl.Ident{Version: version, Backend: "socketcan", Bus: "upstairs"}},
+		{appConfig{backend: "cannelloni-udp:10.0.0.2:20000", canIf: "can0"}, cnl.Ident{Version: version, Backend: "cannelloni-udp"}},
+	} {
+		if got := tc.cfg.identity(); got != tc.want {
+			t.Fatalf("%s: got %+v, want %+v", tc.cfg.backend, got, tc.want)
+		}
+	}
+}
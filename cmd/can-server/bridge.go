@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/bridge"
+)
+
+// bridgeSpecs parses -bridge and checks every route names a configured
+// instance. Bridging needs [instance.*] sections (named instances).
+func (c *appConfig) bridgeSpecs(insts []*appConfig) ([]bridge.Spec, error) {
+	specs, err := bridge.ParseSpecs(c.bridge)
+	if err != nil || len(specs) == 0 {
+		return nil, err
+	}
+	names := make(map[string]bool, len(insts))
+	for _, ic := range insts {
+		if ic.name != "" {
+			names[ic.name] = true
+		}
+	}
+	for _, sp := range specs {
+		for _, n := range []string{sp.From, sp.To} {
+			if !names[n] {
+				return nil, fmt.Errorf("bridge %s: unknown instance %q", sp, n)
+			}
+		}
+	}
+	return specs, nil
+}
+
+// startBridge wires the configured routes between running instances and
+// pumps them until ctx is cancelled. It returns nil when no routes are set.
+func startBridge(ctx context.Context, cfg *appConfig, insts []*instance, l *slog.Logger, wg *sync.WaitGroup) (*bridge.Bridge, error) {
+	cfgs := make([]*appConfig, len(insts))
+	byName := make(map[string]*instance, len(insts))
+	for i, in := range insts {
+		cfgs[i] = in.cfg
+		byName[in.name] = in
+	}
+	specs, err := cfg.bridgeSpecs(cfgs)
+	if err != nil || len(specs) == 0 {
+		return nil, err
+	}
+	br := bridge.New(cfg.bridgeTTL, 0)
+	for _, sp := range specs {
+		from, to := byName[sp.From], byName[sp.To]
+		if _, err := br.Add(
+			bridge.Endpoint{Name: from.name, Hub: from.hub, Send: from.tx.send},
+			bridge.Endpoint{Name: to.name, Hub: to.hub, Send: to.tx.send},
+		); err != nil {
+			return nil, err
+		}
+		l.Info("bridge_route", "from", sp.From, "to", sp.To)
+	}
+	wg.Add(1)
+	go func() { defer wg.Done(); br.Run(ctx) }()
+	return br, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+)
+
+// canIfaces returns the SocketCAN interfaces of -can-if, a comma separated
+// list.
+func (c *appConfig) canIfaces() []string {
+	var out []string
+	for _, s := range strings.Split(c.canIf, ",") {
+		out = append(out, strings.TrimSpace(s))
+	}
+	return out
+}
+
+// validateCANIfaces checks -can-if and -can-tx-route of the socketcan
+// backend.
+func (c *appConfig) validateCANIfaces() error {
+	if kind, _ := splitBackend(c.backend); kind != "socketcan" {
+		if c.canTxRoute != "" {
+			return fmt.Errorf("can-tx-route requires the socketcan backend")
+		}
+		return nil
+	}
+	ifaces := c.canIfaces()
+	for i, s := range ifaces {
+		if s == "" {
+			return fmt.Errorf("can-if: empty interface name in %q", c.canIf)
+		}
+		if slices.Contains(ifaces[:i], s) {
+			return fmt.Errorf("can-if: %s listed twice", s)
+		}
+	}
+	if len(ifaces) > 256 { // frames carry the index in a byte
+		return fmt.Errorf("can-if: at most 256 interfaces")
+	}
+	if c.canTxRoute != "" && len(ifaces) < 2 {
+		return fmt.Errorf("can-tx-route needs several can-if interfaces")
+	}
+	if _, err := parseTxRoute(c.canTxRoute, ifaces); err != nil {
+		return fmt.Errorf("can-tx-route: %w", err)
+	}
+	return nil
+}
+
+// txRoute decides which interfaces of a multi-interface backend transmit a
+// client frame: the first rule matching the frame ID wins, frames no rule
+// matches go to all interfaces.
+type txRoute struct {
+	rules []txRouteRule
+	all   []int
+}
+
+type txRouteRule struct {
+	ids     *filter.Filter // nil matches every ID
+	targets []int
+}
+
+// parseTxRoute parses "<ids>=<iface>[,<iface>]" rules separated by ";".
+// ids is a filter list (see -rx-allow) or * for every ID.
+func parseTxRoute(spec string, ifaces []string) (*txRoute, error) {
+	rt := &txRoute{}
+	for i := range ifaces {
+		rt.all = append(rt.all, i)
+	}
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		ids, names, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("rule %q: want <ids>=<iface>[,<iface>]", part)
+		}
+		ids = strings.TrimSpace(ids)
+		if ids == "*" {
+			ids = ""
+		} else if ids == "" {
+			return nil, fmt.Errorf("rule %q: no IDs (use * for all)", part)
+		}
+		f, err := filter.New(ids, "")
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", part, err)
+		}
+		r := txRouteRule{ids: f}
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+			j := slices.Index(ifaces, name)
+			if j < 0 {
+				return nil, fmt.Errorf("rule %q: %q is not in can-if", part, name)
+			}
+			if !slices.Contains(r.targets, j) {
+				r.targets = append(r.targets, j)
+			}
+		}
+		rt.rules = append(rt.rules, r)
+	}
+	return rt, nil
+}
+
+// targets returns the interface indexes transmitting fr.
+func (rt *txRoute) targets(fr *can.Frame) []int {
+	for _, r := range rt.rules {
+		if r.ids.Allow(fr) {
+			return r.targets
+		}
+	}
+	return rt.all
+}
+
+// routedTx combines the transmit paths of the interfaces of one backend
+// under rt. A frame routed to several interfaces is sent on each; the
+// first error is returned. The queue reported is the fullest one.
+func routedTx(txs []backendTx, rt *txRoute) backendTx {
+	return backendTx{
+		send: func(fr can.Frame) error {
+			var first error
+			for _, i := range rt.targets(&fr) {
+				if err := txs[i].send(fr); err != nil && first == nil {
+					first = err
+				}
+			}
+			return first
+		},
+		sendWait: func(ctx context.Context, fr can.Frame) error {
+			var first error
+			for _, i := range rt.targets(&fr) {
+				if err := txs[i].wait(ctx, fr); err != nil && first == nil {
+					first = err
+				}
+			}
+			return first
+		},
+		queue: func() (depth, capacity int) {
+			fill := -1.0
+			for _, t := range txs {
+				if t.queue == nil {
+					continue
+				}
+				d, c := t.queue()
+				if c > 0 && float64(d)/float64(c) > fill {
+					depth, capacity, fill = d, c, float64(d)/float64(c)
+				}
+			}
+			return depth, capacity
+		},
+	}
+}
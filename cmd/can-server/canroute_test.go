@@ -0,0 +1,56 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestParseTxRoute(t *testing.T) {
+	ifaces := []string{"can0", "can1", "can2"}
+	rt, err := parseTxRoute("0x100-0x1FF = can1; 0x18FF0000/0x1FFF0000=can2, can0; *=can0", ifaces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		id   uint32
+		want []int
+	}{
+		{0x150, []int{1}},
+		{0x18FF1234 | can.CAN_EFF_FLAG, []int{2, 0}},
+		{0x7FF, []int{0}},
+	} {
+		if got := rt.targets(&can.Frame{CANID: tc.id}); !slices.Equal(got, tc.want) {
+			t.Errorf("%X: targets %v, want %v", tc.id, got, tc.want)
+		}
+	}
+	if rt, _ := parseTxRoute("", ifaces); !slices.Equal(rt.targets(&can.Frame{CANID: 1}), []int{0, 1, 2}) {
+		t.Error("no rules must route to all interfaces")
+	}
+	for _, spec := range []string{"0x100", "=can0", "0x100=can9", "0xZZ=can0"} {
+		if _, err := parseTxRoute(spec, ifaces); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+}
+
+func TestValidateCANIfaces(t *testing.T) {
+	for _, tc := range []struct {
+		backend, canIf, route string
+		ok                    bool
+	}{
+		{"socketcan", "can0", "", true},
+		{"socketcan", "can0,can1", "0x100=can1", true},
+		{"socketcan", "can0,,can1", "", false},
+		{"socketcan", "can0,can0", "", false},
+		{"socketcan", "can0", "0x100=can0", false},
+		{"serial", "", "", true},
+		{"serial", "can0,can1", "0x100=can1", false},
+	} {
+		c := &appConfig{backend: tc.backend, canIf: tc.canIf, canTxRoute: tc.route}
+		if err := c.validateCANIfaces(); (err == nil) != tc.ok {
+			t.Errorf("%s can-if=%q route=%q: err=%v", tc.backend, tc.canIf, tc.route, err)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// effective returns the resolved configuration as flag-name/value pairs in
+// flag declaration order. Secrets are redacted.
+func (c *appConfig) effective() [][2]string {
+	redact := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return "<redacted>"
+	}
+	return [][2]string{
+		{"backend", c.backend},
+		{"serial", c.serialDev},
+		{"baud", strconv.Itoa(c.baud)},
+		{"serial-read-timeout", c.serialReadTO.String()},
+		{"serial-no-checksum", strconv.FormatBool(c.serialNoChecksum)},
+		{"slcan-bitrate", strconv.Itoa(c.slcanBitrate)},
+		{"can-if", c.canIf},
+		{"can-loopback", strconv.FormatBool(c.canLoopback)},
+		{"can-recv-own", strconv.FormatBool(c.canRecvOwn)},
+		{"can-busy-poll", c.canBusyPoll.String()},
+		{"can-spin", c.canSpin.String()},
+		{"can-tx-wait", c.canTxWait.String()},
+		{"can-txqueuelen", strconv.Itoa(c.canTxQueueLen)},
+		{"can-tx-drop-poll", c.canTxDropPoll.String()},
+		{"can-err-filter", c.canErrFilter},
+		{"can-tx-route", c.canTxRoute},
+		{"normalize-eff", c.normalizeEFF},
+		{"normalize-flags", c.normalizeFlags},
+		{"normalize-strip-err", strconv.FormatBool(c.normalizeStripErr)},
+		{"udp-local", c.udpLocal},
+		{"upstream-tx-buffer", strconv.Itoa(c.upstreamTxBuffer)},
+		{"upstream-ping", c.upstreamPing.String()},
+		{"upstream-compression", strconv.FormatBool(c.upstreamCompression)},
+		{"upstream-packet-framing", strconv.FormatBool(c.upstreamPacketFraming)},
+		{"replay-file", c.replayFile},
+		{"replay-speed", strconv.FormatFloat(c.replaySpeed, 'g', -1, 64)},
+		{"replay-loop", strconv.FormatBool(c.replayLoop)},
+		{"replay-tx-file", c.replayTxFile},
+		{"rx-allow", c.rxAllow},
+		{"rx-deny", c.rxDeny},
+		{"tx-allow", c.txAllow},
+		{"tx-deny", c.txDeny},
+		{"rx-transform", c.rxTransform},
+		{"tx-transform", c.txTransform},
+		{"tx-dedup-window", c.txDedupWindow.String()},
+		{"tx-dedup-ids", c.txDedupIDs},
+		{"tx-priority-ids", c.txPriorityIDs},
+		{"tx-inhibit", c.txInhibit},
+		{"arbitration-id", c.arbID},
+		{"arbitration-priority", strconv.Itoa(c.arbPriority)},
+		{"arbitration-interval", c.arbInterval.String()},
+		{"tx-dry-run", strconv.FormatBool(c.txDryRun)},
+		{"cyclic-tx", c.cyclicTx},
+		{"heartbeat-frame", c.hbFrame},
+		{"heartbeat-interval", c.hbInterval.String()},
+		{"heartbeat-target", c.hbTarget},
+		{"heartbeat-counter", strconv.FormatBool(c.hbCounter)},
+		{"wait-device", c.waitDevice.String()},
+		{"rx-watchdog", c.rxWatchdog.String()},
+		{"rx-watchdog-restart", strconv.FormatBool(c.rxWatchdogRestart)},
+		{"rx-pipeline", strconv.Itoa(c.rxPipeline)},
+		{"emulate", c.emulate},
+		{"listen", c.listenAddr},
+		{"port-sniff", strconv.FormatBool(c.portSniff)},
+		{"packet-framing", strconv.FormatBool(c.packetFraming)},
+		{"fd-bit", c.fdBit},
+		{"compression", strconv.FormatBool(c.compression)},
+		{"compression-min-saving", strconv.Itoa(c.compressSaving)},
+		{"max-clients", strconv.Itoa(c.maxClients)},
+		{"conn-rate", strconv.Itoa(c.connRate)},
+		{"conn-ban", c.connBan.String()},
+		{"handshake-timeout", c.handshakeTO.String()},
+		{"client-read-timeout", c.clientReadTO.String()},
+		{"flush-interval", c.flushInterval.String()},
+		{"batch-size", strconv.Itoa(c.batchSize)},
+		{"read-buffer", strconv.Itoa(c.readBuffer)},
+		{"max-decode-bytes", strconv.Itoa(c.maxDecodeBytes)},
+		{"max-burst-frames", strconv.Itoa(c.maxBurstFrames)},
+		{"burst-yield", c.burstYield.String()},
+		{"max-handshake-bytes", strconv.Itoa(c.maxHandshake)},
+		{"session-grace", c.sessionGrace.String()},
+		{"session-replay", strconv.Itoa(c.sessionReplay)},
+		{"session-peer", c.sessionPeer},
+		{"session-peer-token", redact(c.sessionPeerToken)},
+		{"session-sync", c.sessionSync.String()},
+		{"hub-buffer", strconv.Itoa(c.hubBuffer)},
+		{"hub-policy", c.hubPolicy},
+		{"hub-workers", strconv.Itoa(c.hubWorkers)},
+		{"log-format", c.logFormat},
+		{"log-level", c.logLevel},
+		{"log-metrics-interval", c.logMetricsEvery.String()},
+		{"hub-sample-interval", c.hubSampleEvery.String()},
+		{"counter-audit", c.counterAudit.String()},
+		{"counter-audit-tolerance", strconv.Itoa(c.counterAuditTol)},
+		{"metrics-addr", c.metricsAddr},
+		{"metrics-bind-policy", c.metricsBind},
+		{"metrics-fallback-addr", c.metricsFallback},
+		{"metrics-namespace", c.metricsNS},
+		{"metrics-labels", c.metricsLabels},
+		{"http-allow", c.httpAllow},
+		{"ws-origins", c.wsOrigins},
+		{"control-socket", c.controlSocket},
+		{"annotate", c.annotate},
+		{"annotate-log", c.annotateLog},
+		{"alerts", c.alerts},
+		{"alert-webhook", c.alertWebhook},
+		{"alert-cooldown", c.alertCooldown.String()},
+		{"mqtt", c.mqtt},
+		{"mqtt-topic", c.mqttTopic},
+		{"mqtt-format", c.mqttFormat},
+		{"mqtt-qos", strconv.Itoa(c.mqttQoS)},
+		{"mqtt-retain", strconv.FormatBool(c.mqttRetain)},
+		{"mqtt-client-id", c.mqttClientID},
+		{"mqtt-username", c.mqttUsername},
+		{"mqtt-password", redact(c.mqttPassword)},
+		{"mqtt-tls-ca", c.mqttTLSCA},
+		{"mqtt-tls-cert", c.mqttTLSCert},
+		{"mqtt-tls-key", c.mqttTLSKey},
+		{"mqtt-tx-topic", c.mqttTxTopic},
+		{"mqtt-tx-allow", c.mqttTxAllow},
+		{"ampio-events", c.ampioEvents},
+		{"ampio-prefix", c.ampioPrefix},
+		{"ampio-topic", c.ampioTopic},
+		{"ampio-devices", strconv.FormatBool(c.ampioDevices)},
+		{"store", c.store},
+		{"store-retention", c.storeRetention.String()},
+		{"store-max-frames", strconv.Itoa(c.storeMaxFrames)},
+		{"store-presence-timeout", c.storePresence.String()},
+		{"clock-step-policy", c.clockPolicy},
+		{"clock-step-threshold", c.clockThreshold.String()},
+		{"capture-size", strconv.Itoa(c.captureSize)},
+		{"capture-trigger", c.captureTrigger},
+		{"capture-trigger-dir", c.captureTrigDir},
+		{"capture-trigger-pre", c.captureTrigPre.String()},
+		{"capture-trigger-post", c.captureTrigPost.String()},
+		{"capture-trigger-keep", strconv.Itoa(c.captureTrigKeep)},
+		{"bridge", c.bridge},
+		{"bridge-ttl", strconv.Itoa(c.bridgeTTL)},
+		{"pair-key", redact(c.pairKey)},
+		{"pair-port", strconv.Itoa(c.pairPort)},
+		{"mdns-enable", strconv.FormatBool(c.mdnsEnable)},
+		{"mdns-name", c.mdnsName},
+		{"dump-dir", c.dumpDir},
+		{"event-history", strconv.Itoa(c.eventRingSize)},
+		{"memory-limit-mb", strconv.Itoa(c.memoryLimitMB)},
+		{"frame-validation", c.frameValidation},
+		{"auth-token", redact(c.authToken)},
+		{"token-file", c.tokenFile},
+		{"access-file", c.accessFile},
+		{"client-role", c.clientRole},
+		{"client-roles", c.clientRoles},
+		{"tls-cert", c.tlsCert},
+		{"tls-key", c.tlsKey},
+		{"tls-client-ca", c.tlsClientCA},
+	}
+}
+
+// runCheckConfig prints the effective configuration, optionally probes the
+// backend and returns the process exit code (0 = OK).
+func runCheckConfig(w io.Writer, cfg *appConfig) int {
+	if cfg.configFile != "" {
+		fmt.Fprintf(w, "# config file: %s\n", cfg.configFile)
+	}
+	fmt.Fprintf(w, "# env prefix: %s\n", envPrefix())
+	for _, kv := range cfg.effective() {
+		fmt.Fprintf(w, "%s = %q\n", kv[0], kv[1])
+	}
+	failed := false
+	if tok, err := loadAuthToken(cfg); err != nil {
+		fmt.Fprintf(w, "# FAIL auth token: %v\n", err)
+		failed = true
+	} else if _, err := loadAccess(cfg, tok); err != nil {
+		fmt.Fprintf(w, "# FAIL access file: %v\n", err)
+		failed = true
+	}
+	if cfg.checkProbe {
+		if err := probeBackend(cfg); err != nil {
+			fmt.Fprintf(w, "# FAIL backend probe: %v\n", err)
+			failed = true
+		} else {
+			fmt.Fprintf(w, "# backend probe OK (%s)\n", cfg.backend)
+		}
+	}
+	if failed {
+		return 1
+	}
+	fmt.Fprintln(w, "# configuration OK")
+	return 0
+}
+
+// probeBackend checks the backend device is present without opening it for
+// writing or changing its state.
+func probeBackend(cfg *appConfig) error {
+	kind, arg := splitBackend(cfg.backend)
+	switch kind {
+	case "serial", "slcan":
+		f, err := os.OpenFile(cfg.serialDev, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			return fmt.Errorf("serial %s: %w", cfg.serialDev, err)
+		}
+		return f.Close()
+	case "socketcan":
+		for _, iface := range cfg.canIfaces() {
+			ifi, err := net.InterfaceByName(iface)
+			if err != nil {
+				return fmt.Errorf("can-if %s: %w", iface, err)
+			}
+			if ifi.Flags&net.FlagUp == 0 {
+				return fmt.Errorf("can-if %s is down", iface)
+			}
+		}
+		return nil
+	case "loopback":
+		return nil
+	case "replay":
+		_, err := readCandumpFile(cfg.replayFile)
+		return err
+	case backendCannelloniUDP:
+		if _, err := net.ResolveUDPAddr("udp", arg); err != nil {
+			return fmt.Errorf("cannelloni-udp remote %s: %w", arg, err)
+		}
+		return nil
+	case backendCannelloniTCP:
+		if _, err := net.ResolveTCPAddr("tcp", arg); err != nil {
+			return fmt.Errorf("cannelloni-tcp upstream %s: %w", arg, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown backend %q", cfg.backend)
+	}
+}
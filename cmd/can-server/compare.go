@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/capture"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+// compareMaxListed bounds the unmatched frames printed per side.
+const compareMaxListed = 50
+
+// compareSide is one backend taking part in -compare.
+type compareSide struct {
+	label string
+	cfg   *appConfig
+	recs  []capture.Record
+	err   error
+}
+
+// compareSides returns the two backends -compare captures from: the serial
+// and socketcan backends of a single-instance config, or the two configured
+// instances.
+func (c *appConfig) compareSides() ([2]*compareSide, error) {
+	var sides [2]*compareSide
+	insts, err := c.instanceConfigs()
+	if err != nil {
+		return sides, err
+	}
+	if len(c.instances) == 0 {
+		for i, kind := range []string{"serial", "socketcan"} {
+			ic := *c
+			ic.backend = kind
+			sides[i] = &compareSide{label: kind, cfg: &ic}
+		}
+		return sides, nil
+	}
+	if len(insts) != 2 {
+		return sides, fmt.Errorf("compare needs exactly two instances (have %d)", len(insts))
+	}
+	for i, ic := range insts {
+		sides[i] = &compareSide{label: ic.name, cfg: ic}
+	}
+	return sides, nil
+}
+
+// runCompare captures from two backends attached to the same physical bus
+// for cfg.compareFor, then reports frames seen on only one of them and the
+// receive-time skew of the rest. It returns the process exit code (0 = both
+// captures agree).
+func runCompare(ctx context.Context, w io.Writer, cfg *appConfig, l *slog.Logger) int {
+	sides, err := cfg.compareSides()
+	if err != nil {
+		fmt.Fprintf(w, "FAIL configuration: %v\n", err)
+		return 1
+	}
+	a, b := sides[0], sides[1]
+	fmt.Fprintf(w, "# compare a=%s (%s) b=%s (%s) duration=%s tolerance=%s\n",
+		a.label, backendTarget(a.cfg), b.label, backendTarget(b.cfg), cfg.compareFor, cfg.compareTolerance)
+	var wg sync.WaitGroup
+	for _, s := range sides {
+		wg.Add(1)
+		go func(s *compareSide) {
+			defer wg.Done()
+			s.recs, s.err = compareCapture(ctx, s.cfg, cfg.compareFor, l)
+		}(s)
+	}
+	wg.Wait()
+	failed := false
+	for _, s := range sides {
+		if s.err != nil {
+			fmt.Fprintf(w, "FAIL %s backend open: %v\n", s.label, s.err)
+			failed = true
+		}
+	}
+	if failed {
+		fmt.Fprintln(w, "# compare FAIL")
+		return 1
+	}
+	d := capture.Compare(a.recs, b.recs, cfg.compareTolerance)
+	fmt.Fprintf(w, "# %s: %d frames, %s: %d frames\n", a.label, len(a.recs), b.label, len(b.recs))
+	if d.Matched > 0 {
+		fmt.Fprintf(w, "matched %d frames, skew %s-%s min=%s mean=%s max=%s\n",
+			d.Matched, b.label, a.label, d.SkewMin, d.SkewMean, d.SkewMax)
+	} else {
+		fmt.Fprintln(w, "matched 0 frames")
+	}
+	writeUnmatched(w, a.label, d.OnlyA)
+	writeUnmatched(w, b.label, d.OnlyB)
+	if len(d.OnlyA) > 0 || len(d.OnlyB) > 0 || d.Matched == 0 {
+		fmt.Fprintf(w, "# compare FAIL (%d only on %s, %d only on %s)\n", len(d.OnlyA), a.label, len(d.OnlyB), b.label)
+		return 1
+	}
+	fmt.Fprintln(w, "# compare PASS")
+	return 0
+}
+
+// compareCapture runs the backend of cfg against a private hub for d and
+// returns every frame it received with its receive time.
+func compareCapture(parent context.Context, cfg *appConfig, d time.Duration, l *slog.Logger) ([]capture.Record, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	var (
+		mu   sync.Mutex
+		recs []capture.Record
+	)
+	h := hub.New()
+	h.Tap = func(fr can.Frame) {
+		now := time.Now()
+		mu.Lock()
+		recs = append(recs, capture.Record{Time: now, Frame: fr})
+		mu.Unlock()
+	}
+	var wg sync.WaitGroup
+	_, cleanup, err := initBackend(ctx, cfg, h, l, &wg)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+	cleanup()
+	cancel()
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	return recs, nil
+}
+
+// writeUnmatched lists frames seen only by side, oldest first.
+func writeUnmatched(w io.Writer, side string, recs []capture.Record) {
+	for i, rec := range recs {
+		if i == compareMaxListed {
+			fmt.Fprintf(w, "ONLY %s ... %d more\n", side, len(recs)-i)
+			return
+		}
+		us := rec.Time.UnixMicro()
+		fmt.Fprintf(w, "ONLY %s (%d.%06d) %s\n", side, us/1e6, us%1e6, rec.Frame)
+	}
+}
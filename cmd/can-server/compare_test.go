@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/serial"
+)
+
+func TestCompareSides(t *testing.T) {
+	c := baseInstanceConfig()
+	sides, err := c.compareSides()
+	if err != nil || sides[0].cfg.backend != "serial" || sides[1].cfg.backend != "socketcan" || c.backend != "loopback" {
+		t.Fatalf("single instance: %+v, %+v, %v", sides[0], sides[1], err)
+	}
+	c.instances = []instanceSection{{name: "a", values: map[string]string{"listen": ":21000"}}}
+	if _, err := c.compareSides(); err == nil || !strings.Contains(err.Error(), "exactly two") {
+		t.Fatalf("expected instance count error, got %v", err)
+	}
+}
+
+func TestCompareSerialPair(t *testing.T) {
+	frame := serTestWireEnvelope([]byte{0, 0, 0x01, 0x23, 0xAA, 0x01})
+	openSerialPort = func(string, int, time.Duration) (serial.Port, error) {
+		return &fakeSerialPort{reads: [][]byte{frame}}, nil
+	}
+	defer func() { openSerialPort = serial.Open }()
+
+	c := baseInstanceConfig()
+	c.backend = "serial"
+	c.compareFor = 100 * time.Millisecond
+	c.compareTolerance = time.Second
+	c.instances = []instanceSection{
+		{name: "usb", values: map[string]string{"listen": ":21000", "serial": "/dev/ttyUSB0"}},
+		{name: "uart", values: map[string]string{"listen": ":21001", "serial": "/dev/ttyS1"}},
+	}
+	var out bytes.Buffer
+	if code := runCompare(context.Background(), &out, &c, testLogger()); code != 0 {
+		t.Fatalf("exit %d, report:\n%s", code, out.String())
+	}
+	for _, want := range []string{"a=usb (serial /dev/ttyUSB0) b=uart (serial /dev/ttyS1)", "matched 1 frames", "# compare PASS"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("report missing %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -4,30 +4,207 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/activation"
+	"github.com/kstaniek/go-ampio-server/internal/annotate"
+	"github.com/kstaniek/go-ampio-server/internal/arbiter"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/clock"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/cyclic"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/inhibit"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/pairing"
+	"github.com/kstaniek/go-ampio-server/internal/secret"
+	"github.com/kstaniek/go-ampio-server/internal/slcan"
+	"github.com/kstaniek/go-ampio-server/internal/socketcan"
+	"github.com/kstaniek/go-ampio-server/internal/stream"
+	"github.com/kstaniek/go-ampio-server/internal/validate"
 )
 
 type appConfig struct {
-	serialDev       string
-	baud            int
-	listenAddr      string
-	serialReadTO    time.Duration
-	logFormat       string
-	logLevel        string
-	metricsAddr     string
-	hubBuffer       int
-	hubPolicy       string
-	logMetricsEvery time.Duration
-	backend         string
-	canIf           string
-	maxClients      int
-	handshakeTO     time.Duration
-	clientReadTO    time.Duration
-	mdnsEnable      bool
-	mdnsName        string
+	serialDev             string
+	baud                  int
+	listenAddr            string
+	serialReadTO          time.Duration
+	serialNoChecksum      bool
+	slcanBitrate          int
+	logFormat             string
+	logLevel              string
+	metricsAddr           string
+	metricsBind           string
+	metricsFallback       string
+	metricsNS             string
+	metricsLabels         string
+	controlSocket         string
+	httpAllow             string
+	wsOrigins             string
+	annotate              string
+	annotateLog           string
+	alerts                string
+	alertWebhook          string
+	alertCooldown         time.Duration
+	mqtt                  string
+	mqttTopic             string
+	mqttFormat            string
+	mqttQoS               int
+	mqttRetain            bool
+	mqttClientID          string
+	mqttUsername          string
+	mqttPassword          string
+	mqttTLSCA             string
+	mqttTLSCert           string
+	mqttTLSKey            string
+	mqttTxTopic           string
+	mqttTxAllow           string
+	ampioEvents           string
+	ampioPrefix           string
+	ampioTopic            string
+	ampioDevices          bool
+	store                 string
+	storeRetention        time.Duration
+	storeMaxFrames        int
+	storePresence         time.Duration
+	clockPolicy           string
+	clockThreshold        time.Duration
+	hubBuffer             int
+	hubPolicy             string
+	hubWorkers            int
+	logMetricsEvery       time.Duration
+	hubSampleEvery        time.Duration
+	counterAudit          time.Duration
+	counterAuditTol       int
+	backend               string
+	canIf                 string
+	canLoopback           bool
+	canRecvOwn            bool
+	canBusyPoll           time.Duration
+	canSpin               time.Duration
+	canTxWait             time.Duration
+	canTxQueueLen         int
+	canTxDropPoll         time.Duration
+	canErrFilter          string
+	canTxRoute            string
+	normalizeEFF          string
+	normalizeFlags        string
+	normalizeStripErr     bool
+	packetFraming         bool
+	fdBit                 string
+	udpLocal              string
+	replayFile            string
+	replaySpeed           float64
+	replayLoop            bool
+	replayTxFile          string
+	upstreamTxBuffer      int
+	upstreamPing          time.Duration
+	upstreamCompression   bool
+	upstreamPacketFraming bool
+	rxAllow               string
+	rxDeny                string
+	txAllow               string
+	txDeny                string
+	rxTransform           string
+	txTransform           string
+	txDedupWindow         time.Duration
+	txDedupIDs            string
+	txPriorityIDs         string
+	txInhibit             string
+	arbID                 string
+	arbPriority           int
+	arbInterval           time.Duration
+	txDryRun              bool
+	cyclicTx              string
+	hbFrame               string
+	hbInterval            time.Duration
+	hbTarget              string
+	hbCounter             bool
+	rxWatchdog            time.Duration
+	waitDevice            time.Duration
+	rxWatchdogRestart     bool
+	rxPipeline            int
+	emulate               string
+	portSniff             bool
+	compression           bool
+	compressSaving        int
+	maxClients            int
+	connRate              int
+	connBan               time.Duration
+	handshakeTO           time.Duration
+	clientReadTO          time.Duration
+	flushInterval         time.Duration
+	batchSize             int
+	readBuffer            int
+	maxDecodeBytes        int
+	maxBurstFrames        int
+	burstYield            time.Duration
+	maxHandshake          int
+	captureSize           int
+	captureTrigger        string
+	captureTrigDir        string
+	captureTrigPre        time.Duration
+	captureTrigPost       time.Duration
+	captureTrigKeep       int
+	sessionGrace          time.Duration
+	sessionReplay         int
+	sessionPeer           string
+	sessionPeerToken      string
+	sessionSync           time.Duration
+	bridge                string
+	bridgeTTL             int
+	pairKey               string
+	pairPort              int
+	mdnsEnable            bool
+	mdnsName              string
+	dumpDir               string
+	eventRingSize         int
+	memoryLimitMB         int
+	frameValidation       string
+	authToken             string
+	tokenFile             string
+	accessFile            string
+	clientRole            string
+	clientRoles           string
+	tlsCert               string
+	tlsKey                string
+	tlsClientCA           string
+	configFile            string
+	checkConfig           bool
+	checkProbe            bool
+	doctor                bool
+	selfTest              bool
+	selfTestFor           time.Duration
+	selfTestProbe         string
+	compare               bool
+	compareFor            time.Duration
+	compareTolerance      time.Duration
+	assertGolden          string
+	assertFor             time.Duration
+	assertTolerance       time.Duration
+	assertRecord          string
+	diff                  string
+	diffAll               bool
+	soak                  time.Duration
+	soakClients           int
+	soakRate              int
+	soakInterval          time.Duration
+	soakLifetime          time.Duration
+	printDefaults         bool
+	// notes is the -annotate pipeline, built once in main and shared by
+	// every instance.
+	notes *annotate.Pipeline
+	// inherited holds the client sockets passed in by systemd, claimed by
+	// the instances at startup.
+	inherited *activation.Set
+	// name identifies a gateway instance in multi-instance mode ("" when single).
+	name      string
+	instances []instanceSection
+	vbuses    []instanceSection
 }
 
 func parseFlags() (*appConfig, bool) {
@@ -36,42 +213,366 @@ func parseFlags() (*appConfig, bool) {
 	baud := flag.Int("baud", 115200, "Serial baud rate")
 	listen := flag.String("listen", ":20000", "TCP listen address")
 	serialReadTO := flag.Duration("serial-read-timeout", 50*time.Millisecond, "Serial read timeout")
+	serialNoChecksum := flag.Bool("serial-no-checksum", false, "Neither verify nor compute serial frame checksums (trusted back-to-back links only; reported in metrics)")
+	slcanBitrate := flag.Int("slcan-bitrate", 500000, "CAN bitrate the slcan backend sets on the adapter (S0-S8 rates; 0 keeps the adapter setting)")
 	logFormat := flag.String("log-format", "text", "Log format: text|json")
 	logLevel := flag.String("log-level", "info", "Log level: debug|info|warn|error")
 	metricsAddr := flag.String("metrics-addr", "", "Metrics HTTP listen address (e.g., :9100); empty disables")
+	metricsBind := flag.String("metrics-bind-policy", metrics.BindWarn, "When metrics-addr is in use: warn (run without metrics)|fail (abort startup)|retry (bind in the background)|fallback (use metrics-fallback-addr)")
+	metricsFallback := flag.String("metrics-fallback-addr", ":0", "Metrics listen address used by metrics-bind-policy=fallback (:0 picks a free port)")
+	metricsNS := flag.String("metrics-namespace", "", "Prefix of every exported metric name, e.g. ampio (empty for none)")
+	metricsLabels := flag.String("metrics-labels", "", "Constant labels added to every exported metric, e.g. site=home,bus=main")
+	httpAllow := flag.String("http-allow", "", "Client CIDRs allowed to use the metrics/admin HTTP server, comma separated (empty allows all)")
+	wsOrigins := flag.String("ws-origins", "", "Browser origins besides the server's own allowed to open /api/ws, e.g. https://dash.lan, comma separated (* allows all)")
+	annotate := flag.String("annotate", "", "Frame decoders for annotations, comma separated: ampio[:0xNN][:<formats file>], j1939, dbc:<file> (empty disables)")
+	alerts := flag.String("alerts", "", "Alert rule file: thresholds, flapping and rate-of-change rules on decoded frame values (empty disables)")
+	alertWebhook := flag.String("alert-webhook", "", "URL receiving each fired alert as a JSON POST (empty disables)")
+	alertCooldown := flag.Duration("alert-cooldown", time.Minute, "Minimum time between two alerts of one rule for the same CAN ID")
+	mqttBroker := flag.String("mqtt", "", "MQTT broker bus frames are published to, e.g. tcp://broker.lan:1883 or mqtts://broker.lan (empty disables)")
+	mqttTopic := flag.String("mqtt-topic", "ampio/can/{id}", "MQTT topic of each frame; {id} is the hex CAN ID, {instance} the instance name")
+	mqttFormat := flag.String("mqtt-format", "json", "MQTT payload: json (id, data, timestamp) or raw (the data bytes)")
+	mqttQoS := flag.Int("mqtt-qos", 0, "MQTT QoS of published frames: 0 or 1")
+	mqttRetain := flag.Bool("mqtt-retain", false, "Publish frames as retained messages, so subscribers get the last frame of each topic at once")
+	mqttClientID := flag.String("mqtt-client-id", "", "MQTT client ID (default can-server-<hostname>)")
+	mqttUsername := flag.String("mqtt-username", "", "MQTT user name (empty connects anonymously)")
+	mqttPassword := flag.String("mqtt-password", "", "MQTT password (prefer CAN_SERVER_MQTT_PASSWORD_FILE)")
+	mqttTLSCA := flag.String("mqtt-tls-ca", "", "PEM CA bundle verifying a TLS broker (default system roots)")
+	mqttTLSCert := flag.String("mqtt-tls-cert", "", "PEM client certificate presented to a TLS broker (with -mqtt-tls-key)")
+	mqttTLSKey := flag.String("mqtt-tls-key", "", "PEM private key of -mqtt-tls-cert")
+	mqttTxTopic := flag.String("mqtt-tx-topic", "", "MQTT topic filter whose messages are sent to the bus; {instance} is the instance name (empty disables)")
+	mqttTxAllow := flag.String("mqtt-tx-allow", "", "CAN IDs -mqtt-tx-topic may send, in -rx-allow syntax (required with -mqtt-tx-topic)")
+	ampioEvents := flag.String("ampio-events", "", "Decode Ampio state broadcasts and send the states to: log, mqtt or log,mqtt (empty disables)")
+	ampioPrefix := flag.String("ampio-prefix", "0x1D", "Top ID byte of Ampio modules for -ampio-events and -ampio-devices")
+	ampioTopic := flag.String("ampio-topic", "ampio/state/{module}/{kind}", "MQTT topic of decoded Ampio states; {module} is the module address, {kind} the state kind, {instance} the instance name")
+	ampioDevices := flag.Bool("ampio-devices", false, "Learn the Ampio modules on the bus from their frames and list them at /api/devices")
+	storeSpec := flag.String("store", "", "Persistent history store for frames, per-ID state and presence, e.g. sqlite:/var/lib/can-server/history.db (empty disables)")
+	storeRetention := flag.Duration("store-retention", 24*time.Hour, "Delete stored history older than this (0 keeps it)")
+	storeMaxFrames := flag.Int("store-max-frames", 0, "Keep at most this many stored frames, oldest deleted first (0 = no cap)")
+	storePresence := flag.Duration("store-presence-timeout", 2*time.Minute, "Record a CAN ID offline after this long without frames (0 disables presence history)")
+	clockPolicy := flag.String("clock-step-policy", "correct", "Timestamps after a backward wall clock step: correct (stay monotonic, converge slowly) or flag (follow the clock); steps are logged either way")
+	clockThreshold := flag.Duration("clock-step-threshold", clock.DefaultThreshold, "Smallest wall clock jump treated as a step")
+	annotateLog := flag.String("annotate-log", "", "Decoders whose annotations are added to per-frame debug logs: names from -annotate or all (empty disables)")
+	controlSocket := flag.String("control-socket", "", "Unix socket path for runtime control commands, e.g. enabling the metrics server (empty disables)")
 	hubBuf := flag.Int("hub-buffer", 512, "Per-client hub buffer (frames)")
-	hubPolicy := flag.String("hub-policy", "drop", "Backpressure policy: drop|kick")
+	hubPolicy := flag.String("hub-policy", "drop", "Backpressure policy: drop|kick|drop-oldest|coalesce")
+	hubWorkers := flag.Int("hub-workers", 0, "Fan out backend frames with this many workers over client shards (0 = inline; for hundreds of clients)")
 	logMetricsEvery := flag.Duration("log-metrics-interval", 0, "If >0, periodically log metrics counters (for non-Prometheus setups)")
-	backend := flag.String("backend", "socketcan", "CAN backend: serial|socketcan (default socketcan)")
-	canIf := flag.String("can-if", "can0", "SocketCAN interface (when --backend=socketcan)")
+	hubSampleEvery := flag.Duration("hub-sample-interval", time.Second, "Interval for sampling hub client/fanout/queue-depth gauges (0 -> default 1s)")
+	counterAudit := flag.Duration("counter-audit", 0, "If >0, cross-check client TX and backend RX frame counters at this interval and warn about unaccounted frames")
+	counterAuditTol := flag.Int("counter-audit-tolerance", 4096, "Unaccounted frames tolerated by -counter-audit before it warns; must exceed the frames queued in flight")
+	backend := flag.String("backend", "socketcan", "CAN backend: serial|slcan|socketcan|loopback|replay|cannelloni-udp:host:port|cannelloni-tcp:host:port (default socketcan)")
+	canIf := flag.String("can-if", "can0", "SocketCAN interface, or a comma separated list merged into one bus (when --backend=socketcan)")
+	canLoopback := flag.Bool("can-loopback", true, "SocketCAN CAN_RAW_LOOPBACK: echo frames written by the gateway to other sockets on the interface")
+	canRecvOwn := flag.Bool("can-recv-own", false, "SocketCAN CAN_RAW_RECV_OWN_MSGS: receive the gateway's own frames back into its RX path and clients (needs -can-loopback)")
+	canBusyPoll := flag.Duration("can-busy-poll", 0, "SocketCAN SO_BUSY_POLL: kernel busy-polls the device for up to this long per read (0 disables; latency-critical setups)")
+	canSpin := flag.Duration("can-spin", 0, "SocketCAN reads spin this long before blocking (burns CPU for lower wake-up latency; 0 disables)")
+	canTxWait := flag.Duration("can-tx-wait", socketcan.DefaultTxWait, "SocketCAN: wait this long for room when the kernel TX queue is full (ENOBUFS) before dropping the frame (0 drops at once)")
+	canTxQueueLen := flag.Int("can-txqueuelen", 0, "SocketCAN: set the interface kernel TX queue length (frames) at startup; needs CAP_NET_ADMIN (0 leaves it unchanged)")
+	canTxDropPoll := flag.Duration("can-tx-drop-poll", 5*time.Second, "SocketCAN: how often to sample kernel TX drops of the interface (0 disables)")
+	canTxRoute := flag.String("can-tx-route", "", "SocketCAN with several -can-if interfaces: route client frames by ID, rules \"<ids>=<iface>[,<iface>]\" separated by ; (ids as -tx-allow, or *); unmatched frames go to all interfaces")
+	canErrFilter := flag.String("can-err-filter", "", "SocketCAN: receive error frames of these classes (all, a mask, or names like busoff,crtl,restarted); counted and sent to clients that subscribe (empty disables)")
+	normalizeEFF := flag.String("normalize-eff", "", "Mark backend frame IDs extended: keep|auto (IDs above 0x7FF)|force (default: force for serial, keep otherwise)")
+	normalizeFlags := flag.String("normalize-flags", "preserve", "CAN ID flags of backend and client frames: preserve|strip (remote requests pass as data frames)")
+	normalizeStripErr := flag.Bool("normalize-strip-err", false, "Drop error frames reported by the backend before the hub")
+	rxAllow := flag.String("rx-allow", "", "Backend RX allow list: IDs, lo-hi ranges or id/mask, comma separated (empty allows all)")
+	rxDeny := flag.String("rx-deny", "", "Backend RX deny list (same syntax; wins over allow)")
+	txAllow := flag.String("tx-allow", "", "Backend TX allow list; client frames not matching are never written to the bus")
+	txDeny := flag.String("tx-deny", "", "Backend TX deny list (same syntax; wins over allow)")
+	rxTransform := flag.String("rx-transform", "", "Backend RX payload transforms: \"<ids> = <op>[, <op>...]\" rules separated by ';' (ops: swap <off> <n>, bits <src> <n> <dst>, set <off> <hex>)")
+	txTransform := flag.String("tx-transform", "", "Backend TX payload transforms applied to client frames before the device (same syntax)")
+	txDedupWindow := flag.Duration("tx-dedup-window", 0, "Collapse identical frames sent to the backend within this window (0 disables)")
+	txDedupIDs := flag.String("tx-dedup-ids", "", "CAN IDs subject to TX dedup (filter list syntax; empty = all)")
+	txPriorityIDs := flag.String("tx-priority-ids", "", "CAN IDs written to the backend ahead of queued bulk traffic (filter list syntax; empty disables)")
+	txInhibit := flag.String("tx-inhibit", "", "Quiet hours: local-time windows during which client frames are not sent to the backend (e.g. \"mon-fri 22:00-06:00,sun 00:00-24:00\")")
+	arbID := flag.String("arbitration-id", "", "Active/standby arbitration with redundant gateways on the same bus: heartbeat CAN ID (3 or 8 hex digits; empty disables)")
+	arbPriority := flag.Int("arbitration-priority", arbiter.DefaultPriority, "Arbitration priority 0-255; when no gateway is active, the highest takes over")
+	arbInterval := flag.Duration("arbitration-interval", arbiter.DefaultInterval, "Arbitration heartbeat period; a peer silent for three periods is considered gone")
+	hbFrame := flag.String("heartbeat-frame", "", "Gateway heartbeat frame in candump notation, sent every -heartbeat-interval so other systems can detect liveness (empty disables)")
+	hbInterval := flag.Duration("heartbeat-interval", time.Second, "Gateway heartbeat period")
+	hbTarget := flag.String("heartbeat-target", "bus", "Where gateway heartbeats go: bus|clients|both")
+	hbCounter := flag.Bool("heartbeat-counter", false, "Count gateway heartbeats in the last data byte of -heartbeat-frame")
+	cyclicTx := flag.String("cyclic-tx", "", "Frames the gateway sends periodically: <frame>@<period>, comma separated (e.g. \"123#01@100ms\"; empty disables)")
+	waitDevice := flag.Duration("wait-device", 0, "At startup, wait up to this long for the serial device or CAN interface to appear instead of failing at once (0 disables)")
+	rxWatchdog := flag.Duration("rx-watchdog", 0, "Report the backend RX loop as stalled when it completes no read for this long while the device is up (0 disables)")
+	rxWatchdogRestart := flag.Bool("rx-watchdog-restart", false, "Close and reopen the backend when the RX watchdog reports a stall")
+	rxPipeline := flag.Int("rx-pipeline", 0, "Split backend RX into read, decode and broadcast goroutines joined by queues of this many items (0 = one goroutine; for fully loaded buses on small boards)")
+	txDryRun := flag.Bool("tx-dry-run", false, "Shadow mode: process client frames normally but log them instead of writing to the backend")
+	emulate := flag.String("emulate", "", "Rule file of emulated devices answering client queries instead of the bus (empty disables)")
+	udpLocal := flag.String("udp-local", ":20000", "Local UDP address for the cannelloni-udp backend")
+	replayFile := flag.String("replay-file", "", "candump log the replay backend plays to clients (required for --backend=replay)")
+	replaySpeed := flag.Float64("replay-speed", 1, "Replay speed multiplier on the log timestamps (2 = twice as fast; 0 = no pauses)")
+	replayLoop := flag.Bool("replay-loop", false, "Start the replay log over when it ends")
+	upstreamTxBuffer := flag.Int("upstream-tx-buffer", 256, "Client frames the cannelloni-tcp backend queues while its upstream is unreachable (0 drops them at once)")
+	upstreamPing := flag.Duration("upstream-ping", 0, "Ping the cannelloni-tcp upstream this often and reconnect when a ping goes unanswered (can-server upstreams only; 0 disables)")
+	upstreamCompression := flag.Bool("upstream-compression", false, "Ask the cannelloni-tcp upstream to compress the frames it sends (can-server upstreams only)")
+	upstreamPacketFraming := flag.Bool("upstream-packet-framing", false, "Speak cannelloni DATA packet framing to the cannelloni-tcp upstream (stock cannelloni TCP builds)")
+	replayTxFile := flag.String("replay-tx-file", "", "candump file client frames are appended to in replay mode (default <replay-file>.tx)")
+	portSniff := flag.Bool("port-sniff", false, "Tell clients on the listen port apart by their first bytes and serve HTTP requests there too (cannelloni clients must not wait for the server hello)")
+	packetFraming := flag.Bool("packet-framing", false, "Frame client streams as cannelloni DATA packets (header with sequence number and frame count), like stock cannelloni TCP builds")
+	fdBit := flag.String("fd-bit", "reject", "Client frames with the CAN FD length bit on streams that did not negotiate FD: reject (close the connection) | mask (ignore the bit, as before protocol revision 7)")
+	compression := flag.Bool("compression", false, "Let clients negotiate DEFLATE compression of the frames they receive")
+	compressSaving := flag.Int("compression-min-saving", 10, "Turn a client's compression off when it saves less than this percentage of its bytes (0: only when it grows them)")
 	maxClients := flag.Int("max-clients", 0, "Maximum simultaneous TCP clients (0 = unlimited)")
+	connRate := flag.Int("conn-rate", 0, "Max TCP connection attempts per minute from one IP before it is banned (0 = unlimited)")
+	connBan := flag.Duration("conn-ban", 5*time.Minute, "How long an IP exceeding conn-rate is refused")
 	handshakeTO := flag.Duration("handshake-timeout", 3*time.Second, "Client handshake timeout")
 	clientReadTO := flag.Duration("client-read-timeout", 60*time.Second, "Per-connection read deadline")
+	flushInterval := flag.Duration("flush-interval", 5*time.Millisecond, "Max time a client writer holds frames before flushing (0 -> default 5ms)")
+	batchSize := flag.Int("batch-size", 64, "Frames per client write batch, flushed when reached (0 -> default 64)")
+	readBuffer := flag.Int("read-buffer", 4096, "Per-connection client read buffer in bytes (0 -> default 4096)")
+	maxDecodeBytes := flag.Int("max-decode-bytes", cnl.MaxFrameSize, "Max bytes one client frame decode may consume before the connection is dropped (0 -> default)")
+	maxBurstFrames := flag.Int("max-burst-frames", 16, "Max client frames decoded per read burst before the reader yields (0 -> default 16)")
+	burstYield := flag.Duration("burst-yield", 0, "Pause after each full client burst so concurrent senders share the backend fairly (0 only yields the CPU)")
+	maxHandshake := flag.Int("max-handshake-bytes", 64, "Max bytes read from a client before the handshake completes (0 -> default 64)")
+	captureSize := flag.Int("capture-size", 4096, "Recent backend frames kept in memory for history replay and /api/capture (0 disables)")
+	captureTrigger := flag.String("capture-trigger", "", "Conditions writing a capture window to disk, comma separated: <id>[#<data>[/<mask>]], error, drops>N (empty disables)")
+	captureTrigDir := flag.String("capture-trigger-dir", "", "Directory triggered captures are written to (required with -capture-trigger)")
+	captureTrigPre := flag.Duration("capture-trigger-pre", 5*time.Second, "Capture window before a trigger")
+	captureTrigPost := flag.Duration("capture-trigger-post", 5*time.Second, "Capture window after a trigger")
+	captureTrigKeep := flag.Int("capture-trigger-keep", 20, "Triggered captures kept per bus, oldest deleted first (0 keeps all)")
+	sessionGrace := flag.Duration("session-grace", 30*time.Second, "How long a disconnected client's session is kept for resumption (0 disables sessions)")
+	sessionReplay := flag.Int("session-replay", 256, "Max frames queued for a disconnected session and replayed on resume (0 -> default 256)")
+	sessionPeer := flag.String("session-peer", "", "Admin API URL of the active gateway of a hot-standby pair whose client sessions this one takes over on failover (empty disables)")
+	sessionPeerToken := flag.String("session-peer-token", "", "Bearer token for the -session-peer admin API (prefer CAN_SERVER_SESSION_PEER_TOKEN_FILE)")
+	sessionSync := flag.Duration("session-sync", 2*time.Second, "How often client sessions are fetched from -session-peer")
+	bridgeRoutes := flag.String("bridge", "", "Bridge routes between instances: from>to or a<>b, comma separated (multi-instance mode)")
+	bridgeTTL := flag.Int("bridge-ttl", 4, "Maximum bridge hops a frame may take before it is dropped as a loop")
+	pairKey := flag.String("pair-key", "", "Shared key: discover another can-server with the same key on the LAN and federate with it (prefer CAN_SERVER_PAIR_KEY_FILE; empty disables)")
+	pairPort := flag.Int("pair-port", pairing.DefaultPort, "UDP port of the pairing beacons and TCP port of the pairing link")
 	mdnsEnable := flag.Bool("mdns-enable", false, "Enable mDNS/Avahi advertisement (packaged systemd unit enables by default)")
 	mdnsName := flag.String("mdns-name", "", "mDNS instance name (default can-server-<hostname>)")
+	dumpDir := flag.String("dump-dir", "", "Directory for SIGUSR1 diagnostic dumps (empty logs the dump)")
+	memoryLimitMB := flag.Int("memory-limit-mb", 0, "Cap on memory held by queued frames (client + backend queues) in MiB; above it queues drop aggressively (0 disables)")
+	frameValidation := flag.String("frame-validation", "strict", "Frame validation (DLC, ID range, flags): strict drops invalid frames, lenient repairs or passes them, off skips checks")
+	eventRingSize := flag.Int("event-history", 256, "Number of recent warn/error events kept for /api/events and dumps (0 disables)")
+	authToken := flag.String("auth-token", "", "Bearer token required by the admin API (prefer -token-file or CAN_SERVER_AUTH_TOKEN_FILE)")
+	tokenFile := flag.String("token-file", "", "File containing the admin API bearer token (re-read on SIGHUP)")
+	accessFile := flag.String("access-file", "", "File of API identities, one '<name> <role> <token>' per line, roles read|write|admin (re-read on SIGHUP)")
+	clientRole := flag.String("client-role", "write", "Role of TCP clients not matched by -client-roles: read (receive only), write, admin or none (refused)")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate for TLS on the client listener (with -tls-key; empty disables TLS)")
+	tlsKey := flag.String("tls-key", "", "PEM private key of -tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "PEM CA bundle; clients must present a certificate it signed, named by its CN/SAN (needs -tls-cert)")
+	clientRoles := flag.String("client-roles", "", "Roles of TCP clients by address: <cidr>=<role>, comma separated, first match wins")
+	configFile := flag.String("config", "", "Config file (key = value per line, keys are flag names)")
+	checkConfig := flag.Bool("check-config", false, "Validate configuration, print the effective config and exit")
+	checkProbe := flag.Bool("check-probe", false, "With -check-config, also probe the backend device read-only")
+	selfTest := flag.Bool("self-test", false, "Open the backend, listen briefly, print a pass/fail report and exit")
+	selfTestFor := flag.Duration("self-test-duration", 5*time.Second, "How long -self-test listens for bus traffic")
+	selfTestProbe := flag.String("self-test-probe", "", "Frame sent by -self-test before listening, cansend notation (e.g. 7FF#); empty sends nothing")
+	compare := flag.Bool("compare", false, "Capture from the serial and socketcan backends (or two instances) at once, report frames seen on only one and exit")
+	compareFor := flag.Duration("compare-duration", 10*time.Second, "How long -compare captures")
+	compareTolerance := flag.Duration("compare-tolerance", 100*time.Millisecond, "Max receive-time skew for -compare to treat two identical frames as the same")
+	assertGolden := flag.String("assert", "", "Record backend traffic, compare it against this golden candump log, print a diff report and exit (non-zero on mismatch)")
+	assertFor := flag.Duration("assert-duration", 0, "How long -assert records (0 = the golden file's span plus assert-tolerance)")
+	assertTolerance := flag.Duration("assert-tolerance", 100*time.Millisecond, "Max timing deviation of a recorded frame from its golden offset")
+	diff := flag.String("diff", "", "Compare two candump logs ID by ID (before.log,after.log), print the frame count and payload changes and exit (1 when they differ)")
+	diffAll := flag.Bool("diff-all", false, "Also list the IDs -diff found unchanged")
+	assertRecord := flag.String("assert-record", "", "Also write the -assert recording to this candump log (e.g. to create a golden file)")
+	// Hidden: release qualification, not operation (see soakFlags).
+	soak := flag.Duration("soak", 0, "Soak test: run synthetic clients for this long while watching goroutines, heap and fds for growth, then exit (1 when something grew)")
+	soakClients := flag.Int("soak-clients", 8, "Synthetic clients of -soak")
+	soakRate := flag.Int("soak-rate", 100, "Frames per second all -soak clients send together (0 = receive only)")
+	soakInterval := flag.Duration("soak-interval", time.Minute, "How often -soak samples goroutines, heap and fds")
+	soakLifetime := flag.Duration("soak-lifetime", 30*time.Second, "A -soak client reconnects after this long (0 keeps its connection)")
+	flag.CommandLine.Usage = usageWithout(flag.CommandLine, soakFlags)
+	printDefaults := flag.Bool("print-default-config", false, "Print a commented config file template with default values and exit")
 	showVersion := flag.Bool("version", false, "Print version and exit")
-	flag.Parse()
+	// "can-server doctor [flags]" checks the host instead of serving.
+	args := os.Args[1:]
+	doctor := len(args) > 0 && args[0] == "doctor"
+	if doctor {
+		args = args[1:]
+	}
+	_ = flag.CommandLine.Parse(args) // ExitOnError: exits on bad flags
+	if *printDefaults {
+		// Emit before env/file resolution so the template reflects built-in defaults.
+		return &appConfig{printDefaults: true}, *showVersion
+	}
 
 	// Track which flags were explicitly set to give them precedence over env.
 	setFlags := map[string]struct{}{}
 	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = struct{}{} })
+	// Precedence: flag > env > config file > default. File values are applied
+	// through the flag set so they share parsing with the command line.
+	if _, ok := setFlags["config"]; !ok {
+		if v, ok := os.LookupEnv(envName("CONFIG")); ok && strings.TrimSpace(v) != "" {
+			*configFile = strings.TrimSpace(v)
+		}
+	}
+	if *configFile != "" {
+		fc, err := applyConfigFile(flag.CommandLine, *configFile, setFlags)
+		if err != nil {
+			fmt.Printf("configuration error: %v\n", err)
+			return nil, *showVersion
+		}
+		cfg.instances = fc.instances
+		cfg.vbuses = fc.vbuses
+	}
 	cfg.serialDev = *serialDev
 	cfg.baud = *baud
 	cfg.listenAddr = *listen
 	cfg.serialReadTO = *serialReadTO
+	cfg.serialNoChecksum = *serialNoChecksum
+	cfg.slcanBitrate = *slcanBitrate
 	cfg.logFormat = *logFormat
 	cfg.logLevel = *logLevel
 	cfg.metricsAddr = *metricsAddr
+	cfg.metricsBind = *metricsBind
+	cfg.metricsFallback = *metricsFallback
+	cfg.metricsNS = *metricsNS
+	cfg.metricsLabels = *metricsLabels
+	cfg.controlSocket = *controlSocket
+	cfg.httpAllow = *httpAllow
+	cfg.wsOrigins = *wsOrigins
+	cfg.annotate = *annotate
+	cfg.annotateLog = *annotateLog
+	cfg.alerts = *alerts
+	cfg.alertWebhook = *alertWebhook
+	cfg.alertCooldown = *alertCooldown
+	cfg.mqtt = *mqttBroker
+	cfg.mqttTopic = *mqttTopic
+	cfg.mqttFormat = *mqttFormat
+	cfg.mqttQoS = *mqttQoS
+	cfg.mqttRetain = *mqttRetain
+	cfg.mqttClientID = *mqttClientID
+	cfg.mqttUsername = *mqttUsername
+	cfg.mqttPassword = *mqttPassword
+	cfg.mqttTLSCA = *mqttTLSCA
+	cfg.mqttTLSCert = *mqttTLSCert
+	cfg.mqttTLSKey = *mqttTLSKey
+	cfg.mqttTxTopic = *mqttTxTopic
+	cfg.mqttTxAllow = *mqttTxAllow
+	cfg.ampioEvents = *ampioEvents
+	cfg.ampioPrefix = *ampioPrefix
+	cfg.ampioTopic = *ampioTopic
+	cfg.ampioDevices = *ampioDevices
+	cfg.store = *storeSpec
+	cfg.storeRetention = *storeRetention
+	cfg.storeMaxFrames = *storeMaxFrames
+	cfg.storePresence = *storePresence
+	cfg.clockPolicy = *clockPolicy
+	cfg.clockThreshold = *clockThreshold
 	cfg.hubBuffer = *hubBuf
 	cfg.hubPolicy = *hubPolicy
+	cfg.hubWorkers = *hubWorkers
 	cfg.logMetricsEvery = *logMetricsEvery
+	cfg.hubSampleEvery = *hubSampleEvery
+	cfg.counterAudit = *counterAudit
+	cfg.counterAuditTol = *counterAuditTol
 	cfg.backend = *backend
 	cfg.canIf = *canIf
+	cfg.canLoopback = *canLoopback
+	cfg.canRecvOwn = *canRecvOwn
+	cfg.canBusyPoll = *canBusyPoll
+	cfg.canSpin = *canSpin
+	cfg.canTxWait = *canTxWait
+	cfg.canTxQueueLen = *canTxQueueLen
+	cfg.canTxDropPoll = *canTxDropPoll
+	cfg.canErrFilter = *canErrFilter
+	cfg.canTxRoute = *canTxRoute
+	cfg.normalizeEFF = *normalizeEFF
+	cfg.normalizeFlags = *normalizeFlags
+	cfg.normalizeStripErr = *normalizeStripErr
+	cfg.packetFraming = *packetFraming
+	cfg.fdBit = *fdBit
+	cfg.udpLocal = *udpLocal
+	cfg.replayFile = *replayFile
+	cfg.replaySpeed = *replaySpeed
+	cfg.replayLoop = *replayLoop
+	cfg.replayTxFile = *replayTxFile
+	cfg.upstreamTxBuffer = *upstreamTxBuffer
+	cfg.upstreamPing = *upstreamPing
+	cfg.upstreamCompression = *upstreamCompression
+	cfg.upstreamPacketFraming = *upstreamPacketFraming
+	cfg.rxAllow = *rxAllow
+	cfg.rxDeny = *rxDeny
+	cfg.txAllow = *txAllow
+	cfg.txDeny = *txDeny
+	cfg.rxTransform = *rxTransform
+	cfg.txTransform = *txTransform
+	cfg.txDedupWindow = *txDedupWindow
+	cfg.txDedupIDs = *txDedupIDs
+	cfg.txPriorityIDs = *txPriorityIDs
+	cfg.txInhibit = *txInhibit
+	cfg.arbID = *arbID
+	cfg.arbPriority = *arbPriority
+	cfg.arbInterval = *arbInterval
+	cfg.txDryRun = *txDryRun
+	cfg.cyclicTx = *cyclicTx
+	cfg.hbFrame = *hbFrame
+	cfg.hbInterval = *hbInterval
+	cfg.hbTarget = *hbTarget
+	cfg.hbCounter = *hbCounter
+	cfg.rxWatchdog = *rxWatchdog
+	cfg.waitDevice = *waitDevice
+	cfg.rxWatchdogRestart = *rxWatchdogRestart
+	cfg.rxPipeline = *rxPipeline
+	cfg.emulate = *emulate
+	cfg.portSniff = *portSniff
+	cfg.compression = *compression
+	cfg.compressSaving = *compressSaving
 	cfg.maxClients = *maxClients
+	cfg.connRate = *connRate
+	cfg.connBan = *connBan
 	cfg.handshakeTO = *handshakeTO
 	cfg.clientReadTO = *clientReadTO
+	cfg.flushInterval = *flushInterval
+	cfg.batchSize = *batchSize
+	cfg.readBuffer = *readBuffer
+	cfg.maxDecodeBytes = *maxDecodeBytes
+	cfg.maxBurstFrames = *maxBurstFrames
+	cfg.sessionGrace = *sessionGrace
+	cfg.sessionReplay = *sessionReplay
+	cfg.sessionPeer = *sessionPeer
+	cfg.sessionPeerToken = *sessionPeerToken
+	cfg.sessionSync = *sessionSync
+	cfg.burstYield = *burstYield
+	cfg.maxHandshake = *maxHandshake
+	cfg.captureSize = *captureSize
+	cfg.captureTrigger = *captureTrigger
+	cfg.captureTrigDir = *captureTrigDir
+	cfg.captureTrigPre = *captureTrigPre
+	cfg.captureTrigPost = *captureTrigPost
+	cfg.captureTrigKeep = *captureTrigKeep
+	cfg.bridge = *bridgeRoutes
+	cfg.bridgeTTL = *bridgeTTL
+	cfg.pairKey = *pairKey
+	cfg.pairPort = *pairPort
 	cfg.mdnsEnable = *mdnsEnable
 	cfg.mdnsName = *mdnsName
+	cfg.dumpDir = *dumpDir
+	cfg.eventRingSize = *eventRingSize
+	cfg.memoryLimitMB = *memoryLimitMB
+	cfg.frameValidation = *frameValidation
+	cfg.authToken = *authToken
+	cfg.tokenFile = *tokenFile
+	cfg.accessFile = *accessFile
+	cfg.clientRole = *clientRole
+	cfg.clientRoles = *clientRoles
+	cfg.tlsCert = *tlsCert
+	cfg.tlsKey = *tlsKey
+	cfg.tlsClientCA = *tlsClientCA
+	cfg.configFile = *configFile
+	cfg.checkConfig = *checkConfig
+	cfg.checkProbe = *checkProbe
+	cfg.doctor = doctor
+	cfg.selfTest = *selfTest
+	cfg.selfTestFor = *selfTestFor
+	cfg.selfTestProbe = *selfTestProbe
+	cfg.compare = *compare
+	cfg.compareFor = *compareFor
+	cfg.compareTolerance = *compareTolerance
+	cfg.assertGolden = *assertGolden
+	cfg.assertFor = *assertFor
+	cfg.assertTolerance = *assertTolerance
+	cfg.assertRecord = *assertRecord
+	cfg.soak = *soak
+	cfg.soakClients = *soakClients
+	cfg.soakRate = *soakRate
+	cfg.soakInterval = *soakInterval
+	cfg.soakLifetime = *soakLifetime
+	cfg.diff = *diff
+	cfg.diffAll = *diffAll
 
 	if err := applyEnvOverrides(cfg, setFlags); err != nil {
 		fmt.Printf("environment override error: %v\n", err)
@@ -82,6 +583,23 @@ func parseFlags() (*appConfig, bool) {
 		fmt.Printf("configuration error: %v\n", err)
 		return nil, *showVersion
 	}
+	ics, err := cfg.instanceConfigs()
+	if err != nil {
+		fmt.Printf("configuration error: %v\n", err)
+		return nil, *showVersion
+	}
+	if _, err := cfg.bridgeSpecs(ics); err != nil {
+		fmt.Printf("configuration error: %v\n", err)
+		return nil, *showVersion
+	}
+	if _, err := cfg.vbusConfigs(ics); err != nil {
+		fmt.Printf("configuration error: %v\n", err)
+		return nil, *showVersion
+	}
+	if err := cfg.validateSoakBackends(ics); err != nil {
+		fmt.Printf("configuration error: %v\n", err)
+		return nil, *showVersion
+	}
 	return cfg, *showVersion
 }
 
@@ -101,25 +619,72 @@ func (c *appConfig) validate() error {
 	default:
 		return fmt.Errorf("invalid log-level: %s", c.logLevel)
 	}
-	switch c.backend {
-	case "serial", "socketcan":
+	switch kind, arg := splitBackend(c.backend); kind {
+	case "serial", "slcan", "socketcan", "loopback", "replay":
+		if arg != "" {
+			return fmt.Errorf("invalid backend: %s", c.backend)
+		}
+	case backendCannelloniUDP:
+		if _, _, err := net.SplitHostPort(arg); err != nil {
+			return fmt.Errorf("invalid backend %s: want cannelloni-udp:host:port", c.backend)
+		}
+		if _, _, err := net.SplitHostPort(c.udpLocal); err != nil {
+			return fmt.Errorf("invalid udp-local %q: %w", c.udpLocal, err)
+		}
+	case backendCannelloniTCP:
+		if err := c.validateCannelloniTCP(arg); err != nil {
+			return err
+		}
 	default:
 		return fmt.Errorf("invalid backend: %s", c.backend)
 	}
-	switch c.hubPolicy {
-	case "drop", "kick":
+	switch c.metricsBind {
+	case "", metrics.BindWarn, metrics.BindFail, metrics.BindRetry, metrics.BindFallback:
 	default:
+		return fmt.Errorf("invalid metrics-bind-policy: %s (use warn|fail|retry|fallback)", c.metricsBind)
+	}
+	if _, err := clock.ParsePolicy(c.clockPolicy); err != nil {
+		return fmt.Errorf("clock-step-policy: %w", err)
+	}
+	if c.clockThreshold < 0 || c.clockThreshold > 0 && c.clockThreshold < time.Millisecond {
+		return fmt.Errorf("clock-step-threshold must be 0 (default) or at least 1ms")
+	}
+	if _, err := metrics.ParseNets(c.httpAllow); err != nil {
+		return fmt.Errorf("http-allow: %w", err)
+	}
+	if _, err := stream.ParseOrigins(c.wsOrigins); err != nil {
+		return fmt.Errorf("ws-origins: %w", err)
+	}
+	if err := metrics.CheckNamespace(c.metricsNS); err != nil {
+		return fmt.Errorf("metrics-namespace: %w", err)
+	}
+	if _, err := metrics.ParseLabels(c.metricsLabels); err != nil {
+		return fmt.Errorf("metrics-labels: %w", err)
+	}
+	if _, err := c.logAnnotations(); err != nil {
+		return err
+	}
+	if _, err := hub.ParsePolicy(c.hubPolicy); err != nil {
 		return fmt.Errorf("invalid hub-policy: %s", c.hubPolicy)
 	}
 	if c.hubBuffer <= 0 {
 		return fmt.Errorf("hub-buffer must be > 0 (got %d)", c.hubBuffer)
 	}
+	if c.hubWorkers < 0 {
+		return fmt.Errorf("hub-workers must be >= 0 (got %d)", c.hubWorkers)
+	}
+	if c.rxPipeline < 0 {
+		return fmt.Errorf("rx-pipeline must be >= 0 (got %d)", c.rxPipeline)
+	}
 	if c.baud <= 0 {
 		return fmt.Errorf("baud must be > 0 (got %d)", c.baud)
 	}
 	if c.serialReadTO <= 0 {
 		return fmt.Errorf("serial-read-timeout must be > 0")
 	}
+	if err := slcan.CheckBitrate(c.slcanBitrate); err != nil {
+		return fmt.Errorf("slcan-bitrate: %w", err)
+	}
 	if c.handshakeTO <= 0 {
 		return fmt.Errorf("handshake-timeout must be > 0")
 	}
@@ -129,114 +694,575 @@ func (c *appConfig) validate() error {
 	if c.maxClients < 0 {
 		return fmt.Errorf("max-clients must be >= 0")
 	}
+	if c.connRate < 0 || c.connBan < 0 {
+		return fmt.Errorf("conn-rate and conn-ban must be >= 0")
+	}
+	if c.connRate > 0 && c.connBan == 0 {
+		return fmt.Errorf("conn-ban must be > 0 with conn-rate")
+	}
+	if c.compressSaving < 0 || c.compressSaving > 99 {
+		return fmt.Errorf("compression-min-saving must be between 0 and 99")
+	}
+	if c.fdBit != "" && c.fdBit != "reject" && c.fdBit != "mask" {
+		return fmt.Errorf("fd-bit must be reject or mask (got %q)", c.fdBit)
+	}
+	if c.canRecvOwn && !c.canLoopback {
+		return fmt.Errorf("can-recv-own requires can-loopback")
+	}
+	if err := c.validateReplay(); err != nil {
+		return err
+	}
+	if kind, _ := splitBackend(c.backend); c.serialNoChecksum && kind != "serial" {
+		return fmt.Errorf("serial-no-checksum requires the serial backend")
+	}
+	if err := c.validateCANIfaces(); err != nil {
+		return err
+	}
+	if mask, err := can.ParseErrMask(c.canErrFilter); err != nil {
+		return fmt.Errorf("can-err-filter: %w", err)
+	} else if kind, _ := splitBackend(c.backend); mask != 0 && kind != "socketcan" {
+		return fmt.Errorf("can-err-filter requires the socketcan backend")
+	}
+	if _, err := c.normalization(); err != nil {
+		return err
+	}
+	if c.normalizeStripErr && c.errMask() != 0 {
+		return fmt.Errorf("normalize-strip-err drops the error frames can-err-filter asks for")
+	}
+	if c.canBusyPoll < 0 || c.canSpin < 0 || c.canTxWait < 0 || c.canTxDropPoll < 0 {
+		return fmt.Errorf("can-busy-poll, can-spin, can-tx-wait and can-tx-drop-poll must be >= 0")
+	}
+	if c.canTxQueueLen < 0 {
+		return fmt.Errorf("can-txqueuelen must be >= 0")
+	}
+	if c.flushInterval < 0 {
+		return fmt.Errorf("flush-interval must be >= 0")
+	}
+	if c.batchSize < 0 {
+		return fmt.Errorf("batch-size must be >= 0 (got %d)", c.batchSize)
+	}
+	if c.readBuffer < 0 {
+		return fmt.Errorf("read-buffer must be >= 0 (got %d)", c.readBuffer)
+	}
+	if c.maxDecodeBytes < 0 || (c.maxDecodeBytes > 0 && c.maxDecodeBytes < cnl.MaxFrameSize) {
+		return fmt.Errorf("max-decode-bytes must be 0 or >= %d (got %d)", cnl.MaxFrameSize, c.maxDecodeBytes)
+	}
+	if c.sessionGrace < 0 {
+		return fmt.Errorf("session-grace must be >= 0")
+	}
+	if c.sessionReplay < 0 || c.sessionReplay > 0xFFFF {
+		return fmt.Errorf("session-replay must be in [0, 65535] (got %d)", c.sessionReplay)
+	}
+	if err := c.validateSessionPeer(); err != nil {
+		return err
+	}
+	if c.maxBurstFrames < 0 {
+		return fmt.Errorf("max-burst-frames must be >= 0 (got %d)", c.maxBurstFrames)
+	}
+	if c.burstYield < 0 {
+		return fmt.Errorf("burst-yield must be >= 0")
+	}
+	if c.maxHandshake < 0 || (c.maxHandshake > 0 && c.maxHandshake < cnl.HelloSize) {
+		return fmt.Errorf("max-handshake-bytes must be 0 or >= %d (got %d)", cnl.HelloSize, c.maxHandshake)
+	}
+	if _, _, err := c.filters(); err != nil {
+		return err
+	}
+	if _, _, err := c.transforms(); err != nil {
+		return err
+	}
+	if c.hubSampleEvery < 0 {
+		return fmt.Errorf("hub-sample-interval must be >= 0")
+	}
+	if err := c.validateCounterAudit(); err != nil {
+		return err
+	}
+	if c.txDedupWindow < 0 {
+		return fmt.Errorf("tx-dedup-window must be >= 0")
+	}
+	if _, err := c.deduper(); err != nil {
+		return err
+	}
+	if _, err := c.txOptions(); err != nil {
+		return err
+	}
+	if _, err := inhibit.ParseSchedule(c.txInhibit); err != nil {
+		return fmt.Errorf("tx-inhibit: %w", err)
+	}
+	if err := c.validateArbitration(); err != nil {
+		return err
+	}
+	if _, err := cyclic.Parse(c.cyclicTx); err != nil {
+		return fmt.Errorf("cyclic-tx: %w", err)
+	}
+	if err := c.validateHeartbeat(); err != nil {
+		return err
+	}
+	if c.rxWatchdog < 0 || c.waitDevice < 0 {
+		return fmt.Errorf("rx-watchdog and wait-device must be >= 0")
+	}
+	if kind, _ := splitBackend(c.backend); c.rxWatchdog > 0 && kind == "loopback" {
+		return fmt.Errorf("rx-watchdog: the loopback backend has no RX loop")
+	} else if c.rxWatchdog > 0 && (kind == "serial" || kind == "slcan") && c.rxWatchdog <= c.serialReadTO {
+		return fmt.Errorf("rx-watchdog (%s) must exceed serial-read-timeout (%s): idle reads keep the loop alive", c.rxWatchdog, c.serialReadTO)
+	}
+	if _, err := c.emulator(); err != nil {
+		return err
+	}
+	if err := c.validateAlerts(); err != nil {
+		return err
+	}
+	if err := c.validateMQTT(); err != nil {
+		return err
+	}
+	if err := c.validateAmpio(); err != nil {
+		return err
+	}
+	if err := c.validateStore(); err != nil {
+		return err
+	}
+	if c.eventRingSize < 0 {
+		return fmt.Errorf("event-history must be >= 0")
+	}
+	if c.memoryLimitMB < 0 {
+		return fmt.Errorf("memory-limit-mb must be >= 0")
+	}
+	if c.frameValidation != "" {
+		if _, err := validate.ParseMode(c.frameValidation); err != nil {
+			return fmt.Errorf("frame-validation: %w", err)
+		}
+	}
+	if c.captureSize < 0 {
+		return fmt.Errorf("capture-size must be >= 0")
+	}
+	if err := c.validateCaptureTrigger(); err != nil {
+		return err
+	}
+	if c.pairKey != "" && len(c.pairKey) < minPairKey {
+		return fmt.Errorf("pair-key must be at least %d characters", minPairKey)
+	}
+	if c.pairKey != "" && (c.pairPort <= 0 || c.pairPort > 65535) {
+		return fmt.Errorf("pair-port must be 1-65535")
+	}
+	// A hop limit of 0 would drop every bridged frame; it is only
+	// tolerated when nothing is bridged.
+	if c.bridgeTTL < 0 || (c.bridgeTTL == 0 && (c.bridge != "" || c.pairKey != "")) {
+		return fmt.Errorf("bridge-ttl must be >= 1")
+	}
+	if c.selfTest && c.selfTestFor <= 0 {
+		return fmt.Errorf("self-test-duration must be > 0")
+	}
+	if c.selfTestProbe != "" {
+		if _, err := can.ParseFrame(c.selfTestProbe); err != nil {
+			return fmt.Errorf("self-test-probe: %w", err)
+		}
+	}
+	if c.compare && c.compareFor <= 0 {
+		return fmt.Errorf("compare-duration must be > 0")
+	}
+	if c.compare && c.compareTolerance <= 0 {
+		return fmt.Errorf("compare-tolerance must be > 0")
+	}
+	if c.assertGolden != "" && c.assertFor < 0 {
+		return fmt.Errorf("assert-duration must be >= 0")
+	}
+	if c.assertGolden != "" && c.assertTolerance <= 0 {
+		return fmt.Errorf("assert-tolerance must be > 0")
+	}
+	if err := c.validateSoak(); err != nil {
+		return err
+	}
+	if c.authToken != "" && c.tokenFile != "" {
+		return fmt.Errorf("auth-token and token-file are mutually exclusive")
+	}
+	if _, err := c.serverTLS(); err != nil {
+		return err
+	}
+	if _, err := c.clientAccess(); err != nil {
+		return err
+	}
 	// No extra validation needed for mDNS besides enable flag.
 	return nil
 }
 
-// applyEnvOverrides maps CAN_SERVER_* environment variables to config fields
+// envPrefixVar names the bootstrap variable that replaces the default
+// CAN_SERVER_ prefix (e.g. AMPIO_GW_), letting differently configured
+// instances share supervisor templates. It is always read under this name.
+const (
+	envPrefixVar     = "CAN_SERVER_ENV_PREFIX"
+	defaultEnvPrefix = "CAN_SERVER_"
+)
+
+// envPrefix returns the active environment variable prefix.
+func envPrefix() string {
+	if v := strings.TrimSpace(os.Getenv(envPrefixVar)); v != "" {
+		return v
+	}
+	return defaultEnvPrefix
+}
+
+// envName returns the environment variable name for suffix under the active prefix.
+func envName(suffix string) string { return envPrefix() + suffix }
+
+// applyEnvOverrides maps <prefix>* (default CAN_SERVER_*) environment variables to config fields
 // unless a corresponding flag was explicitly set. Boolean & numeric parsing is lax:
 // empty values ignored. Duration accepts Go time.ParseDuration format.
+// Every variable may instead be supplied as <NAME>_FILE pointing to a file
+// holding the value (Docker/Kubernetes secrets convention).
 func applyEnvOverrides(c *appConfig, set map[string]struct{}) error {
 	// mapping: env var -> apply func
 	// Only apply if NOT in set (flag wins).
 	var firstErr error
-	get := func(k string) (string, bool) { v, ok := os.LookupEnv(k); return strings.TrimSpace(v), ok }
+	get := func(k string) (string, bool) {
+		v, ok, err := secret.LookupEnv(k)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("invalid %s_FILE: %w", k, err)
+		}
+		return v, ok && err == nil
+	}
 	if _, ok := set["serial"]; !ok {
-		if v, ok := get("CAN_SERVER_SERIAL"); ok && v != "" {
+		if v, ok := get(envName("SERIAL")); ok && v != "" {
 			c.serialDev = v
 		}
 	}
 	if _, ok := set["baud"]; !ok {
-		if v, ok := get("CAN_SERVER_BAUD"); ok && v != "" {
+		if v, ok := get(envName("BAUD")); ok && v != "" {
 			if n, err := strconv.Atoi(v); err == nil && n > 0 {
 				c.baud = n
 			} else if err != nil && firstErr == nil {
-				firstErr = fmt.Errorf("invalid CAN_SERVER_BAUD: %w", err)
+				firstErr = fmt.Errorf("invalid %s: %w", envName("BAUD"), err)
 			}
 		}
 	}
 	if _, ok := set["listen"]; !ok {
-		if v, ok := get("CAN_SERVER_LISTEN"); ok && v != "" {
+		if v, ok := get(envName("LISTEN")); ok && v != "" {
 			c.listenAddr = v
 		}
 	}
 	if _, ok := set["serial-read-timeout"]; !ok {
-		if v, ok := get("CAN_SERVER_SERIAL_READ_TIMEOUT"); ok && v != "" {
+		if v, ok := get(envName("SERIAL_READ_TIMEOUT")); ok && v != "" {
 			if d, err := time.ParseDuration(v); err == nil && d > 0 {
 				c.serialReadTO = d
 			} else if err != nil && firstErr == nil {
-				firstErr = fmt.Errorf("invalid CAN_SERVER_SERIAL_READ_TIMEOUT: %w", err)
+				firstErr = fmt.Errorf("invalid %s: %w", envName("SERIAL_READ_TIMEOUT"), err)
 			}
 		}
 	}
 	if _, ok := set["log-format"]; !ok {
-		if v, ok := get("CAN_SERVER_LOG_FORMAT"); ok && v != "" {
+		if v, ok := get(envName("LOG_FORMAT")); ok && v != "" {
 			c.logFormat = v
 		}
 	}
 	if _, ok := set["log-level"]; !ok {
-		if v, ok := get("CAN_SERVER_LOG_LEVEL"); ok && v != "" {
+		if v, ok := get(envName("LOG_LEVEL")); ok && v != "" {
 			c.logLevel = v
 		}
 	}
 	if _, ok := set["metrics-addr"]; !ok {
-		if v, ok := get("CAN_SERVER_METRICS"); ok {
+		if v, ok := get(envName("METRICS")); ok {
 			c.metricsAddr = v
 		}
 	}
 	if _, ok := set["hub-buffer"]; !ok {
-		if v, ok := get("CAN_SERVER_HUB_BUFFER"); ok && v != "" {
+		if v, ok := get(envName("HUB_BUFFER")); ok && v != "" {
 			if n, err := strconv.Atoi(v); err == nil && n > 0 {
 				c.hubBuffer = n
 			} else if err != nil && firstErr == nil {
-				firstErr = fmt.Errorf("invalid CAN_SERVER_HUB_BUFFER: %w", err)
+				firstErr = fmt.Errorf("invalid %s: %w", envName("HUB_BUFFER"), err)
 			}
 		}
 	}
 	if _, ok := set["hub-policy"]; !ok {
-		if v, ok := get("CAN_SERVER_HUB_POLICY"); ok && v != "" {
+		if v, ok := get(envName("HUB_POLICY")); ok && v != "" {
 			c.hubPolicy = v
 		}
 	}
 	if _, ok := set["backend"]; !ok {
-		if v, ok := get("CAN_SERVER_BACKEND"); ok && v != "" {
+		if v, ok := get(envName("BACKEND")); ok && v != "" {
 			c.backend = v
 		}
 	}
 	if _, ok := set["can-if"]; !ok {
-		if v, ok := get("CAN_SERVER_IF"); ok && v != "" {
+		if v, ok := get(envName("IF")); ok && v != "" {
 			c.canIf = v
 		}
 	}
+	for _, e := range []struct {
+		flag, env string
+		dst       *bool
+	}{
+		{"can-loopback", "CAN_LOOPBACK", &c.canLoopback},
+		{"serial-no-checksum", "SERIAL_NO_CHECKSUM", &c.serialNoChecksum},
+		{"can-recv-own", "CAN_RECV_OWN", &c.canRecvOwn},
+		{"normalize-strip-err", "NORMALIZE_STRIP_ERR", &c.normalizeStripErr},
+		{"tx-dry-run", "TX_DRY_RUN", &c.txDryRun},
+		{"replay-loop", "REPLAY_LOOP", &c.replayLoop},
+		{"upstream-compression", "UPSTREAM_COMPRESSION", &c.upstreamCompression},
+		{"upstream-packet-framing", "UPSTREAM_PACKET_FRAMING", &c.upstreamPacketFraming},
+		{"heartbeat-counter", "HEARTBEAT_COUNTER", &c.hbCounter},
+		{"rx-watchdog-restart", "RX_WATCHDOG_RESTART", &c.rxWatchdogRestart},
+		{"port-sniff", "PORT_SNIFF", &c.portSniff},
+		{"packet-framing", "PACKET_FRAMING", &c.packetFraming},
+		{"compression", "COMPRESSION", &c.compression},
+		{"mqtt-retain", "MQTT_RETAIN", &c.mqttRetain},
+		{"ampio-devices", "AMPIO_DEVICES", &c.ampioDevices},
+	} {
+		if _, ok := set[e.flag]; !ok {
+			if v, ok := get(envName(e.env)); ok && v != "" {
+				if b, err := strconv.ParseBool(v); err == nil {
+					*e.dst = b
+				} else if firstErr == nil {
+					firstErr = fmt.Errorf("invalid %s: %w", envName(e.env), err)
+				}
+			}
+		}
+	}
+	for _, e := range []struct {
+		flag, env string
+		dst       *string
+	}{
+		{"bridge", "BRIDGE", &c.bridge},
+		{"can-err-filter", "CAN_ERR_FILTER", &c.canErrFilter},
+		{"can-tx-route", "CAN_TX_ROUTE", &c.canTxRoute},
+		{"normalize-eff", "NORMALIZE_EFF", &c.normalizeEFF},
+		{"normalize-flags", "NORMALIZE_FLAGS", &c.normalizeFlags},
+		{"fd-bit", "FD_BIT", &c.fdBit},
+		{"pair-key", "PAIR_KEY", &c.pairKey},
+		{"session-peer", "SESSION_PEER", &c.sessionPeer},
+		{"session-peer-token", "SESSION_PEER_TOKEN", &c.sessionPeerToken},
+		{"metrics-bind-policy", "METRICS_BIND_POLICY", &c.metricsBind},
+		{"metrics-fallback-addr", "METRICS_FALLBACK_ADDR", &c.metricsFallback},
+		{"metrics-namespace", "METRICS_NAMESPACE", &c.metricsNS},
+		{"metrics-labels", "METRICS_LABELS", &c.metricsLabels},
+		{"control-socket", "CONTROL_SOCKET", &c.controlSocket},
+		{"http-allow", "HTTP_ALLOW", &c.httpAllow},
+		{"ws-origins", "WS_ORIGINS", &c.wsOrigins},
+		{"frame-validation", "FRAME_VALIDATION", &c.frameValidation},
+		{"access-file", "ACCESS_FILE", &c.accessFile},
+		{"client-role", "CLIENT_ROLE", &c.clientRole},
+		{"client-roles", "CLIENT_ROLES", &c.clientRoles},
+		{"tls-cert", "TLS_CERT", &c.tlsCert},
+		{"tls-key", "TLS_KEY", &c.tlsKey},
+		{"tls-client-ca", "TLS_CLIENT_CA", &c.tlsClientCA},
+		{"annotate", "ANNOTATE", &c.annotate},
+		{"annotate-log", "ANNOTATE_LOG", &c.annotateLog},
+		{"alerts", "ALERTS", &c.alerts},
+		{"alert-webhook", "ALERT_WEBHOOK", &c.alertWebhook},
+		{"mqtt", "MQTT", &c.mqtt},
+		{"mqtt-topic", "MQTT_TOPIC", &c.mqttTopic},
+		{"mqtt-format", "MQTT_FORMAT", &c.mqttFormat},
+		{"mqtt-client-id", "MQTT_CLIENT_ID", &c.mqttClientID},
+		{"mqtt-username", "MQTT_USERNAME", &c.mqttUsername},
+		{"mqtt-password", "MQTT_PASSWORD", &c.mqttPassword},
+		{"mqtt-tls-ca", "MQTT_TLS_CA", &c.mqttTLSCA},
+		{"mqtt-tls-cert", "MQTT_TLS_CERT", &c.mqttTLSCert},
+		{"mqtt-tls-key", "MQTT_TLS_KEY", &c.mqttTLSKey},
+		{"mqtt-tx-topic", "MQTT_TX_TOPIC", &c.mqttTxTopic},
+		{"mqtt-tx-allow", "MQTT_TX_ALLOW", &c.mqttTxAllow},
+		{"ampio-events", "AMPIO_EVENTS", &c.ampioEvents},
+		{"ampio-prefix", "AMPIO_PREFIX", &c.ampioPrefix},
+		{"ampio-topic", "AMPIO_TOPIC", &c.ampioTopic},
+		{"store", "STORE", &c.store},
+		{"capture-trigger", "CAPTURE_TRIGGER", &c.captureTrigger},
+		{"capture-trigger-dir", "CAPTURE_TRIGGER_DIR", &c.captureTrigDir},
+		{"clock-step-policy", "CLOCK_STEP_POLICY", &c.clockPolicy},
+		{"rx-allow", "RX_ALLOW", &c.rxAllow},
+		{"rx-deny", "RX_DENY", &c.rxDeny},
+		{"tx-allow", "TX_ALLOW", &c.txAllow},
+		{"tx-deny", "TX_DENY", &c.txDeny},
+		{"rx-transform", "RX_TRANSFORM", &c.rxTransform},
+		{"tx-transform", "TX_TRANSFORM", &c.txTransform},
+		{"tx-dedup-ids", "TX_DEDUP_IDS", &c.txDedupIDs},
+		{"emulate", "EMULATE", &c.emulate},
+		{"replay-file", "REPLAY_FILE", &c.replayFile},
+		{"replay-tx-file", "REPLAY_TX_FILE", &c.replayTxFile},
+		{"tx-priority-ids", "TX_PRIORITY_IDS", &c.txPriorityIDs},
+		{"tx-inhibit", "TX_INHIBIT", &c.txInhibit},
+		{"arbitration-id", "ARBITRATION_ID", &c.arbID},
+		{"cyclic-tx", "CYCLIC_TX", &c.cyclicTx},
+		{"heartbeat-frame", "HEARTBEAT_FRAME", &c.hbFrame},
+		{"heartbeat-target", "HEARTBEAT_TARGET", &c.hbTarget},
+	} {
+		if _, ok := set[e.flag]; !ok {
+			if v, ok := get(envName(e.env)); ok {
+				*e.dst = v
+			}
+		}
+	}
+	if _, ok := set["udp-local"]; !ok {
+		if v, ok := get(envName("UDP_LOCAL")); ok && v != "" {
+			c.udpLocal = v
+		}
+	}
+	if _, ok := set["replay-speed"]; !ok {
+		if v, ok := get(envName("REPLAY_SPEED")); ok && v != "" {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				c.replaySpeed = f
+			} else if firstErr == nil {
+				firstErr = fmt.Errorf("invalid %s: %w", envName("REPLAY_SPEED"), err)
+			}
+		}
+	}
 	if _, ok := set["max-clients"]; !ok {
-		if v, ok := get("CAN_SERVER_MAX_CLIENTS"); ok && v != "" {
+		if v, ok := get(envName("MAX_CLIENTS")); ok && v != "" {
 			if n, err := strconv.Atoi(v); err == nil && n >= 0 {
 				c.maxClients = n
 			} else if err != nil && firstErr == nil {
-				firstErr = fmt.Errorf("invalid CAN_SERVER_MAX_CLIENTS: %w", err)
+				firstErr = fmt.Errorf("invalid %s: %w", envName("MAX_CLIENTS"), err)
+			}
+		}
+	}
+	if _, ok := set["capture-size"]; !ok {
+		if v, ok := get(envName("CAPTURE_SIZE")); ok && v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+				c.captureSize = n
+			} else if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("invalid %s: %w", envName("CAPTURE_SIZE"), err)
+			}
+		}
+	}
+	if _, ok := set["bridge-ttl"]; !ok {
+		if v, ok := get(envName("BRIDGE_TTL")); ok && v != "" {
+			if n, err := strconv.Atoi(v); err == nil {
+				c.bridgeTTL = n
+			} else if firstErr == nil {
+				firstErr = fmt.Errorf("invalid %s: %w", envName("BRIDGE_TTL"), err)
 			}
 		}
 	}
 	if _, ok := set["handshake-timeout"]; !ok {
-		if v, ok := get("CAN_SERVER_HANDSHAKE_TIMEOUT"); ok && v != "" {
+		if v, ok := get(envName("HANDSHAKE_TIMEOUT")); ok && v != "" {
 			if d, err := time.ParseDuration(v); err == nil && d > 0 {
 				c.handshakeTO = d
 			} else if err != nil && firstErr == nil {
-				firstErr = fmt.Errorf("invalid CAN_SERVER_HANDSHAKE_TIMEOUT: %w", err)
+				firstErr = fmt.Errorf("invalid %s: %w", envName("HANDSHAKE_TIMEOUT"), err)
 			}
 		}
 	}
 	if _, ok := set["client-read-timeout"]; !ok {
-		if v, ok := get("CAN_SERVER_CLIENT_READ_TIMEOUT"); ok && v != "" {
+		if v, ok := get(envName("CLIENT_READ_TIMEOUT")); ok && v != "" {
 			if d, err := time.ParseDuration(v); err == nil && d > 0 {
 				c.clientReadTO = d
 			} else if err != nil && firstErr == nil {
-				firstErr = fmt.Errorf("invalid CAN_SERVER_CLIENT_READ_TIMEOUT: %w", err)
+				firstErr = fmt.Errorf("invalid %s: %w", envName("CLIENT_READ_TIMEOUT"), err)
+			}
+		}
+	}
+	if _, ok := set["flush-interval"]; !ok {
+		if v, ok := get(envName("FLUSH_INTERVAL")); ok && v != "" {
+			if d, err := time.ParseDuration(v); err == nil && d > 0 {
+				c.flushInterval = d
+			} else if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("invalid %s: %w", envName("FLUSH_INTERVAL"), err)
+			}
+		}
+	}
+	if _, ok := set["batch-size"]; !ok {
+		if v, ok := get(envName("BATCH_SIZE")); ok && v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				c.batchSize = n
+			} else if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("invalid %s: %w", envName("BATCH_SIZE"), err)
+			}
+		}
+	}
+	for _, e := range []struct {
+		flag, env string
+		dst       *int
+	}{
+		{"hub-workers", "HUB_WORKERS", &c.hubWorkers},
+		{"rx-pipeline", "RX_PIPELINE", &c.rxPipeline},
+		{"pair-port", "PAIR_PORT", &c.pairPort},
+		{"read-buffer", "READ_BUFFER", &c.readBuffer},
+		{"max-decode-bytes", "MAX_DECODE_BYTES", &c.maxDecodeBytes},
+		{"max-burst-frames", "MAX_BURST_FRAMES", &c.maxBurstFrames},
+		{"max-handshake-bytes", "MAX_HANDSHAKE_BYTES", &c.maxHandshake},
+		{"session-replay", "SESSION_REPLAY", &c.sessionReplay},
+		{"conn-rate", "CONN_RATE", &c.connRate},
+		{"compression-min-saving", "COMPRESSION_MIN_SAVING", &c.compressSaving},
+		{"memory-limit-mb", "MEMORY_LIMIT_MB", &c.memoryLimitMB},
+		{"store-max-frames", "STORE_MAX_FRAMES", &c.storeMaxFrames},
+		{"capture-trigger-keep", "CAPTURE_TRIGGER_KEEP", &c.captureTrigKeep},
+		{"can-txqueuelen", "CAN_TXQUEUELEN", &c.canTxQueueLen},
+		{"slcan-bitrate", "SLCAN_BITRATE", &c.slcanBitrate},
+		{"arbitration-priority", "ARBITRATION_PRIORITY", &c.arbPriority},
+		{"counter-audit-tolerance", "COUNTER_AUDIT_TOLERANCE", &c.counterAuditTol},
+		{"upstream-tx-buffer", "UPSTREAM_TX_BUFFER", &c.upstreamTxBuffer},
+		{"mqtt-qos", "MQTT_QOS", &c.mqttQoS},
+	} {
+		if _, ok := set[e.flag]; !ok {
+			if v, ok := get(envName(e.env)); ok && v != "" {
+				if n, err := strconv.Atoi(v); err == nil {
+					*e.dst = n
+				} else if firstErr == nil {
+					firstErr = fmt.Errorf("invalid %s: %w", envName(e.env), err)
+				}
+			}
+		}
+	}
+	for _, e := range []struct {
+		flag, env string
+		dst       *time.Duration
+	}{
+		{"can-busy-poll", "CAN_BUSY_POLL", &c.canBusyPoll},
+		{"can-spin", "CAN_SPIN", &c.canSpin},
+		{"can-tx-wait", "CAN_TX_WAIT", &c.canTxWait},
+		{"can-tx-drop-poll", "CAN_TX_DROP_POLL", &c.canTxDropPoll},
+		{"rx-watchdog", "RX_WATCHDOG", &c.rxWatchdog},
+		{"wait-device", "WAIT_DEVICE", &c.waitDevice},
+		{"session-grace", "SESSION_GRACE", &c.sessionGrace},
+		{"session-sync", "SESSION_SYNC", &c.sessionSync},
+		{"arbitration-interval", "ARBITRATION_INTERVAL", &c.arbInterval},
+		{"heartbeat-interval", "HEARTBEAT_INTERVAL", &c.hbInterval},
+		{"conn-ban", "CONN_BAN", &c.connBan},
+		{"alert-cooldown", "ALERT_COOLDOWN", &c.alertCooldown},
+		{"store-retention", "STORE_RETENTION", &c.storeRetention},
+		{"store-presence-timeout", "STORE_PRESENCE_TIMEOUT", &c.storePresence},
+		{"clock-step-threshold", "CLOCK_STEP_THRESHOLD", &c.clockThreshold},
+		{"capture-trigger-pre", "CAPTURE_TRIGGER_PRE", &c.captureTrigPre},
+		{"capture-trigger-post", "CAPTURE_TRIGGER_POST", &c.captureTrigPost},
+		{"counter-audit", "COUNTER_AUDIT", &c.counterAudit},
+		{"upstream-ping", "UPSTREAM_PING", &c.upstreamPing},
+	} {
+		if _, ok := set[e.flag]; !ok {
+			if v, ok := get(envName(e.env)); ok && v != "" {
+				if d, err := time.ParseDuration(v); err == nil {
+					*e.dst = d
+				} else if firstErr == nil {
+					firstErr = fmt.Errorf("invalid %s: %w", envName(e.env), err)
+				}
+			}
+		}
+	}
+	if _, ok := set["burst-yield"]; !ok {
+		if v, ok := get(envName("BURST_YIELD")); ok && v != "" {
+			if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+				c.burstYield = d
+			} else if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("invalid %s: %w", envName("BURST_YIELD"), err)
+			}
+		}
+	}
+	if _, ok := set["hub-sample-interval"]; !ok {
+		if v, ok := get(envName("HUB_SAMPLE_INTERVAL")); ok && v != "" {
+			if d, err := time.ParseDuration(v); err == nil && d > 0 {
+				c.hubSampleEvery = d
+			} else if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("invalid %s: %w", envName("HUB_SAMPLE_INTERVAL"), err)
+			}
+		}
+	}
+	if _, ok := set["tx-dedup-window"]; !ok {
+		if v, ok := get(envName("TX_DEDUP_WINDOW")); ok && v != "" {
+			if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+				c.txDedupWindow = d
+			} else if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("invalid %s: %w", envName("TX_DEDUP_WINDOW"), err)
 			}
 		}
 	}
 	if _, ok := set["mdns-enable"]; !ok {
-		if v, ok := get("CAN_SERVER_MDNS_ENABLE"); ok && v != "" {
+		if v, ok := get(envName("MDNS_ENABLE")); ok && v != "" {
 			switch strings.ToLower(v) {
 			case "1", "true", "yes", "on":
 				c.mdnsEnable = true
@@ -246,16 +1272,40 @@ func applyEnvOverrides(c *appConfig, set map[string]struct{}) error {
 		}
 	}
 	if _, ok := set["mdns-name"]; !ok {
-		if v, ok := get("CAN_SERVER_MDNS_NAME"); ok && v != "" {
+		if v, ok := get(envName("MDNS_NAME")); ok && v != "" {
 			c.mdnsName = v
 		}
 	}
 	if _, ok := set["log-metrics-interval"]; !ok {
-		if v, ok := get("CAN_SERVER_LOG_METRICS_INTERVAL"); ok && v != "" {
+		if v, ok := get(envName("LOG_METRICS_INTERVAL")); ok && v != "" {
 			if d, err := time.ParseDuration(v); err == nil && d >= 0 {
 				c.logMetricsEvery = d
 			} else if err != nil && firstErr == nil {
-				firstErr = fmt.Errorf("invalid CAN_SERVER_LOG_METRICS_INTERVAL: %w", err)
+				firstErr = fmt.Errorf("invalid %s: %w", envName("LOG_METRICS_INTERVAL"), err)
+			}
+		}
+	}
+	if _, ok := set["dump-dir"]; !ok {
+		if v, ok := get(envName("DUMP_DIR")); ok && v != "" {
+			c.dumpDir = v
+		}
+	}
+	// The token file variant stays file-backed (not inlined) so SIGHUP can re-read it.
+	_, tokFlag := set["auth-token"]
+	_, fileFlag := set["token-file"]
+	if !tokFlag && !fileFlag {
+		if v, ok := os.LookupEnv(envName("AUTH_TOKEN")); ok && strings.TrimSpace(v) != "" {
+			c.authToken = strings.TrimSpace(v)
+		} else if v, ok := os.LookupEnv(envName("AUTH_TOKEN_FILE")); ok && strings.TrimSpace(v) != "" {
+			c.tokenFile = strings.TrimSpace(v)
+		}
+	}
+	if _, ok := set["event-history"]; !ok {
+		if v, ok := get(envName("EVENT_HISTORY")); ok && v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+				c.eventRingSize = n
+			} else if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("invalid %s: %w", envName("EVENT_HISTORY"), err)
 			}
 		}
 	}
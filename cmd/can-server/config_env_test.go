@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -76,3 +77,52 @@ func TestApplyEnvOverrides_BadInt(t *testing.T) {
 		t.Fatalf("expected error for bad integer")
 	}
 }
+
+func TestApplyEnvOverrides_CustomPrefix(t *testing.T) {
+	t.Setenv(envPrefixVar, "AMPIO_GW_")
+	t.Setenv("AMPIO_GW_LISTEN", ":21000")
+	t.Setenv("CAN_SERVER_BAUD", "230400") // ignored under a custom prefix
+	c := &appConfig{listenAddr: ":20000", baud: 115200}
+	if err := applyEnvOverrides(c, map[string]struct{}{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.listenAddr != ":21000" || c.baud != 115200 {
+		t.Fatalf("got listen=%q baud=%d", c.listenAddr, c.baud)
+	}
+	t.Setenv("AMPIO_GW_BAUD", "x")
+	if err := applyEnvOverrides(c, map[string]struct{}{}); err == nil || !strings.Contains(err.Error(), "AMPIO_GW_BAUD") {
+		t.Fatalf("expected error naming AMPIO_GW_BAUD, got %v", err)
+	}
+}
+
+func TestApplyEnvOverrides_FlushTuning(t *testing.T) {
+	base := &appConfig{}
+	t.Setenv("CAN_SERVER_FLUSH_INTERVAL", "2ms")
+	t.Setenv("CAN_SERVER_BATCH_SIZE", "16")
+	if err := applyEnvOverrides(base, map[string]struct{}{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if base.flushInterval != 2*time.Millisecond || base.batchSize != 16 {
+		t.Fatalf("flush tuning = %v/%d", base.flushInterval, base.batchSize)
+	}
+	t.Setenv("CAN_SERVER_BATCH_SIZE", "many")
+	if err := applyEnvOverrides(&appConfig{}, map[string]struct{}{}); err == nil {
+		t.Fatal("expected error for bad batch size")
+	}
+}
+
+func TestApplyEnvOverrides_SocketCANOwnMessages(t *testing.T) {
+	base := &appConfig{canLoopback: true}
+	t.Setenv("CAN_SERVER_CAN_LOOPBACK", "false")
+	t.Setenv("CAN_SERVER_CAN_RECV_OWN", "1")
+	if err := applyEnvOverrides(base, map[string]struct{}{"can-recv-own": {}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if base.canLoopback || base.canRecvOwn {
+		t.Fatalf("loopback=%v recv-own=%v, want env loopback and flag recv-own", base.canLoopback, base.canRecvOwn)
+	}
+	t.Setenv("CAN_SERVER_CAN_LOOPBACK", "maybe")
+	if err := applyEnvOverrides(&appConfig{}, map[string]struct{}{}); err == nil {
+		t.Fatal("expected error for bad boolean")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configFileSkip lists flags that are meaningless inside a config file.
+var configFileSkip = map[string]struct{}{
+	"config":               {},
+	"version":              {},
+	"check-config":         {},
+	"check-probe":          {},
+	"print-default-config": {},
+	"self-test":            {},
+	"self-test-duration":   {},
+	"self-test-probe":      {},
+	"compare":              {},
+	"compare-duration":     {},
+	"compare-tolerance":    {},
+	"assert":               {},
+	"assert-duration":      {},
+	"assert-tolerance":     {},
+	"assert-record":        {},
+	"diff":                 {},
+	"diff-all":             {},
+	"soak":                 {},
+	"soak-clients":         {},
+	"soak-rate":            {},
+	"soak-interval":        {},
+	"soak-lifetime":        {},
+}
+
+// instanceSection holds the raw keys of one [instance.<name>] or
+// [vbus.<name>] section.
+type instanceSection struct {
+	name   string
+	values map[string]string
+}
+
+// fileConfig is the parsed content of a config file: top-level keys plus
+// optional per-instance and virtual bus sections, in file order.
+type fileConfig struct {
+	values    map[string]string
+	instances []instanceSection
+	vbuses    []instanceSection
+}
+
+// parseConfigFile reads a key/value config file. Keys are flag names.
+// Both TOML-style `key = value` and YAML-style `key: value` lines are
+// accepted; `#` starts a comment and values may be single or double quoted.
+// `[instance.<name>]` starts a section describing one gateway instance and
+// `[vbus.<name>]` one virtual bus.
+func parseConfigFile(path string) (*fileConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	defer f.Close()
+	fc := &fileConfig{values: make(map[string]string)}
+	cur := fc.values
+	sc := bufio.NewScanner(f)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" || line == "---" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			kind, name, _ := strings.Cut(strings.TrimSpace(line[1:len(line)-1]), ".")
+			secs := &fc.instances
+			if kind == "vbus" {
+				secs = &fc.vbuses
+			}
+			if kind != "instance" && kind != "vbus" || !validInstanceName(name) {
+				return nil, fmt.Errorf("config file %s:%d: expected [instance.<name>] or [vbus.<name>] (letters, digits, - or _)", path, lineNo)
+			}
+			for _, in := range *secs {
+				if in.name == name {
+					return nil, fmt.Errorf("config file %s:%d: duplicate %s %q", path, lineNo, kind, name)
+				}
+			}
+			*secs = append(*secs, instanceSection{name: name, values: make(map[string]string)})
+			cur = (*secs)[len(*secs)-1].values
+			continue
+		}
+		i := strings.IndexAny(line, "=:")
+		if i <= 0 {
+			return nil, fmt.Errorf("config file %s:%d: expected key = value", path, lineNo)
+		}
+		key := strings.TrimSpace(line[:i])
+		val := unquote(strings.TrimSpace(line[i+1:]))
+		if _, dup := cur[key]; dup {
+			return nil, fmt.Errorf("config file %s:%d: duplicate key %q", path, lineNo, key)
+		}
+		cur[key] = val
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	return fc, nil
+}
+
+func validInstanceName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// applyConfigFile sets flags in fs from the file at path unless they were
+// explicitly given on the command line (present in set). Instance and
+// virtual bus sections are returned unapplied; see appConfig.instanceConfigs
+// and appConfig.vbusConfigs.
+func applyConfigFile(fs *flag.FlagSet, path string, set map[string]struct{}) (*fileConfig, error) {
+	fc, err := parseConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range fc.values {
+		if _, skip := configFileSkip[k]; skip || fs.Lookup(k) == nil {
+			return nil, fmt.Errorf("config file %s: unknown key %q", path, k)
+		}
+		if _, ok := set[k]; ok {
+			continue // command line wins
+		}
+		if err := fs.Set(k, v); err != nil {
+			return nil, fmt.Errorf("config file %s: %s: %w", path, k, err)
+		}
+	}
+	return fc, nil
+}
+
+// stripComment removes a trailing # comment that is not inside quotes.
+func stripComment(s string) string {
+	var quote rune
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#':
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' && s[len(s)-1] == '"' || s[0] == '\'' && s[len(s)-1] == '\'') {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// writeDefaultConfig emits a commented config file template listing every
+// configurable flag with its usage text and built-in default.
+func writeDefaultConfig(w io.Writer, fs *flag.FlagSet) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# can-server configuration file")
+	fmt.Fprintln(bw, "# Keys are flag names. Uncomment and edit the entries you need.")
+	fmt.Fprintln(bw, "# Precedence: command-line flag > environment variable > this file > default.")
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, skip := configFileSkip[f.Name]; skip {
+			return
+		}
+		kind, usage := flag.UnquoteUsage(f)
+		val := f.DefValue
+		if kind == "string" {
+			val = strconv.Quote(val)
+		}
+		fmt.Fprintf(bw, "\n# %s\n# %s = %s\n", usage, f.Name, val)
+	})
+	return bw.Flush()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConf(t *testing.T, body string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "can-server.conf")
+	if err := os.WriteFile(p, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestApplyConfigFile_Precedence(t *testing.T) {
+	fs := flag.NewFlagSet("t", flag.ContinueOnError)
+	listen := fs.String("listen", ":20000", "")
+	baud := fs.Int("baud", 115200, "")
+	policy := fs.String("hub-policy", "drop", "")
+	p := writeConf(t, "# comment\nlisten = \":21000\" # trailing\nbaud: 230400\nhub-policy = 'kick'\n")
+	// baud given on the command line wins over the file.
+	if _, err := applyConfigFile(fs, p, map[string]struct{}{"baud": {}}); err != nil {
+		t.Fatalf("applyConfigFile: %v", err)
+	}
+	if *listen != ":21000" || *baud != 115200 || *policy != "kick" {
+		t.Fatalf("got listen=%q baud=%d policy=%q", *listen, *baud, *policy)
+	}
+}
+
+func TestApplyConfigFile_Errors(t *testing.T) {
+	fs := flag.NewFlagSet("t", flag.ContinueOnError)
+	fs.Int("baud", 115200, "")
+	for name, body := range map[string]string{
+		"unknown":   "nope = 1\n",
+		"badValue":  "baud = fast\n",
+		"noKey":     "just text\n",
+		"duplicate": "baud = 1\nbaud = 2\n",
+	} {
+		if _, err := applyConfigFile(fs, writeConf(t, body), nil); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+// TestApplyConfigFile_ModeFlags ensures a config file cannot turn the
+// daemon into a one-shot run.
+func TestApplyConfigFile_ModeFlags(t *testing.T) {
+	fs := flag.NewFlagSet("t", flag.ContinueOnError)
+	for _, kv := range [][2]string{
+		{"self-test", "true"},
+		{"self-test-duration", "1s"},
+		{"self-test-probe", "7FF#"},
+		{"compare", "true"},
+		{"compare-duration", "1s"},
+		{"compare-tolerance", "1ms"},
+		{"assert", "golden.log"},
+		{"assert-duration", "1s"},
+		{"assert-tolerance", "1ms"},
+		{"assert-record", "out.log"},
+		{"diff", "a.log,b.log"},
+		{"diff-all", "true"},
+	} {
+		fs.String(kv[0], "", "")
+		if _, err := applyConfigFile(fs, writeConf(t, kv[0]+" = "+kv[1]+"\n"), nil); err == nil {
+			t.Fatalf("%s: expected error", kv[0])
+		}
+	}
+}
+
+func TestRunCheckConfig(t *testing.T) {
+	cfg := &appConfig{backend: "loopback", authToken: "secret", checkProbe: true}
+	var out bytes.Buffer
+	if rc := runCheckConfig(&out, cfg); rc != 0 {
+		t.Fatalf("expected rc 0, got %d: %s", rc, out.String())
+	}
+	if strings.Contains(out.String(), "secret") || !strings.Contains(out.String(), "configuration OK") {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+	out.Reset()
+	cfg = &appConfig{backend: "socketcan", canIf: "does-not-exist0", checkProbe: true}
+	if rc := runCheckConfig(&out, cfg); rc == 0 {
+		t.Fatalf("expected probe failure, output:\n%s", out.String())
+	}
+}
+
+// TestWriteDefaultConfigRoundTrip uncomments every entry of the template and
+// ensures it parses back to the same defaults.
+func TestWriteDefaultConfigRoundTrip(t *testing.T) {
+	fs := flag.NewFlagSet("t", flag.ContinueOnError)
+	name := fs.String("mdns-name", "", "mDNS instance name")
+	baud := fs.Int("baud", 115200, "Serial baud rate")
+	to := fs.Duration("client-read-timeout", 0, "Per-connection read deadline")
+	fs.Bool("version", false, "Print version and exit")
+	var out bytes.Buffer
+	if err := writeDefaultConfig(&out, fs); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "version") {
+		t.Fatalf("template should skip mode flags:\n%s", out.String())
+	}
+	var b strings.Builder
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "# ") && strings.Contains(line, " = ") {
+			line = strings.TrimPrefix(line, "# ")
+		}
+		b.WriteString(line + "\n")
+	}
+	if _, err := applyConfigFile(fs, writeConf(t, b.String()), nil); err != nil {
+		t.Fatalf("template did not round-trip: %v\n%s", err, b.String())
+	}
+	if *name != "" || *baud != 115200 || *to != 0 {
+		t.Fatalf("defaults changed: name=%q baud=%d to=%v", *name, *baud, *to)
+	}
+}
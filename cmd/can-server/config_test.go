@@ -24,6 +24,11 @@ func TestConfigValidate_OK(t *testing.T) {
 	if err := c.validate(); err != nil {
 		t.Fatalf("expected ok got %v", err)
 	}
+	// Serial IDs are extended, so is the heartbeat ID.
+	c.arbID, c.arbInterval = "000007F0", time.Second
+	if err := c.validate(); err != nil {
+		t.Fatalf("extended arbitration ID on serial: %v", err)
+	}
 }
 
 func TestConfigValidate_Errors(t *testing.T) {
@@ -38,9 +43,47 @@ func TestConfigValidate_Errors(t *testing.T) {
 		{"badHubBuf", func(c *appConfig) { c.hubBuffer = 0 }},
 		{"badBaud", func(c *appConfig) { c.baud = 0 }},
 		{"badSerialTO", func(c *appConfig) { c.serialReadTO = 0 }},
+		{"decodeBytesBelowFrame", func(c *appConfig) { c.maxDecodeBytes = 12 }},
+		{"handshakeBytesBelowHello", func(c *appConfig) { c.maxHandshake = 4 }},
+		{"recvOwnNoLoopback", func(c *appConfig) { c.canRecvOwn, c.canLoopback = true, false }},
+		{"noChecksumNotSerial", func(c *appConfig) { c.backend, c.serialNoChecksum = "socketcan", true }},
+		{"errFilterNotSocketCAN", func(c *appConfig) { c.backend, c.canErrFilter = "serial", "busoff" }},
+		{"badErrFilter", func(c *appConfig) { c.canErrFilter = "nope" }},
+		{"badNormalizeEFF", func(c *appConfig) { c.normalizeEFF = "always" }},
+		{"badNormalizeFlags", func(c *appConfig) { c.normalizeFlags = "drop" }},
+		{"stripErrWithErrFilter", func(c *appConfig) { c.canErrFilter, c.normalizeStripErr = "all", true }},
+		{"badRxPipeline", func(c *appConfig) { c.rxPipeline = -1 }},
 		{"badHandshakeTO", func(c *appConfig) { c.handshakeTO = 0 }},
 		{"badClientReadTO", func(c *appConfig) { c.clientReadTO = 0 }},
 		{"badMaxClients", func(c *appConfig) { c.maxClients = -1 }},
+		{"unknownDecoder", func(c *appConfig) { c.annotate = "nope" }},
+		{"annotateLogNotConfigured", func(c *appConfig) { c.annotate, c.annotateLog = "j1939", "ampio" }},
+		{"badMetricsNamespace", func(c *appConfig) { c.metricsNS = "1x" }},
+		{"badFrameValidation", func(c *appConfig) { c.frameValidation = "loose" }},
+		{"badFDBit", func(c *appConfig) { c.fdBit = "drop" }},
+		{"reservedMetricsLabel", func(c *appConfig) { c.metricsLabels = "instance=a" }},
+		{"connBanZero", func(c *appConfig) { c.connRate, c.connBan = 10, 0 }},
+		{"bridgeTTLZero", func(c *appConfig) { c.pairKey, c.pairPort, c.bridgeTTL = "0123456789abcdef", 20010, 0 }},
+		{"missingAlertRules", func(c *appConfig) { c.alerts = "/nonexistent/alerts.rules" }},
+		{"badAlertWebhook", func(c *appConfig) { c.alertWebhook = "ftp://example.com" }},
+		{"negativeAlertCooldown", func(c *appConfig) { c.alertCooldown = -time.Second }},
+		{"badSessionPeer", func(c *appConfig) { c.sessionPeer, c.sessionGrace = "peer:9100", time.Minute }},
+		{"sessionPeerWithoutSessions", func(c *appConfig) { c.sessionPeer, c.sessionSync = "http://peer:9100", time.Second }},
+		{"badArbitrationID", func(c *appConfig) { c.arbID, c.arbInterval = "7F00", time.Second }},
+		{"badArbitrationPriority", func(c *appConfig) { c.arbID, c.arbPriority, c.arbInterval = "000007F0", 256, time.Second }},
+		{"arbitrationIDFiltered", func(c *appConfig) { c.arbID, c.arbInterval, c.rxAllow = "000007F0", time.Second, "0x100-0x1FF" }},
+		{"arbitrationStandardIDForcedEFF", func(c *appConfig) { c.arbID, c.arbInterval = "7F0", time.Second }},
+		{"badHeartbeatFrame", func(c *appConfig) { c.hbFrame, c.hbInterval, c.hbTarget = "7FE", time.Second, "bus" }},
+		{"badHeartbeatTarget", func(c *appConfig) { c.hbFrame, c.hbInterval, c.hbTarget = "7FE#01", time.Second, "can" }},
+		{"heartbeatFiltered", func(c *appConfig) {
+			c.hbFrame, c.hbInterval, c.hbTarget, c.txDeny = "7FE#01", time.Second, "bus", "0x7FE"
+		}},
+		{"heartbeatArbitrationID", func(c *appConfig) {
+			c.hbFrame, c.hbInterval, c.hbTarget = "000007F0#01", time.Second, "both"
+			c.arbID, c.arbInterval = "000007F0", time.Second
+		}},
+		{"shortCounterAudit", func(c *appConfig) { c.counterAudit = 10 * time.Millisecond }},
+		{"negCounterAuditTolerance", func(c *appConfig) { c.counterAudit, c.counterAuditTol = time.Minute, -1 }},
 	}
 	for _, tc := range tests {
 		base := &appConfig{
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+const (
+	controlIdleTimeout = time.Minute
+	metricsStopTimeout = 5 * time.Second
+)
+
+// metricsControl owns the metrics/admin HTTP server so it can be opened and
+// closed at runtime through the control socket.
+type metricsControl struct {
+	ctx  context.Context
+	def  string // -metrics-addr, used when "metrics on" names no address
+	bind metrics.BindOptions
+
+	mu   sync.Mutex
+	srv  *http.Server
+	addr string
+}
+
+// start opens the metrics server on addr (def when empty) with the given
+// bind policy. It fails when the server is already running.
+func (m *metricsControl) start(addr, policy string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if addr == "" {
+		addr = m.def
+	}
+	if addr == "" {
+		return errors.New("no address given and -metrics-addr is not set")
+	}
+	if m.srv != nil {
+		return fmt.Errorf("already running on %s", m.addr)
+	}
+	b := m.bind
+	b.Policy = policy
+	srv, err := metrics.StartHTTP(m.ctx, addr, b)
+	if err != nil {
+		return err
+	}
+	m.srv, m.addr = srv, addr
+	return nil
+}
+
+// stop shuts the metrics server down; stopping a stopped server is a no-op.
+func (m *metricsControl) stop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), metricsStopTimeout)
+	defer cancel()
+	err := m.srv.Shutdown(ctx)
+	m.srv, m.addr = nil, ""
+	return err
+}
+
+// status describes the server state for control replies.
+func (m *metricsControl) status() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case m.srv == nil:
+		return "off"
+	case metrics.HTTPUp():
+		return "on addr=" + metrics.ListenAddr()
+	default:
+		return "binding addr=" + m.addr
+	}
+}
+
+// ready reports false while a started server is not listening yet (e.g.
+// still retrying its bind). A server switched off is not a readiness issue.
+func (m *metricsControl) ready() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.srv == nil || metrics.HTTPUp()
+}
+
+// controlCommand executes one control socket command and returns its
+// one-line reply, which starts with "ok" or "error".
+func controlCommand(line string, mc *metricsControl) string {
+	f := strings.Fields(line)
+	if len(f) < 2 || f[0] != "metrics" {
+		return "error usage: metrics on [addr] | metrics off | metrics status"
+	}
+	switch {
+	case f[1] == "on" && len(f) <= 3:
+		addr := ""
+		if len(f) == 3 {
+			addr = f[2]
+		}
+		// An operator asking for the port wants to hear about a failed bind
+		// rather than have it logged.
+		policy := mc.bind.Policy
+		if policy == "" || policy == metrics.BindWarn {
+			policy = metrics.BindFail
+		}
+		if err := mc.start(addr, policy); err != nil {
+			return "error " + err.Error()
+		}
+	case f[1] == "off" && len(f) == 2:
+		if err := mc.stop(); err != nil {
+			return "error " + err.Error()
+		}
+	case f[1] == "status" && len(f) == 2:
+	default:
+		return "error usage: metrics on [addr] | metrics off | metrics status"
+	}
+	return "ok " + mc.status()
+}
+
+// startControlSocket listens on the unix socket path (mode 0600) and serves
+// line-based control commands until ctx is done. A stale socket left by a
+// previous run is replaced; any other file at path is an error.
+func startControlSocket(ctx context.Context, path string, mc *metricsControl, l *slog.Logger, wg *sync.WaitGroup) error {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("control socket: %w", err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		_ = ln.Close()
+		return fmt.Errorf("control socket: %w", err)
+	}
+	l.Info("control_socket_listen", "path", path)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					l.Error("control_socket_error", "error", err)
+				}
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serveControl(ctx, conn, mc, l)
+			}()
+		}
+	}()
+	return nil
+}
+
+func serveControl(ctx context.Context, conn net.Conn, mc *metricsControl, l *slog.Logger) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	for ctx.Err() == nil {
+		_ = conn.SetReadDeadline(time.Now().Add(controlIdleTimeout))
+		if !sc.Scan() {
+			return
+		}
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		reply := controlCommand(line, mc)
+		l.Info("control_command", "command", line, "reply", reply)
+		if _, err := fmt.Fprintln(conn, reply); err != nil {
+			return
+		}
+	}
+}
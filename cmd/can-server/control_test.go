@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestControlSocketMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	mc := &metricsControl{ctx: ctx, def: "127.0.0.1:0"}
+	defer func() { _ = mc.stop() }()
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	if err := startControlSocket(ctx, path, mc, testLogger(), &wg); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	do := func(cmd string) string {
+		t.Helper()
+		if _, err := fmt.Fprintln(conn, cmd); err != nil {
+			t.Fatal(err)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(line)
+	}
+
+	if got := do("metrics status"); got != "ok off" {
+		t.Fatalf("status: %q", got)
+	}
+	if got := do("metrics on"); !strings.HasPrefix(got, "ok on addr=127.0.0.1:") {
+		t.Fatalf("on: %q", got)
+	}
+	if !mc.ready() {
+		t.Fatal("running metrics server not ready")
+	}
+	if got := do("metrics on"); !strings.HasPrefix(got, "error already running") {
+		t.Fatalf("second on: %q", got)
+	}
+	if got := do("metrics off"); got != "ok off" {
+		t.Fatalf("off: %q", got)
+	}
+	if got := do("metrics bogus"); !strings.HasPrefix(got, "error usage") {
+		t.Fatalf("bogus: %q", got)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+// devicePollInterval is how often waitDevice looks for the device.
+var devicePollInterval = 250 * time.Millisecond
+
+// backendDevice returns the serial device node, CAN interface or replay log
+// the backend of cfg opens and whether it exists now. name is empty for
+// backends without a local device; with several CAN interfaces it is the
+// first missing one.
+func backendDevice(cfg *appConfig) (name string, exists bool) {
+	switch kind, _ := splitBackend(cfg.backend); kind {
+	case "socketcan":
+		for _, iface := range cfg.canIfaces() {
+			if _, err := net.InterfaceByName(iface); err != nil {
+				return iface, false
+			}
+		}
+		return cfg.canIf, true
+	case "serial", "slcan":
+		_, err := os.Stat(cfg.serialDev)
+		return cfg.serialDev, err == nil
+	case "replay":
+		_, err := os.Stat(cfg.replayFile)
+		return cfg.replayFile, err == nil
+	}
+	return "", false
+}
+
+// waitDevice blocks until the backend device exists, for up to
+// -wait-device, so the gateway can start before USB enumeration or the
+// CAN interface setup finished. It returns at once when waiting is off or
+// the backend has no local device.
+func waitDevice(ctx context.Context, cfg *appConfig, l *slog.Logger) error {
+	if cfg.waitDevice <= 0 {
+		return nil
+	}
+	name, ok := backendDevice(cfg)
+	if name == "" || ok {
+		return nil
+	}
+	l.Info("backend_wait_device", "device", name, "timeout", cfg.waitDevice)
+	start := time.Now()
+	deadline := time.NewTimer(cfg.waitDevice)
+	defer deadline.Stop()
+	t := time.NewTicker(devicePollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return fmt.Errorf("device %s did not appear within %v", name, cfg.waitDevice)
+		case <-t.C:
+		}
+		if dev, ok := backendDevice(cfg); ok {
+			l.Info("backend_device_ready", "device", dev, "waited", time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+	}
+}
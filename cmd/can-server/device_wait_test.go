@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitDevice(t *testing.T) {
+	old := devicePollInterval
+	devicePollInterval = 5 * time.Millisecond
+	defer func() { devicePollInterval = old }()
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dev := filepath.Join(t.TempDir(), "ttyACM0")
+	cfg := &appConfig{backend: "serial", serialDev: dev, waitDevice: 2 * time.Second}
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		_ = os.WriteFile(dev, nil, 0o600)
+	}()
+	if err := waitDevice(context.Background(), cfg, l); err != nil {
+		t.Fatalf("device appearing late: %v", err)
+	}
+
+	cfg.serialDev = filepath.Join(t.TempDir(), "never")
+	cfg.waitDevice = 30 * time.Millisecond
+	if err := waitDevice(context.Background(), cfg, l); err == nil || !strings.Contains(err.Error(), "did not appear") {
+		t.Fatalf("missing device: got %v", err)
+	}
+
+	cfg.waitDevice = 0
+	if err := waitDevice(context.Background(), cfg, l); err != nil {
+		t.Fatalf("waiting disabled: %v", err)
+	}
+}
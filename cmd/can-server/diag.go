@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/block"
+	"github.com/kstaniek/go-ampio-server/internal/events"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+// writeDiagnostics writes a one-shot snapshot of process, per-instance hub and
+// client state followed by all goroutine stacks.
+func writeDiagnostics(w io.Writer, ring *events.Ring, insts ...*instance) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	fmt.Fprintf(w, "=== can-server diagnostics %s ===\n", time.Now().Format(time.RFC3339Nano))
+	fmt.Fprintf(w, "version=%s commit=%s date=%s\n", version, commit, date)
+	fmt.Fprintf(w, "goroutines=%d heap_alloc=%d heap_objects=%d num_gc=%d\n", runtime.NumGoroutine(), ms.HeapAlloc, ms.HeapObjects, ms.NumGC)
+
+	snap := metrics.Snap()
+	fmt.Fprintf(w, "\n--- counters ---\n%+v\n", snap)
+
+	for _, in := range insts {
+		writeInstanceDiagnostics(w, in.name, in.srv, in.hub)
+		if in.blocks != nil {
+			for _, e := range in.blocks.Entries() {
+				fmt.Fprintf(w, "block id=%s direction=%s expires=%s reason=%q by=%s\n", block.FormatID(e.ID), e.Dir, e.Expires.Format(time.RFC3339), e.Reason, e.By)
+			}
+		}
+	}
+	if ring != nil {
+		fmt.Fprintf(w, "\n--- recent events (total %d) ---\n", ring.Total())
+		for _, e := range ring.Snapshot() {
+			fmt.Fprintf(w, "%s %s %s %v\n", e.Time.Format(time.RFC3339Nano), e.Level, e.Msg, e.Attrs)
+		}
+	}
+
+	fmt.Fprintf(w, "\n--- goroutines ---\n")
+	_ = pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+func writeInstanceDiagnostics(w io.Writer, name string, srv *server.Server, h *hub.Hub) {
+	if name != "" {
+		fmt.Fprintf(w, "\n=== instance %s ===\n", name)
+	}
+	if h != nil {
+		fmt.Fprintf(w, "\n--- hub ---\nclients=%d buffer=%d policy=%s %+v\n", h.Count(), h.OutBufSize(), h.Policy(), h.Stats())
+	}
+	if srv != nil {
+		fmt.Fprintf(w, "\n--- server ---\naddr=%s %+v\n", srv.Addr(), srv.Stats())
+		for _, c := range srv.Clients() {
+			fmt.Fprintf(w, "client id=%d remote=%s identity=%s role=%s since=%s queue=%d/%d rtt=%s\n", c.ID, c.Remote, c.Identity, c.Role, c.ConnectedAt.Format(time.RFC3339), c.QueueLen, c.QueueCap, c.RTT)
+			if c.Compression != "" {
+				fmt.Fprintf(w, "  compression=%s raw_bytes=%d wire_bytes=%d\n", c.Compression, c.CompressRaw, c.CompressWire)
+			}
+		}
+		for _, e := range srv.RecentErrors() {
+			fmt.Fprintf(w, "server_error time=%s msg=%s\n", e.Time.Format(time.RFC3339Nano), e.Msg)
+		}
+	}
+}
+
+// dumpDiagnostics writes diagnostics to a timestamped file in dir, or to the
+// log when dir is empty.
+func dumpDiagnostics(dir string, ring *events.Ring, l *slog.Logger, insts ...*instance) {
+	var buf bytes.Buffer
+	writeDiagnostics(&buf, ring, insts...)
+	if dir == "" {
+		l.Warn("diagnostic_dump", "dump", buf.String())
+		return
+	}
+	name := filepath.Join(dir, fmt.Sprintf("can-server-dump-%s.txt", time.Now().UTC().Format("20060102T150405.000Z")))
+	if err := os.WriteFile(name, buf.Bytes(), 0o600); err != nil {
+		l.Error("diagnostic_dump_failed", "error", err, "path", name)
+		l.Warn("diagnostic_dump", "dump", buf.String())
+		return
+	}
+	l.Warn("diagnostic_dump", "path", name, "bytes", buf.Len())
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/events"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+func TestWriteDiagnostics(t *testing.T) {
+	var buf bytes.Buffer
+	ring := events.NewRing(4)
+	ring.Add(events.Event{Level: "WARN", Msg: "serial_read_error"})
+	writeDiagnostics(&buf, ring,
+		&instance{srv: server.NewServer(), hub: hub.New()},
+		&instance{name: "b", srv: server.NewServer(), hub: hub.New()})
+	out := buf.String()
+	for _, want := range []string{"--- hub ---", "--- server ---", "=== instance b ===", "--- goroutines ---", "goroutine ", "serial_read_error"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("diagnostics missing %q", want)
+		}
+	}
+}
+
+func TestDumpDiagnosticsToDir(t *testing.T) {
+	dir := t.TempDir()
+	dumpDiagnostics(dir, nil, testLogger(), &instance{hub: hub.New()})
+	matches, _ := filepath.Glob(filepath.Join(dir, "can-server-dump-*.txt"))
+	if len(matches) != 1 {
+		t.Fatalf("expected one dump file, got %v", matches)
+	}
+	if fi, err := os.Stat(matches[0]); err != nil || fi.Size() == 0 {
+		t.Fatalf("dump file empty or unreadable: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/kstaniek/go-ampio-server/internal/capture"
+)
+
+// runDiff compares the two candump logs of cfg.diff ID by ID and prints
+// the changes. It returns the process exit code like diff(1): 0 when no ID
+// changed, 1 when some did and 2 on errors.
+func runDiff(w io.Writer, cfg *appConfig) int {
+	before, after, ok := strings.Cut(cfg.diff, ",")
+	if !ok || before == "" || after == "" || strings.Contains(after, ",") {
+		fmt.Fprintln(w, "FAIL diff: want -diff before.log,after.log")
+		return 2
+	}
+	a, err := readCandumpFile(before)
+	if err != nil {
+		fmt.Fprintf(w, "FAIL %v\n", err)
+		return 2
+	}
+	b, err := readCandumpFile(after)
+	if err != nil {
+		fmt.Fprintf(w, "FAIL %v\n", err)
+		return 2
+	}
+	diffs := capture.DiffIDs(a, b)
+	fmt.Fprintf(w, "# diff a=%s (%d frames, %s) b=%s (%d frames, %s) ids=%d\n",
+		before, len(a), span(a), after, len(b), span(b), len(diffs))
+	n := capture.WriteIDDiffs(w, diffs, cfg.diffAll)
+	fmt.Fprintf(w, "# %d of %d IDs changed\n", n, len(diffs))
+	if n > 0 {
+		return 1
+	}
+	return 0
+}
+
+// span is the time covered by a capture.
+func span(recs []capture.Record) string {
+	return recs[len(recs)-1].Time.Sub(recs[0].Time).String()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunDiff(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	before := write("before.log", "(1600000000.000000) can0 123#01\n(1600000001.000000) can0 123#01\n")
+	after := write("after.log", "(1600000100.000000) can0 123#01\n(1600000101.000000) can0 124#01\n")
+	for _, tc := range []struct {
+		spec string
+		code int
+		want []string
+	}{
+		{before + "," + before, 0, []string{"# 0 of 1 IDs changed"}},
+		{before + "," + after, 1, []string{"rate     123", "new      124", "# 2 of 2 IDs changed"}},
+		{before, 2, []string{"want -diff before.log,after.log"}},
+		{before + "," + filepath.Join(dir, "missing.log"), 2, []string{"FAIL"}},
+	} {
+		var out bytes.Buffer
+		c := &appConfig{diff: tc.spec}
+		if code := runDiff(&out, c); code != tc.code {
+			t.Errorf("%s: exit %d, want %d\n%s", tc.spec, code, tc.code, out.String())
+		}
+		for _, w := range tc.want {
+			if !strings.Contains(out.String(), w) {
+				t.Errorf("%s: output lacks %q:\n%s", tc.spec, w, out.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+)
+
+const (
+	doctorDialTimeout = time.Second
+	unitName          = "can-server.service"
+)
+
+// Doctor check outcomes. Only doctorFail makes the command exit non-zero.
+const (
+	doctorPass = "PASS"
+	doctorWarn = "WARN"
+	doctorFail = "FAIL"
+	doctorSkip = "SKIP"
+)
+
+// doctorCheck is one environment check and, when it did not pass, what to
+// do about it.
+type doctorCheck struct {
+	status string
+	msg    string
+	fix    string
+}
+
+// unitDirs are searched for the packaged systemd unit.
+var unitDirs = []string{"/etc/systemd/system", "/lib/systemd/system", "/usr/lib/systemd/system"}
+
+// runDoctor checks the host prerequisites of cfg (devices, ports, mDNS,
+// systemd), prints each result with remediation text and returns the
+// process exit code (0 = no failures).
+func runDoctor(w io.Writer, cfg *appConfig) int {
+	insts, err := cfg.instanceConfigs()
+	if err != nil {
+		fmt.Fprintf(w, "FAIL configuration: %v\n", err)
+		return 1
+	}
+	var checks []doctorCheck
+	anyRunning := false
+	for _, ic := range insts {
+		prefix := ""
+		if ic.name != "" {
+			prefix = "[" + ic.name + "] "
+		}
+		// A running gateway holds its device and ports; checking them would
+		// only report its own locks as failures.
+		running := gatewayRunning(ic.listenAddr)
+		anyRunning = anyRunning || running
+		backend := doctorBackend(ic)
+		if running && holdsBackend(ic) {
+			backend = []doctorCheck{{status: doctorSkip, msg: "backend " + ic.backend + ": held by the running can-server"}}
+		}
+		for _, c := range append(backend, doctorListen("listen", ic.listenAddr)) {
+			c.msg = prefix + c.msg
+			checks = append(checks, c)
+		}
+	}
+	if cfg.metricsAddr != "" {
+		c := doctorListen("metrics-addr", cfg.metricsAddr)
+		if anyRunning && c.status == doctorFail && strings.HasSuffix(c.msg, "already in use") {
+			c.status = doctorWarn
+			c.msg += " (can-server already running?)"
+		}
+		checks = append(checks, c)
+	}
+	checks = append(checks, doctorMDNS(cfg), doctorSystemd())
+	failed := false
+	for _, c := range checks {
+		fmt.Fprintf(w, "%s %s\n", c.status, c.msg)
+		if c.fix != "" && c.status != doctorPass {
+			fmt.Fprintf(w, "     fix: %s\n", c.fix)
+		}
+		failed = failed || c.status == doctorFail
+	}
+	if failed {
+		fmt.Fprintln(w, "# doctor: problems found")
+		return 1
+	}
+	fmt.Fprintln(w, "# doctor: OK")
+	return 0
+}
+
+// doctorBackend checks the backend device of one instance.
+func doctorBackend(cfg *appConfig) []doctorCheck {
+	kind, arg := splitBackend(cfg.backend)
+	switch kind {
+	case "serial", "slcan":
+		return []doctorCheck{doctorSerial(cfg.serialDev)}
+	case "socketcan":
+		var checks []doctorCheck
+		for _, iface := range cfg.canIfaces() {
+			checks = append(checks, doctorSocketCAN(iface)...)
+		}
+		return checks
+	case "replay":
+		recs, err := readCandumpFile(cfg.replayFile)
+		if err != nil {
+			return []doctorCheck{{doctorFail, fmt.Sprintf("replay log %s: %v", cfg.replayFile, err), "Point -replay-file at a candump -l log (\"(sec.usec) iface ID#DATA\" lines)."}}
+		}
+		return []doctorCheck{{status: doctorPass, msg: fmt.Sprintf("replay log %s: %d frames", cfg.replayFile, len(recs))}}
+	case backendCannelloniUDP:
+		if _, err := net.ResolveUDPAddr("udp", arg); err != nil {
+			return []doctorCheck{{doctorFail, fmt.Sprintf("cannelloni-udp remote %s: %v", arg, err), "Use host:port with a resolvable host (check DNS or use an IP address)."}}
+		}
+		c := doctorCheck{status: doctorPass, msg: "cannelloni-udp remote " + arg + " resolves"}
+		ln, err := net.ListenPacket("udp", cfg.udpLocal)
+		if err != nil {
+			return []doctorCheck{c, {doctorFail, fmt.Sprintf("udp-local %s: %v", cfg.udpLocal, err), "Pick a free local port with -udp-local (ss -lunp shows UDP sockets in use)."}}
+		}
+		_ = ln.Close()
+		return []doctorCheck{c, {status: doctorPass, msg: "udp-local " + cfg.udpLocal + " can be bound"}}
+	case backendCannelloniTCP:
+		conn, err := net.DialTimeout("tcp", arg, doctorDialTimeout)
+		if err != nil {
+			return []doctorCheck{{doctorFail, fmt.Sprintf("cannelloni-tcp upstream %s: %v", arg, err), "Check the upstream server runs and its port is reachable from here (firewall, VPN). The gateway keeps redialling, so this is only fatal if it persists."}}
+		}
+		_ = conn.Close()
+		return []doctorCheck{{status: doctorPass, msg: "cannelloni-tcp upstream " + arg + " accepts connections"}}
+	default:
+		return []doctorCheck{{status: doctorPass, msg: "backend " + cfg.backend + " needs no device"}}
+	}
+}
+
+func doctorSerial(dev string) doctorCheck {
+	fi, err := os.Stat(dev)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return doctorCheck{doctorFail, "serial device " + dev + " not found",
+			"Check the adapter is plugged in (dmesg | tail), list candidates with ls -l /dev/serial/by-id/ and set -serial to a stable by-id path."}
+	case err != nil:
+		return doctorCheck{doctorFail, fmt.Sprintf("serial device %s: %v", dev, err), ""}
+	case fi.Mode()&fs.ModeCharDevice == 0:
+		return doctorCheck{doctorFail, "serial device " + dev + " is not a character device", "Point -serial at the tty device node (e.g. /dev/ttyUSB0)."}
+	}
+	f, err := os.OpenFile(dev, os.O_RDWR|syscall.O_NONBLOCK|syscall.O_NOCTTY, 0)
+	if err != nil {
+		if errors.Is(err, fs.ErrPermission) {
+			return doctorCheck{doctorFail, "serial device " + dev + ": permission denied",
+				"Add the service user to the group owning the device (ls -l " + dev + ", usually dialout): sudo usermod -aG dialout $USER, then log in again."}
+		}
+		return doctorCheck{doctorFail, fmt.Sprintf("serial device %s: %v", dev, err), "Make sure no other program (e.g. ModemManager) holds the port."}
+	}
+	_ = f.Close()
+	return doctorCheck{status: doctorPass, msg: "serial device " + dev + " is readable and writable"}
+}
+
+func doctorSocketCAN(iface string) []doctorCheck {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return []doctorCheck{{doctorFail, fmt.Sprintf("can-if %s: %v", iface, err),
+			"Load the CAN driver (for a HAT check the dtoverlay lines in /boot/config.txt; dmesg | grep -i can) or create a virtual bus: sudo ip link add dev " + iface + " type vcan."}}
+	}
+	out := []doctorCheck{{status: doctorPass, msg: "can-if " + iface + " exists"}}
+	// ARPHRD_CAN; sysfs is Linux only, so an unreadable type is not an error.
+	if t, err := os.ReadFile("/sys/class/net/" + iface + "/type"); err == nil && strings.TrimSpace(string(t)) != "280" {
+		out = append(out, doctorCheck{doctorFail, "can-if " + iface + " is not a CAN interface", "Set -can-if to a CAN interface (ip -br link shows them as link/can)."})
+	}
+	if ifi.Flags&net.FlagUp == 0 {
+		return append(out, doctorCheck{doctorFail, "can-if " + iface + " is down",
+			"sudo ip link set " + iface + " up type can bitrate 50000 (vcan: sudo ip link set " + iface + " up); make it persistent with systemd-networkd or /etc/network/interfaces."})
+	}
+	if st, err := os.ReadFile("/sys/class/net/" + iface + "/operstate"); err == nil {
+		if s := strings.TrimSpace(string(st)); s != "up" && s != "unknown" {
+			return append(out, doctorCheck{doctorWarn, "can-if " + iface + " is up but its link is " + s,
+				"Check wiring and termination; ip -details -statistics link show " + iface + " shows bus-off/error-passive state. Restart it with ip link set " + iface + " down && ip link set " + iface + " up."})
+		}
+	}
+	return append(out, doctorCheck{status: doctorPass, msg: "can-if " + iface + " is up"})
+}
+
+// holdsBackend reports whether a running instance of cfg keeps its backend
+// open exclusively, so doctor cannot check it alongside.
+func holdsBackend(cfg *appConfig) bool {
+	switch kind, _ := splitBackend(cfg.backend); kind {
+	case "serial", "slcan", backendCannelloniUDP:
+		return true
+	}
+	return false
+}
+
+// gatewayRunning reports whether addr is bound by a server answering the
+// cannelloni handshake, most likely a running can-server.
+func gatewayRunning(addr string) bool {
+	ln, err := net.Listen("tcp", addr)
+	if err == nil {
+		_ = ln.Close()
+		return false
+	}
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		return false
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	return answersCannelloni(port)
+}
+
+// doctorListen checks addr can be bound. A busy port answering the
+// cannelloni handshake most likely belongs to a running can-server.
+func doctorListen(name, addr string) doctorCheck {
+	ln, err := net.Listen("tcp", addr)
+	if err == nil {
+		_ = ln.Close()
+		return doctorCheck{status: doctorPass, msg: name + " " + addr + " is available"}
+	}
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		return doctorCheck{doctorFail, fmt.Sprintf("%s %s: %v", name, addr, err), "Use an address of this host; ports below 1024 need root or CAP_NET_BIND_SERVICE."}
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	if name == "listen" && answersCannelloni(port) {
+		return doctorCheck{doctorWarn, name + " " + addr + " is in use by a cannelloni server (can-server already running?)",
+			"Stop the running instance (systemctl stop can-server) before starting another one on this port, or choose another -listen address."}
+	}
+	return doctorCheck{doctorFail, name + " " + addr + " is already in use",
+		"Find the owner with ss -ltnp 'sport = :" + port + "' and stop it, or choose another -" + name + " address."}
+}
+
+func answersCannelloni(port string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), doctorDialTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	return cnl.Handshake(ctx, conn, doctorDialTimeout) == nil
+}
+
+// doctorMDNS checks there is an interface mDNS can advertise on.
+func doctorMDNS(cfg *appConfig) doctorCheck {
+	if !cfg.mdnsEnable {
+		return doctorCheck{status: doctorSkip, msg: "mdns-enable is off"}
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return doctorCheck{doctorFail, fmt.Sprintf("mdns: list interfaces: %v", err), ""}
+	}
+	var names []string
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 && ifi.Flags&net.FlagLoopback == 0 {
+			names = append(names, ifi.Name)
+		}
+	}
+	if len(names) == 0 {
+		return doctorCheck{doctorWarn, "mdns: no multicast-capable network interface is up",
+			"Bring up the LAN interface, or enable multicast on it (ip link set <if> multicast on); otherwise disable mDNS with -mdns-enable=false."}
+	}
+	return doctorCheck{status: doctorPass, msg: "mdns: can advertise on " + strings.Join(names, ",")}
+}
+
+// doctorSystemd checks the packaged unit is installed and reports its state.
+func doctorSystemd() doctorCheck {
+	if runtime.GOOS != "linux" {
+		return doctorCheck{status: doctorSkip, msg: "systemd: not Linux"}
+	}
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		return doctorCheck{status: doctorSkip, msg: "systemd: not the init system"}
+	}
+	unit := ""
+	for _, d := range unitDirs {
+		if _, err := os.Stat(d + "/" + unitName); err == nil {
+			unit = d + "/" + unitName
+			break
+		}
+	}
+	if unit == "" {
+		return doctorCheck{doctorWarn, "systemd: " + unitName + " is not installed",
+			"Install the .deb package, or copy packaging/deb/etc/systemd/system/" + unitName + " to /etc/systemd/system/ and run systemctl daemon-reload && systemctl enable --now can-server."}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorDialTimeout)
+	defer cancel()
+	enabled, _ := exec.CommandContext(ctx, "systemctl", "is-enabled", unitName).Output()
+	active, _ := exec.CommandContext(ctx, "systemctl", "is-active", unitName).Output()
+	state := fmt.Sprintf("%s, %s", strings.TrimSpace(string(enabled)), strings.TrimSpace(string(active)))
+	if strings.TrimSpace(string(enabled)) != "enabled" {
+		return doctorCheck{doctorWarn, "systemd: " + unit + " (" + state + ")", "Start it at boot with systemctl enable can-server."}
+	}
+	return doctorCheck{status: doctorPass, msg: "systemd: " + unit + " (" + state + ")"}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+func TestDoctorListen(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	if c := doctorListen("metrics-addr", busy.Addr().String()); c.status != doctorFail || !strings.Contains(c.fix, "ss -ltnp") {
+		t.Fatalf("busy port: %+v", c)
+	}
+	_ = busy.Close()
+	if c := doctorListen("listen", busy.Addr().String()); c.status != doctorPass {
+		t.Fatalf("free port: %+v", c)
+	}
+
+	// A port held by a cannelloni server is reported as a running gateway.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := server.NewServer(server.WithHub(hub.New()), server.WithCodec(&cnl.Codec{}), server.WithListenAddr("127.0.0.1:0"))
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+	if c := doctorListen("listen", srv.Addr()); c.status != doctorWarn || !strings.Contains(c.msg, "cannelloni") {
+		t.Fatalf("running gateway: %+v", c)
+	}
+
+	// With the gateway running, the device it holds is not reported as failing.
+	var buf bytes.Buffer
+	cfg := &appConfig{backend: "serial", serialDev: "/dev/does-not-exist", listenAddr: srv.Addr()}
+	if code := runDoctor(&buf, cfg); code != 0 || !strings.Contains(buf.String(), "SKIP backend serial: held by the running can-server") {
+		t.Fatalf("running gateway: code %d\n%s", code, buf.String())
+	}
+}
+
+func TestRunDoctor(t *testing.T) {
+	var buf bytes.Buffer
+	cfg := &appConfig{backend: "serial", serialDev: "/dev/does-not-exist", listenAddr: "127.0.0.1:0"}
+	if code := runDoctor(&buf, cfg); code != 1 {
+		t.Fatalf("missing serial device: code %d\n%s", code, buf.String())
+	}
+	if !strings.Contains(buf.String(), "FAIL serial device /dev/does-not-exist not found") || !strings.Contains(buf.String(), "fix: ") {
+		t.Fatalf("report:\n%s", buf.String())
+	}
+	buf.Reset()
+	cfg = &appConfig{backend: "loopback", listenAddr: "127.0.0.1:0"}
+	if code := runDoctor(&buf, cfg); code != 0 {
+		t.Fatalf("loopback: code %d\n%s", code, buf.String())
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/arbiter"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/heartbeat"
+)
+
+// heartbeatConfig builds the -heartbeat-* settings; ok is false when
+// heartbeats are off.
+func (c *appConfig) heartbeatConfig() (hc heartbeat.Config, ok bool, err error) {
+	if c.hbFrame == "" {
+		return hc, false, nil
+	}
+	fr, err := can.ParseFrame(c.hbFrame)
+	if err != nil {
+		return hc, false, fmt.Errorf("heartbeat-frame: %w", err)
+	}
+	target, err := heartbeat.ParseTarget(c.hbTarget)
+	if err != nil {
+		return hc, false, fmt.Errorf("heartbeat-target: %w", err)
+	}
+	hc = heartbeat.Config{Frame: fr, Interval: c.hbInterval, Counter: c.hbCounter, Target: target}
+	if err := hc.Check(); err != nil {
+		return hc, false, fmt.Errorf("heartbeat: %w", err)
+	}
+	return hc, true, nil
+}
+
+func (c *appConfig) validateHeartbeat() error {
+	hc, ok, err := c.heartbeatConfig()
+	if err != nil || !ok {
+		return err
+	}
+	rx, tx, err := c.filters()
+	if err != nil {
+		return err
+	}
+	if hc.Target&heartbeat.Bus != 0 && tx != nil && !tx.Allow(&hc.Frame) {
+		return fmt.Errorf("heartbeat-frame %s: the backend TX filter must pass it", c.hbFrame)
+	}
+	if hc.Target&heartbeat.Clients != 0 && rx != nil && !rx.Allow(&hc.Frame) {
+		return fmt.Errorf("heartbeat-frame %s: the backend RX filter must pass it", c.hbFrame)
+	}
+	if c.arbID != "" {
+		if id, err := arbiter.ParseID(c.arbID); err == nil && id == hc.Frame.CANID&^can.CAN_RTR_FLAG {
+			return fmt.Errorf("heartbeat-frame %s: the ID is the arbitration-id", c.hbFrame)
+		}
+	}
+	return nil
+}
+
+// startHeartbeat sends the -heartbeat-frame beats: bus beats go through the
+// instance transmit path (so TX inhibit, blocks and arbitration apply),
+// client beats through the hub like bus frames.
+func (in *instance) startHeartbeat(ctx context.Context, l *slog.Logger, wg *sync.WaitGroup) {
+	hc, ok, _ := in.cfg.heartbeatConfig() // validated at startup
+	if !ok {
+		return
+	}
+	hc.Bus = in.tx.send
+	hc.Clients = in.hub.Broadcast
+	hc.Logger = l
+	l.Info("heartbeat_enabled", "frame", hc.Frame.String(), "interval", hc.Interval,
+		"target", hc.Target.String(), "counter", hc.Counter)
+	s := heartbeat.New(hc)
+	wg.Add(1)
+	go func() { defer wg.Done(); s.Run(ctx) }()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/store"
+)
+
+// historyPrefix is the admin API path of the stored history.
+const historyPrefix = "/api/history"
+
+// validateStore checks -store names a registered backend without opening
+// it, so -check-config does not create database files.
+func (c *appConfig) validateStore() error {
+	if c.store == "" {
+		return nil
+	}
+	name, arg, _ := strings.Cut(c.store, ":")
+	if !slices.Contains(store.Available(), name) {
+		return fmt.Errorf("store: unknown backend %q (have %s)", name, strings.Join(store.Available(), ", "))
+	}
+	if arg == "" {
+		return fmt.Errorf("store: want %s:<path>", name)
+	}
+	if c.storeRetention < 0 || c.storeMaxFrames < 0 || c.storePresence < 0 {
+		return fmt.Errorf("store-retention, store-max-frames and store-presence-timeout must be >= 0")
+	}
+	return nil
+}
+
+// startStore opens -store and records the frames of every instance into
+// it (nil when disabled). The store is closed once the recorder has
+// written its last batch on shutdown.
+func startStore(ctx context.Context, cfg *appConfig, insts []*instance, l *slog.Logger, wg *sync.WaitGroup) (store.Store, error) {
+	if cfg.store == "" {
+		return nil, nil
+	}
+	st, err := store.Open(cfg.store)
+	if err != nil {
+		return nil, err
+	}
+	rec := store.NewRecorder(st, store.RecorderConfig{
+		Retention:       cfg.storeRetention,
+		MaxFrames:       cfg.storeMaxFrames,
+		PresenceTimeout: cfg.storePresence,
+		Logger:          l,
+	})
+	for _, in := range insts {
+		name := in.name
+		watchHub(ctx, in.hub, wg, func(fr *can.Frame) { rec.Add(name, *fr) })
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rec.Run(ctx)
+		if err := st.Close(); err != nil {
+			l.Warn("store_close_error", "error", err)
+		}
+	}()
+	l.Info("store_enabled", "store", cfg.store, "retention", cfg.storeRetention, "max_frames", cfg.storeMaxFrames, "presence_timeout", cfg.storePresence)
+	return st, nil
+}
@@ -6,20 +6,15 @@ import (
 	"github.com/kstaniek/go-ampio-server/internal/hub"
 )
 
-func initHub(cfg *appConfig, l *slog.Logger) *hub.Hub {
-	h := hub.New()
-	h.OutBufSize = cfg.hubBuffer
-	switch cfg.hubPolicy {
-	case "drop":
-		h.Policy = hub.PolicyDrop
-	case "kick":
-		h.Policy = hub.PolicyKick
-	default:
-		l.Warn("unknown_hub_policy", "policy", cfg.hubPolicy, "used", "drop")
-		h.Policy = hub.PolicyDrop
+func initHub(cfg *appConfig, l *slog.Logger) (*hub.Hub, error) {
+	policy, err := hub.ParsePolicy(cfg.hubPolicy)
+	if err != nil {
+		return nil, err
 	}
-	policyStr := map[hub.BackpressurePolicy]string{hub.PolicyDrop: "drop", hub.PolicyKick: "kick"}[h.Policy]
-	l.Info("build_info", "version", version, "commit", commit, "date", date)
-	l.Info("hub_config", "policy", policyStr, "buffer", h.OutBufSize)
-	return h
+	h, err := hub.NewWithOptions(hub.WithOutBufSize(cfg.hubBuffer), hub.WithPolicy(policy))
+	if err != nil {
+		return nil, err
+	}
+	l.Info("hub_config", "policy", h.Policy().String(), "buffer", h.OutBufSize(), "workers", cfg.hubWorkers)
+	return h, nil
 }
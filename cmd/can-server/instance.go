@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/ampio"
+	"github.com/kstaniek/go-ampio-server/internal/arbiter"
+	"github.com/kstaniek/go-ampio-server/internal/block"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/capture"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/cyclic"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/inhibit"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+// instance is one backend + hub + TCP listener pair. A process runs one
+// instance by default, or several when the config file has [instance.*]
+// sections.
+type instance struct {
+	name     string
+	cfg      *appConfig
+	hub      *hub.Hub
+	srv      *server.Server
+	cleanup  func()
+	tx       backendTx     // filtered, counted transmit path shared by clients and the admin API
+	capture  *capture.Ring // recent backend frames; nil when -capture-size is 0
+	inhibit  *inhibit.Inhibitor
+	arbiter  *arbiter.Arbiter // nil without -arbitration-id
+	blocks   *block.List      // administrative CAN ID blocks (/api/blocks)
+	devices  *ampio.Devices   // Ampio modules seen on the bus; nil without -ampio-devices
+	txFrames atomic.Uint64
+}
+
+// startInstance initializes the hub and backend for cfg, then starts the TCP
+// server (and mDNS when enabled). fail is invoked if the listener dies.
+func startInstance(ctx context.Context, cfg *appConfig, l *slog.Logger, wg *sync.WaitGroup, fail func()) (*instance, error) {
+	if cfg.name != "" {
+		l = l.With("instance", cfg.name)
+	}
+	in := &instance{name: cfg.name, cfg: cfg}
+	var err error
+	if in.hub, err = initHub(cfg, l); err != nil {
+		return nil, err
+	}
+	in.hub.StartWorkers(ctx, cfg.hubWorkers)
+	if cfg.captureSize > 0 {
+		in.capture = capture.NewRing(cfg.captureSize)
+		in.hub.Tap = in.capture.Add
+		in.startTrigger(ctx, l, wg)
+	}
+	in.arbiter = in.initArbitration(l)
+	norm, _ := cfg.normalization() // validated at startup
+	in.blocks = block.New(l, norm.EFF)
+	in.hub.Filter = in.blocks.AllowRX // the backend RX filter is chained in
+	if notes := cfg.logNotes(); notes != nil {
+		startFrameLog(ctx, in.hub, notes, l, wg)
+	}
+	btx, cleanup, err := initBackend(ctx, cfg, in.hub, l, wg)
+	if err != nil {
+		return nil, err
+	}
+	sched, _ := inhibit.ParseSchedule(cfg.txInhibit) // validated at startup
+	in.inhibit = inhibit.New(sched, l)
+	if !sched.Empty() {
+		l.Info("tx_inhibit_schedule", "windows", sched.String())
+		wg.Add(1)
+		go func() { defer wg.Done(); in.inhibit.Run(ctx) }()
+	}
+	in.runArbitration(ctx, btx.send, wg)
+	in.cleanup = func() {
+		cleanup()
+		in.inhibit.Close()
+		in.blocks.Close()
+		if in.arbiter != nil {
+			in.arbiter.Close()
+		}
+	}
+	in.tx = btx.guard(func(fr *can.Frame) (bool, error) {
+		if err := in.inhibit.Check(); err != nil {
+			return false, err
+		}
+		if err := in.blocks.CheckTX(fr); err != nil {
+			return false, err
+		}
+		if in.arbiter != nil {
+			if err := in.arbiter.Check(fr); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}, func(*can.Frame) { in.txFrames.Add(1) })
+	if entries, _ := cyclic.Parse(cfg.cyclicTx); len(entries) > 0 { // validated at startup
+		in.startCyclic(ctx, entries, l, wg)
+	}
+	in.startHeartbeat(ctx, l, wg)
+	opts := append(clientServerOptions(cfg, l),
+		server.WithHub(in.hub),
+		server.WithSend(in.tx.send),
+		server.WithSendWait(in.tx.sendWait),
+	)
+	if in.capture != nil {
+		opts = append(opts, server.WithHistory(in.history))
+	}
+	if in.tx.queue != nil {
+		opts = append(opts, server.WithTxQueue(in.tx.queue))
+	}
+	if ln := cfg.inherited.Take(in.name, cfg.listenAddr, in.name == ""); ln != nil {
+		l.Info("systemd_listener", "addr", ln.Addr().String())
+		opts = append(opts, server.WithListener(ln))
+	}
+	in.srv = server.NewServer(opts...)
+	in.srv.SetListenAddr(cfg.listenAddr)
+	if in.name != "" {
+		if err := metrics.RegisterInstance(in.name, in.sample); err != nil {
+			in.cleanup()
+			return nil, err
+		}
+	}
+	go func() {
+		if err := in.srv.Serve(ctx); err != nil {
+			l.Error("tcp_server_error", "error", err)
+			fail()
+		}
+	}()
+	go in.advertise(ctx, l)
+	return in, nil
+}
+
+// startCyclic sends the cyclic TX entries through the instance transmit
+// path (so TX inhibit, blocks and arbitration apply) and exports their timing.
+func (in *instance) startCyclic(ctx context.Context, entries []cyclic.Entry, l *slog.Logger, wg *sync.WaitGroup) {
+	sched := cyclic.New(entries, in.tx.send)
+	metrics.RegisterCyclic(in.name, func() []metrics.CyclicSample {
+		st := sched.Stats()
+		out := make([]metrics.CyclicSample, len(st))
+		for i, s := range st {
+			out[i] = metrics.CyclicSample{Entry: s.Entry, Sent: s.Sent, Errors: s.Errors, Missed: s.Missed,
+				Jitter: s.Jitter, JitterMax: s.JitterMax, JitterMean: s.JitterMean}
+		}
+		return out
+	})
+	for _, e := range entries {
+		l.Info("cyclic_tx", "entry", e.Name(), "frame", e.Frame.String())
+	}
+	wg.Add(1)
+	go func() { defer wg.Done(); sched.Run(ctx) }()
+}
+
+// clientServerOptions returns the client-facing TCP server settings of cfg
+// shared by instances and virtual buses.
+func clientServerOptions(cfg *appConfig, l *slog.Logger) []server.ServerOption {
+	nets, _ := cfg.clientAccess() // validated with the config
+	opts := []server.ServerOption{
+		server.WithAccess(nets.Identify),
+		server.WithCodec(&cnl.Codec{MaskFD: cfg.fdBit == "mask"}),
+		server.WithLogger(l),
+		server.WithMaxClients(cfg.maxClients),
+		server.WithConnRate(cfg.connRate, cfg.connBan),
+		server.WithHandshakeTimeout(cfg.handshakeTO),
+		server.WithReadDeadline(cfg.clientReadTO),
+		server.WithFlushInterval(cfg.flushInterval),
+		server.WithBatchSize(cfg.batchSize),
+		server.WithReadBufferSize(cfg.readBuffer),
+		server.WithSessions(cfg.sessionGrace, cfg.sessionReplay),
+		server.WithIdent(cfg.identity()),
+		server.WithLimits(server.Limits{
+			MaxDecodeBytes:    cfg.maxDecodeBytes,
+			MaxBurstFrames:    cfg.maxBurstFrames,
+			BurstYield:        cfg.burstYield,
+			MaxHandshakeBytes: cfg.maxHandshake,
+		}),
+	}
+	if tc, _ := cfg.serverTLS(); tc != nil { // validated with the config
+		opts = append(opts, server.WithTLS(tc))
+	}
+	if cfg.portSniff {
+		opts = append(opts, server.WithProtocolHandlers(protocolHandlers()))
+	}
+	if cfg.compression {
+		opts = append(opts, server.WithCompression(1-float64(cfg.compressSaving)/100))
+	}
+	if cfg.errMask() != 0 {
+		opts = append(opts, server.WithErrorFrames(true))
+	}
+	if cfg.packetFraming {
+		opts = append(opts, server.WithPacketFraming(true))
+	}
+	if cfg.carriesFD() {
+		opts = append(opts, server.WithFD(true))
+	}
+	return opts
+}
+
+// history returns the captured backend frames of the last d.
+func (in *instance) history(d time.Duration) []can.Frame {
+	recs := in.capture.Last(d)
+	out := make([]can.Frame, len(recs))
+	for i, rec := range recs {
+		out[i] = rec.Frame
+	}
+	return out
+}
+
+// captureIface names the instance bus in capture downloads; several
+// SocketCAN interfaces are joined with "+".
+func (in *instance) captureIface() string {
+	if kind, _ := splitBackend(in.cfg.backend); kind == "socketcan" {
+		return strings.Join(in.cfg.canIfaces(), "+")
+	}
+	if in.name != "" {
+		return in.name
+	}
+	return "can0"
+}
+
+// captureIfaces names the frames of each interface in capture files; nil
+// unless the backend has several.
+func (in *instance) captureIfaces() []string {
+	if kind, _ := splitBackend(in.cfg.backend); kind == "socketcan" && len(in.cfg.canIfaces()) > 1 {
+		return in.cfg.canIfaces()
+	}
+	return nil
+}
+
+// sample reports per-instance counters for the shared metrics endpoint.
+func (in *instance) sample() metrics.InstanceSample {
+	hs := in.hub.Stats()
+	ss := in.srv.Stats()
+	return metrics.InstanceSample{
+		RxFrames:        hs.Frames,
+		TxFrames:        in.txFrames.Load(),
+		HubDrops:        hs.Drops,
+		HubKicks:        hs.Kicks,
+		Clients:         hs.Clients,
+		Accepted:        ss.Accepted,
+		BackendOverflow: ss.BackendOverflow,
+		BackendErrors:   ss.BackendErrors,
+	}
+}
+
+// ready reports whether the instance listener is bound.
+func (in *instance) ready() bool {
+	select {
+	case <-in.srv.Ready():
+		return true
+	default:
+		return false
+	}
+}
+
+// advertise starts mDNS advertisement once the listener is ready.
+func (in *instance) advertise(ctx context.Context, l *slog.Logger) {
+	if !in.cfg.mdnsEnable {
+		return
+	}
+	select {
+	case <-in.srv.Ready():
+	case <-ctx.Done():
+		return
+	}
+	// Extract port from bound address (host:port or :port)
+	addr := in.srv.Addr()
+	var portNum int
+	if _, p, err := net.SplitHostPort(addr); err == nil {
+		if pn, perr := strconv.Atoi(p); perr == nil {
+			portNum = pn
+		}
+	}
+	if portNum == 0 { // fallback attempt if format unexpected
+		lastColon := strings.LastIndex(addr, ":")
+		if lastColon >= 0 {
+			if pn, perr := strconv.Atoi(addr[lastColon+1:]); perr == nil {
+				portNum = pn
+			}
+		}
+	}
+	cleanupMDNS, err := startMDNS(ctx, in.cfg, portNum)
+	if err != nil {
+		l.Warn("mdns_start_failed", "error", err)
+		return
+	}
+	l.Info("mdns_started", "service", mdnsServiceType, "name", in.cfg.mdnsName, "port", portNum)
+	go func() { <-ctx.Done(); cleanupMDNS() }()
+}
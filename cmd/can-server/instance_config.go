@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+// bindInstanceFlags registers the per-instance settings of c on fs. Only
+// these keys may appear inside an [instance.<name>] config section; logging,
+// metrics and admin settings stay process-wide.
+func bindInstanceFlags(fs *flag.FlagSet, c *appConfig) {
+	fs.StringVar(&c.backend, "backend", c.backend, "")
+	fs.StringVar(&c.serialDev, "serial", c.serialDev, "")
+	fs.IntVar(&c.baud, "baud", c.baud, "")
+	fs.DurationVar(&c.serialReadTO, "serial-read-timeout", c.serialReadTO, "")
+	fs.BoolVar(&c.serialNoChecksum, "serial-no-checksum", c.serialNoChecksum, "")
+	fs.IntVar(&c.slcanBitrate, "slcan-bitrate", c.slcanBitrate, "")
+	fs.StringVar(&c.canIf, "can-if", c.canIf, "")
+	fs.BoolVar(&c.canLoopback, "can-loopback", c.canLoopback, "")
+	fs.BoolVar(&c.canRecvOwn, "can-recv-own", c.canRecvOwn, "")
+	fs.DurationVar(&c.canBusyPoll, "can-busy-poll", c.canBusyPoll, "")
+	fs.DurationVar(&c.canSpin, "can-spin", c.canSpin, "")
+	fs.DurationVar(&c.canTxWait, "can-tx-wait", c.canTxWait, "")
+	fs.IntVar(&c.canTxQueueLen, "can-txqueuelen", c.canTxQueueLen, "")
+	fs.DurationVar(&c.canTxDropPoll, "can-tx-drop-poll", c.canTxDropPoll, "")
+	fs.StringVar(&c.canErrFilter, "can-err-filter", c.canErrFilter, "")
+	fs.StringVar(&c.canTxRoute, "can-tx-route", c.canTxRoute, "")
+	fs.StringVar(&c.normalizeEFF, "normalize-eff", c.normalizeEFF, "")
+	fs.StringVar(&c.normalizeFlags, "normalize-flags", c.normalizeFlags, "")
+	fs.BoolVar(&c.normalizeStripErr, "normalize-strip-err", c.normalizeStripErr, "")
+	fs.StringVar(&c.udpLocal, "udp-local", c.udpLocal, "")
+	fs.IntVar(&c.upstreamTxBuffer, "upstream-tx-buffer", c.upstreamTxBuffer, "")
+	fs.DurationVar(&c.upstreamPing, "upstream-ping", c.upstreamPing, "")
+	fs.BoolVar(&c.upstreamCompression, "upstream-compression", c.upstreamCompression, "")
+	fs.BoolVar(&c.upstreamPacketFraming, "upstream-packet-framing", c.upstreamPacketFraming, "")
+	fs.StringVar(&c.replayFile, "replay-file", c.replayFile, "")
+	fs.Float64Var(&c.replaySpeed, "replay-speed", c.replaySpeed, "")
+	fs.BoolVar(&c.replayLoop, "replay-loop", c.replayLoop, "")
+	fs.StringVar(&c.replayTxFile, "replay-tx-file", c.replayTxFile, "")
+	fs.StringVar(&c.rxAllow, "rx-allow", c.rxAllow, "")
+	fs.StringVar(&c.rxDeny, "rx-deny", c.rxDeny, "")
+	fs.StringVar(&c.txAllow, "tx-allow", c.txAllow, "")
+	fs.StringVar(&c.txDeny, "tx-deny", c.txDeny, "")
+	fs.StringVar(&c.rxTransform, "rx-transform", c.rxTransform, "")
+	fs.StringVar(&c.txTransform, "tx-transform", c.txTransform, "")
+	fs.DurationVar(&c.txDedupWindow, "tx-dedup-window", c.txDedupWindow, "")
+	fs.StringVar(&c.txDedupIDs, "tx-dedup-ids", c.txDedupIDs, "")
+	fs.StringVar(&c.txPriorityIDs, "tx-priority-ids", c.txPriorityIDs, "")
+	fs.StringVar(&c.txInhibit, "tx-inhibit", c.txInhibit, "")
+	fs.StringVar(&c.arbID, "arbitration-id", c.arbID, "")
+	fs.IntVar(&c.arbPriority, "arbitration-priority", c.arbPriority, "")
+	fs.DurationVar(&c.arbInterval, "arbitration-interval", c.arbInterval, "")
+	fs.BoolVar(&c.txDryRun, "tx-dry-run", c.txDryRun, "")
+	fs.StringVar(&c.cyclicTx, "cyclic-tx", c.cyclicTx, "")
+	fs.StringVar(&c.hbFrame, "heartbeat-frame", c.hbFrame, "")
+	fs.DurationVar(&c.hbInterval, "heartbeat-interval", c.hbInterval, "")
+	fs.StringVar(&c.hbTarget, "heartbeat-target", c.hbTarget, "")
+	fs.BoolVar(&c.hbCounter, "heartbeat-counter", c.hbCounter, "")
+	fs.DurationVar(&c.waitDevice, "wait-device", c.waitDevice, "")
+	fs.DurationVar(&c.rxWatchdog, "rx-watchdog", c.rxWatchdog, "")
+	fs.BoolVar(&c.rxWatchdogRestart, "rx-watchdog-restart", c.rxWatchdogRestart, "")
+	fs.IntVar(&c.rxPipeline, "rx-pipeline", c.rxPipeline, "")
+	fs.StringVar(&c.emulate, "emulate", c.emulate, "")
+	fs.StringVar(&c.listenAddr, "listen", c.listenAddr, "")
+	fs.BoolVar(&c.portSniff, "port-sniff", c.portSniff, "")
+	fs.BoolVar(&c.packetFraming, "packet-framing", c.packetFraming, "")
+	fs.StringVar(&c.fdBit, "fd-bit", c.fdBit, "")
+	fs.BoolVar(&c.compression, "compression", c.compression, "")
+	fs.IntVar(&c.compressSaving, "compression-min-saving", c.compressSaving, "")
+	fs.IntVar(&c.hubBuffer, "hub-buffer", c.hubBuffer, "")
+	fs.StringVar(&c.hubPolicy, "hub-policy", c.hubPolicy, "")
+	fs.IntVar(&c.hubWorkers, "hub-workers", c.hubWorkers, "")
+	fs.IntVar(&c.maxClients, "max-clients", c.maxClients, "")
+	fs.StringVar(&c.clientRole, "client-role", c.clientRole, "")
+	fs.StringVar(&c.clientRoles, "client-roles", c.clientRoles, "")
+	fs.StringVar(&c.tlsCert, "tls-cert", c.tlsCert, "")
+	fs.StringVar(&c.tlsKey, "tls-key", c.tlsKey, "")
+	fs.StringVar(&c.tlsClientCA, "tls-client-ca", c.tlsClientCA, "")
+	fs.IntVar(&c.connRate, "conn-rate", c.connRate, "")
+	fs.DurationVar(&c.connBan, "conn-ban", c.connBan, "")
+	fs.DurationVar(&c.handshakeTO, "handshake-timeout", c.handshakeTO, "")
+	fs.DurationVar(&c.clientReadTO, "client-read-timeout", c.clientReadTO, "")
+	fs.DurationVar(&c.flushInterval, "flush-interval", c.flushInterval, "")
+	fs.IntVar(&c.batchSize, "batch-size", c.batchSize, "")
+	fs.IntVar(&c.readBuffer, "read-buffer", c.readBuffer, "")
+	fs.IntVar(&c.maxDecodeBytes, "max-decode-bytes", c.maxDecodeBytes, "")
+	fs.IntVar(&c.maxBurstFrames, "max-burst-frames", c.maxBurstFrames, "")
+	fs.DurationVar(&c.burstYield, "burst-yield", c.burstYield, "")
+	fs.IntVar(&c.maxHandshake, "max-handshake-bytes", c.maxHandshake, "")
+	fs.IntVar(&c.captureSize, "capture-size", c.captureSize, "")
+	fs.StringVar(&c.captureTrigger, "capture-trigger", c.captureTrigger, "")
+	fs.DurationVar(&c.captureTrigPre, "capture-trigger-pre", c.captureTrigPre, "")
+	fs.DurationVar(&c.captureTrigPost, "capture-trigger-post", c.captureTrigPost, "")
+	fs.DurationVar(&c.sessionGrace, "session-grace", c.sessionGrace, "")
+	fs.IntVar(&c.sessionReplay, "session-replay", c.sessionReplay, "")
+	fs.BoolVar(&c.mdnsEnable, "mdns-enable", c.mdnsEnable, "")
+	fs.StringVar(&c.mdnsName, "mdns-name", c.mdnsName, "")
+}
+
+// instanceConfigs expands c into one config per gateway instance. Without
+// [instance.*] sections the result is c itself (single, unnamed instance).
+// Each section starts from the resolved process-wide values and overrides
+// only the keys it lists.
+func (c *appConfig) instanceConfigs() ([]*appConfig, error) {
+	if len(c.instances) == 0 {
+		return []*appConfig{c}, nil
+	}
+	out := make([]*appConfig, 0, len(c.instances))
+	listens := make(map[string]string)
+	for _, sec := range c.instances {
+		ic := *c
+		ic.instances = nil
+		ic.vbuses = nil
+		ic.name = sec.name
+		if ic.mdnsName != "" {
+			ic.mdnsName = c.mdnsName + "-" + sec.name
+		}
+		fs := flag.NewFlagSet(sec.name, flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		bindInstanceFlags(fs, &ic)
+		keys := make([]string, 0, len(sec.values))
+		for k := range sec.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if fs.Lookup(k) == nil {
+				return nil, fmt.Errorf("instance %s: key %q is not per-instance", sec.name, k)
+			}
+			if err := fs.Set(k, sec.values[k]); err != nil {
+				return nil, fmt.Errorf("instance %s: %s: %w", sec.name, k, err)
+			}
+		}
+		if err := ic.validate(); err != nil {
+			return nil, fmt.Errorf("instance %s: %w", sec.name, err)
+		}
+		key := normalizeListen(ic.listenAddr)
+		if prev, dup := listens[key]; dup {
+			return nil, fmt.Errorf("instance %s: listen %s already used by instance %s", sec.name, ic.listenAddr, prev)
+		}
+		listens[key] = sec.name
+		out = append(out, &ic)
+	}
+	return out, nil
+}
+
+// normalizeListen maps equivalent wildcard listen forms to one key for duplicate detection.
+func normalizeListen(a string) string {
+	host, port, err := net.SplitHostPort(a)
+	if err != nil {
+		return a
+	}
+	switch strings.Trim(host, "[]") {
+	case "", "0.0.0.0", "::":
+		host = ""
+	}
+	return net.JoinHostPort(host, port)
+}
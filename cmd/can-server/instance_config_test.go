@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func baseInstanceConfig() appConfig {
+	return appConfig{
+		logFormat: "text", logLevel: "info", backend: "loopback", listenAddr: ":20000",
+		hubBuffer: 512, hubPolicy: "drop", baud: 115200, serialReadTO: 50 * time.Millisecond,
+		handshakeTO: time.Second, clientReadTO: time.Minute,
+	}
+}
+
+func TestInstanceConfigs(t *testing.T) {
+	fs := flag.NewFlagSet("t", flag.ContinueOnError)
+	fs.String("listen", ":20000", "")
+	fs.String("backend", "serial", "")
+	body := "backend = loopback\n\n[instance.a]\nlisten = :21000\n\n[instance.b]\nlisten = :21001\nhub-policy = kick\n"
+	fc, err := applyConfigFile(fs, writeConf(t, body), nil)
+	if err != nil {
+		t.Fatalf("applyConfigFile: %v", err)
+	}
+	base := baseInstanceConfig()
+	base.mdnsName = "gw"
+	base.instances = fc.instances
+	out, err := base.instanceConfigs()
+	if err != nil {
+		t.Fatalf("instanceConfigs: %v", err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected 2 instances, got %d", len(out))
+	}
+	a, b := out[0], out[1]
+	if a.name != "a" || a.listenAddr != ":21000" || a.hubPolicy != "drop" || a.mdnsName != "gw-a" {
+		t.Fatalf("instance a: %+v", a)
+	}
+	if b.name != "b" || b.listenAddr != ":21001" || b.hubPolicy != "kick" || b.backend != "loopback" {
+		t.Fatalf("instance b: %+v", b)
+	}
+}
+
+func TestInstanceConfigs_Single(t *testing.T) {
+	base := &appConfig{backend: "loopback"}
+	out, err := base.instanceConfigs()
+	if err != nil || len(out) != 1 || out[0] != base {
+		t.Fatalf("expected base config back, got %v, %v", out, err)
+	}
+}
+
+func TestInstanceConfigs_Errors(t *testing.T) {
+	base := baseInstanceConfig()
+	for name, tc := range map[string]struct {
+		secs []instanceSection
+		want string
+	}{
+		"globalKey": {
+			secs: []instanceSection{{name: "a", values: map[string]string{"metrics-addr": ":9000"}}},
+			want: "not per-instance",
+		},
+		"duplicateListen": {
+			secs: []instanceSection{
+				{name: "a", values: map[string]string{"listen": ":21000"}},
+				{name: "b", values: map[string]string{"listen": "0.0.0.0:21000"}},
+			},
+			want: "already used",
+		},
+		"badValue": {
+			secs: []instanceSection{{name: "a", values: map[string]string{"baud": "fast"}}},
+			want: "baud",
+		},
+	} {
+		c := base
+		c.instances = tc.secs
+		if _, err := c.instanceConfigs(); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%s: expected error containing %q, got %v", name, tc.want, err)
+		}
+	}
+}
+
+func TestParseConfigFile_BadSection(t *testing.T) {
+	for _, body := range []string{"[server]\n", "[instance.]\n", "[instance.a b]\n", "[instance.a]\n[instance.a]\n"} {
+		if _, err := parseConfigFile(writeConf(t, body)); err == nil {
+			t.Fatalf("expected error for %q", body)
+		}
+	}
+}
+
+func TestBridgeSpecs(t *testing.T) {
+	insts := []*appConfig{{name: "a"}, {name: "b"}}
+	c := &appConfig{bridge: "a<>b"}
+	specs, err := c.bridgeSpecs(insts)
+	if err != nil || len(specs) != 2 {
+		t.Fatalf("bridgeSpecs = %v, %v", specs, err)
+	}
+	c.bridge = "a>c"
+	if _, err := c.bridgeSpecs(insts); err == nil || !strings.Contains(err.Error(), `unknown instance "c"`) {
+		t.Fatalf("expected unknown instance error, got %v", err)
+	}
+	c.bridge = "a>b"
+	if _, err := c.bridgeSpecs([]*appConfig{{}}); err == nil {
+		t.Fatal("expected error bridging without named instances")
+	}
+}
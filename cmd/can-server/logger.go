@@ -4,22 +4,22 @@ import (
 	"log/slog"
 	"os"
 
+	"github.com/kstaniek/go-ampio-server/internal/events"
 	"github.com/kstaniek/go-ampio-server/internal/logging"
 )
 
-func setupLogger(format, level string) *slog.Logger {
-	var lvl slog.Level
-	switch level {
-	case "debug":
-		lvl = slog.LevelDebug
-	case "warn":
-		lvl = slog.LevelWarn
-	case "error":
-		lvl = slog.LevelError
-	default:
+// setupLogger builds the process logger. When ring is non-nil, warn and error
+// records are additionally retained there for /api/events and diagnostics.
+func setupLogger(format, level string, ring *events.Ring) *slog.Logger {
+	lvl, err := logging.ParseLevel(level)
+	if err != nil {
 		lvl = slog.LevelInfo
 	}
-	l := logging.New(format, lvl, os.Stderr).With("app", "can-server")
+	l := logging.NewDynamic(format, lvl, os.Stderr)
+	if ring != nil {
+		l = slog.New(events.NewHandler(l.Handler(), ring, slog.LevelWarn))
+	}
+	l = l.With("app", "can-server")
 	logging.Set(l)
 	return l
 }
@@ -2,18 +2,30 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
-	"net"
 	"os"
 	"os/signal"
-	"strconv"
-	"strings"
 	"sync"
 	"syscall"
+	"time"
 
-	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/access"
+	"github.com/kstaniek/go-ampio-server/internal/activation"
+	"github.com/kstaniek/go-ampio-server/internal/ampio"
+	"github.com/kstaniek/go-ampio-server/internal/block"
+	"github.com/kstaniek/go-ampio-server/internal/capture"
+	"github.com/kstaniek/go-ampio-server/internal/clock"
+	"github.com/kstaniek/go-ampio-server/internal/events"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/inhibit"
+	"github.com/kstaniek/go-ampio-server/internal/logging"
+	"github.com/kstaniek/go-ampio-server/internal/memguard"
 	"github.com/kstaniek/go-ampio-server/internal/metrics"
-	"github.com/kstaniek/go-ampio-server/internal/server"
+	"github.com/kstaniek/go-ampio-server/internal/query"
+	"github.com/kstaniek/go-ampio-server/internal/store"
+	"github.com/kstaniek/go-ampio-server/internal/stream"
+	"github.com/kstaniek/go-ampio-server/internal/validate"
 )
 
 // Helper implementations moved to dedicated files: version.go, config.go, logger.go, hub_init.go, metrics_logger.go, backend.go.
@@ -24,90 +36,307 @@ func main() {
 		fmt.Printf("can-server %s (commit %s, built %s)\n", version, commit, date)
 		return
 	}
-	l := setupLogger(cfg.logFormat, cfg.logLevel)
-	h := initHub(cfg, l)
+	if cfg == nil { // parseFlags already reported the problem
+		os.Exit(2)
+	}
+	if cfg.printDefaults {
+		if err := writeDefaultConfig(os.Stdout, flag.CommandLine); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	if cfg.checkConfig {
+		os.Exit(runCheckConfig(os.Stdout, cfg))
+	}
+	if cfg.doctor {
+		os.Exit(runDoctor(os.Stdout, cfg))
+	}
+	if cfg.selfTest {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		code := runSelfTest(ctx, os.Stdout, cfg, setupLogger(cfg.logFormat, "warn", nil))
+		stop()
+		os.Exit(code)
+	}
+	if cfg.compare {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		code := runCompare(ctx, os.Stdout, cfg, setupLogger(cfg.logFormat, "warn", nil))
+		stop()
+		os.Exit(code)
+	}
+	if cfg.diff != "" {
+		os.Exit(runDiff(os.Stdout, cfg))
+	}
+	if cfg.assertGolden != "" {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		code := runAssert(ctx, os.Stdout, cfg, setupLogger(cfg.logFormat, "warn", nil))
+		stop()
+		os.Exit(code)
+	}
+	var evRing *events.Ring // nil with -event-history 0
+	if cfg.eventRingSize > 0 {
+		evRing = events.NewRing(cfg.eventRingSize)
+	}
+	l := setupLogger(cfg.logFormat, cfg.logLevel, evRing)
+	authToken, terr := loadAuthToken(cfg)
+	if terr != nil {
+		l.Error("auth_token_error", "error", terr)
+		return
+	}
+	acl, aerr := loadAccess(cfg, authToken)
+	if aerr != nil {
+		l.Error("access_file_error", "error", aerr)
+		return
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	var wg sync.WaitGroup
 	startMetricsLogger(ctx, cfg.logMetricsEvery, l, &wg)
+	memguard.SetLimit(int64(cfg.memoryLimitMB) << 20)
+	vmode, _ := validate.ParseMode(cfg.frameValidation) // validated with the config; "" is strict
+	validate.SetMode(vmode)
+	cpol, _ := clock.ParsePolicy(cfg.clockPolicy) // validated with the config
+	clk := clock.New(cpol, cfg.clockThreshold)
+	clock.SetDefault(clk)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		clk.Watch(ctx, time.Second)
+	}()
+	l.Info("build_info", "version", version, "commit", commit, "date", date)
 
-	sendFunc, cleanup, berr := initBackend(ctx, cfg, h, l, &wg)
-	if berr != nil {
-		l.Error("backend_init_error", "error", berr)
+	notes, aerr := cfg.annotations()
+	if aerr != nil {
+		l.Error("annotate_init_error", "error", aerr)
 		return
 	}
-
-	srv := server.NewServer(
-		server.WithHub(h),
-		server.WithCodec(&cnl.Codec{}),
-		server.WithSend(sendFunc),
-		server.WithLogger(l),
-		server.WithMaxClients(cfg.maxClients),
-		server.WithHandshakeTimeout(cfg.handshakeTO),
-		server.WithReadDeadline(cfg.clientReadTO),
-	)
-	srv.SetListenAddr(cfg.listenAddr)
-	go func() {
-		if err := srv.Serve(ctx); err != nil {
-			l.Error("tcp_server_error", "error", err)
+	cfg.notes = notes
+	if notes != nil {
+		l.Info("annotate_decoders", "decoders", notes.Names(), "versions", notes.Versions(), "log", cfg.annotateLog)
+	}
+	instCfgs, ierr := cfg.instanceConfigs()
+	if ierr != nil {
+		l.Error("instance_config_error", "error", ierr)
+		return
+	}
+	lns, lerr := activation.Listeners()
+	if lerr != nil {
+		l.Error("systemd_listeners_error", "error", lerr)
+		return
+	}
+	cfg.inherited = activation.NewSet(lns)
+	for _, ic := range instCfgs {
+		ic.inherited = cfg.inherited
+	}
+	var insts []*instance
+	cleanupAll := func() {
+		for _, in := range insts {
+			in.cleanup()
+		}
+	}
+	for _, ic := range instCfgs {
+		in, err := startInstance(ctx, ic, l, &wg, cancel)
+		if err != nil {
+			l.Error("backend_init_error", "instance", ic.name, "error", err)
 			cancel()
+			cleanupAll()
+			return
 		}
-	}()
+		insts = append(insts, in)
+	}
+	for _, ln := range cfg.inherited.Rest() {
+		l.Warn("systemd_listener_unused", "name", ln.Name, "addr", ln.Addr().String())
+		_ = ln.Close()
+	}
+	vbs, err := startVBuses(ctx, cfg, insts, l, &wg, cancel)
+	if err != nil {
+		l.Error("vbus_init_error", "error", err)
+		cancel()
+		cleanupAll()
+		return
+	}
+	br, err := startBridge(ctx, cfg, insts, l, &wg)
+	if err != nil {
+		l.Error("bridge_init_error", "error", err)
+		cancel()
+		cleanupAll()
+		return
+	}
+	if err := startPairing(ctx, cfg, insts, l, &wg); err != nil {
+		l.Error("pair_init_error", "error", err)
+		cancel()
+		cleanupAll()
+		return
+	}
+	if err := startAlerts(ctx, cfg, insts, l, &wg); err != nil {
+		l.Error("alerts_init_error", "error", err)
+		cancel()
+		cleanupAll()
+		return
+	}
+	if err := startAmpioLog(ctx, cfg, insts, l, &wg); err != nil {
+		l.Error("ampio_init_error", "error", err)
+		cancel()
+		cleanupAll()
+		return
+	}
+	if err := startAmpioDevices(ctx, cfg, insts, l, &wg); err != nil {
+		l.Error("ampio_init_error", "error", err)
+		cancel()
+		cleanupAll()
+		return
+	}
+	if err := startMQTT(ctx, cfg, insts, l, &wg); err != nil {
+		l.Error("mqtt_init_error", "error", err)
+		cancel()
+		cleanupAll()
+		return
+	}
+	hist, err := startStore(ctx, cfg, insts, l, &wg)
+	if err != nil {
+		l.Error("store_init_error", "error", err)
+		cancel()
+		cleanupAll()
+		return
+	}
+	startSessionSync(ctx, cfg, insts, l, &wg)
+	startCounterAudit(ctx, cfg, insts, vbs, l, &wg)
+	hubs := make([]*hub.Hub, 0, len(insts)+len(vbs))
+	for _, in := range insts {
+		hubs = append(hubs, in.hub)
+	}
+	for _, vb := range vbs {
+		hubs = append(hubs, vb.Hub())
+	}
+	wg.Add(1)
+	go func() { defer wg.Done(); hub.RunSampler(ctx, cfg.hubSampleEvery, hubs...) }()
+	startSignalHandlers(ctx, cfg, l, signalHooks{
+		dump: func() { dumpDiagnostics(cfg.dumpDir, evRing, l, insts...) },
+		reload: func() {
+			if err := acl.Reload(); err != nil {
+				l.Error("secret_reload_failed", "error", err)
+				return
+			}
+			l.Info("secrets_reloaded", "token_file", authToken.Path(), "access_file", cfg.accessFile)
+		},
+	})
 
-	// Start mDNS advertisement once listener is ready.
-	go func() {
-		if !cfg.mdnsEnable {
-			return
+	mc := &metricsControl{ctx: ctx, def: cfg.metricsAddr, bind: metrics.BindOptions{Policy: cfg.metricsBind, Fallback: cfg.metricsFallback}}
+	// Ready when every instance and virtual bus listener is bound and
+	// context not cancelled.
+	metrics.SetReadinessFunc(func() bool {
+		for _, in := range insts {
+			if !in.ready() {
+				return false
+			}
 		}
-		select {
-		case <-srv.Ready():
-		case <-ctx.Done():
-			return
+		for _, vb := range vbs {
+			if !vb.ready() {
+				return false
+			}
+		}
+		// A metrics server that is still retrying its bind is not ready.
+		return ctx.Err() == nil && mc.ready()
+	})
+	// The control socket can open the metrics server later, so the admin
+	// endpoints are registered whenever either is configured.
+	if cfg.metricsAddr != "" || cfg.controlSocket != "" {
+		nets, _ := metrics.ParseNets(cfg.httpAllow) // validated with the config
+		metrics.SetAllowedNets(nets)
+		labels, _ := metrics.ParseLabels(cfg.metricsLabels) // validated with the config
+		if err := metrics.Register(metrics.WithNamespace(cfg.metricsNS), metrics.WithConstLabels(labels)); err != nil {
+			l.Warn("metrics_register_error", "error", err)
+		}
+		metrics.InitBuildInfo(version, commit, date)
+		registerAdminRW(acl, access.View, access.Manage, "/api/loglevel", logging.LevelHandler())
+		if evRing != nil {
+			registerAdmin(acl, access.View, "/api/events", evRing.Handler())
+		}
+		queries := make(map[string]*query.Requester, len(insts))
+		for _, in := range insts {
+			queries[in.name] = query.New(in.hub, in.tx.wait)
 		}
-		// Extract port from bound address (host:port or :port)
-		addr := srv.Addr()
-		var portNum int
-		if _, p, err := net.SplitHostPort(addr); err == nil {
-			if pn, perr := strconv.Atoi(p); perr == nil {
-				portNum = pn
+		registerAdmin(acl, access.Send, "/api/request", query.Handler(queries))
+		registerAdmin(acl, access.View, "/api/routes", routesHandler(insts, br))
+		registerAdmin(acl, access.View, "/api/vbus", vbusHandler(vbs))
+		tunable := make(map[string]tunableTarget, len(insts))
+		for _, in := range insts {
+			tunable[in.name] = tunableTarget{name: in.name, hub: in.hub, srv: in.srv}
+		}
+		registerAdminRW(acl, access.View, access.Manage, "/api/tunables", tunablesHandler(tunable))
+		registerAdmin(acl, access.Manage, sessionsPath, sessionsHandler(insts))
+		inhibitors := make(map[string]*inhibit.Inhibitor, len(insts))
+		for _, in := range insts {
+			inhibitors[in.name] = in.inhibit
+		}
+		registerAdminRW(acl, access.View, access.Filters, "/api/tx-inhibit", inhibit.Handler(inhibitors))
+		blocks := make(map[string]*block.List, len(insts))
+		for _, in := range insts {
+			blocks[in.name] = in.blocks
+		}
+		registerAdminRW(acl, access.View, access.Filters, "/api/blocks", block.Handler(blocks))
+		if cfg.ampioDevices {
+			devices := make(map[string]*ampio.Devices, len(insts))
+			for _, in := range insts {
+				devices[in.name] = in.devices
 			}
+			registerAdmin(acl, access.View, "/api/devices", ampio.Handler(devices))
 		}
-		if portNum == 0 { // fallback attempt if format unexpected
-			lastColon := strings.LastIndex(addr, ":")
-			if lastColon >= 0 {
-				if pn, perr := strconv.Atoi(addr[lastColon+1:]); perr == nil {
-					portNum = pn
-				}
+		captures := make(map[string]capture.Target, len(insts))
+		for _, in := range insts {
+			if in.capture != nil {
+				captures[in.name] = capture.Target{Ring: in.capture, Iface: in.captureIface(), Ifaces: in.captureIfaces()}
 			}
 		}
-		cleanupMDNS, err := startMDNS(ctx, cfg, portNum)
-		if err != nil {
-			l.Warn("mdns_start_failed", "error", err)
-			return
+		registerAdmin(acl, access.Capture, "/api/capture", capture.Handler(captures, notes))
+		registerAdmin(acl, access.Capture, "/api/diff", capture.DiffHandler(captures))
+		streams := make(map[string]*hub.Hub, len(insts))
+		for _, in := range insts {
+			streams[in.name] = in.hub
 		}
-		l.Info("mdns_started", "service", mdnsServiceType, "name", cfg.mdnsName, "port", portNum)
-		go func() { <-ctx.Done(); cleanupMDNS() }()
-	}()
-
-	// Ready when server listener is bound and context not cancelled.
-	metrics.SetReadinessFunc(func() bool {
-		select {
-		case <-srv.Ready():
-		default:
-			return false
+		registerAdmin(acl, access.View, "/api/stream", stream.Handler(streams, notes))
+		sockets := make(map[string]stream.Target, len(insts))
+		for _, in := range insts {
+			sockets[in.name] = stream.Target{Hub: in.hub, Send: in.tx.send}
 		}
-		return ctx.Err() == nil
-	})
+		origins, _ := stream.ParseOrigins(cfg.wsOrigins) // validated with the config
+		registerAdmin(acl, access.View, "/api/ws", stream.WebSocket(sockets, notes, origins))
+		if hist != nil {
+			h := store.Handler(hist, historyPrefix, cfg.storeRetention)
+			registerAdmin(acl, access.Capture, historyPrefix, h)
+			registerAdmin(acl, access.Capture, historyPrefix+"/", h)
+		}
+	}
 	if cfg.metricsAddr != "" {
-		metrics.InitBuildInfo(version, commit, date)
-		srvHTTP := metrics.StartHTTP(cfg.metricsAddr)
-		defer func() { _ = srvHTTP.Shutdown(context.Background()) }()
+		if err := mc.start(cfg.metricsAddr, cfg.metricsBind); err != nil {
+			l.Error("metrics_init_error", "error", err)
+			cancel()
+			cleanupAll()
+			return
+		}
+	}
+	defer func() { _ = mc.stop() }()
+	if cfg.controlSocket != "" {
+		if err := startControlSocket(ctx, cfg.controlSocket, mc, l, &wg); err != nil {
+			l.Error("control_socket_error", "error", err)
+			cancel()
+			cleanupAll()
+			return
+		}
 	}
+	soakDone := startSoak(ctx, cfg, insts, l)
 	sigCh := make(chan os.Signal, 2)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	s := <-sigCh
-	l.Info("shutdown_signal", "signal", s.String())
+	code := 0
+	select {
+	case s := <-sigCh:
+		l.Info("shutdown_signal", "signal", s.String())
+	case code = <-soakDone:
+	}
 	cancel()
-	cleanup()
+	cleanupAll()
 	wg.Wait()
+	if code != 0 {
+		_ = mc.stop() // os.Exit skips the deferred stop
+		os.Exit(code)
+	}
 }
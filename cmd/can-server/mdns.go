@@ -4,9 +4,13 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/grandcat/zeroconf"
+
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
 )
 
 // startMDNS registers the service via mDNS and returns a cleanup function.
@@ -21,11 +25,20 @@ func startMDNS(ctx context.Context, cfg *appConfig, port int) (func(), error) {
 	if instance == "" {
 		host, _ := os.Hostname()
 		instance = fmt.Sprintf("can-server-%s", host)
+		if cfg.name != "" {
+			instance += "-" + cfg.name
+		}
 	}
+	kind, _ := splitBackend(cfg.backend)
 	meta := []string{
-		"backend=" + cfg.backend,
+		"backend=" + kind,
 		"version=" + version,
 		"commit=" + commit,
+		"features=" + features(cfg),
+		"proto=" + strconv.Itoa(cnl.ProtocolRevision),
+	}
+	if cfg.name != "" {
+		meta = append(meta, "instance="+cfg.name)
 	}
 	// Hardcoded service type; domain local.
 	svc, err := zeroconf.Register(instance, mdnsServiceType, "local.", port, meta, nil)
@@ -42,3 +55,27 @@ func startMDNS(ctx context.Context, cfg *appConfig, port int) (func(), error) {
 	}()
 	return func() { close(done); svc.Shutdown(); time.Sleep(50 * time.Millisecond) }, nil
 }
+
+// features lists the optional client protocol extensions the instance supports.
+func features(cfg *appConfig) string {
+	f := []string{cnl.FeatureTxAck, cnl.FeaturePing, cnl.FeatureFilter, cnl.FeatureIdent, cnl.FeatureRTR}
+	if cfg.captureSize > 0 {
+		f = append(f, cnl.FeatureHistory)
+	}
+	if cfg.sessionGrace > 0 {
+		f = append(f, cnl.FeatureSession)
+	}
+	if cfg.compression {
+		f = append(f, cnl.FeatureCompress)
+	}
+	if cfg.errMask() != 0 {
+		f = append(f, cnl.FeatureErrors)
+	}
+	if cfg.txQueued() {
+		f = append(f, cnl.FeatureFlow)
+	}
+	if cfg.carriesFD() {
+		f = append(f, cnl.FeatureFD)
+	}
+	return strings.Join(f, ",")
+}
@@ -25,12 +25,17 @@ func startMetricsLogger(ctx context.Context, interval time.Duration, l *slog.Log
 				l.Info("metrics_snapshot",
 					"serial_rx", snap.SerialRx,
 					"socketcan_rx", snap.SocketCANRx,
+					"socketcan_rx_own", snap.SocketCANOwn,
 					"serial_tx", snap.SerialTx,
 					"socketcan_tx", snap.SocketCANTx,
+					"socketcan_kernel_tx_dropped", snap.SocketCANKDrop,
+					"udp_rx", snap.UDPRx,
+					"udp_tx", snap.UDPTx,
 					"tcp_rx", snap.TCPRx,
 					"tcp_tx", snap.TCPTx,
 					"hub_drops", snap.HubDrops,
 					"errors", snap.Errors,
+					"serial_checksum_disabled", snap.SerialNoChecksum,
 				)
 			case <-ctx.Done():
 				return
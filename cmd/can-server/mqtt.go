@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/mqtt"
+	"github.com/kstaniek/go-ampio-server/internal/validate"
+)
+
+// mqttQueue bounds the frames waiting for the broker; further ones are
+// dropped and counted.
+const mqttQueue = 4096
+
+// mqttRetainCache bounds the topics whose last retained frame is published
+// again after a broker reconnect.
+const mqttRetainCache = 4096
+
+// mqttStateCache bounds the topics whose last decoded Ampio state is
+// published again after a broker reconnect. States have their own cache so
+// raw frames cannot crowd them out.
+const mqttStateCache = 4096
+
+// mqttPlaceholder matches the {name} placeholders of -mqtt-topic.
+var mqttPlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+
+// mqttFrame is the JSON payload of a published frame.
+type mqttFrame struct {
+	ID       string    `json:"id"`
+	Extended bool      `json:"extended"`
+	RTR      bool      `json:"rtr,omitempty"`
+	Len      int       `json:"len"`
+	Data     string    `json:"data"` // hex payload
+	Instance string    `json:"instance,omitempty"`
+	Time     time.Time `json:"ts"`
+}
+
+func (c *appConfig) validateMQTT() error {
+	if c.mqtt == "" {
+		return nil
+	}
+	_, useTLS, err := mqtt.ParseBroker(c.mqtt)
+	if err != nil {
+		return fmt.Errorf("mqtt: %w", err)
+	}
+	if c.mqttTopic == "" || strings.ContainsAny(c.mqttTopic, "+#") {
+		return fmt.Errorf("mqtt-topic: want a topic without wildcards (got %q)", c.mqttTopic)
+	}
+	for _, p := range mqttPlaceholder.FindAllString(c.mqttTopic, -1) {
+		if p != "{id}" && p != "{instance}" {
+			return fmt.Errorf("mqtt-topic: unknown placeholder %s (want {id} or {instance})", p)
+		}
+	}
+	if c.mqttFormat != "json" && c.mqttFormat != "raw" {
+		return fmt.Errorf("mqtt-format must be json or raw")
+	}
+	if c.mqttQoS != 0 && c.mqttQoS != 1 {
+		return fmt.Errorf("mqtt-qos must be 0 or 1 (QoS 2 is not supported)")
+	}
+	if !useTLS && (c.mqttTLSCA != "" || c.mqttTLSCert != "" || c.mqttTLSKey != "") {
+		return fmt.Errorf("mqtt-tls-* need an ssl://, tls:// or mqtts:// broker")
+	}
+	if _, err = c.mqttTLS(); err != nil {
+		return err
+	}
+	return c.validateMQTTTx()
+}
+
+// validateMQTTTx checks -mqtt-tx-topic and its -mqtt-tx-allow list.
+func (c *appConfig) validateMQTTTx() error {
+	if c.mqttTxTopic == "" {
+		if c.mqttTxAllow != "" {
+			return fmt.Errorf("mqtt-tx-allow needs -mqtt-tx-topic")
+		}
+		return nil
+	}
+	for _, p := range mqttPlaceholder.FindAllString(c.mqttTxTopic, -1) {
+		if p != "{instance}" {
+			return fmt.Errorf("mqtt-tx-topic: unknown placeholder %s (want {instance})", p)
+		}
+	}
+	levels := strings.Split(c.mqttTxTopic, "/")
+	for i, lv := range levels {
+		if (strings.Contains(lv, "#") && (lv != "#" || i < len(levels)-1)) || (strings.Contains(lv, "+") && lv != "+") {
+			return fmt.Errorf("mqtt-tx-topic: %q: + and # must fill a whole level, and # must be the last", c.mqttTxTopic)
+		}
+	}
+	if c.mqttTxAllow == "" {
+		return fmt.Errorf("mqtt-tx-allow is required with -mqtt-tx-topic")
+	}
+	if _, err := filter.New(c.mqttTxAllow, ""); err != nil {
+		return fmt.Errorf("mqtt-tx-allow: %w", err)
+	}
+	// Subscribing to our own topics would send every bus frame back to the bus.
+	published := mqttTopic(strings.ReplaceAll(c.mqttTopic, "{instance}", "main"), &can.Frame{CANID: 0x123})
+	if mqtt.Match(strings.ReplaceAll(c.mqttTxTopic, "{instance}", "main"), published) {
+		return fmt.Errorf("mqtt-tx-topic %q matches the published -mqtt-topic %q", c.mqttTxTopic, c.mqttTopic)
+	}
+	return nil
+}
+
+// mqttTLS builds the broker TLS settings from -mqtt-tls-ca, -mqtt-tls-cert
+// and -mqtt-tls-key (nil verifies against the system roots without a
+// client certificate).
+func (c *appConfig) mqttTLS() (*tls.Config, error) {
+	if c.mqttTLSCA == "" && c.mqttTLSCert == "" && c.mqttTLSKey == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.mqttTLSCert != "" || c.mqttTLSKey != "" {
+		if c.mqttTLSCert == "" || c.mqttTLSKey == "" {
+			return nil, fmt.Errorf("mqtt-tls-cert and mqtt-tls-key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.mqttTLSCert, c.mqttTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt-tls-cert: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if c.mqttTLSCA != "" {
+		pem, err := os.ReadFile(c.mqttTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt-tls-ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("mqtt-tls-ca: no certificates in %s", c.mqttTLSCA)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// defaultMQTTClientID is the client ID without -mqtt-client-id:
+// can-server-<hostname>.
+func defaultMQTTClientID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "gateway"
+	}
+	return "can-server-" + host
+}
+
+// mqttTopic expands the -mqtt-topic template for fr; tmpl has {instance}
+// already replaced.
+func mqttTopic(tmpl string, fr *can.Frame) string {
+	if !strings.Contains(tmpl, "{id}") {
+		return tmpl
+	}
+	var id string
+	if fr.CANID&can.CAN_EFF_FLAG != 0 {
+		id = fmt.Sprintf("%08X", fr.CANID&can.CAN_EFF_MASK)
+	} else {
+		id = fmt.Sprintf("%03X", fr.CANID&can.CAN_SFF_MASK)
+	}
+	return strings.ReplaceAll(tmpl, "{id}", id)
+}
+
+// mqttPayload encodes fr in the -mqtt-format: a JSON object or the bare
+// data bytes.
+func mqttPayload(format, instance string, fr *can.Frame, now time.Time) []byte {
+	n := min(int(fr.Len), len(fr.Data))
+	if format == "raw" {
+		return append([]byte(nil), fr.Data[:n]...)
+	}
+	ext := fr.CANID&can.CAN_EFF_FLAG != 0
+	mask := uint32(can.CAN_SFF_MASK)
+	if ext {
+		mask = can.CAN_EFF_MASK
+	}
+	rtr := fr.CANID&can.CAN_RTR_FLAG != 0
+	if rtr {
+		n = 0
+	}
+	b, _ := json.Marshal(mqttFrame{
+		ID:       fmt.Sprintf("0x%X", fr.CANID&mask),
+		Extended: ext,
+		RTR:      rtr,
+		Len:      int(fr.Len),
+		Data:     hex.EncodeToString(fr.Data[:n]),
+		Instance: instance,
+		Time:     now,
+	})
+	return b
+}
+
+// mqttTxFrame decodes a message of -mqtt-tx-topic: a JSON object with the
+// id and hex data of the frame, as published with -mqtt-format json, or
+// candump notation ("123#DEADBEEF").
+func mqttTxFrame(payload []byte) (can.Frame, error) {
+	s := strings.TrimSpace(string(payload))
+	if !strings.HasPrefix(s, "{") {
+		return can.ParseFrame(s)
+	}
+	var fr can.Frame
+	var m mqttFrame
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		return fr, err
+	}
+	digits := strings.TrimPrefix(strings.TrimPrefix(m.ID, "0x"), "0X")
+	id, err := strconv.ParseUint(digits, 16, 32)
+	if err != nil || digits == "" {
+		return fr, fmt.Errorf("bad id %q", m.ID)
+	}
+	switch {
+	case !m.Extended && id <= can.CAN_SFF_MASK:
+		fr.CANID = uint32(id)
+	case id <= can.CAN_EFF_MASK:
+		fr.CANID = uint32(id) | can.CAN_EFF_FLAG
+	default:
+		return fr, fmt.Errorf("id %q out of range", m.ID)
+	}
+	if m.RTR {
+		if m.Len < 0 || m.Len > 8 {
+			return fr, fmt.Errorf("bad len %d", m.Len)
+		}
+		fr.CANID |= can.CAN_RTR_FLAG
+		fr.Len = uint8(m.Len)
+		return fr, nil
+	}
+	data, err := hex.DecodeString(m.Data)
+	if err != nil || len(data) > 8 {
+		return fr, fmt.Errorf("data must be 0..8 hex bytes (got %q)", m.Data)
+	}
+	if m.Len != 0 && m.Len != len(data) {
+		return fr, fmt.Errorf("len %d does not match %d data bytes", m.Len, len(data))
+	}
+	fr.Len = uint8(len(data))
+	copy(fr.Data[:], data)
+	return fr, nil
+}
+
+// mqttTx sends the messages of -mqtt-tx-topic to the bus of the instance
+// whose topic filter they match.
+type mqttTx struct {
+	filters []string // per instance, {instance} expanded
+	insts   []*instance
+	allow   *filter.Filter
+	log     *slog.Logger
+}
+
+// newMQTTTx routes -mqtt-tx-topic to insts: one subscription per instance
+// with {instance}, otherwise one subscription for the first instance.
+func newMQTTTx(cfg *appConfig, insts []*instance, l *slog.Logger) (*mqttTx, error) {
+	allow, err := filter.New(cfg.mqttTxAllow, "")
+	if err != nil {
+		return nil, fmt.Errorf("mqtt-tx-allow: %w", err)
+	}
+	t := &mqttTx{allow: allow, log: l}
+	if !strings.Contains(cfg.mqttTxTopic, "{instance}") {
+		insts = insts[:1]
+	}
+	for _, in := range insts {
+		t.filters = append(t.filters, strings.ReplaceAll(cfg.mqttTxTopic, "{instance}", in.name))
+		t.insts = append(t.insts, in)
+	}
+	return t, nil
+}
+
+// subscriptions returns the topic filters to subscribe to.
+func (t *mqttTx) subscriptions(qos byte) []mqtt.Subscription {
+	subs := make([]mqtt.Subscription, len(t.filters))
+	for i, f := range t.filters {
+		subs[i] = mqtt.Subscription{Filter: f, QoS: qos}
+	}
+	return subs
+}
+
+// handle sends one message to the bus, or counts and logs why it did not.
+func (t *mqttTx) handle(m mqtt.Message) {
+	reason, err := t.send(m)
+	if reason == "" {
+		metrics.IncMQTTTx()
+		return
+	}
+	metrics.IncMQTTTxRejected(reason)
+	t.log.Debug("mqtt_tx_rejected", "topic", m.Topic, "reason", reason, "err", err)
+}
+
+// send returns the rejection reason of a message not sent.
+func (t *mqttTx) send(m mqtt.Message) (reason string, err error) {
+	// A retained message is replayed on every reconnect: sending it would
+	// repeat a stale command.
+	if m.Retain {
+		return "retained", nil
+	}
+	var in *instance
+	for i, f := range t.filters {
+		if mqtt.Match(f, m.Topic) {
+			in = t.insts[i]
+			break
+		}
+	}
+	if in == nil {
+		return "parse", fmt.Errorf("topic matches no instance")
+	}
+	fr, err := mqttTxFrame(m.Payload)
+	if err != nil {
+		return "parse", err
+	}
+	if !t.allow.Allow(&fr) {
+		return "id", nil
+	}
+	if err := in.tx.send(fr); err != nil {
+		if errors.Is(err, validate.ErrInvalid) {
+			return "invalid", err
+		}
+		return "backend", err
+	}
+	return "", nil
+}
+
+// startMQTT publishes every bus frame of every instance to the -mqtt
+// broker. Publishing never blocks the bus: frames the broker cannot take
+// in time are dropped and counted. With -mqtt-tx-topic it also subscribes
+// and sends the frames it receives to the bus.
+func startMQTT(ctx context.Context, cfg *appConfig, insts []*instance, l *slog.Logger, wg *sync.WaitGroup) error {
+	if cfg.mqtt == "" {
+		return nil
+	}
+	_, useTLS, err := mqtt.ParseBroker(cfg.mqtt)
+	if err != nil {
+		return err
+	}
+	tlsCfg, err := cfg.mqttTLS()
+	if err != nil {
+		return err
+	}
+	clientID := cfg.mqttClientID
+	if clientID == "" {
+		clientID = defaultMQTTClientID()
+	}
+	opts := mqtt.Options{
+		Broker:    cfg.mqtt,
+		ClientID:  clientID,
+		Username:  cfg.mqttUsername,
+		Password:  cfg.mqttPassword,
+		TLS:       tlsCfg,
+		Queue:     mqttQueue,
+		Logger:    l,
+		OnPublish: metrics.IncMQTTPublished,
+		OnState:   metrics.SetMQTTConnected,
+	}
+	// Retained messages are the last value of their topic; a broker that
+	// lost them gets them back on the reconnect. Decoded states are always
+	// retained, so Home Assistant entities recover at once; raw frames only
+	// with -mqtt-retain.
+	_, states, _ := cfg.ampioOutputs() // validated with the config
+	var retained, stateCache *mqtt.Cache
+	if cfg.mqttRetain {
+		retained = mqtt.NewCache(mqttRetainCache)
+	}
+	if states {
+		stateCache = mqtt.NewCache(mqttStateCache)
+	}
+	if retained != nil || stateCache != nil {
+		opts.Republish = func() []mqtt.Message {
+			var out []mqtt.Message
+			if stateCache != nil {
+				out = stateCache.Messages()
+			}
+			if retained != nil {
+				out = append(out, retained.Messages()...)
+			}
+			return out
+		}
+	}
+	qos := byte(cfg.mqttQoS)
+	if cfg.mqttTxTopic != "" {
+		tx, err := newMQTTTx(cfg, insts, l)
+		if err != nil {
+			return err
+		}
+		opts.Subscriptions = tx.subscriptions(qos)
+		opts.OnMessage = tx.handle
+	}
+	cl, err := mqtt.New(opts)
+	if err != nil {
+		return err
+	}
+	wg.Add(1)
+	go func() { defer wg.Done(); cl.Run(ctx) }()
+	var lastDropLog time.Time
+	var mu sync.Mutex
+	// publish queues m and, once queued, keeps it in cache (when non-nil)
+	// for the next reconnect.
+	publish := func(m mqtt.Message, cache *mqtt.Cache, now time.Time) {
+		if cl.Publish(m) {
+			if cache != nil {
+				cache.Put(m)
+			}
+			return
+		}
+		metrics.IncMQTTDropped()
+		mu.Lock()
+		defer mu.Unlock()
+		if now.Sub(lastDropLog) >= time.Minute {
+			lastDropLog = now
+			l.Warn("mqtt_queue_full", "broker", cfg.mqtt, "queue", mqttQueue)
+		}
+	}
+	dec, _ := cfg.ampioDecoder()
+	for _, in := range insts {
+		name := in.name
+		tmpl := strings.ReplaceAll(cfg.mqttTopic, "{instance}", name)
+		watchHub(ctx, in.hub, wg, func(fr *can.Frame) {
+			if cnl.IsControl(fr) {
+				return
+			}
+			now := time.Now()
+			publish(mqtt.Message{Topic: mqttTopic(tmpl, fr), Payload: mqttPayload(cfg.mqttFormat, name, fr, now), QoS: qos, Retain: cfg.mqttRetain}, retained, now)
+		})
+		if !states {
+			continue
+		}
+		stateTmpl := strings.ReplaceAll(cfg.ampioTopic, "{instance}", name)
+		watchHub(ctx, in.hub, wg, func(fr *can.Frame) {
+			ev, ok := dec.Decode(fr)
+			if !ok {
+				return
+			}
+			now := time.Now()
+			b, _ := json.Marshal(ampioEvent{Event: ev, Instance: name, Time: now})
+			publish(mqtt.Message{Topic: ampioTopic(stateTmpl, &ev), Payload: b, QoS: qos, Retain: true}, stateCache, now)
+		})
+	}
+	l.Info("mqtt_enabled", "broker", cfg.mqtt, "client_id", clientID, "topic", cfg.mqttTopic, "format", cfg.mqttFormat,
+		"qos", cfg.mqttQoS, "retain", cfg.mqttRetain, "tls", useTLS, "tx_topic", cfg.mqttTxTopic)
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/mqtt"
+	"github.com/kstaniek/go-ampio-server/internal/validate"
+)
+
+func TestValidateMQTT(t *testing.T) {
+	ok := appConfig{mqtt: "tcp://broker.lan", mqttTopic: "ampio/can/{id}", mqttFormat: "json"}
+	for _, tc := range []struct {
+		name string
+		mod  func(*appConfig)
+		ok   bool
+	}{
+		{"valid", func(*appConfig) {}, true},
+		{"off ignores the rest", func(c *appConfig) { c.mqtt, c.mqttFormat = "", "xml" }, true},
+		{"instance placeholder", func(c *appConfig) { c.mqttTopic = "ampio/{instance}/{id}" }, true},
+		{"raw qos 1", func(c *appConfig) { c.mqttFormat, c.mqttQoS = "raw", 1 }, true},
+		{"bad scheme", func(c *appConfig) { c.mqtt = "http://broker.lan" }, false},
+		{"wildcard topic", func(c *appConfig) { c.mqttTopic = "ampio/#" }, false},
+		{"unknown placeholder", func(c *appConfig) { c.mqttTopic = "ampio/{bus}" }, false},
+		{"bad format", func(c *appConfig) { c.mqttFormat = "xml" }, false},
+		{"qos 2", func(c *appConfig) { c.mqttQoS = 2 }, false},
+		{"tls files on plain broker", func(c *appConfig) { c.mqttTLSCA = "/etc/ca.pem" }, false},
+		{"missing tls ca", func(c *appConfig) { c.mqtt, c.mqttTLSCA = "mqtts://broker.lan", "/nonexistent/ca.pem" }, false},
+		{"cert without key", func(c *appConfig) { c.mqtt, c.mqttTLSCert = "mqtts://broker.lan", "/etc/cert.pem" }, false},
+		{"tx topic", func(c *appConfig) { c.mqttTxTopic, c.mqttTxAllow = "ampio/{instance}/tx/#", "0x100-0x1FF" }, true},
+		{"tx topic without allow", func(c *appConfig) { c.mqttTxTopic = "ampio/tx" }, false},
+		{"tx allow without topic", func(c *appConfig) { c.mqttTxAllow = "0x100" }, false},
+		{"bad tx allow", func(c *appConfig) { c.mqttTxTopic, c.mqttTxAllow = "ampio/tx", "zz" }, false},
+		{"tx topic id placeholder", func(c *appConfig) { c.mqttTxTopic, c.mqttTxAllow = "ampio/tx/{id}", "0x100" }, false},
+		{"tx topic partial wildcard", func(c *appConfig) { c.mqttTxTopic, c.mqttTxAllow = "ampio/tx#", "0x100" }, false},
+		{"tx topic inner #", func(c *appConfig) { c.mqttTxTopic, c.mqttTxAllow = "ampio/#/tx", "0x100" }, false},
+		{"tx topic loops", func(c *appConfig) { c.mqttTxTopic, c.mqttTxAllow = "ampio/can/+", "0x100" }, false},
+	} {
+		c := ok
+		tc.mod(&c)
+		if err := c.validateMQTT(); (err == nil) != tc.ok {
+			t.Fatalf("%s: err=%v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestMQTTTopicAndPayload(t *testing.T) {
+	eff := can.Frame{CANID: 0x1D000123 | can.CAN_EFF_FLAG, Len: 2, Data: [64]byte{0xAB, 0x01}}
+	sff := can.Frame{CANID: 0x12, Len: 0}
+	if got := mqttTopic("ampio/can/{id}", &eff); got != "ampio/can/1D000123" {
+		t.Fatalf("eff topic %q", got)
+	}
+	if got := mqttTopic("ampio/can/{id}/state", &sff); got != "ampio/can/012/state" {
+		t.Fatalf("sff topic %q", got)
+	}
+	if got := mqttPayload("raw", "", &eff, time.Time{}); string(got) != "\xab\x01" {
+		t.Fatalf("raw payload %x", got)
+	}
+	ts := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	want := `{"id":"0x1D000123","extended":true,"len":2,"data":"ab01","instance":"main","ts":"2025-01-02T03:04:05Z"}`
+	if got := mqttPayload("json", "main", &eff, ts); string(got) != want {
+		t.Fatalf("json payload\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestMQTTTxFrame(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want can.Frame
+		ok   bool
+	}{
+		{"123#DEAD", can.Frame{CANID: 0x123, Len: 2, Data: [64]byte{0xDE, 0xAD}}, true},
+		{" 1D000123#R\n", can.Frame{CANID: 0x1D000123 | can.CAN_EFF_FLAG | can.CAN_RTR_FLAG}, true},
+		{`{"id":"0x123","data":"0102"}`, can.Frame{CANID: 0x123, Len: 2, Data: [64]byte{1, 2}}, true},
+		{`{"id":"1D000123","data":"ab","len":1}`, can.Frame{CANID: 0x1D000123 | can.CAN_EFF_FLAG, Len: 1, Data: [64]byte{0xAB}}, true},
+		{`{"id":"0x12","extended":true,"data":""}`, can.Frame{CANID: 0x12 | can.CAN_EFF_FLAG}, true},
+		{`{"id":"0x123","rtr":true,"len":4}`, can.Frame{CANID: 0x123 | can.CAN_RTR_FLAG, Len: 4}, true},
+		{`{"id":"0x123","data":"010203040506070809"}`, can.Frame{}, false},
+		{`{"id":"0x123","data":"0102","len":3}`, can.Frame{}, false},
+		{`{"id":"0x20000000","data":""}`, can.Frame{}, false},
+		{`{"id":"","data":""}`, can.Frame{}, false},
+		{`{"id":`, can.Frame{}, false},
+		{"123", can.Frame{}, false},
+	} {
+		got, err := mqttTxFrame([]byte(tc.in))
+		if (err == nil) != tc.ok || (tc.ok && got != tc.want) {
+			t.Fatalf("%s: got %+v err=%v", tc.in, got, err)
+		}
+	}
+}
+
+func TestMQTTTxSend(t *testing.T) {
+	var sent []can.Frame
+	sendErr := error(nil)
+	in := &instance{name: "main", tx: backendTx{send: func(fr can.Frame) error {
+		if sendErr != nil {
+			return sendErr
+		}
+		sent = append(sent, fr)
+		return nil
+	}}}
+	other := &instance{name: "aux", tx: backendTx{send: func(can.Frame) error { t.Fatal("sent to aux"); return nil }}}
+	cfg := &appConfig{mqttTxTopic: "ampio/{instance}/tx", mqttTxAllow: "0x100-0x1FF"}
+	tx, err := newMQTTTx(cfg, []*instance{other, in}, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subs := tx.subscriptions(1); len(subs) != 2 || subs[1] != (mqtt.Subscription{Filter: "ampio/main/tx", QoS: 1}) {
+		t.Fatalf("subscriptions %+v", subs)
+	}
+	for _, tc := range []struct {
+		m      mqtt.Message
+		err    error
+		reason string
+	}{
+		{mqtt.Message{Topic: "ampio/main/tx", Payload: []byte("123#01")}, nil, ""},
+		{mqtt.Message{Topic: "ampio/main/tx", Payload: []byte("123#01"), Retain: true}, nil, "retained"},
+		{mqtt.Message{Topic: "ampio/main/tx", Payload: []byte("junk")}, nil, "parse"},
+		{mqtt.Message{Topic: "ampio/main/tx", Payload: []byte("223#01")}, nil, "id"},
+		{mqtt.Message{Topic: "ampio/main/tx", Payload: []byte("123#01")}, validate.ErrInvalid, "invalid"},
+		{mqtt.Message{Topic: "ampio/main/tx", Payload: []byte("123#01")}, filter.ErrDenied, "backend"},
+	} {
+		sendErr = tc.err
+		if reason, err := tx.send(tc.m); reason != tc.reason {
+			t.Fatalf("%+v: reason %q (%v), want %q", tc.m, reason, err, tc.reason)
+		}
+	}
+	if len(sent) != 1 || sent[0] != (can.Frame{CANID: 0x123, Len: 1, Data: [64]byte{1}}) {
+		t.Fatalf("sent %+v", sent)
+	}
+
+	// Without {instance} the first instance gets every message.
+	cfg.mqttTxTopic = "ampio/tx/#"
+	if tx, _ = newMQTTTx(cfg, []*instance{in, other}, testLogger()); len(tx.filters) != 1 {
+		t.Fatalf("filters %q", tx.filters)
+	}
+	sendErr = nil
+	if reason, err := tx.send(mqtt.Message{Topic: "ampio/tx/x", Payload: []byte(`{"id":"0x150","data":"aa"}`)}); reason != "" || len(sent) != 2 {
+		t.Fatalf("reason %q err=%v", reason, err)
+	}
+}
+
+// readMQTT reads one MQTT control packet.
+func readMQTT(r *bufio.Reader) (byte, []byte, error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(r) // the remaining length is a base-128 varint
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return h, body, err
+}
+
+func TestStartMQTT(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	type msg struct {
+		topic   string
+		payload []byte
+		retain  bool
+	}
+	got := make(chan msg, 4)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if _, _, err := readMQTT(r); err != nil { // CONNECT
+			return
+		}
+		_, _ = conn.Write([]byte{0x20, 2, 0, 0}) // CONNACK accepted
+		for {
+			h, body, err := readMQTT(r)
+			if err != nil {
+				return
+			}
+			if h>>4 == 8 { // SUBSCRIBE: grant QoS 0 and send a frame to the TX topic
+				_, _ = conn.Write([]byte{0x90, 3, body[0], body[1], 0})
+				topic, payload := "ampio/main/tx", "123#CAFE"
+				pub := append([]byte{0x30, byte(2 + len(topic) + len(payload)), 0, byte(len(topic))}, topic...)
+				_, _ = conn.Write(append(pub, payload...))
+				continue
+			}
+			if h>>4 != 3 { // PUBLISH
+				continue
+			}
+			n := int(binary.BigEndian.Uint16(body))
+			got <- msg{topic: string(body[2 : 2+n]), payload: body[2+n:], retain: h&1 != 0}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() { cancel(); wg.Wait() }()
+	sent := make(chan can.Frame, 1)
+	in := &instance{name: "main", hub: hub.New(), tx: backendTx{send: func(fr can.Frame) error { sent <- fr; return nil }}}
+	cfg := &appConfig{mqtt: "tcp://" + ln.Addr().String(), mqttTopic: "ampio/{instance}/{id}", mqttFormat: "json",
+		mqttTxTopic: "ampio/{instance}/tx", mqttTxAllow: "0x123", ampioEvents: "mqtt", ampioTopic: "ampio/{instance}/state/{module}/{kind}"}
+	if err := startMQTT(ctx, cfg, []*instance{in}, testLogger(), &wg); err != nil {
+		t.Fatalf("startMQTT: %v", err)
+	}
+	in.hub.Broadcast(can.Frame{CANID: 0x1D000123 | can.CAN_EFF_FLAG, Len: 1, Data: [64]byte{7}})
+	select {
+	case m := <-got:
+		var fr mqttFrame
+		if err := json.Unmarshal(m.payload, &fr); err != nil {
+			t.Fatalf("payload %s: %v", m.payload, err)
+		}
+		if m.topic != "ampio/main/1D000123" || m.retain || fr.ID != "0x1D000123" || fr.Data != "07" || fr.Instance != "main" {
+			t.Fatalf("got topic %q retain=%v payload %s", m.topic, m.retain, m.payload)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("nothing published")
+	}
+	select {
+	case fr := <-sent:
+		if fr != (can.Frame{CANID: 0x123, Len: 2, Data: [64]byte{0xCA, 0xFE}}) {
+			t.Fatalf("sent %+v", fr)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("TX topic message not sent to the bus")
+	}
+
+	// A decoded Ampio broadcast goes to its state topic as well, retained
+	// even without -mqtt-retain.
+	in.hub.Broadcast(can.Frame{CANID: 0x1D000123 | can.CAN_EFF_FLAG, Len: 4, Data: [64]byte{0xFE, 0x05, 0xEB, 0x00}})
+	for {
+		select {
+		case m := <-got:
+			if m.topic != "ampio/main/state/000123/temperature" {
+				continue
+			}
+			if !m.retain || !strings.HasPrefix(string(m.payload), `{"module":"000123","kind":"temperature","temperatures":[23.5],"instance":"main","ts":`) {
+				t.Fatalf("state payload %s", m.payload)
+			}
+			return
+		case <-time.After(3 * time.Second):
+			t.Fatal("Ampio state not published")
+		}
+	}
+}
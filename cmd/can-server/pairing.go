@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/bridge"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/pairing"
+)
+
+// minPairKey is the shortest accepted -pair-key.
+const minPairKey = 8
+
+// startPairing broadcasts pairing beacons for -pair-key and federates the
+// instance with every peer using the same key (nil when disabled).
+func startPairing(ctx context.Context, cfg *appConfig, insts []*instance, l *slog.Logger, wg *sync.WaitGroup) error {
+	if cfg.pairKey == "" {
+		return nil
+	}
+	if len(insts) != 1 {
+		return fmt.Errorf("pairing needs a single instance (have %d)", len(insts))
+	}
+	in := insts[0]
+	name := cfg.mdnsName
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	p := pairing.New(pairing.Config{
+		Key:    []byte(cfg.pairKey),
+		Name:   name,
+		Port:   cfg.pairPort,
+		Logger: l,
+		Link: func(ctx context.Context, peer pairing.Peer, conn net.Conn) error {
+			return runPeerLink(ctx, cfg.bridgeTTL, in, peer, conn, l)
+		},
+	})
+	l.Info("pair_enabled", "node", p.Node(), "name", name, "port", cfg.pairPort)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := p.Run(ctx); err != nil {
+			l.Error("pair_error", "error", err)
+		}
+	}()
+	return nil
+}
+
+// runPeerLink bridges the local bus with peer's over the authenticated
+// pairing link conn, in both directions, until the connection fails. Frames
+// travel in cannelloni wire encoding. Frames from the peer enter a private
+// hub so the bridge loop prevention applies to the link like to a route
+// between local instances.
+func runPeerLink(ctx context.Context, ttl int, in *instance, peer pairing.Peer, conn net.Conn, l *slog.Logger) error {
+	linkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() { <-linkCtx.Done(); _ = conn.Close() }()
+	var (
+		mu  sync.Mutex
+		enc cnl.Codec
+	)
+	send := func(fr can.Frame) error {
+		mu.Lock()
+		defer mu.Unlock()
+		_, err := enc.EncodeTo(conn, []can.Frame{fr})
+		return err
+	}
+	remote := hub.New()
+	local := bridge.Endpoint{Name: "local", Hub: in.hub, Send: in.tx.send}
+	far := bridge.Endpoint{Name: "peer:" + peer.Node, Hub: remote, Send: send}
+	br := bridge.New(ttl, 0)
+	if _, err := br.Add(local, far); err != nil {
+		return err
+	}
+	if _, err := br.Add(far, local); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() { defer close(done); br.Run(linkCtx) }()
+	l.Info("pair_link_up", "peer", peer.Name, "addr", peer.Addr)
+	var dec cnl.Codec
+	_, err := dec.DecodeN(bufio.NewReader(conn), 0, remote.Broadcast)
+	cancel()
+	<-done
+	if ctx.Err() != nil || errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/pairing"
+)
+
+func TestPeerLink(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// The peer end of the authenticated link, driven by hand.
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	sent := make(chan can.Frame, 4)
+	in := &instance{hub: hub.New(), tx: backendTx{send: func(fr can.Frame) error { sent <- fr; return nil }}}
+	done := make(chan error, 1)
+	go func() {
+		done <- runPeerLink(ctx, 4, in, pairing.Peer{Node: "0000000000000002", Name: "peer"}, conn, testLogger())
+	}()
+	for in.hub.Stats().Clients == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("link not established")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// A local bus frame reaches the peer.
+	var codec cnl.Codec
+	r := bufio.NewReader(peer)
+	in.hub.Broadcast(can.Frame{CANID: 0x100, Len: 1})
+	if fr, err := codec.Decode(r); err != nil || fr.CANID != 0x100 {
+		t.Fatalf("peer got %+v err=%v", fr, err)
+	}
+	// A peer bus frame reaches the local bus.
+	if _, err := codec.EncodeTo(peer, []can.Frame{{CANID: 0x200, Len: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case fr := <-sent:
+		if fr.CANID != 0x200 {
+			t.Fatalf("local bus got 0x%X", fr.CANID)
+		}
+	case <-ctx.Done():
+		t.Fatal("peer frame not forwarded")
+	}
+	// Its echo on the local bus is not sent back to the peer.
+	in.hub.Broadcast(can.Frame{CANID: 0x200, Len: 1})
+	_ = peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if fr, err := codec.Decode(r); err == nil {
+		t.Fatalf("echo looped back: %+v", fr)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("link: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/kstaniek/go-ampio-server/internal/bridge"
+)
+
+// Route kinds reported by /api/routes.
+const (
+	routeRX     = "rx"     // backend -> TCP clients of the same instance
+	routeTX     = "tx"     // TCP clients -> backend of the same instance
+	routeBridge = "bridge" // backend RX of one instance -> backend TX of another
+)
+
+// routeInfo describes one frame path and its counters.
+type routeInfo struct {
+	Kind     string            `json:"kind"`
+	Instance string            `json:"instance,omitempty"`
+	From     string            `json:"from"`
+	To       string            `json:"to"`
+	Filter   string            `json:"filter,omitempty"`
+	Dedup    string            `json:"dedup,omitempty"`
+	Counters map[string]uint64 `json:"counters"`
+}
+
+// routeTable lists every path a frame can take through the process: per
+// instance the RX (backend -> clients) and TX (clients -> backend) paths
+// with their filters, then any bridge routes.
+func routeTable(insts []*instance, br *bridge.Bridge) []routeInfo {
+	var out []routeInfo
+	for _, in := range insts {
+		rxf, txf, _ := in.cfg.filters() // validated at startup
+		target := backendTarget(in.cfg)
+		hs, ss := in.hub.Stats(), in.srv.Stats()
+		out = append(out, routeInfo{
+			Kind: routeRX, Instance: in.name, From: target, To: "clients",
+			Filter: filterSpec(rxf.String()),
+			Counters: map[string]uint64{
+				"frames":  hs.Frames,
+				"denied":  hs.Denied,
+				"dropped": hs.Drops,
+				"kicked":  hs.Kicks,
+				"clients": uint64(hs.Clients),
+			},
+		})
+		tx := routeInfo{
+			Kind: routeTX, Instance: in.name, From: "clients", To: target,
+			Filter: filterSpec(txf.String()),
+			Counters: map[string]uint64{
+				"frames":    ss.ClientFrames,
+				"denied":    ss.BackendDenied,
+				"inhibited": ss.BackendInhibited,
+				"overflow":  ss.BackendOverflow,
+				"errors":    ss.BackendErrors,
+			},
+		}
+		if in.cfg.txDedupWindow > 0 {
+			tx.Dedup = fmt.Sprintf("window=%s ids=%s", in.cfg.txDedupWindow, filterSpec(in.cfg.txDedupIDs))
+		}
+		out = append(out, tx)
+	}
+	if br != nil {
+		for _, r := range br.Routes() {
+			st := r.Stats()
+			out = append(out, routeInfo{
+				Kind: routeBridge, From: r.From, To: r.To,
+				Counters: map[string]uint64{
+					"forwarded": st.Forwarded,
+					"loops":     st.Loops,
+					"errors":    st.Errors,
+				},
+			})
+		}
+	}
+	return out
+}
+
+// filterSpec renders an unset filter list as "all".
+func filterSpec(s string) string {
+	if s == "" || s == "none" {
+		return "all"
+	}
+	return s
+}
+
+// routesHandler serves GET /api/routes.
+func routesHandler(insts []*instance, br *bridge.Bridge) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ttl := 0
+		if br != nil {
+			ttl = br.TTL()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			BridgeTTL int         `json:"bridge_ttl,omitempty"`
+			Routes    []routeInfo `json:"routes"`
+		}{ttl, routeTable(insts, br)})
+	})
+}
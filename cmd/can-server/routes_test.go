@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/bridge"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+func TestRoutesHandler(t *testing.T) {
+	a := &instance{name: "a", hub: hub.New(), srv: server.NewServer(),
+		cfg: &appConfig{backend: "socketcan", canIf: "can0", rxDeny: "0x700-0x7FF", txDedupWindow: 50 * time.Millisecond}}
+	b := &instance{name: "b", hub: hub.New(), srv: server.NewServer(), cfg: &appConfig{backend: "loopback"}}
+	a.hub.Filter = func(fr *can.Frame) bool { return fr.CANID < 0x700 }
+	a.hub.Broadcast(can.Frame{CANID: 0x100})
+	a.hub.Broadcast(can.Frame{CANID: 0x701})
+	br := bridge.New(3, 0)
+	_, _ = br.Add(bridge.Endpoint{Name: "a", Hub: a.hub}, bridge.Endpoint{Name: "b", Hub: b.hub})
+
+	rec := httptest.NewRecorder()
+	routesHandler([]*instance{a, b}, br).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/routes", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var got struct {
+		BridgeTTL int         `json:"bridge_ttl"`
+		Routes    []routeInfo `json:"routes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.BridgeTTL != 3 || len(got.Routes) != 5 {
+		t.Fatalf("unexpected table: %+v", got)
+	}
+	rx := got.Routes[0]
+	if rx.Kind != routeRX || rx.From != "socketcan can0" || rx.Counters["frames"] != 1 || rx.Counters["denied"] != 1 || rx.Filter == "all" {
+		t.Fatalf("rx route: %+v", rx)
+	}
+	if tx := got.Routes[1]; tx.Kind != routeTX || tx.Filter != "all" || tx.Dedup == "" {
+		t.Fatalf("tx route: %+v", tx)
+	}
+	if br := got.Routes[4]; br.Kind != routeBridge || br.From != "a" || br.To != "b" {
+		t.Fatalf("bridge route: %+v", br)
+	}
+
+	rec = httptest.NewRecorder()
+	routesHandler(nil, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/routes", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST got %d", rec.Code)
+	}
+}
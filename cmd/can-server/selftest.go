@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+const (
+	// selfTestProbeTimeout bounds the wait for the probe frame to be written.
+	selfTestProbeTimeout = time.Second
+	// selfTestMaxMalformed is the tolerated share of malformed serial frames
+	// (checksum/length errors) relative to decoded frames.
+	selfTestMaxMalformed = 0.01
+)
+
+// selfTestResult is the outcome of one instance's self-test.
+type selfTestResult struct {
+	frames    uint64
+	ids       int
+	malformed uint64
+	probeErr  error
+	openErr   error
+}
+
+// runSelfTest opens every configured backend, listens for cfg.selfTestFor,
+// optionally transmits the probe frame and prints a pass/fail report. It
+// returns the process exit code (0 = all checks passed).
+func runSelfTest(ctx context.Context, w io.Writer, cfg *appConfig, l *slog.Logger) int {
+	var probe *can.Frame
+	if cfg.selfTestProbe != "" {
+		fr, err := can.ParseFrame(cfg.selfTestProbe)
+		if err != nil {
+			fmt.Fprintf(w, "FAIL self-test-probe: %v\n", err)
+			return 1
+		}
+		probe = &fr
+	}
+	insts, err := cfg.instanceConfigs()
+	if err != nil {
+		fmt.Fprintf(w, "FAIL configuration: %v\n", err)
+		return 1
+	}
+	failed := false
+	for _, ic := range insts {
+		prefix := ""
+		if ic.name != "" {
+			prefix = "[" + ic.name + "] "
+		}
+		fmt.Fprintf(w, "# %sself-test backend=%s duration=%s\n", prefix, ic.backend, cfg.selfTestFor)
+		res := selfTestInstance(ctx, ic, probe, cfg.selfTestFor, l)
+		for _, c := range res.checks(ic, probe) {
+			status := "PASS"
+			if !c.ok {
+				status = "FAIL"
+				failed = true
+			}
+			fmt.Fprintf(w, "%s %s%s\n", status, prefix, c.msg)
+		}
+	}
+	if failed {
+		fmt.Fprintln(w, "# self-test FAIL")
+		return 1
+	}
+	fmt.Fprintln(w, "# self-test PASS")
+	return 0
+}
+
+// selfTestInstance runs the backend of cfg against a private hub for d.
+func selfTestInstance(parent context.Context, cfg *appConfig, probe *can.Frame, d time.Duration, l *slog.Logger) selfTestResult {
+	var res selfTestResult
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	h := hub.New()
+	cl := &hub.Client{Out: make(chan can.Frame, 1024), Closed: make(chan struct{})}
+	h.Add(cl)
+	var (
+		frames atomic.Uint64
+		ids    = make(map[uint32]struct{}) // read only after done
+		done   = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case fr := <-cl.Out:
+				frames.Add(1)
+				ids[fr.CANID] = struct{}{}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	before := metrics.Snap().Malformed
+	var wg sync.WaitGroup
+	tx, cleanup, err := initBackend(ctx, cfg, h, l, &wg)
+	if err != nil {
+		res.openErr = err
+		cancel()
+		<-done
+		return res
+	}
+	if probe != nil {
+		pctx, pcancel := context.WithTimeout(ctx, selfTestProbeTimeout)
+		res.probeErr = tx.wait(pctx, *probe)
+		pcancel()
+	}
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+	cleanup()
+	cancel()
+	wg.Wait()
+	<-done
+	res.frames = frames.Load()
+	res.ids = len(ids)
+	res.malformed = metrics.Snap().Malformed - before
+	return res
+}
+
+type selfTestCheck struct {
+	ok  bool
+	msg string
+}
+
+// checks turns a result into report lines in a fixed order.
+func (r selfTestResult) checks(cfg *appConfig, probe *can.Frame) []selfTestCheck {
+	kind, _ := splitBackend(cfg.backend)
+	if r.openErr != nil {
+		return []selfTestCheck{{false, fmt.Sprintf("backend open: %v", r.openErr)}}
+	}
+	out := []selfTestCheck{{true, "backend open (" + backendTarget(cfg) + ")"}}
+	if probe != nil {
+		if r.probeErr != nil {
+			out = append(out, selfTestCheck{false, fmt.Sprintf("probe %s: %v", probe, r.probeErr)})
+		} else {
+			out = append(out, selfTestCheck{true, fmt.Sprintf("probe %s sent", probe)})
+		}
+	}
+	if r.frames == 0 {
+		out = append(out, selfTestCheck{false, "rx activity: no frames received"})
+	} else {
+		out = append(out, selfTestCheck{true, fmt.Sprintf("rx activity: %d frames, %d distinct IDs", r.frames, r.ids)})
+	}
+	if kind == "serial" {
+		ok := float64(r.malformed) <= selfTestMaxMalformed*float64(r.frames)
+		out = append(out, selfTestCheck{ok, fmt.Sprintf("serial checksum: %d malformed of %d frames", r.malformed, r.frames+r.malformed)})
+	}
+	return out
+}
+
+// backendTarget names the device or peer a backend talks to.
+func backendTarget(cfg *appConfig) string {
+	switch kind, arg := splitBackend(cfg.backend); kind {
+	case "serial", "slcan":
+		return kind + " " + cfg.serialDev
+	case "socketcan":
+		return "socketcan " + cfg.canIf
+	case "replay":
+		return "replay " + cfg.replayFile
+	case backendCannelloniUDP:
+		return "cannelloni-udp " + arg + " via " + cfg.udpLocal
+	case backendCannelloniTCP:
+		return "cannelloni-tcp " + arg
+	default:
+		return kind
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/serial"
+)
+
+func TestSelfTestLoopbackProbe(t *testing.T) {
+	cfg := &appConfig{backend: "loopback", selfTestFor: 50 * time.Millisecond, selfTestProbe: "7FF#0102"}
+	var out bytes.Buffer
+	if code := runSelfTest(context.Background(), &out, cfg, testLogger()); code != 0 {
+		t.Fatalf("exit %d, report:\n%s", code, out.String())
+	}
+	for _, want := range []string{"PASS probe 7FF#0102 sent", "PASS rx activity: 1 frames", "# self-test PASS"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("report missing %q:\n%s", want, out.String())
+		}
+	}
+
+	cfg.selfTestProbe = ""
+	out.Reset()
+	if code := runSelfTest(context.Background(), &out, cfg, testLogger()); code != 1 {
+		t.Fatalf("silent bus: exit %d, report:\n%s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "FAIL rx activity") {
+		t.Fatalf("report missing rx failure:\n%s", out.String())
+	}
+}
+
+func TestSelfTestSerialChecksum(t *testing.T) {
+	good := serTestWireEnvelope([]byte{0, 0, 0x01, 0x23, 0xAA, 0x01})
+	bad := serTestWireEnvelope([]byte{0, 0, 0x01, 0x23, 0xBB, 0x02})
+	bad[len(bad)-1] ^= 0xFF
+	openSerialPort = func(string, int, time.Duration) (serial.Port, error) {
+		return &fakeSerialPort{reads: [][]byte{good, bad, good}}, nil
+	}
+	defer func() { openSerialPort = serial.Open }()
+
+	cfg := &appConfig{backend: "serial", serialDev: "fake", baud: 115200, serialReadTO: 10 * time.Millisecond, selfTestFor: 100 * time.Millisecond}
+	var out bytes.Buffer
+	if code := runSelfTest(context.Background(), &out, cfg, testLogger()); code != 1 {
+		t.Fatalf("exit %d, report:\n%s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "FAIL serial checksum: 1 malformed") {
+		t.Fatalf("report missing checksum failure:\n%s", out.String())
+	}
+}
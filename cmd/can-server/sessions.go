@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+const (
+	sessionsPath = "/api/sessions"
+	// maxSessionsBody bounds the session export read from the peer.
+	maxSessionsBody = 16 << 20
+)
+
+// sessionsExport is the body of GET /api/sessions: the sessions of every
+// instance, keyed by instance name ("" in single-instance mode).
+type sessionsExport struct {
+	Instances map[string][]server.SessionState `json:"instances"`
+}
+
+func (c *appConfig) validateSessionPeer() error {
+	if c.sessionPeer == "" {
+		return nil
+	}
+	u, err := url.Parse(c.sessionPeer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("session-peer: want an http(s) URL (got %q)", c.sessionPeer)
+	}
+	if c.sessionGrace <= 0 {
+		return fmt.Errorf("session-peer needs sessions (session-grace > 0)")
+	}
+	if c.sessionSync <= 0 {
+		return fmt.Errorf("session-sync must be > 0")
+	}
+	return nil
+}
+
+// sessionsHandler serves GET /api/sessions with the client sessions of
+// every instance, for the standby gateway of a hot-standby pair. Session
+// tokens let a client take its session over, so the endpoint needs the
+// manage permission.
+func sessionsHandler(insts []*instance) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		out := sessionsExport{Instances: make(map[string][]server.SessionState, len(insts))}
+		for _, in := range insts {
+			out.Instances[in.name] = in.srv.ExportSessions()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	})
+}
+
+// startSessionSync fetches the client sessions of -session-peer every
+// -session-sync and holds them on the instances of the same name, so their
+// clients can resume them here when the shared address fails over. The
+// sessions last fetched are kept while the peer is unreachable.
+func startSessionSync(ctx context.Context, cfg *appConfig, insts []*instance, l *slog.Logger, wg *sync.WaitGroup) {
+	if cfg.sessionPeer == "" {
+		return
+	}
+	src := strings.TrimRight(cfg.sessionPeer, "/") + sessionsPath
+	hc := &http.Client{Timeout: max(cfg.sessionSync, time.Second)}
+	l.Info("session_sync_enabled", "peer", cfg.sessionPeer, "interval", cfg.sessionSync)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(cfg.sessionSync)
+		defer t.Stop()
+		failing := false
+		for {
+			err := syncSessions(ctx, hc, src, cfg.sessionPeerToken, insts, l)
+			switch {
+			case err != nil && ctx.Err() == nil:
+				metrics.IncError(metrics.ErrSessionSync)
+				if !failing {
+					l.Warn("session_sync_error", "peer", cfg.sessionPeer, "error", err)
+				}
+				failing = true
+			case err == nil && failing:
+				l.Info("session_sync_recovered", "peer", cfg.sessionPeer)
+				failing = false
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// syncSessions fetches the session export at src once and imports it.
+func syncSessions(ctx context.Context, hc *http.Client, src, token string, insts []*instance, l *slog.Logger) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer answered %s", resp.Status)
+	}
+	var exp sessionsExport
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, maxSessionsBody)).Decode(&exp); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	for _, in := range insts {
+		n, err := in.srv.ImportSessions(exp.Instances[in.name])
+		if errors.Is(err, server.ErrSessionsDisabled) {
+			continue
+		}
+		if err != nil {
+			l.Warn("session_sync_skipped", "instance", in.name, "error", err)
+		}
+		l.Debug("session_sync", "instance", in.name, "sessions", n)
+	}
+	return nil
+}
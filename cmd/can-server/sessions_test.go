@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+func TestSessionSync(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"instances":{"a":[{"token":1,"identity":"x"},{"token":0}]}}`))
+	}))
+	defer ts.Close()
+
+	standby := &instance{name: "a", hub: hub.New(), srv: server.NewServer(server.WithSessions(time.Minute, 0))}
+	other := &instance{name: "b", hub: hub.New(), srv: server.NewServer()}
+	insts := []*instance{standby, other}
+	var logs bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	src := ts.URL + sessionsPath
+	if err := syncSessions(context.Background(), ts.Client(), src, "bad", insts, l); err == nil {
+		t.Fatal("expected an error for a rejected token")
+	}
+	if err := syncSessions(context.Background(), ts.Client(), src, "tok", insts, l); err != nil {
+		t.Fatal(err)
+	}
+	// The valid session is held for instance a; b has sessions disabled.
+	out := logs.String()
+	if !strings.Contains(out, "msg=session_sync_skipped instance=a") || !strings.Contains(out, "msg=session_sync instance=a sessions=1") {
+		t.Fatalf("logs: %s", out)
+	}
+	if strings.Contains(out, "instance=b") {
+		t.Fatalf("instance without sessions synced: %s", out)
+	}
+
+	// Imported sessions are not exported again.
+	rec := httptest.NewRecorder()
+	sessionsHandler(insts).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, sessionsPath, nil))
+	if got := strings.TrimSpace(rec.Body.String()); got != `{"instances":{"a":[],"b":null}}` {
+		t.Fatalf("export: %s", got)
+	}
+	rec = httptest.NewRecorder()
+	sessionsHandler(insts).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, sessionsPath, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST: %d", rec.Code)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// signalHooks are the actions bound to runtime control signals.
+type signalHooks struct {
+	dump   func()
+	reload func()
+}
+
+// startSignalHandlers is a no-op on platforms without SIGUSR1/SIGUSR2/SIGHUP.
+func startSignalHandlers(ctx context.Context, cfg *appConfig, l *slog.Logger, hooks signalHooks) {}
@@ -0,0 +1,62 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/kstaniek/go-ampio-server/internal/logging"
+)
+
+// signalHooks are the actions bound to runtime control signals.
+type signalHooks struct {
+	dump   func() // SIGUSR1: diagnostic snapshot
+	reload func() // SIGHUP: re-read secrets and reloadable settings
+}
+
+// startSignalHandlers installs runtime control signal handlers.
+// SIGUSR1 invokes hooks.dump, SIGHUP invokes hooks.reload and SIGUSR2
+// toggles between the configured log level and debug.
+func startSignalHandlers(ctx context.Context, cfg *appConfig, l *slog.Logger, hooks signalHooks) {
+	base, err := logging.ParseLevel(cfg.logLevel)
+	if err != nil {
+		base = slog.LevelInfo
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case s := <-ch:
+				switch s {
+				case syscall.SIGUSR1:
+					if hooks.dump != nil {
+						hooks.dump()
+					}
+				case syscall.SIGHUP:
+					if hooks.reload != nil {
+						hooks.reload()
+					}
+				case syscall.SIGUSR2:
+					prev := logging.Level()
+					next := slog.LevelDebug
+					if prev == slog.LevelDebug {
+						next = base
+						if base == slog.LevelDebug {
+							next = slog.LevelInfo
+						}
+					}
+					logging.SetLevel(next)
+					l.Log(ctx, slog.LevelWarn, "log_level_changed", "from", logging.LevelName(prev), "to", logging.LevelName(next), "source", "SIGUSR2")
+				}
+			}
+		}
+	}()
+}
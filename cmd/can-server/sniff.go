@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+// sniffedHeaderTimeout bounds how long an HTTP client on a client port may
+// take to send its request headers.
+const sniffedHeaderTimeout = 10 * time.Second
+
+// sniffedHTTP serves the HTTP requests arriving on -port-sniff client ports
+// with the metrics and admin endpoints, as on -metrics-addr. The server
+// starts with the first request, after the endpoints are registered.
+var sniffedHTTP = sync.OnceValue(func() *server.ConnListener {
+	ln := server.NewConnListener()
+	srv := &http.Server{Handler: metrics.Handler(), ReadHeaderTimeout: sniffedHeaderTimeout}
+	go func() { _ = srv.Serve(ln) }()
+	return ln
+})
+
+// protocolHandlers routes the connections of a -port-sniff client port that
+// are not cannelloni clients.
+func protocolHandlers() map[server.Protocol]func(net.Conn) {
+	return map[server.Protocol]func(net.Conn){
+		server.ProtoHTTP: func(c net.Conn) { sniffedHTTP().Deliver(c) },
+	}
+}
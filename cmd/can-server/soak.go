@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/soak"
+)
+
+// soakFlags are the -soak settings. They qualify releases on target
+// hardware rather than configure a gateway, so -help and the config file
+// template leave them out.
+var soakFlags = []string{"soak", "soak-clients", "soak-rate", "soak-interval", "soak-lifetime"}
+
+// usageWithout returns a usage function for fs that lists every flag but
+// hidden.
+func usageWithout(fs *flag.FlagSet, hidden []string) func() {
+	return func() {
+		skip := make(map[string]bool, len(hidden))
+		for _, n := range hidden {
+			skip[n] = true
+		}
+		shown := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+		shown.SetOutput(fs.Output())
+		fs.VisitAll(func(f *flag.Flag) {
+			if skip[f.Name] {
+				return
+			}
+			shown.Var(f.Value, f.Name, f.Usage)
+			shown.Lookup(f.Name).DefValue = f.DefValue
+		})
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		shown.PrintDefaults()
+	}
+}
+
+// validateSoak checks the -soak settings.
+func (c *appConfig) validateSoak() error {
+	if c.soak < 0 {
+		return fmt.Errorf("soak must be >= 0")
+	}
+	if c.soak == 0 {
+		return nil
+	}
+	if c.soakClients <= 0 {
+		return fmt.Errorf("soak-clients must be > 0")
+	}
+	if c.soakRate < 0 {
+		return fmt.Errorf("soak-rate must be >= 0")
+	}
+	if c.soakInterval < time.Second {
+		return fmt.Errorf("soak-interval must be >= 1s")
+	}
+	if c.soakLifetime < 0 {
+		return fmt.Errorf("soak-lifetime must be >= 0")
+	}
+	return nil
+}
+
+// validateSoakBackends refuses -soak on an instance with a live bus: the
+// soak clients transmit synthetic frames, which only the loopback and
+// replay backends and -tx-dry-run keep off the bus. Receive-only soaks
+// (-soak-rate 0) send nothing.
+func (c *appConfig) validateSoakBackends(insts []*appConfig) error {
+	if c.soak <= 0 || c.soakRate == 0 {
+		return nil
+	}
+	for _, ic := range insts {
+		if kind, _ := splitBackend(ic.backend); kind != "loopback" && kind != "replay" && !ic.txDryRun {
+			name := ""
+			if ic.name != "" {
+				name = " of instance " + ic.name
+			}
+			return fmt.Errorf("soak would send frames with CAN ID %08X to the %s backend%s (use loopback or replay, -tx-dry-run or -soak-rate 0)",
+				soak.CANID&can.CAN_EFF_MASK, kind, name)
+		}
+	}
+	return nil
+}
+
+// startSoak runs the -soak clients against the instance listeners once
+// they are bound. The returned channel yields the exit code when the soak
+// ends: 1 when a resource grew over a whole window. It is nil (never
+// ready) without -soak. The backends were checked by validateSoakBackends.
+func startSoak(ctx context.Context, cfg *appConfig, insts []*instance, l *slog.Logger) <-chan int {
+	if cfg.soak <= 0 {
+		return nil
+	}
+	done := make(chan int, 1)
+	go func() {
+		addrs := make([]string, 0, len(insts))
+		for _, in := range insts {
+			select {
+			case <-in.srv.Ready():
+			case <-ctx.Done():
+				return
+			}
+			addrs = append(addrs, in.srv.Addr())
+		}
+		l.Info("soak_start", "duration", cfg.soak, "clients", cfg.soakClients, "rate", cfg.soakRate,
+			"interval", cfg.soakInterval, "lifetime", cfg.soakLifetime, "window", soak.DefaultWindow)
+		sctx, cancel := context.WithTimeout(ctx, cfg.soak)
+		defer cancel()
+		rep := soak.Run(sctx, soak.Config{
+			Addrs:    addrs,
+			Clients:  cfg.soakClients,
+			Rate:     cfg.soakRate,
+			Lifetime: cfg.soakLifetime,
+			Interval: cfg.soakInterval,
+			Logger:   l,
+		})
+		if ctx.Err() != nil {
+			return // interrupted; the signal shuts down
+		}
+		grown := make([]string, 0, len(rep.Growth))
+		for _, g := range rep.Growth {
+			grown = append(grown, g.Resource)
+		}
+		l.Info("soak_done", "samples", rep.Samples, "sent", rep.Sent, "received", rep.Received, "reconnects", rep.Reconnects,
+			"errors", rep.Errors, "goroutines", fmt.Sprintf("%d->%d", rep.First.Goroutines, rep.Last.Goroutines),
+			"heap_alloc", fmt.Sprintf("%d->%d", rep.First.HeapAlloc, rep.Last.HeapAlloc),
+			"fds", fmt.Sprintf("%d->%d", rep.First.FDs, rep.Last.FDs), "growth", grown)
+		if rep.Samples < soak.DefaultWindow {
+			l.Warn("soak_too_short", "samples", rep.Samples, "window", soak.DefaultWindow)
+		}
+		if len(rep.Growth) > 0 {
+			done <- 1
+			return
+		}
+		done <- 0
+	}()
+	return done
+}
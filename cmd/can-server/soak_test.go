@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageWithout(t *testing.T) {
+	fs := flag.NewFlagSet("can-server", flag.ContinueOnError)
+	var out bytes.Buffer
+	fs.SetOutput(&out)
+	fs.String("listen", ":20000", "TCP listen address")
+	fs.Duration("soak", 0, "Soak test")
+	fs.Usage = usageWithout(fs, soakFlags)
+	if err := fs.Parse([]string{"-nope"}); err == nil {
+		t.Fatal("unknown flag accepted")
+	}
+	if s := out.String(); !strings.Contains(s, "-listen") || !strings.Contains(s, `(default ":20000")`) || strings.Contains(s, "soak") {
+		t.Fatalf("usage:\n%s", s)
+	}
+}
+
+func TestValidateSoak(t *testing.T) {
+	ok := appConfig{soak: time.Hour, soakClients: 8, soakRate: 100, soakInterval: time.Minute, soakLifetime: 30 * time.Second}
+	for _, tc := range []struct {
+		name string
+		mod  func(*appConfig)
+		ok   bool
+	}{
+		{"valid", func(*appConfig) {}, true},
+		{"off ignores the rest", func(c *appConfig) { c.soak, c.soakClients = 0, 0 }, true},
+		{"receive only", func(c *appConfig) { c.soakRate = 0 }, true},
+		{"no clients", func(c *appConfig) { c.soakClients = 0 }, false},
+		{"fast sampling", func(c *appConfig) { c.soakInterval = 100 * time.Millisecond }, false},
+		{"negative lifetime", func(c *appConfig) { c.soakLifetime = -time.Second }, false},
+	} {
+		c := ok
+		tc.mod(&c)
+		if err := c.validateSoak(); (err == nil) != tc.ok {
+			t.Fatalf("%s: err=%v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestValidateSoakBackends(t *testing.T) {
+	c := appConfig{soak: time.Hour, soakRate: 100}
+	for _, tc := range []struct {
+		name string
+		inst appConfig
+		ok   bool
+	}{
+		{"loopback", appConfig{backend: "loopback"}, true},
+		{"replay", appConfig{backend: "replay"}, true},
+		{"dry run", appConfig{backend: "serial", txDryRun: true}, true},
+		{"live bus", appConfig{backend: "serial"}, false},
+		{"live upstream", appConfig{backend: "cannelloni-tcp:gw:20000"}, false},
+	} {
+		err := c.validateSoakBackends([]*appConfig{{backend: "loopback"}, &tc.inst})
+		if (err == nil) != tc.ok {
+			t.Fatalf("%s: err=%v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+	live := []*appConfig{{backend: "socketcan"}}
+	if err := (&appConfig{soak: time.Hour}).validateSoakBackends(live); err != nil {
+		t.Fatalf("receive-only soak refused: %v", err)
+	}
+	if err := (&appConfig{soakRate: 100}).validateSoakBackends(live); err != nil {
+		t.Fatalf("no soak refused: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/capture"
+)
+
+// validateCaptureTrigger checks the -capture-trigger settings.
+func (c *appConfig) validateCaptureTrigger() error {
+	t, err := capture.ParseTrigger(c.captureTrigger)
+	if err != nil {
+		return fmt.Errorf("capture-trigger: %w", err)
+	}
+	if t == nil {
+		return nil
+	}
+	switch {
+	case c.captureSize == 0:
+		return fmt.Errorf("capture-trigger needs capture-size > 0")
+	case c.captureTrigDir == "":
+		return fmt.Errorf("capture-trigger needs capture-trigger-dir")
+	case c.captureTrigPre < 0 || c.captureTrigPost < 0 || c.captureTrigPre+c.captureTrigPost > capture.MaxWindow:
+		return fmt.Errorf("capture-trigger-pre and capture-trigger-post must be >= 0 and at most %s together", capture.MaxWindow)
+	case c.captureTrigKeep < 0:
+		return fmt.Errorf("capture-trigger-keep must be >= 0")
+	}
+	return nil
+}
+
+// startTrigger arms -capture-trigger on the instance capture ring. It
+// replaces the hub tap, so it runs before the first broadcast.
+func (in *instance) startTrigger(ctx context.Context, l *slog.Logger, wg *sync.WaitGroup) {
+	t, _ := capture.ParseTrigger(in.cfg.captureTrigger) // validated at startup
+	if t == nil || in.capture == nil {
+		return
+	}
+	tr := capture.NewTriggered(capture.TriggerConfig{
+		Trigger: t,
+		Ring:    in.capture,
+		Iface:   in.captureIface(),
+		Ifaces:  in.captureIfaces(),
+		Dir:     in.cfg.captureTrigDir,
+		Pre:     in.cfg.captureTrigPre,
+		Post:    in.cfg.captureTrigPost,
+		Keep:    in.cfg.captureTrigKeep,
+		Drops:   func() uint64 { return in.hub.Stats().Drops },
+		Logger:  l,
+	})
+	ring := in.capture
+	in.hub.Tap = func(fr can.Frame) {
+		ring.Add(fr)
+		tr.Observe(fr)
+	}
+	wg.Add(1)
+	go func() { defer wg.Done(); tr.Run(ctx) }()
+	l.Info("capture_trigger_armed", "trigger", t.String(), "dir", in.cfg.captureTrigDir, "pre", in.cfg.captureTrigPre, "post", in.cfg.captureTrigPost)
+}
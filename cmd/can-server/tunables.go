@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/access"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/instances"
+	"github.com/kstaniek/go-ampio-server/internal/logging"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+// Bounds of the runtime tunables not enforced by the hub or server.
+const (
+	maxTunableHubBuffer = 1 << 16
+	maxTunableConnRate  = 10000
+	maxTunableConnBan   = 24 * time.Hour
+)
+
+// tunables are the instance settings that can be changed without a restart.
+type tunables struct {
+	HubPolicy     string `json:"hub_policy"`
+	HubBuffer     int    `json:"hub_buffer"`
+	FlushInterval string `json:"flush_interval"`
+	BatchSize     int    `json:"batch_size"`
+	ConnRate      int    `json:"conn_rate"`
+	ConnBan       string `json:"conn_ban"`
+}
+
+// tunablesUpdate is the body of PUT /api/tunables; omitted keys are kept.
+type tunablesUpdate struct {
+	HubPolicy     *string `json:"hub_policy"`
+	HubBuffer     *int    `json:"hub_buffer"`
+	FlushInterval *string `json:"flush_interval"`
+	BatchSize     *int    `json:"batch_size"`
+	ConnRate      *int    `json:"conn_rate"`
+	ConnBan       *string `json:"conn_ban"`
+}
+
+// tunableTarget is the hub and client server of one instance.
+type tunableTarget struct {
+	name string
+	hub  *hub.Hub
+	srv  *server.Server
+}
+
+func (t tunableTarget) get() tunables {
+	rate, ban := t.srv.ConnRate()
+	return tunables{
+		HubPolicy:     t.hub.Policy().String(),
+		HubBuffer:     t.hub.OutBufSize(),
+		FlushInterval: t.srv.FlushInterval().String(),
+		BatchSize:     t.srv.BatchSize(),
+		ConnRate:      rate,
+		ConnBan:       ban.String(),
+	}
+}
+
+// tunableChange is one validated setting change. apply is nil when an
+// earlier change of the same plan sets it too (conn_rate and conn_ban).
+type tunableChange struct {
+	key, from, to string
+	apply         func() error
+}
+
+// plan validates u against the current settings and returns the changes it
+// makes. Nothing is applied when any value is out of bounds.
+func (t tunableTarget) plan(u tunablesUpdate) ([]tunableChange, error) {
+	cur := t.get()
+	var out []tunableChange
+	add := func(key string, from, to any, apply func() error) bool {
+		f, n := fmt.Sprint(from), fmt.Sprint(to)
+		if f == n {
+			return false
+		}
+		out = append(out, tunableChange{key: key, from: f, to: n, apply: apply})
+		return true
+	}
+	if u.HubPolicy != nil {
+		p, err := hub.ParsePolicy(*u.HubPolicy)
+		if err != nil {
+			return nil, err
+		}
+		add("hub_policy", cur.HubPolicy, p, func() error { return t.hub.SetPolicy(p) })
+	}
+	if u.HubBuffer != nil {
+		n := *u.HubBuffer
+		if n <= 0 || n > maxTunableHubBuffer {
+			return nil, fmt.Errorf("hub_buffer must be in [1, %d] (got %d)", maxTunableHubBuffer, n)
+		}
+		add("hub_buffer", cur.HubBuffer, n, func() error { return t.hub.SetOutBufSize(n) })
+	}
+	if u.FlushInterval != nil {
+		d, err := time.ParseDuration(*u.FlushInterval)
+		if err != nil {
+			return nil, fmt.Errorf("flush_interval: %w", err)
+		}
+		if d <= 0 || d > server.MaxFlushInterval {
+			return nil, fmt.Errorf("flush_interval must be in (0, %v] (got %v)", server.MaxFlushInterval, d)
+		}
+		add("flush_interval", cur.FlushInterval, d, func() error { return t.srv.SetFlushInterval(d) })
+	}
+	if u.BatchSize != nil {
+		n := *u.BatchSize
+		if n <= 0 || n > server.MaxBatchSize {
+			return nil, fmt.Errorf("batch_size must be in [1, %d] (got %d)", server.MaxBatchSize, n)
+		}
+		add("batch_size", cur.BatchSize, n, func() error { return t.srv.SetBatchSize(n) })
+	}
+	if u.ConnRate != nil || u.ConnBan != nil {
+		rate, ban := t.srv.ConnRate()
+		if u.ConnRate != nil {
+			if rate = *u.ConnRate; rate < 0 || rate > maxTunableConnRate {
+				return nil, fmt.Errorf("conn_rate must be in [0, %d] (got %d)", maxTunableConnRate, rate)
+			}
+		}
+		if u.ConnBan != nil {
+			d, err := time.ParseDuration(*u.ConnBan)
+			if err != nil {
+				return nil, fmt.Errorf("conn_ban: %w", err)
+			}
+			if d <= 0 || d > maxTunableConnBan {
+				return nil, fmt.Errorf("conn_ban must be in (0, %v] (got %v)", maxTunableConnBan, d)
+			}
+			ban = d
+		}
+		apply := func() error { return t.srv.SetConnRate(rate, ban) }
+		if add("conn_rate", cur.ConnRate, rate, apply) {
+			apply = nil
+		}
+		add("conn_ban", cur.ConnBan, ban, apply)
+	}
+	return out, nil
+}
+
+// tunablesHandler serves /api/tunables. targets maps instance names to
+// their hub and server; ?instance= selects one and may be omitted when
+// there is only one.
+//
+//	GET                                   -> current settings
+//	PUT/POST {"batch_size":128,...}       -> apply, return the new settings
+//
+// Every change is logged as tunable_changed with the caller identity. A
+// body with any invalid value changes nothing.
+func tunablesHandler(targets map[string]tunableTarget) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, err := instances.Pick(targets, r.URL.Query().Get("instance"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var u tunablesUpdate
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&u); err != nil {
+				http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			changes, err := t.plan(u)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			who := "anonymous"
+			if id, ok := access.FromContext(r.Context()); ok {
+				who = id.Name
+			}
+			for _, c := range changes {
+				if c.apply != nil {
+					if err := c.apply(); err != nil {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+						return
+					}
+				}
+				logging.L().Info("tunable_changed", "instance", t.name, "key", c.key, "from", c.from, "to", c.to, "identity", who)
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(t.get())
+	})
+}
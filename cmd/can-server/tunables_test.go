@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+func TestTunablesHandler(t *testing.T) {
+	h, _ := hub.NewWithOptions(hub.WithOutBufSize(64))
+	srv := server.NewServer(server.WithConnRate(0, 5*time.Minute))
+	handler := tunablesHandler(map[string]tunableTarget{"": {hub: h, srv: srv}})
+	do := func(method, body string) (*httptest.ResponseRecorder, tunables) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/api/tunables", strings.NewReader(body)))
+		var got tunables
+		if rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec, got
+	}
+
+	rec, got := do(http.MethodGet, "")
+	if rec.Code != http.StatusOK || got.HubPolicy != "drop" || got.HubBuffer != 64 || got.BatchSize != 64 || got.ConnBan != "5m0s" {
+		t.Fatalf("GET: %d %+v", rec.Code, got)
+	}
+	rec, got = do(http.MethodPut, `{"hub_policy":"kick","hub_buffer":1024,"flush_interval":"10ms","batch_size":128,"conn_rate":30}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", rec.Code, rec.Body)
+	}
+	want := tunables{HubPolicy: "kick", HubBuffer: 1024, FlushInterval: "10ms", BatchSize: 128, ConnRate: 30, ConnBan: "5m0s"}
+	if got != want {
+		t.Fatalf("PUT: got %+v want %+v", got, want)
+	}
+	if h.Policy() != hub.PolicyKick || srv.BatchSize() != 128 || srv.FlushInterval() != 10*time.Millisecond {
+		t.Fatal("settings not applied")
+	}
+
+	// One value out of bounds rejects the whole update.
+	for _, body := range []string{
+		`{"batch_size":64,"flush_interval":"1h"}`,
+		`{"batch_size":64,"hub_buffer":0}`,
+		`{"hub_policy":"bogus"}`,
+		`{"conn_ban":"48h"}`,
+		`{"unknown":1}`,
+	} {
+		if rec, _ := do(http.MethodPut, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d want 400", body, rec.Code)
+		}
+	}
+	if srv.BatchSize() != 128 {
+		t.Fatalf("rejected update changed batch size to %d", srv.BatchSize())
+	}
+	if rec, _ := do(http.MethodDelete, ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("DELETE: %d", rec.Code)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+	"github.com/kstaniek/go-ampio-server/internal/vbus"
+)
+
+// vbusConfig is one [vbus.<name>] section: a virtual bus carved out of the
+// physical bus of an instance, with its own listener and clients.
+type vbusConfig struct {
+	name       string
+	instance   string // parent instance; "" in single-instance mode
+	listen     string
+	ids        string // physical IDs the bus receives and may send
+	txIDs      string // narrower TX set; empty: ids
+	txRate     float64
+	txBurst    int
+	maxClients int
+}
+
+// bindVBusFlags registers the keys of a [vbus.<name>] section on fs.
+func bindVBusFlags(fs *flag.FlagSet, v *vbusConfig) {
+	fs.StringVar(&v.instance, "instance", v.instance, "")
+	fs.StringVar(&v.listen, "listen", v.listen, "")
+	fs.StringVar(&v.ids, "ids", v.ids, "")
+	fs.StringVar(&v.txIDs, "tx-ids", v.txIDs, "")
+	fs.Float64Var(&v.txRate, "tx-rate", v.txRate, "")
+	fs.IntVar(&v.txBurst, "tx-burst", v.txBurst, "")
+	fs.IntVar(&v.maxClients, "max-clients", v.maxClients, "")
+}
+
+// vbusConfigs parses the [vbus.*] sections against the instance configs
+// insts (see instanceConfigs). Listen addresses must differ from each other
+// and from the instance listeners.
+func (c *appConfig) vbusConfigs(insts []*appConfig) ([]*vbusConfig, error) {
+	if len(c.vbuses) == 0 {
+		return nil, nil
+	}
+	parents := make(map[string]bool, len(insts))
+	listens := make(map[string]string)
+	for _, ic := range insts {
+		parents[ic.name] = true
+		listens[normalizeListen(ic.listenAddr)] = "instance " + ic.name
+	}
+	out := make([]*vbusConfig, 0, len(c.vbuses))
+	for _, sec := range c.vbuses {
+		v := &vbusConfig{name: sec.name}
+		fs := flag.NewFlagSet(sec.name, flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		bindVBusFlags(fs, v)
+		keys := make([]string, 0, len(sec.values))
+		for k := range sec.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if fs.Lookup(k) == nil {
+				return nil, fmt.Errorf("vbus %s: unknown key %q", sec.name, k)
+			}
+			if err := fs.Set(k, sec.values[k]); err != nil {
+				return nil, fmt.Errorf("vbus %s: %s: %w", sec.name, k, err)
+			}
+		}
+		if !parents[v.instance] {
+			if v.instance == "" {
+				return nil, fmt.Errorf("vbus %s: instance is required with [instance.*] sections", sec.name)
+			}
+			return nil, fmt.Errorf("vbus %s: unknown instance %q", sec.name, v.instance)
+		}
+		if v.listen == "" || v.ids == "" {
+			return nil, fmt.Errorf("vbus %s: listen and ids are required", sec.name)
+		}
+		if _, err := v.config(); err != nil {
+			return nil, fmt.Errorf("vbus %s: %w", sec.name, err)
+		}
+		if v.txRate < 0 || v.txBurst < 0 || v.maxClients < 0 {
+			return nil, fmt.Errorf("vbus %s: tx-rate, tx-burst and max-clients must be >= 0", sec.name)
+		}
+		key := normalizeListen(v.listen)
+		if prev, dup := listens[key]; dup {
+			return nil, fmt.Errorf("vbus %s: listen %s already used by %s", sec.name, v.listen, prev)
+		}
+		listens[key] = "vbus " + sec.name
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// config builds the vbus.Config of v.
+func (v *vbusConfig) config() (vbus.Config, error) {
+	rx, err := filter.New(v.ids, "")
+	if err != nil {
+		return vbus.Config{}, fmt.Errorf("ids: %w", err)
+	}
+	tx := rx
+	if v.txIDs != "" {
+		if tx, err = filter.New(v.txIDs, ""); err != nil {
+			return vbus.Config{}, fmt.Errorf("tx-ids: %w", err)
+		}
+	}
+	return vbus.Config{Name: v.name, RX: rx, TX: tx, TxRate: v.txRate, TxBurst: v.txBurst}, nil
+}
+
+// virtualBus is a running virtual bus and its client listener.
+type virtualBus struct {
+	*vbus.Bus
+	cfg *vbusConfig
+	srv *server.Server
+}
+
+// startVBuses starts the configured virtual buses on top of the running
+// instances. Each bus gets a hub fed from its instance hub and a TCP server
+// with the instance client settings, whose transmit path goes through the
+// bus checks to the instance backend. fail is invoked if a listener dies.
+func startVBuses(ctx context.Context, cfg *appConfig, insts []*instance, l *slog.Logger, wg *sync.WaitGroup, fail func()) ([]*virtualBus, error) {
+	cfgs := make([]*appConfig, len(insts))
+	byName := make(map[string]*instance, len(insts))
+	for i, in := range insts {
+		cfgs[i] = in.cfg
+		byName[in.name] = in
+	}
+	vcs, err := cfg.vbusConfigs(cfgs)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*virtualBus, 0, len(vcs))
+	for _, vc := range vcs {
+		in := byName[vc.instance]
+		bl := l.With("vbus", vc.name)
+		bc, _ := vc.config() // validated with the config
+		h, err := initHub(in.cfg, bl)
+		if err != nil {
+			return nil, err
+		}
+		h.StartWorkers(ctx, in.cfg.hubWorkers)
+		vb := &virtualBus{Bus: vbus.New(bc, h), cfg: vc}
+		ident := in.cfg.identity()
+		ident.Bus = vc.name
+		opts := append(clientServerOptions(in.cfg, bl),
+			server.WithIdent(ident),
+			server.WithHub(h),
+			server.WithSend(vb.Send(in.tx.send)),
+			server.WithSendWait(vb.SendWait(in.tx.wait)),
+			server.WithMaxClients(vc.maxClients),
+		)
+		vb.srv = server.NewServer(opts...)
+		vb.srv.SetListenAddr(vc.listen)
+		if err := metrics.RegisterInstance("vbus:"+vc.name, vb.sample); err != nil {
+			return nil, err
+		}
+		wg.Add(1)
+		go func() { defer wg.Done(); vb.Run(ctx, in.hub) }()
+		go func() {
+			if err := vb.srv.Serve(ctx); err != nil {
+				bl.Error("tcp_server_error", "error", err)
+				fail()
+			}
+		}()
+		bl.Info("vbus_started", "instance", vc.instance, "listen", vc.listen, "ids", vc.ids, "tx_ids", bc.TX.String(),
+			"tx_rate", vc.txRate, "max_clients", vc.maxClients)
+		out = append(out, vb)
+	}
+	return out, nil
+}
+
+// sample reports the bus counters as instance "vbus:<name>" series.
+func (vb *virtualBus) sample() metrics.InstanceSample {
+	hs := vb.Hub().Stats()
+	ss := vb.srv.Stats()
+	bs := vb.Stats()
+	return metrics.InstanceSample{
+		RxFrames:        bs.RxFrames,
+		TxFrames:        bs.TxFrames,
+		HubDrops:        hs.Drops,
+		HubKicks:        hs.Kicks,
+		Clients:         hs.Clients,
+		Accepted:        ss.Accepted,
+		BackendOverflow: ss.BackendOverflow,
+		BackendErrors:   ss.BackendErrors,
+	}
+}
+
+// ready reports whether the bus listener is bound.
+func (vb *virtualBus) ready() bool {
+	select {
+	case <-vb.srv.Ready():
+		return true
+	default:
+		return false
+	}
+}
+
+// vbusInfo is one entry of GET /api/vbus.
+type vbusInfo struct {
+	Name     string     `json:"name"`
+	Instance string     `json:"instance,omitempty"`
+	Listen   string     `json:"listen"`
+	IDs      string     `json:"ids"`
+	TxIDs    string     `json:"tx_ids,omitempty"`
+	TxRate   float64    `json:"tx_rate,omitempty"`
+	Clients  int        `json:"clients"`
+	Stats    vbus.Stats `json:"stats"`
+}
+
+// vbusHandler serves GET /api/vbus: the virtual buses with their counters.
+func vbusHandler(vbs []*virtualBus) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		out := make([]vbusInfo, 0, len(vbs))
+		for _, vb := range vbs {
+			out = append(out, vbusInfo{
+				Name: vb.Name(), Instance: vb.cfg.instance, Listen: vb.srv.Addr(), IDs: vb.cfg.ids, TxIDs: vb.cfg.txIDs,
+				TxRate: vb.cfg.txRate, Clients: vb.Hub().Count(), Stats: vb.Stats(),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestVBusConfigs(t *testing.T) {
+	fs := flag.NewFlagSet("t", flag.ContinueOnError)
+	fs.String("listen", ":20000", "")
+	body := "listen = :20000\n\n[vbus.team-a]\nlisten = :21000\nids = 0x100-0x1FF\ntx-ids = 0x180-0x1FF\ntx-rate = 50\n\n[vbus.team-b]\nlisten = :21001\nids = 0x200/0x700\n"
+	fc, err := applyConfigFile(fs, writeConf(t, body), nil)
+	if err != nil {
+		t.Fatalf("applyConfigFile: %v", err)
+	}
+	base := baseInstanceConfig()
+	base.vbuses = fc.vbuses
+	out, err := base.vbusConfigs([]*appConfig{&base})
+	if err != nil {
+		t.Fatalf("vbusConfigs: %v", err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected 2 virtual buses, got %d", len(out))
+	}
+	a := out[0]
+	if a.name != "team-a" || a.listen != ":21000" || a.txRate != 50 || a.instance != "" {
+		t.Fatalf("vbus team-a: %+v", a)
+	}
+	bc, err := a.config()
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	if bc.RX == bc.TX {
+		t.Fatal("tx-ids not applied")
+	}
+}
+
+func TestVBusConfigs_Errors(t *testing.T) {
+	named := baseInstanceConfig()
+	named.name = "a"
+	for name, tc := range map[string]struct {
+		insts []*appConfig
+		vals  map[string]string
+		want  string
+	}{
+		"unknownKey":      {vals: map[string]string{"listen": ":21000", "ids": "0x100", "backend": "loopback"}, want: `unknown key "backend"`},
+		"missingIDs":      {vals: map[string]string{"listen": ":21000"}, want: "listen and ids are required"},
+		"badIDs":          {vals: map[string]string{"listen": ":21000", "ids": "zz"}, want: "ids:"},
+		"listenTaken":     {vals: map[string]string{"listen": "0.0.0.0:20000", "ids": "0x100"}, want: "already used by instance"},
+		"negativeRate":    {vals: map[string]string{"listen": ":21000", "ids": "0x100", "tx-rate": "-1"}, want: "must be >= 0"},
+		"unknownInstance": {vals: map[string]string{"listen": ":21000", "ids": "0x100", "instance": "x"}, want: `unknown instance "x"`},
+		"needsInstance":   {insts: []*appConfig{&named}, vals: map[string]string{"listen": ":21000", "ids": "0x100"}, want: "instance is required"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := baseInstanceConfig()
+			c.vbuses = []instanceSection{{name: "v", values: tc.vals}}
+			insts := tc.insts
+			if insts == nil {
+				insts = []*appConfig{&c}
+			}
+			if _, err := c.vbusConfigs(insts); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("err = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// minWatchdogTick bounds how often the RX watchdog samples the hub.
+const minWatchdogTick = 10 * time.Millisecond
+
+// backendLinkUp reports whether the backend device claims to be up: the
+// SocketCAN interfaces are administratively up, the serial device node
+// exists. Other backends have no link state. A var for tests.
+var backendLinkUp = func(cfg *appConfig) bool {
+	switch kind, _ := splitBackend(cfg.backend); kind {
+	case "socketcan":
+		for _, iface := range cfg.canIfaces() {
+			if ifi, err := net.InterfaceByName(iface); err != nil || ifi.Flags&net.FlagUp == 0 {
+				return false
+			}
+		}
+		return true
+	case "serial", "slcan":
+		_, err := os.Stat(cfg.serialDev)
+		return err == nil
+	}
+	return true
+}
+
+// rxWatchdog owns an opened backend and watches its RX loops. When a loop
+// completed no read cycle for -rx-watchdog while the device claims to be
+// up, it logs backend_rx_stalled and, with -rx-watchdog-restart, closes and
+// reopens the backend. The transmit path follows the reopened backend.
+type rxWatchdog struct {
+	cfg *appConfig
+	h   *hub.Hub
+	l   *slog.Logger
+	wg  *sync.WaitGroup
+
+	cur     atomic.Pointer[backendTx]
+	live    atomic.Pointer[rxLiveness] // RX loops of cur
+	stop    context.CancelFunc         // cancels the RX loop and writer of cur
+	cleanup func()
+}
+
+// rxLivenessKey carries the rxLiveness of a watched backend in the context
+// its RX loops run with.
+type rxLivenessKey struct{}
+
+// rxLiveness collects the RX loops of one opened backend. A read loop is
+// alive while it keeps completing read cycles: a read that returned a
+// frame, or returned idle after the read timeout of the loop, which is
+// below the watchdog window. A quiet bus is therefore not a stall; a loop
+// stuck in a read, failing every read or ended is.
+type rxLiveness struct {
+	idle time.Duration // read timeout for loops that would block on a quiet bus
+
+	mu    sync.Mutex
+	loops []*rxBeat
+}
+
+func (lv *rxLiveness) snapshot() []*rxBeat {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	return slices.Clone(lv.loops)
+}
+
+// rxBeat counts the completed read cycles of one RX loop. A nil *rxBeat,
+// for a backend without a watchdog, ignores beats.
+type rxBeat struct {
+	n    atomic.Uint64
+	idle time.Duration
+}
+
+// rxLoopBeat registers an RX loop with the watchdog of ctx.
+func rxLoopBeat(ctx context.Context) *rxBeat {
+	lv, _ := ctx.Value(rxLivenessKey{}).(*rxLiveness)
+	if lv == nil {
+		return nil
+	}
+	b := &rxBeat{idle: lv.idle}
+	lv.mu.Lock()
+	lv.loops = append(lv.loops, b)
+	lv.mu.Unlock()
+	return b
+}
+
+func (b *rxBeat) beat() {
+	if b != nil {
+		b.n.Add(1)
+	}
+}
+
+// readTimeout returns how long a read of the loop may block on a quiet
+// bus before it returns idle and beats; 0 without a watchdog.
+func (b *rxBeat) readTimeout() time.Duration {
+	if b == nil {
+		return 0
+	}
+	return b.idle
+}
+
+// watchBackend opens the backend under an RX watchdog. The returned
+// cleanup stops the watchdog before closing the current backend.
+func watchBackend(ctx context.Context, cfg *appConfig, h *hub.Hub, l *slog.Logger, wg *sync.WaitGroup) (backendTx, func(), error) {
+	w := &rxWatchdog{cfg: cfg, h: h, l: l, wg: wg}
+	if err := w.open(ctx); err != nil {
+		return backendTx{}, func() {}, err
+	}
+	l.Info("backend_rx_watchdog", "window", cfg.rxWatchdog, "restart", cfg.rxWatchdogRestart)
+	wctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		w.run(wctx)
+	}()
+	tx := backendTx{
+		send:     func(fr can.Frame) error { return w.cur.Load().send(fr) },
+		sendWait: func(ctx context.Context, fr can.Frame) error { return w.cur.Load().wait(ctx, fr) },
+		queue: func() (int, int) {
+			if q := w.cur.Load().queue; q != nil {
+				return q()
+			}
+			return 0, 0
+		},
+	}
+	return tx, func() { cancel(); <-done; w.close() }, nil
+}
+
+func (w *rxWatchdog) open(ctx context.Context) error {
+	live := &rxLiveness{idle: w.tick()}
+	bctx, cancel := context.WithCancel(context.WithValue(ctx, rxLivenessKey{}, live))
+	tx, cleanup, err := openBackend(bctx, w.cfg, w.h, w.l, w.wg)
+	if err != nil {
+		cancel()
+		return err
+	}
+	w.cur.Store(&tx)
+	w.live.Store(live)
+	w.stop, w.cleanup = cancel, cleanup
+	return nil
+}
+
+// close stops the RX loop before closing the device, so the loop sees the
+// cancelled context instead of reporting read errors.
+func (w *rxWatchdog) close() {
+	w.stop()
+	w.cleanup()
+	w.stop, w.cleanup = func() {}, func() {}
+}
+
+// tick is how often the watchdog samples the RX loops.
+func (w *rxWatchdog) tick() time.Duration { return max(w.cfg.rxWatchdog/4, minWatchdogTick) }
+
+func (w *rxWatchdog) run(ctx context.Context) {
+	window := w.cfg.rxWatchdog
+	t := time.NewTicker(w.tick())
+	defer t.Stop()
+	type loopState struct {
+		n     uint64
+		since time.Time // last read cycle seen
+	}
+	seen := make(map[*rxBeat]loopState)
+	stalled := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		now := time.Now()
+		var idle time.Duration // of the least lively loop
+		for _, b := range w.live.Load().snapshot() {
+			n := b.n.Load()
+			st, ok := seen[b]
+			if !ok || n != st.n {
+				seen[b] = loopState{n, now}
+				continue
+			}
+			idle = max(idle, now.Sub(st.since))
+		}
+		switch {
+		case idle < window:
+			if stalled && idle == 0 {
+				w.l.Info("backend_rx_recovered", "backend", w.cfg.backend)
+				stalled = false
+			}
+		case !backendLinkUp(w.cfg):
+			clear(seen) // a link that is down is not a stalled loop
+		case !stalled:
+			metrics.IncBackendRxStall()
+			w.l.Warn("backend_rx_stalled", "backend", w.cfg.backend, "idle", idle.Round(time.Millisecond),
+				"restart", w.cfg.rxWatchdogRestart)
+			if !w.cfg.rxWatchdogRestart {
+				stalled = true
+				continue
+			}
+			w.restart(ctx)
+			clear(seen)
+		}
+	}
+}
+
+// restart closes and reopens the backend. When reopening fails the
+// transmit path keeps failing on the closed device until the next attempt,
+// one window later.
+func (w *rxWatchdog) restart(ctx context.Context) {
+	w.close()
+	metrics.IncBackendRestart()
+	if err := w.open(ctx); err != nil {
+		metrics.IncError(metrics.ErrBackendRestart)
+		w.l.Error("backend_restart_failed", "backend", w.cfg.backend, "error", err)
+		return
+	}
+	w.l.Warn("backend_restarted", "backend", w.cfg.backend)
+}
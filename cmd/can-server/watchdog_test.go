@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/serial"
+)
+
+// wedgedSerialPort is a serial port whose reads hang until it is closed,
+// like a wedged USB adapter.
+type wedgedSerialPort struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (p *wedgedSerialPort) Read([]byte) (int, error) {
+	<-p.closed
+	return 0, os.ErrClosed
+}
+func (p *wedgedSerialPort) Write(b []byte) (int, error) { return len(b), nil }
+func (p *wedgedSerialPort) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+// TestRxWatchdogRestart checks that a serial backend whose reads hang is
+// reported stalled and reopened, and that TX follows the reopened port.
+func TestRxWatchdogRestart(t *testing.T) {
+	dev := filepath.Join(t.TempDir(), "ttyUSB0")
+	if err := os.WriteFile(dev, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var opens atomic.Int32
+	openSerialPort = func(string, int, time.Duration) (serial.Port, error) {
+		opens.Add(1)
+		return &wedgedSerialPort{closed: make(chan struct{})}, nil
+	}
+	defer func() { openSerialPort = serial.Open }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	cfg := &appConfig{backend: "serial", serialDev: dev, rxWatchdog: 40 * time.Millisecond, rxWatchdogRestart: true}
+	stalls, restarts := metrics.Snap().BackendRxStalls, metrics.Snap().BackendRestarts
+	tx, cleanup, err := watchBackend(ctx, cfg, hub.New(), slog.New(slog.NewTextHandler(io.Discard, nil)), &wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for opens.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := opens.Load(); n < 3 {
+		t.Fatalf("opens = %d, want >= 3", n)
+	}
+	if err := tx.send(can.Frame{CANID: 0x123, Len: 1}); err != nil {
+		t.Fatalf("send after restart: %v", err)
+	}
+	s := metrics.Snap()
+	if s.BackendRxStalls-stalls < 2 || s.BackendRestarts-restarts < 2 {
+		t.Fatalf("stalls %d restarts %d, want >= 2 each", s.BackendRxStalls-stalls, s.BackendRestarts-restarts)
+	}
+	cleanup()
+	cancel()
+	wg.Wait()
+}
+
+// TestRxWatchdogQuietBus checks that reads returning idle at the read
+// timeout keep the loop alive: a quiet bus is not a stall.
+func TestRxWatchdogQuietBus(t *testing.T) {
+	dev := filepath.Join(t.TempDir(), "ttyUSB0")
+	if err := os.WriteFile(dev, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var opens atomic.Int32
+	openSerialPort = func(string, int, time.Duration) (serial.Port, error) {
+		opens.Add(1)
+		return &fakeSerialPort{}, nil // EOF every 10ms, as at the read timeout
+	}
+	defer func() { openSerialPort = serial.Open }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	cfg := &appConfig{backend: "serial", serialDev: dev, rxWatchdog: 40 * time.Millisecond, rxWatchdogRestart: true}
+	stalls := metrics.Snap().BackendRxStalls
+	_, cleanup, err := watchBackend(ctx, cfg, hub.New(), slog.New(slog.NewTextHandler(io.Discard, nil)), &wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	cleanup()
+	if n, d := opens.Load(), metrics.Snap().BackendRxStalls-stalls; n != 1 || d != 0 {
+		t.Fatalf("opens = %d, stalls = %d on a quiet bus; want 1, 0", n, d)
+	}
+	cancel()
+	wg.Wait()
+}
+
+// TestRxWatchdogLinkDown checks that a missing device is not a stall.
+func TestRxWatchdogLinkDown(t *testing.T) {
+	var opens atomic.Int32
+	openSerialPort = func(string, int, time.Duration) (serial.Port, error) {
+		opens.Add(1)
+		return &fakeSerialPort{}, nil
+	}
+	defer func() { openSerialPort = serial.Open }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	cfg := &appConfig{backend: "serial", serialDev: filepath.Join(t.TempDir(), "gone"), rxWatchdog: 20 * time.Millisecond, rxWatchdogRestart: true}
+	_, cleanup, err := watchBackend(ctx, cfg, hub.New(), slog.New(slog.NewTextHandler(io.Discard, nil)), &wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	cleanup()
+	if n := opens.Load(); n != 1 {
+		t.Fatalf("opens = %d, want 1 while the device is missing", n)
+	}
+	cancel()
+	wg.Wait()
+}
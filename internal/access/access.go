@@ -0,0 +1,113 @@
+// Package access implements the role model of the gateway. Every caller,
+// a TCP client or an admin API request, is resolved to an Identity whose
+// Role decides which permissions it has:
+//
+//	read   view: receive bus frames, read status endpoints
+//	write  read + send: transmit frames
+//	admin  write + filters, capture, manage: change TX gates and filters,
+//	       download captures and history, change runtime settings
+//
+// API identities come from bearer tokens (see Table); TCP clients are
+// identified by their network address (see Nets).
+package access
+
+import (
+	"fmt"
+
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// Role is a set of permissions.
+type Role uint8
+
+const (
+	None Role = iota // no access; connections are refused
+	Read
+	Write
+	Admin
+)
+
+var roleNames = [...]string{None: "none", Read: "read", Write: "write", Admin: "admin"}
+
+func (r Role) String() string {
+	if int(r) < len(roleNames) {
+		return roleNames[r]
+	}
+	return fmt.Sprintf("role(%d)", uint8(r))
+}
+
+// ParseRole converts "none", "read", "write" or "admin" to a Role.
+func ParseRole(s string) (Role, error) {
+	for r, n := range roleNames {
+		if s == n {
+			return Role(r), nil
+		}
+	}
+	return None, fmt.Errorf("unknown role %q (want read|write|admin|none)", s)
+}
+
+// Perm is one permission checked by the server or the admin API.
+type Perm uint8
+
+const (
+	View    Perm = iota // receive frames, read status
+	Send                // transmit frames to the bus
+	Filters             // change what may reach the bus (filters, TX inhibit)
+	Capture             // download captures and stored history
+	Manage              // change runtime settings (log level, tunables)
+)
+
+var permNames = [...]string{View: "view", Send: "send", Filters: "filters", Capture: "capture", Manage: "manage"}
+
+func (p Perm) String() string {
+	if int(p) < len(permNames) {
+		return permNames[p]
+	}
+	return fmt.Sprintf("perm(%d)", uint8(p))
+}
+
+func perms(ps ...Perm) uint32 {
+	var m uint32
+	for _, p := range ps {
+		m |= 1 << p
+	}
+	return m
+}
+
+var grants = [...]uint32{
+	None:  0,
+	Read:  perms(View),
+	Write: perms(View, Send),
+	Admin: perms(View, Send, Filters, Capture, Manage),
+}
+
+// Can reports whether r grants p.
+func (r Role) Can(p Perm) bool {
+	return int(r) < len(grants) && grants[r]&(1<<p) != 0
+}
+
+// Identity is an authenticated caller.
+type Identity struct {
+	Name string
+	Role Role
+}
+
+// Check returns an error when id lacks p and counts the denial in
+// access_denied_total.
+func (id Identity) Check(p Perm) error {
+	if id.Role.Can(p) {
+		return nil
+	}
+	metrics.IncAccessDenied(p.String())
+	return &DeniedError{ID: id, Perm: p}
+}
+
+// DeniedError reports a permission the caller's role does not grant.
+type DeniedError struct {
+	ID   Identity
+	Perm Perm
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("access denied: %s (role %s) may not %s", e.ID.Name, e.ID.Role, e.Perm)
+}
@@ -0,0 +1,146 @@
+package access
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/secret"
+)
+
+func TestRoleGrants(t *testing.T) {
+	for _, tc := range []struct {
+		role Role
+		can  []Perm
+		not  []Perm
+	}{
+		{None, nil, []Perm{View, Send}},
+		{Read, []Perm{View}, []Perm{Send, Filters, Capture, Manage}},
+		{Write, []Perm{View, Send}, []Perm{Filters, Capture, Manage}},
+		{Admin, []Perm{View, Send, Filters, Capture, Manage}, nil},
+	} {
+		for _, p := range tc.can {
+			if !tc.role.Can(p) {
+				t.Errorf("%s cannot %s", tc.role, p)
+			}
+		}
+		for _, p := range tc.not {
+			if tc.role.Can(p) {
+				t.Errorf("%s can %s", tc.role, p)
+			}
+		}
+	}
+	if _, err := ParseRole("root"); err == nil {
+		t.Fatal("want error for unknown role")
+	}
+}
+
+func TestTableRequire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access")
+	body := "# name role token\nops admin s3cret-ops\ndash read r3ad-only  # dashboards\nbot write wr1te\n"
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tab := NewTable(secret.Literal("legacy"))
+	if err := tab.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	h := tab.RequireMethod(View, Filters, ok)
+	for _, tc := range []struct {
+		method, token string
+		want          int
+	}{
+		{http.MethodGet, "", http.StatusUnauthorized},
+		{http.MethodGet, "nope", http.StatusUnauthorized},
+		{http.MethodGet, "r3ad-only", http.StatusOK},
+		{http.MethodPost, "r3ad-only", http.StatusForbidden},
+		{http.MethodPost, "wr1te", http.StatusForbidden},
+		{http.MethodPost, "s3cret-ops", http.StatusOK},
+		{http.MethodPost, "legacy", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, "/api/tx-inhibit", nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s with %q: got %d want %d", tc.method, tc.token, rec.Code, tc.want)
+		}
+	}
+	if id, ok := tab.Lookup("wr1te"); !ok || id.Name != "bot" || id.Role != Write {
+		t.Fatalf("Lookup = %+v, %v", id, ok)
+	}
+
+	// A broken file keeps the previous identities.
+	_ = os.WriteFile(path, []byte("ops superuser x\n"), 0o600)
+	if err := tab.Reload(); err == nil {
+		t.Fatal("want error for an unknown role")
+	}
+	if _, ok := tab.Lookup("r3ad-only"); !ok {
+		t.Fatal("identities lost after a failed reload")
+	}
+}
+
+func TestTableQueryToken(t *testing.T) {
+	tab := NewTable(secret.Literal("s3cret"))
+	h := tab.Require(View, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tc := range []struct {
+		upgrade string
+		want    int
+	}{
+		{"websocket", http.StatusOK},
+		// Outside WebSocket upgrades the token only travels in the header.
+		{"", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/ws?access_token=s3cret", nil)
+		req.Header.Set("Upgrade", tc.upgrade)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("upgrade %q: got %d want %d", tc.upgrade, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestNetsIdentify(t *testing.T) {
+	n, err := ParseNets("192.168.1.10=admin, 192.168.0.0/16=write, ::1=none", Read)
+	if err != nil {
+		t.Fatalf("ParseNets: %v", err)
+	}
+	for _, tc := range []struct {
+		ip   string
+		want Role
+	}{
+		{"192.168.1.10", Admin},
+		{"192.168.7.7", Write},
+		{"10.0.0.1", Read},
+		{"::1", None},
+		{"::ffff:192.168.7.7", Write},
+	} {
+		if id := n.Identify(&net.TCPAddr{IP: net.ParseIP(tc.ip), Port: 20000}); id.Role != tc.want {
+			t.Errorf("%s: role %s, want %s", tc.ip, id.Role, tc.want)
+		}
+	}
+	if _, err := ParseNets("10.0.0.0/8=boss", Read); err == nil {
+		t.Fatal("want error for an unknown role")
+	}
+}
+
+func TestRequireAttachesIdentity(t *testing.T) {
+	tab := NewTable(secret.Literal("s3cret"))
+	var got Identity
+	h := tab.Require(View, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = FromContext(r.Context())
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/tunables", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got.Name != "admin" || got.Role != Admin {
+		t.Fatalf("identity = %+v", got)
+	}
+}
@@ -0,0 +1,67 @@
+package access
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+type netRule struct {
+	prefix netip.Prefix
+	role   Role
+}
+
+// Nets assigns roles to TCP clients by remote address: the first matching
+// prefix wins, other clients get the default role.
+type Nets struct {
+	rules []netRule
+	def   Role
+}
+
+// ParseNets parses a comma separated list of "<cidr|ip>=<role>" rules.
+func ParseNets(spec string, def Role) (*Nets, error) {
+	n := &Nets{def: def}
+	for _, e := range strings.Split(spec, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		cidr, rs, ok := strings.Cut(e, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: want <cidr>=<role>", e)
+		}
+		role, err := ParseRole(strings.TrimSpace(rs))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", e, err)
+		}
+		cidr = strings.TrimSpace(cidr)
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			a, aerr := netip.ParseAddr(cidr)
+			if aerr != nil {
+				return nil, fmt.Errorf("%q: %w", e, err)
+			}
+			p = netip.PrefixFrom(a, a.BitLen())
+		}
+		n.rules = append(n.rules, netRule{prefix: p.Masked(), role: role})
+	}
+	return n, nil
+}
+
+// Identify returns the identity of a client at addr, named after the rule
+// that matched ("default" when none did).
+func (n *Nets) Identify(addr net.Addr) Identity {
+	if n == nil {
+		return Identity{Name: "default", Role: Write}
+	}
+	if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+		a := ap.Addr().Unmap()
+		for _, r := range n.rules {
+			if r.prefix.Contains(a) {
+				return Identity{Name: r.prefix.String(), Role: r.role}
+			}
+		}
+	}
+	return Identity{Name: "default", Role: n.def}
+}
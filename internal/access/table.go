@@ -0,0 +1,186 @@
+package access
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/logging"
+	"github.com/kstaniek/go-ampio-server/internal/secret"
+)
+
+type tokenEntry struct {
+	token string
+	id    Identity
+}
+
+// Table maps API bearer tokens to identities. It holds the tokens of an
+// access file (one "<name> <role> <token>" per line) and, for backward
+// compatibility, the single admin token of -auth-token/-token-file. Safe
+// for concurrent use.
+type Table struct {
+	admin *secret.Value // identity "admin", role admin
+
+	mu      sync.RWMutex
+	path    string
+	entries []tokenEntry
+}
+
+// NewTable returns a table with the legacy admin token (may be nil or unset).
+func NewTable(admin *secret.Value) *Table { return &Table{admin: admin} }
+
+// LoadFile reads the access file at path; Reload re-reads it later.
+func (t *Table) LoadFile(path string) error {
+	t.mu.Lock()
+	t.path = path
+	t.mu.Unlock()
+	return t.Reload()
+}
+
+// Reload re-reads the access file, if any, and the admin token file. On
+// error the previous tokens are kept.
+func (t *Table) Reload() error {
+	if err := t.admin.Reload(); err != nil {
+		return err
+	}
+	t.mu.RLock()
+	path := t.path
+	t.mu.RUnlock()
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("access file: %w", err)
+	}
+	defer f.Close()
+	entries, err := parseTokens(f)
+	if err != nil {
+		return fmt.Errorf("access file %s: %w", path, err)
+	}
+	t.mu.Lock()
+	t.entries = entries
+	t.mu.Unlock()
+	return nil
+}
+
+// parseTokens reads "<name> <role> <token>" lines; # starts a comment.
+func parseTokens(r io.Reader) ([]tokenEntry, error) {
+	var out []tokenEntry
+	names := make(map[string]bool)
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 3 {
+			return nil, fmt.Errorf("line %d: want <name> <role> <token>", ln)
+		}
+		role, err := ParseRole(f[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", ln, err)
+		}
+		if names[f[0]] {
+			return nil, fmt.Errorf("line %d: duplicate name %q", ln, f[0])
+		}
+		names[f[0]] = true
+		out = append(out, tokenEntry{token: f[2], id: Identity{Name: f[0], Role: role}})
+	}
+	return out, sc.Err()
+}
+
+// Enabled reports whether any token is configured. Without tokens the API
+// is open and every request acts as admin.
+func (t *Table) Enabled() bool {
+	if t.admin.IsSet() {
+		return true
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.entries) > 0
+}
+
+// Lookup returns the identity of token. Every entry is compared in
+// constant time.
+func (t *Table) Lookup(token string) (Identity, bool) {
+	var id Identity
+	found := false
+	if want := t.admin.Get(); want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1 {
+		id, found = Identity{Name: "admin", Role: Admin}, true
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, e := range t.entries {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(e.token)) == 1 && !found {
+			id, found = e.id, true
+		}
+	}
+	return id, found
+}
+
+// Require wraps h so that only callers whose role grants p reach it: 401
+// without a known bearer token, 403 when the role lacks p. With no tokens
+// configured requests pass through unchanged.
+func (t *Table) Require(p Perm, h http.Handler) http.Handler {
+	return t.RequireMethod(p, p, h)
+}
+
+type ctxKey struct{}
+
+// FromContext returns the identity Require attached to an admin request.
+// ok is false when the API runs without tokens.
+func FromContext(ctx context.Context) (id Identity, ok bool) {
+	id, ok = ctx.Value(ctxKey{}).(Identity)
+	return id, ok
+}
+
+// bearer returns the token of a request: the Authorization header, or the
+// access_token query parameter of a WebSocket upgrade, since browsers cannot
+// set headers on a WebSocket.
+func bearer(r *http.Request) (string, bool) {
+	if tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return tok, true
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return "", false
+	}
+	tok := r.URL.Query().Get("access_token")
+	return tok, tok != ""
+}
+
+// RequireMethod is Require with read for GET and HEAD requests and write
+// for the other methods. The caller identity is attached to the request
+// context (see FromContext).
+func (t *Table) RequireMethod(read, write Perm, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !t.Enabled() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		tok, ok := bearer(r)
+		id, known := t.Lookup(tok)
+		if !ok || !known {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="can-server"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		p := write
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			p = read
+		}
+		if err := id.Check(p); err != nil {
+			logging.L().Warn("access_denied", "identity", id.Name, "role", id.Role.String(), "perm", p.String(), "path", r.URL.Path)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, id)))
+	})
+}
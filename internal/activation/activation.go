@@ -0,0 +1,131 @@
+// Package activation receives listening sockets passed in by systemd socket
+// activation (sd_listen_fds), so the service manager can own the client
+// port: it accepts connections while the gateway starts or restarts, and
+// the gateway needs no privileges to bind it.
+package activation
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// firstFD is SD_LISTEN_FDS_START, the first passed descriptor.
+var firstFD = 3
+
+// Listener is an inherited listening socket and its FileDescriptorName.
+type Listener struct {
+	Name string
+	net.Listener
+}
+
+// Listeners returns the sockets passed to this process, or none when
+// LISTEN_PID names another process (or is unset). The LISTEN_* variables are
+// unset so child processes do not inherit them. Only stream sockets are
+// supported.
+func Listeners() ([]Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("activation: invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(v)
+	}
+	out := make([]Listener, 0, n)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(firstFD+i), name)
+		ln, err := net.FileListener(f)
+		_ = f.Close() // FileListener holds a duplicate
+		if err != nil {
+			for _, l := range out {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("activation: descriptor %d (%s): %w", firstFD+i, name, err)
+		}
+		out = append(out, Listener{Name: name, Listener: ln})
+	}
+	return out, nil
+}
+
+// Set hands inherited listeners out to the servers that claim them. Safe
+// for concurrent use.
+type Set struct {
+	mu  sync.Mutex
+	lns []Listener
+}
+
+// NewSet returns a set of lns.
+func NewSet(lns []Listener) *Set { return &Set{lns: lns} }
+
+// Take removes and returns the listener for a server called name listening
+// on addr: the one whose FileDescriptorName is name, else the one bound to
+// addr, else the only one when single is set (a single server). It returns
+// nil when none matches.
+func (s *Set) Take(name, addr string, single bool) net.Listener {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pick := -1
+	for i, l := range s.lns {
+		if name != "" && l.Name == name {
+			pick = i
+			break
+		}
+		if pick < 0 && sameAddr(l.Addr(), addr) {
+			pick = i
+		}
+	}
+	if pick < 0 && single && len(s.lns) == 1 {
+		pick = 0
+	}
+	if pick < 0 {
+		return nil
+	}
+	ln := s.lns[pick].Listener
+	s.lns = append(s.lns[:pick], s.lns[pick+1:]...)
+	return ln
+}
+
+// Rest removes and returns the listeners nobody took.
+func (s *Set) Rest() []Listener {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rest := s.lns
+	s.lns = nil
+	return rest
+}
+
+// sameAddr reports whether a listener bound to a serves the listen address
+// addr: the ports match and addr names no host, a wildcard host or a's IP.
+func sameAddr(a net.Addr, addr string) bool {
+	ta, ok := a.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != strconv.Itoa(ta.Port) {
+		return false
+	}
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsUnspecified() || ip.Equal(ta.IP))
+}
@@ -0,0 +1,76 @@
+package activation
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The test cannot place the socket at descriptor 3; start there instead.
+	defer func(fd int) { firstFD = fd }(firstFD)
+	firstFD = int(f.Fd())
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "bus")
+	lns, err := Listeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lns) != 1 || lns[0].Name != "bus" || lns[0].Addr().String() != ln.Addr().String() {
+		t.Fatalf("listeners %+v", lns)
+	}
+	if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		t.Fatal("LISTEN_FDS left set")
+	}
+	lns[0].Close()
+
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	if lns, err := Listeners(); lns != nil || err != nil {
+		t.Fatalf("sockets of another process taken: %v %v", lns, err)
+	}
+}
+
+func TestSetTake(t *testing.T) {
+	listen := func() net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		return ln
+	}
+	a, b, c := listen(), listen(), listen()
+	s := NewSet([]Listener{{"a", a}, {"unknown", b}, {"unknown", c}})
+	_, port, _ := net.SplitHostPort(b.Addr().String())
+	if got := s.Take("x", ":"+port, false); got != b {
+		t.Fatalf("by address: got %v", got)
+	}
+	if got := s.Take("a", ":1", false); got != a {
+		t.Fatalf("by name: got %v", got)
+	}
+	if got := s.Take("y", "10.0.0.1:"+port, false); got != nil {
+		t.Fatalf("other host matched: %v", got)
+	}
+	if got := s.Take("", ":1", true); got != c {
+		t.Fatalf("single: got %v", got)
+	}
+	if rest := s.Rest(); len(rest) != 0 {
+		t.Fatalf("rest %v", rest)
+	}
+	var none *Set
+	if none.Take("", ":1", true) != nil || none.Rest() != nil {
+		t.Fatal("nil set returned listeners")
+	}
+}
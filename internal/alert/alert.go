@@ -0,0 +1,504 @@
+// Package alert watches decoded values of bus frames and raises events
+// when they cross thresholds, change too often (flapping) or change too
+// fast, for lightweight monitoring straight from the gateway.
+//
+// A rule file holds one rule per line:
+//
+//	# name     ids          value                condition
+//	hall_temp  0x1D000123   ampio:temperature:1  > 30
+//	frost      0x1D000123   ampio:temperature:1  < 3
+//	door       0x1D000200   ampio:input:4        flaps 10/1m
+//	boiler     0x300        u16be@2*0.5          rate 5/1m
+//
+// <ids> uses the filter list syntax (no spaces), "*" matches any ID. The
+// value is either a channel of an Ampio state broadcast,
+// "ampio:<kind>:<channel>" decoded by the ampio package, with kind
+// temperature, input, output, flag, analog or dimmer (binary channels are
+// 0 or 1), or a raw field "<type>@<byte>[*scale][+offset]" for other
+// devices, with type u8, s8, u16, s16, u32, s32 (little-endian) or u16be,
+// s16be, u32be, s32be. Conditions:
+//
+//	> X, < X          the value crosses the threshold (re-armed once it
+//	                  is back on the other side)
+//	flaps N/<window>  the value changed more than N times within window
+//	rate X/<window>   the value moved by more than X within window
+//
+// State is kept per rule, instance and CAN ID, so one rule can watch many
+// modules.
+package alert
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/ampio"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+)
+
+// ErrBadRule reports an unparsable alert rule.
+var ErrBadRule = errors.New("bad alert rule")
+
+// Condition kinds.
+const (
+	Above = ">"
+	Below = "<"
+	Flaps = "flaps"
+	Rate  = "rate"
+)
+
+type field struct {
+	off    int
+	size   int // bytes
+	signed bool
+	be     bool
+	scale  float64
+	offset float64
+}
+
+func (f *field) value(fr *can.Frame) (float64, bool) {
+	if int(fr.Len) < f.off+f.size {
+		return 0, false
+	}
+	b := fr.Data[f.off : f.off+f.size]
+	var raw uint64
+	switch f.size {
+	case 1:
+		raw = uint64(b[0])
+	case 2:
+		if f.be {
+			raw = uint64(binary.BigEndian.Uint16(b))
+		} else {
+			raw = uint64(binary.LittleEndian.Uint16(b))
+		}
+	case 4:
+		if f.be {
+			raw = uint64(binary.BigEndian.Uint32(b))
+		} else {
+			raw = uint64(binary.LittleEndian.Uint32(b))
+		}
+	}
+	v := float64(raw)
+	if bits := uint(f.size * 8); f.signed && raw&(1<<(bits-1)) != 0 {
+		v = float64(int64(raw) - int64(1)<<bits)
+	}
+	return v*f.scale + f.offset, true
+}
+
+// ampioKinds maps the kinds of ampio values to the broadcasts carrying
+// them.
+var ampioKinds = map[string][]ampio.Kind{
+	"temperature": {ampio.KindTemperature},
+	"input":       {ampio.KindInputs, ampio.KindInputsExt},
+	"output":      {ampio.KindOutputs},
+	"flag":        {ampio.KindFlags},
+	"analog":      {ampio.KindAnalog},
+	"dimmer":      {ampio.KindDimmers},
+}
+
+// ampioValue selects one channel of an Ampio state broadcast.
+type ampioValue struct {
+	kinds   []ampio.Kind
+	channel int // 1-based
+}
+
+func (a *ampioValue) value(dec ampio.Decoder, fr *can.Frame) (float64, bool) {
+	ev, ok := dec.Decode(fr)
+	if !ok || !slices.Contains(a.kinds, ev.Kind) {
+		return 0, false
+	}
+	if ev.Kind == ampio.KindTemperature {
+		if a.channel > len(ev.Temperatures) {
+			return 0, false
+		}
+		return ev.Temperatures[a.channel-1], true
+	}
+	i := a.channel - ev.First
+	switch {
+	case ev.States != nil:
+		if i < 0 || i >= len(ev.States) {
+			return 0, false
+		}
+		if ev.States[i] {
+			return 1, true
+		}
+		return 0, true
+	case ev.Levels != nil:
+		if i < 0 || i >= len(ev.Levels) {
+			return 0, false
+		}
+		return float64(ev.Levels[i]), true
+	}
+	return 0, false
+}
+
+// parseAmpio parses "ampio:<kind>:<channel>".
+func parseAmpio(s string) (*ampioValue, error) {
+	kind, ch, ok := strings.Cut(strings.TrimPrefix(s, "ampio:"), ":")
+	kinds := ampioKinds[kind]
+	if !ok || kinds == nil {
+		return nil, fmt.Errorf("%w: value %q: want ampio:<kind>:<channel> with kind temperature, input, output, flag, analog or dimmer", ErrBadRule, s)
+	}
+	n, err := strconv.Atoi(ch)
+	if err != nil || n < 1 || n > 64 {
+		return nil, fmt.Errorf("%w: value %q: channel", ErrBadRule, s)
+	}
+	return &ampioValue{kinds: kinds, channel: n}, nil
+}
+
+// Rule is one parsed alert rule.
+type Rule struct {
+	Name      string
+	ids       *filter.Filter
+	ampio     *ampioValue // nil for a raw field
+	field     field
+	Kind      string
+	Threshold float64       // >, <, rate
+	Count     int           // flaps
+	Window    time.Duration // flaps, rate
+}
+
+// Load reads a rule file.
+func Load(path string) ([]*Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// Parse reads rules from r.
+func Parse(r io.Reader) ([]*Rule, error) {
+	var rules []*Rule
+	names := make(map[string]bool)
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		rl, err := parseRule(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", ln, err)
+		}
+		if names[rl.Name] {
+			return nil, fmt.Errorf("line %d: %w: duplicate name %q", ln, ErrBadRule, rl.Name)
+		}
+		names[rl.Name] = true
+		rules = append(rules, rl)
+	}
+	return rules, sc.Err()
+}
+
+func parseRule(f []string) (*Rule, error) {
+	if len(f) < 5 {
+		return nil, fmt.Errorf("%w: want <name> <ids> <value> <condition>", ErrBadRule)
+	}
+	rl := &Rule{Name: f[0]}
+	if f[1] != "*" {
+		ids, err := filter.New(f[1], "")
+		if err != nil || ids == nil {
+			return nil, fmt.Errorf("%w: ids %q", ErrBadRule, f[1])
+		}
+		rl.ids = ids
+	}
+	var err error
+	if strings.HasPrefix(f[2], "ampio:") {
+		if rl.ampio, err = parseAmpio(f[2]); err != nil {
+			return nil, err
+		}
+	} else if rl.field, err = parseField(f[2]); err != nil {
+		return nil, err
+	}
+	switch rl.Kind = f[3]; rl.Kind {
+	case Above, Below:
+		if len(f) != 5 {
+			return nil, fmt.Errorf("%w: want %s <threshold>", ErrBadRule, rl.Kind)
+		}
+		if rl.Threshold, err = strconv.ParseFloat(f[4], 64); err != nil {
+			return nil, fmt.Errorf("%w: threshold %q", ErrBadRule, f[4])
+		}
+	case Flaps, Rate:
+		n, w, ok := strings.Cut(f[4], "/")
+		if !ok || len(f) != 5 {
+			return nil, fmt.Errorf("%w: want %s <n>/<window>", ErrBadRule, rl.Kind)
+		}
+		if rl.Window, err = time.ParseDuration(w); err != nil || rl.Window <= 0 {
+			return nil, fmt.Errorf("%w: window %q", ErrBadRule, w)
+		}
+		if rl.Kind == Flaps {
+			if rl.Count, err = strconv.Atoi(n); err != nil || rl.Count <= 0 {
+				return nil, fmt.Errorf("%w: flap count %q", ErrBadRule, n)
+			}
+		} else if rl.Threshold, err = strconv.ParseFloat(n, 64); err != nil || rl.Threshold <= 0 {
+			return nil, fmt.Errorf("%w: rate %q", ErrBadRule, n)
+		}
+	default:
+		return nil, fmt.Errorf("%w: condition %q (want >, <, flaps or rate)", ErrBadRule, f[3])
+	}
+	return rl, nil
+}
+
+// value extracts the watched value of fr.
+func (rl *Rule) value(dec ampio.Decoder, fr *can.Frame) (float64, bool) {
+	if rl.ampio != nil {
+		return rl.ampio.value(dec, fr)
+	}
+	return rl.field.value(fr)
+}
+
+// parseField parses "<type>@<byte>[*scale][+offset]" (a negative offset
+// is written "+-40").
+func parseField(s string) (field, error) {
+	f := field{scale: 1}
+	typ, rest, ok := strings.Cut(s, "@")
+	if !ok {
+		return f, fmt.Errorf("%w: value %q: want <type>@<byte>", ErrBadRule, s)
+	}
+	rest, off, hasOff := strings.Cut(rest, "+")
+	pos, scale, hasScale := strings.Cut(rest, "*")
+	var err error
+	if hasOff {
+		if f.offset, err = strconv.ParseFloat(off, 64); err != nil {
+			return f, fmt.Errorf("%w: value %q: offset", ErrBadRule, s)
+		}
+	}
+	if hasScale {
+		if f.scale, err = strconv.ParseFloat(scale, 64); err != nil {
+			return f, fmt.Errorf("%w: value %q: scale", ErrBadRule, s)
+		}
+	}
+	base, be := strings.CutSuffix(typ, "be")
+	f.be = be
+	switch base {
+	case "u8", "s8":
+		f.size = 1
+	case "u16", "s16":
+		f.size = 2
+	case "u32", "s32":
+		f.size = 4
+	}
+	if f.size == 0 || (be && f.size == 1) {
+		return f, fmt.Errorf("%w: value type %q", ErrBadRule, typ)
+	}
+	f.signed = base[0] == 's'
+	if f.off, err = strconv.Atoi(pos); err != nil || f.off < 0 || f.off+f.size > 8 {
+		return f, fmt.Errorf("%w: value %q: byte offset", ErrBadRule, s)
+	}
+	return f, nil
+}
+
+// Event is a fired alert.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Rule     string    `json:"rule"`
+	Instance string    `json:"instance,omitempty"`
+	Frame    string    `json:"frame"`
+	Value    float64   `json:"value"`
+	Reason   string    `json:"reason"`
+	Note     string    `json:"note,omitempty"` // frame annotation, when configured
+}
+
+type sample struct {
+	at time.Time
+	v  float64
+}
+
+type key struct {
+	rule     *Rule
+	instance string
+	id       uint32
+}
+
+// state is the history of one rule for one instance and CAN ID.
+type state struct {
+	last    float64
+	seen    bool
+	fired   bool        // threshold crossed and not re-armed yet
+	changes []time.Time // flaps: value change times within the window
+	samples []sample    // rate: values within the window
+	lastAt  time.Time   // last time the alert fired
+	pending *Event      // alert held back by the cooldown
+}
+
+// Engine evaluates rules against frames. Observe is safe for concurrent use.
+type Engine struct {
+	rules    []*Rule
+	cooldown time.Duration
+	dec      ampio.Decoder
+	fire     func(Event)
+	now      func() time.Time
+	after    func(time.Duration, func()) // schedules deferred alerts
+
+	mu    sync.Mutex
+	state map[key]*state
+}
+
+// NewEngine returns an engine calling fire for every alert; dec decodes the
+// ampio values of the rules. A rule fires at most once per cooldown for
+// each instance and CAN ID. An alert raised during the cooldown is held
+// back and fires when the cooldown ends, if its condition still holds
+// then (a threshold rule still past its threshold).
+func NewEngine(rules []*Rule, cooldown time.Duration, dec ampio.Decoder, fire func(Event)) *Engine {
+	return &Engine{
+		rules: rules, cooldown: cooldown, dec: dec, fire: fire, now: time.Now,
+		after: func(d time.Duration, f func()) { time.AfterFunc(d, f) },
+		state: make(map[key]*state),
+	}
+}
+
+// Observe evaluates fr, received on instance, against every rule. note, if
+// non-nil, describes the frame in fired events.
+func (e *Engine) Observe(instance string, fr *can.Frame, note func(*can.Frame) string) {
+	if fr.CANID&(can.CAN_RTR_FLAG|can.CAN_ERR_FLAG) != 0 {
+		return
+	}
+	now := e.now()
+	for _, rl := range e.rules {
+		if !rl.ids.Allow(fr) {
+			continue
+		}
+		v, ok := rl.value(e.dec, fr)
+		if !ok {
+			continue
+		}
+		e.mu.Lock()
+		k := key{rl, instance, fr.CANID}
+		st := e.state[k]
+		if st == nil {
+			st = &state{}
+			e.state[k] = st
+		}
+		reason := st.eval(rl, now, v)
+		if st.pending != nil && isThreshold(rl) {
+			// A held-back threshold alert reports the latest value, and is
+			// dropped once the value is back.
+			if !st.fired {
+				st.pending = nil
+			} else if reason == "" {
+				reason = thresholdReason(rl, v)
+			}
+		}
+		if reason == "" {
+			e.mu.Unlock()
+			continue
+		}
+		ev := Event{Time: now, Rule: rl.Name, Instance: instance, Frame: fr.String(), Value: v, Reason: reason}
+		if note != nil {
+			ev.Note = note(fr)
+		}
+		fire := st.lastAt.IsZero() || now.Sub(st.lastAt) >= e.cooldown
+		if fire {
+			st.lastAt, st.pending = now, nil
+		} else {
+			if st.pending == nil {
+				e.after(st.lastAt.Add(e.cooldown).Sub(now), func() { e.firePending(k) })
+			}
+			st.pending = &ev
+		}
+		e.mu.Unlock()
+		if fire {
+			e.fire(ev)
+		}
+	}
+}
+
+// firePending fires the alert of k held back by the cooldown.
+func (e *Engine) firePending(k key) {
+	e.mu.Lock()
+	st := e.state[k]
+	if st == nil || st.pending == nil {
+		e.mu.Unlock()
+		return
+	}
+	now := e.now()
+	if wait := st.lastAt.Add(e.cooldown).Sub(now); wait > 0 {
+		e.mu.Unlock()
+		e.after(wait, func() { e.firePending(k) })
+		return
+	}
+	ev := *st.pending
+	st.lastAt, st.pending = now, nil
+	e.mu.Unlock()
+	e.fire(ev)
+}
+
+func isThreshold(rl *Rule) bool { return rl.Kind == Above || rl.Kind == Below }
+
+func thresholdReason(rl *Rule, v float64) string {
+	return fmt.Sprintf("value %g %s %g", v, rl.Kind, rl.Threshold)
+}
+
+// eval records v and returns why the rule fires ("" when it does not).
+func (st *state) eval(rl *Rule, now time.Time, v float64) string {
+	prev, seen := st.last, st.seen
+	st.last, st.seen = v, true
+	switch rl.Kind {
+	case Above, Below:
+		over := v > rl.Threshold
+		if rl.Kind == Below {
+			over = v < rl.Threshold
+		}
+		if !over {
+			st.fired = false
+			return ""
+		}
+		if st.fired {
+			return ""
+		}
+		st.fired = true
+		return thresholdReason(rl, v)
+	case Flaps:
+		if !seen || v == prev {
+			return ""
+		}
+		st.changes = append(trimTimes(st.changes, now.Add(-rl.Window)), now)
+		if len(st.changes) > rl.Count {
+			n := len(st.changes)
+			st.changes = st.changes[:0]
+			return fmt.Sprintf("%d changes within %s", n, rl.Window)
+		}
+	case Rate:
+		st.samples = append(trimSamples(st.samples, now.Add(-rl.Window)), sample{now, v})
+		lo, hi := math.Inf(1), math.Inf(-1)
+		for _, s := range st.samples {
+			lo, hi = min(lo, s.v), max(hi, s.v)
+		}
+		if hi-lo > rl.Threshold {
+			st.samples = append(st.samples[:0], sample{now, v})
+			return fmt.Sprintf("changed by %g within %s", hi-lo, rl.Window)
+		}
+	}
+	return ""
+}
+
+func trimTimes(ts []time.Time, cut time.Time) []time.Time {
+	i := 0
+	for i < len(ts) && ts[i].Before(cut) {
+		i++
+	}
+	return append(ts[:0], ts[i:]...)
+}
+
+func trimSamples(ss []sample, cut time.Time) []sample {
+	i := 0
+	for i < len(ss) && ss[i].at.Before(cut) {
+		i++
+	}
+	return append(ss[:0], ss[i:]...)
+}
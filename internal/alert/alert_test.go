@@ -0,0 +1,249 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/ampio"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func mustParse(t *testing.T, s string) []*Rule {
+	t.Helper()
+	rules, err := Parse(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	return rules
+}
+
+func frame(t *testing.T, s string) *can.Frame {
+	t.Helper()
+	fr, err := can.ParseFrame(s)
+	if err != nil {
+		t.Fatalf("frame %q: %v", s, err)
+	}
+	return &fr
+}
+
+// testEngine returns an engine with a controllable clock and the fired
+// events. Deferred alerts are due when the test calls runTimers.
+func testEngine(rules []*Rule, cooldown time.Duration) (*Engine, *time.Time, *[]Event) {
+	var fired []Event
+	e := NewEngine(rules, cooldown, ampio.Decoder{}, func(ev Event) { fired = append(fired, ev) })
+	now := time.Unix(1000, 0)
+	e.now = func() time.Time { return now }
+	e.after = func(time.Duration, func()) {}
+	return e, &now, &fired
+}
+
+// captureTimers makes e record its deferred alerts; the returned function
+// runs the recorded ones.
+func captureTimers(e *Engine) func() {
+	var timers []func()
+	e.after = func(_ time.Duration, f func()) { timers = append(timers, f) }
+	return func() {
+		run := timers
+		timers = nil
+		for _, f := range run {
+			f()
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{
+		"t 0x123 u8@0",
+		"t 0x123 u8@0 >= 3",
+		"t 0x123 u8@8 > 3",
+		"t 0x123 u16@7 > 3",
+		"t 0x123 u8be@0 > 3",
+		"t 0x123 f32@0 > 3",
+		"t 0x123 u8@0*x > 3",
+		"t zz u8@0 > 3",
+		"t 0x123 u8@0 flaps 0/1m",
+		"t 0x123 u8@0 rate 5",
+		"t 0x123 u8@0 > 3\nt 0x124 u8@0 < 3",
+		"t 0x123 ampio:humidity:1 > 3",
+		"t 0x123 ampio:input > 3",
+		"t 0x123 ampio:input:0 > 3",
+		"t 0x123 ampio:input:65 > 3",
+	} {
+		if _, err := Parse(strings.NewReader(s)); !errors.Is(err, ErrBadRule) {
+			t.Errorf("%q: err = %v, want ErrBadRule", s, err)
+		}
+	}
+}
+
+func TestFieldValue(t *testing.T) {
+	rules := mustParse(t, `
+a * s16@1*0.1+-40 > 0
+b * u16be@1 > 0
+c * s8@0 > 0
+`)
+	fr := frame(t, "123#FF2C01")
+	for i, want := range []float64{0.1*300 - 40, 0x2C01, -1} {
+		v, ok := rules[i].field.value(fr)
+		if !ok || v != want {
+			t.Errorf("rule %s: value = %v, %v; want %v", rules[i].Name, v, ok, want)
+		}
+	}
+	if _, ok := rules[0].field.value(frame(t, "123#FF2C")); ok {
+		t.Error("short frame decoded")
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	e, _, fired := testEngine(mustParse(t, "hot 0x123 u8@0 > 30"), 0)
+	for _, s := range []string{"123#1E", "123#1F", "123#20", "124#40", "123#10", "123#21"} {
+		e.Observe("", frame(t, s), nil)
+	}
+	if len(*fired) != 2 {
+		t.Fatalf("fired %d alerts, want 2 (crossing, re-armed crossing): %+v", len(*fired), *fired)
+	}
+	if ev := (*fired)[0]; ev.Rule != "hot" || ev.Value != 31 || ev.Frame != "123#1F" {
+		t.Errorf("event = %+v", ev)
+	}
+}
+
+func TestAmpioValue(t *testing.T) {
+	rules := mustParse(t, `
+temp * ampio:temperature:2 > 0
+in3 * ampio:input:3 > 0
+in34 * ampio:input:34 > 0
+dim2 * ampio:dimmer:2 > 0
+`)
+	dec := ampio.Decoder{}
+	for _, tc := range []struct {
+		rule int
+		fr   string
+		want float64
+		ok   bool
+	}{
+		{0, "1D000123#FE05EB00F6FF", -1, true},
+		{0, "1D000123#FE05EB00", 0, false}, // one sensor only
+		{0, "1E000123#FE05EB00F6FF", 0, false},
+		{1, "1D000123#FE0104", 1, true},
+		{1, "1D000123#FE0100", 0, true},
+		{1, "1D000123#FE0C04", 0, false}, // outputs, not inputs
+		{2, "1D000123#FE0202", 1, true},
+		{2, "1D000123#FE0102", 0, false}, // inputs 1-32 only
+		{3, "1D000123#FE0E0A14", 20, true},
+	} {
+		v, ok := rules[tc.rule].value(dec, frame(t, tc.fr))
+		if ok != tc.ok || v != tc.want {
+			t.Errorf("rule %s, %s: value = %v, %v; want %v, %v", rules[tc.rule].Name, tc.fr, v, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestFlapsAndCooldown(t *testing.T) {
+	e, now, fired := testEngine(mustParse(t, "door 0x200 u8@0 flaps 3/1m"), time.Minute)
+	runTimers := captureTimers(e)
+	flip := func(n int) {
+		for i := 0; i < n; i++ {
+			*now = now.Add(time.Second)
+			e.Observe("a", frame(t, []string{"200#00", "200#01"}[i%2]), func(*can.Frame) string { return "door" })
+		}
+	}
+	flip(4) // first frame sets the baseline: three changes
+	if len(*fired) != 0 {
+		t.Fatalf("fired early: %+v", *fired)
+	}
+	flip(1)
+	if len(*fired) != 1 || (*fired)[0].Instance != "a" || (*fired)[0].Note != "door" {
+		t.Fatalf("fired = %+v", *fired)
+	}
+	flip(8) // flapping again within the cooldown
+	if len(*fired) != 1 {
+		t.Fatalf("cooldown ignored: %+v", *fired)
+	}
+	*now = now.Add(time.Minute)
+	runTimers()
+	if len(*fired) != 2 || !strings.Contains((*fired)[1].Reason, "changes") {
+		t.Fatalf("deferred alert not fired after the cooldown: %+v", *fired)
+	}
+	runTimers()
+	if len(*fired) != 2 {
+		t.Fatalf("deferred alert fired twice: %+v", *fired)
+	}
+}
+
+func TestThresholdCooldown(t *testing.T) {
+	e, now, fired := testEngine(mustParse(t, "hot 0x123 u8@0 > 30"), time.Minute)
+	runTimers := captureTimers(e)
+	step := func(s string) {
+		*now = now.Add(10 * time.Second)
+		e.Observe("", frame(t, s), nil)
+	}
+	step("123#20")
+	step("123#10")
+	step("123#21") // second crossing within the cooldown: deferred
+	step("123#22")
+	if len(*fired) != 1 {
+		t.Fatalf("fired %d alerts within the cooldown, want 1", len(*fired))
+	}
+	*now = now.Add(time.Minute)
+	runTimers()
+	if len(*fired) != 2 || (*fired)[1].Value != 0x22 {
+		t.Fatalf("deferred crossing = %+v, want value 34", *fired)
+	}
+
+	step("123#10")
+	step("123#21") // crossing within the cooldown, then back below
+	step("123#10")
+	*now = now.Add(time.Minute)
+	runTimers()
+	if len(*fired) != 2 {
+		t.Fatalf("fired a crossing that was over when the cooldown ended: %+v", (*fired)[2:])
+	}
+}
+
+func TestRate(t *testing.T) {
+	e, now, fired := testEngine(mustParse(t, "boiler 0x300 u8@0 rate 5/1m"), 0)
+	for _, v := range []string{"14", "16", "18"} { // +4 within the window
+		*now = now.Add(10 * time.Second)
+		e.Observe("", frame(t, "300#"+v), nil)
+	}
+	*now = now.Add(time.Minute) // the slow climb leaves the window
+	e.Observe("", frame(t, "300#1A"), nil)
+	if len(*fired) != 0 {
+		t.Fatalf("fired on a slow change: %+v", *fired)
+	}
+	*now = now.Add(time.Second)
+	e.Observe("", frame(t, "300#20"), nil)
+	if len(*fired) != 1 || !strings.Contains((*fired)[0].Reason, "changed by 6") {
+		t.Fatalf("fired = %+v", *fired)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	got := make(chan Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev Event
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		got <- ev
+	}))
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := NewWebhook(srv.URL, time.Second, nil)
+	go w.Run(ctx)
+	w.Send(Event{Rule: "hot", Frame: "123#1F", Value: 31})
+	select {
+	case ev := <-got:
+		if ev.Rule != "hot" || ev.Value != 31 {
+			t.Errorf("posted %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook not called")
+	}
+}
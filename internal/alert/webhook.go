@@ -0,0 +1,79 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// webhookQueue bounds the events waiting for delivery; alerts beyond it are
+// dropped (and logged) rather than stalling frame processing.
+const webhookQueue = 64
+
+// Webhook POSTs events as JSON to a URL from a single background worker.
+type Webhook struct {
+	url    string
+	client *http.Client
+	log    *slog.Logger
+	queue  chan Event
+}
+
+// NewWebhook returns a sender for url; each request gives up after timeout.
+func NewWebhook(url string, timeout time.Duration, l *slog.Logger) *Webhook {
+	if l == nil {
+		l = slog.Default()
+	}
+	return &Webhook{url: url, client: &http.Client{Timeout: timeout}, log: l, queue: make(chan Event, webhookQueue)}
+}
+
+// Send queues ev for delivery without blocking.
+func (w *Webhook) Send(ev Event) {
+	select {
+	case w.queue <- ev:
+	default:
+		metrics.IncError(metrics.ErrAlertWebhook)
+		w.log.Warn("alert_webhook_dropped", "rule", ev.Rule, "reason", "queue full")
+	}
+}
+
+// Run delivers queued events until ctx is done.
+func (w *Webhook) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-w.queue:
+			if err := w.post(ctx, ev); err != nil {
+				metrics.IncError(metrics.ErrAlertWebhook)
+				w.log.Warn("alert_webhook_failed", "rule", ev.Rule, "error", err)
+			}
+		}
+	}
+}
+
+func (w *Webhook) post(ctx context.Context, ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Package ampio decodes the state broadcasts of Ampio modules into
+// structured events, so the gateway can log or publish module states rather
+// than raw CAN bytes.
+//
+// Ampio modules send with 29-bit IDs: the top byte is a bus-wide prefix
+// (0x1D by default) and the low 24 bits the module address. Broadcasts have
+// type 0xFE in Data[0] and a subtype in Data[1] selecting the layout of the
+// rest of the payload. The layouts come from the Ampio format database of
+// the annotate package: a broadcast format with an event mapping decodes
+// into an Event whose Kind is the format name. The built-in database has:
+//
+//	0x00 device       Data[2] device type code
+//	0x01 inputs       binary inputs 1-32, one bit each (Data[2..5])
+//	0x02 inputs_ext   binary inputs 33-64
+//	0x05 temperature  up to 3 sensors, s16 in 0.1 °C (Data[2..7])
+//	0x06 analog       up to 6 analog inputs, one byte each
+//	0x0C outputs      outputs 1-32, one bit each
+//	0x0E dimmers      up to 6 dimmer levels, one byte each
+//	0x80 flags        flags 1-32, one bit each
+//
+// Devices keeps a table of the modules seen on the bus.
+package ampio
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/annotate"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// DefaultPrefix is the top byte of the IDs Ampio modules send with.
+const DefaultPrefix = 0x1D
+
+// TypeBroadcast is the message type (Data[0]) of state broadcasts.
+const TypeBroadcast = 0xFE
+
+// Kind names what a broadcast reports: the name of its format.
+type Kind string
+
+// Kinds of the built-in format database.
+const (
+	KindDevice      Kind = "device"
+	KindInputs      Kind = "inputs"
+	KindInputsExt   Kind = "inputs_ext"
+	KindTemperature Kind = "temperature"
+	KindAnalog      Kind = "analog"
+	KindOutputs     Kind = "outputs"
+	KindDimmers     Kind = "dimmers"
+	KindFlags       Kind = "flags"
+)
+
+// Address is a module address, the low 24 bits of its CAN ID.
+type Address uint32
+
+func (a Address) String() string { return fmt.Sprintf("%06X", uint32(a)) }
+
+// MarshalText formats a as 6 hex digits, as in logs and annotations.
+func (a Address) MarshalText() ([]byte, error) { return []byte(a.String()), nil }
+
+// Event is one decoded broadcast. Only the fields of its Kind are set.
+type Event struct {
+	Module Address `json:"module"`
+	Kind   Kind    `json:"kind"`
+	// DeviceType is the type code of the module (KindDevice).
+	DeviceType uint8 `json:"device_type,omitempty"`
+	// Temperatures in °C, one per sensor in the frame (KindTemperature).
+	Temperatures []float64 `json:"temperatures,omitempty"`
+	// States of binary inputs, outputs or flags: States[i] is channel
+	// First+i.
+	States []bool `json:"states,omitempty"`
+	// Levels of analog inputs or dimmers: Levels[i] is channel First+i.
+	Levels []uint8 `json:"levels,omitempty"`
+	First  int     `json:"first,omitempty"`
+}
+
+// Equal reports whether e and o report the same state of the same module.
+func (e Event) Equal(o Event) bool {
+	return e.Module == o.Module && e.Kind == o.Kind && e.DeviceType == o.DeviceType && e.First == o.First &&
+		slices.Equal(e.Temperatures, o.Temperatures) && slices.Equal(e.States, o.States) && slices.Equal(e.Levels, o.Levels)
+}
+
+// LogValue logs the module, the kind and the fields of the kind.
+func (e Event) LogValue() slog.Value {
+	attrs := []slog.Attr{slog.String("module", e.Module.String()), slog.String("kind", string(e.Kind))}
+	switch {
+	case e.Kind == KindDevice:
+		attrs = append(attrs, slog.String("device_type", fmt.Sprintf("0x%02X", e.DeviceType)))
+	case e.Temperatures != nil:
+		attrs = append(attrs, slog.Any("temperatures", e.Temperatures))
+	case e.States != nil:
+		on := []int{}
+		for i, s := range e.States {
+			if s {
+				on = append(on, e.First+i)
+			}
+		}
+		attrs = append(attrs, slog.Any("on", on))
+	case e.Levels != nil:
+		attrs = append(attrs, slog.Int("first", e.First), slog.Any("levels", e.Levels))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// builtinFormats is the built-in format database, parsed once.
+var builtinFormats = sync.OnceValue(annotate.BuiltinAmpioFormats)
+
+// Decoder decodes the broadcasts of modules sending with Prefix.
+type Decoder struct {
+	// Prefix is the top byte of module IDs; zero means DefaultPrefix.
+	Prefix uint8
+	// Formats holds the broadcast layouts; nil means the built-in
+	// database.
+	Formats *annotate.AmpioFormats
+}
+
+// Module returns the address of the module that sent fr, if an Ampio
+// module did. Any frame counts, not only broadcasts.
+func (d Decoder) Module(fr *can.Frame) (Address, bool) {
+	if fr.CANID&can.CAN_EFF_FLAG == 0 || fr.CANID&(can.CAN_RTR_FLAG|can.CAN_ERR_FLAG) != 0 || fr.IsFD() {
+		return 0, false
+	}
+	prefix := d.Prefix
+	if prefix == 0 {
+		prefix = DefaultPrefix
+	}
+	id := fr.CANID & can.CAN_EFF_MASK
+	if id>>24 != uint32(prefix) {
+		return 0, false
+	}
+	return Address(id & 0xFFFFFF), true
+}
+
+// Decode returns the event of a state broadcast. Other frames, formats
+// without an event mapping and payloads too short for their format report
+// false.
+func (d Decoder) Decode(fr *can.Frame) (Event, bool) {
+	addr, ok := d.Module(fr)
+	if !ok || fr.Len < 2 || fr.Data[0] != TypeBroadcast {
+		return Event{}, false
+	}
+	formats := d.Formats
+	if formats == nil {
+		formats = builtinFormats()
+	}
+	m, ok := formats.Decode(fr)
+	if !ok {
+		return Event{}, false
+	}
+	ev := Event{Module: addr, Kind: Kind(m.Name)}
+	decoded := false
+	for _, v := range m.Fields {
+		switch {
+		case m.Event == annotate.AmpioEventStates:
+			if !decoded {
+				ev.First = v.First
+			}
+			for i := range 8 * v.Bytes {
+				ev.States = append(ev.States, v.Raw&(1<<i) != 0)
+			}
+		case !v.Complete():
+			continue
+		case m.Event == annotate.AmpioEventDevice:
+			if decoded {
+				continue
+			}
+			ev.DeviceType = uint8(v.Raw)
+		case m.Event == annotate.AmpioEventLevels:
+			ev.First = 1
+			ev.Levels = append(ev.Levels, uint8(v.Raw))
+		case m.Event == annotate.AmpioEventTemperatures:
+			ev.Temperatures = append(ev.Temperatures, v.Value)
+		default: // annotation only
+			continue
+		}
+		decoded = true
+	}
+	if !decoded {
+		return Event{}, false
+	}
+	return ev, true
+}
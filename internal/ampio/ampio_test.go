@@ -0,0 +1,105 @@
+package ampio
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/annotate"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func frame(id uint32, data ...byte) can.Frame {
+	fr := can.Frame{CANID: id | can.CAN_EFF_FLAG, Len: uint8(len(data))}
+	copy(fr.Data[:], data)
+	return fr
+}
+
+// states returns n channel states with the given ones on.
+func states(n int, on ...int) []bool {
+	s := make([]bool, n)
+	for _, i := range on {
+		s[i] = true
+	}
+	return s
+}
+
+func TestDecode(t *testing.T) {
+	var d Decoder
+	for _, tc := range []struct {
+		name string
+		fr   can.Frame
+		want Event
+	}{
+		{"device", frame(0x1D000123, 0xFE, 0x00, 0x0A), Event{Module: 0x123, Kind: KindDevice, DeviceType: 0x0A}},
+		{"temperature", frame(0x1D000123, 0xFE, 0x05, 0xEB, 0x00, 0xF6, 0xFF), Event{Module: 0x123, Kind: KindTemperature, Temperatures: []float64{23.5, -1}}},
+		{"inputs", frame(0x1D000123, 0xFE, 0x01, 0x05), Event{Module: 0x123, Kind: KindInputs, First: 1, States: states(8, 0, 2)}},
+		{"inputs ext", frame(0x1D000001, 0xFE, 0x02, 0x80), Event{Module: 1, Kind: KindInputsExt, First: 33, States: states(8, 7)}},
+		{"flags", frame(0x1D000001, 0xFE, 0x80, 0x00, 0x01), Event{Module: 1, Kind: KindFlags, First: 1, States: states(16, 8)}},
+		{"dimmers", frame(0x1D000001, 0xFE, 0x0E, 10, 20, 30), Event{Module: 1, Kind: KindDimmers, First: 1, Levels: []uint8{10, 20, 30}}},
+	} {
+		got, ok := d.Decode(&tc.fr)
+		if !ok || !got.Equal(tc.want) {
+			t.Fatalf("%s: got %+v ok=%v, want %+v", tc.name, got, ok, tc.want)
+		}
+	}
+
+	for name, fr := range map[string]can.Frame{
+		"other prefix":      frame(0x1E000123, 0xFE, 0x00, 0x0A),
+		"standard id":       {CANID: 0x123, Len: 3, Data: [64]byte{0xFE, 0x00, 0x0A}},
+		"not a broadcast":   frame(0x1D000123, 0x0A, 0x00, 0x0A),
+		"unknown subtype":   frame(0x1D000123, 0xFE, 0x7F, 0x00),
+		"short":             frame(0x1D000123, 0xFE, 0x00),
+		"short temperature": frame(0x1D000123, 0xFE, 0x05, 0x01),
+	} {
+		if ev, ok := d.Decode(&fr); ok {
+			t.Fatalf("%s: decoded %+v", name, ev)
+		}
+	}
+	fr := frame(0x1E000123, 0xFE, 0x00, 0x0A)
+	if ev, ok := (Decoder{Prefix: 0x1E}).Decode(&fr); !ok || ev.DeviceType != 0x0A {
+		t.Fatalf("custom prefix: %+v ok=%v", ev, ok)
+	}
+}
+
+func TestDecodeFormats(t *testing.T) {
+	db := `{"version": 1, "revision": "site-1", "formats": [
+		{"type": "0xFE", "subtype": "0x0C", "name": "relays", "event": "states", "fields": [{"name": "r", "byte": 2, "size": 1, "first": 9}]},
+		{"type": "0xFE", "subtype": "0x20", "name": "humidity", "event": "temperatures", "fields": [{"name": "h", "byte": 2, "size": 1, "scale": 0.5}]},
+		{"type": "0xFE", "subtype": "0x21", "name": "raw", "fields": [{"name": "b", "byte": 2, "size": 1}]}]}`
+	o, err := annotate.ParseAmpioFormats(strings.NewReader(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := Decoder{Formats: annotate.BuiltinAmpioFormats().Override(o)}
+	for _, tc := range []struct {
+		name string
+		fr   can.Frame
+		want Event
+	}{
+		{"replaced", frame(0x1D000123, 0xFE, 0x0C, 0x02), Event{Module: 0x123, Kind: "relays", First: 9, States: states(8, 1)}},
+		{"added", frame(0x1D000123, 0xFE, 0x20, 90), Event{Module: 0x123, Kind: "humidity", Temperatures: []float64{45}}},
+		{"built in", frame(0x1D000123, 0xFE, 0x00, 0x0A), Event{Module: 0x123, Kind: KindDevice, DeviceType: 0x0A}},
+	} {
+		got, ok := d.Decode(&tc.fr)
+		if !ok || !got.Equal(tc.want) {
+			t.Fatalf("%s: got %+v ok=%v, want %+v", tc.name, got, ok, tc.want)
+		}
+	}
+	fr := frame(0x1D000123, 0xFE, 0x21, 0x01)
+	if ev, ok := d.Decode(&fr); ok {
+		t.Fatalf("format without event decoded: %+v", ev)
+	}
+}
+
+func TestEventJSON(t *testing.T) {
+	fr := frame(0x1D000123, 0xFE, 0x05, 0xEB, 0x00)
+	ev, _ := Decoder{}.Decode(&fr)
+	b, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"module":"000123","kind":"temperature","temperatures":[23.5]}`; string(b) != want {
+		t.Fatalf("got %s, want %s", b, want)
+	}
+}
@@ -0,0 +1,79 @@
+package ampio
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// MaxDevices bounds a device table. Modules first seen when it is full are
+// not added, so a flood of stray IDs cannot grow it without limit.
+const MaxDevices = 4096
+
+// Device is one module seen on the bus.
+type Device struct {
+	Module     Address   `json:"module"`                // module address (MAC)
+	DeviceType uint8     `json:"device_type,omitempty"` // from its device broadcast; 0 until one is seen
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	Frames     uint64    `json:"frames"`
+}
+
+// Devices learns which modules are on the bus from the state broadcasts
+// they send periodically. It is safe for concurrent use.
+type Devices struct {
+	dec Decoder
+	mu  sync.Mutex
+	m   map[Address]*Device
+}
+
+// NewDevices returns an empty table for modules sending with d's prefix.
+func NewDevices(d Decoder) *Devices {
+	return &Devices{dec: d, m: map[Address]*Device{}}
+}
+
+// Observe records fr, received at now, if it is a module's state
+// broadcast. Other frames, such as commands addressed to a module, do not
+// prove that the module exists.
+func (t *Devices) Observe(fr *can.Frame, now time.Time) {
+	addr, ok := t.dec.Module(fr)
+	if !ok || fr.Len < 2 || fr.Data[0] != TypeBroadcast {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dev := t.m[addr]
+	if dev == nil {
+		if len(t.m) >= MaxDevices {
+			return
+		}
+		dev = &Device{Module: addr, FirstSeen: now}
+		t.m[addr] = dev
+	}
+	dev.LastSeen = now
+	dev.Frames++
+	if ev, ok := t.dec.Decode(fr); ok && ev.Kind == KindDevice {
+		dev.DeviceType = ev.DeviceType
+	}
+}
+
+// List returns the devices ordered by address.
+func (t *Devices) List() []Device {
+	t.mu.Lock()
+	out := make([]Device, 0, len(t.m))
+	for _, d := range t.m {
+		out = append(out, *d)
+	}
+	t.mu.Unlock()
+	slices.SortFunc(out, func(a, b Device) int { return int(a.Module) - int(b.Module) })
+	return out
+}
+
+// Len returns the number of devices in the table.
+func (t *Devices) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.m)
+}
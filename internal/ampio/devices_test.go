@@ -0,0 +1,81 @@
+package ampio
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestDevices(t *testing.T) {
+	tbl := NewDevices(Decoder{})
+	t0 := time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC)
+	for i, fr := range []can.Frame{
+		frame(0x1D000200, 0xFE, 0x01, 0x01),
+		frame(0x1D000123, 0xFE, 0x05, 0xEB, 0x00),
+		{CANID: 0x123, Len: 1},           // not a module
+		frame(0x1E000001, 0xFE, 0x01, 0), // other prefix
+		frame(0x1D000123, 0xFE, 0x00, 0x0A),
+		frame(0x1D000300, 0x0A, 0x01), // not a broadcast
+		frame(0x1D000400, 0xFE),       // no subtype
+	} {
+		tbl.Observe(&fr, t0.Add(time.Duration(i)*time.Second))
+	}
+	want := []Device{
+		{Module: 0x123, DeviceType: 0x0A, FirstSeen: t0.Add(time.Second), LastSeen: t0.Add(4 * time.Second), Frames: 2},
+		{Module: 0x200, FirstSeen: t0, LastSeen: t0, Frames: 1},
+	}
+	got := tbl.List()
+	if len(got) != len(want) {
+		t.Fatalf("got %+v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("device %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	// A full table keeps the modules it has.
+	for id := uint32(0); tbl.Len() < MaxDevices; id++ {
+		fr := frame(0x1D100000|id, 0xFE, 0x01, 0)
+		tbl.Observe(&fr, t0)
+	}
+	fr := frame(0x1DFFFFFF, 0xFE, 0x01, 0)
+	tbl.Observe(&fr, t0)
+	if tbl.Len() != MaxDevices {
+		t.Fatalf("table grew to %d", tbl.Len())
+	}
+}
+
+func TestDevicesHandler(t *testing.T) {
+	a, b := NewDevices(Decoder{}), NewDevices(Decoder{})
+	fr := frame(0x1D000123, 0xFE, 0x00, 0x0A)
+	a.Observe(&fr, time.Now())
+	h := Handler(map[string]*Devices{"a": a, "b": b})
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+	rec := get("/api/devices?instance=a")
+	var body struct {
+		Devices []map[string]any `json:"devices"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("%d %s: %v", rec.Code, rec.Body, err)
+	}
+	if len(body.Devices) != 1 || body.Devices[0]["module"] != "000123" || body.Devices[0]["device_type"] != float64(0x0A) || body.Devices[0]["frames"] != float64(1) {
+		t.Fatalf("devices %v", body.Devices)
+	}
+	if rec := get("/api/devices"); rec.Code != http.StatusNotFound {
+		t.Fatalf("no instance with two tables: %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/devices?instance=a", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST: %d", rec.Code)
+	}
+}
@@ -0,0 +1,44 @@
+package ampio
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/instances"
+)
+
+type deviceJSON struct {
+	Device
+	Age string `json:"age"` // time since LastSeen
+}
+
+// Handler exposes the device tables over HTTP. targets maps instance names
+// to tables; the ?instance= parameter selects one and may be omitted when
+// there is only one.
+//
+//	GET -> {"devices":[{"module":"000123","device_type":10,"first_seen":...,"last_seen":...,"frames":42,"age":"1.2s"}]}
+func Handler(targets map[string]*Devices) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		t, err := instances.Pick(targets, r.URL.Query().Get("instance"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		now := time.Now()
+		devs := t.List()
+		out := make([]deviceJSON, len(devs))
+		for i, d := range devs {
+			out[i] = deviceJSON{Device: d, Age: now.Sub(d.LastSeen).Round(100 * time.Millisecond).String()}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Devices []deviceJSON `json:"devices"`
+		}{out})
+	})
+}
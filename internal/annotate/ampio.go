@@ -0,0 +1,79 @@
+package annotate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// defaultAmpioPrefix is the top byte of the 29-bit IDs Ampio modules send
+// with; the low 24 bits carry the module address.
+const defaultAmpioPrefix = 0x1D
+
+func init() {
+	Register("ampio", newAmpio)
+}
+
+// newAmpio builds the decoder from "[0xNN][:<formats file>]": the ID prefix
+// byte, and a format file overriding the built-in database.
+func newAmpio(arg string) (Decoder, error) {
+	d := ampio{prefix: defaultAmpioPrefix, formats: BuiltinAmpioFormats()}
+	prefix, path, _ := strings.Cut(arg, ":")
+	v, err := strconv.ParseUint(prefix, 0, 8)
+	switch {
+	case prefix == "":
+	case err == nil:
+		d.prefix = uint32(v)
+	case errors.Is(err, strconv.ErrRange), path != "":
+		return nil, fmt.Errorf("ID prefix %q: want one byte, e.g. 0x1D", prefix)
+	default: // "ampio:<file>"
+		path = arg
+	}
+	if path == "" {
+		return d, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	o, err := ParseAmpioFormats(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	d.formats = d.formats.Override(o)
+	return d, nil
+}
+
+// ampio names the sending module and message type of Ampio frames: the
+// module address from the ID and the type byte from Data[0]. Types in the
+// format database are decoded into their fields as well.
+type ampio struct {
+	prefix  uint32
+	formats *AmpioFormats
+}
+
+func (d ampio) Annotate(fr *can.Frame) string {
+	if fr.CANID&can.CAN_EFF_FLAG == 0 || fr.CANID&(can.CAN_RTR_FLAG|can.CAN_ERR_FLAG) != 0 {
+		return ""
+	}
+	id := fr.CANID & can.CAN_EFF_MASK
+	if id>>24 != d.prefix {
+		return ""
+	}
+	if fr.Len == 0 {
+		return fmt.Sprintf("ampio module=%06X", id&0xFFFFFF)
+	}
+	note := fmt.Sprintf("ampio module=%06X type=0x%02X", id&0xFFFFFF, fr.Data[0])
+	if af := d.formats.lookup(fr); af != nil {
+		note += " " + af.describe(fr)
+	}
+	return note
+}
+
+// Version returns the revision of the format database.
+func (d ampio) Version() string { return d.formats.Revision() }
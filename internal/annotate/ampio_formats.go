@@ -0,0 +1,294 @@
+package annotate
+
+import (
+	_ "embed"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// AmpioFormatVersion is the schema version of Ampio format files this build
+// reads. Files with another version are rejected rather than misread.
+const AmpioFormatVersion = 1
+
+//go:embed ampio_formats.json
+var builtinAmpioFormats []byte
+
+// AmpioFormats maps Ampio message types to the layout of their payload.
+// Formats are data, not code: the built-in database ships embedded, and a
+// file in the same schema adds module types or replaces built-in entries.
+type AmpioFormats struct {
+	revision string
+	byType   map[byte]*ampioFormat   // formats matching on Data[0] alone
+	bySub    map[uint16]*ampioFormat // type<<8 | subtype (Data[1])
+}
+
+type ampioFormat struct {
+	name   string
+	event  string
+	fields []ampioField
+}
+
+// How a format is reported as a decoded module state (its "event"); the
+// Ampio state decoder builds its events from these. Formats without one
+// are only annotated.
+const (
+	AmpioEventDevice       = "device"       // the first field is the device type code
+	AmpioEventStates       = "states"       // bit masks of channels, lowest bit first
+	AmpioEventLevels       = "levels"       // one level per field
+	AmpioEventTemperatures = "temperatures" // one scaled value per field
+)
+
+type ampioField struct {
+	Name   string  `json:"name"`
+	Byte   int     `json:"byte"` // offset in Data
+	Size   int     `json:"size"` // 1, 2 or 4 bytes
+	Big    bool    `json:"big"`  // big endian; Ampio payloads are little endian
+	Signed bool    `json:"signed"`
+	Scale  float64 `json:"scale"` // 0 means 1
+	Offset float64 `json:"offset"`
+	Unit   string  `json:"unit"`
+	Hex    bool    `json:"hex"`   // raw value in hex, e.g. bit masks
+	First  int     `json:"first"` // channel of the lowest bit of a state mask; 0 means 1
+}
+
+type ampioFormatFile struct {
+	Version  int    `json:"version"`
+	Revision string `json:"revision"`
+	Formats  []struct {
+		Type    string       `json:"type"`
+		Subtype string       `json:"subtype"`
+		Name    string       `json:"name"`
+		Event   string       `json:"event"`
+		Fields  []ampioField `json:"fields"`
+	} `json:"formats"`
+}
+
+// BuiltinAmpioFormats returns the embedded format database.
+func BuiltinAmpioFormats() *AmpioFormats {
+	f, err := ParseAmpioFormats(strings.NewReader(string(builtinAmpioFormats)))
+	if err != nil {
+		panic("annotate: built-in Ampio formats: " + err.Error())
+	}
+	return f
+}
+
+// ParseAmpioFormats reads a format database in JSON:
+//
+//	{"version": 1, "revision": "...", "formats": [
+//	  {"type": "0xFE", "subtype": "0x05", "name": "temperature", "event": "temperatures", "fields": [
+//	    {"name": "t1", "byte": 2, "size": 2, "signed": true, "scale": 0.1, "unit": "degC"}]}]}
+//
+// subtype is optional and matches Data[1]. event is optional and names how
+// the format is reported as a module state (AmpioEventDevice and so on).
+func ParseAmpioFormats(r io.Reader) (*AmpioFormats, error) {
+	var file ampioFormatFile
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, err
+	}
+	if file.Version != AmpioFormatVersion {
+		return nil, fmt.Errorf("format version %d not supported (want %d)", file.Version, AmpioFormatVersion)
+	}
+	if file.Revision == "" {
+		return nil, errors.New("no revision")
+	}
+	f := &AmpioFormats{revision: file.Revision, byType: map[byte]*ampioFormat{}, bySub: map[uint16]*ampioFormat{}}
+	for i, e := range file.Formats {
+		typ, err := strconv.ParseUint(e.Type, 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("format %d: type %q: want one byte", i, e.Type)
+		}
+		if e.Name == "" {
+			return nil, fmt.Errorf("format %d: no name", i)
+		}
+		switch e.Event {
+		case "", AmpioEventDevice, AmpioEventStates, AmpioEventLevels, AmpioEventTemperatures:
+		default:
+			return nil, fmt.Errorf("format %s: unknown event %q (want device, states, levels or temperatures)", e.Name, e.Event)
+		}
+		for _, fd := range e.Fields {
+			if err := fd.check(); err != nil {
+				return nil, fmt.Errorf("format %s: %w", e.Name, err)
+			}
+		}
+		af := &ampioFormat{name: e.Name, event: e.Event, fields: e.Fields}
+		if e.Subtype == "" {
+			if f.byType[byte(typ)] != nil {
+				return nil, fmt.Errorf("format %s: type %s defined twice", e.Name, e.Type)
+			}
+			f.byType[byte(typ)] = af
+			continue
+		}
+		sub, err := strconv.ParseUint(e.Subtype, 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("format %s: subtype %q: want one byte", e.Name, e.Subtype)
+		}
+		key := uint16(typ)<<8 | uint16(sub)
+		if f.bySub[key] != nil {
+			return nil, fmt.Errorf("format %s: type %s subtype %s defined twice", e.Name, e.Type, e.Subtype)
+		}
+		f.bySub[key] = af
+	}
+	return f, nil
+}
+
+func (fd ampioField) check() error {
+	if fd.Name == "" {
+		return errors.New("field without a name")
+	}
+	switch fd.Size {
+	case 1, 2, 4:
+	default:
+		return fmt.Errorf("field %s: size %d (want 1, 2 or 4)", fd.Name, fd.Size)
+	}
+	if fd.Byte < 0 || fd.Byte+fd.Size > 8 { // Ampio runs classic CAN
+		return fmt.Errorf("field %s: bytes %d..%d outside the payload", fd.Name, fd.Byte, fd.Byte+fd.Size-1)
+	}
+	if fd.First < 0 {
+		return fmt.Errorf("field %s: first channel %d", fd.Name, fd.First)
+	}
+	return nil
+}
+
+// Override returns f with the formats of o added, o's entries replacing
+// those of f for the same type and subtype. The revision names both.
+func (f *AmpioFormats) Override(o *AmpioFormats) *AmpioFormats {
+	out := &AmpioFormats{revision: f.revision + "+" + o.revision, byType: map[byte]*ampioFormat{}, bySub: map[uint16]*ampioFormat{}}
+	for _, src := range []*AmpioFormats{f, o} {
+		for k, v := range src.byType {
+			out.byType[k] = v
+		}
+		for k, v := range src.bySub {
+			out.bySub[k] = v
+		}
+	}
+	return out
+}
+
+// Revision returns the revision of the database, "<built-in>+<file>" for a
+// built-in database overridden by a file.
+func (f *AmpioFormats) Revision() string { return f.revision }
+
+// Len returns the number of known formats.
+func (f *AmpioFormats) Len() int { return len(f.byType) + len(f.bySub) }
+
+// lookup returns the format of fr, preferring a subtype match.
+func (f *AmpioFormats) lookup(fr *can.Frame) *ampioFormat {
+	if f == nil || fr.Len == 0 {
+		return nil
+	}
+	if fr.Len > 1 {
+		if af := f.bySub[uint16(fr.Data[0])<<8|uint16(fr.Data[1])]; af != nil {
+			return af
+		}
+	}
+	return f.byType[fr.Data[0]]
+}
+
+// describe returns the format name and the fields that fit in fr.
+func (af *ampioFormat) describe(fr *can.Frame) string {
+	var b strings.Builder
+	b.WriteString(af.name)
+	for _, fd := range af.fields {
+		if fd.Byte+fd.Size > int(fr.Len) {
+			continue
+		}
+		b.WriteByte(' ')
+		b.WriteString(fd.Name)
+		b.WriteByte('=')
+		b.WriteString(fd.format(fr.Data[fd.Byte : fd.Byte+fd.Size]))
+	}
+	return b.String()
+}
+
+func (fd ampioField) format(p []byte) string {
+	raw := fd.raw(p)
+	if fd.Hex {
+		return fmt.Sprintf("0x%0*X", fd.Size*2, raw)
+	}
+	return fmt.Sprintf("%g%s", fd.value(raw), fd.Unit)
+}
+
+func (fd ampioField) raw(p []byte) uint32 {
+	switch {
+	case fd.Size == 1:
+		return uint32(p[0])
+	case fd.Size == 2 && fd.Big:
+		return uint32(binary.BigEndian.Uint16(p))
+	case fd.Size == 2:
+		return uint32(binary.LittleEndian.Uint16(p))
+	case fd.Big:
+		return binary.BigEndian.Uint32(p)
+	}
+	return binary.LittleEndian.Uint32(p)
+}
+
+// value applies sign, scale and offset to raw.
+func (fd ampioField) value(raw uint32) float64 {
+	v := float64(raw)
+	if fd.Signed {
+		shift := 32 - 8*fd.Size
+		v = float64(int32(raw<<shift) >> shift)
+	}
+	if fd.Scale != 0 {
+		v *= fd.Scale
+	}
+	return v + fd.Offset
+}
+
+// AmpioMessage is a frame decoded by its format.
+type AmpioMessage struct {
+	Name   string       // format name
+	Event  string       // AmpioEvent*, "" for formats that are only annotated
+	Fields []AmpioValue // the fields the frame carries, in database order
+}
+
+// AmpioValue is one decoded field.
+type AmpioValue struct {
+	Name string
+	// Bytes is how many bytes of the field the frame carries. A little
+	// endian field cut short by the frame length keeps its low bytes in
+	// Raw, which suits state masks; other fields are complete.
+	Bytes, Size int
+	Raw         uint32
+	Value       float64 // Raw with sign, scale and offset; complete fields only
+	First       int     // channel of the lowest bit of a state mask
+}
+
+// Complete reports whether the frame carries the whole field.
+func (v AmpioValue) Complete() bool { return v.Bytes == v.Size }
+
+// Decode decodes fr by its format; it reports false for frames without
+// one.
+func (f *AmpioFormats) Decode(fr *can.Frame) (AmpioMessage, bool) {
+	af := f.lookup(fr)
+	if af == nil {
+		return AmpioMessage{}, false
+	}
+	m := AmpioMessage{Name: af.name, Event: af.event}
+	for _, fd := range af.fields {
+		n := min(int(fr.Len), fd.Byte+fd.Size) - fd.Byte
+		if n <= 0 || n < fd.Size && fd.Big {
+			continue
+		}
+		v := AmpioValue{Name: fd.Name, Bytes: n, Size: fd.Size, First: max(fd.First, 1)}
+		if n == fd.Size {
+			v.Raw = fd.raw(fr.Data[fd.Byte:])
+			v.Value = fd.value(v.Raw)
+		} else {
+			for i := n - 1; i >= 0; i-- {
+				v.Raw = v.Raw<<8 | uint32(fr.Data[fd.Byte+i])
+			}
+		}
+		m.Fields = append(m.Fields, v)
+	}
+	return m, true
+}
@@ -0,0 +1,174 @@
+// Package annotate attaches human-readable descriptions to CAN frames.
+// Decoders (Ampio, J1939, DBC files, ...) are registered by name; a Pipeline
+// runs the configured ones, and every consumer (event stream, capture
+// download, debug log) selects the subset it wants.
+package annotate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// Decoder describes the frames it recognises. Annotate returns "" for
+// frames it does not know.
+type Decoder interface {
+	Annotate(fr *can.Frame) string
+}
+
+// Versioned is implemented by decoders driven by versioned data, such as
+// the Ampio format database, so the revision in use can be reported.
+type Versioned interface {
+	Version() string
+}
+
+// Factory builds a decoder from the argument after "name:" in a spec
+// (empty when there is none, e.g. the DBC file path for "dbc:bus.dbc").
+type Factory func(arg string) (Decoder, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a decoder available to New under name. It panics on a
+// duplicate name, like other registration-at-init APIs.
+func Register(name string, f Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, dup := registry[name]; dup {
+		panic("annotate: decoder " + name + " registered twice")
+	}
+	registry[name] = f
+}
+
+// Available lists the registered decoder names.
+func Available() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for n := range registry {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Pipeline runs decoders in order. A nil Pipeline annotates nothing.
+type Pipeline struct {
+	names []string
+	decs  []Decoder
+}
+
+// New builds a pipeline from a comma separated list of decoder specs,
+// "name" or "name:arg" (e.g. "ampio,j1939,dbc:/etc/can/bus.dbc"). An empty
+// spec returns nil.
+func New(spec string) (*Pipeline, error) {
+	var p Pipeline
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		name, arg, _ := strings.Cut(s, ":")
+		registryMu.RLock()
+		f := registry[name]
+		registryMu.RUnlock()
+		if f == nil {
+			return nil, fmt.Errorf("unknown decoder %q (have %s)", name, strings.Join(Available(), ", "))
+		}
+		for _, n := range p.names {
+			if n == name {
+				return nil, fmt.Errorf("decoder %q listed twice", name)
+			}
+		}
+		d, err := f(arg)
+		if err != nil {
+			return nil, fmt.Errorf("decoder %s: %w", name, err)
+		}
+		p.names = append(p.names, name)
+		p.decs = append(p.decs, d)
+	}
+	if len(p.decs) == 0 {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+// Names lists the decoders of p in order.
+func (p *Pipeline) Names() []string {
+	if p == nil {
+		return nil
+	}
+	return append([]string(nil), p.names...)
+}
+
+// Versions lists "name=version" for the decoders of p that report one.
+func (p *Pipeline) Versions() []string {
+	if p == nil {
+		return nil
+	}
+	var out []string
+	for i, d := range p.decs {
+		if v, ok := d.(Versioned); ok {
+			out = append(out, p.names[i]+"="+v.Version())
+		}
+	}
+	return out
+}
+
+// Select returns the part of p a subscriber asked for: "" selects nothing
+// (nil), "all" the whole pipeline, otherwise a comma separated list of
+// decoder names configured in p.
+func (p *Pipeline) Select(names string) (*Pipeline, error) {
+	switch names = strings.TrimSpace(names); names {
+	case "":
+		return nil, nil
+	case "all":
+		return p, nil
+	}
+	var out Pipeline
+	for _, n := range strings.Split(names, ",") {
+		n = strings.TrimSpace(n)
+		i := p.index(n)
+		if i < 0 {
+			return nil, fmt.Errorf("decoder %q not configured (have %s)", n, strings.Join(p.Names(), ", "))
+		}
+		out.names = append(out.names, n)
+		out.decs = append(out.decs, p.decs[i])
+	}
+	return &out, nil
+}
+
+func (p *Pipeline) index(name string) int {
+	if p == nil {
+		return -1
+	}
+	for i, n := range p.names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Annotate returns the descriptions of fr from every decoder that
+// recognises it, joined with "; ", or "" when none does.
+func (p *Pipeline) Annotate(fr *can.Frame) string {
+	if p == nil {
+		return ""
+	}
+	var out string
+	for _, d := range p.decs {
+		if s := d.Annotate(fr); s != "" {
+			if out != "" {
+				out += "; "
+			}
+			out += s
+		}
+	}
+	return out
+}
@@ -0,0 +1,146 @@
+package annotate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+const testDBC = `VERSION ""
+
+BO_ 256 Engine: 8 ECU
+ SG_ Speed : 0|16@1+ (0.25,0) [0|16383] "rpm" Dash
+ SG_ Temp : 23|8@0- (1,-40) [-40|215] "degC" Dash
+
+BO_ 2566844672 Mux: 8 ECU
+ SG_ Sel M : 0|8@1+ (1,0) [0|255] "" Dash
+ SG_ A m1 : 8|8@1+ (1,0) [0|255] "" Dash
+ SG_ B m2 : 8|8@1+ (1,0) [0|255] "" Dash
+`
+
+func TestPipeline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bus.dbc")
+	if err := os.WriteFile(path, []byte(testDBC), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New("ampio,j1939,dbc:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Speed 0x0FA0*0.25 = 1000 (Intel); Temp byte 2 = 0xFB = -5 -> -45 (Motorola, signed).
+	fr := can.Frame{CANID: 0x100, Len: 3, Data: [64]byte{0xA0, 0x0F, 0xFB}}
+	if got := p.Annotate(&fr); got != "Engine Speed=1000rpm Temp=-45degC" {
+		t.Fatalf("dbc: %q", got)
+	}
+	// 0x18FEF100 (DBC ID 0x98FEF100 with the extended bit) is also J1939 CCVS.
+	fr = can.Frame{CANID: 0x18FEF100 | can.CAN_EFF_FLAG, Len: 2, Data: [64]byte{2, 7}}
+	if got := p.Annotate(&fr); got != "j1939 pgn=65265 CCVS prio=6 sa=0; Mux Sel=2 B=7" {
+		t.Fatalf("j1939+dbc mux: %q", got)
+	}
+	fr = can.Frame{CANID: 0x1D000123 | can.CAN_EFF_FLAG, Len: 1, Data: [64]byte{0xFE}}
+	if got := p.Annotate(&fr); !strings.HasPrefix(got, "ampio module=000123 type=0xFE; j1939") {
+		t.Fatalf("ampio: %q", got)
+	}
+
+	// Subscribers pick a subset.
+	sub, err := p.Select("ampio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sub.Annotate(&fr); got != "ampio module=000123 type=0xFE" {
+		t.Fatalf("selected: %q", got)
+	}
+	if none, _ := p.Select(""); none.Annotate(&fr) != "" {
+		t.Fatal("empty selection annotated")
+	}
+	if _, err := p.Select("nope"); err == nil {
+		t.Fatal("expected error for unconfigured decoder")
+	}
+	if _, err := New("bogus"); err == nil {
+		t.Fatal("expected error for unknown decoder")
+	}
+}
+
+func TestAmpioFormats(t *testing.T) {
+	p, err := New("ampio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := p.Versions(); len(v) != 1 || v[0] != "ampio="+BuiltinAmpioFormats().Revision() {
+		t.Fatalf("versions %v", v)
+	}
+	// t1 0x00EB = 23.5, t2 0xFFF6 = -1; t3 lies beyond the frame.
+	fr := can.Frame{CANID: 0x1D000123 | can.CAN_EFF_FLAG, Len: 6, Data: [64]byte{0xFE, 0x05, 0xEB, 0x00, 0xF6, 0xFF}}
+	if got := p.Annotate(&fr); got != "ampio module=000123 type=0xFE temperature t1=23.5degC t2=-1degC" {
+		t.Fatalf("temperature: %q", got)
+	}
+
+	// A file adds types and replaces built-in ones.
+	path := filepath.Join(t.TempDir(), "ampio.json")
+	file := `{"version": 1, "revision": "site-1", "formats": [
+		{"type": "0xFE", "subtype": "0x05", "name": "temp", "fields": [{"name": "t", "byte": 2, "size": 2, "big": true}]},
+		{"type": "0x30", "name": "scene", "fields": [{"name": "id", "byte": 1, "size": 1, "hex": true}]}]}`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err = New("ampio:0x1E:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr.CANID = 0x1E000123 | can.CAN_EFF_FLAG
+	if got := p.Annotate(&fr); got != "ampio module=000123 type=0xFE temp t=60160" {
+		t.Fatalf("override: %q", got)
+	}
+	fr.Len, fr.Data[0], fr.Data[1] = 2, 0x30, 0x07
+	if got := p.Annotate(&fr); got != "ampio module=000123 type=0x30 scene id=0x07" {
+		t.Fatalf("added: %q", got)
+	}
+	if v := p.Versions(); v[0] != "ampio="+BuiltinAmpioFormats().Revision()+"+site-1" {
+		t.Fatalf("override versions %v", v)
+	}
+	if _, err := New("ampio:" + path); err != nil {
+		t.Fatalf("file without prefix: %v", err)
+	}
+
+	for _, bad := range []string{
+		`{"version": 2, "revision": "x", "formats": []}`,
+		`{"version": 1, "formats": []}`,
+		`{"version": 1, "revision": "x", "formats": [{"type": "0x100", "name": "a"}]}`,
+		`{"version": 1, "revision": "x", "formats": [{"type": "1", "name": "a", "fields": [{"name": "f", "byte": 6, "size": 4}]}]}`,
+		`{"version": 1, "revision": "x", "formats": [{"type": "1", "name": "a"}, {"type": "1", "name": "b"}]}`,
+		`{"version": 1, "revision": "x", "formats": [], "extra": 1}`,
+		`{"version": 1, "revision": "x", "formats": [{"type": "1", "name": "a", "event": "volts"}]}`,
+	} {
+		if _, err := ParseAmpioFormats(strings.NewReader(bad)); err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+	if _, err := New("ampio:0x1FF"); err == nil {
+		t.Error("two-byte prefix accepted")
+	}
+}
+
+func TestAmpioFormatsDecode(t *testing.T) {
+	f := BuiltinAmpioFormats()
+	// Fields cut short by the frame keep their low bytes and no value.
+	fr := can.Frame{Len: 3, Data: [64]byte{0xFE, 0x02, 0x81}}
+	m, ok := f.Decode(&fr)
+	if !ok || m.Name != "inputs_ext" || m.Event != AmpioEventStates || len(m.Fields) != 1 {
+		t.Fatalf("inputs: %+v ok=%v", m, ok)
+	}
+	if v := m.Fields[0]; v.Raw != 0x81 || v.Bytes != 1 || v.Complete() || v.First != 33 {
+		t.Fatalf("partial mask: %+v", v)
+	}
+	fr = can.Frame{Len: 5, Data: [64]byte{0xFE, 0x05, 0xEB, 0x00, 0xF6}}
+	if m, _ := f.Decode(&fr); len(m.Fields) != 2 || m.Fields[0].Value != 23.5 || !m.Fields[0].Complete() || m.Fields[1].Complete() {
+		t.Fatalf("temperature: %+v", m)
+	}
+	fr.Data[0] = 0x30
+	if m, ok := f.Decode(&fr); ok {
+		t.Fatalf("unknown type: %+v", m)
+	}
+}
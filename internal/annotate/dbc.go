@@ -0,0 +1,210 @@
+package annotate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func init() {
+	Register("dbc", func(path string) (Decoder, error) {
+		if path == "" {
+			return nil, errors.New("want dbc:<file>")
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ParseDBC(f)
+	})
+}
+
+// dbcExtended marks extended IDs in DBC BO_ lines (and our message keys).
+const dbcExtended = 0x80000000
+
+type dbcSignal struct {
+	name      string
+	start     uint
+	size      uint
+	motorola  bool
+	signed    bool
+	factor    float64
+	offset    float64
+	unit      string
+	mux       bool // multiplexer switch
+	muxVal    int  // >= 0: only present when the switch has this value
+	hasMuxVal bool
+}
+
+type dbcMessage struct {
+	name    string
+	signals []dbcSignal
+}
+
+// DBC decodes frames with the messages and signals of a Vector DBC file.
+// Only the BO_ and SG_ definitions are used (including simple
+// multiplexing); value tables and attributes are ignored.
+type DBC struct {
+	msgs map[uint32]*dbcMessage // key: ID | dbcExtended for 29-bit IDs
+}
+
+// ParseDBC reads DBC definitions from r.
+func ParseDBC(r io.Reader) (*DBC, error) {
+	d := &DBC{msgs: make(map[uint32]*dbcMessage)}
+	var cur *dbcMessage
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case strings.HasPrefix(line, "BO_ "):
+			f := strings.Fields(line)
+			if len(f) < 3 {
+				return nil, fmt.Errorf("line %d: malformed BO_", ln)
+			}
+			id, err := strconv.ParseUint(f[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: message ID: %w", ln, err)
+			}
+			cur = &dbcMessage{name: strings.TrimSuffix(f[2], ":")}
+			d.msgs[uint32(id)] = cur
+		case strings.HasPrefix(line, "SG_ "):
+			if cur == nil {
+				return nil, fmt.Errorf("line %d: SG_ outside a message", ln)
+			}
+			sig, err := parseDBCSignal(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", ln, err)
+			}
+			cur.signals = append(cur.signals, sig)
+		case line == "":
+			cur = nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// parseDBCSignal parses
+//
+//	SG_ name [M|mN] : start|size@order sign (factor,offset) [min|max] "unit" receivers
+func parseDBCSignal(line string) (dbcSignal, error) {
+	var s dbcSignal
+	head, rest, ok := strings.Cut(strings.TrimPrefix(line, "SG_ "), ":")
+	if !ok {
+		return s, errors.New("malformed SG_")
+	}
+	hf := strings.Fields(head)
+	if len(hf) == 0 {
+		return s, errors.New("SG_ without a name")
+	}
+	s.name = hf[0]
+	if len(hf) > 1 {
+		switch m := hf[1]; {
+		case m == "M":
+			s.mux = true
+		case strings.HasPrefix(m, "m"):
+			v, err := strconv.Atoi(strings.TrimSuffix(m[1:], "M"))
+			if err != nil {
+				return s, fmt.Errorf("signal %s: multiplex indicator %q", s.name, m)
+			}
+			s.muxVal, s.hasMuxVal = v, true
+		}
+	}
+	rf := strings.Fields(rest)
+	if len(rf) < 2 {
+		return s, fmt.Errorf("signal %s: missing layout", s.name)
+	}
+	var order, sign byte
+	if n, err := fmt.Sscanf(rf[0], "%d|%d@%c%c", &s.start, &s.size, &order, &sign); n != 4 || err != nil || s.size == 0 || s.size > 64 {
+		return s, fmt.Errorf("signal %s: layout %q", s.name, rf[0])
+	}
+	s.motorola, s.signed = order == '0', sign == '-'
+	if n, err := fmt.Sscanf(rf[1], "(%g,%g)", &s.factor, &s.offset); n != 2 || err != nil {
+		return s, fmt.Errorf("signal %s: scaling %q", s.name, rf[1])
+	}
+	if i := strings.IndexByte(rest, '"'); i >= 0 {
+		if j := strings.IndexByte(rest[i+1:], '"'); j >= 0 {
+			s.unit = rest[i+1 : i+1+j]
+		}
+	}
+	return s, nil
+}
+
+// raw extracts the signal bits from data.
+func (s *dbcSignal) raw(data []byte) uint64 {
+	var buf [8]byte
+	copy(buf[:], data)
+	mask := uint64(1)<<s.size - 1
+	if s.size == 64 {
+		mask = ^uint64(0)
+	}
+	var v uint64
+	if s.motorola {
+		// Start is the MSB in the DBC sawtooth numbering; convert it to the
+		// bit index from the top of the big-endian 64-bit word.
+		msb := (s.start/8)*8 + (7 - s.start%8)
+		if msb+s.size > 64 {
+			return 0
+		}
+		v = binary.BigEndian.Uint64(buf[:]) >> (64 - msb - s.size)
+	} else {
+		if s.start+s.size > 64 {
+			return 0
+		}
+		v = binary.LittleEndian.Uint64(buf[:]) >> s.start
+	}
+	return v & mask
+}
+
+func (s *dbcSignal) value(data []byte) float64 {
+	r := s.raw(data)
+	if s.signed && s.size < 64 && r&(1<<(s.size-1)) != 0 {
+		return float64(int64(r|^(uint64(1)<<s.size-1)))*s.factor + s.offset
+	}
+	if s.signed {
+		return float64(int64(r))*s.factor + s.offset
+	}
+	return float64(r)*s.factor + s.offset
+}
+
+// Annotate implements Decoder: "MessageName sig=value[unit] ...".
+func (d *DBC) Annotate(fr *can.Frame) string {
+	if fr.CANID&(can.CAN_RTR_FLAG|can.CAN_ERR_FLAG) != 0 {
+		return ""
+	}
+	key := fr.CANID & can.CAN_SFF_MASK
+	if fr.CANID&can.CAN_EFF_FLAG != 0 {
+		key = fr.CANID&can.CAN_EFF_MASK | dbcExtended
+	}
+	m := d.msgs[key]
+	if m == nil {
+		return ""
+	}
+	data := fr.Data[:min(int(fr.Len), 8)]
+	mux := -1
+	for i := range m.signals {
+		if m.signals[i].mux {
+			mux = int(m.signals[i].raw(data))
+		}
+	}
+	var b strings.Builder
+	b.WriteString(m.name)
+	for i := range m.signals {
+		s := &m.signals[i]
+		if s.hasMuxVal && s.muxVal != mux {
+			continue
+		}
+		fmt.Fprintf(&b, " %s=%g%s", s.name, s.value(data), s.unit)
+	}
+	return b.String()
+}
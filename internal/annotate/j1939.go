@@ -0,0 +1,54 @@
+package annotate
+
+import (
+	"fmt"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func init() {
+	Register("j1939", func(string) (Decoder, error) { return j1939{}, nil })
+}
+
+// j1939PGNs names a few common parameter groups.
+var j1939PGNs = map[uint32]string{
+	59392: "ACK",
+	59904: "Request",
+	60160: "TP.DT",
+	60416: "TP.CM",
+	60928: "Address Claimed",
+	61443: "EEC2",
+	61444: "EEC1",
+	65226: "DM1",
+	65262: "ET1",
+	65263: "EFL/P1",
+	65265: "CCVS",
+	65266: "LFE",
+	65269: "AMB",
+	65270: "IC1",
+	65271: "VEP1",
+}
+
+// j1939 decodes the 29-bit identifier layout of SAE J1939: priority,
+// parameter group number, destination (PDU1) and source address.
+type j1939 struct{}
+
+func (j1939) Annotate(fr *can.Frame) string {
+	if fr.CANID&can.CAN_EFF_FLAG == 0 || fr.CANID&(can.CAN_RTR_FLAG|can.CAN_ERR_FLAG) != 0 {
+		return ""
+	}
+	id := fr.CANID & can.CAN_EFF_MASK
+	prio := id >> 26
+	pgn := (id >> 8) & 0x3FFFF
+	sa := id & 0xFF
+	dst := ""
+	if pf := (pgn >> 8) & 0xFF; pf < 240 { // PDU1: PS is the destination address
+		dst = fmt.Sprintf(" da=%d", pgn&0xFF)
+		pgn &^= 0xFF
+	}
+	name := ""
+	if n, ok := j1939PGNs[pgn]; ok {
+		name = " " + n
+	}
+	return fmt.Sprintf("j1939 pgn=%d%s prio=%d sa=%d%s", pgn, name, prio, sa, dst)
+}
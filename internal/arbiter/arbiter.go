@@ -0,0 +1,286 @@
+// Package arbiter elects one active gateway among redundant gateways
+// attached to the same CAN bus, so that only the active one writes client
+// frames to the bus and commands are not sent twice.
+//
+// Every gateway broadcasts a heartbeat frame on a reserved CAN ID:
+//
+//	byte 0     version (1)
+//	byte 1     state: 0 standby, 1 active
+//	byte 2     priority (higher wins)
+//	bytes 3-6  node ID, random per process (big endian)
+//	byte 7     reserved (0)
+//
+// A gateway that hears no heartbeat for three intervals considers the
+// sender gone. A standby gateway becomes active when no live gateway is
+// active and it ranks first among the live ones (highest priority, then
+// lowest node ID). An active gateway stays active until it hears a
+// better-ranked active one, which resolves two gateways taking over at
+// once; a recovered gateway with a higher priority does not preempt it.
+// A starting gateway listens for one timeout before it may take over.
+package arbiter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+	"github.com/kstaniek/go-ampio-server/internal/inhibit"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+const (
+	// DefaultInterval is the heartbeat period.
+	DefaultInterval = 200 * time.Millisecond
+	// DefaultPriority is the election priority of a gateway.
+	DefaultPriority = 100
+	// timeoutBeats is how many heartbeat periods a peer may stay silent.
+	timeoutBeats = 3
+
+	version      = 1
+	beatLen      = 8
+	stateStandby = 0
+	stateActive  = 1
+)
+
+var (
+	// ErrStandby is returned for client frames dropped because the gateway
+	// is on standby. It wraps inhibit.ErrInhibited, so clients see the
+	// inhibited acknowledgement status.
+	ErrStandby = fmt.Errorf("%w: gateway on standby", inhibit.ErrInhibited)
+	// ErrReserved is returned for client frames using the heartbeat ID.
+	ErrReserved = fmt.Errorf("%w: arbitration heartbeat ID", filter.ErrDenied)
+)
+
+// active counts active Arbiters for the process-wide gauge.
+var active atomic.Int64
+
+// ParseID parses a heartbeat ID in candump notation: up to 3 hex digits for
+// a standard ID, 8 for an extended one.
+func ParseID(s string) (uint32, error) {
+	fr, err := can.ParseFrame(s + "#")
+	if err != nil {
+		return 0, fmt.Errorf("arbitration id %q: want up to 3 (standard) or 8 (extended) hex digits", s)
+	}
+	return fr.CANID, nil
+}
+
+// Config configures an Arbiter.
+type Config struct {
+	ID       uint32        // heartbeat CAN ID (CAN_EFF_FLAG set for extended)
+	Priority uint8         // election priority; higher wins
+	Interval time.Duration // heartbeat period (0: DefaultInterval)
+	Logger   *slog.Logger
+}
+
+type peer struct {
+	priority uint8
+	active   bool
+	seen     time.Time
+}
+
+// Arbiter runs the election of one gateway. Check is cheap enough for
+// every client frame.
+type Arbiter struct {
+	cfg     Config
+	node    uint32
+	timeout time.Duration
+	l       *slog.Logger
+	now     func() time.Time
+
+	on       atomic.Bool
+	mu       sync.Mutex // guards the fields below
+	peers    map[uint32]peer
+	started  time.Time
+	sendFail bool
+}
+
+// New returns an Arbiter on standby with a random node ID.
+func New(cfg Config) *Arbiter {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return &Arbiter{
+		cfg:     cfg,
+		node:    binary.BigEndian.Uint32(b[:]),
+		timeout: timeoutBeats * cfg.Interval,
+		l:       cfg.Logger,
+		now:     time.Now,
+		peers:   make(map[uint32]peer),
+	}
+}
+
+// Node returns the node ID sent in heartbeats.
+func (a *Arbiter) Node() uint32 { return a.node }
+
+// ID returns the heartbeat CAN ID.
+func (a *Arbiter) ID() uint32 { return a.cfg.ID }
+
+// Active reports whether this gateway is the active one.
+func (a *Arbiter) Active() bool { return a.on.Load() }
+
+// Check returns ErrReserved for a client frame on the heartbeat ID and
+// ErrStandby (counting the frame) while the gateway is on standby.
+func (a *Arbiter) Check(fr *can.Frame) error {
+	if fr.CANID&^can.CAN_RTR_FLAG == a.cfg.ID {
+		return ErrReserved
+	}
+	if !a.on.Load() {
+		metrics.IncArbitrationDropped()
+		return ErrStandby
+	}
+	return nil
+}
+
+// Observe feeds a bus frame to the election; frames on other IDs and the
+// gateway's own heartbeats are ignored. It may be called from the hub tap.
+func (a *Arbiter) Observe(fr can.Frame) {
+	if fr.CANID != a.cfg.ID || fr.Len != beatLen || fr.Data[0] != version {
+		return
+	}
+	node := binary.BigEndian.Uint32(fr.Data[3:7])
+	if node == a.node {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	if _, known := a.peers[node]; !known {
+		a.l.Info("arbitration_peer_seen", "node", fmt.Sprintf("%08x", node), "priority", fr.Data[2])
+	}
+	a.peers[node] = peer{priority: fr.Data[2], active: fr.Data[1] == stateActive, seen: now}
+	a.electLocked(now)
+}
+
+// Run sends heartbeats with send and re-runs the election every interval
+// until ctx is done, then gives up the active role. send writes to the bus
+// directly; it must not be gated by Check.
+func (a *Arbiter) Run(ctx context.Context, send func(can.Frame) error) {
+	a.mu.Lock()
+	a.started = a.now()
+	a.mu.Unlock()
+	t := time.NewTicker(a.cfg.Interval)
+	defer t.Stop()
+	for {
+		a.tick(send)
+		select {
+		case <-ctx.Done():
+			a.Close()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// tick expires silent peers, runs the election and sends a heartbeat.
+func (a *Arbiter) tick(send func(can.Frame) error) {
+	a.mu.Lock()
+	now := a.now()
+	for node, p := range a.peers {
+		if now.Sub(p.seen) > a.timeout {
+			delete(a.peers, node)
+			a.l.Warn("arbitration_peer_lost", "node", fmt.Sprintf("%08x", node), "was_active", p.active)
+		}
+	}
+	a.electLocked(now)
+	beat := a.heartbeat()
+	a.mu.Unlock()
+	err := send(beat)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case err != nil && !a.sendFail:
+		a.sendFail = true
+		a.l.Warn("arbitration_heartbeat_error", "error", err)
+	case err == nil && a.sendFail:
+		a.sendFail = false
+		a.l.Info("arbitration_heartbeat_recovered")
+	}
+}
+
+// heartbeat builds the heartbeat frame for the current state.
+func (a *Arbiter) heartbeat() can.Frame {
+	fr := can.Frame{CANID: a.cfg.ID, Len: beatLen}
+	fr.Data[0], fr.Data[1], fr.Data[2] = version, stateStandby, a.cfg.Priority
+	if a.on.Load() {
+		fr.Data[1] = stateActive
+	}
+	binary.BigEndian.PutUint32(fr.Data[3:7], a.node)
+	return fr
+}
+
+// outranks reports whether a peer with priority and node wins the
+// election against this gateway.
+func (a *Arbiter) outranks(priority uint8, node uint32) bool {
+	if priority != a.cfg.Priority {
+		return priority > a.cfg.Priority
+	}
+	return node < a.node
+}
+
+// electLocked applies the election rules (see the package doc). Callers
+// hold mu.
+func (a *Arbiter) electLocked(now time.Time) {
+	anyActive, better, betterActive := false, false, false
+	for node, p := range a.peers {
+		wins := a.outranks(p.priority, node)
+		anyActive = anyActive || p.active
+		better = better || wins
+		betterActive = betterActive || (wins && p.active)
+	}
+	if a.on.Load() {
+		if betterActive {
+			a.setLocked(false, "better_active_peer")
+		}
+		return
+	}
+	if a.started.IsZero() || now.Sub(a.started) < a.timeout {
+		return // still listening for an active gateway
+	}
+	if !anyActive && !better {
+		a.setLocked(true, "no_active_peer")
+	}
+}
+
+func (a *Arbiter) setLocked(on bool, reason string) {
+	if a.on.Swap(on) == on {
+		return
+	}
+	state := metrics.ArbitrationStandby
+	if on {
+		state = metrics.ArbitrationActive
+		metrics.SetArbitrationActive(int(active.Add(1)))
+		a.l.Warn("arbitration_active", "reason", reason, "node", fmt.Sprintf("%08x", a.node), "peers", len(a.peers))
+	} else {
+		metrics.SetArbitrationActive(int(active.Add(-1)))
+		a.l.Warn("arbitration_standby", "reason", reason, "node", fmt.Sprintf("%08x", a.node), "peers", len(a.peers))
+	}
+	metrics.IncArbitrationTransition(state)
+}
+
+// Close gives up the active role and its share of the process-wide gauge.
+// A last heartbeat is not sent; peers take over after the timeout.
+func (a *Arbiter) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.setLocked(false, "shutdown")
+}
+
+// State returns "active" or "standby".
+func (a *Arbiter) State() string {
+	if a.on.Load() {
+		return metrics.ArbitrationActive
+	}
+	return metrics.ArbitrationStandby
+}
@@ -0,0 +1,128 @@
+package arbiter
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+	"github.com/kstaniek/go-ampio-server/internal/inhibit"
+)
+
+// node is an Arbiter on a simulated bus with a manual clock.
+type node struct {
+	*Arbiter
+	t    *time.Time
+	sent []can.Frame
+}
+
+func newNode(t *time.Time, priority uint8, id uint32) *node {
+	a := New(Config{ID: 0x7F0, Priority: priority, Interval: 100 * time.Millisecond,
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	a.node = id
+	a.now = func() time.Time { return *t }
+	a.started = *t
+	return &node{Arbiter: a, t: t}
+}
+
+// step advances the clock by one interval, ticks every node and delivers
+// each heartbeat to the other nodes.
+func step(t *time.Time, nodes ...*node) {
+	*t = t.Add(100 * time.Millisecond)
+	for _, n := range nodes {
+		n.tick(func(fr can.Frame) error { n.sent = append(n.sent, fr); return nil })
+	}
+	for _, n := range nodes {
+		for _, fr := range n.sent {
+			for _, o := range nodes {
+				o.Observe(fr) // own heartbeats are ignored
+			}
+		}
+		n.sent = nil
+	}
+}
+
+func TestElection(t *testing.T) {
+	now := time.Unix(0, 0)
+	a, b := newNode(&now, 100, 2), newNode(&now, 200, 3)
+	defer a.Close()
+	defer b.Close()
+	step(&now, a, b)
+	if a.Active() || b.Active() {
+		t.Fatal("took over while listening")
+	}
+	for range 4 {
+		step(&now, a, b)
+	}
+	if a.Active() || !b.Active() {
+		t.Fatalf("active a=%v b=%v; want the higher priority", a.Active(), b.Active())
+	}
+	fr := can.Frame{CANID: 0x100}
+	if err := a.Check(&fr); !errors.Is(err, ErrStandby) || !errors.Is(err, inhibit.ErrInhibited) {
+		t.Fatalf("standby check: %v", err)
+	}
+	if err := b.Check(&fr); err != nil {
+		t.Fatalf("active check: %v", err)
+	}
+	beat := can.Frame{CANID: 0x7F0}
+	if err := b.Check(&beat); !errors.Is(err, filter.ErrDenied) {
+		t.Fatalf("heartbeat ID: %v", err)
+	}
+
+	// b falls silent: a takes over after the timeout.
+	for range timeoutBeats {
+		step(&now, a)
+		if a.Active() {
+			t.Fatal("took over before the timeout")
+		}
+	}
+	step(&now, a)
+	if !a.Active() {
+		t.Fatal("no takeover after the active peer was lost")
+	}
+
+	// b restarts: it does not preempt a.
+	b.Close()
+	b = newNode(&now, 200, 3)
+	defer b.Close()
+	for range 5 {
+		step(&now, a, b)
+	}
+	if !a.Active() || b.Active() {
+		t.Fatalf("active a=%v b=%v; want no preemption", a.Active(), b.Active())
+	}
+}
+
+func TestElectionTie(t *testing.T) {
+	now := time.Unix(0, 0)
+	a, b := newNode(&now, 100, 5), newNode(&now, 100, 4)
+	defer a.Close()
+	defer b.Close()
+	// Both listened alone and went active; the lower node ID stays.
+	for range timeoutBeats + 1 {
+		step(&now, a)
+		step(&now, b)
+	}
+	if !a.Active() || !b.Active() {
+		t.Fatal("setup: both should be active")
+	}
+	step(&now, a, b)
+	if a.Active() || !b.Active() {
+		t.Fatalf("active a=%v b=%v; want the lower node ID", a.Active(), b.Active())
+	}
+}
+
+func TestParseID(t *testing.T) {
+	if id, err := ParseID("7F0"); err != nil || id != 0x7F0 {
+		t.Fatalf("standard: %x %v", id, err)
+	}
+	if id, err := ParseID("1FFFFFF0"); err != nil || id != 0x1FFFFFF0|can.CAN_EFF_FLAG {
+		t.Fatalf("extended: %x %v", id, err)
+	}
+	if _, err := ParseID("7F00"); err == nil {
+		t.Fatal("4-digit ID accepted")
+	}
+}
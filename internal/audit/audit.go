@@ -0,0 +1,122 @@
+// Package audit cross-checks related frame counters while the gateway runs.
+// A check relates the frames entering a path (e.g. received from TCP
+// clients) to those leaving it, written or counted as dropped. Frames that
+// enter but never show up on the other side point at an accounting bug or a
+// silent drop path, which is otherwise only noticed as missing traffic.
+package audit
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// Check relates two cumulative counters. Out may count more than the
+// frames of In (other sources share the path), so a check only catches
+// frames missing from Out, never surplus ones.
+type Check struct {
+	Name string
+	In   func() uint64 // frames entering the path
+	Out  func() uint64 // frames leaving it: written, or dropped and counted
+}
+
+// Config configures an Auditor.
+type Config struct {
+	Interval time.Duration
+	// Tolerance is how many frames may be unaccounted before a check
+	// reports. Frames in flight (queued between In and Out) count as
+	// unaccounted until they leave, so it must exceed the queues on the
+	// path.
+	Tolerance uint64
+	Checks    []Check
+	Logger    *slog.Logger
+}
+
+// Divergence is one check found out of balance.
+type Divergence struct {
+	Check   string
+	In, Out uint64 // counter increase over the window
+	Missing uint64 // frames unaccounted for
+	Window  time.Duration
+}
+
+// Auditor runs the checks every interval.
+type Auditor struct {
+	cfg   Config
+	state []checkState
+	now   func() time.Time
+}
+
+type checkState struct {
+	in, out uint64    // counters at the last sample
+	since   time.Time // start of the window
+	winIn   uint64    // increase of in since the window started
+	winOut  uint64
+	missing uint64 // frames entered but not accounted, carried over samples
+}
+
+// New returns an Auditor with the current counter values as the baseline.
+func New(cfg Config) *Auditor {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	a := &Auditor{cfg: cfg, state: make([]checkState, len(cfg.Checks)), now: time.Now}
+	now := a.now()
+	for i, c := range cfg.Checks {
+		a.state[i] = checkState{in: c.In(), out: c.Out(), since: now}
+	}
+	return a
+}
+
+// Run samples every interval until ctx is cancelled.
+func (a *Auditor) Run(ctx context.Context) {
+	t := time.NewTicker(a.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			a.Sample()
+		}
+	}
+}
+
+// Sample reads the counters once and reports, logs and counts the checks
+// whose unaccounted frames exceed the tolerance. Missing frames carry over
+// between samples, so frames still in flight at one sample are settled by
+// the next, while surplus frames from other sources never hide more than
+// one sample's worth. A reported check starts over.
+func (a *Auditor) Sample() []Divergence {
+	var out []Divergence
+	now := a.now()
+	for i, c := range a.cfg.Checks {
+		st := &a.state[i]
+		in, o := c.In(), c.Out()
+		dIn, dOut := in-st.in, o-st.out
+		st.in, st.out = in, o
+		st.winIn += dIn
+		st.winOut += dOut
+		if dIn >= dOut {
+			st.missing += dIn - dOut
+		} else {
+			st.missing -= min(st.missing, dOut-dIn)
+		}
+		if st.missing == 0 {
+			st.since, st.winIn, st.winOut = now, 0, 0
+			continue
+		}
+		if st.missing <= a.cfg.Tolerance {
+			continue
+		}
+		d := Divergence{Check: c.Name, In: st.winIn, Out: st.winOut, Missing: st.missing, Window: now.Sub(st.since)}
+		out = append(out, d)
+		metrics.IncAuditDivergence(c.Name)
+		a.cfg.Logger.Warn("counter_audit_divergence", "check", d.Check, "in", d.In, "out", d.Out,
+			"missing", d.Missing, "window", d.Window, "tolerance", a.cfg.Tolerance)
+		st.since, st.winIn, st.winOut, st.missing = now, 0, 0, 0
+	}
+	return out
+}
@@ -0,0 +1,49 @@
+package audit
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestSample(t *testing.T) {
+	var in, out uint64
+	now := time.Unix(1700000000, 0)
+	a := New(Config{
+		Interval:  time.Second,
+		Tolerance: 10,
+		Checks:    []Check{{Name: "tx", In: func() uint64 { return in }, Out: func() uint64 { return out }}},
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	a.now = func() time.Time { return now }
+	step := func(dIn, dOut uint64) []Divergence {
+		in += dIn
+		out += dOut
+		now = now.Add(time.Second)
+		return a.Sample()
+	}
+
+	// Frames in flight at one sample leave by the next.
+	if d := step(100, 92); d != nil {
+		t.Fatalf("in flight reported: %+v", d)
+	}
+	if d := step(50, 58); d != nil {
+		t.Fatalf("settled reported: %+v", d)
+	}
+	// Surplus from other sources does not hide later losses for long.
+	if d := step(0, 500); d != nil {
+		t.Fatalf("surplus reported: %+v", d)
+	}
+	if d := step(10, 5); d != nil {
+		t.Fatalf("within tolerance: %+v", d)
+	}
+	d := step(10, 3)
+	if len(d) != 1 || d[0].Check != "tx" || d[0].Missing != 12 || d[0].In != 20 || d[0].Out != 8 || d[0].Window != 2*time.Second {
+		t.Fatalf("divergence: %+v", d)
+	}
+	// A reported check starts over.
+	if d := step(5, 0); d != nil {
+		t.Fatalf("after report: %+v", d)
+	}
+}
@@ -0,0 +1,234 @@
+// Package block keeps an administrative block list of CAN IDs: frames with
+// a blocked ID are not forwarded from the bus to clients, or not written to
+// the bus, or both, until the block expires. It is meant for incidents, such
+// as silencing a misbehaving module, not for permanent filtering (see the
+// backend filters for that).
+package block
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/normalize"
+)
+
+// MaxTTL bounds how long a block may last; blocks are for incidents.
+const MaxTTL = 7 * 24 * time.Hour
+
+// ErrBlocked is returned for client frames with a blocked ID. It wraps
+// filter.ErrDenied, so clients see the denied acknowledgement status.
+var ErrBlocked = fmt.Errorf("%w: CAN ID blocked", filter.ErrDenied)
+
+// active counts blocks of all Lists for the process-wide gauge.
+var active atomic.Int64
+
+// Dir selects the directions a block applies to.
+type Dir uint8
+
+const (
+	RX   Dir = 1 << iota // bus to clients
+	TX                   // clients to bus
+	Both = RX | TX
+)
+
+// ParseDir parses rx, tx or both ("" is both).
+func ParseDir(s string) (Dir, error) {
+	switch strings.ToLower(s) {
+	case "", "both":
+		return Both, nil
+	case "rx":
+		return RX, nil
+	case "tx":
+		return TX, nil
+	}
+	return 0, fmt.Errorf("unknown direction %q (use rx|tx|both)", s)
+}
+
+func (d Dir) String() string {
+	switch d {
+	case RX:
+		return "rx"
+	case TX:
+		return "tx"
+	}
+	return "both"
+}
+
+// Entry is one block.
+type Entry struct {
+	ID      uint32 // CAN ID with the EFF flag
+	Dir     Dir
+	Expires time.Time
+	Reason  string
+	By      string // identity that added it
+}
+
+type entry struct {
+	Entry
+	timer *time.Timer
+}
+
+// List is the block list of one bus. AllowRX and CheckTX are cheap while
+// the list is empty.
+type List struct {
+	l   *slog.Logger
+	eff normalize.EFFMode
+	n   atomic.Int32 // len(m), read without mu
+	mu  sync.Mutex
+	m   map[uint32]*entry
+	now func() time.Time
+}
+
+// New returns an empty List. IDs are marked extended as eff, the backend
+// normalization, does, so a block matches the frames the bus reports and
+// the frames clients send for the same ID. Changes are logged to l.
+func New(l *slog.Logger, eff normalize.EFFMode) *List {
+	if l == nil {
+		l = slog.Default()
+	}
+	return &List{l: l, eff: eff, m: make(map[uint32]*entry), now: time.Now}
+}
+
+// key normalizes id and drops the flags other than EFF, so a block covers
+// data and remote frames of the ID.
+func (b *List) key(id uint32) uint32 {
+	if id = b.eff.ID(id); id&can.CAN_EFF_FLAG != 0 {
+		return id & (can.CAN_EFF_MASK | can.CAN_EFF_FLAG)
+	}
+	return id & can.CAN_SFF_MASK
+}
+
+// Add blocks id in dir for ttl, replacing an existing block of the ID.
+func (b *List) Add(id uint32, dir Dir, ttl time.Duration, reason, by string) (Entry, error) {
+	if ttl <= 0 || ttl > MaxTTL {
+		return Entry{}, fmt.Errorf("ttl must be > 0 and <= %s", MaxTTL)
+	}
+	if dir&Both == 0 {
+		return Entry{}, errors.New("no direction")
+	}
+	id = b.key(id)
+	e := &entry{Entry: Entry{ID: id, Dir: dir, Expires: b.now().Add(ttl), Reason: reason, By: by}}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if old := b.m[id]; old != nil {
+		old.timer.Stop()
+	} else {
+		b.n.Add(1)
+		metrics.SetFrameBlocks(int(active.Add(1)))
+	}
+	b.m[id] = e
+	e.timer = time.AfterFunc(ttl, func() { b.expire(e) })
+	b.l.Warn("frame_block_added", "can_id", FormatID(id), "direction", dir.String(), "ttl", ttl, "reason", reason, "identity", by)
+	return e.Entry, nil
+}
+
+// Remove lifts the block of id; it reports whether there was one.
+func (b *List) Remove(id uint32, by string) bool {
+	id = b.key(id)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.m[id]
+	if e == nil {
+		return false
+	}
+	e.timer.Stop()
+	b.dropLocked(id)
+	b.l.Warn("frame_block_removed", "can_id", FormatID(id), "direction", e.Dir.String(), "identity", by)
+	return true
+}
+
+func (b *List) expire(e *entry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.m[e.ID] != e { // replaced or removed meanwhile
+		return
+	}
+	b.dropLocked(e.ID)
+	b.l.Warn("frame_block_expired", "can_id", FormatID(e.ID), "direction", e.Dir.String(), "reason", e.Reason, "identity", e.By)
+}
+
+// dropLocked deletes the block of id. Callers hold mu.
+func (b *List) dropLocked(id uint32) {
+	delete(b.m, id)
+	b.n.Add(-1)
+	metrics.SetFrameBlocks(int(active.Add(-1)))
+}
+
+// Close lifts all blocks without logging, on shutdown.
+func (b *List) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, e := range b.m {
+		e.timer.Stop()
+		b.dropLocked(id)
+	}
+}
+
+// Entries returns the active blocks ordered by ID.
+func (b *List) Entries() []Entry {
+	b.mu.Lock()
+	out := make([]Entry, 0, len(b.m))
+	for _, e := range b.m {
+		out = append(out, e.Entry)
+	}
+	b.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func (b *List) blocked(fr *can.Frame, dir Dir) bool {
+	if b.n.Load() == 0 {
+		return false
+	}
+	b.mu.Lock()
+	e := b.m[b.key(fr.CANID)]
+	b.mu.Unlock()
+	return e != nil && e.Dir&dir != 0
+}
+
+// AllowRX reports whether a bus frame may reach clients; blocked frames
+// are counted. It fits the hub Filter.
+func (b *List) AllowRX(fr *can.Frame) bool {
+	if fr.CANID&can.CAN_ERR_FLAG != 0 || !b.blocked(fr, RX) {
+		return true
+	}
+	metrics.IncFrameBlocked(metrics.FilterRX)
+	return false
+}
+
+// CheckTX returns ErrBlocked (and counts the frame) for a client frame with
+// an ID blocked for TX.
+func (b *List) CheckTX(fr *can.Frame) error {
+	if !b.blocked(fr, TX) {
+		return nil
+	}
+	metrics.IncFrameBlocked(metrics.FilterTX)
+	return ErrBlocked
+}
+
+// ParseID parses a CAN ID in candump notation: up to 3 hex digits for a
+// standard ID, 8 for an extended one.
+func ParseID(s string) (uint32, error) {
+	fr, err := can.ParseFrame(strings.TrimPrefix(strings.TrimSpace(s), "0x") + "#")
+	if err != nil {
+		return 0, fmt.Errorf("CAN ID %q: want up to 3 (standard) or 8 (extended) hex digits", s)
+	}
+	return fr.CANID, nil
+}
+
+// FormatID formats id in candump notation.
+func FormatID(id uint32) string {
+	if id&can.CAN_EFF_FLAG != 0 {
+		return fmt.Sprintf("%08X", id&can.CAN_EFF_MASK)
+	}
+	return fmt.Sprintf("%03X", id&can.CAN_SFF_MASK)
+}
@@ -0,0 +1,138 @@
+package block
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+	"github.com/kstaniek/go-ampio-server/internal/normalize"
+)
+
+func quiet() *slog.Logger { return slog.New(slog.NewTextHandler(io.Discard, nil)) }
+
+func TestListDirections(t *testing.T) {
+	b := New(quiet(), normalize.EFFKeep)
+	defer b.Close()
+	std := can.Frame{CANID: 0x123}
+	ext := can.Frame{CANID: 0x123 | can.CAN_EFF_FLAG}
+	if !b.AllowRX(&std) || b.CheckTX(&std) != nil {
+		t.Fatal("empty list blocks")
+	}
+	if _, err := b.Add(0x123, RX, time.Minute, "flooding", "ops"); err != nil {
+		t.Fatal(err)
+	}
+	if b.AllowRX(&std) || !b.AllowRX(&ext) {
+		t.Fatal("rx block must match the standard ID only")
+	}
+	if err := b.CheckTX(&std); err != nil {
+		t.Fatalf("rx block applied to tx: %v", err)
+	}
+	rtr := can.Frame{CANID: 0x123 | can.CAN_RTR_FLAG}
+	if _, err := b.Add(0x123, Both, time.Minute, "", "ops"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CheckTX(&rtr); !errors.Is(err, ErrBlocked) || !errors.Is(err, filter.ErrDenied) {
+		t.Fatalf("tx: %v", err)
+	}
+	if n := len(b.Entries()); n != 1 {
+		t.Fatalf("replacing a block: %d entries", n)
+	}
+	if !b.Remove(0x123, "ops") || b.Remove(0x123, "ops") {
+		t.Fatal("remove")
+	}
+	if !b.AllowRX(&std) {
+		t.Fatal("removed block still applies")
+	}
+	if _, err := b.Add(0x123, Both, 0, "", ""); err == nil {
+		t.Fatal("zero ttl accepted")
+	}
+}
+
+func TestListNormalizedIDs(t *testing.T) {
+	b := New(quiet(), normalize.EFFForce)
+	defer b.Close()
+	if _, err := b.Add(0x123, Both, time.Minute, "", "ops"); err != nil {
+		t.Fatal(err)
+	}
+	bus := can.Frame{CANID: 0x123 | can.CAN_EFF_FLAG} // as the serial backend reports it
+	if b.AllowRX(&bus) {
+		t.Fatal("standard block misses the normalized bus frame")
+	}
+	client := can.Frame{CANID: 0x123}
+	if err := b.CheckTX(&client); !errors.Is(err, ErrBlocked) {
+		t.Fatalf("tx: %v", err)
+	}
+	if got := b.Entries(); len(got) != 1 || FormatID(got[0].ID) != "00000123" {
+		t.Fatalf("entries: %+v", got)
+	}
+	if !b.Remove(0x123|can.CAN_EFF_FLAG, "ops") {
+		t.Fatal("extended notation does not lift the block")
+	}
+}
+
+func TestListExpiry(t *testing.T) {
+	b := New(quiet(), normalize.EFFKeep)
+	defer b.Close()
+	if _, err := b.Add(0x100, TX, 20*time.Millisecond, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	fr := can.Frame{CANID: 0x100}
+	deadline := time.Now().Add(2 * time.Second)
+	for b.CheckTX(&fr) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("block did not expire")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(b.Entries()) != 0 {
+		t.Fatal("expired block listed")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	b := New(quiet(), normalize.EFFKeep)
+	defer b.Close()
+	h := Handler(map[string]*List{"": b})
+	do := func(method, target, body string) (*httptest.ResponseRecorder, []entryJSON) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		var out struct {
+			Blocks []entryJSON `json:"blocks"`
+		}
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+				t.Fatalf("%s %s: %v", method, target, err)
+			}
+		}
+		return rec, out.Blocks
+	}
+	if rec, got := do(http.MethodPost, "/api/blocks", `{"id":"0x1ABCDEF0","ttl":"10m","direction":"tx","reason":"stuck relay"}`); rec.Code != http.StatusOK ||
+		len(got) != 1 || got[0].ID != "1ABCDEF0" || got[0].Direction != "tx" || got[0].Reason != "stuck relay" || got[0].By != "anonymous" {
+		t.Fatalf("add: %d %+v", rec.Code, got)
+	}
+	for _, body := range []string{`{"id":"0x1234","ttl":"10m"}`, `{"id":"123","ttl":"-1s"}`, `{"id":"123","ttl":"1m","direction":"up"}`, `{"id":"123"}`} {
+		if rec, _ := do(http.MethodPut, "/api/blocks", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", body, rec.Code)
+		}
+	}
+	if rec, got := do(http.MethodGet, "/api/blocks", ""); rec.Code != http.StatusOK || len(got) != 1 {
+		t.Fatalf("get: %d %+v", rec.Code, got)
+	}
+	if rec, got := do(http.MethodDelete, "/api/blocks?id=1ABCDEF0", ""); rec.Code != http.StatusOK || len(got) != 0 {
+		t.Fatalf("delete: %d %+v", rec.Code, got)
+	}
+	if rec, _ := do(http.MethodDelete, "/api/blocks?id=1ABCDEF0", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("delete again: %d", rec.Code)
+	}
+	if rec, _ := do(http.MethodGet, "/api/blocks?instance=x", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown instance: %d", rec.Code)
+	}
+}
@@ -0,0 +1,107 @@
+package block
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/access"
+	"github.com/kstaniek/go-ampio-server/internal/instances"
+)
+
+type entryJSON struct {
+	ID        string    `json:"id"`
+	Direction string    `json:"direction"`
+	Expires   time.Time `json:"expires"`
+	Remaining string    `json:"remaining"`
+	Reason    string    `json:"reason,omitempty"`
+	By        string    `json:"by,omitempty"`
+}
+
+type addRequest struct {
+	ID        string `json:"id"`
+	TTL       string `json:"ttl"`
+	Direction string `json:"direction"`
+	Reason    string `json:"reason"`
+}
+
+// Handler exposes the block lists over HTTP. targets maps instance names to
+// lists; the ?instance= parameter selects one and may be omitted when there
+// is only one. Changes are logged with the identity of the caller.
+//
+//	GET                  -> {"blocks":[{"id":"123","direction":"both",...}]}
+//	PUT/POST {"id":"123","ttl":"15m","direction":"rx|tx|both","reason":"..."}
+//	DELETE ?id=123
+func Handler(targets map[string]*List) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := instances.Pick(targets, r.URL.Query().Get("instance"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		who := "anonymous"
+		if id, ok := access.FromContext(r.Context()); ok {
+			who = id.Name
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var req addRequest
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&req); err != nil {
+				http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			id, err := ParseID(req.ID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ttl, err := time.ParseDuration(req.TTL)
+			if err != nil {
+				http.Error(w, "invalid ttl: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			dir, err := ParseDir(req.Direction)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, err := b.Add(id, dir, ttl, req.Reason, who); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			id, err := ParseID(r.URL.Query().Get("id"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !b.Remove(id, who) {
+				http.Error(w, "not blocked", http.StatusNotFound)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		now := b.now()
+		out := struct {
+			Blocks []entryJSON `json:"blocks"`
+		}{Blocks: []entryJSON{}}
+		for _, e := range b.Entries() {
+			out.Blocks = append(out.Blocks, entryJSON{
+				ID:        FormatID(e.ID),
+				Direction: e.Dir.String(),
+				Expires:   e.Expires,
+				Remaining: e.Expires.Sub(now).Round(time.Second).String(),
+				Reason:    e.Reason,
+				By:        e.By,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	})
+}
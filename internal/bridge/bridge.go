@@ -0,0 +1,278 @@
+// Package bridge forwards frames between gateway instances (one hub's
+// backend RX to another instance's backend TX) and keeps bridged topologies
+// loop-free.
+//
+// The CAN and cannelloni wire formats have no room for metadata, so
+// provenance is tracked out of band: every frame a route injects into a
+// destination is remembered for a short window together with its origin
+// instance and hop count. When an identical frame then shows up on that
+// destination's hub (loopback/UDP echo, or a peer bridging it back), it
+// inherits the recorded provenance instead of being treated as new traffic.
+// A frame is dropped, and counted as a loop, when it would return to its
+// origin or exceed the hop TTL.
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/logging"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+const (
+	// DefaultTTL is the maximum number of bridge hops a frame may take.
+	DefaultTTL = 4
+	// DefaultWindow is how long an injected frame's provenance is remembered.
+	DefaultWindow = 500 * time.Millisecond
+	// sweepThreshold bounds the provenance table; above it expired marks are pruned.
+	sweepThreshold = 4096
+)
+
+// ErrBadRoute reports an unparsable or inconsistent route specification.
+var ErrBadRoute = errors.New("bad bridge route")
+
+// Spec is a parsed "from>to" route.
+type Spec struct{ From, To string }
+
+func (s Spec) String() string { return s.From + ">" + s.To }
+
+// ParseSpecs parses a comma separated list of "from>to" routes. "a<>b" is
+// shorthand for both directions.
+func ParseSpecs(s string) ([]Spec, error) {
+	var out []Spec
+	seen := make(map[Spec]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var specs []Spec
+		if a, b, ok := strings.Cut(part, "<>"); ok {
+			specs = []Spec{{strings.TrimSpace(a), strings.TrimSpace(b)}, {strings.TrimSpace(b), strings.TrimSpace(a)}}
+		} else if a, b, ok := strings.Cut(part, ">"); ok {
+			specs = []Spec{{strings.TrimSpace(a), strings.TrimSpace(b)}}
+		} else {
+			return nil, fmt.Errorf("%w %q: want from>to or a<>b", ErrBadRoute, part)
+		}
+		for _, sp := range specs {
+			if sp.From == "" || sp.To == "" || sp.From == sp.To {
+				return nil, fmt.Errorf("%w %q", ErrBadRoute, part)
+			}
+			if seen[sp] {
+				return nil, fmt.Errorf("%w %q: duplicate", ErrBadRoute, sp)
+			}
+			seen[sp] = true
+			out = append(out, sp)
+		}
+	}
+	return out, nil
+}
+
+// Endpoint is one side of a route: the instance hub frames are read from
+// and the (filtered) backend transmit path frames are written to.
+type Endpoint struct {
+	Name string
+	Hub  *hub.Hub
+	Send func(can.Frame) error
+}
+
+// Route is an active source→destination path with its counters.
+type Route struct {
+	From, To  string
+	src       *hub.Hub
+	send      func(can.Frame) error
+	forwarded atomic.Uint64
+	loops     atomic.Uint64
+	errors    atomic.Uint64
+}
+
+// RouteStats is a snapshot of per-route counters.
+type RouteStats struct {
+	Forwarded uint64 // frames written to the destination backend
+	Loops     uint64 // frames dropped by loop prevention
+	Errors    uint64 // destination backend send failures
+}
+
+// Stats returns the route counters.
+func (r *Route) Stats() RouteStats {
+	return RouteStats{Forwarded: r.forwarded.Load(), Loops: r.loops.Load(), Errors: r.errors.Load()}
+}
+
+type key struct {
+	id   uint32
+	len  uint8
+	data [8]byte
+}
+
+// mark is the provenance of frames injected into an endpoint.
+type mark struct {
+	origin string
+	hops   int
+	at     time.Time
+}
+
+// Bridge owns the routes and the shared provenance table.
+type Bridge struct {
+	ttl    int
+	window time.Duration
+	now    func() time.Time
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	marks  map[string]map[key]*mark // destination -> injected frames
+	routes []*Route
+}
+
+// New returns a Bridge allowing at most ttl hops (<=0 uses DefaultTTL) and
+// remembering provenance for window (<=0 uses DefaultWindow).
+func New(ttl int, window time.Duration) *Bridge {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	return &Bridge{
+		ttl:    ttl,
+		window: window,
+		now:    time.Now,
+		logger: logging.L(),
+		marks:  make(map[string]map[key]*mark),
+	}
+}
+
+// Add registers a route from one endpoint to another. Must be called before Run.
+func (b *Bridge) Add(from, to Endpoint) (*Route, error) {
+	if from.Name == to.Name {
+		return nil, fmt.Errorf("%w %s>%s", ErrBadRoute, from.Name, to.Name)
+	}
+	r := &Route{From: from.Name, To: to.Name, src: from.Hub, send: to.Send}
+	b.mu.Lock()
+	b.routes = append(b.routes, r)
+	b.mu.Unlock()
+	return r, nil
+}
+
+// Routes returns the registered routes in insertion order.
+func (b *Bridge) Routes() []*Route {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*Route(nil), b.routes...)
+}
+
+// TTL returns the hop limit.
+func (b *Bridge) TTL() int { return b.ttl }
+
+// Run pumps every route until ctx is cancelled.
+func (b *Bridge) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, r := range b.Routes() {
+		wg.Add(1)
+		go func(r *Route) { defer wg.Done(); b.pump(ctx, r) }(r)
+	}
+	wg.Wait()
+}
+
+// pump subscribes to the route source hub. If the hub kicks the subscriber
+// (kick policy), it re-subscribes; frames missed meanwhile are lost.
+func (b *Bridge) pump(ctx context.Context, r *Route) {
+	size := r.src.OutBufSize()
+	for {
+		cl := &hub.Client{Out: make(chan can.Frame, size), Closed: make(chan struct{})}
+		r.src.Add(cl)
+		closed := false
+		for !closed {
+			select {
+			case fr := <-cl.Out:
+				b.forward(r, fr)
+			case <-cl.Closed:
+				closed = true
+			case <-ctx.Done():
+				r.src.Remove(cl)
+				return
+			}
+		}
+		r.src.Remove(cl)
+		b.logger.Warn("bridge_resubscribe", "route", r.From+">"+r.To)
+	}
+}
+
+// forward applies loop prevention and writes fr to the route destination.
+func (b *Bridge) forward(r *Route, fr can.Frame) {
+	origin, hops := r.From, 0
+	if m, ok := b.claim(r.From, fr); ok {
+		origin, hops = m.origin, m.hops
+	}
+	switch {
+	case origin == r.To:
+		r.loops.Add(1)
+		metrics.IncBridgeLoop(metrics.LoopOrigin)
+		return
+	case hops >= b.ttl:
+		r.loops.Add(1)
+		metrics.IncBridgeLoop(metrics.LoopTTL)
+		return
+	}
+	// Record before sending so an immediate echo finds the mark.
+	b.inject(r.To, fr, origin, hops+1)
+	if err := r.send(fr); err != nil {
+		r.errors.Add(1)
+		return
+	}
+	r.forwarded.Add(1)
+	metrics.IncBridgeForwarded()
+}
+
+func frameKey(fr can.Frame) key {
+	k := key{id: fr.CANID, len: fr.Len}
+	copy(k.data[:], fr.Data[:8])
+	return k
+}
+
+// claim returns the provenance of fr if it was recently injected into ep.
+// Marks are not consumed: every route leaving ep must see the same origin.
+func (b *Bridge) claim(ep string, fr can.Frame) (mark, bool) {
+	now := b.now()
+	k := frameKey(fr)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, ok := b.marks[ep][k]
+	if !ok {
+		return mark{}, false
+	}
+	if now.Sub(m.at) >= b.window {
+		delete(b.marks[ep], k)
+		return mark{}, false
+	}
+	return *m, true
+}
+
+// inject records that fr (origin, hops) is being written into ep.
+func (b *Bridge) inject(ep string, fr can.Frame, origin string, hops int) {
+	now := b.now()
+	k := frameKey(fr)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.marks[ep]
+	if t == nil {
+		t = make(map[key]*mark)
+		b.marks[ep] = t
+	}
+	t[k] = &mark{origin: origin, hops: hops, at: now}
+	if len(t) > sweepThreshold {
+		for k, m := range t {
+			if now.Sub(m.at) >= b.window {
+				delete(t, k)
+			}
+		}
+	}
+}
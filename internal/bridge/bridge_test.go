@@ -0,0 +1,99 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+// loopbackEndpoint models a backend whose transmitted frames reappear on its
+// own hub (loopback or a UDP peer echoing back).
+func loopbackEndpoint(name string) Endpoint {
+	h := hub.New()
+	return Endpoint{Name: name, Hub: h, Send: func(fr can.Frame) error { h.Broadcast(fr); return nil }}
+}
+
+func waitStats(t *testing.T, r *Route, want RouteStats) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for r.Stats() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("route %s>%s stats = %+v, want %+v", r.From, r.To, r.Stats(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitSubscribed blocks until every route pump has joined its source hub.
+func waitSubscribed(t *testing.T, eps ...Endpoint) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for _, ep := range eps {
+		for ep.Hub.Count() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: bridge did not subscribe", ep.Name)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestBridgeStopsReturnToOrigin(t *testing.T) {
+	a, b := loopbackEndpoint("a"), loopbackEndpoint("b")
+	br := New(0, time.Second)
+	ab, _ := br.Add(a, b)
+	ba, _ := br.Add(b, a)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go br.Run(ctx)
+	waitSubscribed(t, a, b)
+
+	a.Hub.Broadcast(can.Frame{CANID: 0x100, Len: 1, Data: [64]byte{1}})
+	waitStats(t, ab, RouteStats{Forwarded: 1})
+	waitStats(t, ba, RouteStats{Loops: 1})
+
+	// Traffic originating on b still crosses to a once.
+	b.Hub.Broadcast(can.Frame{CANID: 0x200, Len: 1, Data: [64]byte{2}})
+	waitStats(t, ba, RouteStats{Forwarded: 1, Loops: 1})
+	waitStats(t, ab, RouteStats{Forwarded: 1, Loops: 1})
+}
+
+func TestBridgeTTL(t *testing.T) {
+	a, b, c := loopbackEndpoint("a"), loopbackEndpoint("b"), loopbackEndpoint("c")
+	br := New(1, time.Second)
+	ab, _ := br.Add(a, b)
+	bc, _ := br.Add(b, c)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go br.Run(ctx)
+	waitSubscribed(t, a, b)
+
+	a.Hub.Broadcast(can.Frame{CANID: 0x300})
+	waitStats(t, ab, RouteStats{Forwarded: 1})
+	waitStats(t, bc, RouteStats{Loops: 1})
+}
+
+func TestParseSpecs(t *testing.T) {
+	specs, err := ParseSpecs(" can0 > can1 , x<>y ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Spec{{"can0", "can1"}, {"x", "y"}, {"y", "x"}}
+	if len(specs) != len(want) {
+		t.Fatalf("specs = %v", specs)
+	}
+	for i := range want {
+		if specs[i] != want[i] {
+			t.Fatalf("specs = %v, want %v", specs, want)
+		}
+	}
+	for _, bad := range []string{"a", "a>a", ">b", "a>b,a>b", "a<>b,b>a"} {
+		if _, err := ParseSpecs(bad); !errors.Is(err, ErrBadRoute) {
+			t.Fatalf("%q: expected ErrBadRoute, got %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package can
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Error classes of error frames: bits of the CAN ID below CAN_ERR_FLAG
+// (same values as <linux/can/error.h>).
+const (
+	CAN_ERR_TX_TIMEOUT = 0x00000001
+	CAN_ERR_LOSTARB    = 0x00000002
+	CAN_ERR_CRTL       = 0x00000004
+	CAN_ERR_PROT       = 0x00000008
+	CAN_ERR_TRX        = 0x00000010
+	CAN_ERR_ACK        = 0x00000020
+	CAN_ERR_BUSOFF     = 0x00000040
+	CAN_ERR_BUSERROR   = 0x00000080
+	CAN_ERR_RESTARTED  = 0x00000100
+	CAN_ERR_CNT        = 0x00000200
+	CAN_ERR_MASK       = 0x1FFFFFFF
+)
+
+// errClasses names the error classes, in bit order.
+var errClasses = []struct {
+	name string
+	bit  uint32
+}{
+	{"tx-timeout", CAN_ERR_TX_TIMEOUT},
+	{"lostarb", CAN_ERR_LOSTARB},
+	{"crtl", CAN_ERR_CRTL},
+	{"prot", CAN_ERR_PROT},
+	{"trx", CAN_ERR_TRX},
+	{"ack", CAN_ERR_ACK},
+	{"busoff", CAN_ERR_BUSOFF},
+	{"buserror", CAN_ERR_BUSERROR},
+	{"restarted", CAN_ERR_RESTARTED},
+	{"cnt", CAN_ERR_CNT},
+}
+
+// ParseErrMask parses an error class mask for CAN_RAW_ERR_FILTER: "all", a
+// number ("0x1C0") or a comma-separated list of class names ("busoff,
+// crtl,restarted"). An empty spec returns 0 (no error frames).
+func ParseErrMask(spec string) (uint32, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "":
+		return 0, nil
+	case "all":
+		return CAN_ERR_MASK, nil
+	}
+	if n, err := strconv.ParseUint(spec, 0, 32); err == nil {
+		if n > CAN_ERR_MASK {
+			return 0, fmt.Errorf("error mask %s exceeds 0x%X", spec, CAN_ERR_MASK)
+		}
+		return uint32(n), nil
+	}
+	var mask uint32
+next:
+	for _, f := range strings.Split(spec, ",") {
+		f = strings.TrimSpace(f)
+		for _, c := range errClasses {
+			if f == c.name {
+				mask |= c.bit
+				continue next
+			}
+		}
+		return 0, fmt.Errorf("unknown error class %q (have all, %s)", f, strings.Join(ErrClassNames(), ", "))
+	}
+	return mask, nil
+}
+
+// ErrClassNames lists the error class names in bit order.
+func ErrClassNames() []string {
+	out := make([]string, len(errClasses))
+	for i, c := range errClasses {
+		out[i] = c.name
+	}
+	return out
+}
+
+// ErrClasses names the classes an error frame reports; "other" stands for
+// bits without a name. It returns nil for frames without CAN_ERR_FLAG.
+func ErrClasses(canid uint32) []string {
+	if canid&CAN_ERR_FLAG == 0 {
+		return nil
+	}
+	var out []string
+	rest := canid & CAN_ERR_MASK
+	for _, c := range errClasses {
+		if rest&c.bit != 0 {
+			out = append(out, c.name)
+			rest &^= c.bit
+		}
+	}
+	if rest != 0 || len(out) == 0 {
+		out = append(out, "other")
+	}
+	return out
+}
@@ -0,0 +1,35 @@
+package can
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseErrMask(t *testing.T) {
+	for spec, want := range map[string]uint32{
+		"":                       0,
+		"all":                    CAN_ERR_MASK,
+		"0x1C0":                  0x1C0,
+		"busoff, crtl,restarted": CAN_ERR_BUSOFF | CAN_ERR_CRTL | CAN_ERR_RESTARTED,
+	} {
+		got, err := ParseErrMask(spec)
+		if err != nil || got != want {
+			t.Fatalf("%q: got 0x%X %v, want 0x%X", spec, got, err, want)
+		}
+	}
+	for _, bad := range []string{"busof", "0x20000000", "busoff,"} {
+		if _, err := ParseErrMask(bad); err == nil {
+			t.Fatalf("%q accepted", bad)
+		}
+	}
+}
+
+func TestErrClasses(t *testing.T) {
+	if got := ErrClasses(0x123); got != nil {
+		t.Fatalf("data frame classes %v", got)
+	}
+	got := ErrClasses(CAN_ERR_FLAG | CAN_ERR_CRTL | CAN_ERR_BUSOFF | 0x10000)
+	if want := []string{"crtl", "busoff", "other"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,67 @@
+package can
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrBadFrameSpec reports a frame string ParseFrame cannot interpret.
+var ErrBadFrameSpec = errors.New("bad frame spec")
+
+// ParseFrame parses candump/cansend notation: "<id>#<data>" where id is 3
+// hex digits (standard) or 8 hex digits (extended) and data is up to 8 hex
+// bytes, optionally separated by dots ("123#DE.AD"). "<id>#R" is a remote
+// frame.
+func ParseFrame(s string) (Frame, error) {
+	var fr Frame
+	idStr, dataStr, ok := strings.Cut(strings.TrimSpace(s), "#")
+	if !ok {
+		return fr, fmt.Errorf("%w: %q: missing '#'", ErrBadFrameSpec, s)
+	}
+	id, err := strconv.ParseUint(idStr, 16, 32)
+	if err != nil {
+		return fr, fmt.Errorf("%w: %q: bad id", ErrBadFrameSpec, s)
+	}
+	switch {
+	case len(idStr) <= 3 && id <= CAN_SFF_MASK:
+		fr.CANID = uint32(id)
+	case len(idStr) == 8 && id <= CAN_EFF_MASK:
+		fr.CANID = uint32(id) | CAN_EFF_FLAG
+	default:
+		return fr, fmt.Errorf("%w: %q: id must be 3 (standard) or 8 (extended) hex digits", ErrBadFrameSpec, s)
+	}
+	if strings.EqualFold(dataStr, "R") {
+		fr.CANID |= CAN_RTR_FLAG
+		return fr, nil
+	}
+	data, err := hex.DecodeString(strings.ReplaceAll(dataStr, ".", ""))
+	if err != nil || len(data) > 8 {
+		return fr, fmt.Errorf("%w: %q: data must be 0..8 hex bytes", ErrBadFrameSpec, s)
+	}
+	fr.Len = uint8(len(data))
+	copy(fr.Data[:], data)
+	return fr, nil
+}
+
+// String formats f in the notation accepted by ParseFrame.
+func (f Frame) String() string {
+	var b strings.Builder
+	if f.CANID&CAN_EFF_FLAG != 0 {
+		fmt.Fprintf(&b, "%08X#", f.CANID&CAN_EFF_MASK)
+	} else {
+		fmt.Fprintf(&b, "%03X#", f.CANID&CAN_SFF_MASK)
+	}
+	if f.CANID&CAN_RTR_FLAG != 0 {
+		b.WriteByte('R')
+		return b.String()
+	}
+	n := int(f.Len)
+	if n > len(f.Data) {
+		n = len(f.Data)
+	}
+	fmt.Fprintf(&b, "%X", f.Data[:n])
+	return b.String()
+}
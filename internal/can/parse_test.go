@@ -0,0 +1,36 @@
+package can
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseFrame(t *testing.T) {
+	cases := []struct {
+		in   string
+		id   uint32
+		data []byte
+	}{
+		{"123#DEADBEEF", 0x123, []byte{0xDE, 0xAD, 0xBE, 0xEF}},
+		{"7FF#", 0x7FF, nil},
+		{"1FFFFFFF#01.02", 0x1FFFFFFF | CAN_EFF_FLAG, []byte{1, 2}},
+		{"00000123#R", 0x123 | CAN_EFF_FLAG | CAN_RTR_FLAG, nil},
+	}
+	for _, tc := range cases {
+		fr, err := ParseFrame(tc.in)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.in, err)
+		}
+		if fr.CANID != tc.id || int(fr.Len) != len(tc.data) || string(fr.Data[:fr.Len]) != string(tc.data) {
+			t.Fatalf("%s: got %08X len %d % X", tc.in, fr.CANID, fr.Len, fr.Data[:fr.Len])
+		}
+		if back, _ := ParseFrame(fr.String()); back != fr {
+			t.Fatalf("%s: round trip via %q differs", tc.in, fr.String())
+		}
+	}
+	for _, bad := range []string{"", "123", "800#", "1234#00", "123#0", "123#001122334455667788", "xyz#00"} {
+		if _, err := ParseFrame(bad); !errors.Is(err, ErrBadFrameSpec) {
+			t.Fatalf("%q: expected ErrBadFrameSpec, got %v", bad, err)
+		}
+	}
+}
@@ -9,20 +9,54 @@ const (
 	CAN_EFF_MASK = 0x1FFFFFFF
 )
 
+// CAN FD flag bits for Frame.Flags (same values as <linux/can.h>)
+const (
+	CANFD_BRS = 0x01 // bit rate switch: data phase at the higher rate
+	CANFD_ESI = 0x02 // error state indicator of the transmitter
+	CANFD_FDF = 0x04 // the frame is a CAN FD frame
+)
+
+// MaxFDLen is the payload size limit of CAN FD frames.
+const MaxFDLen = 64
+
 // Frame is a simple CAN/ frame holder used across the gateway.
 // can_id contains EFF/RTR/ERR flags in its upper bits like SocketCAN.
-// Len is payload length (0..8 for classic); only the first Len bytes are valid.
+// Len is payload length (0..8 for classic, up to 64 for CAN FD); only the
+// first Len bytes are valid.
 //
 // Note: This is a convenience type. Codecs map this to/from their wires.
 type Frame struct {
 	CANID uint32
 	Len   uint8
+	// Iface is the index of the backend interface a received frame came
+	// from (-can-if can0,can1); 0 for single-interface backends. Codecs
+	// do not carry it.
+	Iface uint8
+	// Flags holds the CANFD_* bits of a CAN FD frame; 0 for classic frames.
+	Flags uint8
 	Data  [64]byte
 }
 
+// IsFD reports whether f is a CAN FD frame.
+func (f *Frame) IsFD() bool { return f.Flags&CANFD_FDF != 0 }
+
+// fdLens are the payload sizes a CAN FD frame can have.
+var fdLens = [...]uint8{0, 1, 2, 3, 4, 5, 6, 7, 8, 12, 16, 20, 24, 32, 48, 64}
+
+// FDLen rounds n up to the next payload size of a CAN FD frame, at most
+// MaxFDLen; a sender pads the payload to it.
+func FDLen(n int) uint8 {
+	for _, l := range fdLens {
+		if n <= int(l) {
+			return l
+		}
+	}
+	return MaxFDLen
+}
+
 func (f Frame) CopyShallow() Frame { // handy for tests
 	var g Frame
-	g.CANID, g.Len = f.CANID, f.Len
+	g.CANID, g.Len, g.Flags = f.CANID, f.Len, f.Flags
 	copy(g.Data[:], f.Data[:])
 	return g
 }
@@ -0,0 +1,62 @@
+package capture
+
+import (
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// Diff is the result of comparing two captures of the same bus.
+type Diff struct {
+	Matched int
+	// OnlyA and OnlyB hold frames without a counterpart in the other capture.
+	OnlyA, OnlyB []Record
+	// Skew statistics of matched pairs, measured as B.Time - A.Time.
+	SkewMin, SkewMax, SkewMean time.Duration
+}
+
+// Compare pairs frames of two time-ordered captures of the same bus. A frame
+// in a matches the earliest unmatched identical frame in b received within
+// tolerance of it; repeated frames therefore pair up in order.
+func Compare(a, b []Record, tolerance time.Duration) Diff {
+	var d Diff
+	pending := make(map[can.Frame][]int) // unmatched b indices per frame, oldest first
+	for i, rec := range b {
+		pending[rec.Frame] = append(pending[rec.Frame], i)
+	}
+	matched := make([]bool, len(b))
+	var skewSum time.Duration
+	for _, rec := range a {
+		q := pending[rec.Frame]
+		// Candidates too old for this frame are too old for every later one.
+		for len(q) > 0 && b[q[0]].Time.Before(rec.Time.Add(-tolerance)) {
+			q = q[1:]
+		}
+		if len(q) == 0 || b[q[0]].Time.After(rec.Time.Add(tolerance)) {
+			pending[rec.Frame] = q
+			d.OnlyA = append(d.OnlyA, rec)
+			continue
+		}
+		j := q[0]
+		pending[rec.Frame] = q[1:]
+		matched[j] = true
+		skew := b[j].Time.Sub(rec.Time)
+		if d.Matched == 0 || skew < d.SkewMin {
+			d.SkewMin = skew
+		}
+		if d.Matched == 0 || skew > d.SkewMax {
+			d.SkewMax = skew
+		}
+		skewSum += skew
+		d.Matched++
+	}
+	for j, rec := range b {
+		if !matched[j] {
+			d.OnlyB = append(d.OnlyB, rec)
+		}
+	}
+	if d.Matched > 0 {
+		d.SkewMean = skewSum / time.Duration(d.Matched)
+	}
+	return d
+}
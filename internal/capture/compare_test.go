@@ -0,0 +1,31 @@
+package capture
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestCompare(t *testing.T) {
+	t0 := time.Unix(1700000000, 0)
+	rec := func(ms int, id uint32) Record {
+		return Record{Time: t0.Add(time.Duration(ms) * time.Millisecond), Frame: can.Frame{CANID: id, Len: 1}}
+	}
+	a := []Record{rec(0, 0x100), rec(10, 0x100), rec(20, 0x200), rec(30, 0x300)}
+	b := []Record{rec(2, 0x100), rec(14, 0x100), rec(25, 0x400), rec(500, 0x300)}
+	d := Compare(a, b, 50*time.Millisecond)
+	if d.Matched != 2 {
+		t.Fatalf("matched %d, want 2", d.Matched)
+	}
+	if d.SkewMin != 2*time.Millisecond || d.SkewMax != 4*time.Millisecond || d.SkewMean != 3*time.Millisecond {
+		t.Fatalf("skew min=%v mean=%v max=%v", d.SkewMin, d.SkewMean, d.SkewMax)
+	}
+	// 0x300 is present on both sides but too far apart to be the same frame.
+	if len(d.OnlyA) != 2 || d.OnlyA[0].Frame.CANID != 0x200 || d.OnlyA[1].Frame.CANID != 0x300 {
+		t.Fatalf("OnlyA: %+v", d.OnlyA)
+	}
+	if len(d.OnlyB) != 2 || d.OnlyB[0].Frame.CANID != 0x400 || d.OnlyB[1].Frame.CANID != 0x300 {
+		t.Fatalf("OnlyB: %+v", d.OnlyB)
+	}
+}
@@ -0,0 +1,218 @@
+package capture
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/annotate"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/clock"
+	"github.com/kstaniek/go-ampio-server/internal/instances"
+)
+
+// MaxWindow bounds the history a single request may ask for.
+const MaxWindow = time.Hour
+
+// Target is a capture ring exposed over HTTP; Iface names the bus in the
+// candump output and the file. Ifaces, when set, names the frames of each
+// backend interface instead.
+type Target struct {
+	Ring   *Ring
+	Iface  string
+	Ifaces []string
+}
+
+// ifaces returns the per-frame interface names of tg.
+func (tg Target) ifaces() []string {
+	if len(tg.Ifaces) > 0 {
+		return tg.Ifaces
+	}
+	return []string{tg.Iface}
+}
+
+// Handler serves GET requests returning the last ?seconds=N (default 60) of
+// captured frames as a candump log download. targets maps instance names to
+// rings; ?instance= selects one and may be omitted when there is only one.
+// ?annotate=<decoders|all> adds "# note" comments from ann after each frame.
+func Handler(targets map[string]Target, ann *annotate.Pipeline) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tg, err := instances.Pick(targets, r.URL.Query().Get("instance"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		window := time.Minute
+		if v := r.URL.Query().Get("seconds"); v != "" {
+			d, err := time.ParseDuration(v + "s")
+			if err != nil || d <= 0 || d > MaxWindow {
+				http.Error(w, fmt.Sprintf("seconds must be in (0, %d]", int(MaxWindow.Seconds())), http.StatusBadRequest)
+				return
+			}
+			window = d
+		}
+		notes, err := ann.Select(r.URL.Query().Get("annotate"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		recs := tg.Ring.Last(window)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.log"`, tg.Iface, time.Now().UTC().Format("20060102T150405Z")))
+		w.Header().Set("X-Capture-Frames", fmt.Sprint(len(recs)))
+		var note func(*can.Frame) string
+		if notes != nil {
+			note = notes.Annotate
+		}
+		_ = WriteCandumpIfaces(w, tg.ifaces(), recs, note)
+	})
+}
+
+// maxDiffUpload bounds each capture file uploaded to DiffHandler.
+const maxDiffUpload = 32 << 20
+
+// DiffSide describes one capture of a diff.
+type DiffSide struct {
+	From   time.Time `json:"from,omitzero"`
+	To     time.Time `json:"to,omitzero"`
+	File   string    `json:"file,omitempty"`
+	Frames int       `json:"frames"`
+}
+
+// DiffReport is the response of DiffHandler.
+type DiffReport struct {
+	A       DiffSide `json:"a"`
+	B       DiffSide `json:"b"`
+	Changed int      `json:"changed"`
+	IDs     []IDDiff `json:"ids"`
+}
+
+// DiffHandler compares two captures ID by ID (see DiffIDs) and answers with
+// a DiffReport. GET compares two windows of the ring of ?instance=, given
+// as ?a=<from>/<to>&b=<from>/<to>; each end is an RFC 3339 time, a negative
+// duration before now such as -10m, or "now" (also when empty). POST
+// compares two candump logs uploaded as the multipart files "a" and "b".
+// Unchanged IDs are left out unless ?all=1.
+func DiffHandler(targets map[string]Target) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rep DiffReport
+		var a, b []Record
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			var tg Target
+			if tg, err = instances.Pick(targets, r.URL.Query().Get("instance")); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			now := clock.Now()
+			for _, side := range []struct {
+				param string
+				dst   *DiffSide
+				recs  *[]Record
+			}{{"a", &rep.A, &a}, {"b", &rep.B, &b}} {
+				from, to, err := parseWindow(r.URL.Query().Get(side.param), now)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("%s: %v", side.param, err), http.StatusBadRequest)
+					return
+				}
+				*side.recs = tg.Ring.Between(from, to)
+				side.dst.From, side.dst.To = from, to
+			}
+		case http.MethodPost:
+			// Both files plus room for the multipart headers.
+			r.Body = http.MaxBytesReader(w, r.Body, 2*maxDiffUpload+1<<20)
+			if err := r.ParseMultipartForm(maxDiffUpload); err != nil {
+				code := http.StatusBadRequest
+				var tooBig *http.MaxBytesError
+				if errors.As(err, &tooBig) {
+					code = http.StatusRequestEntityTooLarge
+				}
+				http.Error(w, err.Error(), code)
+				return
+			}
+			for _, side := range []struct {
+				field string
+				dst   *DiffSide
+				recs  *[]Record
+			}{{"a", &rep.A, &a}, {"b", &rep.B, &b}} {
+				f, hdr, err := r.FormFile(side.field)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("%s: %v", side.field, err), http.StatusBadRequest)
+					return
+				}
+				if hdr.Size > maxDiffUpload {
+					_ = f.Close()
+					http.Error(w, fmt.Sprintf("%s: file larger than %d bytes", side.field, maxDiffUpload), http.StatusRequestEntityTooLarge)
+					return
+				}
+				*side.recs, err = ReadCandump(f)
+				_ = f.Close()
+				if err != nil {
+					http.Error(w, fmt.Sprintf("%s: %v", side.field, err), http.StatusBadRequest)
+					return
+				}
+				side.dst.File = hdr.Filename
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rep.A.Frames, rep.B.Frames = len(a), len(b)
+		rep.IDs = DiffIDs(a, b)
+		all := r.URL.Query().Get("all") == "1"
+		kept := rep.IDs[:0]
+		for _, d := range rep.IDs {
+			if d.Status != IDSame {
+				rep.Changed++
+			}
+			if d.Status != IDSame || all {
+				kept = append(kept, d)
+			}
+		}
+		rep.IDs = kept
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(rep)
+	})
+}
+
+// parseWindow parses "<from>/<to>" relative to now.
+func parseWindow(s string, now time.Time) (from, to time.Time, err error) {
+	f, t, ok := strings.Cut(s, "/")
+	if !ok {
+		return from, to, fmt.Errorf("want <from>/<to>, e.g. -20m/-10m")
+	}
+	if from, err = parseWindowEnd(f, now); err != nil {
+		return
+	}
+	if to, err = parseWindowEnd(t, now); err != nil {
+		return
+	}
+	if !from.Before(to) {
+		err = fmt.Errorf("window ends before it starts")
+	}
+	return
+}
+
+func parseWindowEnd(s string, now time.Time) (time.Time, error) {
+	if s == "" || s == "now" {
+		return now, nil
+	}
+	if strings.HasPrefix(s, "-") {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
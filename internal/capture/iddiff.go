@@ -0,0 +1,206 @@
+package capture
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// ID diff statuses.
+const (
+	IDSame    = "same"
+	IDNew     = "new"     // only in B
+	IDGone    = "gone"    // only in A
+	IDRate    = "rate"    // frame rate changed by more than RateTolerance
+	IDPayload = "payload" // payloads seen in one capture only
+)
+
+// RateTolerance is the relative frame rate change DiffIDs still reports as
+// the same rate; periodic traffic jitters across windows.
+const RateTolerance = 0.2
+
+// maxPayloads bounds the payloads listed per ID and side.
+const maxPayloads = 8
+
+// IDStats summarises the frames of one CAN ID in a capture.
+type IDStats struct {
+	Frames   int     `json:"frames"`
+	Rate     float64 `json:"rate"`     // frames per second over the capture span
+	Payloads int     `json:"payloads"` // distinct payloads
+	Last     string  `json:"last,omitempty"`
+	// Varying marks the byte positions whose value changed within the
+	// capture (bit i for byte i), e.g. counters and measurements.
+	Varying uint64 `json:"varying,omitempty"`
+}
+
+// IDDiff compares the frames of one CAN ID in two captures.
+type IDDiff struct {
+	ID     string  `json:"id"`
+	Status string  `json:"status"` // IDSame, IDNew, IDGone, IDRate or IDPayload
+	A      IDStats `json:"a"`
+	B      IDStats `json:"b"`
+	// OnlyA and OnlyB list payloads seen in one capture only (at most
+	// maxPayloads each, hex).
+	OnlyA []string `json:"only_a,omitempty"`
+	OnlyB []string `json:"only_b,omitempty"`
+
+	canid uint32
+}
+
+// idFrames collects one capture side of an ID.
+type idFrames struct {
+	stats    IDStats
+	first    []byte
+	payloads map[string]struct{}
+	order    []string // payloads in order of appearance
+}
+
+func summarize(recs []Record) map[uint32]*idFrames {
+	out := make(map[uint32]*idFrames)
+	for i := range recs {
+		fr := &recs[i].Frame
+		p := fr.Data[:min(int(fr.Len), len(fr.Data))]
+		f := out[fr.CANID]
+		if f == nil {
+			f = &idFrames{first: append([]byte(nil), p...), payloads: make(map[string]struct{})}
+			out[fr.CANID] = f
+		}
+		f.stats.Frames++
+		for j := range max(len(p), len(f.first)) {
+			if (j < len(p)) != (j < len(f.first)) || j < len(p) && p[j] != f.first[j] {
+				f.stats.Varying |= 1 << j
+			}
+		}
+		key := string(p)
+		if _, ok := f.payloads[key]; !ok {
+			f.payloads[key] = struct{}{}
+			f.order = append(f.order, key)
+		}
+		f.stats.Last = hex.EncodeToString(p)
+	}
+	var span time.Duration
+	if len(recs) > 1 {
+		span = recs[len(recs)-1].Time.Sub(recs[0].Time)
+	}
+	for _, f := range out {
+		f.stats.Payloads = len(f.payloads)
+		if span > 0 {
+			f.stats.Rate = math.Round(float64(f.stats.Frames)/span.Seconds()*100) / 100
+		}
+	}
+	return out
+}
+
+// DiffIDs compares two captures ID by ID, e.g. the bus before and after a
+// module was swapped, and returns one entry per CAN ID seen in either,
+// ordered by ID. Rates are taken over each capture's own span, so windows
+// of different lengths compare. Payloads of IDs whose bytes vary in both
+// captures (counters, measurements) are not compared.
+func DiffIDs(a, b []Record) []IDDiff {
+	sa, sb := summarize(a), summarize(b)
+	ids := make(map[uint32]struct{}, len(sa)+len(sb))
+	for id := range sa {
+		ids[id] = struct{}{}
+	}
+	for id := range sb {
+		ids[id] = struct{}{}
+	}
+	out := make([]IDDiff, 0, len(ids))
+	for id := range ids {
+		d := IDDiff{ID: formatID(id), Status: IDSame, canid: id}
+		fa, fb := sa[id], sb[id]
+		switch {
+		case fa == nil:
+			d.Status, d.B = IDNew, fb.stats
+		case fb == nil:
+			d.Status, d.A = IDGone, fa.stats
+		default:
+			d.A, d.B = fa.stats, fb.stats
+			d.OnlyA = onlyIn(fa, fb)
+			d.OnlyB = onlyIn(fb, fa)
+			if (len(d.OnlyA) > 0 || len(d.OnlyB) > 0) && (fa.stats.Varying == 0 || fb.stats.Varying == 0) {
+				d.Status = IDPayload
+			} else if rateChanged(fa.stats.Rate, fb.stats.Rate) {
+				d.Status = IDRate
+			}
+		}
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].canid < out[j].canid })
+	return out
+}
+
+// onlyIn lists the payloads of x missing from y.
+func onlyIn(x, y *idFrames) []string {
+	var out []string
+	for _, p := range x.order {
+		if _, ok := y.payloads[p]; !ok {
+			if len(out) == maxPayloads {
+				break
+			}
+			out = append(out, hex.EncodeToString([]byte(p)))
+		}
+	}
+	return out
+}
+
+func rateChanged(a, b float64) bool {
+	if a == 0 || b == 0 {
+		return a != b
+	}
+	return math.Abs(b-a)/a > RateTolerance
+}
+
+// formatID renders a CAN ID like the candump format: 3 hex digits for
+// standard IDs, 8 for extended ones, with the flags as suffixes.
+func formatID(canid uint32) string {
+	s := fmt.Sprintf("%03X", canid&can.CAN_SFF_MASK)
+	if canid&can.CAN_EFF_FLAG != 0 {
+		s = fmt.Sprintf("%08X", canid&can.CAN_EFF_MASK)
+	}
+	if canid&can.CAN_RTR_FLAG != 0 {
+		s += " rtr"
+	}
+	if canid&can.CAN_ERR_FLAG != 0 {
+		s += " err"
+	}
+	return s
+}
+
+// WriteIDDiffs writes a text report of diffs, listing only the IDs that
+// changed unless all is set. It returns how many changed.
+func WriteIDDiffs(w io.Writer, diffs []IDDiff, all bool) int {
+	changed := 0
+	for i := range diffs {
+		d := &diffs[i]
+		if d.Status != IDSame {
+			changed++
+		} else if !all {
+			continue
+		}
+		fmt.Fprintf(w, "%-8s %-12s frames %d -> %d, rate %.2f/s -> %.2f/s", d.Status, d.ID, d.A.Frames, d.B.Frames, d.A.Rate, d.B.Rate)
+		if d.A.Last != "" || d.B.Last != "" {
+			fmt.Fprintf(w, ", last %s -> %s", orDash(d.A.Last), orDash(d.B.Last))
+		}
+		fmt.Fprintln(w)
+		for _, p := range d.OnlyA {
+			fmt.Fprintf(w, "         - %s\n", orDash(p))
+		}
+		for _, p := range d.OnlyB {
+			fmt.Fprintf(w, "         + %s\n", orDash(p))
+		}
+	}
+	return changed
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,152 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// before: 0x100 constant at 10/s, 0x200 counting, 0x300 present.
+const diffBefore = `(1700000000.000000) can0 100#01
+(1700000000.000000) can0 200#00
+(1700000000.000000) can0 300#
+(1700000000.100000) can0 100#01
+(1700000000.100000) can0 200#01
+(1700000001.000000) can0 100#01
+`
+
+// after: 0x100 changed payload, 0x200 still counting, 0x300 gone, 0x400 new.
+const diffAfter = `(1700000100.000000) can0 100#02
+(1700000100.000000) can0 200#07
+(1700000100.100000) can0 100#02
+(1700000100.100000) can0 200#08
+(1700000100.500000) can0 400#FF
+(1700000101.000000) can0 100#02
+`
+
+func TestDiffIDs(t *testing.T) {
+	a, _ := ReadCandump(strings.NewReader(diffBefore))
+	b, _ := ReadCandump(strings.NewReader(diffAfter))
+	diffs := DiffIDs(a, b)
+	got := map[string]string{}
+	for _, d := range diffs {
+		got[d.ID] = d.Status
+	}
+	want := map[string]string{"100": IDPayload, "200": IDSame, "300": IDGone, "400": IDNew}
+	for id, st := range want {
+		if got[id] != st {
+			t.Errorf("%s: status %q, want %q", id, got[id], st)
+		}
+	}
+	if d := diffs[0]; d.A.Frames != 3 || d.B.Frames != 3 || len(d.OnlyA) != 1 || d.OnlyA[0] != "01" || d.OnlyB[0] != "02" {
+		t.Fatalf("0x100: %+v", d)
+	}
+	if d := diffs[1]; d.A.Varying != 1 || d.B.Varying != 1 {
+		t.Fatalf("0x200 varying %b %b", d.A.Varying, d.B.Varying)
+	}
+	var buf bytes.Buffer
+	if n := WriteIDDiffs(&buf, diffs, false); n != 3 || strings.Contains(buf.String(), "200") {
+		t.Fatalf("report (%d changed):\n%s", n, buf.String())
+	}
+}
+
+func TestDiffRate(t *testing.T) {
+	mk := func(n int) []Record {
+		recs := make([]Record, n)
+		for i := range recs {
+			recs[i].Time = time.Unix(0, 0).Add(time.Duration(i) * time.Second / time.Duration(n-1))
+			recs[i].Frame.CANID = 0x10
+		}
+		return recs
+	}
+	if d := DiffIDs(mk(11), mk(12)); d[0].Status != IDSame {
+		t.Fatalf("10%% faster: %+v", d[0])
+	}
+	if d := DiffIDs(mk(11), mk(21)); d[0].Status != IDRate {
+		t.Fatalf("twice as fast: %+v", d[0])
+	}
+}
+
+func TestDiffHandler(t *testing.T) {
+	r := NewRing(16)
+	now := time.Now()
+	r.now = func() time.Time { return now.Add(-30 * time.Minute) }
+	r.Add(parseTestFrame(t, "100#01"))
+	r.now = func() time.Time { return now.Add(-5 * time.Minute) }
+	r.Add(parseTestFrame(t, "100#02"))
+	h := DiffHandler(map[string]Target{"": {Ring: r, Iface: "can0"}})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/diff?a=-1h/-10m&b=-10m/now", nil))
+	var rep DiffReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if rep.A.Frames != 1 || rep.B.Frames != 1 || rep.Changed != 1 || rep.IDs[0].Status != IDPayload {
+		t.Fatalf("report %+v", rep)
+	}
+	for _, q := range []string{"a=-1h&b=-10m/now", "a=-10m/-1h&b=/now", "a=x/now&b=/now"} {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/diff?"+q, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status %d", q, rec.Code)
+		}
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, f := range []struct{ name, data string }{{"a", diffBefore}, {"b", diffBefore}} {
+		fw, _ := mw.CreateFormFile(f.name, f.name+".log")
+		_, _ = fw.Write([]byte(f.data))
+	}
+	_ = mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/diff?all=1", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	rep = DiffReport{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if rep.Changed != 0 || len(rep.IDs) != 3 || rep.A.File != "a.log" {
+		t.Fatalf("report %+v", rep)
+	}
+
+	// An oversized upload is refused instead of being diffed cut short.
+	pr, pw := io.Pipe()
+	mw = multipart.NewWriter(pw)
+	go func() {
+		fw, _ := mw.CreateFormFile("a", "a.log")
+		line := []byte("(0.000000) can0 100#01\n")
+		for n := 0; n <= maxDiffUpload; n += len(line) {
+			_, _ = fw.Write(line)
+		}
+		_ = mw.Close()
+		_ = pw.Close()
+	}()
+	req = httptest.NewRequest(http.MethodPost, "/api/diff", pr)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	_ = pr.Close()
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized upload: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func parseTestFrame(t *testing.T, s string) can.Frame {
+	t.Helper()
+	fr, err := can.ParseFrame(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fr
+}
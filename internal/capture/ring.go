@@ -0,0 +1,192 @@
+// Package capture keeps a bounded in-memory history of bus frames so that
+// recent traffic can be retrieved after the fact (e.g. by a client that was
+// disconnected when something happened).
+package capture
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/clock"
+)
+
+// Record is one captured frame with its receive time.
+type Record struct {
+	Time  time.Time
+	Frame can.Frame
+	// Step is the wall clock step detected since the previous record, if
+	// any (see package clock); times before and after it do not compare.
+	Step time.Duration
+}
+
+// Ring is a fixed-capacity circular buffer of frames. Safe for concurrent use.
+type Ring struct {
+	mu    sync.Mutex
+	buf   []Record
+	next  int
+	full  bool
+	total uint64
+	now   func() time.Time
+	steps func() (uint64, time.Duration)
+	seen  uint64 // clock steps already flagged
+}
+
+// NewRing returns a ring holding the most recent size frames.
+func NewRing(size int) *Ring {
+	if size <= 0 {
+		size = 1
+	}
+	r := &Ring{buf: make([]Record, size), now: clock.Now, steps: clock.Steps}
+	r.seen, _ = r.steps()
+	return r
+}
+
+// Add records fr with the current time.
+func (r *Ring) Add(fr can.Frame) {
+	now := r.now()
+	n, step := r.steps()
+	r.mu.Lock()
+	rec := Record{Time: now, Frame: fr}
+	if n != r.seen {
+		r.seen, rec.Step = n, step
+	}
+	r.buf[r.next] = rec
+	r.next++
+	if r.next == len(r.buf) {
+		r.next = 0
+		r.full = true
+	}
+	r.total++
+	r.mu.Unlock()
+}
+
+// Since returns the frames recorded at or after t, oldest first.
+func (r *Ring) Since(t time.Time) []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.next
+	start := 0
+	if r.full {
+		n = len(r.buf)
+		start = r.next
+	}
+	// Records are time-ordered; skip the prefix older than t.
+	first := n
+	for i := 0; i < n; i++ {
+		if !r.buf[(start+i)%len(r.buf)].Time.Before(t) {
+			first = i
+			break
+		}
+	}
+	out := make([]Record, 0, n-first)
+	for i := first; i < n; i++ {
+		out = append(out, r.buf[(start+i)%len(r.buf)])
+	}
+	return out
+}
+
+// Between returns the frames recorded from from up to and including to,
+// oldest first.
+func (r *Ring) Between(from, to time.Time) []Record {
+	recs := r.Since(from)
+	for i, rec := range recs {
+		if rec.Time.After(to) {
+			return recs[:i]
+		}
+	}
+	return recs
+}
+
+// Last returns the frames recorded within d before now, oldest first.
+func (r *Ring) Last(d time.Duration) []Record { return r.Since(r.now().Add(-d)) }
+
+// Stats reports the ring capacity, frames held and frames ever added.
+func (r *Ring) Stats() (capacity, held int, total uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	held = r.next
+	if r.full {
+		held = len(r.buf)
+	}
+	return len(r.buf), held, r.total
+}
+
+// WriteCandump writes recs in candump log format ("(sec.usec) iface ID#DATA"),
+// readable by can-utils canplayer and log2asc.
+func WriteCandump(w io.Writer, iface string, recs []Record) error {
+	return WriteCandumpAnnotated(w, iface, recs, nil)
+}
+
+// WriteCandumpAnnotated is WriteCandump with a "# note" comment line after
+// every frame note describes; canplayer skips comment lines. A record
+// taken after a clock step is preceded by a "# clock step" comment.
+func WriteCandumpAnnotated(w io.Writer, iface string, recs []Record, note func(*can.Frame) string) error {
+	return WriteCandumpIfaces(w, []string{iface}, recs, note)
+}
+
+// WriteCandumpIfaces is WriteCandumpAnnotated for a backend with several
+// interfaces: each frame is written with ifaces[Frame.Iface], or ifaces[0]
+// when the index is out of range.
+func WriteCandumpIfaces(w io.Writer, ifaces []string, recs []Record, note func(*can.Frame) string) error {
+	for i := range recs {
+		rec := &recs[i]
+		if rec.Step != 0 {
+			if _, err := fmt.Fprintf(w, "# clock step %+.6fs\n", rec.Step.Seconds()); err != nil {
+				return err
+			}
+		}
+		iface := ifaces[0]
+		if int(rec.Frame.Iface) < len(ifaces) {
+			iface = ifaces[rec.Frame.Iface]
+		}
+		us := rec.Time.UnixMicro()
+		if _, err := fmt.Fprintf(w, "(%d.%06d) %s %s\n", us/1e6, us%1e6, iface, rec.Frame); err != nil {
+			return err
+		}
+		if note == nil {
+			continue
+		}
+		if s := note(&rec.Frame); s != "" {
+			if _, err := fmt.Fprintf(w, "# %s\n", s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadCandump parses a candump log as written by WriteCandump (or
+// candump -l): "(sec.usec) iface ID#DATA" lines. Blank lines and "#"
+// comments are skipped.
+func ReadCandump(r io.Reader) ([]Record, error) {
+	var recs []Record
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) < 3 || !strings.HasPrefix(f[0], "(") || !strings.HasSuffix(f[0], ")") {
+			return nil, fmt.Errorf("line %d: want \"(sec.usec) iface ID#DATA\"", ln)
+		}
+		sec, usec, ok := strings.Cut(f[0][1:len(f[0])-1], ".")
+		s, err1 := strconv.ParseInt(sec, 10, 64)
+		us, err2 := strconv.ParseInt(usec, 10, 64)
+		if !ok || err1 != nil || err2 != nil || len(usec) != 6 {
+			return nil, fmt.Errorf("line %d: bad timestamp %s", ln, f[0])
+		}
+		fr, err := can.ParseFrame(f[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", ln, err)
+		}
+		recs = append(recs, Record{Time: time.Unix(s, us*1000), Frame: fr})
+	}
+	return recs, sc.Err()
+}
@@ -0,0 +1,147 @@
+package capture
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/annotate"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestRingSinceWraps(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	now := base
+	r := NewRing(3)
+	r.now = func() time.Time { return now }
+	for i := 0; i < 5; i++ {
+		now = base.Add(time.Duration(i) * time.Second)
+		r.Add(can.Frame{CANID: uint32(i)})
+	}
+	recs := r.Since(base)
+	if len(recs) != 3 || recs[0].Frame.CANID != 2 || recs[2].Frame.CANID != 4 {
+		t.Fatalf("since(base) = %+v", recs)
+	}
+	recs = r.Last(1500 * time.Millisecond)
+	if len(recs) != 2 || recs[0].Frame.CANID != 3 {
+		t.Fatalf("last(1.5s) = %+v", recs)
+	}
+	if capacity, held, total := r.Stats(); capacity != 3 || held != 3 || total != 5 {
+		t.Fatalf("stats = %d %d %d", capacity, held, total)
+	}
+}
+
+func TestWriteCandumpAndHandler(t *testing.T) {
+	r := NewRing(4)
+	r.now = func() time.Time { return time.Unix(1700000000, 123456000) }
+	r.Add(can.Frame{CANID: 0x123, Len: 2, Data: [64]byte{0xDE, 0xAD}})
+	var buf bytes.Buffer
+	if err := WriteCandump(&buf, "can0", r.Since(time.Time{})); err != nil {
+		t.Fatal(err)
+	}
+	if want := "(1700000000.123456) can0 123#DEAD\n"; buf.String() != want {
+		t.Fatalf("candump = %q, want %q", buf.String(), want)
+	}
+
+	h := Handler(map[string]Target{"": {Ring: r, Iface: "can0"}}, nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/capture?seconds=3600", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Capture-Frames") != "1" || rec.Body.String() != buf.String() {
+		t.Fatalf("status %d frames %s", rec.Code, rec.Header().Get("X-Capture-Frames"))
+	}
+	for _, q := range []string{"seconds=0", "seconds=abc", "seconds=7200"} {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/capture?"+q, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status %d", q, rec.Code)
+		}
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/capture?instance=nope", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown instance: status %d", rec.Code)
+	}
+}
+
+func TestHandlerAnnotate(t *testing.T) {
+	r := NewRing(4)
+	r.now = func() time.Time { return time.Unix(1700000000, 0) }
+	r.Add(can.Frame{CANID: 0x1D001234 | can.CAN_EFF_FLAG, Len: 1, Data: [64]byte{0x10}})
+	r.Add(can.Frame{CANID: 0x123, Len: 1})
+	ann, err := annotate.New("ampio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Handler(map[string]Target{"": {Ring: r, Iface: "can0"}}, ann)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/capture?annotate=all", nil))
+	want := "(1700000000.000000) can0 1D001234#10\n# ampio module=001234 type=0x10\n(1700000000.000000) can0 123#00\n"
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Fatalf("status %d body %q, want %q", rec.Code, rec.Body.String(), want)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/capture?annotate=dbc", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("unconfigured decoder: status %d", rec.Code)
+	}
+}
+
+func TestReadCandump(t *testing.T) {
+	in := "# golden\n(1700000000.123456) can0 123#DEAD\n# note\n\n(1700000001.000001) vcan1 1D000123#R\n"
+	recs, err := ReadCandump(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || !recs[0].Time.Equal(time.Unix(1700000000, 123456000)) || recs[1].Frame.String() != "1D000123#R" {
+		t.Fatalf("records = %+v", recs)
+	}
+	var buf bytes.Buffer
+	_ = WriteCandump(&buf, "can0", recs[:1])
+	if again, err := ReadCandump(&buf); err != nil || len(again) != 1 || again[0] != recs[0] {
+		t.Fatalf("round trip = %+v, %v", again, err)
+	}
+	for _, bad := range []string{"123#00", "(1.5) can0 123#00", "(x.000000) can0 123#00", "(1.000000) can0 12#0"} {
+		if _, err := ReadCandump(strings.NewReader(bad)); err == nil {
+			t.Fatalf("%q: expected error", bad)
+		}
+	}
+}
+
+func TestWriteCandumpIfaces(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	recs := []Record{
+		{Time: at, Frame: can.Frame{CANID: 0x100, Iface: 1}},
+		{Time: at, Frame: can.Frame{CANID: 0x101}},
+		{Time: at, Frame: can.Frame{CANID: 0x102, Iface: 7}}, // unknown index
+	}
+	var buf bytes.Buffer
+	if err := WriteCandumpIfaces(&buf, []string{"can0", "can1"}, recs, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := "(1700000000.000000) can1 100#\n(1700000000.000000) can0 101#\n(1700000000.000000) can0 102#\n"
+	if buf.String() != want {
+		t.Fatalf("candump = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestClockStepFlagged(t *testing.T) {
+	r := NewRing(4)
+	r.now = func() time.Time { return time.Unix(1700000000, 0) }
+	var steps uint64
+	r.steps = func() (uint64, time.Duration) { return steps, -90 * time.Second }
+	r.Add(can.Frame{CANID: 0x100})
+	steps++
+	r.Add(can.Frame{CANID: 0x101})
+	r.Add(can.Frame{CANID: 0x102})
+	var buf bytes.Buffer
+	if err := WriteCandump(&buf, "can0", r.Since(time.Time{})); err != nil {
+		t.Fatal(err)
+	}
+	want := "(1700000000.000000) can0 100#\n# clock step -90.000000s\n(1700000000.000000) can0 101#\n(1700000000.000000) can0 102#\n"
+	if buf.String() != want {
+		t.Fatalf("candump = %q, want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,266 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/clock"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// Trigger reasons (capture_triggers_total{reason}).
+const (
+	ReasonFrame = "frame"
+	ReasonError = "error"
+	ReasonDrops = "drops"
+)
+
+// Trigger is a set of conditions starting a triggered capture; any one of
+// them fires it.
+type Trigger struct {
+	frames   []frameCond
+	errors   bool
+	dropRate uint64 // hub drops per second above which to fire; 0 = off
+	spec     string
+}
+
+// frameCond matches frames of one ID whose payload equals data under mask.
+type frameCond struct {
+	id         uint32
+	data, mask []byte
+}
+
+// ParseTrigger parses a comma-separated list of conditions:
+//
+//	0x1A0             any frame with this ID
+//	0x1A0#01FF        ... whose payload starts with these bytes
+//	0x1A0#0100/FF00   ... compared under a mask of the same length
+//	error             an error frame reported by the controller
+//	drops>100         more than 100 frames a second dropped for slow clients
+//
+// An empty spec returns nil.
+func ParseTrigger(spec string) (*Trigger, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	t := &Trigger{spec: spec}
+	for _, f := range strings.Split(spec, ",") {
+		f = strings.TrimSpace(f)
+		switch {
+		case f == "error":
+			t.errors = true
+		case strings.HasPrefix(f, "drops>"):
+			n, err := strconv.ParseUint(f[len("drops>"):], 10, 64)
+			if err != nil || n == 0 {
+				return nil, fmt.Errorf("trigger %q: want drops>N with N > 0", f)
+			}
+			t.dropRate = n
+		default:
+			c, err := parseFrameCond(f)
+			if err != nil {
+				return nil, fmt.Errorf("trigger %q: %w", f, err)
+			}
+			t.frames = append(t.frames, c)
+		}
+	}
+	return t, nil
+}
+
+func parseFrameCond(s string) (frameCond, error) {
+	var c frameCond
+	idStr, payload, hasData := strings.Cut(s, "#")
+	id, err := strconv.ParseUint(idStr, 0, 32)
+	if err != nil || id > can.CAN_EFF_MASK {
+		return c, fmt.Errorf("invalid id %q", idStr)
+	}
+	c.id = uint32(id)
+	if !hasData {
+		return c, nil
+	}
+	dataStr, maskStr, hasMask := strings.Cut(payload, "/")
+	if c.data, err = hex.DecodeString(dataStr); err != nil || len(c.data) == 0 || len(c.data) > 8 {
+		return c, fmt.Errorf("invalid data %q: want 1-8 hex bytes", dataStr)
+	}
+	if !hasMask {
+		c.mask = bytes.Repeat([]byte{0xFF}, len(c.data))
+	} else if c.mask, err = hex.DecodeString(maskStr); err != nil || len(c.mask) != len(c.data) {
+		return c, fmt.Errorf("invalid mask %q: want as many bytes as the data", maskStr)
+	}
+	return c, nil
+}
+
+func (t *Trigger) String() string { return t.spec }
+
+// WatchesDrops reports whether the trigger has a drops> condition.
+func (t *Trigger) WatchesDrops() bool { return t.dropRate > 0 }
+
+// match returns the reason fr fires the trigger, or "".
+func (t *Trigger) match(fr *can.Frame) string {
+	if fr.CANID&can.CAN_ERR_FLAG != 0 {
+		if t.errors {
+			return ReasonError
+		}
+		return ""
+	}
+	for i := range t.frames {
+		if t.frames[i].match(fr) {
+			return ReasonFrame
+		}
+	}
+	return ""
+}
+
+func (c *frameCond) match(fr *can.Frame) bool {
+	if fr.CANID&can.CAN_EFF_MASK != c.id || int(fr.Len) < len(c.data) {
+		return false
+	}
+	for i, b := range c.data {
+		if fr.Data[i]&c.mask[i] != b&c.mask[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TriggerConfig configures a Triggered capture.
+type TriggerConfig struct {
+	Trigger   *Trigger
+	Ring      *Ring
+	Iface     string        // bus name in the file, also its name prefix
+	Ifaces    []string      // per-interface bus names in the file, if several
+	Dir       string        // directory the captures are written to
+	Pre, Post time.Duration // window around the trigger
+	Keep      int           // captures of Iface kept in Dir; 0 keeps all
+	// Drops returns the frames dropped for slow clients so far; required
+	// by drops> conditions.
+	Drops  func() uint64
+	Logger *slog.Logger
+}
+
+// firing is a trigger that fired.
+type firing struct {
+	at     time.Time
+	reason string
+}
+
+// Triggered writes the frames around each firing of a trigger to a candump
+// file, like an oscilloscope in normal trigger mode: once fired it records
+// Post more, writes Pre before to Post after, and re-arms. Firings during
+// the post window extend nothing; they are part of that capture.
+type Triggered struct {
+	cfg   TriggerConfig
+	fired chan firing
+}
+
+// NewTriggered returns a triggered capture; it fires once Run is started.
+func NewTriggered(cfg TriggerConfig) *Triggered {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return &Triggered{cfg: cfg, fired: make(chan firing, 1)}
+}
+
+// Observe checks fr against the trigger. It is meant for the hub tap, after
+// the frame was added to the ring, and never blocks.
+func (t *Triggered) Observe(fr can.Frame) {
+	if reason := t.cfg.Trigger.match(&fr); reason != "" {
+		t.fire(reason)
+	}
+}
+
+func (t *Triggered) fire(reason string) {
+	select {
+	case t.fired <- firing{at: clock.Now(), reason: reason}:
+	default: // a capture is already pending
+	}
+}
+
+// Run waits for firings and writes their captures until ctx is done. A
+// capture whose post window is cut short by shutdown is written with what
+// was recorded.
+func (t *Triggered) Run(ctx context.Context) {
+	var tick <-chan time.Time
+	var drops uint64
+	if t.cfg.Trigger.WatchesDrops() && t.cfg.Drops != nil {
+		tk := time.NewTicker(time.Second)
+		defer tk.Stop()
+		tick, drops = tk.C, t.cfg.Drops()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			n := t.cfg.Drops()
+			if n-drops > t.cfg.Trigger.dropRate {
+				t.fire(ReasonDrops)
+			}
+			drops = n
+		case f := <-t.fired:
+			metrics.IncCaptureTrigger(f.reason)
+			timer := time.NewTimer(t.cfg.Post)
+			select {
+			case <-ctx.Done():
+			case <-timer.C:
+			}
+			timer.Stop()
+			t.write(f)
+			// Firings during the window belong to this capture.
+			select {
+			case <-t.fired:
+			default:
+			}
+			if tick != nil {
+				drops = t.cfg.Drops()
+			}
+		}
+	}
+}
+
+// write saves the window of f and prunes old captures.
+func (t *Triggered) write(f firing) {
+	recs := t.cfg.Ring.Between(f.at.Add(-t.cfg.Pre), f.at.Add(t.cfg.Post))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# trigger %s (%s) at %s, window -%s/+%s\n", f.reason, t.cfg.Trigger, f.at.UTC().Format(time.RFC3339Nano), t.cfg.Pre, t.cfg.Post)
+	ifaces := t.cfg.Ifaces
+	if len(ifaces) == 0 {
+		ifaces = []string{t.cfg.Iface}
+	}
+	_ = WriteCandumpIfaces(&buf, ifaces, recs, nil)
+	name := filepath.Join(t.cfg.Dir, fmt.Sprintf("%s-trigger-%s.log", t.cfg.Iface, f.at.UTC().Format("20060102T150405.000Z")))
+	if err := os.WriteFile(name, buf.Bytes(), 0o600); err != nil {
+		metrics.IncError(metrics.ErrCapture)
+		t.cfg.Logger.Error("capture_trigger_write_error", "path", name, "error", err)
+		return
+	}
+	t.cfg.Logger.Warn("capture_triggered", "reason", f.reason, "path", name, "frames", len(recs))
+	t.prune()
+}
+
+// prune deletes the oldest captures of the bus beyond Keep.
+func (t *Triggered) prune() {
+	if t.cfg.Keep <= 0 {
+		return
+	}
+	names, err := filepath.Glob(filepath.Join(t.cfg.Dir, t.cfg.Iface+"-trigger-*.log"))
+	if err != nil || len(names) <= t.cfg.Keep {
+		return
+	}
+	sort.Strings(names) // UTC timestamps sort by time
+	for _, n := range names[:len(names)-t.cfg.Keep] {
+		if err := os.Remove(n); err != nil {
+			t.cfg.Logger.Warn("capture_trigger_prune_error", "path", n, "error", err)
+		}
+	}
+}
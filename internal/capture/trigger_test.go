@@ -0,0 +1,93 @@
+package capture
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestParseTrigger(t *testing.T) {
+	tr, err := ParseTrigger("0x1A0#0100/FF00, error, drops>50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		fr   can.Frame
+		want string
+	}{
+		{can.Frame{CANID: 0x1A0, Len: 2, Data: [64]byte{0x01, 0x77}}, ReasonFrame},
+		{can.Frame{CANID: 0x1A0, Len: 2, Data: [64]byte{0x02, 0x00}}, ""},
+		{can.Frame{CANID: 0x1A0, Len: 1, Data: [64]byte{0x01}}, ""}, // shorter than the pattern
+		{can.Frame{CANID: 0x1A1, Len: 2, Data: [64]byte{0x01}}, ""},
+		{can.Frame{CANID: can.CAN_ERR_FLAG | 0x4, Len: 8}, ReasonError},
+	} {
+		if got := tr.match(&c.fr); got != c.want {
+			t.Errorf("%v: reason %q, want %q", c.fr, got, c.want)
+		}
+	}
+	if !tr.WatchesDrops() {
+		t.Fatal("drops condition lost")
+	}
+	if tr, err := ParseTrigger(" "); tr != nil || err != nil {
+		t.Fatalf("empty spec: %v %v", tr, err)
+	}
+	for _, bad := range []string{"0x1A0#0", "0x1A0#01/FF00", "drops>0", "drops>x", "0x40000000", "errors"} {
+		if _, err := ParseTrigger(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestTriggeredWritesWindow(t *testing.T) {
+	dir := t.TempDir()
+	tr, _ := ParseTrigger("0x100")
+	r := NewRing(64)
+	tg := NewTriggered(TriggerConfig{Trigger: tr, Ring: r, Iface: "can0", Dir: dir, Pre: time.Minute, Post: 50 * time.Millisecond, Keep: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() { defer close(done); tg.Run(ctx) }()
+	tap := func(fr can.Frame) { r.Add(fr); tg.Observe(fr) }
+
+	captures := func() []string {
+		names, _ := filepath.Glob(filepath.Join(dir, "can0-trigger-*.log"))
+		return names
+	}
+	var last string
+	for round := 0; round < 2; round++ {
+		tap(can.Frame{CANID: 0x0FF})
+		tap(can.Frame{CANID: 0x100}) // fires
+		tap(can.Frame{CANID: 0x100}) // within the post window
+		tap(can.Frame{CANID: 0x101})
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if names := captures(); len(names) > 0 && names[len(names)-1] != last {
+				last = names[len(names)-1]
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if names := captures(); len(names) == 0 || names[len(names)-1] != last {
+			t.Fatalf("round %d: no capture written", round)
+		}
+		time.Sleep(100 * time.Millisecond) // past the window, re-armed
+	}
+	names := captures()
+	if len(names) != 1 {
+		t.Fatalf("captures %v, want the newest only (keep 1)", names)
+	}
+	b, err := os.ReadFile(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "# trigger frame (0x100)") || strings.Count(string(b), " can0 ") != 8 {
+		t.Fatalf("capture:\n%s", b)
+	}
+	cancel()
+	<-done
+}
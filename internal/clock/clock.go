@@ -0,0 +1,157 @@
+// Package clock timestamps frames for captures and clients. It compares the
+// wall clock against the monotonic clock on every reading, so a step of the
+// system time (NTP syncing after boot, an operator running date, a Pi
+// without an RTC restoring its fake-hwclock) is detected, logged and, by
+// default, kept from making timestamps run backwards.
+package clock
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/logging"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// Policy is how a Clock treats a backward step.
+type Policy int
+
+const (
+	// Correct keeps timestamps monotonic: after a backward step they stay on
+	// the old timeline and converge on the wall clock at slewRate.
+	Correct Policy = iota
+	// Flag follows the wall clock, backward steps included; steps are only
+	// logged, counted and flagged (Steps).
+	Flag
+)
+
+// ParsePolicy parses "correct" or "flag"; "" is Correct.
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "", "correct":
+		return Correct, nil
+	case "flag":
+		return Flag, nil
+	}
+	return 0, fmt.Errorf("unknown clock step policy %q (have correct, flag)", s)
+}
+
+func (p Policy) String() string {
+	if p == Flag {
+		return "flag"
+	}
+	return "correct"
+}
+
+// DefaultThreshold is the smallest wall/monotonic divergence between two
+// readings treated as a step; NTP slews far slower than that.
+const DefaultThreshold = 500 * time.Millisecond
+
+// slewRate is the share of elapsed time by which a backward step correction
+// is paid back: timestamps then advance at 90% of real time.
+const slewRate = 0.1
+
+// Clock issues timestamps. Safe for concurrent use.
+type Clock struct {
+	policy    Policy
+	threshold time.Duration
+	// read returns the wall time and a monotonic reading.
+	read func() (time.Time, time.Duration)
+
+	mu       sync.Mutex
+	started  bool
+	wall     time.Time     // previous wall reading
+	mono     time.Duration // previous monotonic reading
+	stamp    time.Time     // last timestamp issued
+	offset   time.Duration // correction added to the wall clock (Correct)
+	steps    uint64
+	lastStep time.Duration
+}
+
+// New returns a clock treating divergences of at least threshold as steps
+// (DefaultThreshold when <= 0).
+func New(policy Policy, threshold time.Duration) *Clock {
+	if threshold <= 0 {
+		threshold = DefaultThreshold
+	}
+	start := time.Now()
+	return &Clock{policy: policy, threshold: threshold, read: func() (time.Time, time.Duration) {
+		t := time.Now()
+		return t.Round(0), t.Sub(start)
+	}}
+}
+
+// Now returns the current timestamp, without a monotonic reading.
+func (c *Clock) Now() time.Time {
+	wall, mono := c.read()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.started {
+		elapsed := mono - c.mono
+		if c.offset > 0 {
+			c.offset -= min(c.offset, time.Duration(float64(elapsed)*slewRate))
+		}
+		if step := wall.Sub(c.wall) - elapsed; step >= c.threshold || step <= -c.threshold {
+			c.stepped(step)
+		}
+	}
+	c.started, c.wall, c.mono = true, wall, mono
+	ts := wall.Add(c.offset)
+	if c.policy == Correct && ts.Before(c.stamp) {
+		ts = c.stamp
+	}
+	c.stamp = ts
+	return ts
+}
+
+// stepped records a step of the wall clock. c.mu is held.
+func (c *Clock) stepped(step time.Duration) {
+	c.steps++
+	c.lastStep = step
+	dir := "forward"
+	if step < 0 {
+		dir = "backward"
+	}
+	if c.policy == Correct {
+		// A forward step first cancels an outstanding correction.
+		c.offset = max(0, c.offset-step)
+	}
+	metrics.IncClockStep(dir)
+	logging.L().Warn("clock_step", "direction", dir, "step", step, "policy", c.policy.String(), "correction", c.offset)
+}
+
+// Steps reports how many steps were detected and the latest one.
+func (c *Clock) Steps() (n uint64, last time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.steps, c.lastStep
+}
+
+// Watch reads the clock every interval until ctx is done, so steps are
+// detected and logged while no frames are timestamped.
+func (c *Clock) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			c.Now()
+		}
+	}
+}
+
+var def = New(Correct, DefaultThreshold)
+
+// SetDefault replaces the process clock. Call it before timestamps are
+// issued.
+func SetDefault(c *Clock) { def = c }
+
+// Now returns a timestamp from the process clock.
+func Now() time.Time { return def.Now() }
+
+// Steps reports the steps detected by the process clock.
+func Steps() (uint64, time.Duration) { return def.Steps() }
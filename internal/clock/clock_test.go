@@ -0,0 +1,82 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+// fake is a clock whose wall and monotonic readings are set by the test.
+type fake struct {
+	wall time.Time
+	mono time.Duration
+}
+
+func (f *fake) advance(d time.Duration) { f.wall, f.mono = f.wall.Add(d), f.mono+d }
+
+func newFake(policy Policy) (*Clock, *fake) {
+	f := &fake{wall: time.Unix(1700000000, 0)}
+	c := New(policy, time.Second)
+	c.read = func() (time.Time, time.Duration) { return f.wall, f.mono }
+	return c, f
+}
+
+func TestCorrectBackwardStep(t *testing.T) {
+	c, f := newFake(Correct)
+	c.Now()
+	f.advance(10 * time.Second)
+	before := c.Now()
+	f.advance(time.Second)
+	f.wall = f.wall.Add(-time.Hour) // NTP steps back an hour
+	after := c.Now()
+	if got := after.Sub(before); got != time.Second {
+		t.Fatalf("timestamp advanced %v across the step, want 1s", got)
+	}
+	if n, step := c.Steps(); n != 1 || step != -time.Hour {
+		t.Fatalf("steps = %d %v", n, step)
+	}
+	// The correction is paid back at slewRate: timestamps advance 9s per 10s.
+	f.advance(10 * time.Second)
+	if got := c.Now().Sub(after); got != 9*time.Second {
+		t.Fatalf("slewed advance %v, want 9s", got)
+	}
+	// A forward step cancels the outstanding correction.
+	f.wall = f.wall.Add(2 * time.Hour)
+	if got, want := c.Now(), f.wall; !got.Equal(want) {
+		t.Fatalf("after forward step %v, want wall clock %v", got, want)
+	}
+	if n, step := c.Steps(); n != 2 || step != 2*time.Hour {
+		t.Fatalf("steps = %d %v", n, step)
+	}
+}
+
+func TestFlagFollowsWallClock(t *testing.T) {
+	c, f := newFake(Flag)
+	c.Now()
+	f.advance(time.Second)
+	f.wall = f.wall.Add(-time.Minute)
+	if got, want := c.Now(), f.wall; !got.Equal(want) {
+		t.Fatalf("got %v, want wall clock %v", got, want)
+	}
+	if n, _ := c.Steps(); n != 1 {
+		t.Fatalf("steps = %d, want 1", n)
+	}
+	// Divergence below the threshold is not a step.
+	f.advance(time.Second)
+	f.wall = f.wall.Add(-100 * time.Millisecond)
+	c.Now()
+	if n, _ := c.Steps(); n != 1 {
+		t.Fatalf("steps = %d, want 1", n)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, s := range []string{"correct", "flag"} {
+		p, err := ParsePolicy(s)
+		if err != nil || p.String() != s {
+			t.Fatalf("%s: %v %v", s, p, err)
+		}
+	}
+	if _, err := ParsePolicy("off"); err == nil {
+		t.Fatal("unknown policy accepted")
+	}
+}
@@ -8,33 +8,73 @@ import (
 	"io"
 
 	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/validate"
 
 	"github.com/kstaniek/go-ampio-server/internal/can"
 )
 
-// Codec encodes/decodes cannelloni frames. Stateless and safe for concurrent use.
-type Codec struct{}
+// MaxFrameSize is the largest wire size of one classic frame: 4-byte ID,
+// length byte and 8 data bytes.
+const MaxFrameSize = 4 + 1 + 8
 
-// ErrInvalidLength is returned when a frame length (DLC) is outside 0..8.
+// MaxFDFrameSize is the largest wire size of one CAN FD frame: 4-byte ID,
+// length byte, flags byte and 64 data bytes.
+const MaxFDFrameSize = 4 + 1 + 1 + can.MaxFDLen
+
+// LenFD is the high bit of the length byte. As in cannelloni it marks a CAN
+// FD frame: a flags byte (can.CANFD_BRS, can.CANFD_ESI) follows the length
+// byte and the payload holds up to can.MaxFDLen bytes. A stream carries FD
+// frames only after both sides agreed on them with OpFD.
+const LenFD = 0x80
+
+// fdWireFlags are the Frame.Flags bits carried by the FD flags byte.
+const fdWireFlags = can.CANFD_BRS | can.CANFD_ESI
+
+// Codec encodes/decodes cannelloni frames. It is safe for concurrent use;
+// FD is a property of one stream, so a connection negotiating it decodes
+// with a Codec of its own.
+type Codec struct {
+	// FD accepts CAN FD frames (LenFD), once negotiated with OpFD.
+	FD bool
+	// MaskFD ignores LenFD on a stream without FD, as releases before
+	// protocol revision 7 did, for legacy peers setting the bit spuriously.
+	// Otherwise such a frame fails with ErrFDNotNegotiated.
+	MaskFD bool
+	// RTR carries remote requests (CAN_RTR_FLAG) without payload, as
+	// cannelloni does, once negotiated with OpRTR. Otherwise their length
+	// is followed by that many payload bytes, as before revision 4 and
+	// since revision 9, so legacy peers stay in sync.
+	RTR bool
+}
+
+// ErrInvalidLength is returned when a frame length (DLC) is outside
+// 0..validate.MaxDLC.
 var ErrInvalidLength = errors.New("cannelloni: invalid length")
 
 // ErrTruncatedFrame is returned when the underlying reader ends mid-frame.
 var ErrTruncatedFrame = errors.New("cannelloni: truncated frame")
 
+// ErrFDNotNegotiated is returned for a frame with LenFD on a stream that did
+// not negotiate FD. The stream cannot be decoded past it: the frame carries
+// a flags byte a legacy decoder would read as payload.
+var ErrFDNotNegotiated = errors.New("cannelloni: FD frame without FD negotiated")
+
 // Encode packs frames into a single cannelloni packet (DATA).
 func (c *Codec) Encode(frames []can.Frame) []byte {
 	if len(frames) == 0 {
 		return nil
 	}
 	var buf bytes.Buffer
-	// Pre-size: worst case per frame = 4(id)+1(len)+8(data)
-	buf.Grow(len(frames) * (4 + 1 + 8))
+	// Pre-size: worst case per classic frame = 4(id)+1(len)+8(data)
+	buf.Grow(len(frames) * MaxFrameSize)
 	_, _ = c.EncodeTo(&buf, frames)
 	return buf.Bytes()
 }
 
 // EncodeTo writes the wire representation of frames to w and returns bytes written.
 // Each frame is encoded as: 4-byte BE CANID, 1-byte length (lower 7 bits), payload.
+// Remote requests (CAN_RTR_FLAG) carry the requested length and, with RTR,
+// no payload. CAN FD frames set LenFD and add the flags byte.
 func (c *Codec) EncodeTo(w io.Writer, frames []can.Frame) (int, error) {
 	var total int
 	for _, f := range frames {
@@ -45,11 +85,15 @@ func (c *Codec) EncodeTo(w io.Writer, frames []can.Frame) (int, error) {
 		if err != nil {
 			return total, fmt.Errorf("cannelloni encode id: %w", err)
 		}
-		if _, err := w.Write([]byte{f.Len}); err != nil { // length byte
-			total++ // conservative increment
+		hdr, hn, ln := lenHeader(&f)
+		n, err = w.Write(hdr[:hn])
+		total += n
+		if err != nil {
 			return total, fmt.Errorf("cannelloni encode len: %w", err)
 		}
-		ln := int(f.Len & 0x7F)
+		if c.noData(f.CANID) {
+			ln = 0
+		}
 		if ln > 0 {
 			n, err = w.Write(f.Data[:ln])
 			total += n
@@ -61,6 +105,36 @@ func (c *Codec) EncodeTo(w io.Writer, frames []can.Frame) (int, error) {
 	return total, nil
 }
 
+// AppendFrame appends the wire representation of f (as written by
+// EncodeTo) to dst. The bytes depend on f and c alone, so one encoding can
+// be shared by every stream with the same settings.
+func (c *Codec) AppendFrame(dst []byte, f *can.Frame) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, f.CANID)
+	hdr, hn, ln := lenHeader(f)
+	dst = append(dst, hdr[:hn]...)
+	if ln > 0 && !c.noData(f.CANID) {
+		dst = append(dst, f.Data[:ln]...)
+	}
+	return dst
+}
+
+// lenHeader returns the hn bytes following the ID of f (the length byte,
+// and the flags byte of a CAN FD frame) and the payload size they announce.
+func lenHeader(f *can.Frame) (hdr [2]byte, hn, ln int) {
+	if f.IsFD() {
+		ln = min(int(f.Len), can.MaxFDLen)
+		return [2]byte{byte(ln) | LenFD, f.Flags & fdWireFlags}, 2, ln
+	}
+	return [2]byte{f.Len}, 1, min(int(f.Len&0x7F), len(f.Data))
+}
+
+// noData reports whether a frame with canid goes without payload: a remote
+// request on a stream with RTR. The control ID has every flag bit set but
+// carries a payload.
+func (c *Codec) noData(canid uint32) bool {
+	return c.RTR && canid&can.CAN_RTR_FLAG != 0 && canid != ControlID
+}
+
 // Decode reads exactly one frame from r.
 // It returns io.EOF if called at a clean frame boundary and no more data is available.
 func (c *Codec) Decode(r io.Reader) (can.Frame, error) {
@@ -79,12 +153,31 @@ func (c *Codec) Decode(r io.Reader) (can.Frame, error) {
 	if n == 0 {
 		return f, io.EOF
 	}
-	ln := int(lb[0] & 0x7F) // high bit masked per protocol (future flags?)
-	if ln > 8 {             // ln cannot be negative
+	maxLen := validate.MaxDLC
+	if lb[0]&LenFD != 0 {
+		switch {
+		case c.FD:
+			var fb [1]byte
+			if _, err := io.ReadFull(r, fb[:]); err != nil {
+				metrics.IncMalformed()
+				return f, fmt.Errorf("cannelloni decode flags: %w", ErrTruncatedFrame)
+			}
+			f.Flags = fb[0]&fdWireFlags | can.CANFD_FDF
+			maxLen = can.MaxFDLen
+		case !c.MaskFD:
+			metrics.IncMalformed()
+			return f, fmt.Errorf("cannelloni decode: %w", ErrFDNotNegotiated)
+		}
+	}
+	ln := int(lb[0] &^ LenFD)
+	if ln > maxLen { // framing: the payload size must be known
 		metrics.IncMalformed()
 		return f, fmt.Errorf("cannelloni decode: %w (%d)", ErrInvalidLength, ln)
 	}
 	f.Len = uint8(ln)
+	if c.noData(f.CANID) {
+		return f, nil // a remote request has no data section
+	}
 	if ln > 0 {
 		if _, err := io.ReadFull(r, f.Data[:ln]); err != nil {
 			if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
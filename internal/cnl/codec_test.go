@@ -3,6 +3,7 @@ package cnl
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"io"
 	"testing"
 
@@ -65,15 +66,31 @@ func TestCNLCodec_EncodeToMatchesEncode(t *testing.T) {
 	}
 }
 
+func TestCNLCodec_AppendFrameMatchesEncodeTo(t *testing.T) {
+	codec := Codec{RTR: true}
+	frames := []can.Frame{mkFrame(0x10, 8), mkFrame(0x11, 0), {CANID: 0x12 | can.CAN_RTR_FLAG, Len: 4}, Compress(CompressDeflate)}
+	var buf bytes.Buffer
+	if _, err := codec.EncodeTo(&buf, frames); err != nil {
+		t.Fatalf("EncodeTo error: %v", err)
+	}
+	var app []byte
+	for i := range frames {
+		app = codec.AppendFrame(app, &frames[i])
+	}
+	if !bytes.Equal(app, buf.Bytes()) {
+		t.Fatalf("AppendFrame vs EncodeTo mismatch\napp=% X\nencTo=% X", app, buf.Bytes())
+	}
+}
+
 func TestCNLCodec_DecodeErrors(t *testing.T) {
 	codec := Codec{}
-	// Invalid length ( >8 ) => craft payload with len=0x89
+	// Invalid length ( >8 ) => craft payload with len=0x09
 	var bad bytes.Buffer
 	// id
 	bad.Write([]byte{0, 0, 0, 1})
-	bad.WriteByte(0x89) // length high bit masked -> 0x09 => 9 (>8)
-	if _, err := codec.Decode(&bad); err == nil {
-		t.Fatalf("expected error for invalid length")
+	bad.WriteByte(0x09)
+	if _, err := codec.Decode(&bad); !errors.Is(err, ErrInvalidLength) {
+		t.Fatalf("expected error for invalid length, got %v", err)
 	}
 
 	// Truncated payload
@@ -125,3 +142,70 @@ func BenchmarkCNLCodec_DecodeN(b *testing.B) {
 		_, _ = codec.DecodeN(r, 0, func(can.Frame) {})
 	}
 }
+
+func TestCNLCodec_RTR(t *testing.T) {
+	rtr := can.Frame{CANID: 0x123 | can.CAN_RTR_FLAG, Len: 4, Data: [64]byte{1, 2, 3, 4}}
+	data := mkFrame(0x456, 2)
+	for _, tc := range []struct {
+		codec Codec
+		size  int
+	}{
+		// Legacy streams keep the payload bytes of a remote request.
+		{Codec{}, 5 + 4 + 5 + 2},
+		// After OpRTR they carry only the length, as in cannelloni.
+		{Codec{RTR: true}, 5 + 5 + 2},
+	} {
+		wire := tc.codec.Encode([]can.Frame{rtr, data})
+		if len(wire) != tc.size {
+			t.Fatalf("RTR=%v: wire size %d, want %d", tc.codec.RTR, len(wire), tc.size)
+		}
+		var got []can.Frame
+		if _, err := tc.codec.DecodeN(bytes.NewReader(wire), 0, func(fr can.Frame) { got = append(got, fr) }); err != io.EOF {
+			t.Fatalf("RTR=%v: decode: %v", tc.codec.RTR, err)
+		}
+		want := rtr
+		if tc.codec.RTR {
+			want = can.Frame{CANID: rtr.CANID, Len: 4}
+		}
+		if len(got) != 2 || got[0] != want || got[1] != data {
+			t.Fatalf("RTR=%v: got %+v", tc.codec.RTR, got)
+		}
+	}
+}
+
+func TestCNLCodec_FD(t *testing.T) {
+	fr := can.Frame{CANID: 0x123, Len: 12, Flags: can.CANFD_FDF | can.CANFD_BRS}
+	for i := range 12 {
+		fr.Data[i] = byte(i)
+	}
+	wire := (&Codec{}).AppendFrame(nil, &fr)
+	if wire[4] != LenFD|12 || wire[5] != can.CANFD_BRS || len(wire) != 4+2+12 {
+		t.Fatalf("encoding % X", wire)
+	}
+	var buf bytes.Buffer
+	if _, err := (&Codec{}).EncodeTo(&buf, []can.Frame{fr}); err != nil || !bytes.Equal(buf.Bytes(), wire) {
+		t.Fatalf("EncodeTo % X (err=%v), want % X", buf.Bytes(), err, wire)
+	}
+
+	got, err := (&Codec{FD: true}).Decode(bytes.NewReader(wire))
+	if err != nil || got != fr {
+		t.Fatalf("FD decode: %+v err=%v", got, err)
+	}
+	// A stream without FD rejects the bit rather than misreading the flags
+	// byte as payload...
+	if _, err := (&Codec{}).Decode(bytes.NewReader(wire)); !errors.Is(err, ErrFDNotNegotiated) {
+		t.Fatalf("legacy decode: err=%v", err)
+	}
+	// ...unless told to mask it like earlier releases.
+	legacy := []byte{0, 0, 1, 0x23, LenFD | 2, 0xAA, 0xBB}
+	got, err = (&Codec{MaskFD: true}).Decode(bytes.NewReader(legacy))
+	if err != nil || got.Len != 2 || got.IsFD() || got.Data[0] != 0xAA {
+		t.Fatalf("masked decode: %+v err=%v", got, err)
+	}
+	if _, err := (&Codec{FD: true}).Decode(bytes.NewReader([]byte{0, 0, 1, 0x23, LenFD | 65, 0})); !errors.Is(err, ErrInvalidLength) {
+		t.Fatalf("FD length 65: err=%v", err)
+	}
+	if _, err := (&Codec{FD: true}).Decode(bytes.NewReader(wire[:5])); !errors.Is(err, ErrTruncatedFrame) {
+		t.Fatalf("missing flags byte: err=%v", err)
+	}
+}
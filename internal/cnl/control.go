@@ -0,0 +1,435 @@
+package cnl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// ControlID is the reserved CAN ID carrying gateway control messages inside
+// the cannelloni stream. It sets every flag bit together with the highest
+// 29-bit identifier, a combination no real bus frame can have, so control
+// messages never reach a backend. Data[0] holds the op code.
+const ControlID = 0xFFFFFFFF
+
+// Control op codes.
+const (
+	// OpTxAckEnable (client -> server) turns on TX acknowledgements for the
+	// connection; the server confirms with the same op.
+	OpTxAckEnable = 0x01
+	// OpTxAck (server -> client) reports the outcome of one submitted frame.
+	OpTxAck = 0x02
+	// OpHistory (client -> server) requests the captured bus frames of the
+	// last Data[1:3] seconds (uint16 BE).
+	OpHistory = 0x03
+	// OpHistoryBegin (server -> client) precedes a history replay.
+	OpHistoryBegin = 0x04
+	// OpHistoryEnd (server -> client) follows the last replayed frame.
+	OpHistoryEnd = 0x05
+	// OpSession (both ways) opens or resumes a session: the client sends
+	// its previous token (0 for a new session), the server answers with the
+	// status and the token to use on the next reconnect.
+	OpSession = 0x06
+	// OpPing (client -> server) asks for an immediate OpPong echoing its
+	// payload; the client reports its last measured RTT in it.
+	OpPing = 0x07
+	// OpPong (server -> client) answers OpPing.
+	OpPong = 0x08
+	// OpCompress (both ways) negotiates compression of the server -> client
+	// stream: the client asks for an algorithm, the server answers with
+	// the one it switches to and later announces when it falls back.
+	OpCompress = 0x09
+	// OpFilter (both ways) pushes a receive filter down to the server: the
+	// client sends FilterBegin, the filter list in FilterText chunks and
+	// FilterCommit; the server answers FilterOK or FilterInvalid.
+	OpFilter = 0x0A
+	// OpErrFrames (both ways) subscribes the connection to CAN error frames
+	// (CAN_ERR_FLAG): the client asks for ErrFramesOn or ErrFramesOff, the
+	// server answers with the state now in force.
+	OpErrFrames = 0x0B
+	// OpFlow (both ways) subscribes the connection to flow-control hints:
+	// the client asks for FlowOn or FlowOff, the server answers with
+	// FlowHint (the current state; more follow whenever the level
+	// changes), FlowOff or FlowUnavailable.
+	OpFlow = 0x0C
+	// OpFD (both ways) negotiates CAN FD frames (LenFD) on the connection,
+	// both directions at once: the client asks for FDOn or FDOff, the
+	// server answers with the state now in force or FDUnavailable. The
+	// server decodes FD frames from the request on; the client sends them
+	// only after the FDOn answer, which precedes the first FD frame from
+	// the server.
+	OpFD = 0x0D
+	// OpIdent (both ways) identifies the gateway: the client sends
+	// IdentQuery, the server answers with its version, backend and bus name
+	// in IdentVersion, IdentBackend and IdentBus text chunks, then
+	// IdentEnd.
+	OpIdent = 0x0E
+	// OpRTR (both ways) negotiates remote requests without payload
+	// (Codec.RTR), both directions at once: the client asks for RTROn or
+	// RTROff, the server answers with the state now in force. The server
+	// decodes the new form from the request on and sends it after the
+	// answer; the client sends no remote request until the answer.
+	OpRTR = 0x0F
+)
+
+// History replay status codes (OpHistoryBegin Data[1]).
+const (
+	HistoryOK          = 0x00
+	HistoryUnavailable = 0x01 // capture disabled on the server
+)
+
+// Session status codes (OpSession Data[1], server -> client).
+const (
+	SessionNew         = 0x00 // fresh session (unknown, expired or zero token)
+	SessionResumed     = 0x01 // state restored; missed frames follow as a history replay
+	SessionUnavailable = 0x02 // sessions disabled on the server
+)
+
+// Compression codes (OpCompress Data[1]). After an OpCompress
+// CompressDeflate answer the server -> client stream is a raw DEFLATE stream
+// (RFC 1951), flushed with every batch. An OpCompress CompressOff inside it
+// is followed by the final block; the stream is plain again after it.
+const (
+	CompressOff         = 0x00 // server: compression ended
+	CompressDeflate     = 0x01 // client: request DEFLATE; server: DEFLATE stream follows
+	CompressUnavailable = 0x02 // server: compression disabled
+)
+
+// Filter codes (OpFilter Data[1]). The list uses the syntax of the server
+// -rx-allow flag ("0x123,0x100-0x1FF,0x18FF0000/0x1FFF0000"); an empty list
+// passes every ID. A committed filter replaces the previous one.
+const (
+	FilterBegin   = 0x00 // client: start a filter, Data[2] holds its flags
+	FilterText    = 0x01 // client: next bytes of the list in Data[2:8], NUL padded
+	FilterCommit  = 0x02 // client: apply the filter
+	FilterOK      = 0x03 // server: filter applied
+	FilterInvalid = 0x04 // server: list invalid or too long; the previous filter stays
+)
+
+// FilterChangeOnly (FilterBegin flag) passes a frame only when its payload
+// differs from the last passed frame with the same ID.
+const FilterChangeOnly = 0x01
+
+// MaxFilterText bounds the filter list a client may push, in bytes.
+const MaxFilterText = 1024
+
+// Error frame codes (OpErrFrames Data[1]).
+const (
+	ErrFramesOff         = 0x00 // client: stop; server: error frames are not sent
+	ErrFramesOn          = 0x01 // client: subscribe; server: error frames follow
+	ErrFramesUnavailable = 0x02 // server: the backend reports no error frames
+)
+
+// Flow codes (OpFlow Data[1]).
+const (
+	FlowOff         = 0x00 // client: stop; server: hints are not sent
+	FlowOn          = 0x01 // client: subscribe
+	FlowUnavailable = 0x02 // server: the backend has no TX queue to report
+	FlowHint        = 0x03 // server: level, queue depth and capacity follow
+)
+
+// FD codes (OpFD Data[1]).
+const (
+	FDOff         = 0x00 // client: classic frames only; server: FD frames are neither sent nor accepted
+	FDOn          = 0x01 // client: request FD; server: FD frames may follow both ways
+	FDUnavailable = 0x02 // server: the backend carries no CAN FD frames
+)
+
+// RTR codes (OpRTR Data[1]).
+const (
+	RTROff = 0x00 // remote requests carry their length in payload bytes
+	RTROn  = 0x01 // remote requests carry no payload, as in cannelloni
+)
+
+// Ident codes (OpIdent Data[1]). Text chunks carry the next bytes of their
+// field in Data[2:8], NUL padded; empty fields are not sent.
+const (
+	IdentQuery   = 0x00 // client: ask for the identification
+	IdentVersion = 0x01 // server: server version
+	IdentBackend = 0x02 // server: backend kind, e.g. socketcan
+	IdentBus     = 0x03 // server: bus name (instance, virtual bus or interface)
+	IdentEnd     = 0x04 // server: the answer is complete
+)
+
+// MaxIdentText bounds each identification field, in bytes; longer values
+// are cut.
+const MaxIdentText = 64
+
+// Flow levels (FlowHint Data[2]): how a client should pace its frames.
+const (
+	FlowOK   = 0x00 // send freely
+	FlowSlow = 0x01 // the backend TX queue is filling; slow down
+	FlowStop = 0x02 // the queue is nearly full; hold frames until the level drops
+)
+
+// SessionTokenMask bounds session tokens to the 48 bits carried by OpSession.
+const SessionTokenMask = 1<<48 - 1
+
+// TX acknowledgement status codes (OpTxAck Data[1]).
+const (
+	AckOK        = 0x00 // written to the backend
+	AckOverflow  = 0x01 // backend TX queue full, frame dropped
+	AckDenied    = 0x02 // rejected by a backend TX filter
+	AckError     = 0x03 // backend write failed
+	AckInhibited = 0x04 // TX inhibited (quiet hours / maintenance)
+)
+
+// IsControl reports whether fr is a gateway control message.
+func IsControl(fr *can.Frame) bool { return fr.CANID == ControlID }
+
+// ControlFrame builds a control message with op and up to 7 payload bytes.
+func ControlFrame(op byte, payload ...byte) can.Frame {
+	fr := can.Frame{CANID: ControlID, Len: 8}
+	fr.Data[0] = op
+	copy(fr.Data[1:8], payload)
+	return fr
+}
+
+// TxAck builds an acknowledgement for the seq-th frame (1-based, wrapping)
+// submitted on the connection since acknowledgements were enabled.
+// Layout: op, status, seq (uint16 BE), CAN ID (uint32 BE).
+func TxAck(seq uint16, status byte, canID uint32) can.Frame {
+	fr := ControlFrame(OpTxAck, status)
+	binary.BigEndian.PutUint16(fr.Data[2:4], seq)
+	binary.BigEndian.PutUint32(fr.Data[4:8], canID)
+	return fr
+}
+
+// ParseTxAck decodes an OpTxAck control message.
+func ParseTxAck(fr *can.Frame) (seq uint16, status byte, canID uint32, ok bool) {
+	if !IsControl(fr) || fr.Len != 8 || fr.Data[0] != OpTxAck {
+		return 0, 0, 0, false
+	}
+	return binary.BigEndian.Uint16(fr.Data[2:4]), fr.Data[1], binary.BigEndian.Uint32(fr.Data[4:8]), true
+}
+
+// HistoryRequest builds an OpHistory request for the last seconds of traffic.
+func HistoryRequest(seconds uint16) can.Frame {
+	fr := ControlFrame(OpHistory)
+	binary.BigEndian.PutUint16(fr.Data[1:3], seconds)
+	return fr
+}
+
+// HistoryMarker builds an OpHistoryBegin/OpHistoryEnd message.
+// Layout: op, status, frame count (uint16 BE).
+func HistoryMarker(op, status byte, count uint16) can.Frame {
+	fr := ControlFrame(op, status)
+	binary.BigEndian.PutUint16(fr.Data[2:4], count)
+	return fr
+}
+
+// ParseHistoryMarker decodes an OpHistoryBegin/OpHistoryEnd message.
+func ParseHistoryMarker(fr *can.Frame) (op, status byte, count uint16, ok bool) {
+	if !IsControl(fr) || fr.Len != 8 || (fr.Data[0] != OpHistoryBegin && fr.Data[0] != OpHistoryEnd) {
+		return 0, 0, 0, false
+	}
+	return fr.Data[0], fr.Data[1], binary.BigEndian.Uint16(fr.Data[2:4]), true
+}
+
+// SessionMessage builds an OpSession message.
+// Layout: op, status (0 from clients), token (48-bit BE).
+func SessionMessage(status byte, token uint64) can.Frame {
+	fr := ControlFrame(OpSession, status)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], token&SessionTokenMask)
+	copy(fr.Data[2:8], b[2:])
+	return fr
+}
+
+// ParseSession decodes an OpSession message.
+func ParseSession(fr *can.Frame) (status byte, token uint64, ok bool) {
+	if !IsControl(fr) || fr.Len != 8 || fr.Data[0] != OpSession {
+		return 0, 0, false
+	}
+	var b [8]byte
+	copy(b[2:], fr.Data[2:8])
+	return fr.Data[1], binary.BigEndian.Uint64(b[:]), true
+}
+
+// Ping builds an OpPing message carrying seq and the client's last measured
+// round-trip time (0 when unknown).
+// Layout: op, reserved, seq (uint16 BE), RTT in microseconds (uint32 BE).
+func Ping(seq uint16, rtt time.Duration) can.Frame {
+	fr := ControlFrame(OpPing)
+	binary.BigEndian.PutUint16(fr.Data[2:4], seq)
+	binary.BigEndian.PutUint32(fr.Data[4:8], uint32(min(rtt.Microseconds(), math.MaxUint32)))
+	return fr
+}
+
+// ParsePing decodes an OpPing message.
+func ParsePing(fr *can.Frame) (seq uint16, rtt time.Duration, ok bool) {
+	if !IsControl(fr) || fr.Len != 8 || fr.Data[0] != OpPing {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint16(fr.Data[2:4]), time.Duration(binary.BigEndian.Uint32(fr.Data[4:8])) * time.Microsecond, true
+}
+
+// Pong builds the OpPong answer to ping, echoing its payload.
+func Pong(ping can.Frame) can.Frame {
+	ping.Data[0] = OpPong
+	return ping
+}
+
+// ParsePong decodes an OpPong message.
+func ParsePong(fr *can.Frame) (seq uint16, ok bool) {
+	if !IsControl(fr) || fr.Len != 8 || fr.Data[0] != OpPong {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(fr.Data[2:4]), true
+}
+
+// Compress builds an OpCompress message with code (Compress* constants).
+// Layout: op, code.
+func Compress(code byte) can.Frame { return ControlFrame(OpCompress, code) }
+
+// ParseCompress decodes an OpCompress message.
+func ParseCompress(fr *can.Frame) (code byte, ok bool) {
+	if !IsControl(fr) || fr.Len != 8 || fr.Data[0] != OpCompress {
+		return 0, false
+	}
+	return fr.Data[1], true
+}
+
+// FilterMessages builds the OpFilter messages pushing list with flags.
+func FilterMessages(list string, flags byte) []can.Frame {
+	out := []can.Frame{ControlFrame(OpFilter, FilterBegin, flags)}
+	for b := []byte(list); len(b) > 0; {
+		fr := ControlFrame(OpFilter, FilterText)
+		b = b[copy(fr.Data[2:8], b):]
+		out = append(out, fr)
+	}
+	return append(out, ControlFrame(OpFilter, FilterCommit))
+}
+
+// ParseFilter decodes an OpFilter message. payload is Data[2:8].
+func ParseFilter(fr *can.Frame) (code byte, payload []byte, ok bool) {
+	if !IsControl(fr) || fr.Len != 8 || fr.Data[0] != OpFilter {
+		return 0, nil, false
+	}
+	return fr.Data[1], fr.Data[2:8], true
+}
+
+// ErrFrames builds an OpErrFrames message with code (ErrFrames* constants).
+// Layout: op, code.
+func ErrFrames(code byte) can.Frame { return ControlFrame(OpErrFrames, code) }
+
+// ParseErrFrames decodes an OpErrFrames message.
+func ParseErrFrames(fr *can.Frame) (code byte, ok bool) {
+	if !IsControl(fr) || fr.Len != 8 || fr.Data[0] != OpErrFrames {
+		return 0, false
+	}
+	return fr.Data[1], true
+}
+
+// Flow builds an OpFlow message with code (Flow* constants other than
+// FlowHint). Layout: op, code.
+func Flow(code byte) can.Frame { return ControlFrame(OpFlow, code) }
+
+// FlowHintMessage builds an OpFlow FlowHint message.
+// Layout: op, code, level, reserved, queue depth (uint16 BE), queue
+// capacity (uint16 BE); depth and capacity saturate at 65535.
+func FlowHintMessage(level byte, depth, capacity int) can.Frame {
+	fr := ControlFrame(OpFlow, FlowHint, level)
+	binary.BigEndian.PutUint16(fr.Data[4:6], uint16(min(depth, math.MaxUint16)))
+	binary.BigEndian.PutUint16(fr.Data[6:8], uint16(min(capacity, math.MaxUint16)))
+	return fr
+}
+
+// ParseFlow decodes an OpFlow message; level, depth and capacity are set
+// for FlowHint.
+func ParseFlow(fr *can.Frame) (code, level byte, depth, capacity int, ok bool) {
+	if !IsControl(fr) || fr.Len != 8 || fr.Data[0] != OpFlow {
+		return 0, 0, 0, 0, false
+	}
+	if fr.Data[1] == FlowHint {
+		level = fr.Data[2]
+		depth = int(binary.BigEndian.Uint16(fr.Data[4:6]))
+		capacity = int(binary.BigEndian.Uint16(fr.Data[6:8]))
+	}
+	return fr.Data[1], level, depth, capacity, true
+}
+
+// FD builds an OpFD message with code (FD* constants).
+// Layout: op, code.
+func FD(code byte) can.Frame { return ControlFrame(OpFD, code) }
+
+// ParseFD decodes an OpFD message.
+func ParseFD(fr *can.Frame) (code byte, ok bool) {
+	if !IsControl(fr) || fr.Len != 8 || fr.Data[0] != OpFD {
+		return 0, false
+	}
+	return fr.Data[1], true
+}
+
+// RTR builds an OpRTR message with code (RTR* constants).
+// Layout: op, code.
+func RTR(code byte) can.Frame { return ControlFrame(OpRTR, code) }
+
+// ParseRTR decodes an OpRTR message.
+func ParseRTR(fr *can.Frame) (code byte, ok bool) {
+	if !IsControl(fr) || fr.Len != 8 || fr.Data[0] != OpRTR {
+		return 0, false
+	}
+	return fr.Data[1], true
+}
+
+// Ident identifies a gateway (OpIdent).
+type Ident struct {
+	Version string
+	Backend string
+	Bus     string
+}
+
+// IdentRequest builds the OpIdent query of a client.
+func IdentRequest() can.Frame { return ControlFrame(OpIdent, IdentQuery) }
+
+// IdentMessages builds the OpIdent answer carrying id.
+// Layout: op, code, text (6 bytes, NUL padded).
+func IdentMessages(id Ident) []can.Frame {
+	var out []can.Frame
+	for _, f := range []struct {
+		code byte
+		text string
+	}{{IdentVersion, id.Version}, {IdentBackend, id.Backend}, {IdentBus, id.Bus}} {
+		b := []byte(f.text)
+		b = b[:min(len(b), MaxIdentText)]
+		for len(b) > 0 {
+			fr := ControlFrame(OpIdent, f.code)
+			b = b[copy(fr.Data[2:8], b):]
+			out = append(out, fr)
+		}
+	}
+	return append(out, ControlFrame(OpIdent, IdentEnd))
+}
+
+// ParseIdent decodes an OpIdent message. payload is Data[2:8].
+func ParseIdent(fr *can.Frame) (code byte, payload []byte, ok bool) {
+	if !IsControl(fr) || fr.Len != 8 || fr.Data[0] != OpIdent {
+		return 0, nil, false
+	}
+	return fr.Data[1], fr.Data[2:8], true
+}
+
+// Add collects one message of an OpIdent answer into id and reports
+// whether it was the last one (IdentEnd).
+func (id *Ident) Add(fr *can.Frame) (done bool) {
+	code, payload, ok := ParseIdent(fr)
+	if !ok {
+		return false
+	}
+	text := string(bytes.TrimRight(payload, "\x00"))
+	switch code {
+	case IdentVersion:
+		id.Version += text
+	case IdentBackend:
+		id.Backend += text
+	case IdentBus:
+		id.Bus += text
+	case IdentEnd:
+		return true
+	}
+	return false
+}
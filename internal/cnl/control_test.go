@@ -0,0 +1,106 @@
+package cnl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestTxAckRoundTrip(t *testing.T) {
+	c := &Codec{}
+	ack := TxAck(513, AckOverflow, 0x123|can.CAN_EFF_FLAG)
+	fr, err := c.Decode(bytes.NewReader(c.Encode([]can.Frame{ack})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, status, id, ok := ParseTxAck(&fr)
+	if !ok || seq != 513 || status != AckOverflow || id != 0x123|can.CAN_EFF_FLAG {
+		t.Fatalf("got seq=%d status=%d id=0x%X ok=%v", seq, status, id, ok)
+	}
+	enable := ControlFrame(OpTxAckEnable)
+	if _, _, _, ok := ParseTxAck(&enable); ok {
+		t.Fatal("enable op parsed as ack")
+	}
+}
+
+func TestSessionMessageRoundTrip(t *testing.T) {
+	msg := SessionMessage(SessionResumed, 0xA1B2C3D4E5F6)
+	st, token, ok := ParseSession(&msg)
+	if !ok || st != SessionResumed || token != 0xA1B2C3D4E5F6 {
+		t.Fatalf("got status=%d token=%x ok=%v", st, token, ok)
+	}
+	// Tokens are truncated to 48 bits.
+	msg = SessionMessage(0, 1<<60|7)
+	if _, token, _ := ParseSession(&msg); token != 7 {
+		t.Fatalf("token not masked: %x", token)
+	}
+}
+
+func TestPingPongRoundTrip(t *testing.T) {
+	ping := Ping(42, 1500*time.Microsecond)
+	seq, rtt, ok := ParsePing(&ping)
+	if !ok || seq != 42 || rtt != 1500*time.Microsecond {
+		t.Fatalf("ping: seq=%d rtt=%v ok=%v", seq, rtt, ok)
+	}
+	pong := Pong(ping)
+	if seq, ok := ParsePong(&pong); !ok || seq != 42 {
+		t.Fatalf("pong: seq=%d ok=%v", seq, ok)
+	}
+	if _, _, ok := ParsePing(&pong); ok {
+		t.Fatal("pong parsed as ping")
+	}
+}
+
+func TestFlowRoundTrip(t *testing.T) {
+	hint := FlowHintMessage(FlowSlow, 300, 100000)
+	code, level, depth, capacity, ok := ParseFlow(&hint)
+	if !ok || code != FlowHint || level != FlowSlow || depth != 300 || capacity != 0xFFFF {
+		t.Fatalf("hint: code=%d level=%d depth=%d cap=%d ok=%v", code, level, depth, capacity, ok)
+	}
+	off := Flow(FlowOff)
+	if code, _, depth, _, ok := ParseFlow(&off); !ok || code != FlowOff || depth != 0 {
+		t.Fatalf("off: code=%d depth=%d ok=%v", code, depth, ok)
+	}
+	errs := ErrFrames(ErrFramesOn)
+	if _, _, _, _, ok := ParseFlow(&errs); ok {
+		t.Fatal("error frame op parsed as flow")
+	}
+}
+
+func TestFDRoundTrip(t *testing.T) {
+	fr := FD(FDUnavailable)
+	if code, ok := ParseFD(&fr); !ok || code != FDUnavailable {
+		t.Fatalf("code=%d ok=%v", code, ok)
+	}
+	errs := ErrFrames(ErrFramesOn)
+	if _, ok := ParseFD(&errs); ok {
+		t.Fatal("error frame op parsed as FD")
+	}
+}
+
+func TestIdentRoundTrip(t *testing.T) {
+	want := Ident{Version: "v1.2.3-rc1", Backend: "socketcan", Bus: strings.Repeat("b", MaxIdentText)}
+	msgs := IdentMessages(Ident{Version: want.Version, Backend: want.Backend, Bus: want.Bus + "cut"})
+	// 2 version chunks, 2 backend chunks, 11 bus chunks and the end.
+	if len(msgs) != 16 {
+		t.Fatalf("%d messages", len(msgs))
+	}
+	var got Ident
+	for i := range msgs {
+		if done := got.Add(&msgs[i]); done != (i == len(msgs)-1) {
+			t.Fatalf("message %d: done=%v", i, done)
+		}
+	}
+	if got != want {
+		t.Fatalf("got %+v", got)
+	}
+	if req := IdentRequest(); got.Add(&req) || got != want {
+		t.Fatal("query changed the answer")
+	}
+	if len(IdentMessages(Ident{})) != 1 {
+		t.Fatal("empty fields sent")
+	}
+}
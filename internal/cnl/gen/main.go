@@ -0,0 +1,402 @@
+// Command gen writes the Python module and C header describing the can-server
+// wire protocol from the constants of package cnl, so integrators outside Go
+// build against the same values as the server. Run it with go generate in
+// internal/cnl; a test fails when the committed files are stale.
+//
+//	go run ./gen -dir ../../client/proto
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/validate"
+)
+
+const (
+	pythonFile = "can_server_proto.py"
+	headerFile = "can_server_proto.h"
+	header     = "Code generated by go generate (internal/cnl/gen); DO NOT EDIT."
+)
+
+type constant struct {
+	name  string
+	value uint64
+	doc   string
+}
+
+type group struct {
+	title  string
+	consts []constant
+}
+
+// groups are the numeric protocol constants, in output order.
+var groups = []group{
+	{"Frame layout", []constant{
+		{"CAN_EFF_FLAG", can.CAN_EFF_FLAG, "extended (29-bit) identifier"},
+		{"CAN_RTR_FLAG", can.CAN_RTR_FLAG, "remote transmission request"},
+		{"CAN_ERR_FLAG", can.CAN_ERR_FLAG, "error frame"},
+		{"CAN_SFF_MASK", can.CAN_SFF_MASK, "standard identifier bits"},
+		{"CAN_EFF_MASK", can.CAN_EFF_MASK, "extended identifier bits"},
+		{"LEN_MASK", 0x7F, "payload length bits of the length byte"},
+		{"LEN_FD", cnl.LenFD, "length byte flag: CAN FD frame, flags byte follows (after OP_FD)"},
+		{"CANFD_BRS", can.CANFD_BRS, "FD flags byte: bit rate switch"},
+		{"CANFD_ESI", can.CANFD_ESI, "FD flags byte: error state indicator"},
+		{"MAX_DLC", validate.MaxDLC, "largest payload length"},
+		{"MAX_FD_LEN", can.MaxFDLen, "largest payload length of a CAN FD frame"},
+		{"MAX_FRAME_SIZE", cnl.MaxFrameSize, "largest wire size of one frame"},
+		{"MAX_FD_FRAME_SIZE", cnl.MaxFDFrameSize, "largest wire size of one CAN FD frame"},
+		{"CONTROL_ID", cnl.ControlID, "CAN ID of gateway control messages"},
+	}},
+	{"Control ops (control message byte 0)", []constant{
+		{"OP_TX_ACK_ENABLE", cnl.OpTxAckEnable, "client -> server: enable TX acks; echoed as confirmation"},
+		{"OP_TX_ACK", cnl.OpTxAck, "server -> client: outcome of one submitted frame"},
+		{"OP_HISTORY", cnl.OpHistory, "client -> server: replay the last N seconds"},
+		{"OP_HISTORY_BEGIN", cnl.OpHistoryBegin, "server -> client: replay starts"},
+		{"OP_HISTORY_END", cnl.OpHistoryEnd, "server -> client: replay ended"},
+		{"OP_SESSION", cnl.OpSession, "both ways: open or resume a session"},
+		{"OP_PING", cnl.OpPing, "client -> server: ask for an immediate pong"},
+		{"OP_PONG", cnl.OpPong, "server -> client: answer to OP_PING"},
+		{"OP_COMPRESS", cnl.OpCompress, "both ways: negotiate server -> client compression"},
+		{"OP_FILTER", cnl.OpFilter, "both ways: push a receive filter to the server"},
+		{"OP_ERR_FRAMES", cnl.OpErrFrames, "both ways: subscribe to CAN error frames"},
+		{"OP_FLOW", cnl.OpFlow, "both ways: subscribe to flow-control hints"},
+		{"OP_FD", cnl.OpFD, "both ways: negotiate CAN FD frames"},
+		{"OP_IDENT", cnl.OpIdent, "both ways: ask for and answer the gateway identification"},
+		{"OP_RTR", cnl.OpRTR, "both ways: negotiate remote requests without payload"},
+	}},
+	{"TX ack status (OP_TX_ACK byte 1)", []constant{
+		{"ACK_OK", cnl.AckOK, "written to the backend"},
+		{"ACK_OVERFLOW", cnl.AckOverflow, "backend TX queue full, frame dropped"},
+		{"ACK_DENIED", cnl.AckDenied, "rejected by a TX filter or role"},
+		{"ACK_ERROR", cnl.AckError, "backend write failed"},
+		{"ACK_INHIBITED", cnl.AckInhibited, "TX inhibited"},
+	}},
+	{"History status (OP_HISTORY_BEGIN byte 1)", []constant{
+		{"HISTORY_OK", cnl.HistoryOK, "replay follows"},
+		{"HISTORY_UNAVAILABLE", cnl.HistoryUnavailable, "capture disabled on the server"},
+	}},
+	{"Session status (OP_SESSION byte 1, server -> client)", []constant{
+		{"SESSION_NEW", cnl.SessionNew, "fresh session"},
+		{"SESSION_RESUMED", cnl.SessionResumed, "state restored; missed frames follow as a replay"},
+		{"SESSION_UNAVAILABLE", cnl.SessionUnavailable, "sessions disabled on the server"},
+		{"SESSION_TOKEN_MASK", cnl.SessionTokenMask, "session tokens are 48 bits"},
+	}},
+	{"Compression (OP_COMPRESS byte 1)", []constant{
+		{"COMPRESS_OFF", cnl.CompressOff, "server -> client: compression ended, plain stream follows the final block"},
+		{"COMPRESS_DEFLATE", cnl.CompressDeflate, "client: request DEFLATE; server: DEFLATE stream follows"},
+		{"COMPRESS_UNAVAILABLE", cnl.CompressUnavailable, "server -> client: compression disabled"},
+	}},
+	{"Error frame codes (OP_ERR_FRAMES byte 1)", []constant{
+		{"ERR_FRAMES_OFF", cnl.ErrFramesOff, "client: stop; server: error frames are not sent"},
+		{"ERR_FRAMES_ON", cnl.ErrFramesOn, "client: subscribe; server: error frames follow"},
+		{"ERR_FRAMES_UNAVAILABLE", cnl.ErrFramesUnavailable, "server: the backend reports no error frames"},
+	}},
+	{"Flow codes (OP_FLOW byte 1)", []constant{
+		{"FLOW_OFF", cnl.FlowOff, "client: stop; server: hints are not sent"},
+		{"FLOW_ON", cnl.FlowOn, "client: subscribe"},
+		{"FLOW_UNAVAILABLE", cnl.FlowUnavailable, "server: the backend has no TX queue to report"},
+		{"FLOW_HINT", cnl.FlowHint, "server: level, queue depth and capacity follow"},
+	}},
+	{"FD codes (OP_FD byte 1)", []constant{
+		{"FD_OFF", cnl.FDOff, "client: classic frames only; server: no FD frames either way"},
+		{"FD_ON", cnl.FDOn, "client: request FD; server: FD frames may follow both ways"},
+		{"FD_UNAVAILABLE", cnl.FDUnavailable, "server: the backend carries no CAN FD frames"},
+	}},
+	{"RTR codes (OP_RTR byte 1)", []constant{
+		{"RTR_OFF", cnl.RTROff, "remote requests carry their length in payload bytes"},
+		{"RTR_ON", cnl.RTROn, "remote requests carry no payload, as in cannelloni"},
+	}},
+	{"Ident codes (OP_IDENT byte 1)", []constant{
+		{"IDENT_QUERY", cnl.IdentQuery, "client: ask for the identification"},
+		{"IDENT_VERSION", cnl.IdentVersion, "server: next bytes of the server version, NUL padded"},
+		{"IDENT_BACKEND", cnl.IdentBackend, "server: next bytes of the backend kind, NUL padded"},
+		{"IDENT_BUS", cnl.IdentBus, "server: next bytes of the bus name, NUL padded"},
+		{"IDENT_END", cnl.IdentEnd, "server: the answer is complete"},
+		{"MAX_IDENT_TEXT", cnl.MaxIdentText, "longest identification field, in bytes"},
+	}},
+	{"Flow levels (FLOW_HINT byte 2)", []constant{
+		{"FLOW_OK", cnl.FlowOK, "send freely"},
+		{"FLOW_SLOW", cnl.FlowSlow, "backend TX queue filling; slow down"},
+		{"FLOW_STOP", cnl.FlowStop, "queue nearly full; hold frames until the level drops"},
+	}},
+	{"Filter codes (OP_FILTER byte 1)", []constant{
+		{"FILTER_BEGIN", cnl.FilterBegin, "client: start a filter; byte 2 holds the flags"},
+		{"FILTER_TEXT", cnl.FilterText, "client: next bytes of the ID list, NUL padded"},
+		{"FILTER_COMMIT", cnl.FilterCommit, "client: apply the filter"},
+		{"FILTER_OK", cnl.FilterOK, "server: filter applied"},
+		{"FILTER_INVALID", cnl.FilterInvalid, "server: list rejected; the previous filter stays"},
+		{"FILTER_CHANGE_ONLY", cnl.FilterChangeOnly, "flag: only frames whose payload changed"},
+		{"MAX_FILTER_TEXT", cnl.MaxFilterText, "longest ID list, in bytes"},
+	}},
+}
+
+type field struct {
+	name      string
+	off, size int
+}
+
+type layout struct {
+	name   string
+	fields []field
+}
+
+// layouts give the fields of the control messages, as byte offsets into
+// the 8 data bytes. Multi-byte fields are big-endian.
+var layouts = []layout{
+	{"TX_ACK", []field{{"op", 0, 1}, {"status", 1, 1}, {"seq", 2, 2}, {"can_id", 4, 4}}},
+	{"HISTORY_REQUEST", []field{{"op", 0, 1}, {"seconds", 1, 2}}},
+	{"HISTORY_MARKER", []field{{"op", 0, 1}, {"status", 1, 1}, {"count", 2, 2}}},
+	{"SESSION", []field{{"op", 0, 1}, {"status", 1, 1}, {"token", 2, 6}}},
+	{"PING", []field{{"op", 0, 1}, {"seq", 2, 2}, {"rtt_us", 4, 4}}},
+	{"PONG", []field{{"op", 0, 1}, {"seq", 2, 2}, {"rtt_us", 4, 4}}},
+	{"COMPRESS", []field{{"op", 0, 1}, {"code", 1, 1}}},
+	{"FILTER_BEGIN", []field{{"op", 0, 1}, {"code", 1, 1}, {"flags", 2, 1}}},
+	{"FILTER_TEXT", []field{{"op", 0, 1}, {"code", 1, 1}, {"text", 2, 6}}},
+	{"ERR_FRAMES", []field{{"op", 0, 1}, {"code", 1, 1}}},
+	{"FLOW", []field{{"op", 0, 1}, {"code", 1, 1}, {"level", 2, 1}, {"depth", 4, 2}, {"capacity", 6, 2}}},
+	{"FD", []field{{"op", 0, 1}, {"code", 1, 1}}},
+	{"IDENT_TEXT", []field{{"op", 0, 1}, {"code", 1, 1}, {"text", 2, 6}}},
+	{"RTR", []field{{"op", 0, 1}, {"code", 1, 1}}},
+}
+
+var features = []string{cnl.FeatureTxAck, cnl.FeaturePing, cnl.FeatureHistory, cnl.FeatureSession, cnl.FeatureCompress, cnl.FeatureFilter, cnl.FeatureErrors, cnl.FeatureFlow, cnl.FeatureFD, cnl.FeatureIdent, cnl.FeatureRTR}
+
+// doc is the protocol description shared by both outputs.
+var doc = []string{
+	fmt.Sprintf("Wire protocol of can-server (cannelloni over TCP), revision %d.", cnl.ProtocolRevision),
+	"",
+	"A connection starts with both sides sending HELLO. After it each frame is",
+	"a 4-byte big-endian CAN ID carrying the SocketCAN flag bits, a length byte",
+	"(LEN_MASK bits) and that many payload bytes. Frames with CAN ID",
+	"CONTROL_ID are gateway control messages of 8 bytes, the op code first;",
+	"the layouts below give their fields. Optional extensions are advertised",
+	"in the mDNS \"features\" TXT record (FEATURES), the revision in \"proto\".",
+	"",
+	"After an OP_COMPRESS COMPRESS_DEFLATE answer the server -> client bytes",
+	"are a raw DEFLATE stream (RFC 1951) until an OP_COMPRESS COMPRESS_OFF",
+	"message and the final block; the stream is plain again after it.",
+	"",
+	"OP_FILTER pushes a receive filter: FILTER_BEGIN, the ID list (syntax of",
+	"the server -rx-allow flag) in FILTER_TEXT chunks, then FILTER_COMMIT.",
+	"",
+	"OP_FLOW FLOW_ON subscribes to flow hints: the server answers FLOW_HINT",
+	"with the backend TX queue state and sends another whenever the level",
+	"changes. Clients hold frames at FLOW_STOP and slow down at FLOW_SLOW.",
+	"",
+	"LEN_FD in the length byte marks a CAN FD frame: a flags byte (CANFD_*)",
+	"follows the length byte, then up to MAX_FD_LEN payload bytes. It is",
+	"only valid after OP_FD FD_ON; a server closes a connection sending it",
+	"without.",
+	"",
+	"OP_IDENT IDENT_QUERY asks who the server is: it answers with its version,",
+	"backend and bus name in IDENT_VERSION, IDENT_BACKEND and IDENT_BUS text",
+	"chunks (empty fields are left out), then IDENT_END.",
+	"",
+	"OP_RTR RTR_ON makes remote requests (CAN_RTR_FLAG) carry the requested",
+	"length and no payload, as in cannelloni. The server decodes them so",
+	"from the request on and sends them so after its RTR_ON answer; send no",
+	"remote request in between.",
+}
+
+// decimal lists the constants that are sizes rather than bit patterns.
+var decimal = map[string]bool{"MAX_DLC": true, "MAX_FD_LEN": true, "MAX_FRAME_SIZE": true, "MAX_FD_FRAME_SIZE": true, "MAX_FILTER_TEXT": true, "MAX_IDENT_TEXT": true}
+
+func formatConst(c constant) string {
+	if decimal[c.name] {
+		return fmt.Sprint(c.value)
+	}
+	return fmt.Sprintf("0x%02X", c.value)
+}
+
+// structFormat returns the Python struct format of l over 8 bytes.
+func structFormat(l layout) string {
+	var b strings.Builder
+	b.WriteString(">")
+	pos := 0
+	for _, f := range l.fields {
+		if gap := f.off - pos; gap > 0 {
+			fmt.Fprintf(&b, "%dx", gap)
+		}
+		switch f.size {
+		case 1:
+			b.WriteString("B")
+		case 2:
+			b.WriteString("H")
+		case 4:
+			b.WriteString("I")
+		default:
+			fmt.Fprintf(&b, "%ds", f.size)
+		}
+		pos = f.off + f.size
+	}
+	if pos < 8 {
+		fmt.Fprintf(&b, "%dx", 8-pos)
+	}
+	return b.String()
+}
+
+func fieldNames(l layout) string {
+	names := make([]string, len(l.fields))
+	for i, f := range l.fields {
+		names[i] = f.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// python renders the Python module.
+func python() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# %s\n", header)
+	fmt.Fprintf(&b, "\"\"\"%s\n", doc[0])
+	for _, l := range doc[1:] {
+		fmt.Fprintf(&b, "%s\n", strings.TrimRight(l, " "))
+	}
+	b.WriteString("\nSession tokens are the low 6 bytes of a big-endian uint64.\n\"\"\"\n\nimport struct\n\n")
+	fmt.Fprintf(&b, "PROTOCOL_REVISION = %d\n", cnl.ProtocolRevision)
+	fmt.Fprintf(&b, "HELLO = b%q\n", cnl.Hello)
+	for _, g := range groups {
+		fmt.Fprintf(&b, "\n# %s\n", g.title)
+		for _, c := range g.consts {
+			fmt.Fprintf(&b, "%s = %s  # %s\n", c.name, formatConst(c), c.doc)
+		}
+	}
+	b.WriteString("\n# Control message layouts (struct formats over the 8 data bytes)\n")
+	for _, l := range layouts {
+		fmt.Fprintf(&b, "%s_FORMAT = %q  # %s\n", l.name, structFormat(l), fieldNames(l))
+	}
+	quoted := make([]string, len(features))
+	for i, f := range features {
+		quoted[i] = fmt.Sprintf("%q", f)
+	}
+	fmt.Fprintf(&b, "\nFEATURES = (%s)\n", strings.Join(quoted, ", "))
+	b.WriteString(`
+
+def encode_frame(can_id, data=b"", fd_flags=None, rtr=False):
+    """Return the wire bytes of one frame.
+
+    With rtr (after OP_RTR RTR_ON) a remote request (CAN_RTR_FLAG) sends
+    only len(data). With fd_flags (CANFD_* bits) the frame is a CAN FD
+    frame, valid after OP_FD.
+    """
+    if fd_flags is not None:
+        if len(data) > MAX_FD_LEN:
+            raise ValueError("payload longer than %d bytes" % MAX_FD_LEN)
+        return struct.pack(">IBB", can_id, len(data) | LEN_FD, fd_flags) + bytes(data)
+    if len(data) > MAX_DLC:
+        raise ValueError("payload longer than %d bytes" % MAX_DLC)
+    if rtr and can_id & CAN_RTR_FLAG and can_id != CONTROL_ID:
+        return struct.pack(">IB", can_id, len(data))
+    return struct.pack(">IB", can_id, len(data)) + bytes(data)
+
+
+def decode_frame(buf, offset=0, fd=False, rtr=False):
+    """Decode the frame at buf[offset:].
+
+    Returns (can_id, data, next_offset), or None when buf ends mid-frame.
+    With rtr (after OP_RTR RTR_ON) the data of a remote request is zeros of
+    the requested length. CAN FD frames are accepted with fd (after OP_FD
+    FD_ON); their flags are dropped, decode_fd_frame returns them.
+    """
+    frame = decode_fd_frame(buf, offset, fd, rtr)
+    if frame is None:
+        return None
+    can_id, data, _, end = frame
+    return can_id, data, end
+
+
+def decode_fd_frame(buf, offset=0, fd=True, rtr=False):
+    """Decode the frame at buf[offset:] like decode_frame.
+
+    Returns (can_id, data, fd_flags, next_offset); fd_flags is None for a
+    classic frame.
+    """
+    if len(buf) - offset < 5:
+        return None
+    can_id, length = struct.unpack_from(">IB", buf, offset)
+    start, flags, limit = offset + 5, None, MAX_DLC
+    if length & LEN_FD:
+        if not fd:
+            raise ValueError("CAN FD frame without OP_FD")
+        if len(buf) < start + 1:
+            return None
+        flags, start, limit = buf[start], start + 1, MAX_FD_LEN
+    length &= LEN_MASK
+    if length > limit:
+        raise ValueError("invalid frame length %d" % length)
+    if rtr and flags is None and can_id & CAN_RTR_FLAG and can_id != CONTROL_ID:
+        return can_id, bytes(length), None, start
+    end = start + length
+    if len(buf) < end:
+        return None
+    return can_id, bytes(buf[start:end]), flags, end
+
+
+def control_frame(op, payload=b""):
+    """Return the wire bytes of a control message."""
+    data = bytes([op]) + bytes(payload)
+    if len(data) > 8:
+        raise ValueError("control payload longer than 7 bytes")
+    return encode_frame(CONTROL_ID, data.ljust(8, b"\0"))
+`)
+	return b.Bytes()
+}
+
+// cHeader renders the C header.
+func cHeader() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "/* %s */\n\n/*\n", header)
+	for _, l := range doc {
+		fmt.Fprintf(&b, "%s\n", strings.TrimRight(" * "+l, " "))
+	}
+	b.WriteString(" */\n#ifndef CAN_SERVER_PROTO_H\n#define CAN_SERVER_PROTO_H\n\n")
+	fmt.Fprintf(&b, "#define CNL_PROTOCOL_REVISION %d\n", cnl.ProtocolRevision)
+	fmt.Fprintf(&b, "#define CNL_HELLO %q\n", cnl.Hello)
+	fmt.Fprintf(&b, "#define CNL_HELLO_SIZE %d\n", cnl.HelloSize)
+	for _, g := range groups {
+		fmt.Fprintf(&b, "\n/* %s */\n", g.title)
+		for _, c := range g.consts {
+			suffix := "u"
+			if c.value > 0xFFFFFFFF {
+				suffix = "ull"
+			}
+			fmt.Fprintf(&b, "#define CNL_%s %s%s /* %s */\n", c.name, formatConst(c), suffix, c.doc)
+		}
+	}
+	b.WriteString("\n/* Control message layouts: byte offset and size of each field in the\n * 8 data bytes; multi-byte fields are big-endian. */\n")
+	for _, l := range layouts {
+		for _, f := range l.fields {
+			n := strings.ToUpper(f.name)
+			fmt.Fprintf(&b, "#define CNL_%s_%s_OFF %d\n", l.name, n, f.off)
+			fmt.Fprintf(&b, "#define CNL_%s_%s_SIZE %d\n", l.name, n, f.size)
+		}
+	}
+	b.WriteString("\n/* Extensions advertised in the mDNS \"features\" TXT record */\n")
+	for _, f := range features {
+		fmt.Fprintf(&b, "#define CNL_FEATURE_%s %q\n", strings.ToUpper(f), f)
+	}
+	b.WriteString("\n#endif /* CAN_SERVER_PROTO_H */\n")
+	return b.Bytes()
+}
+
+// outputs maps file names to their content.
+func outputs() map[string][]byte {
+	return map[string][]byte{pythonFile: python(), headerFile: cHeader()}
+}
+
+func main() {
+	dir := flag.String("dir", ".", "Output directory")
+	flag.Parse()
+	for name, body := range outputs() {
+		if err := os.WriteFile(filepath.Join(*dir, name), body, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+)
+
+// TestGeneratedUpToDate fails when the committed bindings differ from what
+// the generator emits for the current protocol constants.
+func TestGeneratedUpToDate(t *testing.T) {
+	for name, want := range outputs() {
+		got, err := os.ReadFile(filepath.Join("..", "..", "..", "client", "proto", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s is stale; run go generate ./internal/cnl", name)
+		}
+	}
+}
+
+func TestStructFormat(t *testing.T) {
+	for _, tc := range []struct {
+		l    layout
+		want string
+	}{
+		{layouts[0], ">BBHI"},
+		{layout{fields: []field{{"op", 0, 1}, {"seconds", 1, 2}}}, ">BH5x"},
+		{layout{fields: []field{{"op", 0, 1}, {"token", 2, 6}}}, ">B1x6s"},
+	} {
+		if got := structFormat(tc.l); got != tc.want {
+			t.Errorf("structFormat(%v) = %q want %q", tc.l.fields, got, tc.want)
+		}
+	}
+}
+
+// TestLayoutsMatchEncoders checks the published field offsets against the
+// Go encoders of each control message.
+func TestLayoutsMatchEncoders(t *testing.T) {
+	frames := map[string]can.Frame{
+		"TX_ACK":          cnl.TxAck(0x0102, 0x03, 0x04050607),
+		"HISTORY_REQUEST": cnl.HistoryRequest(0x0102),
+		"HISTORY_MARKER":  cnl.HistoryMarker(cnl.OpHistoryBegin, 0x03, 0x0102),
+		"SESSION":         cnl.SessionMessage(0x03, 0x010203040506),
+		"PING":            cnl.Ping(0x0102, 0x04050607*time.Microsecond),
+		"PONG":            cnl.Pong(cnl.Ping(0x0102, 0x04050607*time.Microsecond)),
+		"COMPRESS":        cnl.Compress(0x03),
+		"ERR_FRAMES":      cnl.ErrFrames(0x03),
+		"FLOW":            cnl.FlowHintMessage(0x03, 0x0102, 0x0405),
+		"FD":              cnl.FD(0x03),
+		"RTR":             cnl.RTR(0x03),
+		"IDENT_TEXT":      cnl.IdentMessages(cnl.Ident{Bus: "\x01\x02\x03\x04\x05\x06"})[0],
+		"FILTER_BEGIN":    cnl.FilterMessages("", 0x03)[0],
+		"FILTER_TEXT":     cnl.FilterMessages("\x01\x02\x03\x04\x05\x06", 0)[1],
+	}
+	want := map[string]uint64{
+		"status": 0x03, "seq": 0x0102, "can_id": 0x04050607, "seconds": 0x0102,
+		"count": 0x0102, "token": 0x010203040506, "rtt_us": 0x04050607,
+		"code": 0x03, "flags": 0x03, "text": 0x010203040506,
+		"level": 0x03, "depth": 0x0102, "capacity": 0x0405,
+	}
+	// Messages whose code byte is fixed by the layout.
+	codes := map[string]uint64{"FILTER_BEGIN": cnl.FilterBegin, "FILTER_TEXT": cnl.FilterText, "FLOW": cnl.FlowHint}
+	for _, l := range layouts {
+		fr, ok := frames[l.name]
+		if !ok {
+			t.Errorf("layout %s has no encoder check", l.name)
+			continue
+		}
+		for _, f := range l.fields {
+			var v uint64
+			for _, b := range fr.Data[f.off : f.off+f.size] {
+				v = v<<8 | uint64(b)
+			}
+			if f.name == "op" {
+				if v == 0 {
+					t.Errorf("%s: op byte is 0", l.name)
+				}
+				continue
+			}
+			exp := want[f.name]
+			if c, ok := codes[l.name]; ok && f.name == "code" {
+				exp = c
+			}
+			if v != exp {
+				t.Errorf("%s.%s = %#x want %#x", l.name, f.name, v, exp)
+			}
+		}
+	}
+}
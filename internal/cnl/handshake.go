@@ -9,7 +9,11 @@ import (
 	"time"
 )
 
-const hello = "CANNELLONIv1"
+// Hello is the greeting both sides send to open a connection.
+const Hello = "CANNELLONIv1"
+
+// HelloSize is the number of bytes each side sends during the handshake.
+const HelloSize = len(Hello)
 
 func Handshake(ctx context.Context, c net.Conn, timeout time.Duration) error {
 	if deadlineErr := c.SetDeadline(time.Now().Add(timeout)); deadlineErr != nil {
@@ -21,15 +25,15 @@ func Handshake(ctx context.Context, c net.Conn, timeout time.Duration) error {
 
 	// Writer
 	go func() {
-		_, err := io.WriteString(c, hello)
+		_, err := io.WriteString(c, Hello)
 		errCh <- err
 	}()
 
 	// Reader
 	go func() {
-		buf := make([]byte, len(hello))
+		buf := make([]byte, len(Hello))
 		_, err := io.ReadFull(c, buf)
-		if err == nil && string(buf) != hello {
+		if err == nil && string(buf) != Hello {
 			err = errors.New("bad hello")
 		}
 		errCh <- err
@@ -0,0 +1,143 @@
+package cnl
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// Packet loss sources (cannelloni_packets_lost_total{source}).
+const (
+	SourceTCP = "tcp"
+	SourceUDP = "udp"
+)
+
+// maxPacketFrames is the largest frame count of a packet header.
+const maxPacketFrames = 0xFFFF
+
+// SeqTracker detects lost cannelloni packets from gaps in their 8-bit
+// sequence numbers. The zero value expects any first packet.
+type SeqTracker struct {
+	next    uint8
+	started bool
+}
+
+// Lost records seq and returns how many packets were skipped before it.
+// A reordered or repeated packet looks like a gap of up to 255; cannelloni
+// over TCP and a direct UDP link do not reorder.
+func (t *SeqTracker) Lost(seq uint8) int {
+	n := 0
+	if t.started {
+		n = int(seq - t.next)
+	}
+	t.next, t.started = seq+1, true
+	return n
+}
+
+// PacketEncoder frames batches as cannelloni DATA packets on a stream, the
+// framing of stock cannelloni builds, numbering them per stream. It is not
+// safe for concurrent use.
+type PacketEncoder struct {
+	seq uint8
+}
+
+// packetCodec encodes the frames of DATA packets. Stock cannelloni sends
+// remote requests without payload.
+var packetCodec = Codec{RTR: true}
+
+// EncodeTo writes frames to w as one packet (more for batches above 65535
+// frames) and returns the bytes written.
+func (e *PacketEncoder) EncodeTo(w io.Writer, frames []can.Frame) (int, error) {
+	var total int
+	for len(frames) > 0 {
+		n := min(len(frames), maxPacketFrames)
+		var hdr [UDPHeaderSize]byte
+		hdr[0], hdr[1], hdr[2] = UDPVersion, UDPOpData, e.seq
+		binary.BigEndian.PutUint16(hdr[3:], uint16(n))
+		e.seq++
+		k, err := w.Write(hdr[:])
+		total += k
+		if err != nil {
+			return total, fmt.Errorf("cannelloni encode header: %w", err)
+		}
+		k, err = packetCodec.EncodeTo(w, frames[:n])
+		total += k
+		if err != nil {
+			return total, err
+		}
+		frames = frames[n:]
+	}
+	return total, nil
+}
+
+// PacketDecoder reads frames from cannelloni DATA packets on a stream and
+// counts sequence gaps in cannelloni_packets_lost_total{source}. It is not
+// safe for concurrent use.
+type PacketDecoder struct {
+	codec  Codec
+	source string
+	left   int // frames of the current packet still to read
+	seq    SeqTracker
+}
+
+// NewPacketDecoder returns a decoder counting lost packets under source.
+// Remote requests carry no payload, as from stock cannelloni.
+func NewPacketDecoder(source string) *PacketDecoder {
+	return &PacketDecoder{codec: Codec{RTR: true}, source: source}
+}
+
+// Codec returns the frame codec of d, for settings such as FD.
+func (d *PacketDecoder) Codec() *Codec { return &d.codec }
+
+// Decode reads exactly one frame, reading packet headers as they come. It
+// returns io.EOF at a clean packet boundary without more data.
+func (d *PacketDecoder) Decode(r io.Reader) (can.Frame, error) {
+	for d.left == 0 {
+		var hdr [UDPHeaderSize]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				metrics.IncMalformed()
+				return can.Frame{}, fmt.Errorf("cannelloni decode header: %w", ErrTruncatedFrame)
+			}
+			return can.Frame{}, err
+		}
+		if hdr[0] != UDPVersion || hdr[1] != UDPOpData {
+			metrics.IncMalformed()
+			return can.Frame{}, fmt.Errorf("%w: version %d op %d", ErrBadPacket, hdr[0], hdr[1])
+		}
+		if n := d.seq.Lost(hdr[2]); n > 0 {
+			metrics.AddCannelloniLost(d.source, n)
+		}
+		d.left = int(binary.BigEndian.Uint16(hdr[3:]))
+	}
+	fr, err := d.codec.Decode(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			// The header promised more frames.
+			metrics.IncMalformed()
+			return fr, fmt.Errorf("cannelloni decode: %w", ErrTruncatedFrame)
+		}
+		return fr, err
+	}
+	d.left--
+	return fr, nil
+}
+
+// DecodeN decodes up to max frames (if max>0) or until an error, invoking
+// onFrame for each, like Codec.DecodeN.
+func (d *PacketDecoder) DecodeN(r io.Reader, max int, onFrame func(can.Frame)) (int, error) {
+	var n int
+	for max <= 0 || n < max {
+		fr, err := d.Decode(r)
+		if err != nil {
+			return n, err
+		}
+		onFrame(fr)
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,88 @@
+package cnl
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestPacketStreamRoundTrip(t *testing.T) {
+	var enc PacketEncoder
+	var buf bytes.Buffer
+	batches := [][]can.Frame{
+		{{CANID: 0x123, Len: 2, Data: [64]byte{1, 2}}},
+		{},
+		{{CANID: 0x1ABCDEF | can.CAN_EFF_FLAG, Len: 8}, {CANID: 0x7FF}},
+	}
+	var want []can.Frame
+	for _, b := range batches {
+		if _, err := enc.EncodeTo(&buf, b); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, b...)
+	}
+	// Packets are numbered per stream and carry their frame count; the
+	// stream parses with the UDP packet decoder packet by packet.
+	wire := buf.Bytes()
+	if wire[2] != 0 || wire[3] != 0 || wire[4] != 1 {
+		t.Fatalf("first header % x", wire[:UDPHeaderSize])
+	}
+	dec := NewPacketDecoder(SourceTCP)
+	var got []can.Frame
+	n, err := dec.DecodeN(bytes.NewReader(wire), 0, func(fr can.Frame) { got = append(got, fr) })
+	if !errors.Is(err, io.EOF) || n != len(want) {
+		t.Fatalf("decoded %d frames, err %v", n, err)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("frame %d: got %+v want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPacketStreamLoss(t *testing.T) {
+	c := &Codec{}
+	var wire []byte
+	for _, seq := range []uint8{254, 255, 2, 3} { // 0 and 1 lost across the wrap
+		wire = append(wire, c.EncodePacket(seq, []can.Frame{{CANID: uint32(seq), Len: 1}})...)
+	}
+	dec := NewPacketDecoder(SourceTCP)
+	r := bytes.NewReader(wire)
+	for range 4 {
+		if _, err := dec.Decode(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dec.seq.next != 4 {
+		t.Fatalf("next seq %d", dec.seq.next)
+	}
+
+	var tr SeqTracker
+	for _, tc := range []struct {
+		seq  uint8
+		lost int
+	}{{7, 0}, {8, 0}, {10, 1}, {9, 254}} {
+		if got := tr.Lost(tc.seq); got != tc.lost {
+			t.Fatalf("Lost(%d) = %d, want %d", tc.seq, got, tc.lost)
+		}
+	}
+}
+
+func TestPacketStreamErrors(t *testing.T) {
+	c := &Codec{}
+	good := c.EncodePacket(1, []can.Frame{{CANID: 1, Len: 4}})
+	for name, p := range map[string][]byte{
+		"version":   append([]byte{1}, good[1:]...),
+		"op":        append([]byte{2, 1}, good[2:]...),
+		"header":    good[:3],
+		"truncated": good[:len(good)-1],
+		"count":     good[:UDPHeaderSize], // one frame promised, none sent
+	} {
+		if _, err := NewPacketDecoder(SourceTCP).Decode(bytes.NewReader(p)); err == nil || errors.Is(err, io.EOF) {
+			t.Fatalf("%s: err %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package cnl
+
+//go:generate go run ./gen -dir ../../client/proto
+
+// ProtocolRevision numbers the wire protocol described by this package:
+// the frame layout, control ops, their layouts and status codes. It is
+// bumped with every change to them, advertised in the mDNS "proto" TXT
+// record and carried by the generated Python and C bindings, so
+// integrators can tell which server revision their copy matches.
+const ProtocolRevision = 9
+
+// Protocol extensions advertised in the mDNS "features" TXT record.
+const (
+	FeatureTxAck    = "txack"     // OpTxAckEnable / OpTxAck
+	FeaturePing     = "ping"      // OpPing / OpPong
+	FeatureHistory  = "history"   // OpHistory replays (capture enabled)
+	FeatureSession  = "session"   // OpSession resumption (sessions enabled)
+	FeatureCompress = "compress"  // OpCompress DEFLATE (compression enabled)
+	FeatureFilter   = "filter"    // OpFilter receive filters
+	FeatureErrors   = "errframes" // OpErrFrames (error frames enabled)
+	FeatureFlow     = "flow"      // OpFlow hints (backend with a TX queue)
+	FeatureFD       = "fd"        // OpFD CAN FD frames (backend carrying them)
+	FeatureIdent    = "ident"     // OpIdent gateway identification
+	FeatureRTR      = "rtr"       // OpRTR remote requests without payload
+)
@@ -0,0 +1,56 @@
+package cnl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// Cannelloni UDP packet header: version, op code, sequence number and a
+// big-endian frame count, followed by frames in the stream encoding.
+const (
+	UDPVersion    = 2
+	UDPOpData     = 0
+	UDPHeaderSize = 5
+	// UDPMaxPayload keeps packets below a typical Ethernet MTU.
+	UDPMaxPayload = 1400
+)
+
+// ErrBadPacket is returned for UDP datagrams that are not cannelloni DATA packets.
+var ErrBadPacket = errors.New("cannelloni: bad udp packet")
+
+// EncodePacket builds one UDP DATA packet carrying frames.
+func (c *Codec) EncodePacket(seq uint8, frames []can.Frame) []byte {
+	var buf bytes.Buffer
+	buf.Grow(UDPHeaderSize + len(frames)*(4+1+8))
+	hdr := [UDPHeaderSize]byte{UDPVersion, UDPOpData, seq}
+	binary.BigEndian.PutUint16(hdr[3:], uint16(len(frames)))
+	buf.Write(hdr[:])
+	_, _ = c.EncodeTo(&buf, frames)
+	return buf.Bytes()
+}
+
+// DecodePacket parses a UDP DATA packet, invoking onFrame for each frame.
+// It returns the packet sequence number.
+func (c *Codec) DecodePacket(p []byte, onFrame func(can.Frame)) (uint8, error) {
+	if len(p) < UDPHeaderSize {
+		return 0, fmt.Errorf("%w: short header (%d bytes)", ErrBadPacket, len(p))
+	}
+	if p[0] != UDPVersion || p[1] != UDPOpData {
+		return 0, fmt.Errorf("%w: version %d op %d", ErrBadPacket, p[0], p[1])
+	}
+	seq := p[2]
+	count := int(binary.BigEndian.Uint16(p[3:5]))
+	r := bytes.NewReader(p[UDPHeaderSize:])
+	for i := 0; i < count; i++ {
+		fr, err := c.Decode(r)
+		if err != nil {
+			return seq, fmt.Errorf("%w: frame %d/%d: %v", ErrBadPacket, i+1, count, err)
+		}
+		onFrame(fr)
+	}
+	return seq, nil
+}
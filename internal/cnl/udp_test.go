@@ -0,0 +1,50 @@
+package cnl
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestUDPPacketRoundTrip(t *testing.T) {
+	c := &Codec{}
+	in := []can.Frame{
+		{CANID: 0x123, Len: 2, Data: [64]byte{1, 2}},
+		{CANID: 0x1ABCDEF | can.CAN_EFF_FLAG, Len: 8, Data: [64]byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		{CANID: 0x7FF, Len: 0},
+	}
+	p := c.EncodePacket(42, in)
+	if p[0] != UDPVersion || p[1] != UDPOpData || p[2] != 42 {
+		t.Fatalf("bad header % x", p[:UDPHeaderSize])
+	}
+	var out []can.Frame
+	seq, err := c.DecodePacket(p, func(fr can.Frame) { out = append(out, fr) })
+	if err != nil || seq != 42 {
+		t.Fatalf("decode: seq=%d err=%v", seq, err)
+	}
+	if len(out) != len(in) {
+		t.Fatalf("got %d frames, want %d", len(out), len(in))
+	}
+	for i := range in {
+		if out[i] != in[i] {
+			t.Fatalf("frame %d: got %+v want %+v", i, out[i], in[i])
+		}
+	}
+}
+
+func TestUDPPacketErrors(t *testing.T) {
+	c := &Codec{}
+	good := c.EncodePacket(1, []can.Frame{{CANID: 1, Len: 4}})
+	for name, p := range map[string][]byte{
+		"short":     {2, 0},
+		"version":   {1, 0, 0, 0, 0},
+		"op":        {2, 1, 0, 0, 0},
+		"truncated": good[:len(good)-1],
+		"count":     append([]byte{2, 0, 0, 0, 2}, good[UDPHeaderSize:]...),
+	} {
+		if _, err := c.DecodePacket(p, func(can.Frame) {}); !errors.Is(err, ErrBadPacket) {
+			t.Fatalf("%s: expected ErrBadPacket, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Package cyclic transmits frames at fixed periods, such as keep-alives
+// other nodes expect from the gateway, and measures how closely each period
+// is kept.
+//
+// Every entry runs on its own timer against absolute deadlines, so a late
+// send does not shift the following ones. The jitter of an entry is the
+// difference between the actual time between two consecutive sends and the
+// configured period; on a loaded system it shows how far the timing drifts
+// before receivers start to miss frames.
+package cyclic
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// MinPeriod is the shortest accepted period.
+const MinPeriod = time.Millisecond
+
+// Entry is one frame sent every Period.
+type Entry struct {
+	Frame  can.Frame
+	Period time.Duration
+}
+
+// Name identifies the entry in stats and metrics: the frame ID and period,
+// e.g. "123@100ms".
+func (e Entry) Name() string {
+	id, _, _ := strings.Cut(e.Frame.String(), "#")
+	return id + "@" + e.Period.String()
+}
+
+// Parse reads a comma separated list of "<frame>@<period>" entries, the
+// frame in candump notation: "123#0102@100ms,1D000123#FF@1s".
+func Parse(spec string) ([]Entry, error) {
+	var out []Entry
+	seen := make(map[string]bool)
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		fs, ps, ok := strings.Cut(s, "@")
+		if !ok {
+			return nil, fmt.Errorf("%q: want <frame>@<period>", s)
+		}
+		fr, err := can.ParseFrame(fs)
+		if err != nil {
+			return nil, err
+		}
+		p, err := time.ParseDuration(strings.TrimSpace(ps))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", s, err)
+		}
+		if p < MinPeriod {
+			return nil, fmt.Errorf("%q: period must be >= %v", s, MinPeriod)
+		}
+		e := Entry{Frame: fr, Period: p}
+		if seen[e.Name()] {
+			return nil, fmt.Errorf("%q: duplicate entry %s", s, e.Name())
+		}
+		seen[e.Name()] = true
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// Stats is a snapshot of one entry.
+type Stats struct {
+	Entry  string
+	Period time.Duration
+	Sent   uint64
+	Errors uint64 // sends the transmit path rejected
+	Missed uint64 // deadlines skipped because a send ran past them
+	// Jitter is actual minus configured period of the last interval;
+	// JitterMax and JitterMean are over absolute values since start.
+	Jitter     time.Duration
+	JitterMax  time.Duration
+	JitterMean time.Duration
+}
+
+type entryState struct {
+	Entry
+	name                 string
+	sent, errors, missed atomic.Uint64
+	jitter, jitterMax    atomic.Int64
+	jitterSum, intervals atomic.Int64
+}
+
+func (st *entryState) observe(interval time.Duration) {
+	j := interval - st.Period
+	st.jitter.Store(int64(j))
+	abs := int64(max(j, -j))
+	if abs > st.jitterMax.Load() {
+		st.jitterMax.Store(abs) // single writer: the entry goroutine
+	}
+	st.jitterSum.Add(abs)
+	st.intervals.Add(1)
+}
+
+func (st *entryState) stats() Stats {
+	s := Stats{
+		Entry: st.name, Period: st.Period,
+		Sent: st.sent.Load(), Errors: st.errors.Load(), Missed: st.missed.Load(),
+		Jitter: time.Duration(st.jitter.Load()), JitterMax: time.Duration(st.jitterMax.Load()),
+	}
+	if n := st.intervals.Load(); n > 0 {
+		s.JitterMean = time.Duration(st.jitterSum.Load() / n)
+	}
+	return s
+}
+
+// Scheduler sends a set of entries.
+type Scheduler struct {
+	entries []*entryState
+	send    func(can.Frame) error
+}
+
+// New returns a scheduler passing the frames of entries to send.
+func New(entries []Entry, send func(can.Frame) error) *Scheduler {
+	s := &Scheduler{send: send}
+	for _, e := range entries {
+		s.entries = append(s.entries, &entryState{Entry: e, name: e.Name()})
+	}
+	return s
+}
+
+// Run sends the entries until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, st := range s.entries {
+		wg.Add(1)
+		go func() { defer wg.Done(); s.run(ctx, st) }()
+	}
+	wg.Wait()
+}
+
+func (s *Scheduler) run(ctx context.Context, st *entryState) {
+	next := time.Now().Add(st.Period)
+	t := time.NewTimer(st.Period)
+	defer t.Stop()
+	var last time.Time
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		now := time.Now()
+		if !last.IsZero() {
+			st.observe(now.Sub(last))
+		}
+		last = now
+		if err := s.send(st.Frame); err != nil {
+			st.errors.Add(1)
+		} else {
+			st.sent.Add(1)
+		}
+		next = next.Add(st.Period)
+		if late := time.Since(next); late >= 0 {
+			skip := late/st.Period + 1
+			st.missed.Add(uint64(skip))
+			next = next.Add(skip * st.Period)
+		}
+		t.Reset(time.Until(next))
+	}
+}
+
+// Stats returns a snapshot of every entry, in configuration order.
+func (s *Scheduler) Stats() []Stats {
+	out := make([]Stats, len(s.entries))
+	for i, st := range s.entries {
+		out[i] = st.stats()
+	}
+	return out
+}
@@ -0,0 +1,65 @@
+package cyclic
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestParse(t *testing.T) {
+	es, err := Parse("123#0102@100ms, 1D000123#FF@1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 2 || es[0].Name() != "123@100ms" || es[1].Name() != "1D000123@1s" {
+		t.Fatalf("entries = %+v", es)
+	}
+	if es[0].Frame.Len != 2 || es[1].Frame.CANID&can.CAN_EFF_FLAG == 0 {
+		t.Fatalf("frames = %v %v", es[0].Frame, es[1].Frame)
+	}
+	if es, err := Parse(""); err != nil || es != nil {
+		t.Fatalf("empty spec: %v %v", es, err)
+	}
+	for _, bad := range []string{"123#01", "123#01@x", "123#01@100us", "zz#01@1s", "123#01@1s,123#02@1s"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("Parse(%q): want error", bad)
+		}
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	var sent atomic.Int64
+	slow := make(chan struct{})
+	s := New([]Entry{
+		{Frame: can.Frame{CANID: 0x100}, Period: 5 * time.Millisecond},
+		{Frame: can.Frame{CANID: 0x200}, Period: 5 * time.Millisecond},
+	}, func(fr can.Frame) error {
+		if fr.CANID == 0x200 {
+			// A send taking three periods makes the entry miss deadlines.
+			select {
+			case <-slow:
+			case <-time.After(15 * time.Millisecond):
+			}
+			return nil
+		}
+		sent.Add(1)
+		return nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	s.Run(ctx)
+	close(slow)
+	st := s.Stats()
+	if st[0].Entry != "100@5ms" || st[0].Sent < 5 || int64(st[0].Sent) != sent.Load() {
+		t.Fatalf("fast entry: %+v (sent %d)", st[0], sent.Load())
+	}
+	if st[0].JitterMax < 0 || st[0].JitterMean > st[0].JitterMax {
+		t.Fatalf("fast entry jitter: %+v", st[0])
+	}
+	if st[1].Missed == 0 || st[1].JitterMean < 5*time.Millisecond {
+		t.Fatalf("slow entry: %+v", st[1])
+	}
+}
@@ -0,0 +1,78 @@
+// Package dedup collapses identical consecutive frames submitted for
+// transmission within a short window (e.g. a UI double-tap sent by one or
+// more clients), so the bus sees the command once.
+package dedup
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// sweepThreshold bounds the per-ID state; above it expired entries are pruned.
+const sweepThreshold = 4096
+
+type entry struct {
+	len  uint8
+	data [8]byte
+	at   time.Time
+}
+
+// Deduper remembers the last frame sent per CAN ID. Safe for concurrent use.
+type Deduper struct {
+	window time.Duration
+	match  func(*can.Frame) bool
+	now    func() time.Time
+
+	mu   sync.Mutex
+	last map[uint32]entry
+}
+
+// New returns a Deduper suppressing repeats within window. match selects the
+// IDs subject to deduplication; nil applies it to every ID.
+func New(window time.Duration, match func(*can.Frame) bool) *Deduper {
+	return &Deduper{window: window, match: match, now: time.Now, last: make(map[uint32]entry)}
+}
+
+// Suppress reports whether fr repeats the last frame recorded for its ID
+// (same flags, length and payload) less than window ago. It does not record
+// fr; call Record once the frame was actually sent, so a failed send does not
+// turn the client's retry into a duplicate.
+func (d *Deduper) Suppress(fr *can.Frame) bool {
+	if d.match != nil && !d.match(fr) {
+		return false
+	}
+	e := entryOf(fr)
+	now := d.now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prev, ok := d.last[fr.CANID]
+	return ok && prev.len == e.len && prev.data == e.data && now.Sub(prev.at) < d.window
+}
+
+// Record makes fr the reference for its ID, starting a new window.
+func (d *Deduper) Record(fr *can.Frame) {
+	if d.match != nil && !d.match(fr) {
+		return
+	}
+	e := entryOf(fr)
+	now := d.now()
+	e.at = now
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.last[fr.CANID] = e
+	if len(d.last) > sweepThreshold {
+		for id, p := range d.last {
+			if now.Sub(p.at) >= d.window {
+				delete(d.last, id)
+			}
+		}
+	}
+}
+
+func entryOf(fr *can.Frame) entry {
+	e := entry{len: fr.Len}
+	copy(e.data[:], fr.Data[:8])
+	return e
+}
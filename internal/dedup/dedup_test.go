@@ -0,0 +1,54 @@
+package dedup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestSuppress(t *testing.T) {
+	now := time.Unix(0, 0)
+	d := New(100*time.Millisecond, func(fr *can.Frame) bool { return fr.CANID < 0x200 })
+	d.now = func() time.Time { return now }
+	fr := can.Frame{CANID: 0x100, Len: 2, Data: [64]byte{1, 2}}
+	other := can.Frame{CANID: 0x100, Len: 2, Data: [64]byte{1, 3}}
+	steps := []struct {
+		advance time.Duration
+		fr      can.Frame
+		want    bool
+	}{
+		{0, fr, false},
+		{10 * time.Millisecond, fr, true},     // repeat inside window
+		{10 * time.Millisecond, other, false}, // payload changed
+		{10 * time.Millisecond, fr, false},    // differs from last (other)
+		{150 * time.Millisecond, fr, false},   // window expired
+		{0, can.Frame{CANID: 0x300}, false},   // outside configured IDs
+		{0, can.Frame{CANID: 0x300}, false},
+	}
+	for i, s := range steps {
+		now = now.Add(s.advance)
+		if got := d.Suppress(&s.fr); got != s.want {
+			t.Fatalf("step %d: got %v want %v", i, got, s.want)
+		}
+		if !s.want {
+			d.Record(&s.fr)
+		}
+	}
+}
+
+func TestSuppressNeedsRecord(t *testing.T) {
+	d := New(time.Second, nil)
+	fr := can.Frame{CANID: 0x100, Len: 1, Data: [64]byte{1}}
+	if d.Suppress(&fr) {
+		t.Fatal("first frame suppressed")
+	}
+	// The send failed, so nothing was recorded and the retry must go out.
+	if d.Suppress(&fr) {
+		t.Fatal("retry after a failed send suppressed")
+	}
+	d.Record(&fr)
+	if !d.Suppress(&fr) {
+		t.Fatal("repeat after a successful send not suppressed")
+	}
+}
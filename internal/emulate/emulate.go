@@ -0,0 +1,233 @@
+// Package emulate answers client queries like Ampio modules on the bus
+// would, from a rule file, so applications can be developed against the
+// gateway with no physical modules present.
+//
+// Each non-comment line of a rule file maps a query to its responses:
+//
+//	# query            -> responses
+//	1D000123#0A01      -> 1D000124#0A0102FF
+//	1D000123#0B??      -> 1D000124#0B$1.00 +20ms 1D000124#0BFF
+//	1D000123#0C        -> 1D000124#0C00 | 1D000124#0C01
+//
+// The query data is a prefix: a frame with the same ID whose data starts
+// with the given bytes matches, and "??" matches any byte. In a response
+// "$N" copies byte N of the query. A response is a list of frames; a
+// "+duration" token delays the frames after it. Alternatives separated by
+// "|" are used in turn on successive matches (e.g. a toggling relay). The
+// first matching rule wins.
+package emulate
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// wildcard marks a query byte that matches any value; refBase marks a
+// response byte copied from the query (refBase+N for byte N).
+const (
+	wildcard = -1
+	refBase  = 0x100
+)
+
+type pattern struct {
+	canID uint32 // with EFF/RTR flags
+	data  []int  // byte values, wildcard, or refBase+N
+}
+
+type step struct {
+	delay time.Duration // before this frame, relative to the previous one
+	fr    pattern
+}
+
+type rule struct {
+	query pattern
+	alts  [][]step
+	hits  atomic.Uint64
+}
+
+// Emulator holds the rules of one rule file.
+type Emulator struct {
+	rules []*rule
+}
+
+// Load reads a rule file.
+func Load(path string) (*Emulator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	e, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return e, nil
+}
+
+// Parse reads rules from r.
+func Parse(r io.Reader) (*Emulator, error) {
+	e := &Emulator{}
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 && strings.TrimSpace(line[:i]) == "" {
+			continue // comment line (frames contain '#' too)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		rl, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", ln, err)
+		}
+		e.rules = append(e.rules, rl)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func parseRule(line string) (*rule, error) {
+	q, resp, ok := strings.Cut(line, "->")
+	if !ok {
+		return nil, fmt.Errorf("missing '->'")
+	}
+	query, err := parsePattern(strings.TrimSpace(q), true)
+	if err != nil {
+		return nil, err
+	}
+	rl := &rule{query: query}
+	for _, alt := range strings.Split(resp, "|") {
+		var steps []step
+		var delay time.Duration
+		for _, tok := range strings.Fields(alt) {
+			if strings.HasPrefix(tok, "+") {
+				d, err := time.ParseDuration(tok[1:])
+				if err != nil || d < 0 {
+					return nil, fmt.Errorf("bad delay %q", tok)
+				}
+				delay += d
+				continue
+			}
+			p, err := parsePattern(tok, false)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, step{delay: delay, fr: p})
+			delay = 0
+		}
+		if len(steps) == 0 {
+			return nil, fmt.Errorf("response without frames")
+		}
+		rl.alts = append(rl.alts, steps)
+	}
+	return rl, nil
+}
+
+// parsePattern parses "<id>#<data>" like can.ParseFrame, plus "??" bytes in
+// queries and "$N" bytes in responses.
+func parsePattern(s string, query bool) (pattern, error) {
+	var p pattern
+	idStr, dataStr, ok := strings.Cut(s, "#")
+	if !ok {
+		return p, fmt.Errorf("%w: %q: missing '#'", can.ErrBadFrameSpec, s)
+	}
+	fr, err := can.ParseFrame(idStr + "#")
+	if err != nil {
+		return p, err
+	}
+	p.canID = fr.CANID
+	if strings.EqualFold(dataStr, "R") {
+		p.canID |= can.CAN_RTR_FLAG
+		return p, nil
+	}
+	dataStr = strings.ReplaceAll(dataStr, ".", "")
+	for dataStr != "" {
+		switch {
+		case query && strings.HasPrefix(dataStr, "??"):
+			p.data = append(p.data, wildcard)
+			dataStr = dataStr[2:]
+		case !query && dataStr[0] == '$':
+			if len(dataStr) < 2 || dataStr[1] < '0' || dataStr[1] > '7' {
+				return p, fmt.Errorf("%q: '$' needs a query byte index 0-7", s)
+			}
+			p.data = append(p.data, refBase+int(dataStr[1]-'0'))
+			dataStr = dataStr[2:]
+		default:
+			if len(dataStr) < 2 {
+				return p, fmt.Errorf("%w: %q: odd number of hex digits", can.ErrBadFrameSpec, s)
+			}
+			v, err := strconv.ParseUint(dataStr[:2], 16, 8)
+			if err != nil {
+				return p, fmt.Errorf("%w: %q: bad data byte %q", can.ErrBadFrameSpec, s, dataStr[:2])
+			}
+			p.data = append(p.data, int(v))
+			dataStr = dataStr[2:]
+		}
+	}
+	if len(p.data) > 8 {
+		return p, fmt.Errorf("%w: %q: data must be 0..8 bytes", can.ErrBadFrameSpec, s)
+	}
+	return p, nil
+}
+
+// Len returns the number of rules.
+func (e *Emulator) Len() int { return len(e.rules) }
+
+func (p *pattern) match(fr *can.Frame) bool {
+	if fr.CANID != p.canID || int(fr.Len) < len(p.data) {
+		return false
+	}
+	for i, b := range p.data {
+		if b != wildcard && fr.Data[i] != byte(b) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *pattern) build(query *can.Frame) can.Frame {
+	fr := can.Frame{CANID: p.canID, Len: uint8(len(p.data))}
+	for i, b := range p.data {
+		if b >= refBase {
+			b = int(query.Data[b-refBase])
+		}
+		fr.Data[i] = byte(b)
+	}
+	return fr
+}
+
+// Handle answers fr when it matches a rule: response frames are passed to
+// emit, immediately or after their delay (from a timer goroutine). It
+// reports whether fr was a query of an emulated device.
+func (e *Emulator) Handle(fr *can.Frame, emit func(can.Frame)) bool {
+	for _, rl := range e.rules {
+		if !rl.query.match(fr) {
+			continue
+		}
+		n := rl.hits.Add(1) - 1
+		steps := rl.alts[n%uint64(len(rl.alts))]
+		var at time.Duration
+		for _, st := range steps {
+			out := st.fr.build(fr)
+			at += st.delay
+			if at == 0 {
+				emit(out)
+			} else {
+				time.AfterFunc(at, func() { emit(out) })
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package emulate
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+const rules = `
+# relay module
+1D000123#0A01 -> 1D000124#0A0102FF
+1D000123#0B?? -> 1D000124#0B$1 +10ms 1D000124#0BFF
+1D000123#0C   -> 1D000124#0C00 | 1D000124#0C01
+123#R         -> 124#01
+`
+
+func mustFrame(t *testing.T, s string) can.Frame {
+	t.Helper()
+	fr, err := can.ParseFrame(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fr
+}
+
+func TestHandle(t *testing.T) {
+	e, err := Parse(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Len() != 4 {
+		t.Fatalf("rules = %d", e.Len())
+	}
+	out := make(chan can.Frame, 8)
+	emit := func(fr can.Frame) { out <- fr }
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case fr := <-out:
+			if fr.String() != want {
+				t.Fatalf("response %s, want %s", fr, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no response, want %s", want)
+		}
+	}
+
+	for _, q := range []string{"1D000123#0A0155", "1D000123#0B42", "1D000123#0C", "1D000123#0C", "1D000123#0C", "123#R"} {
+		fr := mustFrame(t, q)
+		if !e.Handle(&fr, emit) {
+			t.Fatalf("%s not handled", q)
+		}
+	}
+	expect("1D000124#0A0102FF") // query data is a prefix
+	expect("1D000124#0B42")     // $1 copies the query byte
+	expect("1D000124#0C00")     // alternatives cycle
+	expect("1D000124#0C01")
+	expect("1D000124#0C00")
+	expect("124#01")
+	expect("1D000124#0BFF") // delayed
+
+	for _, q := range []string{"1D000123#0A02", "1D000123#0B", "0D000123#0A01", "123#01"} {
+		fr := mustFrame(t, q)
+		if e.Handle(&fr, emit) {
+			t.Fatalf("%s handled", q)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, line := range []string{
+		"1D000123#0A",
+		"1D000123#0A -> ",
+		"1D000123#0A -> 1D000124#$9",
+		"1D000123#0A -> 1D000124#0A +x",
+		"1D000123#$1 -> 1D000124#0A",
+		"12345#00 -> 124#00",
+		"123#0 -> 124#00",
+	} {
+		if _, err := Parse(strings.NewReader(line)); err == nil {
+			t.Fatalf("%q: expected error", line)
+		}
+	}
+}
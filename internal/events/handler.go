@@ -0,0 +1,80 @@
+package events
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Handler is a slog.Handler that forwards every record to next and
+// additionally records records at or above min into a Ring.
+type Handler struct {
+	next   slog.Handler
+	ring   *Ring
+	min    slog.Level
+	attrs  []slog.Attr
+	groups string
+}
+
+// NewHandler wraps next, teeing records >= min into ring.
+func NewHandler(next slog.Handler, ring *Ring, min slog.Level) *Handler {
+	return &Handler{next: next, ring: ring, min: min}
+}
+
+// Enabled reports whether next handles the level.
+func (h *Handler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.next.Enabled(ctx, l)
+}
+
+// Handle records the event (when at or above min) and forwards it.
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= h.min {
+		e := Event{Time: r.Time, Level: r.Level.String(), Msg: r.Message}
+		if n := len(h.attrs) + r.NumAttrs(); n > 0 {
+			e.Attrs = make(map[string]any, n)
+			for _, a := range h.attrs { // keys already group-qualified
+				e.Attrs[a.Key] = attrValue(a.Value)
+			}
+			r.Attrs(func(a slog.Attr) bool {
+				e.Attrs[h.groups+a.Key] = attrValue(a.Value)
+				return true
+			})
+		}
+		h.ring.Add(e)
+	}
+	return h.next.Handle(ctx, r)
+}
+
+// WithAttrs returns a handler carrying extra attributes.
+func (h *Handler) WithAttrs(as []slog.Attr) slog.Handler {
+	c := *h
+	c.next = h.next.WithAttrs(as)
+	c.attrs = make([]slog.Attr, 0, len(h.attrs)+len(as))
+	c.attrs = append(c.attrs, h.attrs...)
+	for _, a := range as {
+		a.Key = h.groups + a.Key
+		c.attrs = append(c.attrs, a)
+	}
+	return &c
+}
+
+// WithGroup returns a handler nesting subsequent attributes under name.
+func (h *Handler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.next = h.next.WithGroup(name)
+	c.groups = h.groups + name + "."
+	return &c
+}
+
+// attrValue converts a slog value to something JSON-friendly; errors become strings.
+func attrValue(v slog.Value) any {
+	v = v.Resolve()
+	if v.Kind() == slog.KindAny {
+		if err, ok := v.Any().(error); ok {
+			return err.Error()
+		}
+	}
+	if v.Kind() == slog.KindDuration {
+		return v.Duration().String()
+	}
+	return v.Any()
+}
@@ -0,0 +1,109 @@
+// Package events keeps a bounded in-memory history of recent warn/error
+// events so operators can inspect what happened after an incident even when
+// the system journal has already rotated.
+package events
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultSize is the ring capacity used when a non-positive size is requested.
+const DefaultSize = 256
+
+// Event is a single recorded log record.
+type Event struct {
+	Time  time.Time      `json:"time"`
+	Level string         `json:"level"`
+	Msg   string         `json:"msg"`
+	Attrs map[string]any `json:"attrs,omitempty"`
+}
+
+// Ring is a fixed-size, concurrency-safe ring of events (oldest overwritten).
+type Ring struct {
+	mu    sync.Mutex
+	buf   []Event
+	next  int
+	full  bool
+	total uint64
+}
+
+// NewRing creates a ring holding up to size events.
+func NewRing(size int) *Ring {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	return &Ring{buf: make([]Event, size)}
+}
+
+// Add records an event, overwriting the oldest when full.
+func (r *Ring) Add(e Event) {
+	r.mu.Lock()
+	r.buf[r.next] = e
+	r.next++
+	if r.next == len(r.buf) {
+		r.next = 0
+		r.full = true
+	}
+	r.total++
+	r.mu.Unlock()
+}
+
+// Snapshot returns stored events ordered oldest first.
+func (r *Ring) Snapshot() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]Event(nil), r.buf[:r.next]...)
+	}
+	out := make([]Event, 0, len(r.buf))
+	out = append(out, r.buf[r.next:]...)
+	return append(out, r.buf[:r.next]...)
+}
+
+// Total returns the number of events ever added (including overwritten ones).
+func (r *Ring) Total() uint64 { r.mu.Lock(); defer r.mu.Unlock(); return r.total }
+
+// Handler serves the ring as JSON (newest last).
+//
+// Query parameters: limit=N keeps the N newest events; level=error keeps
+// only events at or above that level.
+func (r *Ring) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		evs := r.Snapshot()
+		if lv := req.URL.Query().Get("level"); lv != "" {
+			var min slog.Level
+			if err := min.UnmarshalText([]byte(lv)); err != nil {
+				http.Error(w, "invalid level", http.StatusBadRequest)
+				return
+			}
+			filtered := evs[:0]
+			for _, e := range evs {
+				var l slog.Level
+				if l.UnmarshalText([]byte(e.Level)) == nil && l >= min {
+					filtered = append(filtered, e)
+				}
+			}
+			evs = filtered
+		}
+		if ls := req.URL.Query().Get("limit"); ls != "" {
+			n, err := strconv.Atoi(ls)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			if n < len(evs) {
+				evs = evs[len(evs)-n:]
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Total  uint64  `json:"total"`
+			Events []Event `json:"events"`
+		}{Total: r.Total(), Events: evs})
+	})
+}
@@ -0,0 +1,61 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRingOverwritesOldest(t *testing.T) {
+	r := NewRing(3)
+	for _, m := range []string{"a", "b", "c", "d"} {
+		r.Add(Event{Msg: m})
+	}
+	got := r.Snapshot()
+	if len(got) != 3 || got[0].Msg != "b" || got[2].Msg != "d" {
+		t.Fatalf("unexpected snapshot %+v", got)
+	}
+	if r.Total() != 4 {
+		t.Fatalf("total got %d want 4", r.Total())
+	}
+}
+
+func TestHandlerTeesWarnings(t *testing.T) {
+	r := NewRing(8)
+	l := slog.New(NewHandler(slog.NewTextHandler(io.Discard, nil), r, slog.LevelWarn)).With("app", "x")
+	l.Info("ignored")
+	l.Warn("serial_read_error", "error", errors.New("boom"))
+	l.WithGroup("g").Error("fatal", "k", 1)
+	got := r.Snapshot()
+	if len(got) != 2 {
+		t.Fatalf("expected 2 events, got %+v", got)
+	}
+	if got[0].Msg != "serial_read_error" || got[0].Attrs["error"] != "boom" || got[0].Attrs["app"] != "x" {
+		t.Fatalf("unexpected first event %+v", got[0])
+	}
+	if _, ok := got[1].Attrs["g.k"]; !ok {
+		t.Fatalf("expected grouped attr, got %+v", got[1].Attrs)
+	}
+}
+
+func TestRingHTTPFilters(t *testing.T) {
+	r := NewRing(8)
+	r.Add(Event{Level: "WARN", Msg: "w1"})
+	r.Add(Event{Level: "ERROR", Msg: "e1"})
+	r.Add(Event{Level: "ERROR", Msg: "e2"})
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/events?level=error&limit=1", nil))
+	var body struct {
+		Total  uint64
+		Events []Event
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if body.Total != 3 || len(body.Events) != 1 || body.Events[0].Msg != "e2" {
+		t.Fatalf("unexpected body %+v", body)
+	}
+}
@@ -0,0 +1,62 @@
+package filter
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// maxChangeIDs bounds the IDs a Changes filter remembers.
+const maxChangeIDs = 4096
+
+// Changes passes a frame only when its length or payload differs from the
+// last frame passed with the same CAN ID (flag bits included), so a
+// consumer sees state changes instead of periodic repeats. It remembers
+// maxChangeIDs IDs; frames of further IDs always pass. The zero value is
+// ready to use and safe for concurrent use.
+type Changes struct {
+	mu   sync.Mutex
+	last map[uint32]can.Frame
+}
+
+// Allow reports whether fr differs from the last passed frame of its ID.
+func (c *Changes) Allow(fr *can.Frame) bool {
+	n := min(int(fr.Len), len(fr.Data))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev, ok := c.last[fr.CANID]
+	if ok && prev.Len == fr.Len && bytes.Equal(prev.Data[:n], fr.Data[:n]) {
+		return false
+	}
+	if !ok && len(c.last) >= maxChangeIDs {
+		return true
+	}
+	if c.last == nil {
+		c.last = make(map[uint32]can.Frame)
+	}
+	v := can.Frame{CANID: fr.CANID, Len: fr.Len}
+	copy(v.Data[:n], fr.Data[:n])
+	c.last[fr.CANID] = v
+	return true
+}
+
+// Frames returns the last passed frame of every remembered ID, in no
+// particular order.
+func (c *Changes) Frames() []can.Frame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]can.Frame, 0, len(c.last))
+	for _, fr := range c.last {
+		out = append(out, fr)
+	}
+	return out
+}
+
+// Restore remembers frames as the last passed ones of their IDs, for
+// example the Frames of a filter on another gateway.
+func (c *Changes) Restore(frames []can.Frame) {
+	for i := range frames {
+		c.Allow(&frames[i])
+	}
+}
@@ -0,0 +1,146 @@
+// Package filter implements CAN ID allow/deny lists used on the backend RX
+// and TX paths.
+//
+// A list is a comma separated set of entries, each one of:
+//
+//	0x123               single ID
+//	0x100-0x1FF         inclusive range
+//	0x18FF0000/0x1FFF0000  ID/mask (matches when id&mask == ID&mask)
+//
+// IDs are compared without the EFF/RTR/ERR flag bits. Deny entries win over
+// allow entries; an empty allow list allows everything not denied.
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// ErrDenied is returned by senders when a frame is rejected by a TX filter.
+var ErrDenied = errors.New("frame denied by filter")
+
+type rule struct {
+	lo, hi, mask uint32
+}
+
+func (r rule) match(id uint32) bool {
+	v := id & r.mask
+	return v >= r.lo && v <= r.hi
+}
+
+// Filter is an immutable allow/deny ID list. A nil *Filter allows everything.
+type Filter struct {
+	allow []rule
+	deny  []rule
+	spec  string
+}
+
+// New parses allow and deny lists. It returns nil (allow all) when both are empty.
+func New(allow, deny string) (*Filter, error) {
+	a, err := parseList(allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	d, err := parseList(deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	if len(a) == 0 && len(d) == 0 {
+		return nil, nil
+	}
+	return &Filter{allow: a, deny: d, spec: fmt.Sprintf("allow=%q deny=%q", allow, deny)}, nil
+}
+
+// Allow reports whether fr passes the filter.
+func (f *Filter) Allow(fr *can.Frame) bool {
+	if f == nil {
+		return true
+	}
+	id := fr.CANID & can.CAN_EFF_MASK
+	for _, r := range f.deny {
+		if r.match(id) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, r := range f.allow {
+		if r.match(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the source lists (for logs).
+func (f *Filter) String() string {
+	if f == nil {
+		return "none"
+	}
+	return f.spec
+}
+
+func parseList(s string) ([]rule, error) {
+	var out []rule
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		r, err := parseEntry(e)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func parseEntry(e string) (rule, error) {
+	if id, mask, ok := strings.Cut(e, "/"); ok {
+		i, err := parseID(id)
+		if err != nil {
+			return rule{}, err
+		}
+		m, err := parseID(mask)
+		if err != nil {
+			return rule{}, err
+		}
+		return rule{lo: i & m, hi: i & m, mask: m}, nil
+	}
+	if lo, hi, ok := strings.Cut(e, "-"); ok {
+		l, err := parseID(lo)
+		if err != nil {
+			return rule{}, err
+		}
+		h, err := parseID(hi)
+		if err != nil {
+			return rule{}, err
+		}
+		if l > h {
+			return rule{}, fmt.Errorf("empty range %q", e)
+		}
+		return rule{lo: l, hi: h, mask: can.CAN_EFF_MASK}, nil
+	}
+	i, err := parseID(e)
+	if err != nil {
+		return rule{}, err
+	}
+	return rule{lo: i, hi: i, mask: can.CAN_EFF_MASK}, nil
+}
+
+func parseID(s string) (uint32, error) {
+	v, err := strconv.ParseUint(strings.TrimSpace(s), 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid CAN ID %q", s)
+	}
+	if v > can.CAN_EFF_MASK {
+		return 0, fmt.Errorf("CAN ID %q exceeds 29 bits", s)
+	}
+	return uint32(v), nil
+}
@@ -0,0 +1,89 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestFilterAllow(t *testing.T) {
+	f, err := New("0x100-0x1FF, 0x18FF0000/0x1FFF0000, 0x7FF", "0x150")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[uint32]bool{
+		0x100:                         true,
+		0x1FF:                         true,
+		0x150:                         false, // denied
+		0x200:                         false, // not allowed
+		0x7FF:                         true,
+		0x18FF1234 | can.CAN_EFF_FLAG: true,
+		0x18FE1234 | can.CAN_EFF_FLAG: false,
+		0x123 | can.CAN_RTR_FLAG:      true,
+	} {
+		fr := can.Frame{CANID: id}
+		if got := f.Allow(&fr); got != want {
+			t.Fatalf("id 0x%X: got %v want %v", id, got, want)
+		}
+	}
+}
+
+func TestFilterDenyOnly(t *testing.T) {
+	f, err := New("", "0x10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Allow(&can.Frame{CANID: 0x11}) || f.Allow(&can.Frame{CANID: 0x10}) {
+		t.Fatal("deny-only filter mismatch")
+	}
+}
+
+func TestFilterNil(t *testing.T) {
+	f, err := New(" ", "")
+	if err != nil || f != nil {
+		t.Fatalf("expected nil filter, got %v %v", f, err)
+	}
+	if !f.Allow(&can.Frame{CANID: 1}) {
+		t.Fatal("nil filter must allow")
+	}
+}
+
+func TestFilterParseErrors(t *testing.T) {
+	for _, s := range []string{"zz", "0x200-0x100", "0x1-", "0x1/", "0x3FFFFFFF"} {
+		if _, err := New(s, ""); err == nil {
+			t.Fatalf("%q: expected error", s)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	var c Changes
+	a := can.Frame{CANID: 0x100, Len: 2, Data: [64]byte{1, 2}}
+	b := can.Frame{CANID: 0x100, Len: 2, Data: [64]byte{1, 3}}
+	other := can.Frame{CANID: 0x101, Len: 2, Data: [64]byte{1, 2}}
+	for i, tc := range []struct {
+		fr   can.Frame
+		want bool
+	}{{a, true}, {a, false}, {other, true}, {b, true}, {b, false}, {a, true}} {
+		if got := c.Allow(&tc.fr); got != tc.want {
+			t.Errorf("step %d: Allow(%v) = %v want %v", i, tc.fr, got, tc.want)
+		}
+	}
+}
+
+func TestChangesRestore(t *testing.T) {
+	var src Changes
+	a := can.Frame{CANID: 0x100, Len: 2, Data: [64]byte{1, 2}}
+	b := can.Frame{CANID: 0x200 | can.CAN_EFF_FLAG, Len: 1, Data: [64]byte{7}}
+	src.Allow(&a)
+	src.Allow(&b)
+	var dst Changes
+	dst.Restore(src.Frames())
+	if dst.Allow(&a) || dst.Allow(&b) {
+		t.Fatal("restored frames passed again")
+	}
+	a.Data[1] = 3
+	if !dst.Allow(&a) {
+		t.Fatal("changed frame withheld")
+	}
+}
@@ -0,0 +1,137 @@
+// Package heartbeat sends a fixed gateway heartbeat frame at a fixed
+// interval, on the bus and/or to the TCP clients, so other systems can tell
+// the gateway is alive from the traffic alone. With a counter the last data
+// byte counts the beats, so a receiver also notices a stuck sender repeating
+// one frame.
+package heartbeat
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// MinInterval is the shortest accepted interval; heartbeats must not crowd
+// out real traffic.
+const MinInterval = 10 * time.Millisecond
+
+// Target selects where heartbeats go.
+type Target uint8
+
+const (
+	Bus     Target = 1 << iota // transmitted on the CAN bus
+	Clients                    // broadcast to the TCP clients
+	Both    = Bus | Clients
+)
+
+// ParseTarget parses bus, clients or both.
+func ParseTarget(s string) (Target, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "bus":
+		return Bus, nil
+	case "clients":
+		return Clients, nil
+	case "both":
+		return Both, nil
+	}
+	return 0, fmt.Errorf("unknown target %q (use bus|clients|both)", s)
+}
+
+func (t Target) String() string {
+	switch t {
+	case Bus:
+		return "bus"
+	case Clients:
+		return "clients"
+	}
+	return "both"
+}
+
+// Config configures a Sender.
+type Config struct {
+	Frame    can.Frame
+	Interval time.Duration
+	Counter  bool // count beats in the last data byte
+	Target   Target
+	// Bus transmits a frame on the bus; required for the Bus target.
+	Bus func(can.Frame) error
+	// Clients hands a frame to the TCP clients; required for the Clients
+	// target.
+	Clients func(can.Frame)
+	Logger  *slog.Logger
+}
+
+// Check validates the frame and interval of c.
+func (c Config) Check() error {
+	if c.Interval < MinInterval {
+		return fmt.Errorf("interval must be >= %v", MinInterval)
+	}
+	if c.Frame.CANID&can.CAN_ERR_FLAG != 0 {
+		return fmt.Errorf("frame %s: error frames cannot be sent", c.Frame)
+	}
+	if c.Counter && (c.Frame.Len == 0 || c.Frame.CANID&can.CAN_RTR_FLAG != 0) {
+		return fmt.Errorf("frame %s: the counter needs a data byte", c.Frame)
+	}
+	return nil
+}
+
+// Sender sends the heartbeats of one bus.
+type Sender struct {
+	cfg Config
+	seq uint8
+}
+
+// New returns a Sender for cfg, which must pass Check.
+func New(cfg Config) *Sender {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return &Sender{cfg: cfg}
+}
+
+// Run sends a heartbeat every interval until ctx is cancelled, the first
+// one at once.
+func (s *Sender) Run(ctx context.Context) {
+	t := time.NewTicker(s.cfg.Interval)
+	defer t.Stop()
+	for {
+		s.beat()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// next returns the frame of the next beat.
+func (s *Sender) next() can.Frame {
+	fr := s.cfg.Frame
+	if s.cfg.Counter {
+		fr.Data[fr.Len-1] = s.seq
+		s.seq++
+	}
+	return fr
+}
+
+func (s *Sender) beat() {
+	fr := s.next()
+	if s.cfg.Target&Bus != 0 {
+		if err := s.cfg.Bus(fr); err != nil {
+			// Inhibit windows and standby reject heartbeats on purpose.
+			metrics.IncHeartbeatDropped()
+			s.cfg.Logger.Debug("heartbeat_dropped", "frame", fr.String(), "error", err)
+		} else {
+			metrics.IncHeartbeat(metrics.HeartbeatBus)
+		}
+	}
+	if s.cfg.Target&Clients != 0 {
+		s.cfg.Clients(fr)
+		metrics.IncHeartbeat(metrics.HeartbeatClients)
+	}
+}
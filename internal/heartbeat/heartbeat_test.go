@@ -0,0 +1,95 @@
+package heartbeat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestSenderTargetsAndCounter(t *testing.T) {
+	fr, _ := can.ParseFrame("7FE#AA00")
+	var (
+		mu        sync.Mutex
+		bus, cl   []can.Frame
+		rejectBus bool
+	)
+	s := New(Config{
+		Frame: fr, Interval: time.Second, Counter: true, Target: Both,
+		Bus: func(f can.Frame) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if rejectBus {
+				return errors.New("inhibited")
+			}
+			bus = append(bus, f)
+			return nil
+		},
+		Clients: func(f can.Frame) { mu.Lock(); cl = append(cl, f); mu.Unlock() },
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	s.beat()
+	s.beat()
+	rejectBus = true
+	s.beat()
+	if len(bus) != 2 || len(cl) != 3 {
+		t.Fatalf("bus %d clients %d, want 2 and 3", len(bus), len(cl))
+	}
+	for i, f := range cl {
+		if f.Data[0] != 0xAA || f.Data[1] != byte(i) || f.Len != 2 {
+			t.Fatalf("beat %d: %s", i, f)
+		}
+	}
+}
+
+func TestSenderRun(t *testing.T) {
+	fr, _ := can.ParseFrame("7FE#01")
+	got := make(chan can.Frame, 8)
+	s := New(Config{Frame: fr, Interval: MinInterval, Target: Bus,
+		Bus: func(f can.Frame) error { got <- f; return nil }})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { s.Run(ctx); close(done) }()
+	for range 2 {
+		select {
+		case f := <-got:
+			if f != fr {
+				t.Fatalf("sent %s, want %s", f, fr)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no heartbeat")
+		}
+	}
+	cancel()
+	<-done
+}
+
+func TestConfigCheck(t *testing.T) {
+	data, _ := can.ParseFrame("7FE#01")
+	rtr, _ := can.ParseFrame("7FE#R")
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"ok", Config{Frame: data, Interval: time.Second, Counter: true}, true},
+		{"shortInterval", Config{Frame: data, Interval: time.Millisecond}, false},
+		{"counterRTR", Config{Frame: rtr, Interval: time.Second, Counter: true}, false},
+		{"rtr", Config{Frame: rtr, Interval: time.Second}, true},
+	} {
+		if err := tc.cfg.Check(); (err == nil) != tc.ok {
+			t.Errorf("%s: err=%v", tc.name, err)
+		}
+	}
+	if _, err := ParseTarget("up"); err == nil {
+		t.Error("unknown target accepted")
+	}
+	if tg, err := ParseTarget("Both"); err != nil || tg != Both {
+		t.Errorf("both: %v %v", tg, err)
+	}
+}
@@ -1,24 +1,109 @@
 package hub
 
 import (
+	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/kstaniek/go-ampio-server/internal/can"
 	"github.com/kstaniek/go-ampio-server/internal/logging"
+	"github.com/kstaniek/go-ampio-server/internal/memguard"
 	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/validate"
 )
 
 type BackpressurePolicy int
 
 const (
-	PolicyDrop BackpressurePolicy = iota
-	PolicyKick
+	PolicyDrop       BackpressurePolicy = iota // drop frames a slow client has no room for
+	PolicyKick                                 // disconnect a client whose queue is full
+	PolicyDropOldest                           // discard the oldest queued frame to make room
+	PolicyCoalesce                             // keep only the latest waiting frame per CAN ID
 )
 
+// DefaultOutBufSize is the per-client queue length used when no valid
+// WithOutBufSize option is given.
+const DefaultOutBufSize = 512
+
+func (p BackpressurePolicy) String() string {
+	switch p {
+	case PolicyDrop:
+		return "drop"
+	case PolicyKick:
+		return "kick"
+	case PolicyDropOldest:
+		return "drop-oldest"
+	case PolicyCoalesce:
+		return "coalesce"
+	}
+	return fmt.Sprintf("policy(%d)", int(p))
+}
+
+func (p BackpressurePolicy) valid() bool { return p >= PolicyDrop && p <= PolicyCoalesce }
+
+// ParsePolicy converts "drop", "kick", "drop-oldest" or "coalesce" to a
+// policy.
+func ParsePolicy(s string) (BackpressurePolicy, error) {
+	for p := PolicyDrop; p <= PolicyCoalesce; p++ {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return PolicyDrop, fmt.Errorf("unknown backpressure policy %q (want drop|kick|drop-oldest|coalesce)", s)
+}
+
 type Client struct {
 	Out       chan can.Frame
 	Closed    chan struct{}
 	closeOnce sync.Once
+	seq       uint64 // assigned by Add; picks the worker shard
+	queue     queue  // set by Add from the hub policy
+	filter    atomic.Pointer[func(*can.Frame) bool]
+	errFrames atomic.Bool
+	fd        atomic.Bool
+}
+
+// SetFilter makes the hub deliver to c only the frames f accepts (nil: all
+// frames). Frames written to Out directly bypass it.
+func (c *Client) SetFilter(f func(*can.Frame) bool) {
+	if f == nil {
+		c.filter.Store(nil)
+		return
+	}
+	c.filter.Store(&f)
+}
+
+// SetErrorFrames makes the hub deliver error frames (CAN_ERR_FLAG) to c.
+// Clients get none by default: most cannot tell them from data frames.
+func (c *Client) SetErrorFrames(on bool) { c.errFrames.Store(on) }
+
+// ErrorFrames reports whether c receives error frames.
+func (c *Client) ErrorFrames() bool { return c.errFrames.Load() }
+
+// SetFD makes the hub deliver CAN FD frames to c. Clients get none by
+// default: a legacy stream has no encoding for them.
+func (c *Client) SetFD(on bool) { c.fd.Store(on) }
+
+// FD reports whether c receives CAN FD frames.
+func (c *Client) FD() bool { return c.fd.Load() }
+
+// Wants reports whether c takes fr: its filter accepts it, and it is no
+// error or CAN FD frame unless c opted in.
+func (c *Client) Wants(fr *can.Frame) bool {
+	if !c.optedIn(fr) {
+		return false
+	}
+	f := c.filter.Load()
+	return f == nil || (*f)(fr)
+}
+
+// optedIn reports whether fr is no frame kind c must opt in to (error and
+// CAN FD frames), or c did.
+func (c *Client) optedIn(fr *can.Frame) bool {
+	if fr.CANID&can.CAN_ERR_FLAG != 0 && !c.errFrames.Load() {
+		return false
+	}
+	return !fr.IsFD() || c.fd.Load()
 }
 
 // Close signals the client is closed (idempotent).
@@ -28,34 +113,146 @@ func (c *Client) Close() {
 	})
 }
 
+func (c *Client) q() queue {
+	if c.queue == nil {
+		return chanQueue{c.Out}
+	}
+	return c.queue
+}
+
+// QueueLen returns the frames waiting for the client.
+func (c *Client) QueueLen() int { return c.q().len() }
+
+// QueueCap returns how many frames the client queue holds.
+func (c *Client) QueueCap() int { return c.q().cap() }
+
+// Drain removes and returns the frames waiting for the client, oldest
+// first (e.g. to replay them after Remove).
+func (c *Client) Drain() []can.Frame { return c.q().drain() }
+
 type Hub struct {
 	mu         sync.RWMutex
 	clients    map[*Client]struct{}
-	OutBufSize int
-	Policy     BackpressurePolicy
+	view       atomic.Pointer[[]*Client]   // immutable copy of clients, rebuilt on Add/Remove
+	shards     atomic.Pointer[[][]*Client] // view split per worker (worker mode only)
+	pool       atomic.Pointer[workerPool]
+	seq        uint64       // guarded by mu
+	fanout     atomic.Int64 // clients targeted by the most recent broadcast
+	outBufSize atomic.Int64
+	policy     atomic.Int32
+	// Rewrite, when set, may modify backend frames in place before Filter
+	// (backend RX payload transforms). Must be set before the first Broadcast.
+	Rewrite func(*can.Frame)
+	// Filter, when set, drops backend frames it rejects before fan-out
+	// (backend RX filter). Must be set before the first Broadcast.
+	Filter func(*can.Frame) bool
+	// Tap, when set, observes every frame that passes Filter before fan-out
+	// (e.g. the capture ring). Must be cheap and must not block. Must be set
+	// before the first Broadcast.
+	Tap func(can.Frame)
+	// Per-hub counters (process-wide totals live in metrics).
+	frames atomic.Uint64
+	drops  atomic.Uint64
+	kicks  atomic.Uint64
+	denied atomic.Uint64
+}
+
+// Stats is a snapshot of per-hub counters.
+type Stats struct {
+	Frames  uint64 // frames broadcast
+	Drops   uint64 // frames dropped for slow clients
+	Kicks   uint64 // clients closed by the kick policy
+	Denied  uint64 // frames rejected by Filter
+	Clients int
+}
+
+// Option configures a Hub at construction.
+type Option func(*Hub) error
+
+// WithOutBufSize sets the queue length of clients created for the hub
+// (server connections, bridges). It must be > 0.
+func WithOutBufSize(n int) Option {
+	return func(h *Hub) error { return h.SetOutBufSize(n) }
 }
 
-// New creates a Hub with default settings.
-func New() *Hub { return &Hub{clients: make(map[*Client]struct{})} }
+// WithPolicy sets the backpressure policy.
+func WithPolicy(p BackpressurePolicy) Option {
+	return func(h *Hub) error { return h.SetPolicy(p) }
+}
+
+// New creates a Hub that drops frames for slow clients and sizes client
+// queues with DefaultOutBufSize.
+func New() *Hub {
+	h := &Hub{clients: make(map[*Client]struct{})}
+	h.outBufSize.Store(DefaultOutBufSize)
+	return h
+}
+
+// NewWithOptions creates a Hub configured by opts. It fails on the first
+// option with an invalid value.
+func NewWithOptions(opts ...Option) (*Hub, error) {
+	h := New()
+	for _, o := range opts {
+		if err := o(h); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// OutBufSize returns the queue length for new clients.
+func (h *Hub) OutBufSize() int { return int(h.outBufSize.Load()) }
+
+// Policy returns the current backpressure policy.
+func (h *Hub) Policy() BackpressurePolicy { return BackpressurePolicy(h.policy.Load()) }
+
+// SetPolicy changes the backpressure policy while the hub is running.
+// Switching between drop and kick applies from the next delivered frame;
+// the queue kind (drop-oldest, coalesce) of a client is chosen when it is
+// added, so those apply to clients added from now on.
+func (h *Hub) SetPolicy(p BackpressurePolicy) error {
+	if !p.valid() {
+		return fmt.Errorf("unknown backpressure policy %d", int(p))
+	}
+	h.policy.Store(int32(p))
+	return nil
+}
+
+// SetOutBufSize changes the queue length of clients added from now on;
+// connected clients keep their queues.
+func (h *Hub) SetOutBufSize(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("client buffer must be > 0 (got %d)", n)
+	}
+	h.outBufSize.Store(int64(n))
+	return nil
+}
 
 // Add registers a client with the hub.
 func (h *Hub) Add(c *Client) {
 	h.mu.Lock()
 	prev := len(h.clients)
+	h.seq++
+	c.seq = h.seq
+	if c.queue == nil {
+		c.queue = newQueue(h.Policy(), c)
+	}
 	h.clients[c] = struct{}{}
 	cur := len(h.clients)
+	h.rebuildLocked()
 	h.mu.Unlock()
 	if prev == 0 && cur == 1 {
 		logging.L().Info("clients_first_connected")
 	}
 }
 
-// Remove unregisters a client and updates metrics; safe to call multiple times.
+// Remove unregisters a client; safe to call multiple times.
 func (h *Hub) Remove(c *Client) {
 	h.mu.Lock()
 	_, existed := h.clients[c]
 	if existed {
 		delete(h.clients, c)
+		h.rebuildLocked()
 	}
 	cur := len(h.clients)
 	h.mu.Unlock()
@@ -64,42 +261,73 @@ func (h *Hub) Remove(c *Client) {
 	default:
 		c.Close()
 	}
-	metrics.SetHubClients(cur)
 	if existed && cur == 0 {
 		logging.L().Info("clients_last_disconnected")
 	}
 }
 
-// Broadcast sends a frame to all connected clients honoring the backpressure policy.
+// Broadcast sends a frame to all connected clients honoring the backpressure
+// policy. Frames failing validation (see package validate) are not sent.
 func (h *Hub) Broadcast(fr can.Frame) {
-	// Reuse Snapshot to avoid duplicating slice copy logic.
-	clients := h.Snapshot()
-	metrics.SetBroadcastFanout(len(clients))
-	metrics.SetHubClients(len(clients))
-	// queue depth sampling
-	if len(clients) > 0 {
-		max := 0
-		sum := 0
-		for _, c := range clients {
-			l := len(c.Out)
-			if l > max {
-				max = l
-			}
-			sum += l
-		}
-		metrics.SetQueueDepth(max, sum/len(clients))
+	if validate.Frame(validate.RX, &fr) != nil {
+		return
+	}
+	if h.Rewrite != nil {
+		h.Rewrite(&fr)
+	}
+	if h.Filter != nil && !h.Filter(&fr) {
+		h.denied.Add(1)
+		metrics.IncFiltered(metrics.FilterRX)
+		return
+	}
+	if h.Tap != nil {
+		h.Tap(fr)
+	}
+	// Read the prebuilt client view: no lock, no allocation. Gauges are
+	// updated by the background sampler (RunSampler), not per frame.
+	var clients []*Client
+	if v := h.view.Load(); v != nil {
+		clients = *v
+	}
+	h.frames.Add(1)
+	h.fanout.Store(int64(len(clients)))
+	if p := h.pool.Load(); p != nil {
+		p.dispatch(fr)
+		return
 	}
 	for _, c := range clients {
-		select {
-		case c.Out <- fr:
-		default:
-			if h.Policy == PolicyKick {
-				metrics.IncHubKick()
-				c.Close() // signal writer to exit; server will Remove on disconnect
-			} else {
-				metrics.IncHubDrop()
-			}
+		h.deliver(c, fr)
+	}
+}
+
+// deliver queues fr for c honoring the backpressure policy.
+func (h *Hub) deliver(c *Client, fr can.Frame) {
+	if !c.optedIn(&fr) {
+		return // not opted in; not a filter decision
+	}
+	if !c.Wants(&fr) {
+		metrics.IncClientFiltered()
+		return
+	}
+	q := c.q()
+	if memguard.Shed(q.len(), q.cap()) {
+		h.drops.Add(1)
+		metrics.IncHubDrop()
+		return
+	}
+	switch q.push(fr) {
+	case queued:
+	case full:
+		if h.Policy() == PolicyKick {
+			h.kicks.Add(1)
+			metrics.IncHubKick()
+			c.Close() // signal writer to exit; server will Remove on disconnect
+			return
 		}
+		fallthrough
+	case replaced: // a frame was lost either way
+		h.drops.Add(1)
+		metrics.IncHubDrop()
 	}
 }
 
@@ -114,5 +342,27 @@ func (h *Hub) Snapshot() []*Client {
 	return clients
 }
 
+// rebuildLocked refreshes the broadcast view; h.mu must be held for writing.
+func (h *Hub) rebuildLocked() {
+	v := make([]*Client, 0, len(h.clients))
+	for c := range h.clients {
+		v = append(v, c)
+	}
+	h.view.Store(&v)
+	if p := h.pool.Load(); p != nil {
+		shards := make([][]*Client, len(p.in))
+		for _, c := range v {
+			i := c.seq % uint64(len(shards))
+			shards[i] = append(shards[i], c)
+		}
+		h.shards.Store(&shards)
+	}
+}
+
 // Count returns the number of active clients.
 func (h *Hub) Count() int { h.mu.RLock(); n := len(h.clients); h.mu.RUnlock(); return n }
+
+// Stats returns per-hub counters.
+func (h *Hub) Stats() Stats {
+	return Stats{Frames: h.frames.Load(), Drops: h.drops.Load(), Kicks: h.kicks.Load(), Denied: h.denied.Load(), Clients: h.Count()}
+}
@@ -69,3 +69,121 @@ loop:
 		t.Fatalf("fast client did not receive any frames while slow was backpressured")
 	}
 }
+
+func TestHub_Stats(t *testing.T) {
+	h := New()
+	cl := &Client{Out: make(chan can.Frame, 1), Closed: make(chan struct{})}
+	h.Add(cl)
+	defer h.Remove(cl)
+	for i := 0; i < 3; i++ {
+		h.Broadcast(can.Frame{CANID: 0x10})
+	}
+	st := h.Stats()
+	if st.Frames != 3 || st.Drops != 2 || st.Kicks != 0 || st.Clients != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestHub_ErrorFramesOptIn(t *testing.T) {
+	h := New()
+	plain := &Client{Out: make(chan can.Frame, 4), Closed: make(chan struct{})}
+	errs := &Client{Out: make(chan can.Frame, 4), Closed: make(chan struct{})}
+	errs.SetErrorFrames(true)
+	h.Add(plain)
+	h.Add(errs)
+	h.Broadcast(can.Frame{CANID: can.CAN_ERR_FLAG | can.CAN_ERR_BUSOFF, Len: 8})
+	h.Broadcast(can.Frame{CANID: 0x10})
+	if len(plain.Out) != 1 || len(errs.Out) != 2 {
+		t.Fatalf("queued plain=%d errs=%d, want 1 and 2", len(plain.Out), len(errs.Out))
+	}
+	if fr := <-plain.Out; fr.CANID != 0x10 {
+		t.Fatalf("plain client got %+v", fr)
+	}
+}
+
+func TestHub_FDOptIn(t *testing.T) {
+	h := New()
+	plain := &Client{Out: make(chan can.Frame, 4), Closed: make(chan struct{})}
+	fd := &Client{Out: make(chan can.Frame, 4), Closed: make(chan struct{})}
+	fd.SetFD(true)
+	h.Add(plain)
+	h.Add(fd)
+	h.Broadcast(can.Frame{CANID: 0x10, Len: 12, Flags: can.CANFD_FDF})
+	h.Broadcast(can.Frame{CANID: 0x11})
+	if len(plain.Out) != 1 || len(fd.Out) != 2 {
+		t.Fatalf("queued plain=%d fd=%d, want 1 and 2", len(plain.Out), len(fd.Out))
+	}
+	if fr := <-plain.Out; fr.CANID != 0x11 {
+		t.Fatalf("plain client got %+v", fr)
+	}
+}
+
+func TestHub_Sample(t *testing.T) {
+	h := New()
+	a := &Client{Out: make(chan can.Frame, 8), Closed: make(chan struct{})}
+	b := &Client{Out: make(chan can.Frame, 8), Closed: make(chan struct{})}
+	h.Add(a)
+	h.Add(b)
+	for i := 0; i < 3; i++ {
+		h.Broadcast(can.Frame{CANID: 0x10})
+	}
+	<-a.Out // a drained one frame
+	s := h.Sample()
+	if s.Clients != 2 || s.Fanout != 2 || s.QueueMax != 3 || s.QueueSum != 5 {
+		t.Fatalf("unexpected sample: %+v", s)
+	}
+	h.Remove(a)
+	if s := h.Sample(); s.Clients != 1 {
+		t.Fatalf("expected 1 client after remove, got %+v", s)
+	}
+}
+
+func TestHub_Options(t *testing.T) {
+	h := New()
+	if h.OutBufSize() != DefaultOutBufSize || h.Policy() != PolicyDrop {
+		t.Fatalf("defaults: buffer=%d policy=%s", h.OutBufSize(), h.Policy())
+	}
+	if _, err := NewWithOptions(WithOutBufSize(0)); err == nil {
+		t.Fatal("WithOutBufSize(0) accepted")
+	}
+	if _, err := NewWithOptions(WithPolicy(BackpressurePolicy(7))); err == nil {
+		t.Fatal("WithPolicy(7) accepted")
+	}
+	h, err := NewWithOptions(WithOutBufSize(16), WithPolicy(PolicyKick))
+	if err != nil || h.OutBufSize() != 16 || h.Policy() != PolicyKick {
+		t.Fatalf("options: err=%v buffer=%d policy=%s", err, h.OutBufSize(), h.Policy())
+	}
+	if err := h.SetOutBufSize(-1); err == nil {
+		t.Fatal("SetOutBufSize(-1) accepted")
+	}
+	if err := h.SetPolicy(BackpressurePolicy(7)); err == nil || h.Policy() != PolicyKick {
+		t.Fatalf("SetPolicy(7): err=%v policy=%s", err, h.Policy())
+	}
+	if p, err := ParsePolicy("kick"); err != nil || p != PolicyKick {
+		t.Fatalf("ParsePolicy(kick)=%v,%v", p, err)
+	}
+	if _, err := ParsePolicy("block"); err == nil {
+		t.Fatal("ParsePolicy(block) accepted")
+	}
+}
+
+func TestHub_SetPolicyWhileRunning(t *testing.T) {
+	h := New()
+	cl := &Client{Out: make(chan can.Frame, 1), Closed: make(chan struct{})}
+	h.Add(cl)
+	defer h.Remove(cl)
+	h.Broadcast(can.Frame{CANID: 0x10})
+	h.Broadcast(can.Frame{CANID: 0x10}) // dropped
+	if err := h.SetPolicy(PolicyKick); err != nil {
+		t.Fatal(err)
+	}
+	h.Broadcast(can.Frame{CANID: 0x10}) // kicks
+	select {
+	case <-cl.Closed:
+	default:
+		t.Fatal("client not kicked after switching to kick")
+	}
+	if st := h.Stats(); st.Drops != 1 || st.Kicks != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
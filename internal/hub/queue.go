@@ -0,0 +1,222 @@
+package hub
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+)
+
+// pushResult is the outcome of queue.push.
+type pushResult int
+
+const (
+	queued   pushResult = iota
+	full                // not queued; the hub drops the frame or kicks the client
+	replaced            // queued after discarding an older frame
+)
+
+// queue holds the frames waiting for one client in front of its Out
+// channel and decides what happens when the client falls behind. Each
+// backpressure policy has its own queue; Broadcast only acts on the result.
+// push must not block and is called by one goroutine at a time (the
+// broadcaster or the client's fan-out worker).
+type queue interface {
+	push(fr can.Frame) pushResult
+	len() int // frames waiting, including those in Out
+	cap() int
+	// drain removes and returns the waiting frames, oldest first.
+	drain() []can.Frame
+}
+
+// newQueue builds the queue of policy p for c.
+func newQueue(p BackpressurePolicy, c *Client) queue {
+	switch p {
+	case PolicyDropOldest:
+		return ringQueue{chanQueue{c.Out}, c.Closed}
+	case PolicyCoalesce:
+		return newCoalesceQueue(c.Out, c.Closed)
+	}
+	return chanQueue{c.Out}
+}
+
+// chanQueue is the client's Out channel itself: a frame that does not fit
+// is refused (drop and kick policies).
+type chanQueue struct{ out chan can.Frame }
+
+func (q chanQueue) push(fr can.Frame) pushResult {
+	select {
+	case q.out <- fr:
+		return queued
+	default:
+		return full
+	}
+}
+
+func (q chanQueue) len() int { return len(q.out) }
+func (q chanQueue) cap() int { return cap(q.out) }
+
+func (q chanQueue) drain() []can.Frame {
+	var out []can.Frame
+	for {
+		select {
+		case fr := <-q.out:
+			out = append(out, fr)
+		default:
+			return out
+		}
+	}
+}
+
+// ringQueue uses Out as a ring: when it is full the oldest frame makes room
+// for the new one, so a slow client sees the most recent traffic. Control
+// messages the server queued to Out (acks, answers) are never evicted.
+type ringQueue struct {
+	chanQueue
+	closed <-chan struct{}
+}
+
+func (q ringQueue) push(fr can.Frame) pushResult {
+	if q.chanQueue.push(fr) == queued {
+		return queued
+	}
+	select {
+	case old := <-q.out:
+		if cnl.IsControl(&old) {
+			return q.evict(old, fr)
+		}
+	default: // the client drained the queue meanwhile
+	}
+	if q.chanQueue.push(fr) == queued {
+		return replaced
+	}
+	return full // unbuffered Out or a concurrent control message took the slot
+}
+
+// evict makes room for fr when the oldest frame, head, is a control
+// message: it takes the waiting frames out, drops the oldest broadcast
+// frame and puts the rest back in order. With only control messages
+// waiting fr is refused.
+func (q ringQueue) evict(head, fr can.Frame) pushResult {
+	waiting := append([]can.Frame{head}, q.drain()...)
+	i := slices.IndexFunc(waiting, func(w can.Frame) bool { return !cnl.IsControl(&w) })
+	res := full
+	if i >= 0 {
+		waiting = append(slices.Delete(waiting, i, i+1), fr)
+		res = replaced
+	}
+	for _, w := range waiting {
+		if q.chanQueue.push(w) == queued {
+			continue
+		}
+		if !cnl.IsControl(&w) {
+			return full // a concurrent control message took the slot
+		}
+		select { // the writer is draining Out; a control message waits for it
+		case q.out <- w:
+		case <-q.closed:
+			return full
+		}
+	}
+	return res
+}
+
+// coalesceQueue keeps at most one waiting frame per CAN ID: a newer frame
+// overwrites the waiting one in place, so a slow client gets the latest
+// value of every ID instead of a stale backlog. Frames move to Out in
+// arrival order of their IDs, by a goroutine that ends when the client is
+// closed.
+type coalesceQueue struct {
+	out    chan can.Frame
+	closed <-chan struct{}
+	wake   chan struct{}
+
+	mu       sync.Mutex
+	order    []uint32 // IDs waiting, oldest first
+	pending  map[uint32]can.Frame
+	inflight bool // the mover holds a frame it has not handed to Out yet
+}
+
+func newCoalesceQueue(out chan can.Frame, closed <-chan struct{}) *coalesceQueue {
+	q := &coalesceQueue{out: out, closed: closed, wake: make(chan struct{}, 1), pending: make(map[uint32]can.Frame)}
+	go q.run()
+	return q
+}
+
+func (q *coalesceQueue) push(fr can.Frame) pushResult {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.order) == 0 && !q.inflight {
+		select {
+		case q.out <- fr:
+			return queued
+		default:
+		}
+	}
+	if _, ok := q.pending[fr.CANID]; ok {
+		q.pending[fr.CANID] = fr
+		return replaced
+	}
+	if len(q.order) >= max(cap(q.out), 1) {
+		return full
+	}
+	q.order = append(q.order, fr.CANID)
+	q.pending[fr.CANID] = fr
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return queued
+}
+
+func (q *coalesceQueue) run() {
+	for {
+		select {
+		case <-q.wake:
+		case <-q.closed:
+			return
+		}
+		for {
+			q.mu.Lock()
+			if len(q.order) == 0 {
+				q.mu.Unlock()
+				break
+			}
+			id := q.order[0]
+			fr := q.pending[id]
+			q.order = q.order[1:]
+			delete(q.pending, id)
+			q.inflight = true
+			q.mu.Unlock()
+			select {
+			case q.out <- fr:
+			case <-q.closed:
+				return
+			}
+			q.mu.Lock()
+			q.inflight = false
+			q.mu.Unlock()
+		}
+	}
+}
+
+func (q *coalesceQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.out) + len(q.order)
+}
+
+func (q *coalesceQueue) cap() int { return cap(q.out) + max(cap(q.out), 1) }
+
+func (q *coalesceQueue) drain() []can.Frame {
+	out := chanQueue{q.out}.drain()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, id := range q.order {
+		out = append(out, q.pending[id])
+	}
+	q.order = q.order[:0]
+	clear(q.pending)
+	return out
+}
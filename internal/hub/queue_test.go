@@ -0,0 +1,120 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+)
+
+func TestHub_DropOldestKeepsNewest(t *testing.T) {
+	h, _ := NewWithOptions(WithPolicy(PolicyDropOldest))
+	cl := &Client{Out: make(chan can.Frame, 3), Closed: make(chan struct{})}
+	h.Add(cl)
+	defer h.Remove(cl)
+	for i := 0; i < 5; i++ {
+		h.Broadcast(can.Frame{CANID: 0x100 + uint32(i)})
+	}
+	got := cl.Drain()
+	if len(got) != 3 || got[0].CANID != 0x102 || got[2].CANID != 0x104 {
+		t.Fatalf("unexpected queue: %+v", got)
+	}
+	if st := h.Stats(); st.Drops != 2 || st.Kicks != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestHub_DropOldestKeepsControl(t *testing.T) {
+	h, _ := NewWithOptions(WithPolicy(PolicyDropOldest))
+	cl := &Client{Out: make(chan can.Frame, 3), Closed: make(chan struct{})}
+	h.Add(cl)
+	defer h.Remove(cl)
+	ack := cnl.ControlFrame(cnl.OpTxAck, 1)
+	cl.Out <- ack // queued by the server ahead of broadcasts
+	for i := 0; i < 4; i++ {
+		h.Broadcast(can.Frame{CANID: 0x100 + uint32(i)})
+	}
+	got := cl.Drain()
+	if len(got) != 3 || got[0] != ack || got[1].CANID != 0x102 || got[2].CANID != 0x103 {
+		t.Fatalf("unexpected queue: %+v", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		cl.Out <- ack
+	}
+	h.Broadcast(can.Frame{CANID: 0x200})
+	if got := cl.Drain(); len(got) != 3 || got[0] != ack || got[2] != ack {
+		t.Fatalf("control messages evicted: %+v", got)
+	}
+}
+
+func TestCoalesceQueueKeepsLatestPerID(t *testing.T) {
+	// A closed client stops the mover, so frames stay queued for inspection.
+	closed := make(chan struct{})
+	close(closed)
+	q := newCoalesceQueue(make(chan can.Frame, 1), closed)
+	fr := func(id uint32, v byte) can.Frame { return can.Frame{CANID: id, Len: 1, Data: [64]byte{v}} }
+	for _, f := range []struct {
+		fr   can.Frame
+		want pushResult
+	}{
+		{fr(0x10, 1), queued}, // straight into Out
+		{fr(0x20, 1), queued},
+		{fr(0x20, 2), replaced},
+		{fr(0x30, 1), full}, // one waiting ID per Out slot
+		{fr(0x20, 3), replaced},
+	} {
+		if got := q.push(f.fr); got != f.want {
+			t.Fatalf("push %X/%d = %d want %d", f.fr.CANID, f.fr.Data[0], got, f.want)
+		}
+	}
+	if q.len() != 2 || q.cap() != 2 {
+		t.Fatalf("len=%d cap=%d", q.len(), q.cap())
+	}
+	got := q.drain()
+	if len(got) != 2 || got[0].CANID != 0x10 || got[1].CANID != 0x20 || got[1].Data[0] != 3 {
+		t.Fatalf("unexpected frames: %+v", got)
+	}
+}
+
+func TestHub_CoalesceDelivers(t *testing.T) {
+	h, _ := NewWithOptions(WithPolicy(PolicyCoalesce))
+	cl := &Client{Out: make(chan can.Frame, 1), Closed: make(chan struct{})}
+	h.Add(cl)
+	defer h.Remove(cl)
+	// Out holds one frame and one more ID may wait for it.
+	h.Broadcast(can.Frame{CANID: 0x10})
+	h.Broadcast(can.Frame{CANID: 0x11})
+	deadline := time.After(time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case fr := <-cl.Out:
+			if fr.CANID != 0x10+uint32(i) {
+				t.Fatalf("frame %d: got %X", i, fr.CANID)
+			}
+		case <-deadline:
+			t.Fatalf("timeout waiting for frame %d", i)
+		}
+	}
+}
+
+func TestHub_CoalesceBoundsIDs(t *testing.T) {
+	h, _ := NewWithOptions(WithPolicy(PolicyCoalesce))
+	cl := &Client{Out: make(chan can.Frame, 2), Closed: make(chan struct{})}
+	h.Add(cl)
+	defer h.Remove(cl)
+	for i := 0; i < 10; i++ {
+		h.Broadcast(can.Frame{CANID: uint32(i)})
+	}
+	if n := cl.QueueLen(); n > cl.QueueCap() {
+		t.Fatalf("queue len %d exceeds cap %d", n, cl.QueueCap())
+	}
+	h.Remove(cl)
+	got := cl.Drain()
+	for i := 1; i < len(got); i++ {
+		if got[i].CANID <= got[i-1].CANID {
+			t.Fatalf("frames out of order: %+v", got)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package hub
+
+import (
+	"context"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/memguard"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// DefaultSampleInterval is the default period of RunSampler.
+const DefaultSampleInterval = time.Second
+
+// Sample is a point-in-time view of client queues.
+type Sample struct {
+	Clients  int
+	Fanout   int // clients targeted by the most recent broadcast
+	QueueMax int // deepest client queue
+	QueueSum int // total queued frames across clients
+}
+
+// Sample reads current queue depths. It walks the client list once and is
+// meant for periodic sampling, not the per-frame path.
+func (h *Hub) Sample() Sample {
+	var s Sample
+	if v := h.view.Load(); v != nil {
+		for _, c := range *v {
+			l := c.QueueLen()
+			if l > s.QueueMax {
+				s.QueueMax = l
+			}
+			s.QueueSum += l
+		}
+		s.Clients = len(*v)
+	}
+	s.Fanout = int(h.fanout.Load())
+	return s
+}
+
+// RunSampler periodically publishes client, fanout and queue-depth gauges
+// aggregated over hubs until ctx is done. Each sample also refreshes the
+// queued memory accounting (memguard).
+func RunSampler(ctx context.Context, interval time.Duration, hubs ...*Hub) {
+	if interval <= 0 {
+		interval = DefaultSampleInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		publish(hubs)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func publish(hubs []*Hub) {
+	var agg Sample
+	for _, h := range hubs {
+		s := h.Sample()
+		agg.Clients += s.Clients
+		agg.Fanout += s.Fanout
+		agg.QueueSum += s.QueueSum
+		if s.QueueMax > agg.QueueMax {
+			agg.QueueMax = s.QueueMax
+		}
+	}
+	avg := 0
+	if agg.Clients > 0 {
+		avg = agg.QueueSum / agg.Clients
+	}
+	metrics.SetHubClients(agg.Clients)
+	metrics.SetBroadcastFanout(agg.Fanout)
+	metrics.SetQueueDepth(agg.QueueMax, avg)
+	memguard.SetHubQueued(agg.QueueSum)
+	memguard.Update()
+}
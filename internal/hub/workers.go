@@ -0,0 +1,64 @@
+package hub
+
+import (
+	"context"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// workerQueue is the frames buffered per fan-out worker.
+const workerQueue = 256
+
+// workerPool fans frames out over fixed client shards.
+type workerPool struct {
+	in   []chan can.Frame
+	done <-chan struct{}
+}
+
+// StartWorkers moves fan-out off the broadcasting goroutine: n workers each
+// deliver every frame to a fixed shard of the clients until ctx is done.
+// Clients keep their shard for life, so per-client frame order is kept.
+// Broadcast then only hands the frame to the workers, blocking if one falls
+// workerQueue frames behind. Call before the first Broadcast; n < 2 keeps
+// inline fan-out.
+func (h *Hub) StartWorkers(ctx context.Context, n int) {
+	if n < 2 {
+		return
+	}
+	p := &workerPool{in: make([]chan can.Frame, n), done: ctx.Done()}
+	for i := range p.in {
+		p.in[i] = make(chan can.Frame, workerQueue)
+	}
+	h.mu.Lock()
+	h.pool.Store(p)
+	h.rebuildLocked()
+	h.mu.Unlock()
+	for i, in := range p.in {
+		go h.work(i, in, p.done)
+	}
+}
+
+func (h *Hub) work(i int, in <-chan can.Frame, done <-chan struct{}) {
+	for {
+		select {
+		case fr := <-in:
+			if v := h.shards.Load(); v != nil {
+				for _, c := range (*v)[i] {
+					h.deliver(c, fr)
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (p *workerPool) dispatch(fr can.Frame) {
+	for _, in := range p.in {
+		select {
+		case in <- fr:
+		case <-p.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package hub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestWorkersPreserveOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := New()
+	h.StartWorkers(ctx, 3)
+	clients := make([]*Client, 10)
+	for i := range clients {
+		clients[i] = &Client{Out: make(chan can.Frame, 128), Closed: make(chan struct{})}
+		h.Add(clients[i])
+	}
+	for id := uint32(0); id < 100; id++ {
+		h.Broadcast(can.Frame{CANID: id})
+	}
+	for i, c := range clients {
+		for id := uint32(0); id < 100; id++ {
+			select {
+			case fr := <-c.Out:
+				if fr.CANID != id {
+					t.Fatalf("client %d: got 0x%X, want 0x%X", i, fr.CANID, id)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("client %d: frame %d missing", i, id)
+			}
+		}
+	}
+	h.Remove(clients[0])
+	late := &Client{Out: make(chan can.Frame, 1), Closed: make(chan struct{})}
+	h.Add(late)
+	h.Broadcast(can.Frame{CANID: 0x7FF})
+	select {
+	case fr := <-late.Out:
+		if fr.CANID != 0x7FF {
+			t.Fatalf("late client got %+v", fr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("late client not served")
+	}
+	select {
+	case fr := <-clients[0].Out:
+		t.Fatalf("removed client got %+v", fr)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func BenchmarkBroadcastWorkers(b *testing.B) {
+	for _, workers := range []int{0, 4} {
+		b.Run(map[int]string{0: "inline", 4: "workers4"}[workers], func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			h := New()
+			h.StartWorkers(ctx, workers)
+			for i := 0; i < 500; i++ {
+				c := &Client{Out: make(chan can.Frame, 1024), Closed: make(chan struct{})}
+				h.Add(c)
+				go func() {
+					for range c.Out {
+					}
+				}()
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.Broadcast(can.Frame{CANID: uint32(i)})
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package inhibit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/kstaniek/go-ampio-server/internal/instances"
+)
+
+type status struct {
+	Inhibited bool   `json:"inhibited"`
+	Manual    bool   `json:"manual"`
+	Scheduled bool   `json:"scheduled"`
+	Schedule  string `json:"schedule"`
+}
+
+// Handler exposes the inhibitors over HTTP. targets maps instance names to
+// inhibitors; the ?instance= parameter selects one and may be omitted when
+// there is only one.
+//
+//	GET                                  -> {"inhibited":false,"manual":false,...}
+//	PUT/POST ?inhibit=true (or JSON body {"inhibit":true}) -> new state
+func Handler(targets map[string]*Inhibitor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		in, err := instances.Pick(targets, r.URL.Query().Get("instance"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var on bool
+			if v := r.URL.Query().Get("inhibit"); v != "" {
+				if on, err = strconv.ParseBool(v); err != nil {
+					http.Error(w, "invalid inhibit value", http.StatusBadRequest)
+					return
+				}
+			} else {
+				var body struct {
+					Inhibit *bool `json:"inhibit"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Inhibit == nil {
+					http.Error(w, "missing inhibit", http.StatusBadRequest)
+					return
+				}
+				on = *body.Inhibit
+			}
+			in.Set(on, "http")
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status{
+			Inhibited: in.Active(),
+			Manual:    in.Manual(),
+			Scheduled: in.scheduled.Load(),
+			Schedule:  in.sched.String(),
+		})
+	})
+}
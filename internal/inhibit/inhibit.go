@@ -0,0 +1,252 @@
+// Package inhibit implements TX inhibit ("quiet hours"): scheduled time
+// windows or a manual admin toggle during which client frames are not
+// written to the bus, e.g. for maintenance on the physical installation.
+//
+// A schedule is a comma separated list of windows in local time:
+//
+//	22:00-06:00             every day (a window may wrap past midnight)
+//	mon-fri 12:00-13:00     weekday range
+//	sat 00:00-24:00         single day
+//
+// A wrapping window belongs to the day it starts on.
+package inhibit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// ErrInhibited is returned by senders for frames dropped while TX is inhibited.
+var ErrInhibited = errors.New("tx inhibited")
+
+// active counts inhibited Inhibitors for the process-wide gauge.
+var active atomic.Int64
+
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+type window struct {
+	days       uint8 // bit per time.Weekday
+	start, end int   // minutes since midnight; end <= start wraps
+}
+
+func (w window) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	day := uint8(1) << t.Weekday()
+	prev := uint8(1) << ((t.Weekday() + 6) % 7)
+	if w.start < w.end {
+		return w.days&day != 0 && m >= w.start && m < w.end
+	}
+	return (w.days&day != 0 && m >= w.start) || (w.days&prev != 0 && m < w.end)
+}
+
+// Schedule is an immutable set of inhibit windows. The zero value never
+// inhibits.
+type Schedule struct {
+	windows []window
+	spec    string
+}
+
+// ParseSchedule parses a window list (see the package doc). An empty spec
+// yields an empty schedule.
+func ParseSchedule(spec string) (Schedule, error) {
+	s := Schedule{spec: strings.TrimSpace(spec)}
+	if s.spec == "" {
+		return s, nil
+	}
+	for _, ent := range strings.Split(s.spec, ",") {
+		w, err := parseWindow(strings.TrimSpace(ent))
+		if err != nil {
+			return Schedule{}, fmt.Errorf("%q: %w", ent, err)
+		}
+		s.windows = append(s.windows, w)
+	}
+	return s, nil
+}
+
+func parseWindow(ent string) (window, error) {
+	w := window{days: 0x7F}
+	fields := strings.Fields(ent)
+	switch len(fields) {
+	case 1:
+	case 2:
+		d, err := parseDays(fields[0])
+		if err != nil {
+			return w, err
+		}
+		w.days = d
+		fields = fields[1:]
+	default:
+		return w, errors.New("want [days] HH:MM-HH:MM")
+	}
+	from, to, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return w, errors.New("want HH:MM-HH:MM")
+	}
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return w, err
+	}
+	if w.start == w.end || w.start == 24*60 {
+		return w, errors.New("empty window")
+	}
+	if w.end == 24*60 {
+		w.end = 0 // ends at midnight: same as wrapping to 00:00
+	}
+	return w, nil
+}
+
+func parseDays(s string) (uint8, error) {
+	from, to, isRange := strings.Cut(strings.ToLower(s), "-")
+	a, err := dayIndex(from)
+	if err != nil {
+		return 0, err
+	}
+	b := a
+	if isRange {
+		if b, err = dayIndex(to); err != nil {
+			return 0, err
+		}
+	}
+	var mask uint8
+	for d := a; ; d = (d + 1) % 7 {
+		mask |= 1 << d
+		if d == b {
+			return mask, nil
+		}
+	}
+}
+
+func dayIndex(s string) (int, error) {
+	for i, n := range dayNames {
+		if s == n {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day %q (use %s)", s, strings.Join(dayNames, "|"))
+}
+
+func parseClock(s string) (int, error) {
+	hh, mm, ok := strings.Cut(s, ":")
+	h, err1 := strconv.Atoi(hh)
+	m, err2 := strconv.Atoi(mm)
+	if !ok || err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// Contains reports whether t falls inside a window.
+func (s Schedule) Contains(t time.Time) bool {
+	for _, w := range s.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Empty reports whether the schedule has no windows.
+func (s Schedule) Empty() bool { return len(s.windows) == 0 }
+
+// String returns the source spec (for logs).
+func (s Schedule) String() string { return s.spec }
+
+// Inhibitor decides whether client TX is currently inhibited, either by its
+// schedule or by the manual toggle. Check is cheap enough for every frame.
+type Inhibitor struct {
+	sched     Schedule
+	l         *slog.Logger
+	now       func() time.Time
+	manual    atomic.Bool
+	scheduled atomic.Bool
+	mu        sync.Mutex // serializes state transitions
+	on        atomic.Bool
+}
+
+// New returns an Inhibitor for s. Transitions are logged to l.
+func New(s Schedule, l *slog.Logger) *Inhibitor {
+	if l == nil {
+		l = slog.Default()
+	}
+	i := &Inhibitor{sched: s, l: l, now: time.Now}
+	i.refresh("schedule")
+	return i
+}
+
+// Run re-evaluates the schedule every second until ctx is done. It is not
+// needed when the schedule is empty.
+func (i *Inhibitor) Run(ctx context.Context) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			i.refresh("schedule")
+		}
+	}
+}
+
+// Set switches the manual inhibit on or off. The schedule still applies
+// while the manual switch is off.
+func (i *Inhibitor) Set(on bool, source string) {
+	i.manual.Store(on)
+	i.refresh(source)
+}
+
+// Active reports whether TX is inhibited.
+func (i *Inhibitor) Active() bool { return i.on.Load() }
+
+// Manual reports the manual switch.
+func (i *Inhibitor) Manual() bool { return i.manual.Load() }
+
+// Schedule returns the configured schedule.
+func (i *Inhibitor) Schedule() Schedule { return i.sched }
+
+// Check returns ErrInhibited (and counts the frame) while TX is inhibited.
+func (i *Inhibitor) Check() error {
+	if !i.on.Load() {
+		return nil
+	}
+	metrics.IncTxInhibited()
+	return ErrInhibited
+}
+
+func (i *Inhibitor) refresh(source string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.scheduled.Store(i.sched.Contains(i.now()))
+	on := i.manual.Load() || i.scheduled.Load()
+	if i.on.Swap(on) == on {
+		return
+	}
+	if on {
+		metrics.SetTxInhibitActive(int(active.Add(1)))
+		i.l.Warn("tx_inhibit_on", "source", source, "manual", i.manual.Load(), "scheduled", i.scheduled.Load())
+	} else {
+		metrics.SetTxInhibitActive(int(active.Add(-1)))
+		i.l.Info("tx_inhibit_off", "source", source)
+	}
+}
+
+// Close releases the Inhibitor's share of the process-wide gauge.
+func (i *Inhibitor) Close() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.on.Swap(false) {
+		metrics.SetTxInhibitActive(int(active.Add(-1)))
+	}
+}
@@ -0,0 +1,111 @@
+package inhibit
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func at(day time.Weekday, hhmm string) time.Time {
+	t, _ := time.ParseInLocation("15:04", hhmm, time.Local)
+	// 2024-01-07 is a Sunday.
+	return time.Date(2024, 1, 7+int(day), t.Hour(), t.Minute(), 0, 0, time.Local)
+}
+
+func TestScheduleContains(t *testing.T) {
+	s, err := ParseSchedule("mon-fri 22:00-06:00, sat 00:00-24:00, 12:00-12:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		t    time.Time
+		want bool
+	}{
+		{at(time.Monday, "22:00"), true},
+		{at(time.Monday, "21:59"), false},
+		{at(time.Tuesday, "05:59"), true},  // wrapped from Monday
+		{at(time.Monday, "03:00"), false},  // Sunday night is not in mon-fri
+		{at(time.Saturday, "03:00"), true}, // Friday night wrap and the Saturday window
+		{at(time.Saturday, "23:59"), true},
+		{at(time.Sunday, "00:30"), false},
+		{at(time.Sunday, "12:15"), true}, // every day
+		{at(time.Sunday, "12:30"), false},
+	}
+	for _, c := range cases {
+		if got := s.Contains(c.t); got != c.want {
+			t.Errorf("%s %s: got %v want %v", c.t.Weekday(), c.t.Format("15:04"), got, c.want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{"22:00", "xyz 10:00-11:00", "10:00-10:00", "25:00-26:00", "10:60-11:00", "mon fri 10:00-11:00"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+	if s, err := ParseSchedule(" "); err != nil || !s.Empty() {
+		t.Fatalf("blank spec: %v %v", s, err)
+	}
+}
+
+func TestInhibitorManualAndSchedule(t *testing.T) {
+	in := New(Schedule{}, nil)
+	defer in.Close()
+	if err := in.Check(); err != nil {
+		t.Fatalf("idle inhibitor rejected frame: %v", err)
+	}
+	in.Set(true, "test")
+	if err := in.Check(); !errors.Is(err, ErrInhibited) {
+		t.Fatalf("expected ErrInhibited, got %v", err)
+	}
+	in.Set(false, "test")
+	if in.Active() {
+		t.Fatal("still active after manual off")
+	}
+
+	s, _ := ParseSchedule("10:00-11:00")
+	now := at(time.Wednesday, "09:59")
+	sched := New(s, nil)
+	defer sched.Close()
+	sched.now = func() time.Time { return now }
+	sched.refresh("test")
+	if sched.Active() {
+		t.Fatal("active before window")
+	}
+	now = at(time.Wednesday, "10:00")
+	sched.refresh("test")
+	if !sched.Active() {
+		t.Fatal("not active inside window")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	in := New(Schedule{}, nil)
+	defer in.Close()
+	h := Handler(map[string]*Inhibitor{"": in})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/api/tx-inhibit?inhibit=true", nil))
+	if rec.Code != http.StatusOK || !in.Active() || !strings.Contains(rec.Body.String(), `"inhibited":true`) {
+		t.Fatalf("enable: code=%d body=%s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/tx-inhibit", strings.NewReader(`{"inhibit":false}`)))
+	if rec.Code != http.StatusOK || in.Active() {
+		t.Fatalf("disable: code=%d body=%s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/tx-inhibit", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("missing value: code=%d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/tx-inhibit?instance=nope", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown instance: code=%d", rec.Code)
+	}
+}
@@ -0,0 +1,29 @@
+// Package instances resolves the ?instance= parameter of the admin API
+// handlers against the per-instance targets they serve.
+package instances
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Pick returns the target called name, or the only one when name is empty.
+// The error lists the known names, for a 404 body.
+func Pick[T any](targets map[string]T, name string) (T, error) {
+	if t, ok := targets[name]; ok {
+		return t, nil
+	}
+	if name == "" && len(targets) == 1 {
+		for _, t := range targets {
+			return t, nil
+		}
+	}
+	names := make([]string, 0, len(targets))
+	for n := range targets {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var zero T
+	return zero, fmt.Errorf("unknown instance %q (have %s)", name, strings.Join(names, ", "))
+}
@@ -0,0 +1,24 @@
+package instances
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPick(t *testing.T) {
+	one := map[string]int{"a": 1}
+	if v, err := Pick(one, ""); err != nil || v != 1 {
+		t.Fatalf("only instance: %d %v", v, err)
+	}
+	two := map[string]int{"b": 2, "a": 1}
+	if v, err := Pick(two, "b"); err != nil || v != 2 {
+		t.Fatalf("named instance: %d %v", v, err)
+	}
+	_, err := Pick(two, "")
+	if err == nil || !strings.Contains(err.Error(), `(have a, b)`) {
+		t.Fatalf("ambiguous: %v", err)
+	}
+	if _, err := Pick(one, "x"); err == nil {
+		t.Fatal("unknown instance accepted")
+	}
+}
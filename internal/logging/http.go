@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// LevelHandler exposes the process-wide log level over HTTP.
+//
+//	GET            -> {"level":"info"}
+//	PUT/POST ?level=debug (or JSON body {"level":"debug"}) -> new level
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			name := r.URL.Query().Get("level")
+			if name == "" {
+				var body struct {
+					Level string `json:"level"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					http.Error(w, "missing level", http.StatusBadRequest)
+					return
+				}
+				name = body.Level
+			}
+			lvl, err := ParseLevel(name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			prev := Level()
+			SetLevel(lvl)
+			L().Info("log_level_changed", "from", LevelName(prev), "to", LevelName(lvl), "source", "http")
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"level": LevelName(Level())})
+	})
+}
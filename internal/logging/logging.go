@@ -1,15 +1,21 @@
 package logging
 
 import (
+	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"strings"
 	"sync/atomic"
 )
 
 // Global structured logger. Initialized with a reasonable text handler.
 var logger atomic.Pointer[slog.Logger]
 
+// level is the process-wide dynamic log level. Loggers built with
+// NewDynamic consult it on every record so it can be changed at runtime.
+var level slog.LevelVar
+
 func init() {
 	l := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
 	logger.Store(l)
@@ -39,3 +45,35 @@ func New(format string, level slog.Leveler, w io.Writer) *slog.Logger {
 	}
 	return slog.New(h)
 }
+
+// NewDynamic creates a logger bound to the process-wide level variable and
+// sets that variable to lvl. Use SetLevel to change verbosity later.
+func NewDynamic(format string, lvl slog.Level, w io.Writer) *slog.Logger {
+	level.Set(lvl)
+	return New(format, &level, w)
+}
+
+// Level returns the current process-wide log level.
+func Level() slog.Level { return level.Level() }
+
+// SetLevel changes the process-wide log level at runtime.
+func SetLevel(l slog.Level) { level.Set(l) }
+
+// ParseLevel maps debug|info|warn|error (case-insensitive) to a slog level.
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("invalid log level %q", s)
+	}
+}
+
+// LevelName returns the lower-case name used by flags for l.
+func LevelName(l slog.Level) string { return strings.ToLower(l.String()) }
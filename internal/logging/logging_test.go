@@ -0,0 +1,39 @@
+package logging
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLevelHandlerChangesLevel(t *testing.T) {
+	SetLevel(slog.LevelInfo)
+	t.Cleanup(func() { SetLevel(slog.LevelInfo) })
+	h := LevelHandler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/api/loglevel?level=debug", nil))
+	if rec.Code != http.StatusOK || Level() != slog.LevelDebug {
+		t.Fatalf("expected debug, code=%d level=%v", rec.Code, Level())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/loglevel", strings.NewReader(`{"level":"warn"}`)))
+	if rec.Code != http.StatusOK || Level() != slog.LevelWarn {
+		t.Fatalf("expected warn, code=%d level=%v", rec.Code, Level())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/api/loglevel?level=loud", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid level, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/loglevel", nil))
+	if !strings.Contains(rec.Body.String(), `"warn"`) {
+		t.Fatalf("unexpected GET body %q", rec.Body.String())
+	}
+}
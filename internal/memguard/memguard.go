@@ -0,0 +1,96 @@
+// Package memguard accounts for the approximate memory held by queued frames
+// (hub client queues and backend TX queues) and enforces an optional global
+// cap. Above the cap queues shed load aggressively until usage falls back
+// below 3/4 of it.
+package memguard
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// FrameBytes approximates the memory one queued frame occupies.
+const FrameBytes = int64(unsafe.Sizeof(can.Frame{}))
+
+var (
+	limit     atomic.Int64
+	pressure  atomic.Bool
+	hubFrames atomic.Int64
+
+	mu       sync.Mutex
+	backends = map[*func() int]struct{}{}
+)
+
+// Usage is the accounted memory at the last Update.
+type Usage struct {
+	Hub      int64 // bytes queued for TCP clients
+	Backend  int64 // bytes queued for backend writes
+	Limit    int64 // 0 = no cap
+	Pressure bool
+}
+
+// SetLimit sets the cap in bytes on queued frames (0 disables it).
+func SetLimit(n int64) {
+	limit.Store(n)
+	if n <= 0 {
+		pressure.Store(false)
+	}
+}
+
+// SetHubQueued records the frames currently queued in hub client queues.
+func SetHubQueued(n int) { hubFrames.Store(int64(n)) }
+
+// RegisterBackend adds a backend queue whose depth (frames) fn reports.
+// The returned func removes it.
+func RegisterBackend(fn func() int) (unregister func()) {
+	p := &fn
+	mu.Lock()
+	backends[p] = struct{}{}
+	mu.Unlock()
+	return func() {
+		mu.Lock()
+		delete(backends, p)
+		mu.Unlock()
+	}
+}
+
+// Update recomputes usage, publishes the memory gauges and switches load
+// shedding on above the limit and off again below 3/4 of it.
+func Update() Usage {
+	var backendFrames int64
+	mu.Lock()
+	for fn := range backends {
+		backendFrames += int64((*fn)())
+	}
+	mu.Unlock()
+	u := Usage{Hub: hubFrames.Load() * FrameBytes, Backend: backendFrames * FrameBytes, Limit: limit.Load()}
+	if u.Limit > 0 {
+		switch used := u.Hub + u.Backend; {
+		case used > u.Limit:
+			pressure.Store(true)
+		case used < u.Limit/4*3:
+			pressure.Store(false)
+		}
+	}
+	u.Pressure = pressure.Load()
+	metrics.SetQueueMemory(u.Hub, u.Backend, u.Limit, u.Pressure)
+	return u
+}
+
+// Pressure reports whether queued memory is over the limit.
+func Pressure() bool { return pressure.Load() }
+
+// Shed reports whether a frame should be dropped instead of queued on a
+// queue holding n of capacity frames: under pressure queues are kept at a
+// quarter of their capacity. Shed frames are counted.
+func Shed(n, capacity int) bool {
+	if !pressure.Load() || n < capacity/4 {
+		return false
+	}
+	metrics.IncPressureDrop()
+	return true
+}
@@ -0,0 +1,50 @@
+package memguard
+
+import (
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+func TestPressureHysteresis(t *testing.T) {
+	defer SetLimit(0)
+	queued := 0
+	unregister := RegisterBackend(func() int { return queued })
+	defer unregister()
+	SetLimit(100 * FrameBytes)
+
+	queued = 101
+	if u := Update(); !u.Pressure || u.Backend != 101*FrameBytes {
+		t.Fatalf("over limit: %+v", u)
+	}
+	before := metrics.Snap().PressureDrops
+	if Shed(1, 64) {
+		t.Fatal("queue below a quarter must not shed")
+	}
+	if !Shed(16, 64) {
+		t.Fatal("queue at a quarter must shed under pressure")
+	}
+	if metrics.Snap().PressureDrops != before+1 {
+		t.Fatal("shed frame not counted")
+	}
+
+	queued = 80 // below the limit but above the 3/4 release mark
+	if !Update().Pressure {
+		t.Fatal("pressure released before falling under 3/4 of the limit")
+	}
+	queued = 70
+	if Update().Pressure || Shed(64, 64) {
+		t.Fatal("pressure still on under 3/4 of the limit")
+	}
+}
+
+func TestHubQueuedCounts(t *testing.T) {
+	defer SetHubQueued(0)
+	SetHubQueued(10)
+	if u := Update(); u.Hub != 10*FrameBytes || u.Pressure {
+		t.Fatalf("usage %+v", u)
+	}
+	if metrics.Snap().QueueMemory < uint64(10*FrameBytes) {
+		t.Fatal("gauge not published")
+	}
+}
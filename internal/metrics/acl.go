@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kstaniek/go-ampio-server/internal/logging"
+)
+
+// allowedNets restricts which client addresses may use the HTTP server
+// (nil or empty allows everyone).
+var allowedNets atomic.Pointer[[]netip.Prefix]
+
+// ParseNets parses a comma separated list of CIDR prefixes. A bare address
+// stands for a single host. An empty string yields nil.
+func ParseNets(s string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			a, err := netip.ParseAddr(f)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", f, err)
+			}
+			out = append(out, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix %q: %w", f, err)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// SetAllowedNets limits every HTTP endpoint (/metrics, /ready and the admin
+// API) to clients within nets. An empty list lifts the restriction.
+func SetAllowedNets(nets []netip.Prefix) { allowedNets.Store(&nets) }
+
+// allowed reports whether the remote address of r is within the allowed nets.
+func allowed(r *http.Request) bool {
+	p := allowedNets.Load()
+	if p == nil || len(*p) == 0 {
+		return true
+	}
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	a := ap.Addr().Unmap()
+	for _, n := range *p {
+		if n.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowNets rejects requests from outside the allowed nets with 403.
+func allowNets(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed(r) {
+			httpDenied.add(1)
+			logging.L().Debug("http_denied", "remote", r.RemoteAddr, "path", r.URL.Path)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
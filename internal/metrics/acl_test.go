@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowedNets(t *testing.T) {
+	nets, err := ParseNets("10.1.0.0/16, 192.168.5.7,fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetAllowedNets(nets)
+	defer SetAllowedNets(nil)
+	h := allowNets(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for remote, want := range map[string]int{
+		"10.1.2.3:5000":          http.StatusOK,
+		"[::ffff:10.1.2.3]:5000": http.StatusOK,
+		"192.168.5.7:80":         http.StatusOK,
+		"192.168.5.8:80":         http.StatusForbidden,
+		"[fd12::1]:443":          http.StatusOK,
+		"[2001:db8::1]:443":      http.StatusForbidden,
+		"not-an-address":         http.StatusForbidden,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%s: got %d want %d", remote, w.Code, want)
+		}
+	}
+	if _, err := ParseNets("10.0.0.0/33"); err == nil {
+		t.Fatal("expected error for bad prefix")
+	}
+}
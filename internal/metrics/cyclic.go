@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CyclicSample is a reading of one cyclic TX entry (see package cyclic).
+type CyclicSample struct {
+	Entry      string
+	Sent       uint64
+	Errors     uint64
+	Missed     uint64
+	Jitter     time.Duration // last interval minus the period
+	JitterMax  time.Duration
+	JitterMean time.Duration
+}
+
+var (
+	cyclicMu       sync.Mutex
+	cyclicSamplers = map[string]func() []CyclicSample{}
+)
+
+type cyclicCollector struct {
+	sent, errors, missed, jitter, jitterMax, jitterMean *prometheus.Desc
+}
+
+func newCyclicCollector(r *registration) *cyclicCollector {
+	d := func(name, help string) *prometheus.Desc { return r.desc(name, help, "instance", "entry") }
+	return &cyclicCollector{
+		sent:       d("cyclic_tx_frames_total", "Frames sent by a cyclic TX entry."),
+		errors:     d("cyclic_tx_errors_total", "Cyclic TX sends rejected by the transmit path."),
+		missed:     d("cyclic_tx_missed_periods_total", "Cyclic TX deadlines skipped because a send ran past them."),
+		jitter:     d("cyclic_tx_jitter_seconds", "Actual minus configured period of the last cyclic TX interval."),
+		jitterMax:  d("cyclic_tx_jitter_max_seconds", "Largest absolute cyclic TX period jitter since start."),
+		jitterMean: d("cyclic_tx_jitter_mean_seconds", "Mean absolute cyclic TX period jitter since start."),
+	}
+}
+
+func (c *cyclicCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.sent, c.errors, c.missed, c.jitter, c.jitterMax, c.jitterMean} {
+		ch <- d
+	}
+}
+
+func (c *cyclicCollector) Collect(ch chan<- prometheus.Metric) {
+	cyclicMu.Lock()
+	defer cyclicMu.Unlock()
+	for inst, fn := range cyclicSamplers {
+		for _, s := range fn() {
+			ch <- prometheus.MustNewConstMetric(c.sent, prometheus.CounterValue, float64(s.Sent), inst, s.Entry)
+			ch <- prometheus.MustNewConstMetric(c.errors, prometheus.CounterValue, float64(s.Errors), inst, s.Entry)
+			ch <- prometheus.MustNewConstMetric(c.missed, prometheus.CounterValue, float64(s.Missed), inst, s.Entry)
+			ch <- prometheus.MustNewConstMetric(c.jitter, prometheus.GaugeValue, s.Jitter.Seconds(), inst, s.Entry)
+			ch <- prometheus.MustNewConstMetric(c.jitterMax, prometheus.GaugeValue, s.JitterMax.Seconds(), inst, s.Entry)
+			ch <- prometheus.MustNewConstMetric(c.jitterMean, prometheus.GaugeValue, s.JitterMean.Seconds(), inst, s.Entry)
+		}
+	}
+}
+
+// RegisterCyclic exposes the cyclic TX entries of an instance, sampled from
+// fn at scrape time.
+func RegisterCyclic(instance string, fn func() []CyclicSample) {
+	cyclicMu.Lock()
+	cyclicSamplers[instance] = fn
+	cyclicMu.Unlock()
+}
@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/logging"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Bind policies for the metrics HTTP server when its address is in use.
+const (
+	BindWarn     = "warn"     // log the error and run without the endpoint
+	BindFail     = "fail"     // return the error (abort startup)
+	BindRetry    = "retry"    // keep retrying with backoff in the background
+	BindFallback = "fallback" // listen on the fallback address instead
+)
+
+// Retry backoff bounds for BindRetry.
+const (
+	bindRetryMin = time.Second
+	bindRetryMax = 30 * time.Second
+)
+
+// BindOptions configures how StartHTTP reacts to a bind failure.
+type BindOptions struct {
+	Policy   string // BindWarn (default), BindFail, BindRetry or BindFallback
+	Fallback string // address for BindFallback (":0" picks a free port)
+}
+
+// listenAddr holds the address the HTTP server is listening on (nil when
+// down). A server that exits only clears its own address, so a stopped
+// server shutting down late cannot mark a restarted one as down.
+var listenAddr atomic.Pointer[string]
+
+// HTTPUp reports whether the metrics HTTP server is listening.
+func HTTPUp() bool { return listenAddr.Load() != nil }
+
+// ListenAddr returns the address the metrics HTTP server is listening on,
+// or "" when it is down.
+func ListenAddr() string {
+	if a := listenAddr.Load(); a != nil {
+		return *a
+	}
+	return ""
+}
+
+func newMux() *http.ServeMux {
+	registerDefault()
+	mux := http.NewServeMux()
+	if g := registeredGatherer(); g != nil {
+		mux.Handle("/metrics", promhttp.HandlerFor(g, promhttp.HandlerOpts{}))
+	} else {
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+	handlersMu.Lock()
+	for _, eh := range handlers {
+		mux.Handle(eh.pattern, eh.h)
+	}
+	handlersMu.Unlock()
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if IsReady() {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("ready\n"))
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("not ready\n"))
+	})
+	return mux
+}
+
+// Handler returns the handler StartHTTP serves, for HTTP requests arriving
+// on other listeners. It sees the endpoints registered so far.
+func Handler() http.Handler { return allowNets(newMux()) }
+
+// StartHTTP serves Prometheus metrics at /metrics, /ready and the endpoints
+// registered with Handle on addr. When addr cannot be bound, b.Policy
+// decides what happens; only BindFail (and BindFallback when the fallback
+// is busy too) returns an error. Shut the returned server down on exit;
+// with BindRetry cancel ctx as well to stop retrying.
+func StartHTTP(ctx context.Context, addr string, b BindOptions) (*http.Server, error) {
+	srv := &http.Server{Addr: addr, Handler: allowNets(newMux())}
+	ln, err := net.Listen("tcp", addr)
+	if err == nil {
+		serveHTTP(srv, ln, false)
+		return srv, nil
+	}
+	IncError(ErrMetricsBind)
+	switch b.Policy {
+	case BindFail:
+		return nil, fmt.Errorf("metrics listen %s: %w", addr, err)
+	case BindFallback:
+		logging.L().Warn("metrics_bind_failed", "addr", addr, "error", err, "fallback", b.Fallback)
+		ln, ferr := net.Listen("tcp", b.Fallback)
+		if ferr != nil {
+			return nil, fmt.Errorf("metrics listen %s: %w (fallback %s: %v)", addr, err, b.Fallback, ferr)
+		}
+		serveHTTP(srv, ln, true)
+	case BindRetry:
+		logging.L().Warn("metrics_bind_failed", "addr", addr, "error", err, "retry_in", bindRetryMin)
+		go retryHTTP(ctx, srv, addr)
+	default:
+		logging.L().Error("metrics_http_error", "error", err)
+	}
+	return srv, nil
+}
+
+func serveHTTP(srv *http.Server, ln net.Listener, fallback bool) {
+	addr := ln.Addr().String()
+	listenAddr.Store(&addr)
+	if fallback {
+		httpFallback.set(1)
+	} else {
+		httpFallback.set(0)
+	}
+	logging.L().Info("metrics_listen", "addr", addr, "fallback", fallback)
+	go func() {
+		defer func() {
+			if listenAddr.CompareAndSwap(&addr, nil) {
+				httpFallback.set(0)
+			}
+		}()
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.L().Error("metrics_http_error", "error", err)
+		}
+	}()
+}
+
+// retryHTTP binds addr with exponential backoff until it succeeds, ctx is
+// done or srv is shut down.
+func retryHTTP(ctx context.Context, srv *http.Server, addr string) {
+	shut := make(chan struct{})
+	srv.RegisterOnShutdown(func() { close(shut) })
+	backoff := bindRetryMin
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-shut:
+			return
+		case <-time.After(backoff):
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err == nil {
+			serveHTTP(srv, ln, false)
+			return
+		}
+		backoff = min(backoff*2, bindRetryMax)
+		logging.L().Debug("metrics_bind_retry", "addr", addr, "error", err, "retry_in", backoff)
+	}
+}
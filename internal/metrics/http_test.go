@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStartHTTPBindPolicies(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := busy.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := StartHTTP(ctx, addr, BindOptions{Policy: BindFail}); err == nil {
+		t.Fatal("fail policy: expected error")
+	}
+
+	srv, err := StartHTTP(ctx, addr, BindOptions{Policy: BindFallback, Fallback: "127.0.0.1:0"})
+	if err != nil || !HTTPUp() || gathered(t, "metrics_http_fallback", "") != 1 {
+		t.Fatalf("fallback: err=%v up=%v", err, HTTPUp())
+	}
+	_ = srv.Shutdown(context.Background())
+
+	waitUp := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for HTTPUp() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("HTTPUp never became %v", want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitUp(false)
+
+	srv, err = StartHTTP(ctx, addr, BindOptions{Policy: BindRetry})
+	if err != nil || HTTPUp() {
+		t.Fatalf("retry: err=%v up=%v", err, HTTPUp())
+	}
+	_ = busy.Close() // address frees up; the retry loop binds it
+	waitUp(true)
+	_ = srv.Shutdown(context.Background())
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// InstanceSample is a point-in-time reading of one gateway instance, used
+// when several instances share the process (and the metrics endpoint).
+type InstanceSample struct {
+	RxFrames        uint64 // frames received from the backend and broadcast
+	TxFrames        uint64 // frames accepted for backend transmission
+	HubDrops        uint64
+	HubKicks        uint64
+	Clients         int
+	Accepted        uint64
+	BackendOverflow uint64
+	BackendErrors   uint64
+}
+
+var (
+	instMu       sync.Mutex
+	instSamplers = map[string]func() InstanceSample{}
+)
+
+// instanceCollector exports the registered instances, one series per
+// instance and field.
+type instanceCollector struct {
+	rx, tx, drop, kick, clients, accepted, overflow, backendErr *prometheus.Desc
+}
+
+func newInstanceCollector(r *registration) *instanceCollector {
+	d := func(name, help string) *prometheus.Desc { return r.desc(name, help, "instance") }
+	return &instanceCollector{
+		rx:         d("instance_rx_frames_total", "Frames received from the instance backend."),
+		tx:         d("instance_tx_frames_total", "Frames accepted for transmission to the instance backend."),
+		drop:       d("instance_hub_dropped_frames_total", "Frames dropped by the instance hub due to slow clients."),
+		kick:       d("instance_hub_kicked_clients_total", "Clients disconnected by the instance kick policy."),
+		clients:    d("instance_active_clients", "Currently connected clients of the instance."),
+		accepted:   d("instance_accepted_connections_total", "TCP connections accepted by the instance."),
+		overflow:   d("instance_backend_overflow_total", "Client frames dropped because the instance backend TX queue was full."),
+		backendErr: d("instance_backend_errors_total", "Client frames the instance backend failed to accept."),
+	}
+}
+
+func (c *instanceCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.rx, c.tx, c.drop, c.kick, c.clients, c.accepted, c.overflow, c.backendErr} {
+		ch <- d
+	}
+}
+
+func (c *instanceCollector) Collect(ch chan<- prometheus.Metric) {
+	instMu.Lock()
+	defer instMu.Unlock()
+	for name, fn := range instSamplers {
+		s := fn()
+		ch <- prometheus.MustNewConstMetric(c.rx, prometheus.CounterValue, float64(s.RxFrames), name)
+		ch <- prometheus.MustNewConstMetric(c.tx, prometheus.CounterValue, float64(s.TxFrames), name)
+		ch <- prometheus.MustNewConstMetric(c.drop, prometheus.CounterValue, float64(s.HubDrops), name)
+		ch <- prometheus.MustNewConstMetric(c.kick, prometheus.CounterValue, float64(s.HubKicks), name)
+		ch <- prometheus.MustNewConstMetric(c.clients, prometheus.GaugeValue, float64(s.Clients), name)
+		ch <- prometheus.MustNewConstMetric(c.accepted, prometheus.CounterValue, float64(s.Accepted), name)
+		ch <- prometheus.MustNewConstMetric(c.overflow, prometheus.CounterValue, float64(s.BackendOverflow), name)
+		ch <- prometheus.MustNewConstMetric(c.backendErr, prometheus.CounterValue, float64(s.BackendErrors), name)
+	}
+}
+
+// RegisterInstance exposes per-instance series labelled instance=name,
+// sampled from fn at scrape time. Names must be unique.
+func RegisterInstance(name string, fn func() InstanceSample) error {
+	instMu.Lock()
+	defer instMu.Unlock()
+	if _, dup := instSamplers[name]; dup {
+		return fmt.Errorf("metrics: instance %q already registered", name)
+	}
+	instSamplers[name] = fn
+	return nil
+}
+
+// UnregisterInstance removes an instance from the per-instance collector.
+func UnregisterInstance(name string) {
+	instMu.Lock()
+	delete(instSamplers, name)
+	instMu.Unlock()
+}
@@ -4,83 +4,25 @@ import (
 	"net/http"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/kstaniek/go-ampio-server/internal/logging"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Prometheus counters
 var (
-	SerialRxFrames = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "serial_rx_frames_total",
-		Help: "Total CAN frames decoded from the serial link.",
-	})
-	SocketCANRxFrames = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "socketcan_rx_frames_total",
-		Help: "Total CAN frames read from the SocketCAN interface.",
-	})
-	SerialTxFrames = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "serial_tx_frames_total",
-		Help: "Total CAN frames written to the serial link.",
-	})
-	SocketCANTxFrames = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "socketcan_tx_frames_total",
-		Help: "Total CAN frames written to the SocketCAN interface.",
-	})
-	TCPRxFrames = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "tcp_rx_frames_total",
-		Help: "Total CAN frames received from TCP clients.",
-	})
-	TCPTxFrames = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "tcp_tx_frames_total",
-		Help: "Total CAN frames sent to TCP clients.",
-	})
-	HubDroppedFrames = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "hub_dropped_frames_total",
-		Help: "Total CAN frames dropped by hub due to slow clients.",
-	})
-	HubKickedClients = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "hub_kicked_clients_total",
-		Help: "Total clients disconnected due to backpressure kick policy.",
-	})
-	HubRejectedClients = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "hub_rejected_clients_total",
-		Help: "Total client connection attempts rejected (e.g., max-clients).",
-	})
-	HubActiveClients = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "hub_active_clients",
-		Help: "Current number of active connected clients.",
-	})
-	HubBroadcastFanout = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "hub_broadcast_fanout",
-		Help: "Number of clients targeted in the most recent broadcast.",
-	})
-	HubQueueDepthMax = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "hub_queue_depth_max",
-		Help: "Observed max queued frames among clients since last sample window.",
-	})
-	HubQueueDepthAvg = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "hub_queue_depth_avg",
-		Help: "Approximate average queued frames per client in last sample.",
-	})
-	BuildInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "build_info",
-		Help: "Build metadata (value is always 1).",
-	}, []string{"version", "commit", "date"})
-	Errors = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "errors_total",
-		Help: "Error counters by subsystem.",
-	}, []string{"where"})
-	MalformedFrames = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "malformed_frames_total",
-		Help: "Total rejected malformed frames (protocol violations, invalid length, truncated).",
-	})
+	buildInfo   atomic.Pointer[[3]string] // version, commit, date
 	readinessMu sync.RWMutex
 	readinessFn func() bool
+	handlersMu  sync.Mutex
+	handlers    []extraHandler
 )
 
+// extraHandler is an additional endpoint mounted by StartHTTP.
+type extraHandler struct {
+	pattern string
+	h       http.Handler
+}
+
 // Error label constants (stable label values to bound cardinality)
 const (
 	ErrTCPRead        = "tcp_read"
@@ -88,184 +30,562 @@ const (
 	ErrHandshake      = "handshake"
 	ErrSerialWrite    = "serial_write"
 	ErrSerialOverflow = "serial_tx_overflow"
+	ErrSerialRTR      = "serial_rtr_unsupported"
 	ErrSocketCANWrite = "socketcan_write"
 	ErrSocketCANOver  = "socketcan_tx_overflow"
+	ErrSocketCANNoBuf = "socketcan_enobufs"
 	ErrSerialRead     = "serial_read"
 	ErrSocketCANRead  = "socketcan_read"
+	ErrUDPRead        = "cannelloni_udp_read"
+	ErrUDPWrite       = "cannelloni_udp_write"
+	ErrUDPOverflow    = "cannelloni_udp_tx_overflow"
+	ErrSLCANWrite     = "slcan_write"
+	ErrSLCANOverflow  = "slcan_tx_overflow"
+	ErrSLCANReply     = "slcan_error_reply"
+	ErrReplayWrite    = "replay_tx_write"
+	ErrReplayOverflow = "replay_tx_overflow"
+	ErrUpstreamTx     = "upstream_tx_overflow"
+	ErrUpstreamRx     = "upstream_rx_overflow"
+	ErrUpstreamPing   = "upstream_ping_timeout"
+	ErrMetricsBind    = "metrics_bind"
+	ErrAlertWebhook   = "alert_webhook"
+	ErrStore          = "store"
+	ErrBackendRestart = "backend_restart"
+	ErrTLSHandshake   = "tls_handshake"
+	ErrCapture        = "capture"
+	ErrSessionSync    = "session_sync"
 )
 
-// StartHTTP serves Prometheus metrics at /metrics on the given mux.
-// If mux is nil, a default mux is created and registered.
-func StartHTTP(addr string) *http.Server {
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
-		if IsReady() {
-			w.WriteHeader(http.StatusOK)
-			_, _ = w.Write([]byte("ready\n"))
-			return
-		}
-		w.WriteHeader(http.StatusServiceUnavailable)
-		_, _ = w.Write([]byte("not ready\n"))
-	})
-
-	srv := &http.Server{
-		Addr:    addr,
-		Handler: mux,
-	}
-	go func() {
-		logging.L().Info("metrics_listen", "addr", addr)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logging.L().Error("metrics_http_error", "error", err)
-		}
-	}()
-	return srv
-}
+// Flush trigger label values.
+const (
+	FlushSize     = "size"     // batch reached batch-size
+	FlushTimer    = "timer"    // flush-interval ticker fired
+	FlushClose    = "close"    // client or server shutting down
+	FlushPong     = "pong"     // ping answer sent without waiting for the ticker
+	FlushCompress = "compress" // written plain before the stream switches compression
+	FlushRTR      = "rtr"      // written before remote requests switch form (OpRTR)
+)
 
-// Local mirrored counters for easy logging (avoid Prometheus scraping in-process)
-var (
-	localSerialRx    uint64
-	localSerialTx    uint64
-	localSocketCANTx uint64
-	localSocketCANRx uint64
-	localTCPRx       uint64
-	localTCPTx       uint64
-	localHubDrop     uint64
-	localHubKick     uint64
-	localHubReject   uint64
-	localErrors      uint64
-	localHubClients  uint64
-	localFanout      uint64
-	localMalformed   uint64
-	localQDMax       uint64
-	localQDAvg       uint64
+// Bridge loop reason label values.
+const (
+	LoopOrigin = "origin" // frame would return to the instance it came from
+	LoopTTL    = "ttl"    // frame exceeded the bridge hop limit
 )
 
-// Snapshot is a cheap copy of local counters.
+// Connection limit label values.
+const (
+	LimitDecodeBytes    = "decode_bytes"    // one frame needed more bytes than allowed
+	LimitBurstFrames    = "burst_frames"    // reader yielded after a full burst
+	LimitHandshakeBytes = "handshake_bytes" // handshake needed more bytes than allowed
+)
+
+// Client session result label values.
+const (
+	SessionNew      = "new"      // session opened (or unknown token)
+	SessionResumed  = "resumed"  // parked session resumed within the grace period
+	SessionExpired  = "expired"  // parked session dropped after the grace period
+	SessionMigrated = "migrated" // session imported from a peer gateway resumed after failover
+)
+
+// Arbitration state label values.
+const (
+	ArbitrationActive  = "active"
+	ArbitrationStandby = "standby"
+)
+
+// Heartbeat target label values.
+const (
+	HeartbeatBus     = "bus"
+	HeartbeatClients = "clients"
+)
+
+// Flow-control hint level label values.
+const (
+	FlowOK   = "ok"
+	FlowSlow = "slow"
+	FlowStop = "stop"
+)
+
+// Filter path label values.
+const (
+	FilterRX = "rx"
+	FilterTX = "tx"
+)
+
+// Handle registers an additional endpoint (e.g. admin API) served by the
+// metrics HTTP server next to /metrics. Must be called before StartHTTP.
+func Handle(pattern string, h http.Handler) {
+	handlersMu.Lock()
+	handlers = append(handlers, extraHandler{pattern: pattern, h: h})
+	handlersMu.Unlock()
+}
+
+// Snapshot is a cheap copy of the counter store.
 type Snapshot struct {
-	SerialRx      uint64
-	SocketCANRx   uint64
-	SerialTx      uint64
-	SocketCANTx   uint64
-	TCPRx         uint64
-	TCPTx         uint64
-	HubDrops      uint64
-	HubKicks      uint64
-	HubRejects    uint64
-	Errors        uint64 // sum across error labels
-	HubClients    uint64
-	Fanout        uint64
-	Malformed     uint64
-	QueueDepthMax uint64
-	QueueDepthAvg uint64
+	SerialRx         uint64
+	SocketCANRx      uint64
+	SocketCANOwn     uint64 // own transmissions looped back, not in SocketCANRx
+	SocketCANLatency uint64 // smoothed kernel-to-read latency, microseconds
+	SerialTx         uint64
+	SocketCANTx      uint64
+	SocketCANKDrop   uint64 // frames dropped by the kernel after the write succeeded
+	UDPRx            uint64
+	UDPTx            uint64
+	ReplayRx         uint64
+	ReplayTx         uint64
+	UpstreamRx       uint64
+	UpstreamTx       uint64
+	TCPRx            uint64
+	TCPTx            uint64
+	HubDrops         uint64
+	HubKicks         uint64
+	HubRejects       uint64
+	Errors           uint64 // sum across error labels
+	HubClients       uint64
+	Fanout           uint64
+	Malformed        uint64
+	Filtered         uint64
+	QueueDepthMax    uint64
+	QueueDepthAvg    uint64
+	Flushes          uint64 // client writer flushes (all triggers)
+	FlushedFrames    uint64 // frames written by those flushes
+	Bridged          uint64
+	BridgeLoops      uint64 // sum across loop reasons
+	LimitHits        uint64 // sum across connection limits
+	QueueMemory      uint64 // hub + backend queued bytes at the last sample
+	PressureDrops    uint64
+	ClientReads      uint64 // client socket reads
+	ClientReadB      uint64 // bytes returned by those reads
+	ReaderYields     uint64
+	ReaderStarved    uint64
+	BackendRxStalls  uint64
+	BackendRestarts  uint64
+	CompressRaw      uint64 // client stream bytes before compression
+	CompressWire     uint64 // the same bytes as written after compression
+	CompressFallback uint64
+	ClientFiltered   uint64 // frames withheld by client receive filters
+	SerialNoChecksum uint64 // 1 while serial checksums are off
+	Invalid          uint64 // sum across validation rules
+	Normalized       uint64 // sum across normalization changes
+	Blocked          uint64 // sum across block paths
+	AccessDenied     uint64 // sum across permissions
+	TxInhibited      uint64
+	TxDeduped        uint64
+	StandbyDropped   uint64 // client frames dropped on the standby gateway
+	TxDryRun         uint64
+	Emulated         uint64
 }
 
 func Snap() Snapshot {
 	return Snapshot{
-		SerialRx:      atomic.LoadUint64(&localSerialRx),
-		SocketCANRx:   atomic.LoadUint64(&localSocketCANRx),
-		SerialTx:      atomic.LoadUint64(&localSerialTx),
-		SocketCANTx:   atomic.LoadUint64(&localSocketCANTx),
-		TCPRx:         atomic.LoadUint64(&localTCPRx),
-		TCPTx:         atomic.LoadUint64(&localTCPTx),
-		HubDrops:      atomic.LoadUint64(&localHubDrop),
-		HubKicks:      atomic.LoadUint64(&localHubKick),
-		HubRejects:    atomic.LoadUint64(&localHubReject),
-		Errors:        atomic.LoadUint64(&localErrors),
-		HubClients:    atomic.LoadUint64(&localHubClients),
-		Fanout:        atomic.LoadUint64(&localFanout),
-		Malformed:     atomic.LoadUint64(&localMalformed),
-		QueueDepthMax: atomic.LoadUint64(&localQDMax),
-		QueueDepthAvg: atomic.LoadUint64(&localQDAvg),
+		SerialRx:         serialRx.load(),
+		SocketCANRx:      socketCANRx.load(),
+		SocketCANOwn:     socketCANRxOwn.load(),
+		SocketCANLatency: canLatency.load(),
+		SerialTx:         serialTx.load(),
+		SocketCANTx:      socketCANTx.load(),
+		SocketCANKDrop:   socketCANKDrop.load(),
+		UDPRx:            udpRx.load(),
+		UDPTx:            udpTx.load(),
+		ReplayRx:         replayRx.load(),
+		ReplayTx:         replayTx.load(),
+		UpstreamRx:       upstreamRx.load(),
+		UpstreamTx:       upstreamTx.load(),
+		TCPRx:            tcpRx.load(),
+		TCPTx:            tcpTx.load(),
+		HubDrops:         hubDropped.load(),
+		HubKicks:         hubKicked.load(),
+		HubRejects:       hubRejected.load(),
+		Errors:           errorsByWhere.sum(),
+		HubClients:       hubClients.load(),
+		Fanout:           hubFanout.load(),
+		Malformed:        malformed.load(),
+		Filtered:         filteredBy.sum(),
+		QueueDepthMax:    hubQDMax.load(),
+		QueueDepthAvg:    hubQDAvg.load(),
+		Flushes:          flushFrames.count.Load(),
+		FlushedFrames:    flushFrames.sum.Load(),
+		Bridged:          bridged.load(),
+		BridgeLoops:      bridgeLoops.sum(),
+		LimitHits:        limitHits.sum(),
+		QueueMemory:      memHub.load() + memBackend.load(),
+		PressureDrops:    memShed.load(),
+		ClientReads:      readBytes.count.Load(),
+		ClientReadB:      readBytes.sum.Load(),
+		ReaderYields:     readerYield.count.Load(),
+		ReaderStarved:    starved.load(),
+		BackendRxStalls:  rxStalls.load(),
+		BackendRestarts:  restarts.load(),
+		CompressRaw:      compressRaw.load(),
+		CompressWire:     compressWire.load(),
+		CompressFallback: compressOff.load(),
+		ClientFiltered:   clientFiltered.load(),
+		SerialNoChecksum: serialNoSum.load(),
+		Invalid:          invalidBy.sum(),
+		Normalized:       normalizedBy.sum(),
+		Blocked:          blockedBy.sum(),
+		AccessDenied:     deniedBy.sum(),
+		TxInhibited:      txInhibited.load(),
+		TxDeduped:        dedup.load(),
+		StandbyDropped:   arbDropped.load(),
+		TxDryRun:         txDryRun.load(),
+		Emulated:         emulated.load(),
 	}
 }
 
 // Wrapper helpers to keep call sites simple.
-func IncSerialRx() {
-	SerialRxFrames.Inc()
-	atomic.AddUint64(&localSerialRx, 1)
-}
+func IncSerialRx() { serialRx.add(1) }
 
 // IncSocketCANRx increments SocketCAN receive counters.
-func IncSocketCANRx() {
-	SocketCANRxFrames.Inc()
-	atomic.AddUint64(&localSocketCANRx, 1)
-}
+func IncSocketCANRx() { socketCANRx.add(1) }
 
-func IncSerialTx() {
-	SerialTxFrames.Inc()
-	atomic.AddUint64(&localSerialTx, 1)
-}
+// SetSocketCANLatency records the smoothed SocketCAN RX latency.
+func SetSocketCANLatency(d time.Duration) { canLatency.set(uint64(d / time.Microsecond)) }
+
+// IncSocketCANRxOwn counts a received frame the gateway transmitted itself.
+func IncSocketCANRxOwn() { socketCANRxOwn.add(1) }
+
+func IncSerialTx() { serialTx.add(1) }
 
 // IncSocketCANTx increments SocketCAN transmit counters.
-func IncSocketCANTx() {
-	SocketCANTxFrames.Inc()
-	atomic.AddUint64(&localSocketCANTx, 1)
-}
+func IncSocketCANTx() { socketCANTx.add(1) }
+
+// AddSocketCANKernelTxDrops counts frames the kernel dropped on the
+// SocketCAN TX path after the write succeeded.
+func AddSocketCANKernelTxDrops(n uint64) { socketCANKDrop.add(n) }
+
+// SetSocketCANTxQueueLen records the kernel TX queue length of iface.
+func SetSocketCANTxQueueLen(iface string, n int) { canTxQLen.set(iface, uint64(n)) }
+
+// IncUDPRx increments cannelloni UDP receive counters.
+func IncUDPRx() { udpRx.add(1) }
+
+// IncUDPTx increments cannelloni UDP transmit counters.
+func IncUDPTx() { udpTx.add(1) }
+
+// IncReplayRx counts a frame played back by the replay backend.
+func IncReplayRx() { replayRx.add(1) }
 
-func IncTCPRx() {
-	TCPRxFrames.Inc()
-	atomic.AddUint64(&localTCPRx, 1)
+// IncReplayTx counts a client frame captured by the replay backend.
+func IncReplayTx() { replayTx.add(1) }
+
+// IncUpstreamRx counts a frame relayed from the upstream server.
+func IncUpstreamRx() { upstreamRx.add(1) }
+
+// IncUpstreamTx counts a frame relayed to the upstream server.
+func IncUpstreamTx() { upstreamTx.add(1) }
+
+// AddUpstreamRxDropped counts frames from the upstream server that did not
+// fit the relay queue.
+func AddUpstreamRxDropped(n uint64) { errorsByWhere.add(ErrUpstreamRx, n) }
+
+// SetUpstreamConnected records whether the relay backend is connected to
+// the upstream server at addr.
+func SetUpstreamConnected(addr string, up bool) {
+	var v uint64
+	if up {
+		v = 1
+	}
+	upstreamUp.set(addr, v)
 }
 
-func AddTCPTx(n int) {
-	TCPTxFrames.Add(float64(n))
-	atomic.AddUint64(&localTCPTx, uint64(n))
+func IncTCPRx() { tcpRx.add(1) }
+
+func AddTCPTx(n int) { tcpTx.add(uint64(n)) }
+
+func IncHubDrop() { hubDropped.add(1) }
+
+func IncHubKick() { hubKicked.add(1) }
+
+func IncHubReject() { hubRejected.add(1) }
+
+// IncConnRateLimited counts a connection closed by the per-IP rate limit;
+// banned marks the attempt that started a ban.
+func IncConnRateLimited(banned bool) {
+	connRateLimited.add(1)
+	if banned {
+		connRateBans.add(1)
+	}
 }
 
-func IncHubDrop() {
-	HubDroppedFrames.Inc()
-	atomic.AddUint64(&localHubDrop, 1)
+func SetHubClients(n int) { hubClients.set(uint64(n)) }
+
+func SetBroadcastFanout(n int) { hubFanout.set(uint64(n)) }
+
+func IncError(label string) { errorsByWhere.inc(label) }
+
+// ErrorsOf returns the errors_total count of the given subsystems.
+func ErrorsOf(labels ...string) uint64 { return errorsByWhere.of(labels...) }
+
+// SetSerialChecksumDisabled reports whether a serial backend runs without
+// checksums.
+func SetSerialChecksumDisabled(off bool) {
+	var v uint64
+	if off {
+		v = 1
+	}
+	serialNoSum.set(v)
 }
 
-func IncHubKick() {
-	HubKickedClients.Inc()
-	atomic.AddUint64(&localHubKick, 1)
+// IncTxPriority counts a frame queued on a backend priority TX queue.
+func IncTxPriority() { txPriority.add(1) }
+
+// IncArbitrationDropped counts a client frame dropped while the gateway is
+// on standby.
+func IncArbitrationDropped() { arbDropped.add(1) }
+
+// IncArbitrationTransition counts a change of the arbitration state
+// (ArbitrationActive|ArbitrationStandby).
+func IncArbitrationTransition(state string) { arbTransitions.inc(state) }
+
+// SetArbitrationActive records how many instances are the active gateway of
+// their bus.
+func SetArbitrationActive(n int) { arbActive.set(uint64(n)) }
+
+// IncFrameBlocked counts a frame dropped by the administrative block list
+// on path (FilterRX|FilterTX).
+func IncFrameBlocked(path string) { blockedBy.inc(path) }
+
+// SetFrameBlocks records how many CAN ID blocks are active.
+func SetFrameBlocks(n int) { blocksOn.set(uint64(n)) }
+
+// IncHeartbeat counts a heartbeat frame sent to target
+// (HeartbeatBus|HeartbeatClients).
+func IncHeartbeat(target string) { heartbeats.inc(target) }
+
+// IncHeartbeatDropped counts a bus heartbeat the transmit path rejected.
+func IncHeartbeatDropped() { hbDropped.add(1) }
+
+// IncAuditDivergence counts a counter audit check (see internal/audit)
+// whose frames went unaccounted beyond the tolerance.
+func IncAuditDivergence(check string) { auditDiverged.inc(check) }
+
+// IncFlowHint counts a flow-control hint sent to a client at level
+// (FlowOK|FlowSlow|FlowStop).
+func IncFlowHint(level string) { flowHints.inc(level) }
+
+// IncTxInhibited counts a client frame dropped while TX is inhibited.
+func IncTxInhibited() { txInhibited.add(1) }
+
+// SetTxInhibitActive records how many instances currently inhibit TX.
+func SetTxInhibitActive(n int) { inhibitOn.set(uint64(n)) }
+
+// IncTxDryRun counts a client frame withheld from the backend by dry-run mode.
+func IncTxDryRun() { txDryRun.add(1) }
+
+// IncBackendRxStall counts a backend RX loop reported stalled by the watchdog.
+func IncBackendRxStall() { rxStalls.add(1) }
+
+// IncBackendRestart counts a backend reopened by the RX watchdog.
+func IncBackendRestart() { restarts.add(1) }
+
+// AddCompressed counts raw client stream bytes written as wire bytes
+// after compression.
+func AddCompressed(raw, wire int) {
+	compressRaw.add(uint64(raw))
+	compressWire.add(uint64(wire))
 }
 
-func IncHubReject() {
-	HubRejectedClients.Inc()
-	atomic.AddUint64(&localHubReject, 1)
+// IncCompressFallback counts a client whose compression was turned off.
+func IncCompressFallback() { compressOff.add(1) }
+
+// IncClientFiltered counts a frame withheld by a client's receive filter.
+func IncClientFiltered() { clientFiltered.add(1) }
+
+// IncEmulated counts a response frame of an emulated device.
+func IncEmulated() { emulated.add(1) }
+
+// IncDedupSuppressed counts a TX frame collapsed by the dedup stage.
+func IncDedupSuppressed() { dedup.add(1) }
+
+// IncBridgeForwarded counts a frame forwarded by a bridge route.
+func IncBridgeForwarded() { bridged.add(1) }
+
+// IncBridgeLoop counts a bridged frame dropped by loop prevention.
+func IncBridgeLoop(reason string) { bridgeLoops.inc(reason) }
+
+// AddStoreWritten counts frames written to the history store.
+func AddStoreWritten(n int) { storeWritten.add(uint64(n)) }
+
+// IncStoreDropped counts a frame the history store could not queue.
+func IncStoreDropped() { storeDropped.add(1) }
+
+// AddStoreDropped counts frames lost by a failed history store write.
+func AddStoreDropped(n int) { storeDropped.add(uint64(n)) }
+
+// IncMQTTPublished counts a frame published to the MQTT broker.
+func IncMQTTPublished() { mqttPublished.add(1) }
+
+// IncMQTTDropped counts a frame dropped because the MQTT queue was full.
+func IncMQTTDropped() { mqttDropped.add(1) }
+
+// IncMQTTTx counts a frame received from the MQTT TX topic and sent to the bus.
+func IncMQTTTx() { mqttTx.add(1) }
+
+// IncMQTTTxRejected counts a message on the MQTT TX topic that was not sent,
+// by reason.
+func IncMQTTTxRejected(reason string) { mqttTxRejected.inc(reason) }
+
+// SetMQTTConnected records whether the MQTT broker connection is up.
+func SetMQTTConnected(up bool) {
+	var v uint64
+	if up {
+		v = 1
+	}
+	mqttUp.set(v)
 }
 
-func SetHubClients(n int) {
-	HubActiveClients.Set(float64(n))
-	atomic.StoreUint64(&localHubClients, uint64(n))
+// IncAlert counts an alert fired by rule.
+func IncAlert(rule string) { alertsFired.inc(rule) }
+
+// IncLimitHit counts a per-connection protocol limit being hit.
+func IncLimitHit(limit string) { limitHits.inc(limit) }
+
+// IncSniffed counts a connection on a shared client port by protocol.
+func IncSniffed(protocol string) { sniffedBy.inc(protocol) }
+
+// IncCaptureTrigger counts a triggered capture by reason (frame|error|drops).
+func IncCaptureTrigger(reason string) { captureTrigs.inc(reason) }
+
+// IncRxPipelineStall counts a wait for room in the queue of an RX pipeline stage.
+func IncRxPipelineStall(stage string) { pipeStalls.inc(stage) }
+
+// RxPipelineTake counts an item taken by an RX pipeline stage and records
+// the depth of its queue.
+func RxPipelineTake(stage string, depth int) {
+	pipeItems.inc(stage)
+	pipeDepth.set(stage, uint64(depth))
 }
 
-func SetBroadcastFanout(n int) {
-	HubBroadcastFanout.Set(float64(n))
-	atomic.StoreUint64(&localFanout, uint64(n))
+// IncCANErrorFrame counts an error frame of one class (tx-timeout|lostarb|crtl|...).
+func IncCANErrorFrame(class string) { canErrFrames.inc(class) }
+
+// AddCannelloniLost counts n cannelloni packets lost before one received
+// from source (tcp|udp).
+func AddCannelloniLost(source string, n int) { cnlLost.add(source, uint64(n)) }
+
+// IncNormalized counts a frame changed or dropped by normalization.
+func IncNormalized(change string) { normalizedBy.inc(change) }
+
+// NormalizedOf returns the frames_normalized_total count of the given
+// changes.
+func NormalizedOf(changes ...string) uint64 { return normalizedBy.of(changes...) }
+
+// IncClockStep counts a wall clock step by direction (forward|backward).
+func IncClockStep(direction string) { clockSteps.inc(direction) }
+
+// IncSession counts a client session event (SessionNew|SessionResumed|SessionExpired|SessionMigrated).
+func IncSession(result string) { sessionsBy.inc(result) }
+
+// SetSessionsStandby records the number of sessions imported from a peer
+// gateway that no client has resumed here yet.
+func SetSessionsStandby(n int) { sessStandby.set(uint64(n)) }
+
+// SetSessionsParked records the number of sessions waiting for their client.
+func SetSessionsParked(n int) { sessParked.set(uint64(n)) }
+
+// IncInvalidFrame counts a frame violating a validation rule.
+func IncInvalidFrame(rule string) { invalidBy.inc(rule) }
+
+// IncAccessDenied counts a request refused because the caller's role lacks perm.
+func IncAccessDenied(perm string) { deniedBy.inc(perm) }
+
+// IncFiltered counts a frame rejected by a backend filter on path (FilterRX|FilterTX).
+func IncFiltered(path string) { filteredBy.inc(path) }
+
+// IncTransformed counts a frame rewritten by a backend transform on path (FilterRX|FilterTX).
+func IncTransformed(path string) { transformedBy.inc(path) }
+
+var txAckStatus = [...]string{"ok", "overflow", "denied", "error", "inhibited"}
+
+// IncTxAck counts a TX acknowledgement by cannelloni ack status code.
+func IncTxAck(status byte) {
+	label := "unknown"
+	if int(status) < len(txAckStatus) {
+		label = txAckStatus[status]
+	}
+	txAcksBy.inc(label)
 }
 
-func IncError(label string) {
-	Errors.WithLabelValues(label).Inc()
-	atomic.AddUint64(&localErrors, 1)
+func IncMalformed() { malformed.add(1) }
+
+// ObserveFlush records one writer flush of n frames that took d.
+func ObserveFlush(n int, d time.Duration, trigger string) {
+	flushFrames.observe(uint64(n))
+	flushDuration.observe(uint64(d))
+	flushesBy.inc(trigger)
 }
 
-func IncMalformed() {
-	MalformedFrames.Inc()
-	atomic.AddUint64(&localMalformed, 1)
+// AddEncodeCache counts frames written through the shared client encoding
+// cache: hits reused an encoding, misses encoded and published one.
+func AddEncodeCache(hits, misses int) {
+	if hits > 0 {
+		encodeCacheBy.add("hit", uint64(hits))
+	}
+	if misses > 0 {
+		encodeCacheBy.add("miss", uint64(misses))
+	}
 }
 
 // SetQueueDepth records a snapshot of max and avg queue depth.
 func SetQueueDepth(max, avg int) {
-	HubQueueDepthMax.Set(float64(max))
-	HubQueueDepthAvg.Set(float64(avg))
-	atomic.StoreUint64(&localQDMax, uint64(max))
-	atomic.StoreUint64(&localQDAvg, uint64(avg))
+	hubQDMax.set(uint64(max))
+	hubQDAvg.set(uint64(avg))
+}
+
+// ObserveClientRead records one client socket read returning n bytes.
+func ObserveClientRead(n int) { readBytes.observe(uint64(n)) }
+
+// ObserveReadBurst records the frames decoded in one reader iteration.
+func ObserveReadBurst(frames int) { readFrames.observe(uint64(frames)) }
+
+// ObserveReaderYield records how long a reader paused after a full burst.
+func ObserveReaderYield(d time.Duration) { readerYield.observe(uint64(d)) }
+
+// IncReaderStarved counts a reader yield that overran by the starvation threshold.
+func IncReaderStarved() { starved.add(1) }
+
+// SetQueueMemory records queued frame memory, its limit and whether queues
+// are shedding load.
+func SetQueueMemory(hub, backend, limit int64, pressure bool) {
+	memHub.set(uint64(hub))
+	memBackend.set(uint64(backend))
+	memLimit.set(uint64(limit))
+	var p uint64
+	if pressure {
+		p = 1
+	}
+	memPress.set(p)
+}
+
+// IncPressureDrop counts a frame dropped under memory pressure.
+func IncPressureDrop() { memShed.add(1) }
+
+// buildCollector exports build_info once InitBuildInfo has been called.
+type buildCollector struct{ desc *prometheus.Desc }
+
+func newBuildCollector(r *registration) *buildCollector {
+	return &buildCollector{r.desc("build_info", "Build metadata (value is always 1).", "version", "commit", "date")}
+}
+
+func (c *buildCollector) Describe(ch chan<- *prometheus.Desc) { ch <- c.desc }
+
+func (c *buildCollector) Collect(ch chan<- prometheus.Metric) {
+	if b := buildInfo.Load(); b != nil {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 1, b[0], b[1], b[2])
+	}
 }
 
 // InitBuildInfo sets the build info gauge (should be called once at startup).
 func InitBuildInfo(version, commit, date string) {
-	BuildInfo.WithLabelValues(version, commit, date).Set(1)
+	buildInfo.Store(&[3]string{version, commit, date})
 	// Pre-register common error label series so first error does not log a registration latency.
 	for _, lbl := range []string{
 		ErrTCPRead, ErrTCPWrite, ErrHandshake,
 		ErrSerialWrite, ErrSerialOverflow, ErrSerialRead,
-		ErrSocketCANWrite, ErrSocketCANOver, ErrSocketCANRead,
+		ErrSocketCANWrite, ErrSocketCANOver, ErrSocketCANNoBuf, ErrSocketCANRead,
 	} {
-		Errors.WithLabelValues(lbl).Add(0)
+		errorsByWhere.with(lbl)
 	}
 }
 
@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Option configures Register.
+type Option func(*registration)
+
+type registration struct {
+	reg    prometheus.Registerer
+	ns     string
+	labels prometheus.Labels
+}
+
+// WithRegisterer registers the metrics with r instead of
+// prometheus.DefaultRegisterer. When r is also a prometheus.Gatherer (a
+// *prometheus.Registry is), /metrics of StartHTTP serves it.
+func WithRegisterer(r prometheus.Registerer) Option {
+	return func(c *registration) { c.reg = r }
+}
+
+// WithNamespace prefixes every exported name with ns and an underscore
+// (e.g. "gateway" exports gateway_serial_rx_frames_total).
+func WithNamespace(ns string) Option {
+	return func(c *registration) { c.ns = ns }
+}
+
+// WithConstLabels adds labels (e.g. site="home") to every exported
+// series, so several gateways scraped into one Prometheus can be told
+// apart without relabeling. See ParseLabels for the accepted names.
+func WithConstLabels(l prometheus.Labels) Option {
+	return func(c *registration) { c.labels = l }
+}
+
+var nameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// CheckNamespace validates a WithNamespace prefix ("" is none).
+func CheckNamespace(ns string) error {
+	if ns != "" && !nameRE.MatchString(ns) {
+		return fmt.Errorf("namespace %q: want letters, digits and underscores, not starting with a digit", ns)
+	}
+	return nil
+}
+
+// reservedLabels are the label names of the gateway series themselves; a
+// constant label of the same name would make them invalid.
+func reservedLabels() map[string]bool {
+	r := map[string]bool{"instance": true, "client": true, "version": true, "commit": true, "date": true, "le": true}
+	for _, l := range storeLabeled {
+		r[l.label] = true
+	}
+	return r
+}
+
+// ParseLabels parses constant labels for WithConstLabels from a comma
+// separated list of name=value pairs (e.g. "site=home,bus=main"). Names
+// used by the gateway series (instance, where, ...) are rejected.
+func ParseLabels(spec string) (prometheus.Labels, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	reserved := reservedLabels()
+	out := prometheus.Labels{}
+	for _, kv := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		switch {
+		case !ok || v == "":
+			return nil, fmt.Errorf("label %q: want name=value", kv)
+		case !nameRE.MatchString(k) || strings.HasPrefix(k, "__"):
+			return nil, fmt.Errorf("label name %q is not valid", k)
+		case reserved[k]:
+			return nil, fmt.Errorf("label name %q is used by gateway series", k)
+		}
+		if _, dup := out[k]; dup {
+			return nil, fmt.Errorf("label %q set twice", k)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+var (
+	regMu    sync.Mutex
+	regDone  bool
+	gatherer prometheus.Gatherer // nil: prometheus.DefaultGatherer
+)
+
+func (c *registration) desc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(c.ns, "", name), help, labels, c.labels)
+}
+
+// Register exports the package metrics to Prometheus. StartHTTP registers
+// with the defaults when it has not succeeded before. A name clash with metrics already in the registry (e.g. when the gateway
+// is embedded in another program) is returned as an error and leaves
+// nothing of this package registered; the counters keep working and Snap
+// still reads them.
+func Register(opts ...Option) error {
+	c := registration{reg: prometheus.DefaultRegisterer}
+	for _, o := range opts {
+		o(&c)
+	}
+	regMu.Lock()
+	defer regMu.Unlock()
+	cs := []prometheus.Collector{newStoreCollector(&c), newInstanceCollector(&c), newRTTCollector(&c), newCyclicCollector(&c), newBuildCollector(&c)}
+	for i, col := range cs {
+		if err := c.reg.Register(col); err != nil {
+			for _, prev := range cs[:i] {
+				c.reg.Unregister(prev)
+			}
+			return fmt.Errorf("metrics: register: %w", err)
+		}
+	}
+	regDone = true
+	if g, ok := c.reg.(prometheus.Gatherer); ok && c.reg != prometheus.DefaultRegisterer {
+		gatherer = g
+	}
+	return nil
+}
+
+// registerDefault registers with the defaults unless Register already ran.
+// A clash is logged and the server runs without the package metrics on
+// /metrics rather than panicking.
+func registerDefault() {
+	regMu.Lock()
+	done := regDone
+	regMu.Unlock()
+	if done {
+		return
+	}
+	if err := Register(); err != nil {
+		logging.L().Warn("metrics_register_error", "error", err)
+	}
+}
+
+// registeredGatherer returns the gatherer /metrics serves.
+func registeredGatherer() prometheus.Gatherer {
+	regMu.Lock()
+	defer regMu.Unlock()
+	return gatherer
+}
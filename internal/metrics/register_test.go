@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func names(t *testing.T, g prometheus.Gatherer) map[string]bool {
+	t.Helper()
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	out := make(map[string]bool, len(mfs))
+	for _, mf := range mfs {
+		out[mf.GetName()] = true
+	}
+	return out
+}
+
+// resetGatherer restores the /metrics gatherer after a test registered
+// with its own registry.
+func resetGatherer(t *testing.T) {
+	t.Cleanup(func() {
+		regMu.Lock()
+		gatherer = nil
+		regMu.Unlock()
+	})
+}
+
+func TestRegisterNamespace(t *testing.T) {
+	resetGatherer(t)
+	reg := prometheus.NewRegistry()
+	if err := Register(WithRegisterer(reg), WithNamespace("gw")); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	IncSerialRx()
+	got := names(t, reg)
+	if !got["gw_serial_rx_frames_total"] || got["serial_rx_frames_total"] {
+		t.Fatalf("namespaced series missing: %v", got)
+	}
+	if err := Register(WithRegisterer(reg), WithNamespace("gw")); err == nil {
+		t.Fatal("second registration in the same registry succeeded")
+	}
+}
+
+func TestRegisterClash(t *testing.T) {
+	resetGatherer(t)
+	reg := prometheus.NewRegistry()
+	// The host program already exports a build_info of its own.
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "build_info", Help: "Host build."}))
+	if err := Register(WithRegisterer(reg)); err == nil {
+		t.Fatal("clash not reported")
+	}
+	if got := names(t, reg); got["serial_rx_frames_total"] || !got["build_info"] {
+		t.Fatalf("partial registration left behind: %v", got)
+	}
+	if err := Register(WithRegisterer(reg), WithNamespace("gw")); err != nil {
+		t.Fatalf("namespaced registration next to the host metrics: %v", err)
+	}
+}
+
+func TestConstLabels(t *testing.T) {
+	resetGatherer(t)
+	labels, err := ParseLabels("site=home, bus=main")
+	if err != nil || labels["site"] != "home" || labels["bus"] != "main" {
+		t.Fatalf("ParseLabels = %v, %v", labels, err)
+	}
+	for _, bad := range []string{"site", "site=", "1x=a", "__x=a", "instance=a", "where=a", "a=1,a=2"} {
+		if _, err := ParseLabels(bad); err == nil {
+			t.Errorf("ParseLabels(%q) accepted", bad)
+		}
+	}
+	reg := prometheus.NewRegistry()
+	if err := Register(WithRegisterer(reg), WithConstLabels(labels)); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	IncError(ErrTCPRead)
+	mfs, _ := reg.Gather()
+	for _, mf := range mfs {
+		if mf.GetName() != "errors_total" {
+			continue
+		}
+		got := map[string]string{}
+		for _, lp := range mf.GetMetric()[0].GetLabel() {
+			got[lp.GetName()] = lp.GetValue()
+		}
+		if got["site"] != "home" || got["bus"] != "main" || got["where"] == "" {
+			t.Fatalf("errors_total labels = %v", got)
+		}
+		return
+	}
+	t.Fatal("errors_total not exported")
+}
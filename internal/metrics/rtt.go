@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type rttSample struct {
+	identity string
+	rtt      time.Duration
+}
+
+// Client round-trip times reported in OpPing, keyed by client remote address.
+var (
+	rttMu sync.Mutex
+	rttBy = map[string]rttSample{}
+)
+
+type rttCollector struct{ desc *prometheus.Desc }
+
+func newRTTCollector(r *registration) *rttCollector {
+	return &rttCollector{r.desc("client_rtt_seconds", "Last round-trip time reported by a connected client in its ping, by remote address and identity.", "client", "identity")}
+}
+
+func (c *rttCollector) Describe(ch chan<- *prometheus.Desc) { ch <- c.desc }
+
+func (c *rttCollector) Collect(ch chan<- prometheus.Metric) {
+	rttMu.Lock()
+	defer rttMu.Unlock()
+	for client, s := range rttBy {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, s.rtt.Seconds(), client, s.identity)
+	}
+}
+
+// SetClientRTT records the round-trip time reported by client, named
+// identity by its access rule or certificate.
+func SetClientRTT(client, identity string, d time.Duration) {
+	rttMu.Lock()
+	rttBy[client] = rttSample{identity: identity, rtt: d}
+	rttMu.Unlock()
+}
+
+// ForgetClientRTT drops the series of a disconnected client.
+func ForgetClientRTT(client string) {
+	rttMu.Lock()
+	delete(rttBy, client)
+	rttMu.Unlock()
+}
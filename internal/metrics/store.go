@@ -0,0 +1,288 @@
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The counter store is the single source of truth for process-wide
+// counters and gauges. Hot paths do exactly one atomic add; Prometheus
+// reads the same values through storeCollector at scrape time and Snap
+// reads them for logging, so the two views cannot drift.
+
+// Series keep their name and help only; the Prometheus descriptors are
+// built when the store is registered (see Register), so the exported names
+// can carry a namespace.
+
+// value is one unlabelled series in the store.
+type value struct {
+	name, help string
+	kind       prometheus.ValueType
+	v          atomic.Uint64
+}
+
+func newCounter(name, help string) *value {
+	return &value{name: name, help: help, kind: prometheus.CounterValue}
+}
+
+func newGauge(name, help string) *value {
+	return &value{name: name, help: help, kind: prometheus.GaugeValue}
+}
+
+func (c *value) add(n uint64) { c.v.Add(n) }
+func (c *value) set(n uint64) { c.v.Store(n) }
+func (c *value) load() uint64 { return c.v.Load() }
+func (c *value) metric(d *prometheus.Desc) prometheus.Metric {
+	return prometheus.MustNewConstMetric(d, c.kind, float64(c.v.Load()))
+}
+
+// labeled is a counter (or gauge) with a single bounded label. Series are
+// created on first use and never removed; lookups of existing labels are
+// lock-free.
+type labeled struct {
+	name, help, label string
+	kind              prometheus.ValueType
+	series            sync.Map // label -> *atomic.Uint64
+}
+
+func newLabeled(name, help, label string) *labeled {
+	return &labeled{name: name, help: help, label: label, kind: prometheus.CounterValue}
+}
+
+func newLabeledGauge(name, help, label string) *labeled {
+	return &labeled{name: name, help: help, label: label, kind: prometheus.GaugeValue}
+}
+
+func (l *labeled) with(label string) *atomic.Uint64 {
+	if c, ok := l.series.Load(label); ok {
+		return c.(*atomic.Uint64)
+	}
+	c, _ := l.series.LoadOrStore(label, new(atomic.Uint64))
+	return c.(*atomic.Uint64)
+}
+
+func (l *labeled) inc(label string) { l.with(label).Add(1) }
+
+func (l *labeled) add(label string, n uint64) { l.with(label).Add(n) }
+
+func (l *labeled) set(label string, n uint64) { l.with(label).Store(n) }
+
+// sum returns the total across all label values.
+func (l *labeled) sum() uint64 {
+	var n uint64
+	l.series.Range(func(_, c any) bool { n += c.(*atomic.Uint64).Load(); return true })
+	return n
+}
+
+// of returns the total of the given label values.
+func (l *labeled) of(labels ...string) uint64 {
+	var n uint64
+	for _, lbl := range labels {
+		if c, ok := l.series.Load(lbl); ok {
+			n += c.(*atomic.Uint64).Load()
+		}
+	}
+	return n
+}
+
+func (l *labeled) collect(d *prometheus.Desc, ch chan<- prometheus.Metric) {
+	l.series.Range(func(k, c any) bool {
+		ch <- prometheus.MustNewConstMetric(d, l.kind, float64(c.(*atomic.Uint64).Load()), k.(string))
+		return true
+	})
+}
+
+var (
+	serialRx        = newCounter("serial_rx_frames_total", "Total CAN frames decoded from the serial link.")
+	socketCANRx     = newCounter("socketcan_rx_frames_total", "Total CAN frames read from the SocketCAN interface.")
+	socketCANRxOwn  = newCounter("socketcan_rx_own_frames_total", "Frames read back from the SocketCAN interface that the gateway itself transmitted (can-recv-own).")
+	serialTx        = newCounter("serial_tx_frames_total", "Total CAN frames written to the serial link.")
+	socketCANTx     = newCounter("socketcan_tx_frames_total", "Total CAN frames written to the SocketCAN interface.")
+	socketCANKDrop  = newCounter("socketcan_kernel_tx_dropped_total", "Frames the kernel dropped on the SocketCAN interface TX path after accepting them (interface tx_dropped).")
+	udpRx           = newCounter("cannelloni_udp_rx_frames_total", "Total CAN frames received from the remote cannelloni UDP peer.")
+	udpTx           = newCounter("cannelloni_udp_tx_frames_total", "Total CAN frames sent to the remote cannelloni UDP peer.")
+	replayRx        = newCounter("replay_rx_frames_total", "Total CAN frames played back from the replay log.")
+	replayTx        = newCounter("replay_tx_frames_total", "Total client CAN frames captured to the replay TX file.")
+	upstreamRx      = newCounter("upstream_rx_frames_total", "Total CAN frames relayed from the upstream cannelloni TCP server.")
+	upstreamTx      = newCounter("upstream_tx_frames_total", "Total CAN frames relayed to the upstream cannelloni TCP server (sent or queued during an outage).")
+	tcpRx           = newCounter("tcp_rx_frames_total", "Total CAN frames received from TCP clients.")
+	tcpTx           = newCounter("tcp_tx_frames_total", "Total CAN frames sent to TCP clients.")
+	hubDropped      = newCounter("hub_dropped_frames_total", "Total CAN frames dropped by hub due to slow clients.")
+	hubKicked       = newCounter("hub_kicked_clients_total", "Total clients disconnected due to backpressure kick policy.")
+	hubRejected     = newCounter("hub_rejected_clients_total", "Total client connection attempts rejected (e.g., max-clients).")
+	connRateLimited = newCounter("conn_rate_limited_total", "Client connections closed before the handshake by the per-IP connection rate limit.")
+	connRateBans    = newCounter("conn_rate_bans_total", "Temporary bans of client IPs exceeding the connection rate limit.")
+	malformed       = newCounter("malformed_frames_total", "Total rejected malformed frames (protocol violations, invalid length, truncated).")
+	bridged         = newCounter("bridge_forwarded_frames_total", "Frames forwarded between instances by bridge routes.")
+	starved         = newCounter("tcp_reader_starved_total", "Client reader yields that took over 10ms longer than requested (CPU starvation).")
+	memShed         = newCounter("memory_pressure_drops_total", "Frames dropped because queued memory exceeded -memory-limit-mb.")
+	txPriority      = newCounter("backend_tx_priority_frames_total", "Client frames queued on the backend priority TX queue (tx-priority-ids).")
+	hbDropped       = newCounter("heartbeat_dropped_total", "Bus heartbeat frames the transmit path rejected, e.g. while TX is inhibited (-heartbeat-frame).")
+	arbDropped      = newCounter("arbitration_standby_dropped_total", "Client frames dropped because the gateway was on standby (-arbitration-id).")
+	txInhibited     = newCounter("tx_inhibited_frames_total", "Client frames dropped because TX was inhibited (quiet hours or admin toggle).")
+	txDryRun        = newCounter("tx_dry_run_frames_total", "Client frames logged instead of written to the backend (tx-dry-run).")
+	emulated        = newCounter("emulated_responses_total", "Response frames sent by emulated devices (emulate).")
+	httpDenied      = newCounter("http_denied_requests_total", "HTTP requests rejected because the client address is outside -http-allow.")
+	storeWritten    = newCounter("store_written_frames_total", "Frames written to the persistent history store (-store).")
+	storeDropped    = newCounter("store_dropped_frames_total", "Frames lost by the persistent history store because it fell behind or a write failed.")
+	mqttPublished   = newCounter("mqtt_published_frames_total", "Frames published to the MQTT broker (-mqtt): written at QoS 0, acknowledged at QoS 1.")
+	mqttDropped     = newCounter("mqtt_dropped_frames_total", "Frames not published to the MQTT broker because its queue was full.")
+	mqttTx          = newCounter("mqtt_tx_frames_total", "Frames received on -mqtt-tx-topic and sent to the bus.")
+	rxStalls        = newCounter("backend_rx_stalls_total", "Times the backend RX loop delivered no frame within -rx-watchdog while the device was up.")
+	restarts        = newCounter("backend_restarts_total", "Backends closed and reopened by the RX watchdog (-rx-watchdog-restart).")
+	compressRaw     = newCounter("tcp_compress_raw_bytes_total", "Bytes of client streams before DEFLATE compression (OpCompress).")
+	compressWire    = newCounter("tcp_compress_wire_bytes_total", "Bytes written to clients for those streams after compression.")
+	compressOff     = newCounter("tcp_compress_fallbacks_total", "Clients whose compression was turned off because their traffic did not compress.")
+	clientFiltered  = newCounter("client_filtered_frames_total", "Frames not sent to a client because of the receive filter it pushed (OpFilter).")
+	dedup           = newCounter("tx_dedup_suppressed_total", "Client frames not transmitted because they repeated an identical frame within the dedup window.")
+
+	hubClients   = newGauge("hub_active_clients", "Current number of active connected clients.")
+	hubFanout    = newGauge("hub_broadcast_fanout", "Number of clients targeted in the most recent broadcast.")
+	hubQDMax     = newGauge("hub_queue_depth_max", "Observed max queued frames among clients since last sample window.")
+	hubQDAvg     = newGauge("hub_queue_depth_avg", "Approximate average queued frames per client in last sample.")
+	canLatency   = newGauge("socketcan_rx_latency_microseconds", "Moving average of the time from kernel receipt to gateway read of a SocketCAN frame.")
+	memHub       = newGauge("hub_queue_memory_bytes", "Approximate memory held by frames queued for TCP clients.")
+	memBackend   = newGauge("backend_queue_memory_bytes", "Approximate memory held by frames queued for backend writes.")
+	memLimit     = newGauge("queue_memory_limit_bytes", "Configured cap on queued frame memory (0 = none).")
+	blocksOn     = newGauge("frame_blocks_active", "Number of active administrative CAN ID blocks (/api/blocks).")
+	arbActive    = newGauge("arbitration_active", "Number of instances that are the active gateway of their bus (-arbitration-id).")
+	inhibitOn    = newGauge("tx_inhibit_active", "Number of instances whose client TX is currently inhibited.")
+	sessParked   = newGauge("client_sessions_parked", "Client sessions waiting for their client to reconnect.")
+	sessStandby  = newGauge("client_sessions_standby", "Client sessions imported from a peer gateway, waiting for their client to fail over.")
+	httpFallback = newGauge("metrics_http_fallback", "1 when the metrics server listens on -metrics-fallback-addr because -metrics-addr was busy.")
+	serialNoSum  = newGauge("serial_checksum_disabled", "1 while a serial backend runs with -serial-no-checksum (frames are not checksummed).")
+	memPress     = newGauge("memory_pressure", "1 while queued frame memory is over the limit and queues shed load.")
+	mqttUp       = newGauge("mqtt_connected", "1 while the gateway is connected to the MQTT broker (-mqtt).")
+
+	errorsByWhere  = newLabeled("errors_total", "Error counters by subsystem.", "where")
+	filteredBy     = newLabeled("backend_filtered_frames_total", "Frames rejected by backend allow/deny filters, by path (rx|tx).", "path")
+	transformedBy  = newLabeled("backend_transformed_frames_total", "Frames whose payload was rewritten by backend transforms, by path (rx|tx).", "path")
+	txAcksBy       = newLabeled("client_tx_acks_total", "TX acknowledgements sent to clients, by status.", "status")
+	encodeCacheBy  = newLabeled("tcp_encode_cache_frames_total", "Frames written to clients through the shared encoding cache, by result (hit|miss); a hit reused another client's encoding.", "result")
+	flushesBy      = newLabeled("tcp_flushes_total", "Writer flushes to TCP clients, by trigger (size|timer|close|pong|compress|rtr).", "trigger")
+	limitHits      = newLabeled("conn_limit_hits_total", "Per-connection protocol limits hit, by limit (decode_bytes|burst_frames|handshake_bytes).", "limit")
+	sessionsBy     = newLabeled("client_sessions_total", "Client session events, by result (new|resumed|expired|migrated).", "result")
+	bridgeLoops    = newLabeled("bridge_loops_detected_total", "Bridged frames dropped by loop prevention, by reason (origin|ttl).", "reason")
+	mqttTxRejected = newLabeled("mqtt_tx_rejected_total", "Messages on -mqtt-tx-topic not sent to the bus, by reason (retained|parse|id|invalid|backend).", "reason")
+	alertsFired    = newLabeled("alerts_fired_total", "Alerts raised by -alerts rules, by rule name.", "rule")
+	invalidBy      = newLabeled("invalid_frames_total", "Frames failing validation, by rule (dlc|sff_id|err_flag).", "rule")
+	sniffedBy      = newLabeled("sniffed_connections_total", "Connections on shared client ports by detected protocol (cannelloni|tls|http|unknown).", "protocol")
+	captureTrigs   = newLabeled("capture_triggers_total", "Triggered captures written to disk, by reason (frame|error|drops).", "reason")
+	clockSteps     = newLabeled("clock_steps_total", "Wall clock steps detected behind timestamps, by direction (forward|backward).", "direction")
+	canErrFrames   = newLabeled("can_error_frames_total", "Error frames reported by the CAN controller (-can-err-filter), by error class.", "class")
+	normalizedBy   = newLabeled("frames_normalized_total", "Frames whose CAN ID was normalized or that normalization dropped, by change (eff|flags|err_dropped).", "change")
+	blockedBy      = newLabeled("blocked_frames_total", "Frames dropped by administrative CAN ID blocks, by path (rx|tx).", "path")
+	heartbeats     = newLabeled("heartbeat_frames_total", "Gateway heartbeat frames sent (-heartbeat-frame), by target (bus|clients).", "target")
+	auditDiverged  = newLabeled("counter_audit_divergences_total", "Counter audit intervals in which frames entering a path went unaccounted beyond the tolerance (-counter-audit), by check.", "check")
+	flowHints      = newLabeled("client_flow_hints_total", "Flow-control hints sent to clients (OpFlow), by level (ok|slow|stop).", "level")
+	arbTransitions = newLabeled("arbitration_transitions_total", "Arbitration state changes, by new state (active|standby).", "state")
+	cnlLost        = newLabeled("cannelloni_packets_lost_total", "Cannelloni DATA packets missing from sequence number gaps, by source (tcp|udp).", "source")
+	pipeStalls     = newLabeled("rx_pipeline_stalls_total", "Times an RX pipeline stage waited because the queue of the next stage was full, by stage (decode|broadcast).", "stage")
+	pipeItems      = newLabeled("rx_pipeline_processed_total", "Items taken off an RX pipeline queue, by stage: chunks or packets for decode, frames for broadcast.", "stage")
+	canTxQLen      = newLabeledGauge("socketcan_txqueuelen", "Kernel TX queue length of each SocketCAN interface, in frames, by interface.", "if")
+	upstreamUp     = newLabeledGauge("upstream_connected", "1 while the cannelloni-tcp backend is connected to its upstream server, by upstream address.", "upstream")
+	pipeDepth      = newLabeledGauge("rx_pipeline_queue_depth", "Items waiting in an RX pipeline queue when the stage last took one, by stage (decode|broadcast).", "stage")
+	deniedBy       = newLabeled("access_denied_total", "Client frames, connections and API requests refused by role, by permission (view|send|filters|capture|manage).", "perm")
+
+	flushFrames   = newHistogram("tcp_flush_batch_frames", "Frames written per client flush.", 1, 1, 2, 4, 8, 16, 32, 64, 128, 256, 512)
+	flushDuration = newHistogram("tcp_flush_duration_seconds", "Time spent encoding and writing one client flush.", 1e-9,
+		10e3, 50e3, 100e3, 250e3, 500e3, 1e6, 5e6, 10e6, 50e6, 100e6, 500e6, 1e9)
+
+	readBytes   = newHistogram("tcp_read_burst_bytes", "Bytes returned by one client socket read.", 1, 16, 64, 256, 1024, 4096, 16384, 65536)
+	readerYield = newHistogram("tcp_reader_yield_seconds", "Time a client reader paused after a full burst before running again.", 1e-9,
+		10e3, 100e3, 1e6, 5e6, 10e6, 50e6, 100e6, 500e6)
+	readFrames = newHistogram("tcp_read_burst_frames", "Client frames decoded per reader iteration.", 1, 1, 2, 4, 8, 16, 32, 64, 128)
+
+	storeValues = []*value{
+		serialRx, socketCANRx, socketCANRxOwn, serialTx, socketCANTx, socketCANKDrop, udpRx, udpTx, replayRx, replayTx, upstreamRx, upstreamTx, tcpRx, tcpTx,
+		hubDropped, hubKicked, hubRejected, connRateLimited, connRateBans, malformed, memShed, starved, txPriority, hbDropped, arbDropped, txInhibited, txDryRun, emulated, rxStalls, restarts, compressRaw, compressWire, compressOff, clientFiltered, dedup, bridged, httpDenied, storeWritten, storeDropped, mqttPublished, mqttDropped, mqttTx,
+		hubClients, hubFanout, hubQDMax, hubQDAvg, canLatency, memHub, memBackend, memLimit, memPress, inhibitOn, blocksOn, arbActive, sessParked, sessStandby, httpFallback, serialNoSum, mqttUp,
+	}
+	storeLabeled    = []*labeled{errorsByWhere, filteredBy, transformedBy, txAcksBy, flushesBy, encodeCacheBy, limitHits, sessionsBy, bridgeLoops, alertsFired, invalidBy, deniedBy, sniffedBy, clockSteps, captureTrigs, pipeStalls, pipeItems, pipeDepth, canTxQLen, upstreamUp, canErrFrames, normalizedBy, cnlLost, arbTransitions, blockedBy, heartbeats, flowHints, auditDiverged, mqttTxRejected}
+	storeHistograms = []*histogram{flushFrames, flushDuration, readBytes, readFrames, readerYield}
+)
+
+// storeCollector exports the counter store to Prometheus. Its descriptors
+// are parallel to storeValues, storeLabeled and storeHistograms.
+type storeCollector struct {
+	values, labeled, histograms []*prometheus.Desc
+}
+
+func newStoreCollector(r *registration) *storeCollector {
+	c := &storeCollector{}
+	for _, v := range storeValues {
+		c.values = append(c.values, r.desc(v.name, v.help))
+	}
+	for _, l := range storeLabeled {
+		c.labeled = append(c.labeled, r.desc(l.name, l.help, l.label))
+	}
+	for _, h := range storeHistograms {
+		c.histograms = append(c.histograms, r.desc(h.name, h.help))
+	}
+	return c
+}
+
+func (c *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, ds := range [][]*prometheus.Desc{c.values, c.labeled, c.histograms} {
+		for _, d := range ds {
+			ch <- d
+		}
+	}
+}
+
+func (c *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	for i, v := range storeValues {
+		ch <- v.metric(c.values[i])
+	}
+	for i, l := range storeLabeled {
+		l.collect(c.labeled[i], ch)
+	}
+	for i, h := range storeHistograms {
+		ch <- h.metric(c.histograms[i])
+	}
+}
+
+// histogram is a fixed-bucket histogram over integer observations (frames,
+// nanoseconds); scale converts raw units to the exported unit.
+type histogram struct {
+	name   string
+	help   string
+	bounds []uint64 // inclusive upper bounds, ascending
+	scale  float64
+	counts []atomic.Uint64 // one per bound; +Inf is count
+	count  atomic.Uint64
+	sum    atomic.Uint64
+}
+
+func newHistogram(name, help string, scale float64, bounds ...uint64) *histogram {
+	return &histogram{
+		name:   name,
+		help:   help,
+		bounds: bounds,
+		scale:  scale,
+		counts: make([]atomic.Uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(v uint64) {
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i].Add(1)
+			break
+		}
+	}
+	h.sum.Add(v)
+	h.count.Add(1)
+}
+
+func (h *histogram) metric(d *prometheus.Desc) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(h.bounds))
+	var cum uint64
+	for i, b := range h.bounds {
+		cum += h.counts[i].Load()
+		buckets[float64(b)*h.scale] = cum
+	}
+	return prometheus.MustNewConstHistogram(d, h.count.Load(), float64(h.sum.Load())*h.scale, buckets)
+}
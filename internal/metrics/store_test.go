@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// gathered returns the value of a scraped series with an optional label value.
+func gathered(t *testing.T, name, label string) float64 {
+	t.Helper()
+	registerDefault()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if label != "" && (len(m.GetLabel()) == 0 || m.GetLabel()[0].GetValue() != label) {
+				continue
+			}
+			if c := m.GetCounter(); c != nil {
+				return c.GetValue()
+			}
+			return m.GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("series %s{%s} not found", name, label)
+	return 0
+}
+
+func TestStoreSnapMatchesPrometheus(t *testing.T) {
+	before := Snap()
+	IncSerialRx()
+	AddTCPTx(3)
+	IncError(ErrTCPRead)
+	IncError(ErrTCPRead)
+	IncFiltered(FilterTX)
+	SetHubClients(7)
+	after := Snap()
+
+	if d := after.SerialRx - before.SerialRx; d != 1 {
+		t.Fatalf("serial rx delta = %d", d)
+	}
+	if d := after.TCPTx - before.TCPTx; d != 3 {
+		t.Fatalf("tcp tx delta = %d", d)
+	}
+	if d := after.Errors - before.Errors; d != 2 {
+		t.Fatalf("errors delta = %d", d)
+	}
+	if d := after.Filtered - before.Filtered; d != 1 {
+		t.Fatalf("filtered delta = %d", d)
+	}
+	if got := gathered(t, "serial_rx_frames_total", ""); got != float64(after.SerialRx) {
+		t.Fatalf("prometheus serial rx = %v, snap %d", got, after.SerialRx)
+	}
+	if got := gathered(t, "tcp_tx_frames_total", ""); got != float64(after.TCPTx) {
+		t.Fatalf("prometheus tcp tx = %v, snap %d", got, after.TCPTx)
+	}
+	if got := gathered(t, "errors_total", ErrTCPRead); got < 2 {
+		t.Fatalf("prometheus errors{tcp_read} = %v", got)
+	}
+	if got := gathered(t, "hub_active_clients", ""); got != 7 {
+		t.Fatalf("prometheus active clients = %v", got)
+	}
+}
+
+// TestSerialChecksumDisabledExported scrapes /metrics: the gauge is set
+// outside the counter paths the other tests cover.
+func TestSerialChecksumDisabledExported(t *testing.T) {
+	SetSerialChecksumDisabled(true)
+	defer SetSerialChecksumDisabled(false)
+	registerDefault()
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "\nserial_checksum_disabled 1\n") {
+		t.Fatalf("serial_checksum_disabled missing from /metrics:\n%s", rec.Body)
+	}
+}
+
+func TestSocketCANTxQueueLenPerInterface(t *testing.T) {
+	SetSocketCANTxQueueLen("can0", 64)
+	SetSocketCANTxQueueLen("can1", 10)
+	if got := gathered(t, "socketcan_txqueuelen", "can0"); got != 64 {
+		t.Fatalf("socketcan_txqueuelen{if=can0} = %v", got)
+	}
+	if got := gathered(t, "socketcan_txqueuelen", "can1"); got != 10 {
+		t.Fatalf("socketcan_txqueuelen{if=can1} = %v", got)
+	}
+}
+
+func TestObserveFlushHistogram(t *testing.T) {
+	before := Snap()
+	ObserveFlush(1, 20*time.Microsecond, FlushTimer)
+	ObserveFlush(64, 2*time.Millisecond, FlushSize)
+	after := Snap()
+	if d := after.Flushes - before.Flushes; d != 2 {
+		t.Fatalf("flushes delta = %d", d)
+	}
+	if d := after.FlushedFrames - before.FlushedFrames; d != 65 {
+		t.Fatalf("flushed frames delta = %d", d)
+	}
+	registerDefault()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "tcp_flush_batch_frames" {
+			continue
+		}
+		h := mf.GetMetric()[0].GetHistogram()
+		for _, b := range h.GetBucket() {
+			if b.GetUpperBound() == 1 && b.GetCumulativeCount() < 1 {
+				t.Fatalf("bucket le=1 count = %d", b.GetCumulativeCount())
+			}
+			if b.GetUpperBound() == 32 && b.GetCumulativeCount() == h.GetSampleCount() {
+				t.Fatalf("64-frame flush counted in le=32 bucket")
+			}
+		}
+		if got := gathered(t, "tcp_flushes_total", FlushSize); got < 1 {
+			t.Fatalf("tcp_flushes_total{size} = %v", got)
+		}
+		return
+	}
+	t.Fatal("tcp_flush_batch_frames not exported")
+}
@@ -0,0 +1,47 @@
+package mqtt
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Cache keeps the last message of each topic, for Options.Republish. It is
+// bounded: topics first seen when it is full are not kept. It is safe for
+// concurrent use.
+type Cache struct {
+	max int
+	mu  sync.Mutex
+	m   map[string]Message
+}
+
+// NewCache returns a cache of up to max topics.
+func NewCache(max int) *Cache {
+	return &Cache{max: max, m: make(map[string]Message)}
+}
+
+// Put keeps m as the last message of its topic. An empty payload clears a
+// retained message, so the topic is forgotten.
+func (c *Cache) Put(m Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(m.Payload) == 0 {
+		delete(c.m, m.Topic)
+		return
+	}
+	if _, ok := c.m[m.Topic]; ok || len(c.m) < c.max {
+		c.m[m.Topic] = m
+	}
+}
+
+// Messages returns the kept messages ordered by topic.
+func (c *Cache) Messages() []Message {
+	c.mu.Lock()
+	out := make([]Message, 0, len(c.m))
+	for _, m := range c.m {
+		out = append(out, m)
+	}
+	c.mu.Unlock()
+	slices.SortFunc(out, func(a, b Message) int { return strings.Compare(a.Topic, b.Topic) })
+	return out
+}
@@ -0,0 +1,429 @@
+// Package mqtt is a small MQTT 3.1.1 client publishing to a broker: QoS 0
+// and 1, retained messages, TLS and keepalive pings. The connection is
+// dialled and redialled in the background; messages wait in a bounded
+// queue meanwhile, and unacknowledged QoS 1 messages are sent again after a
+// reconnect, followed by the last values the application asks to republish.
+// Subscriptions are made again on every connection and deliver messages to
+// a callback.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for zero Options fields.
+const (
+	DefaultKeepAlive = 30 * time.Second
+	DefaultQueue     = 1024
+)
+
+// maxInflight bounds the QoS 1 messages sent but not yet acknowledged; the
+// queue is not drained while the window is full.
+const maxInflight = 64
+
+const (
+	dialTimeout = 10 * time.Second
+	minBackoff  = time.Second
+	maxBackoff  = 30 * time.Second
+)
+
+// Message is one application message.
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte // 0 or 1
+	Retain  bool
+}
+
+// Subscription is a topic filter to subscribe to, with the maximum QoS (0
+// or 1) to receive it at.
+type Subscription struct {
+	Filter string
+	QoS    byte
+}
+
+// Options configures a Client.
+type Options struct {
+	Broker    string // tcp://, mqtt://, ssl://, tls:// or mqtts:// URL
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration // 0: DefaultKeepAlive
+	TLS       *tls.Config   // for TLS brokers; nil verifies against the system roots
+	Queue     int           // messages waiting for the broker (0: DefaultQueue)
+	Logger    *slog.Logger
+	// OnPublish is called for each message written (QoS 0) or acknowledged
+	// by the broker (QoS 1).
+	OnPublish func()
+	// OnState is called when the connection comes up or goes down.
+	OnState func(connected bool)
+	// Republish returns messages to publish again after every reconnect,
+	// ahead of the queue, e.g. the last values of a Cache: a broker
+	// restarted without persistence has lost its retained messages.
+	Republish func() []Message
+	// Subscriptions are made on every connection; OnMessage receives the
+	// messages. It runs on the connection's reader and should return
+	// quickly: a QoS 1 message is acknowledged once it returns.
+	Subscriptions []Subscription
+	OnMessage     func(Message)
+}
+
+// ParseBroker checks a broker URL and returns the address to dial and
+// whether it uses TLS. The port defaults to 1883, or 8883 with TLS.
+func ParseBroker(s string) (addr string, useTLS bool, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", false, err
+	}
+	port := "1883"
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		useTLS, port = true, "8883"
+	default:
+		return "", false, fmt.Errorf("unsupported scheme %q (want tcp, mqtt, ssl, tls or mqtts)", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", false, fmt.Errorf("missing broker host in %q", s)
+	}
+	if p := u.Port(); p != "" {
+		port = p
+	}
+	return net.JoinHostPort(u.Hostname(), port), useTLS, nil
+}
+
+// Match reports whether topic matches the subscription filter, with the
+// + (one level) and # (all remaining levels) wildcards. Topics starting
+// with $ only match filters naming that first level.
+func Match(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+	fs, ts := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) || (f != "+" && f != ts[i]) {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+type inflight struct {
+	id  uint16
+	msg Message
+}
+
+// Client publishes messages to one broker and receives the messages of its
+// subscriptions. Publish may be called from any goroutine; Run owns the
+// connection.
+type Client struct {
+	opts      Options
+	addr      string
+	useTLS    bool
+	keepAlive time.Duration
+	log       *slog.Logger
+	queue     chan Message
+	connected atomic.Bool
+
+	// Owned by Run.
+	inflight []inflight
+	nextID   uint16
+}
+
+// New returns a client for opts; it connects once Run is called.
+func New(opts Options) (*Client, error) {
+	addr, useTLS, err := ParseBroker(opts.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: %w", err)
+	}
+	c := &Client{opts: opts, addr: addr, useTLS: useTLS, keepAlive: opts.KeepAlive, log: opts.Logger}
+	if c.keepAlive <= 0 {
+		c.keepAlive = DefaultKeepAlive
+	}
+	if c.log == nil {
+		c.log = slog.Default()
+	}
+	n := opts.Queue
+	if n <= 0 {
+		n = DefaultQueue
+	}
+	c.queue = make(chan Message, n)
+	return c, nil
+}
+
+// Publish queues m without blocking. It reports false when the queue is
+// full and m was dropped.
+func (c *Client) Publish(m Message) bool {
+	select {
+	case c.queue <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+// Connected reports whether the client is connected to the broker.
+func (c *Client) Connected() bool { return c.connected.Load() }
+
+// Run connects to the broker and delivers queued messages until ctx is
+// done, redialling with backoff when the connection fails.
+func (c *Client) Run(ctx context.Context) {
+	backoff := minBackoff
+	reconnect := false
+	for ctx.Err() == nil {
+		conn, err := c.dial(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.log.Warn("mqtt_connect_failed", "broker", c.opts.Broker, "error", err, "retry_in", backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxBackoff)
+			continue
+		}
+		backoff = minBackoff
+		var replay []Message
+		if reconnect && c.opts.Republish != nil {
+			replay = c.opts.Republish()
+		}
+		reconnect = true
+		c.setState(true)
+		c.log.Info("mqtt_connected", "broker", c.opts.Broker, "client_id", c.opts.ClientID, "resend", len(c.inflight), "republish", len(replay))
+		err = c.serve(ctx, conn, replay)
+		c.setState(false)
+		if ctx.Err() != nil {
+			return
+		}
+		c.log.Warn("mqtt_disconnected", "broker", c.opts.Broker, "error", err)
+	}
+}
+
+func (c *Client) setState(up bool) {
+	c.connected.Store(up)
+	if c.opts.OnState != nil {
+		c.opts.OnState(up)
+	}
+}
+
+// dial connects and completes the CONNECT/CONNACK exchange.
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	d := net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.useTLS {
+		cfg := &tls.Config{}
+		if c.opts.TLS != nil {
+			cfg = c.opts.TLS.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(c.addr)
+		}
+		conn = tls.Client(conn, cfg)
+	}
+	_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+	keep := uint16(min(c.keepAlive/time.Second, 65535))
+	if _, err := conn.Write(connectPacket(c.opts.ClientID, c.opts.Username, c.opts.Password, keep)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var ack [4]byte // CONNACK is always four bytes
+	_, err = io.ReadFull(conn, ack[:])
+	if err == nil && (ack[0]>>4 != typeConnack || ack[1] != 2) {
+		err = fmt.Errorf("mqtt: expected CONNACK, got packet type %d", ack[0]>>4)
+	}
+	if err == nil {
+		err = connackError(ack[2:])
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// serve delivers messages over conn until it fails or ctx is done, starting
+// with replay. The broker must answer within one and a half keepalive
+// periods; pings keep an idle connection talking.
+func (c *Client) serve(ctx context.Context, conn net.Conn, replay []Message) error {
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		conn.Close()
+	}()
+	acks := make(chan uint16)
+	replies := make(chan []byte) // packets the reader needs written
+	rerr := make(chan error, 1)
+	go func() {
+		r := bufio.NewReader(conn)
+		for {
+			_ = conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+			p, err := readPacket(r)
+			if err != nil {
+				rerr <- err
+				return
+			}
+			switch p.kind() {
+			case typePuback:
+				if len(p.body) < 2 {
+					continue
+				}
+				select {
+				case acks <- binary.BigEndian.Uint16(p.body):
+				case <-done:
+					return
+				}
+			case typeSuback:
+				c.subacked(p.body)
+			case typePublish:
+				m, id, err := parsePublish(p)
+				if err != nil {
+					rerr <- err
+					return
+				}
+				if c.opts.OnMessage != nil {
+					c.opts.OnMessage(m)
+				}
+				if m.QoS == 0 {
+					continue
+				}
+				select {
+				case replies <- appendPacket(nil, typePuback<<4, binary.BigEndian.AppendUint16(nil, id)):
+				case <-done:
+					return
+				}
+			}
+			// PINGRESP only proves the link is alive.
+		}
+	}()
+	write := func(b []byte) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(c.keepAlive))
+		_, err := conn.Write(b)
+		return err
+	}
+	for _, f := range c.inflight {
+		if err := write(publishPacket(&f.msg, f.id, true)); err != nil {
+			return err
+		}
+	}
+	if len(c.opts.Subscriptions) > 0 {
+		if err := write(subscribePacket(c.packetID(), c.opts.Subscriptions)); err != nil {
+			return err
+		}
+	}
+	ping := time.NewTicker(c.keepAlive)
+	defer ping.Stop()
+	for {
+		full := len(c.inflight) >= maxInflight
+		if len(replay) > 0 && !full {
+			if err := c.send(write, replay[0]); err != nil {
+				return err
+			}
+			replay = replay[1:]
+			continue
+		}
+		queue := c.queue
+		if full {
+			queue = nil
+		}
+		select {
+		case <-ctx.Done():
+			_ = write(appendPacket(nil, typeDisconnect<<4, nil))
+			return nil
+		case err := <-rerr:
+			return err
+		case id := <-acks:
+			c.ack(id)
+		case b := <-replies:
+			if err := write(b); err != nil {
+				return err
+			}
+		case m := <-queue:
+			if err := c.send(write, m); err != nil {
+				return err
+			}
+		case <-ping.C:
+			if err := write(appendPacket(nil, typePingreq<<4, nil)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// send writes m, keeping it in flight until acknowledged at QoS 1.
+func (c *Client) send(write func([]byte) error, m Message) error {
+	var id uint16
+	if m.QoS > 0 {
+		id = c.packetID()
+		c.inflight = append(c.inflight, inflight{id: id, msg: m})
+	}
+	if err := write(publishPacket(&m, id, false)); err != nil {
+		return err
+	}
+	if m.QoS == 0 && c.opts.OnPublish != nil {
+		c.opts.OnPublish()
+	}
+	return nil
+}
+
+// subacked logs the outcome of each subscription from a SUBACK body: the
+// packet identifier, then one return code per filter (0x80 refused).
+func (c *Client) subacked(body []byte) {
+	if len(body) < 2 {
+		return
+	}
+	for i, code := range body[2:] {
+		if i >= len(c.opts.Subscriptions) {
+			break
+		}
+		s := c.opts.Subscriptions[i]
+		if code == 0x80 {
+			c.log.Warn("mqtt_subscribe_failed", "broker", c.opts.Broker, "filter", s.Filter)
+			continue
+		}
+		c.log.Info("mqtt_subscribed", "broker", c.opts.Broker, "filter", s.Filter, "qos", code)
+	}
+}
+
+// ack retires the in-flight message id.
+func (c *Client) ack(id uint16) {
+	for i, f := range c.inflight {
+		if f.id != id {
+			continue
+		}
+		c.inflight = append(c.inflight[:i], c.inflight[i+1:]...)
+		if c.opts.OnPublish != nil {
+			c.opts.OnPublish()
+		}
+		return
+	}
+}
+
+// packetID returns the next non-zero packet identifier.
+func (c *Client) packetID() uint16 {
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	return c.nextID
+}
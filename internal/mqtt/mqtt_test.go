@@ -0,0 +1,347 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// broker is a fake broker accepting connections on a loopback port.
+type broker struct {
+	ln    net.Listener
+	conns chan *brokerConn
+}
+
+type brokerConn struct {
+	net.Conn
+	r        *bufio.Reader
+	clientID string
+	user     string
+	pass     string
+}
+
+func newBroker(t *testing.T, code byte) *broker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	b := &broker{ln: ln, conns: make(chan *brokerConn, 4)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			bc := &brokerConn{Conn: c, r: bufio.NewReader(c)}
+			p, err := readPacket(bc.r)
+			if err != nil || p.kind() != typeConnect {
+				c.Close()
+				continue
+			}
+			bc.parseConnect(p.body)
+			_, _ = c.Write([]byte{typeConnack << 4, 2, 0, code})
+			b.conns <- bc
+		}
+	}()
+	return b
+}
+
+func (b *broker) url() string { return "tcp://" + b.ln.Addr().String() }
+
+func (b *broker) accept(t *testing.T) *brokerConn {
+	t.Helper()
+	select {
+	case c := <-b.conns:
+		t.Cleanup(func() { c.Close() })
+		return c
+	case <-time.After(3 * time.Second):
+		t.Fatal("no connection")
+		return nil
+	}
+}
+
+func (c *brokerConn) parseConnect(body []byte) {
+	str := func() string {
+		n := int(binary.BigEndian.Uint16(body))
+		s := string(body[2 : 2+n])
+		body = body[2+n:]
+		return s
+	}
+	_ = str() // protocol name
+	flags := body[1]
+	body = body[4:]
+	c.clientID = str()
+	if flags&0x80 != 0 {
+		c.user = str()
+	}
+	if flags&0x40 != 0 {
+		c.pass = str()
+	}
+}
+
+type published struct {
+	topic   string
+	payload []byte
+	id      uint16
+	qos     byte
+	retain  bool
+	dup     bool
+}
+
+// next reads packets up to the next PUBLISH.
+func (c *brokerConn) next(t *testing.T) published {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		p, err := readPacket(c.r)
+		if err != nil {
+			t.Fatalf("broker read: %v", err)
+		}
+		if p.kind() != typePublish {
+			continue
+		}
+		m := published{qos: p.header >> 1 & 3, retain: p.header&1 != 0, dup: p.header&8 != 0}
+		n := int(binary.BigEndian.Uint16(p.body))
+		m.topic = string(p.body[2 : 2+n])
+		rest := p.body[2+n:]
+		if m.qos > 0 {
+			m.id = binary.BigEndian.Uint16(rest)
+			rest = rest[2:]
+		}
+		m.payload = rest
+		return m
+	}
+}
+
+func (c *brokerConn) puback(id uint16) {
+	_, _ = c.Write(appendPacket(nil, typePuback<<4, binary.BigEndian.AppendUint16(nil, id)))
+}
+
+func TestParseBroker(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		addr string
+		tls  bool
+		ok   bool
+	}{
+		{"tcp://broker.lan", "broker.lan:1883", false, true},
+		{"mqtt://broker.lan:1884", "broker.lan:1884", false, true},
+		{"mqtts://broker.lan", "broker.lan:8883", true, true},
+		{"ssl://[::1]:9883", "[::1]:9883", true, true},
+		{"http://broker.lan", "", false, false},
+		{"tcp://", "", false, false},
+		{"broker.lan:1883", "", false, false},
+	} {
+		addr, useTLS, err := ParseBroker(tc.in)
+		if (err == nil) != tc.ok || addr != tc.addr || useTLS != tc.tls {
+			t.Fatalf("%s: got %q tls=%v err=%v", tc.in, addr, useTLS, err)
+		}
+	}
+}
+
+func TestRemainingLength(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097152} {
+		b := appendPacket(nil, typePublish<<4, make([]byte, n))
+		p, err := readPacket(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil || len(p.body) != n {
+			t.Fatalf("%d: got %d bytes, err=%v", n, len(p.body), err)
+		}
+	}
+}
+
+func TestPublishQoS0(t *testing.T) {
+	b := newBroker(t, 0)
+	var sent atomic.Int32
+	c, err := New(Options{Broker: b.url(), ClientID: "gw", Username: "u", Password: "p", OnPublish: func() { sent.Add(1) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+	bc := b.accept(t)
+	if bc.clientID != "gw" || bc.user != "u" || bc.pass != "p" {
+		t.Fatalf("connect: %+v", bc)
+	}
+	c.Publish(Message{Topic: "ampio/can/123", Payload: []byte("hi"), Retain: true})
+	m := bc.next(t)
+	if m.topic != "ampio/can/123" || string(m.payload) != "hi" || !m.retain || m.qos != 0 {
+		t.Fatalf("got %+v", m)
+	}
+	deadline := time.Now().Add(time.Second)
+	for sent.Load() != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if sent.Load() != 1 || !c.Connected() {
+		t.Fatalf("published=%d connected=%v", sent.Load(), c.Connected())
+	}
+}
+
+func TestPublishQoS1ResentAfterReconnect(t *testing.T) {
+	b := newBroker(t, 0)
+	acked := make(chan struct{}, 1)
+	c, err := New(Options{Broker: b.url(), ClientID: "gw", OnPublish: func() { acked <- struct{}{} }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+	bc := b.accept(t)
+	c.Publish(Message{Topic: "t", Payload: []byte{1}, QoS: 1})
+	first := bc.next(t)
+	if first.qos != 1 || first.id == 0 || first.dup {
+		t.Fatalf("first delivery: %+v", first)
+	}
+	bc.Close() // lost before the PUBACK
+
+	bc = b.accept(t)
+	again := bc.next(t)
+	if again.id != first.id || !again.dup || !bytes.Equal(again.payload, first.payload) {
+		t.Fatalf("resend: %+v", again)
+	}
+	bc.puback(again.id)
+	select {
+	case <-acked:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ack not reported")
+	}
+}
+
+func TestRepublishAfterReconnect(t *testing.T) {
+	b := newBroker(t, 0)
+	cache := NewCache(2)
+	c, err := New(Options{Broker: b.url(), ClientID: "gw", Republish: cache.Messages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+	bc := b.accept(t)
+	for _, m := range []Message{
+		{Topic: "b", Payload: []byte("1"), Retain: true},
+		{Topic: "a", Payload: []byte("1"), Retain: true},
+		{Topic: "a", Payload: []byte("2"), Retain: true},
+		{Topic: "c", Payload: []byte("1"), Retain: true}, // cache full
+	} {
+		if c.Publish(m) {
+			cache.Put(m)
+		}
+		if got := bc.next(t); got.topic != m.Topic {
+			t.Fatalf("first connection: %+v", got)
+		}
+	}
+	bc.Close() // the broker restarts without its retained store
+
+	bc = b.accept(t)
+	for _, want := range []string{"a=2", "b=1"} {
+		m := bc.next(t)
+		if got := m.topic + "=" + string(m.payload); got != want || !m.retain {
+			t.Fatalf("republished %s (retain=%v), want %s", got, m.retain, want)
+		}
+	}
+	c.Publish(Message{Topic: "e", Payload: []byte("1")})
+	if m := bc.next(t); m.topic != "e" {
+		t.Fatalf("after republish: %+v", m)
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := NewCache(2)
+	c.Put(Message{Topic: "a", Payload: []byte("1")})
+	c.Put(Message{Topic: "b", Payload: []byte("1")})
+	c.Put(Message{Topic: "a"}) // cleared
+	c.Put(Message{Topic: "c", Payload: []byte("1")})
+	if got := c.Messages(); len(got) != 2 || got[0].Topic != "b" || got[1].Topic != "c" {
+		t.Fatalf("cache %+v", got)
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	b := newBroker(t, 5)
+	c, err := New(Options{Broker: b.url(), ClientID: "gw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.dial(context.Background()); err == nil || err.Error() != "mqtt: connection refused: not authorized" {
+		t.Fatalf("dial err=%v", err)
+	}
+}
+
+func TestPublishQueueFull(t *testing.T) {
+	c, err := New(Options{Broker: "tcp://127.0.0.1:1", Queue: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Publish(Message{Topic: "a"}) || c.Publish(Message{Topic: "b"}) {
+		t.Fatal("queue of one should take exactly one message")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"ampio/tx", "ampio/tx", true},
+		{"ampio/tx", "ampio/tx/1", false},
+		{"ampio/+/tx", "ampio/main/tx", true},
+		{"ampio/+/tx", "ampio/main/rx", false},
+		{"ampio/#", "ampio", true},
+		{"ampio/#", "ampio/tx/123", true},
+		{"#", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	} {
+		if got := Match(tc.filter, tc.topic); got != tc.want {
+			t.Errorf("Match(%q, %q) = %v", tc.filter, tc.topic, got)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	b := newBroker(t, 0)
+	got := make(chan Message, 1)
+	c, err := New(Options{Broker: b.url(), ClientID: "gw",
+		Subscriptions: []Subscription{{Filter: "ampio/tx/#", QoS: 1}},
+		OnMessage:     func(m Message) { got <- m },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+	bc := b.accept(t)
+	_ = bc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	p, err := readPacket(bc.r)
+	if err != nil || p.kind() != typeSubscribe || p.header&0x0F != 0x02 {
+		t.Fatalf("subscribe: %+v err=%v", p, err)
+	}
+	id := binary.BigEndian.Uint16(p.body)
+	if want := append(appendString(nil, "ampio/tx/#"), 1); !bytes.Equal(p.body[2:], want) {
+		t.Fatalf("subscribe body % X", p.body)
+	}
+	_, _ = bc.Write(appendPacket(nil, typeSuback<<4, append(binary.BigEndian.AppendUint16(nil, id), 1)))
+
+	_, _ = bc.Write(publishPacket(&Message{Topic: "ampio/tx/main", Payload: []byte("123#01"), QoS: 1}, 7, false))
+	select {
+	case m := <-got:
+		if m.Topic != "ampio/tx/main" || string(m.Payload) != "123#01" || m.QoS != 1 {
+			t.Fatalf("got %+v", m)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("message not delivered")
+	}
+	p, err = readPacket(bc.r)
+	if err != nil || p.kind() != typePuback || binary.BigEndian.Uint16(p.body) != 7 {
+		t.Fatalf("puback: %+v err=%v", p, err)
+	}
+}
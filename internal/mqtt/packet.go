@@ -0,0 +1,179 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types (MQTT 3.1.1 section 2.2.1).
+const (
+	typeConnect    = 1
+	typeConnack    = 2
+	typePublish    = 3
+	typePuback     = 4
+	typeSubscribe  = 8
+	typeSuback     = 9
+	typePingreq    = 12
+	typePingresp   = 13
+	typeDisconnect = 14
+)
+
+var errMalformed = errors.New("mqtt: malformed packet")
+
+// connackReasons are the CONNACK return codes refusing a connection.
+var connackReasons = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// packet is one control packet: the fixed header byte and the body after
+// the remaining length.
+type packet struct {
+	header byte
+	body   []byte
+}
+
+func (p packet) kind() byte { return p.header >> 4 }
+
+// appendString appends an MQTT UTF-8 string (16-bit length prefix).
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// appendPacket appends a packet with the fixed header and remaining length.
+func appendPacket(b []byte, header byte, body []byte) []byte {
+	b = append(b, header)
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			break
+		}
+	}
+	return append(b, body...)
+}
+
+// connectPacket encodes CONNECT with a clean session.
+func connectPacket(clientID, user, pass string, keepAlive uint16) []byte {
+	body := appendString(nil, "MQTT")
+	flags := byte(0x02) // clean session
+	if user != "" {
+		flags |= 0x80
+		if pass != "" {
+			flags |= 0x40
+		}
+	}
+	body = append(body, 4, flags) // protocol level 4 = 3.1.1
+	body = binary.BigEndian.AppendUint16(body, keepAlive)
+	body = appendString(body, clientID)
+	if user != "" {
+		body = appendString(body, user)
+		if pass != "" {
+			body = appendString(body, pass)
+		}
+	}
+	return appendPacket(nil, typeConnect<<4, body)
+}
+
+// publishPacket encodes PUBLISH; id is only written for QoS 1.
+func publishPacket(m *Message, id uint16, dup bool) []byte {
+	header := byte(typePublish<<4) | m.QoS<<1
+	if m.Retain {
+		header |= 0x01
+	}
+	if dup {
+		header |= 0x08
+	}
+	body := appendString(make([]byte, 0, 2+len(m.Topic)+2+len(m.Payload)), m.Topic)
+	if m.QoS > 0 {
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	body = append(body, m.Payload...)
+	return appendPacket(nil, header, body)
+}
+
+// subscribePacket encodes SUBSCRIBE for subs.
+func subscribePacket(id uint16, subs []Subscription) []byte {
+	body := binary.BigEndian.AppendUint16(nil, id)
+	for _, s := range subs {
+		body = appendString(body, s.Filter)
+		body = append(body, s.QoS)
+	}
+	return appendPacket(nil, typeSubscribe<<4|0x02, body) // reserved flags 0010
+}
+
+// parsePublish decodes an inbound PUBLISH; id is 0 for QoS 0.
+func parsePublish(p packet) (m Message, id uint16, err error) {
+	m.QoS, m.Retain = p.header>>1&3, p.header&1 != 0
+	b := p.body
+	if len(b) < 2 {
+		return m, 0, errMalformed
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return m, 0, errMalformed
+	}
+	m.Topic, b = string(b[2:2+n]), b[2+n:]
+	if m.QoS > 0 {
+		if len(b) < 2 {
+			return m, 0, errMalformed
+		}
+		id, b = binary.BigEndian.Uint16(b), b[2:]
+	}
+	m.Payload = b
+	return m, id, nil
+}
+
+// readPacket reads one control packet.
+func readPacket(r *bufio.Reader) (packet, error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	n, mul := 0, 1
+	for i := 0; ; i++ {
+		d, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		n += int(d&0x7F) * mul
+		if d&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return packet{}, errMalformed
+		}
+		mul *= 128
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+	return packet{header: h, body: body}, nil
+}
+
+// connackError returns the refusal in a CONNACK body (nil when accepted).
+func connackError(body []byte) error {
+	if len(body) != 2 {
+		return errMalformed
+	}
+	if body[1] == 0 {
+		return nil
+	}
+	if s, ok := connackReasons[body[1]]; ok {
+		return fmt.Errorf("mqtt: connection refused: %s", s)
+	}
+	return fmt.Errorf("mqtt: connection refused: code %d", body[1])
+}
@@ -0,0 +1,118 @@
+// Package normalize brings the CAN IDs of frames into one canonical form
+// before the rest of the gateway sees them. Codecs only undo their framing:
+// the serial codec reports the 32-bit ID of its wire, SocketCAN the kernel's
+// can_id and cannelloni the ID it received. Which flags those IDs carry is
+// decided here, by explicit configuration: whether extended IDs are marked
+// (EFF), whether remote request flags are kept and whether error frames
+// pass. The high bit of the cannelloni length byte is handled in the codec,
+// since the payload size depends on it: it is the cnl.LenFD marker, accepted
+// once FD is negotiated and otherwise rejected unless cnl.Codec.MaskFD
+// ignores it for legacy peers.
+//
+// Validation (package validate) runs after normalization, so a repair made
+// here is not counted as an invalid frame.
+package normalize
+
+import (
+	"fmt"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// Changes counted in frames_normalized_total{change}.
+const (
+	ChangeEFF   = "eff"         // CAN_EFF_FLAG set
+	ChangeFlags = "flags"       // CAN_RTR_FLAG cleared
+	ChangeErr   = "err_dropped" // error frame dropped
+)
+
+// EFFMode decides when a CAN ID is marked extended.
+type EFFMode uint8
+
+const (
+	EFFKeep  EFFMode = iota // as the backend reports it
+	EFFAuto                 // extended when the ID does not fit 11 bits
+	EFFForce                // every frame extended (Ampio buses use 29-bit IDs only)
+)
+
+var effNames = [...]string{EFFKeep: "keep", EFFAuto: "auto", EFFForce: "force"}
+
+func (m EFFMode) String() string {
+	if int(m) < len(effNames) {
+		return effNames[m]
+	}
+	return fmt.Sprintf("eff(%d)", uint8(m))
+}
+
+// ID returns id marked extended when m asks for it. Other flags are kept.
+func (m EFFMode) ID(id uint32) uint32 {
+	if id&can.CAN_EFF_FLAG == 0 {
+		if m == EFFForce || m == EFFAuto && id&can.CAN_EFF_MASK > can.CAN_SFF_MASK {
+			id |= can.CAN_EFF_FLAG
+		}
+	}
+	return id
+}
+
+// ParseEFF converts "keep", "auto" or "force" to an EFFMode.
+func ParseEFF(s string) (EFFMode, error) {
+	for m, n := range effNames {
+		if s == n {
+			return EFFMode(m), nil
+		}
+	}
+	return EFFKeep, fmt.Errorf("unknown EFF mode %q (want keep|auto|force)", s)
+}
+
+// Config selects the canonical form. The zero value changes nothing.
+type Config struct {
+	EFF EFFMode
+	// StripFlags clears CAN_RTR_FLAG: remote requests pass as data frames
+	// of the requested length, for consumers without remote frames.
+	StripFlags bool
+	// StripErr drops error frames (CAN_ERR_FLAG).
+	StripErr bool
+}
+
+// Identity reports whether c leaves every frame as it is.
+func (c Config) Identity() bool { return c == Config{} }
+
+func (c Config) String() string {
+	flags := "preserve"
+	if c.StripFlags {
+		flags = "strip"
+	}
+	return fmt.Sprintf("eff=%s flags=%s strip_err=%t", c.EFF, flags, c.StripErr)
+}
+
+// Rewrite brings the CAN ID of fr into canonical form and reports whether
+// it changed. Error frames keep their ID: it carries the error classes.
+func (c Config) Rewrite(fr *can.Frame) bool {
+	if fr.CANID&can.CAN_ERR_FLAG != 0 {
+		return false
+	}
+	changed := false
+	if id := c.EFF.ID(fr.CANID); id != fr.CANID {
+		fr.CANID = id
+		metrics.IncNormalized(ChangeEFF)
+		changed = true
+	}
+	if c.StripFlags && fr.CANID&can.CAN_RTR_FLAG != 0 {
+		fr.CANID &^= can.CAN_RTR_FLAG
+		metrics.IncNormalized(ChangeFlags)
+		changed = true
+	}
+	return changed
+}
+
+// Frame normalizes a received frame and reports whether it passes; only
+// StripErr drops frames.
+func (c Config) Frame(fr *can.Frame) bool {
+	if c.StripErr && fr.CANID&can.CAN_ERR_FLAG != 0 {
+		metrics.IncNormalized(ChangeErr)
+		return false
+	}
+	c.Rewrite(fr)
+	return true
+}
@@ -0,0 +1,139 @@
+package normalize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/serial"
+	"github.com/kstaniek/go-ampio-server/internal/validate"
+)
+
+const (
+	eff     = can.CAN_EFF_FLAG
+	rtr     = can.CAN_RTR_FLAG
+	errFlag = can.CAN_ERR_FLAG
+)
+
+func TestParseEFF(t *testing.T) {
+	for _, m := range []EFFMode{EFFKeep, EFFAuto, EFFForce} {
+		if got, err := ParseEFF(m.String()); err != nil || got != m {
+			t.Fatalf("ParseEFF(%q) = %v, %v", m, got, err)
+		}
+	}
+	if _, err := ParseEFF("always"); err == nil {
+		t.Fatal("ParseEFF accepted an unknown mode")
+	}
+}
+
+// Sources decode a frame with the given CAN ID and a 2-byte payload the way
+// each backend codec does. The serial wire has no flags.
+var sources = map[string]func(t *testing.T, canid uint32) can.Frame{
+	"serial": func(t *testing.T, canid uint32) can.Frame {
+		wire := []byte{0x2D, 0xD4, 4 + 2 + 1, 0, 0, 0, 0, 0xAA, 0xBB, 0}
+		binary.BigEndian.PutUint32(wire[3:7], canid&can.CAN_EFF_MASK)
+		var got []can.Frame
+		_ = serial.Codec{NoChecksum: true}.DecodeStream(bytes.NewBuffer(wire), func(fr can.Frame) { got = append(got, fr) })
+		if len(got) != 1 {
+			t.Fatalf("serial decoded %d frames", len(got))
+		}
+		return got[0]
+	},
+	"socketcan": func(t *testing.T, canid uint32) can.Frame {
+		// The kernel's can_id is passed on as is.
+		return can.Frame{CANID: canid, Len: 2, Data: [64]byte{0xAA, 0xBB}}
+	},
+	"cannelloni": func(t *testing.T, canid uint32) can.Frame {
+		var c cnl.Codec
+		fr, err := c.Decode(bytes.NewReader(c.Encode([]can.Frame{{CANID: canid, Len: 2, Data: [64]byte{0xAA, 0xBB}}})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fr
+	},
+}
+
+// TestCodecCombinations normalizes frames from every backend codec and
+// checks what clients (cannelloni) and the serial TX wire get.
+func TestCodecCombinations(t *testing.T) {
+	cases := []struct {
+		name   string
+		cfg    Config
+		in     uint32
+		source map[string]uint32 // canonical ID per source; absent: dropped
+	}{
+		{"keep sff", Config{}, 0x123,
+			map[string]uint32{"serial": 0x123, "socketcan": 0x123, "cannelloni": 0x123}},
+		{"keep eff", Config{}, eff | 0x1234,
+			map[string]uint32{"serial": 0x1234, "socketcan": eff | 0x1234, "cannelloni": eff | 0x1234}},
+		{"force sff", Config{EFF: EFFForce}, 0x123,
+			map[string]uint32{"serial": eff | 0x123, "socketcan": eff | 0x123, "cannelloni": eff | 0x123}},
+		{"auto sff", Config{EFF: EFFAuto}, 0x123,
+			map[string]uint32{"serial": 0x123, "socketcan": 0x123, "cannelloni": 0x123}},
+		{"auto long id", Config{EFF: EFFAuto}, 0x1234,
+			map[string]uint32{"serial": eff | 0x1234, "socketcan": eff | 0x1234, "cannelloni": eff | 0x1234}},
+		{"preserve rtr", Config{}, rtr | 0x123,
+			map[string]uint32{"serial": 0x123, "socketcan": rtr | 0x123, "cannelloni": rtr | 0x123}},
+		{"strip rtr", Config{StripFlags: true}, rtr | 0x123,
+			map[string]uint32{"serial": 0x123, "socketcan": 0x123, "cannelloni": 0x123}},
+		{"force keeps rtr", Config{EFF: EFFForce}, rtr | 0x123,
+			map[string]uint32{"serial": eff | 0x123, "socketcan": eff | rtr | 0x123, "cannelloni": eff | rtr | 0x123}},
+		{"err passes", Config{EFF: EFFForce, StripFlags: true}, errFlag | can.CAN_ERR_BUSOFF,
+			map[string]uint32{"serial": eff | can.CAN_ERR_BUSOFF, "socketcan": errFlag | can.CAN_ERR_BUSOFF, "cannelloni": errFlag | can.CAN_ERR_BUSOFF}},
+		{"strip err", Config{StripErr: true}, errFlag | can.CAN_ERR_BUSOFF,
+			map[string]uint32{"serial": can.CAN_ERR_BUSOFF}},
+	}
+	for _, tc := range cases {
+		for name, decode := range sources {
+			fr := decode(t, tc.in)
+			want, pass := tc.source[name]
+			if got := tc.cfg.Frame(&fr); got != pass {
+				t.Fatalf("%s/%s: Frame passed=%v, want %v", tc.name, name, got, pass)
+			}
+			if !pass {
+				continue
+			}
+			if fr.CANID != want {
+				t.Fatalf("%s/%s: id 0x%X, want 0x%X", tc.name, name, fr.CANID, want)
+			}
+			// A long serial ID kept unmarked is what EFF force (the serial
+			// default) exists for: validation rejects it.
+			wantRule := ""
+			if want&can.CAN_EFF_FLAG == 0 && want&can.CAN_EFF_MASK > can.CAN_SFF_MASK {
+				wantRule = "sff_id"
+			}
+			if r := validate.Check(validate.RX, &fr); r != wantRule {
+				t.Fatalf("%s/%s: validation rule %q, want %q", tc.name, name, r, wantRule)
+			}
+			// Clients get the canonical ID over cannelloni.
+			var c cnl.Codec
+			out, err := c.Decode(bytes.NewReader(c.Encode([]can.Frame{fr})))
+			if err != nil || out.CANID != want || out.Len != 2 {
+				t.Fatalf("%s/%s: cannelloni round trip %+v, %v", tc.name, name, out, err)
+			}
+			// The serial wire carries the 29-bit ID without flags.
+			if fr.CANID&(rtr|errFlag) == 0 {
+				wire := serial.Codec{}.Encode(fr)
+				if id := binary.BigEndian.Uint32(wire[5:9]); id != want&can.CAN_EFF_MASK {
+					t.Fatalf("%s/%s: serial wire id 0x%X, want 0x%X", tc.name, name, id, want&can.CAN_EFF_MASK)
+				}
+			}
+		}
+	}
+}
+
+func TestRewriteReportsChange(t *testing.T) {
+	fr := can.Frame{CANID: eff | 0x1234}
+	if (Config{EFF: EFFForce}).Rewrite(&fr) {
+		t.Fatal("an extended ID was reported changed")
+	}
+	fr.CANID = 0x123
+	if !(Config{EFF: EFFForce}).Rewrite(&fr) || fr.CANID != eff|0x123 {
+		t.Fatalf("force: id 0x%X", fr.CANID)
+	}
+	if !(Config{}).Identity() || (Config{StripErr: true}).Identity() {
+		t.Fatal("Identity")
+	}
+}
@@ -0,0 +1,419 @@
+// Package pairing lets two can-servers on the same LAN find each other with
+// UDP broadcast beacons signed by a shared key, and federates them over a
+// TCP link authenticated with the same key.
+//
+// Every server broadcasts a beacon with a random node ID, its link port,
+// its IPv4 addresses, a fresh nonce and an HMAC-SHA256 over all of them. A
+// server only reacts to beacons carrying a valid MAC for its own key, sent
+// from one of the signed addresses and not seen before, so installations
+// with different keys on one LAN stay apart and a captured beacon cannot
+// redirect pairing. Of two paired servers the one with the lower node ID
+// dials the other; both sides prove knowledge of the key in a
+// challenge-response before the link carries frames.
+package pairing
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPort is the UDP port beacons are sent to and received on, and
+	// the TCP port of the pairing link.
+	DefaultPort = 20001
+	// DefaultInterval is how often a beacon is broadcast.
+	DefaultInterval = 5 * time.Second
+	// MaxAge bounds how old (or how far in the future) a beacon timestamp
+	// may be. Nonces are remembered for twice as long, so a captured beacon
+	// cannot be replayed.
+	MaxAge = 30 * time.Second
+	// LinkTimeout bounds dialing and authenticating a pairing link.
+	LinkTimeout = 5 * time.Second
+
+	beaconVersion = 2
+	maxBeacon     = 1024
+	nodeLen       = 16 // hex characters of a node ID
+	nonceLen      = 16
+	linkMagic     = "CSPL"
+)
+
+// ErrBadBeacon reports a beacon that is malformed, stale, replayed or not
+// signed with the shared key.
+var ErrBadBeacon = errors.New("bad pairing beacon")
+
+// ErrBadLink reports a pairing link whose other end did not prove
+// knowledge of the shared key.
+var ErrBadLink = errors.New("pairing link authentication failed")
+
+// Beacon is the JSON payload of a pairing datagram.
+type Beacon struct {
+	V     int      `json:"v"`
+	Node  string   `json:"node"` // random per process, hex
+	Name  string   `json:"name,omitempty"`
+	Port  int      `json:"port"`  // TCP port of the pairing link
+	IPs   []string `json:"ips"`   // IPv4 addresses of the sender
+	Nonce string   `json:"nonce"` // random per beacon, hex
+	TS    int64    `json:"ts"`    // unix seconds
+	MAC   string   `json:"mac"`
+}
+
+func (b *Beacon) mac(key []byte) string {
+	m := hmac.New(sha256.New, key)
+	fmt.Fprintf(m, "%d|%s|%s|%d|%s|%s|%d", b.V, b.Node, b.Name, b.Port, strings.Join(b.IPs, ","), b.Nonce, b.TS)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// Sign sets b.MAC for key.
+func (b *Beacon) Sign(key []byte) { b.MAC = b.mac(key) }
+
+// Verify checks the version, MAC and timestamp of b, and that it was sent
+// from one of the addresses it advertises.
+func (b *Beacon) Verify(key []byte, now time.Time, from net.IP) error {
+	if b.V != beaconVersion || len(b.Node) != nodeLen || b.Nonce == "" || b.Port <= 0 || b.Port > 65535 {
+		return fmt.Errorf("%w: malformed", ErrBadBeacon)
+	}
+	if !hmac.Equal([]byte(b.MAC), []byte(b.mac(key))) {
+		return fmt.Errorf("%w: key mismatch", ErrBadBeacon)
+	}
+	if d := now.Sub(time.Unix(b.TS, 0)); d > MaxAge || d < -MaxAge {
+		return fmt.Errorf("%w: timestamp off by %s", ErrBadBeacon, d.Round(time.Second))
+	}
+	if !slices.Contains(b.IPs, from.String()) {
+		return fmt.Errorf("%w: sent from %s, not an advertised address", ErrBadBeacon, from)
+	}
+	return nil
+}
+
+// Peer is a paired server.
+type Peer struct {
+	Node string
+	Name string
+	Addr string // host:port of its link listener, or the dialer's address
+}
+
+// Config configures a Pairer.
+type Config struct {
+	Key      []byte
+	Name     string        // advertised in beacons (for logs)
+	Port     int           // UDP beacon and TCP link port (0 = DefaultPort)
+	Dest     string        // beacon destination (default 255.255.255.255:Port)
+	Interval time.Duration // beacon period (0 = DefaultInterval)
+	Logger   *slog.Logger
+	// Link runs a federation link to p over the authenticated conn until
+	// it fails or ctx ends. It is called on both sides; the Pairer closes
+	// conn afterwards, and a new beacon restarts the link.
+	Link func(ctx context.Context, p Peer, conn net.Conn) error
+}
+
+// Pairer broadcasts beacons and starts links to peers.
+type Pairer struct {
+	cfg  Config
+	node string
+	now  func() time.Time
+
+	mu     sync.Mutex
+	links  map[string]bool      // node -> link running
+	peers  map[string]Peer      // nodes with a valid beacon
+	nonces map[string]time.Time // beacon nonces seen -> when
+}
+
+// New returns a Pairer with a random node ID.
+func New(cfg Config) *Pairer {
+	if cfg.Port == 0 {
+		cfg.Port = DefaultPort
+	}
+	if cfg.Dest == "" {
+		cfg.Dest = net.JoinHostPort("255.255.255.255", strconv.Itoa(cfg.Port))
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return &Pairer{
+		cfg: cfg, node: randomHex(nodeLen / 2), now: time.Now,
+		links: make(map[string]bool), peers: make(map[string]Peer), nonces: make(map[string]time.Time),
+	}
+}
+
+// Node returns the node ID of this server.
+func (p *Pairer) Node() string { return p.node }
+
+// Run sends and receives beacons, and accepts pairing links, until ctx is
+// cancelled.
+func (p *Pairer) Run(ctx context.Context) error {
+	addr := net.JoinHostPort("", strconv.Itoa(p.cfg.Port))
+	lc := net.ListenConfig{Control: broadcastControl}
+	pc, err := lc.ListenPacket(ctx, "udp4", addr)
+	if err != nil {
+		return err
+	}
+	dest, err := net.ResolveUDPAddr("udp4", p.cfg.Dest)
+	if err != nil {
+		_ = pc.Close()
+		return err
+	}
+	var tl net.ListenConfig
+	ln, err := tl.Listen(ctx, "tcp4", addr)
+	if err != nil {
+		_ = pc.Close()
+		return err
+	}
+	go func() { <-ctx.Done(); _ = pc.Close(); _ = ln.Close() }()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Add(2)
+	go func() { defer wg.Done(); p.announce(ctx, pc, dest) }()
+	go func() { defer wg.Done(); p.acceptLinks(ctx, ln, &wg) }()
+	buf := make([]byte, maxBeacon)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		ua, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		p.handle(ctx, buf[:n], ua.IP, &wg)
+	}
+}
+
+func (p *Pairer) announce(ctx context.Context, pc net.PacketConn, dest net.Addr) {
+	t := time.NewTicker(p.cfg.Interval)
+	defer t.Stop()
+	for {
+		b := Beacon{V: beaconVersion, Node: p.node, Name: p.cfg.Name, Port: p.cfg.Port, IPs: localIPs(), Nonce: randomHex(nonceLen), TS: p.now().Unix()}
+		b.Sign(p.cfg.Key)
+		msg, _ := json.Marshal(b)
+		if _, err := pc.WriteTo(msg, dest); err != nil && ctx.Err() == nil {
+			p.cfg.Logger.Warn("pair_beacon_error", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// handle verifies one datagram and starts a link when this side dials.
+func (p *Pairer) handle(ctx context.Context, msg []byte, ip net.IP, wg *sync.WaitGroup) {
+	var b Beacon
+	if err := json.Unmarshal(msg, &b); err != nil {
+		return
+	}
+	if b.Node == p.node {
+		return // our own broadcast
+	}
+	now := p.now()
+	if err := b.Verify(p.cfg.Key, now, ip); err != nil {
+		p.cfg.Logger.Debug("pair_beacon_rejected", "from", ip.String(), "error", err)
+		return
+	}
+	peer := Peer{Node: b.Node, Name: b.Name, Addr: net.JoinHostPort(ip.String(), strconv.Itoa(b.Port))}
+	p.mu.Lock()
+	if _, replayed := p.nonces[b.Nonce]; replayed {
+		p.mu.Unlock()
+		p.cfg.Logger.Debug("pair_beacon_rejected", "from", ip.String(), "error", fmt.Errorf("%w: replayed", ErrBadBeacon))
+		return
+	}
+	for n, at := range p.nonces {
+		if now.Sub(at) > 2*MaxAge {
+			delete(p.nonces, n)
+		}
+	}
+	p.nonces[b.Nonce] = now
+	_, known := p.peers[b.Node]
+	p.peers[b.Node] = peer
+	dial := p.node < b.Node && !p.links[b.Node] && p.cfg.Link != nil
+	if dial {
+		p.links[b.Node] = true
+	}
+	p.mu.Unlock()
+	if !known {
+		p.cfg.Logger.Info("pair_peer_found", "peer", peer.Name, "node", peer.Node, "addr", peer.Addr, "dial", p.node < b.Node)
+	}
+	if !dial {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := p.dialLink(ctx, peer)
+		if err == nil {
+			err = p.cfg.Link(ctx, peer, conn)
+			_ = conn.Close()
+		}
+		p.linkDone(ctx, peer, err)
+	}()
+}
+
+// linkDone releases the link slot of peer so the next beacon can restart it.
+func (p *Pairer) linkDone(ctx context.Context, peer Peer, err error) {
+	p.mu.Lock()
+	delete(p.links, peer.Node)
+	p.mu.Unlock()
+	if ctx.Err() == nil {
+		p.cfg.Logger.Warn("pair_link_down", "peer", peer.Name, "addr", peer.Addr, "error", err)
+	}
+}
+
+// acceptLinks serves the links dialed by peers with a lower node ID.
+func (p *Pairer) acceptLinks(ctx context.Context, ln net.Listener, wg *sync.WaitGroup) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				p.cfg.Logger.Warn("pair_accept_error", "error", err)
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			peer, err := p.acceptLink(conn)
+			if err != nil {
+				p.cfg.Logger.Warn("pair_link_rejected", "from", conn.RemoteAddr().String(), "error", err)
+				return
+			}
+			err = p.cfg.Link(ctx, peer, conn)
+			p.linkDone(ctx, peer, err)
+		}()
+	}
+}
+
+// The link handshake is a mutual challenge-response over fixed-size
+// messages, so no frame bytes are read ahead:
+//
+//	dialer   -> acceptor  magic, dialer node, dialer nonce
+//	acceptor -> dialer    acceptor node, acceptor nonce, MAC("accept")
+//	dialer   -> acceptor  MAC("dial")
+//
+// Both MACs cover both nodes and both nonces.
+
+// dialLink connects to peer and authenticates the link.
+func (p *Pairer) dialLink(ctx context.Context, peer Peer) (net.Conn, error) {
+	d := net.Dialer{Timeout: LinkTimeout}
+	conn, err := d.DialContext(ctx, "tcp", peer.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.dialerAuth(conn, peer.Node); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (p *Pairer) dialerAuth(conn net.Conn, peerNode string) error {
+	_ = conn.SetDeadline(time.Now().Add(LinkTimeout))
+	nd := randomBytes(nonceLen)
+	if _, err := conn.Write(slices.Concat([]byte(linkMagic), []byte(p.node), nd)); err != nil {
+		return err
+	}
+	var ans [nodeLen + nonceLen + sha256.Size]byte
+	if _, err := io.ReadFull(conn, ans[:]); err != nil {
+		return err
+	}
+	node, na, mac := string(ans[:nodeLen]), ans[nodeLen:nodeLen+nonceLen], ans[nodeLen+nonceLen:]
+	if node != peerNode {
+		return fmt.Errorf("%w: answered by node %q", ErrBadLink, node)
+	}
+	if !hmac.Equal(mac, p.linkMAC("accept", p.node, node, nd, na)) {
+		return fmt.Errorf("%w: key mismatch", ErrBadLink)
+	}
+	if _, err := conn.Write(p.linkMAC("dial", p.node, node, nd, na)); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// acceptLink authenticates a dialed link and claims its slot. The dialer
+// must be a peer whose beacon was accepted and whose node ID is lower.
+func (p *Pairer) acceptLink(conn net.Conn) (Peer, error) {
+	_ = conn.SetDeadline(time.Now().Add(LinkTimeout))
+	var hello [len(linkMagic) + nodeLen + nonceLen]byte
+	if _, err := io.ReadFull(conn, hello[:]); err != nil {
+		return Peer{}, err
+	}
+	if !bytes.Equal(hello[:len(linkMagic)], []byte(linkMagic)) {
+		return Peer{}, fmt.Errorf("%w: not a pairing link", ErrBadLink)
+	}
+	node, nd := string(hello[len(linkMagic):len(linkMagic)+nodeLen]), hello[len(linkMagic)+nodeLen:]
+	p.mu.Lock()
+	peer, known := p.peers[node]
+	p.mu.Unlock()
+	if !known || node >= p.node {
+		return Peer{}, fmt.Errorf("%w: unexpected node %q", ErrBadLink, node)
+	}
+	na := randomBytes(nonceLen)
+	if _, err := conn.Write(slices.Concat([]byte(p.node), na, p.linkMAC("accept", node, p.node, nd, na))); err != nil {
+		return Peer{}, err
+	}
+	var mac [sha256.Size]byte
+	if _, err := io.ReadFull(conn, mac[:]); err != nil {
+		return Peer{}, err
+	}
+	if !hmac.Equal(mac[:], p.linkMAC("dial", node, p.node, nd, na)) {
+		return Peer{}, fmt.Errorf("%w: key mismatch", ErrBadLink)
+	}
+	p.mu.Lock()
+	busy := p.links[node]
+	p.links[node] = true
+	p.mu.Unlock()
+	if busy {
+		return Peer{}, fmt.Errorf("%w: link to node %s already up", ErrBadLink, node)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	peer.Addr = conn.RemoteAddr().String()
+	return peer, nil
+}
+
+func (p *Pairer) linkMAC(role, dialer, acceptor string, nd, na []byte) []byte {
+	m := hmac.New(sha256.New, p.cfg.Key)
+	fmt.Fprintf(m, "pairing-link|%s|%s|%s|", role, dialer, acceptor)
+	m.Write(nd)
+	m.Write(na)
+	return m.Sum(nil)
+}
+
+// localIPs lists the IPv4 addresses of this host, advertised in beacons.
+func localIPs() []string {
+	addrs, _ := net.InterfaceAddrs()
+	var out []string
+	for _, a := range addrs {
+		if in, ok := a.(*net.IPNet); ok && in.IP.To4() != nil {
+			out = append(out, in.IP.String())
+		}
+	}
+	return out
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return b
+}
+
+func randomHex(n int) string { return hex.EncodeToString(randomBytes(n)) }
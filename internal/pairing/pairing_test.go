@@ -0,0 +1,147 @@
+package pairing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBeaconVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	from := net.ParseIP("192.168.1.10")
+	b := Beacon{V: beaconVersion, Node: "0000000000000001", Name: "hall", Port: 20001, IPs: []string{"192.168.1.10"}, Nonce: "ab", TS: now.Unix()}
+	b.Sign([]byte("k1"))
+	if err := b.Verify([]byte("k1"), now, from); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Verify([]byte("k2"), now, from); !errors.Is(err, ErrBadBeacon) {
+		t.Fatalf("wrong key: %v", err)
+	}
+	if err := b.Verify([]byte("k1"), now.Add(MaxAge+time.Second), from); !errors.Is(err, ErrBadBeacon) {
+		t.Fatalf("stale: %v", err)
+	}
+	// Replayed from another host, e.g. to redirect pairing to it.
+	if err := b.Verify([]byte("k1"), now, net.ParseIP("192.168.1.66")); !errors.Is(err, ErrBadBeacon) {
+		t.Fatalf("foreign source: %v", err)
+	}
+	b.IPs = []string{"192.168.1.66"} // tampered after signing
+	if err := b.Verify([]byte("k1"), now, net.ParseIP("192.168.1.66")); !errors.Is(err, ErrBadBeacon) {
+		t.Fatalf("tampered: %v", err)
+	}
+}
+
+func TestBeaconReplay(t *testing.T) {
+	p := New(Config{Key: []byte("k1")})
+	b := Beacon{V: beaconVersion, Node: "ffffffffffffffff", Port: 20001, IPs: []string{"127.0.0.1"}, Nonce: "ab", TS: time.Now().Unix()}
+	b.Sign([]byte("k1"))
+	msg, _ := json.Marshal(b)
+	p.handle(context.Background(), msg, net.ParseIP("127.0.0.1"), nil)
+	delete(p.peers, b.Node)
+	p.handle(context.Background(), msg, net.ParseIP("127.0.0.1"), nil)
+	if _, ok := p.peers[b.Node]; ok {
+		t.Fatal("replayed beacon accepted")
+	}
+}
+
+// freePort returns a port free for both UDP and TCP on 127.0.0.1.
+func freePort(t *testing.T) int {
+	t.Helper()
+	for {
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := pc.LocalAddr().(*net.UDPAddr).Port
+		ln, err := net.Listen("tcp4", "127.0.0.1:"+strconv.Itoa(port))
+		pc.Close()
+		if err == nil {
+			ln.Close()
+			return port
+		}
+	}
+}
+
+func TestPairersLink(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pa, pb := freePort(t), freePort(t)
+	type linked struct {
+		by   string
+		peer Peer
+	}
+	links := make(chan linked, 4)
+	mk := func(name string, port, peerPort int, key string) *Pairer {
+		return New(Config{
+			Key: []byte(key), Name: name, Port: port,
+			Dest:     net.JoinHostPort("127.0.0.1", strconv.Itoa(peerPort)),
+			Interval: 20 * time.Millisecond,
+			Link: func(ctx context.Context, p Peer, conn net.Conn) error {
+				links <- linked{name, p}
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		})
+	}
+	a, b := mk("a", pa, pb, "secret"), mk("b", pb, pa, "secret")
+	a.node, b.node = "0000000000000001", "0000000000000002" // a dials
+	for _, p := range []*Pairer{a, b} {
+		go func(p *Pairer) { _ = p.Run(ctx) }(p)
+	}
+	got := map[string]Peer{}
+	for len(got) < 2 {
+		select {
+		case l := <-links:
+			got[l.by] = l.peer
+		case <-ctx.Done():
+			t.Fatalf("links: %+v", got)
+		}
+	}
+	if p := got["a"]; p.Name != "b" || p.Addr != net.JoinHostPort("127.0.0.1", strconv.Itoa(pb)) {
+		t.Fatalf("a linked to %+v", p)
+	}
+	if p := got["b"]; p.Name != "a" {
+		t.Fatalf("b linked to %+v", p)
+	}
+	time.Sleep(100 * time.Millisecond) // several more beacons
+	if n := len(links); n != 0 {
+		t.Fatalf("%d extra links", n)
+	}
+}
+
+func TestLinkAuthKeyMismatch(t *testing.T) {
+	a := New(Config{Key: []byte("one")})
+	b := New(Config{Key: []byte("two")})
+	a.node, b.node = "0000000000000001", "0000000000000002"
+	b.peers[a.node] = Peer{Node: a.node}
+	ca, cb := net.Pipe()
+	defer ca.Close()
+	defer cb.Close()
+	errc := make(chan error, 1)
+	go func() { _, err := b.acceptLink(cb); cb.Close(); errc <- err }()
+	if err := a.dialerAuth(ca, b.node); !errors.Is(err, ErrBadLink) {
+		t.Fatalf("dialer: %v", err)
+	}
+	ca.Close()
+	if err := <-errc; err == nil {
+		t.Fatal("acceptor authenticated a dialer with another key")
+	}
+}
+
+func TestPairersKeyMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	pa, pb := freePort(t), freePort(t)
+	linked := make(chan Peer, 1)
+	link := func(_ context.Context, p Peer, _ net.Conn) error { linked <- p; return nil }
+	a := New(Config{Key: []byte("one"), Port: pa, Dest: "127.0.0.1:" + strconv.Itoa(pb), Interval: 20 * time.Millisecond, Link: link})
+	b := New(Config{Key: []byte("two"), Port: pb, Dest: "127.0.0.1:" + strconv.Itoa(pa), Interval: 20 * time.Millisecond, Link: link})
+	go func() { _ = a.Run(ctx) }()
+	_ = b.Run(ctx)
+	if len(linked) != 0 {
+		t.Fatal("paired with a different key")
+	}
+}
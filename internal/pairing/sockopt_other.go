@@ -0,0 +1,9 @@
+//go:build !unix
+
+package pairing
+
+import "syscall"
+
+// broadcastControl is a no-op where socket options are not set through
+// golang.org/x/sys/unix; beacons then need a directed Dest address.
+func broadcastControl(_, _ string, _ syscall.RawConn) error { return nil }
@@ -0,0 +1,25 @@
+//go:build unix
+
+package pairing
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// broadcastControl enables SO_BROADCAST, needed to send to the limited
+// broadcast address, and SO_REUSEADDR so a restarted server can rebind.
+func broadcastControl(_, _ string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST, 1); serr != nil {
+			return
+		}
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,134 @@
+package query
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/instances"
+)
+
+const (
+	defaultTimeout = time.Second
+	maxTimeout     = 30 * time.Second
+)
+
+// canID accepts a JSON number or a string in any strconv base prefix ("0x1A").
+type canID uint32
+
+func (c *canID) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid CAN ID %s", b)
+	}
+	*c = canID(v)
+	return nil
+}
+
+func (c canID) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"0x%X"`, uint32(c))), nil
+}
+
+type request struct {
+	ID           canID  `json:"id"`
+	Data         string `json:"data"` // hex payload
+	Extended     bool   `json:"extended"`
+	ResponseID   *canID `json:"response_id"` // required; nil when omitted
+	ResponseMask canID  `json:"response_mask"`
+	Timeout      string `json:"timeout"`
+}
+
+type response struct {
+	ID       canID   `json:"id"`
+	Extended bool    `json:"extended"`
+	Data     string  `json:"data"`
+	RTTMs    float64 `json:"rtt_ms"`
+}
+
+// Handler serves POST requests of the form
+//
+//	{"id":"0x123","data":"0102","response_id":"0x124","response_mask":"0x7FF","timeout":"500ms"}
+//
+// and replies with the first matching frame, or 504 on timeout. targets maps
+// instance names to requesters; the ?instance= parameter selects one and may
+// be omitted when there is only one.
+func Handler(targets map[string]*Requester) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rq, err := instances.Pick(targets, r.URL.Query().Get("instance"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		var body request
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		fr, timeout, err := body.frame()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		resp, rtt, err := rq.Do(ctx, fr, Match{ID: uint32(*body.ResponseID), Mask: uint32(body.ResponseMask)})
+		switch {
+		case errors.Is(err, ErrTimeout):
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(response{
+			ID:       canID(resp.CANID & can.CAN_EFF_MASK),
+			Extended: resp.CANID&can.CAN_EFF_FLAG != 0,
+			Data:     hex.EncodeToString(resp.Data[:resp.Len&0x7F]),
+			RTTMs:    float64(rtt.Microseconds()) / 1000,
+		})
+	})
+}
+
+func (b request) frame() (can.Frame, time.Duration, error) {
+	var fr can.Frame
+	if b.ResponseID == nil {
+		return fr, 0, errors.New("response_id is required")
+	}
+	timeout := defaultTimeout
+	if b.Timeout != "" {
+		d, err := time.ParseDuration(b.Timeout)
+		if err != nil || d <= 0 || d > maxTimeout {
+			return fr, 0, fmt.Errorf("timeout must be a duration in (0, %s]", maxTimeout)
+		}
+		timeout = d
+	}
+	data, err := hex.DecodeString(b.Data)
+	if err != nil || len(data) > 8 {
+		return fr, 0, errors.New("data must be 0..8 hex bytes")
+	}
+	id := uint32(b.ID)
+	if id > can.CAN_EFF_MASK {
+		return fr, 0, errors.New("id exceeds 29 bits")
+	}
+	if b.Extended || id > can.CAN_SFF_MASK {
+		id |= can.CAN_EFF_FLAG
+	}
+	fr.CANID = id
+	fr.Len = uint8(len(data))
+	copy(fr.Data[:], data)
+	return fr, timeout, nil
+}
@@ -0,0 +1,78 @@
+// Package query implements gateway-side request/response correlation: send a
+// frame to the bus and wait for the first reply matching an ID/mask, so
+// clients can query a module without their own state machine.
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+// ErrTimeout is returned when no matching response arrives in time.
+var ErrTimeout = errors.New("query: no response before timeout")
+
+// ErrUnsubscribed is returned when the hub dropped the response subscription.
+var ErrUnsubscribed = errors.New("query: response subscription closed")
+
+// subscriptionBuffer is the hub queue size of a pending request; frames that
+// do not match are discarded as they arrive.
+const subscriptionBuffer = 256
+
+// Requester correlates requests sent through send with responses broadcast by h.
+type Requester struct {
+	hub  *hub.Hub
+	send func(context.Context, can.Frame) error
+}
+
+// New returns a Requester; send should report the backend write outcome.
+func New(h *hub.Hub, send func(context.Context, can.Frame) error) *Requester {
+	return &Requester{hub: h, send: send}
+}
+
+// Match selects response frames: a frame matches when its ID (without flag
+// bits) equals ID under Mask. A zero Mask means an exact 29-bit match.
+type Match struct {
+	ID   uint32
+	Mask uint32
+}
+
+func (m Match) matches(fr *can.Frame) bool {
+	mask := m.Mask
+	if mask == 0 {
+		mask = can.CAN_EFF_MASK
+	}
+	return fr.CANID&can.CAN_EFF_MASK&mask == m.ID&mask
+}
+
+// Do sends req and waits until ctx is done for the first frame matching m.
+// The subscription is registered before sending so fast replies are not
+// missed. It returns the response and the time from send to receipt.
+func (r *Requester) Do(ctx context.Context, req can.Frame, m Match) (can.Frame, time.Duration, error) {
+	cl := &hub.Client{Out: make(chan can.Frame, subscriptionBuffer), Closed: make(chan struct{})}
+	r.hub.Add(cl)
+	defer r.hub.Remove(cl)
+	start := time.Now()
+	if err := r.send(ctx, req); err != nil {
+		return can.Frame{}, 0, fmt.Errorf("query send: %w", err)
+	}
+	for {
+		select {
+		case fr := <-cl.Out:
+			if m.matches(&fr) {
+				return fr, time.Since(start), nil
+			}
+		case <-cl.Closed:
+			return can.Frame{}, 0, ErrUnsubscribed
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return can.Frame{}, 0, ErrTimeout
+			}
+			return can.Frame{}, 0, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+// responder emulates a module answering on id+1 after some unrelated traffic.
+func responder(h *hub.Hub) func(context.Context, can.Frame) error {
+	return func(_ context.Context, req can.Frame) error {
+		go func() {
+			h.Broadcast(can.Frame{CANID: 0x555, Len: 1})
+			resp := can.Frame{CANID: req.CANID + 1, Len: 2}
+			resp.Data[0], resp.Data[1] = 0xBE, 0xEF
+			h.Broadcast(resp)
+		}()
+		return nil
+	}
+}
+
+func TestRequesterDo(t *testing.T) {
+	h := hub.New()
+	rq := New(h, responder(h))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, _, err := rq.Do(ctx, can.Frame{CANID: 0x100}, Match{ID: 0x101})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.CANID != 0x101 || resp.Data[0] != 0xBE {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if h.Count() != 0 {
+		t.Fatalf("subscription leaked: %d clients", h.Count())
+	}
+}
+
+func TestRequesterTimeout(t *testing.T) {
+	h := hub.New()
+	rq := New(h, responder(h))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, _, err := rq.Do(ctx, can.Frame{CANID: 0x100}, Match{ID: 0x200, Mask: 0x7F0}); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	h := hub.New()
+	srv := httptest.NewServer(Handler(map[string]*Requester{"a": New(h, responder(h))}))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"?instance=a", "application/json",
+		strings.NewReader(`{"id":"0x1FFFF00","data":"01","response_id":"0x1FFFF01","timeout":"500ms"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out response
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&out) != nil {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if out.ID != 0x1FFFF01 || !out.Extended || out.Data != "beef" {
+		t.Fatalf("unexpected response %+v", out)
+	}
+
+	for body, code := range map[string]int{
+		`{"id":"0x100","response_id":"0x300","timeout":"20ms"}`: http.StatusGatewayTimeout,
+		`{"id":"0x100","response_id":"0x300","data":"zz"}`:      http.StatusBadRequest,
+		`{"id":"0x100","response_id":"0x300","timeout":"1h"}`:   http.StatusBadRequest,
+		`{"id":"0x100","data":"01"}`:                            http.StatusBadRequest,
+	} {
+		resp, err := http.Post(srv.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Fatalf("%s: got %d want %d", body, resp.StatusCode, code)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Package rxpipe splits a backend RX loop into stages on their own
+// goroutines: the backend's loop only reads from the device, a decode stage
+// turns raw chunks into frames and a broadcast stage hands them to the hub.
+// On a fully loaded 1 Mbit/s bus a single goroutine doing all three can
+// saturate one core of a small board; staged, they spread over the cores
+// and a slow broadcast no longer delays the next read.
+//
+// Stages are joined by bounded queues. A stage whose next queue is full
+// waits (counted in rx_pipeline_stalls_total) rather than dropping, so the
+// backlog moves back into the device or kernel buffers.
+package rxpipe
+
+import (
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// Stage names (rx_pipeline_*{stage}).
+const (
+	StageDecode    = "decode"
+	StageBroadcast = "broadcast"
+)
+
+// Queue is a bounded hand-off to one stage.
+type Queue[T any] struct {
+	stage string
+	ch    chan T
+}
+
+// NewQueue returns a queue feeding stage holding up to depth items.
+func NewQueue[T any](stage string, depth int) *Queue[T] {
+	return &Queue[T]{stage: stage, ch: make(chan T, depth)}
+}
+
+// Put queues v, waiting while the queue is full.
+func (q *Queue[T]) Put(v T) {
+	select {
+	case q.ch <- v:
+		return
+	default:
+	}
+	metrics.IncRxPipelineStall(q.stage)
+	q.ch <- v
+}
+
+// Close ends the queue; Run returns once the queued items are processed.
+func (q *Queue[T]) Close() { close(q.ch) }
+
+// Run calls fn for every queued item until the queue is closed and drained.
+func (q *Queue[T]) Run(fn func(T)) {
+	for v := range q.ch {
+		metrics.RxPipelineTake(q.stage, len(q.ch))
+		fn(v)
+	}
+}
+
+// Pipeline is the decode and broadcast stages of one backend.
+type Pipeline struct {
+	raw    *Queue[[]byte] // nil without a decode stage
+	frames *Queue[can.Frame]
+	wg     sync.WaitGroup
+}
+
+// New starts a pipeline whose queues hold depth items each. decode turns a
+// raw chunk into frames and runs on the decode stage, with the chunks in
+// order; it may keep state such as a partial frame between calls. Backends
+// whose reads return whole frames pass a nil decode and feed Frame.
+// broadcast runs on the broadcast stage for every frame, in order.
+func New(depth int, decode func(b []byte, emit func(can.Frame)), broadcast func(can.Frame)) *Pipeline {
+	p := &Pipeline{frames: NewQueue[can.Frame](StageBroadcast, depth)}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.frames.Run(broadcast)
+	}()
+	if decode != nil {
+		p.raw = NewQueue[[]byte](StageDecode, depth)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer p.frames.Close()
+			p.raw.Run(func(b []byte) { decode(b, p.frames.Put) })
+		}()
+	}
+	return p
+}
+
+// Raw hands a chunk read from the device to the decode stage. The pipeline
+// owns b from then on; the reader must not reuse it.
+func (p *Pipeline) Raw(b []byte) { p.raw.Put(b) }
+
+// Frame hands a frame read whole from the device to the broadcast stage.
+// Only for pipelines without a decode stage.
+func (p *Pipeline) Frame(fr can.Frame) { p.frames.Put(fr) }
+
+// Close stops the pipeline once everything queued is broadcast. Call it
+// from the reader after its last Raw or Frame.
+func (p *Pipeline) Close() {
+	if p.raw != nil {
+		p.raw.Close()
+	} else {
+		p.frames.Close()
+	}
+	p.wg.Wait()
+}
@@ -0,0 +1,56 @@
+package rxpipe
+
+import (
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestPipelineKeepsOrder(t *testing.T) {
+	var got []uint32
+	var partial []byte
+	// decode turns every two bytes into a frame, keeping an odd byte for
+	// the next chunk like a stream codec keeps a partial frame.
+	decode := func(b []byte, emit func(can.Frame)) {
+		partial = append(partial, b...)
+		for len(partial) >= 2 {
+			emit(can.Frame{CANID: uint32(partial[0])<<8 | uint32(partial[1])})
+			partial = partial[2:]
+		}
+	}
+	p := New(1, decode, func(fr can.Frame) { got = append(got, fr.CANID) })
+	var want []uint32
+	for i := 0; i < 200; i++ {
+		want = append(want, uint32(i))
+	}
+	stream := make([]byte, 0, 400)
+	for _, id := range want {
+		stream = append(stream, byte(id>>8), byte(id))
+	}
+	for len(stream) > 0 {
+		n := min(3, len(stream)) // chunks split frames
+		p.Raw(append([]byte(nil), stream[:n]...))
+		stream = stream[n:]
+	}
+	p.Close() // waits for the broadcast stage; got is safe to read
+	if len(got) != len(want) {
+		t.Fatalf("broadcast %d frames, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("frame %d has id %d, want %d", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPipelineFramesOnly(t *testing.T) {
+	n := 0
+	p := New(4, nil, func(can.Frame) { n++ })
+	for i := 0; i < 50; i++ {
+		p.Frame(can.Frame{CANID: uint32(i)})
+	}
+	p.Close()
+	if n != 50 {
+		t.Fatalf("broadcast %d frames, want 50", n)
+	}
+}
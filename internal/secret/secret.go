@@ -0,0 +1,103 @@
+// Package secret loads credentials (tokens, keys) from files or environment
+// variables following the Docker/Kubernetes *_FILE convention, caching the
+// value in memory and allowing an explicit reload.
+package secret
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrEmpty is returned when a secret file exists but contains no value.
+var ErrEmpty = errors.New("secret: empty")
+
+// Value is a cached secret that is either a literal or backed by a file.
+// The zero value is an unset secret. Safe for concurrent use.
+type Value struct {
+	mu   sync.RWMutex
+	path string
+	val  string
+}
+
+// Literal returns a Value holding s directly (not reloadable).
+func Literal(s string) *Value { return &Value{val: s} }
+
+// FromFile returns a Value backed by path and loads it immediately.
+func FromFile(path string) (*Value, error) {
+	v := &Value{path: path}
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Get returns the cached secret ("" when unset).
+func (v *Value) Get() string {
+	if v == nil {
+		return ""
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.val
+}
+
+// IsSet reports whether a non-empty secret is available.
+func (v *Value) IsSet() bool { return v.Get() != "" }
+
+// Path returns the backing file path, if any.
+func (v *Value) Path() string {
+	if v == nil {
+		return ""
+	}
+	return v.path
+}
+
+// Reload re-reads the backing file. Literal values are left unchanged.
+// On error the previously cached value is kept.
+func (v *Value) Reload() error {
+	if v == nil || v.path == "" {
+		return nil
+	}
+	s, err := ReadFile(v.path)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	v.val = s
+	v.mu.Unlock()
+	return nil
+}
+
+// ReadFile reads a secret file, trimming surrounding whitespace (editors and
+// `echo` commonly append a trailing newline).
+func ReadFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %w", path, err)
+	}
+	s := strings.TrimSpace(string(b))
+	if s == "" {
+		return "", fmt.Errorf("secret %s: %w", path, ErrEmpty)
+	}
+	return s, nil
+}
+
+// LookupEnv resolves key from the environment, honoring the key+"_FILE"
+// variant: when KEY_FILE is set its file content is returned instead.
+// KEY takes precedence when both are present.
+func LookupEnv(key string) (string, bool, error) {
+	if v, ok := os.LookupEnv(key); ok {
+		return strings.TrimSpace(v), true, nil
+	}
+	if p, ok := os.LookupEnv(key + "_FILE"); ok && strings.TrimSpace(p) != "" {
+		s, err := ReadFile(strings.TrimSpace(p))
+		if err != nil {
+			return "", true, err
+		}
+		return s, true, nil
+	}
+	return "", false, nil
+}
@@ -0,0 +1,44 @@
+package secret
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFromFileReload(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(p, []byte("first\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := FromFile(p)
+	if err != nil {
+		t.Fatalf("FromFile: %v", err)
+	}
+	if v.Get() != "first" {
+		t.Fatalf("got %q", v.Get())
+	}
+	_ = os.WriteFile(p, []byte("second"), 0o600)
+	if err := v.Reload(); err != nil || v.Get() != "second" {
+		t.Fatalf("reload got %q err=%v", v.Get(), err)
+	}
+	_ = os.WriteFile(p, nil, 0o600)
+	if err := v.Reload(); !errors.Is(err, ErrEmpty) || v.Get() != "second" {
+		t.Fatalf("empty reload should keep cached value, got %q err=%v", v.Get(), err)
+	}
+}
+
+func TestLookupEnvFileVariant(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "tok")
+	_ = os.WriteFile(p, []byte("s3cret\n"), 0o600)
+	t.Setenv("SECRET_TEST_TOKEN_FILE", p)
+	v, ok, err := LookupEnv("SECRET_TEST_TOKEN")
+	if err != nil || !ok || v != "s3cret" {
+		t.Fatalf("got %q ok=%v err=%v", v, ok, err)
+	}
+	t.Setenv("SECRET_TEST_TOKEN", "direct")
+	if v, _, _ := LookupEnv("SECRET_TEST_TOKEN"); v != "direct" {
+		t.Fatalf("direct env should win, got %q", v)
+	}
+}
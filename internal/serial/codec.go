@@ -6,9 +6,17 @@ import (
 
 	"github.com/kstaniek/go-ampio-server/internal/can"
 	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/validate"
 )
 
-type Codec struct{}
+// Codec encodes and decodes Ampio UART frames.
+type Codec struct {
+	// NoChecksum skips verifying the checksum of received frames and writes
+	// a zero checksum instead of computing one. Only for trusted links
+	// (short wiring, both ends configured alike) where the CPU cost matters
+	// more than detecting corruption.
+	NoChecksum bool
+}
 
 // CompactBuffer reclaims consumed prefix capacity when underlying buffer
 // grows too large relative to unread bytes. It returns true if compaction
@@ -33,31 +41,32 @@ func CompactBuffer(b *bytes.Buffer) bool {
 // canUARTSend builds a UART frame:
 // [0x2D, 0xD4, len+1, data..., checksum]
 // checksum = (len+1) + 0x2D + sum(data) (mod 256)
-func canUARTSend(data []byte) []byte {
+// With noSum the checksum byte is left zero.
+func canUARTSend(data []byte, noSum bool) []byte {
 	n := len(data)
 	frame := make([]byte, n+4)
 
 	frame[0] = 0x2D
 	frame[1] = 0xD4
 	frame[2] = byte(n + 1)
+	copy(frame[3:], data)
+	if noSum {
+		return frame
+	}
 
 	sum := frame[2] + 0x2D
-	for i, b := range data {
-		frame[3+i] = b
+	for _, b := range data {
 		sum += b
 	}
 	frame[3+n] = sum
 	return frame
 }
 
-func (Codec) Encode(f can.Frame) []byte {
-	can_id := f.CANID
-	if f.CANID&can.CAN_EFF_FLAG != 0 {
-		can_id &= can.CAN_EFF_MASK
-	}
-	tab := make([]byte, 6+f.Len) // INS(1) + FLAGS(1) + ID(4) + PAYLOAD(0..8)
-	tab[0] = 2                   // INS: 2 = CAN UART SEND WITH EXT ID
-	tab[1] = 0x80 + f.Len        // FLAGS/DLC (0x80 | len) for classic
+func (c Codec) Encode(f can.Frame) []byte {
+	can_id := f.CANID & can.CAN_EFF_MASK // the wire carries the 29-bit ID without flags
+	tab := make([]byte, 6+f.Len)         // INS(1) + FLAGS(1) + ID(4) + PAYLOAD(0..8)
+	tab[0] = 2                           // INS: 2 = CAN UART SEND WITH EXT ID
+	tab[1] = 0x80 + f.Len                // FLAGS/DLC (0x80 | len) for classic
 	tab[2] = byte(can_id >> 24)
 	tab[3] = byte(can_id >> 16)
 	tab[4] = byte(can_id >> 8)
@@ -65,7 +74,7 @@ func (Codec) Encode(f can.Frame) []byte {
 	for i, b := range f.Data[:f.Len] {
 		tab[6+i] = b
 	}
-	return canUARTSend(tab[:6+f.Len])
+	return canUARTSend(tab[:6+f.Len], c.NoChecksum)
 }
 
 // DecodeStream reads from in and emits complete frames via out.
@@ -80,15 +89,15 @@ func (Codec) Encode(f can.Frame) []byte {
 //
 // Example frame (DLC=2):
 // 2D D4 0D 00 00 00 02 FE 10 19 09 19 04 01 20 AA
-func (Codec) DecodeStream(in *bytes.Buffer, out func(can.Frame)) error {
+func (c Codec) DecodeStream(in *bytes.Buffer, out func(can.Frame)) error {
 	const (
 		pre0 = 0x2D
 		pre1 = 0xD4
 
 		// ln = dataBytes + 1(checksum)
 		// dataBytes = INS(1) + FLAGS(1) + ID(4) + PAYLOAD(0..8)
-		minLn = 6 + 0 + 1 // 7 -> allow DLC=0 (zero-length payload)
-		maxLn = 6 + 8 + 1 // 15 -> allow DLC up to 8
+		minLn = 6 + 0 + 1               // 7 -> allow DLC=0 (zero-length payload)
+		maxLn = 6 + validate.MaxDLC + 1 // 15 -> allow DLC up to 8
 	)
 	header := []byte{pre0, pre1}
 
@@ -134,15 +143,17 @@ func (Codec) DecodeStream(in *bytes.Buffer, out func(can.Frame)) error {
 		}
 
 		// checksum: 0x2D + len + sum(data bytes after len)
-		sum := uint(pre0) + uint(data[2])
-		for _, b := range data[3 : req-1] {
-			sum += uint(b)
-		}
-		if byte(sum) != data[req-1] {
-			// checksum mismatch: count and attempt resync
-			metrics.IncMalformed()
-			in.Next(1)
-			continue
+		if !c.NoChecksum {
+			sum := uint(pre0) + uint(data[2])
+			for _, b := range data[3 : req-1] {
+				sum += uint(b)
+			}
+			if byte(sum) != data[req-1] {
+				// checksum mismatch: count and attempt resync
+				metrics.IncMalformed()
+				in.Next(1)
+				continue
+			}
 		}
 
 		// parse frame
@@ -150,7 +161,9 @@ func (Codec) DecodeStream(in *bytes.Buffer, out func(can.Frame)) error {
 		payload := data[7 : req-1] // length can be 0..8
 
 		var f can.Frame
-		f.CANID = id | can.CAN_EFF_FLAG
+		// The wire has no flags; marking the ID extended is up to
+		// normalization (package normalize, EFF force for serial).
+		f.CANID = id & can.CAN_EFF_MASK
 		f.Len = uint8(len(payload))
 		copy(f.Data[:], payload)
 
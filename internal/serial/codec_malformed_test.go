@@ -15,9 +15,9 @@ func TestDecodeStreamMalformed(t *testing.T) {
 	before := metrics.Snap().Malformed
 
 	// Build a valid small frame then corrupt checksum.
-	data := []byte{0, 0, 0, 1, 0xAA} // ID + 1B payload
-	frame := canUARTSend(data)       // returns preamble 2D D4 len checksum
-	frame[len(frame)-1] ^= 0xFF      // corrupt checksum
+	data := []byte{0, 0, 0, 1, 0xAA}  // ID + 1B payload
+	frame := canUARTSend(data, false) // returns preamble 2D D4 len checksum
+	frame[len(frame)-1] ^= 0xFF       // corrupt checksum
 	buf.Write(frame)
 	if err := codec.DecodeStream(&buf, func(_ can.Frame) {}); err != nil {
 		t.Fatalf("DecodeStream error: %v", err)
@@ -14,12 +14,12 @@ func rxWire(id uint32, payload []byte) []byte {
 	data := make([]byte, 4+len(payload))
 	binary.BigEndian.PutUint32(data[:4], rawID)
 	copy(data[4:], payload)
-	return canUARTSend(data)
+	return canUARTSend(data, false)
 }
 
 func f(id uint32, data ...byte) can.Frame {
 	var fr can.Frame
-	fr.CANID = (id & can.CAN_EFF_MASK) | can.CAN_EFF_FLAG
+	fr.CANID = id & can.CAN_EFF_MASK // decoded IDs carry no flags
 	fr.Len = uint8(len(data))
 	copy(fr.Data[:], data)
 	return fr
@@ -78,3 +78,24 @@ func TestSerialCodec_RoundTrip_Chunked(t *testing.T) {
 		}
 	}
 }
+
+func TestSerialCodec_NoChecksum(t *testing.T) {
+	wire := rxWire(0x0123456, []byte{0x9A, 0xBC})
+	wire[len(wire)-1] ^= 0xFF // corrupt the checksum
+
+	var got []can.Frame
+	collect := func(fr can.Frame) { got = append(got, fr) }
+	_ = Codec{}.DecodeStream(bytes.NewBuffer(append([]byte(nil), wire...)), collect)
+	if len(got) != 0 {
+		t.Fatalf("checked codec accepted a bad checksum: %+v", got)
+	}
+	_ = Codec{NoChecksum: true}.DecodeStream(bytes.NewBuffer(wire), collect)
+	if len(got) != 1 || got[0] != f(0x0123456, 0x9A, 0xBC) {
+		t.Fatalf("got %+v", got)
+	}
+
+	enc := Codec{NoChecksum: true}.Encode(f(0x0123456, 0x01))
+	if enc[len(enc)-1] != 0 {
+		t.Fatalf("checksum byte %#x, want 0", enc[len(enc)-1])
+	}
+}
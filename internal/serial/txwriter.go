@@ -3,6 +3,7 @@ package serial
 import (
 	"context"
 	"errors"
+	"fmt"
 
 	"github.com/kstaniek/go-ampio-server/internal/can"
 	"github.com/kstaniek/go-ampio-server/internal/logging"
@@ -12,11 +13,16 @@ import (
 
 var ErrTxOverflow = errors.New("serial tx overflow")
 
+// ErrRTRUnsupported is returned for remote request frames: the Ampio UART
+// protocol has no RTR bit.
+var ErrRTRUnsupported = fmt.Errorf("serial: remote request: %w", transport.ErrUnsupported)
+
 // TXWriter funnels all serial writes through one goroutine.
 type TXWriter struct{ base *transport.AsyncTx }
 
 // NewTXWriter creates a serial TXWriter with a buffered channel of size buf.
-func NewTXWriter(parent context.Context, sp Port, codec Codec, buf int) *TXWriter {
+// opts configure the underlying AsyncTx (e.g. a priority queue).
+func NewTXWriter(parent context.Context, sp Port, codec Codec, buf int, opts ...transport.Option) *TXWriter {
 	send := func(fr can.Frame) error {
 		_, err := sp.Write(codec.Encode(fr))
 		return err
@@ -32,11 +38,37 @@ func NewTXWriter(parent context.Context, sp Port, codec Codec, buf int) *TXWrite
 			return ErrTxOverflow
 		},
 	}
-	return &TXWriter{base: transport.NewAsyncTx(parent, buf, send, hooks)}
+	return &TXWriter{base: transport.NewAsyncTx(parent, buf, send, hooks, opts...)}
+}
+
+// SendFrame queues a frame for asynchronous write (drops with ErrTxOverflow if
+// buffer full, rejects remote requests with ErrRTRUnsupported).
+func (w *TXWriter) SendFrame(fr can.Frame) error {
+	if err := checkRTR(fr); err != nil {
+		return err
+	}
+	return w.base.SendFrame(fr)
+}
+
+// SendFrameWait queues a frame and blocks until it has been written (or failed).
+func (w *TXWriter) SendFrameWait(ctx context.Context, fr can.Frame) error {
+	if err := checkRTR(fr); err != nil {
+		return err
+	}
+	return w.base.SendFrameWait(ctx, fr)
+}
+
+// checkRTR rejects remote requests, which Encode would turn into data frames.
+func checkRTR(fr can.Frame) error {
+	if fr.CANID&can.CAN_RTR_FLAG == 0 {
+		return nil
+	}
+	metrics.IncError(metrics.ErrSerialRTR)
+	return ErrRTRUnsupported
 }
 
-// SendFrame queues a frame for asynchronous write (drops with ErrTxOverflow if buffer full).
-func (w *TXWriter) SendFrame(fr can.Frame) error { return w.base.SendFrame(fr) }
+// Queue reports the TX queue depth and capacity.
+func (w *TXWriter) Queue() (depth, capacity int) { return w.base.Queue() }
 
 // Close stops the writer and waits for pending goroutine exit.
 func (w *TXWriter) Close() { w.base.Close() }
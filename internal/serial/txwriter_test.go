@@ -0,0 +1,39 @@
+package serial
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/transport"
+)
+
+type discardPort struct{ writes int }
+
+func (p *discardPort) Read([]byte) (int, error)    { return 0, nil }
+func (p *discardPort) Write(b []byte) (int, error) { p.writes++; return len(b), nil }
+func (p *discardPort) Close() error                { return nil }
+
+func TestTXWriterRejectsRTR(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := &discardPort{}
+	w := NewTXWriter(ctx, p, Codec{}, 4)
+	defer w.Close()
+	before := metrics.Snap().Errors
+	rtr := can.Frame{CANID: 0x123 | can.CAN_EFF_FLAG | can.CAN_RTR_FLAG, Len: 2}
+	if err := w.SendFrame(rtr); !errors.Is(err, transport.ErrUnsupported) {
+		t.Fatalf("SendFrame err = %v, want ErrUnsupported", err)
+	}
+	if err := w.SendFrameWait(ctx, rtr); !errors.Is(err, ErrRTRUnsupported) {
+		t.Fatalf("SendFrameWait err = %v, want ErrRTRUnsupported", err)
+	}
+	if got := metrics.Snap().Errors - before; got != 2 {
+		t.Fatalf("errors counted %d, want 2", got)
+	}
+	if err := w.SendFrameWait(ctx, can.Frame{CANID: 0x123 | can.CAN_EFF_FLAG, Len: 1}); err != nil || p.writes != 1 {
+		t.Fatalf("data frame: err=%v writes=%d", err, p.writes)
+	}
+}
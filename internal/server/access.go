@@ -0,0 +1,23 @@
+package server
+
+import (
+	"net"
+
+	"github.com/kstaniek/go-ampio-server/internal/access"
+)
+
+// WithAccess sets how client connections are identified. The role of a
+// client's identity decides whether it may connect (access.View) and
+// transmit (access.Send); frames from a client without Send are answered
+// with a denied ack. Without it every client has the write role.
+func WithAccess(identify func(net.Addr) access.Identity) ServerOption {
+	return func(s *Server) { s.identify = identify }
+}
+
+// identity resolves the identity of a client at addr.
+func (s *Server) identity(addr net.Addr) access.Identity {
+	if s.identify == nil {
+		return access.Identity{Name: "default", Role: access.Write}
+	}
+	return s.identify(addr)
+}
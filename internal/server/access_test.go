@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/access"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+func TestAccessRoles(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var role atomic.Uint32
+	var sent atomic.Int32
+	srv := NewServer(
+		WithHub(hub.New()),
+		WithCodec(&cnl.Codec{}),
+		WithSend(func(can.Frame) error { sent.Add(1); return nil }),
+		WithFlushInterval(time.Millisecond),
+		WithAccess(func(net.Addr) access.Identity { return access.Identity{Name: "test", Role: access.Role(role.Load())} }),
+	)
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+
+	// A client without view is refused before the handshake.
+	role.Store(uint32(access.None))
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cnl.Handshake(ctx, conn, time.Second); err == nil {
+		t.Fatal("client without access completed the handshake")
+	}
+	conn.Close()
+
+	// A read-only client receives but its frames are denied.
+	role.Store(uint32(access.Read))
+	conn, err = net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := cnl.Handshake(ctx, conn, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	codec := &cnl.Codec{}
+	r := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := codec.EncodeTo(conn, []can.Frame{cnl.ControlFrame(cnl.OpTxAckEnable), {CANID: 0x123}}); err != nil {
+		t.Fatal(err)
+	}
+	if fr, err := codec.Decode(r); err != nil || fr.Data[0] != cnl.OpTxAckEnable {
+		t.Fatalf("expected enable confirmation, got %+v err=%v", fr, err)
+	}
+	fr, err := codec.Decode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, status, _, ok := cnl.ParseTxAck(&fr); !ok || status != cnl.AckDenied {
+		t.Fatalf("ack status %d ok=%v, want denied", status, ok)
+	}
+	if sent.Load() != 0 {
+		t.Fatal("frame from a read-only client reached the backend")
+	}
+	if cl := srv.Clients(); len(cl) != 1 || cl[0].Role != "read" {
+		t.Fatalf("clients: %+v", cl)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/transport"
+)
+
+func TestTxAckMode(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sendErr := map[uint32]error{0x2: transport.ErrTxOverflow, 0x3: filter.ErrDenied, 0x4: errors.New("bus off")}
+	var waited atomic.Int32
+	srv := NewServer(
+		WithHub(hub.New()),
+		WithCodec(&cnl.Codec{}),
+		WithSend(func(fr can.Frame) error { return sendErr[fr.CANID] }),
+		WithSendWait(func(_ context.Context, fr can.Frame) error { waited.Add(1); return sendErr[fr.CANID] }),
+		WithFrameFilter(func(fr *can.Frame) bool { return fr.CANID != 0x5 }),
+		WithFlushInterval(time.Millisecond),
+	)
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := cnl.Handshake(ctx, conn, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	codec := &cnl.Codec{}
+	r := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	// Without negotiation frames are fire-and-forget.
+	if _, err := codec.EncodeTo(conn, []can.Frame{{CANID: 0x1}, cnl.ControlFrame(cnl.OpTxAckEnable)}); err != nil {
+		t.Fatal(err)
+	}
+	fr, err := codec.Decode(r)
+	if err != nil || !cnl.IsControl(&fr) || fr.Data[0] != cnl.OpTxAckEnable {
+		t.Fatalf("expected enable confirmation, got %+v err=%v", fr, err)
+	}
+	if _, err := codec.EncodeTo(conn, []can.Frame{{CANID: 0x1}, {CANID: 0x2}, {CANID: 0x3}, {CANID: 0x4}, {CANID: 0x5}}); err != nil {
+		t.Fatal(err)
+	}
+	// 0x5 is dropped by the client frame filter and never reaches the backend.
+	want := []byte{cnl.AckOK, cnl.AckOverflow, cnl.AckDenied, cnl.AckError, cnl.AckDenied}
+	for i, st := range want {
+		fr, err := codec.Decode(r)
+		if err != nil {
+			t.Fatalf("ack %d: %v", i, err)
+		}
+		seq, status, id, ok := cnl.ParseTxAck(&fr)
+		if !ok || seq != uint16(i+1) || status != st || id != uint32(i+1) {
+			t.Fatalf("ack %d: seq=%d status=%d id=0x%X ok=%v", i, seq, status, id, ok)
+		}
+	}
+	if waited.Load() != 4 {
+		t.Fatalf("expected 4 waited sends, got %d", waited.Load())
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"compress/flate"
+	"context"
+	"io"
+	"log/slog"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// DefaultCompressRatio is the compressed/raw size above which a client's
+// compression is turned off when WithCompression is given 0.
+const DefaultCompressRatio = 0.9
+
+// compressWindow is how many raw bytes a client's compression ratio is
+// measured over between checks.
+var compressWindow = 64 << 10
+
+// WithCompression lets clients negotiate DEFLATE compression of the frames
+// they receive (OpCompress). The writer measures each client's compressed
+// against its raw bytes and, once a window compresses worse than maxRatio,
+// turns compression off for the rest of the connection: traffic such as
+// sparse frames with random payloads costs CPU without saving bandwidth.
+// maxRatio 0 uses DefaultCompressRatio; without this option clients are
+// told compression is unavailable.
+func WithCompression(maxRatio float64) ServerOption {
+	return func(s *Server) {
+		if maxRatio <= 0 {
+			maxRatio = DefaultCompressRatio
+		}
+		s.compressRatio = maxRatio
+	}
+}
+
+// Client compression states (clientConn.compress).
+const (
+	compressNone = iota
+	compressOn
+	compressFellBack
+)
+
+// compressionName names a client compression state for ClientInfo.
+func compressionName(state int32) string {
+	switch state {
+	case compressOn:
+		return "deflate"
+	case compressFellBack:
+		return "off"
+	default:
+		return ""
+	}
+}
+
+// handleCompress answers a client's OpCompress request. Compression is
+// negotiated once per connection; repeated requests are ignored so the
+// writer never restarts a stream the client is already inflating.
+func (s *Server) handleCompress(ctx context.Context, st *readerState, cl *hub.Client, code byte, logger *slog.Logger) {
+	switch {
+	case st.compress:
+		logger.Debug("client_compress_repeated")
+	case s.compressRatio == 0 || code != cnl.CompressDeflate:
+		s.sendControl(ctx, cl, cnl.Compress(cnl.CompressUnavailable))
+	default:
+		st.compress = true
+		s.sendControl(ctx, cl, cnl.Compress(cnl.CompressDeflate))
+	}
+}
+
+// encoder returns how a writer puts frames on a stream: through the shared
+// encoding cache when the codec has AppendFrame, else the codec's EncodeTo
+// when it has one, else Encode and a single Write. rtr is the stream's
+// OpRTR state, applied to a cnl.Codec. Each writer owns the result.
+func (s *Server) encoder(rtr bool) func(io.Writer, []can.Frame) (int, error) {
+	if c, ok := s.Codec.(*cnl.Codec); ok {
+		c := *c
+		c.RTR = rtr
+		return s.sharedEncoder(&c)
+	}
+	if app, ok := s.Codec.(frameAppender); ok {
+		return s.sharedEncoder(app)
+	}
+	if beTo, ok := s.Codec.(interface {
+		EncodeTo(io.Writer, []can.Frame) (int, error)
+	}); ok {
+		return beTo.EncodeTo
+	}
+	return func(w io.Writer, frames []can.Frame) (int, error) {
+		var payload []byte
+		if be, ok := s.Codec.(interface{ Encode([]can.Frame) []byte }); ok {
+			payload = be.Encode(frames)
+		}
+		return w.Write(payload)
+	}
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
+// compressor is a client writer's DEFLATE stream. It is owned by the writer
+// goroutine.
+type compressor struct {
+	fw     *flate.Writer
+	wire   countWriter
+	encode func(io.Writer, []can.Frame) (int, error)
+	cc     *clientConn // nil when the client is no longer registered
+	raw    int         // raw bytes of the current window
+	packed int         // their compressed size
+}
+
+func newCompressor(conn io.Writer, cc *clientConn, encode func(io.Writer, []can.Frame) (int, error)) *compressor {
+	z := &compressor{wire: countWriter{w: conn}, encode: encode, cc: cc}
+	z.fw, _ = flate.NewWriter(&z.wire, flate.BestSpeed) // fails only for invalid levels
+	return z
+}
+
+// write compresses frames and flushes them to the connection.
+func (z *compressor) write(frames []can.Frame) error {
+	before := z.wire.n
+	n, err := z.encode(z.fw, frames)
+	if err == nil {
+		err = z.fw.Flush()
+	}
+	z.count(n, z.wire.n-before)
+	return err
+}
+
+// close writes OpCompress CompressOff and the final block; the client reads
+// the stream plain after it.
+func (z *compressor) close() error {
+	before := z.wire.n
+	n, err := z.encode(z.fw, []can.Frame{cnl.Compress(cnl.CompressOff)})
+	if err == nil {
+		err = z.fw.Close()
+	}
+	z.count(n, z.wire.n-before)
+	return err
+}
+
+func (z *compressor) count(raw, wire int) {
+	z.raw += raw
+	z.packed += wire
+	metrics.AddCompressed(raw, wire)
+	if z.cc != nil {
+		z.cc.compressRaw.Add(uint64(raw))
+		z.cc.compressWire.Add(uint64(wire))
+	}
+}
+
+// poor reports whether a completed window compressed worse than maxRatio,
+// and its ratio. It starts the next window.
+func (z *compressor) poor(maxRatio float64) (ratio float64, poor bool) {
+	if z.raw < compressWindow {
+		return 0, false
+	}
+	ratio = float64(z.packed) / float64(z.raw)
+	z.raw, z.packed = 0, 0
+	return ratio, ratio > maxRatio
+}
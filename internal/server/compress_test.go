@@ -0,0 +1,127 @@
+package server_test
+
+import (
+	"context"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/client"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+// relay broadcasts n frames made by mk, in chunks that fit the client
+// queue, and checks the client receives them, skipping control messages.
+func relay(t *testing.T, ctx context.Context, h *hub.Hub, c *client.Conn, n int, mk func(i int) can.Frame) {
+	t.Helper()
+	const chunk = 256
+	for i := 0; i < n; i += chunk {
+		var want []can.Frame
+		for j := i; j < min(i+chunk, n); j++ {
+			want = append(want, mk(j))
+			h.Broadcast(want[len(want)-1])
+		}
+		for k := 0; k < len(want); {
+			select {
+			case fr, ok := <-c.Frames():
+				if !ok {
+					t.Fatalf("connection ended: %v", c.Err())
+				}
+				if cnl.IsControl(&fr) {
+					continue
+				}
+				if fr != want[k] {
+					t.Fatalf("frame %d: got %+v, want %+v", i+k, fr, want[k])
+				}
+				k++
+			case <-ctx.Done():
+				t.Fatalf("frame %d not received", i+k)
+			}
+		}
+	}
+}
+
+func TestCompressionFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h := hub.New()
+	srv := server.NewServer(
+		server.WithHub(h),
+		server.WithCodec(&cnl.Codec{}),
+		server.WithSend(func(can.Frame) error { return nil }),
+		server.WithListenAddr("127.0.0.1:0"),
+		server.WithCompression(0.5),
+	)
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+
+	c, err := client.Dial(ctx, srv.Addr(), client.WithCompression())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for len(srv.Clients()) == 0 && ctx.Err() == nil {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Repeated frames compress well and keep compression on.
+	relay(t, ctx, h, c, 3000, func(i int) can.Frame { return can.Frame{CANID: 0x100, Len: 8} })
+	info := srv.Clients()[0]
+	if !c.Compressed() || info.Compression != "deflate" {
+		t.Fatalf("compressible traffic: client compressed=%v, server %+v", c.Compressed(), info)
+	}
+	if info.CompressWire == 0 || info.CompressWire*4 > info.CompressRaw {
+		t.Fatalf("compressible traffic: raw %d wire %d bytes", info.CompressRaw, info.CompressWire)
+	}
+
+	// Random payloads do not; the server falls back and the client reads
+	// the plain stream that follows.
+	rng := rand.New(rand.NewPCG(1, 2))
+	random := func(i int) can.Frame {
+		fr := can.Frame{CANID: uint32(rng.IntN(0x800)), Len: 8}
+		for j := range fr.Data[:fr.Len] {
+			fr.Data[j] = byte(rng.Uint32())
+		}
+		return fr
+	}
+	for i := 0; i < 20 && c.Compressed(); i++ {
+		relay(t, ctx, h, c, 1000, random)
+	}
+	if c.Compressed() || srv.Clients()[0].Compression != "off" {
+		t.Fatalf("random traffic: client compressed=%v, server %+v", c.Compressed(), srv.Clients()[0])
+	}
+	relay(t, ctx, h, c, 100, random)
+}
+
+func TestCompressionUnavailable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := server.NewServer(
+		server.WithHub(hub.New()),
+		server.WithCodec(&cnl.Codec{}),
+		server.WithSend(func(can.Frame) error { return nil }),
+		server.WithListenAddr("127.0.0.1:0"),
+	)
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+
+	c, err := client.Dial(ctx, srv.Addr(), client.WithCompression())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	select {
+	case fr := <-c.Frames():
+		if code, ok := cnl.ParseCompress(&fr); !ok || code != cnl.CompressUnavailable {
+			t.Fatalf("got %+v, want OpCompress unavailable", fr)
+		}
+	case <-ctx.Done():
+		t.Fatal("no answer to the compression request")
+	}
+	if c.Compressed() {
+		t.Fatal("client reports compression")
+	}
+}
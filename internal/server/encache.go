@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// encodeCacheSlots is the number of recently encoded frames the server
+// keeps. Writers of one broadcast reach the cache within a flush interval
+// of each other, long before the slot is reused.
+const (
+	encodeCacheBits  = 10
+	encodeCacheSlots = 1 << encodeCacheBits
+)
+
+// frameAppender appends the wire encoding of one frame; codecs whose
+// encoding depends on the frame alone implement it (cnl.Codec).
+type frameAppender interface {
+	AppendFrame(dst []byte, f *can.Frame) []byte
+}
+
+// encodedFrame is a frame with its wire bytes. Published entries are never
+// modified: writers copy the bytes into their own buffers, and a new
+// encoding replaces the whole entry.
+type encodedFrame struct {
+	fr can.Frame
+	b  []byte
+}
+
+// encodeCache shares frame encodings between the client writers of a
+// server, so a frame broadcast to many clients is encoded once rather than
+// once per client. Entries are keyed by the frame value, so a hit is
+// always the right encoding; a colliding frame simply replaces the slot.
+//
+// Sharing is per frame rather than per batch on purpose. The hub queues
+// every frame to each client on its own, and each writer drains its queue
+// at its own pace, so two clients rarely flush the same batch: flush
+// timing, client filters, error and FD opt-ins, and drops under the
+// backpressure policy all split the stream differently. A batch key would
+// miss where a frame key hits, while the encoding work is the same. The
+// cached bytes are immutable and copied into the writer's buffer, so each
+// flush stays one Write (one TLS record, one DEFLATE input); the copy of
+// a few bytes per frame is cheap next to encoding it.
+type encodeCache struct {
+	slots [encodeCacheSlots]atomic.Pointer[encodedFrame]
+}
+
+// get returns the encoding of fr, encoding and publishing it on a miss.
+func (c *encodeCache) get(fr *can.Frame, app frameAppender) (b []byte, hit bool) {
+	slot := &c.slots[slotOf(fr)]
+	if e := slot.Load(); e != nil && e.fr == *fr {
+		return e.b, true
+	}
+	e := &encodedFrame{fr: *fr, b: app.AppendFrame(nil, fr)}
+	slot.Store(e)
+	return e.b, false
+}
+
+// slotOf hashes fr to a cache slot (Fibonacci hashing on the top bits).
+func slotOf(fr *can.Frame) int {
+	h := uint64(fr.CANID)<<8 | uint64(fr.Len)
+	h ^= binary.LittleEndian.Uint64(fr.Data[:8])
+	return int((h * 0x9E3779B97F4A7C15) >> (64 - encodeCacheBits))
+}
+
+// sharedEncoder returns a writer's encode function for a codec with
+// AppendFrame: the batch is assembled in a buffer owned by the writer and
+// written with one Write. While the server has more than one client, frame
+// encodings come from (and go to) the shared cache; a lone client encodes
+// directly, as there is nobody to share with.
+func (s *Server) sharedEncoder(app frameAppender) func(io.Writer, []can.Frame) (int, error) {
+	var buf []byte
+	return func(w io.Writer, frames []can.Frame) (int, error) {
+		buf = buf[:0]
+		if s.clientCount() > 1 {
+			var hits, misses int
+			for i := range frames {
+				if frames[i].CANID&can.CAN_RTR_FLAG != 0 {
+					// Remote requests depend on the stream (OpRTR).
+					buf = app.AppendFrame(buf, &frames[i])
+					continue
+				}
+				b, hit := s.encCache.get(&frames[i], app)
+				if hit {
+					hits++
+				} else {
+					misses++
+				}
+				buf = append(buf, b...)
+			}
+			metrics.AddEncodeCache(hits, misses)
+		} else {
+			for i := range frames {
+				buf = app.AppendFrame(buf, &frames[i])
+			}
+		}
+		return w.Write(buf)
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+func TestEncodeCache(t *testing.T) {
+	var c encodeCache
+	codec := &cnl.Codec{}
+	a := can.Frame{CANID: 0x1D000123 | can.CAN_EFF_FLAG, Len: 2, Data: [64]byte{1, 2}}
+	b1, hit := c.get(&a, codec)
+	if hit {
+		t.Fatal("first lookup hit")
+	}
+	b2, hit := c.get(&a, codec)
+	if !hit || &b1[0] != &b2[0] {
+		t.Fatal("second lookup did not reuse the encoding")
+	}
+	if want := codec.AppendFrame(nil, &a); !bytes.Equal(b1, want) {
+		t.Fatalf("encoding % X, want % X", b1, want)
+	}
+	// A frame in the same slot replaces the entry without touching the
+	// bytes handed out for the old one.
+	var other can.Frame
+	for id := uint32(0); ; id++ {
+		other = can.Frame{CANID: id, Len: 1, Data: [64]byte{9}}
+		if slotOf(&other) == slotOf(&a) {
+			break
+		}
+	}
+	if b, hit := c.get(&other, codec); hit || !bytes.Equal(b, codec.AppendFrame(nil, &other)) {
+		t.Fatalf("colliding frame: hit=%v % X", hit, b)
+	}
+	if !bytes.Equal(b1, codec.AppendFrame(nil, &a)) {
+		t.Fatal("replaced entry changed bytes already handed out")
+	}
+}
+
+func TestSharedEncoder(t *testing.T) {
+	s := NewServer(WithCodec(&cnl.Codec{}))
+	frames := []can.Frame{{CANID: 0x10, Len: 1, Data: [64]byte{7}}, {CANID: 0x11 | can.CAN_RTR_FLAG, Len: 8}}
+	var want bytes.Buffer
+	_, _ = (&cnl.Codec{}).EncodeTo(&want, frames)
+
+	encA, encB := s.encoder(false), s.encoder(false)
+	for _, clients := range []int{1, 2} {
+		for range clients {
+			s.clients[&hub.Client{}] = &clientConn{}
+		}
+		var a, b bytes.Buffer
+		if _, err := encA(&a, frames); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := encB(&b, frames); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(a.Bytes(), want.Bytes()) || !bytes.Equal(b.Bytes(), want.Bytes()) {
+			t.Fatalf("%d clients: got % X and % X, want % X", len(s.clients), a.Bytes(), b.Bytes(), want.Bytes())
+		}
+	}
+	// With several clients the second writer reuses the first one's bytes.
+	if e := s.encCache.slots[slotOf(&frames[0])].Load(); e == nil || e.fr != frames[0] {
+		t.Fatal("frame not cached")
+	}
+}
+
+// BenchmarkWriterEncode encodes one 64-frame batch for 16 client writers,
+// each writer with its own encoder, as the server does.
+func BenchmarkWriterEncode(b *testing.B) {
+	frames := make([]can.Frame, 64)
+	for i := range frames {
+		frames[i] = can.Frame{CANID: 0x1D000000 | uint32(i) | can.CAN_EFF_FLAG, Len: 8, Data: [64]byte{byte(i), 1, 2, 3, 4, 5, 6, 7}}
+	}
+	run := func(b *testing.B, enc []func(io.Writer, []can.Frame) (int, error)) {
+		var w bytes.Buffer
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, e := range enc {
+				w.Reset()
+				if _, err := e(&w, frames); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+	b.Run("EncodeTo", func(b *testing.B) {
+		enc := make([]func(io.Writer, []can.Frame) (int, error), 16)
+		for i := range enc {
+			enc[i] = (&cnl.Codec{}).EncodeTo
+		}
+		run(b, enc)
+	})
+	b.Run("Shared", func(b *testing.B) {
+		s := NewServer(WithCodec(&cnl.Codec{}))
+		enc := make([]func(io.Writer, []can.Frame) (int, error), 16)
+		for i := range enc {
+			s.clients[&hub.Client{}] = &clientConn{}
+			enc[i] = s.encoder(false)
+		}
+		run(b, enc)
+	})
+}
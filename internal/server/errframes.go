@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+// WithErrorFrames lets clients subscribe to CAN error frames (OpErrFrames).
+// Set it when the backend reports them; otherwise subscriptions are
+// answered ErrFramesUnavailable.
+func WithErrorFrames(on bool) ServerOption {
+	return func(s *Server) { s.errFrames = on }
+}
+
+// handleErrFrames subscribes or unsubscribes a client to error frames and
+// answers with the state in force.
+func (s *Server) handleErrFrames(ctx context.Context, st *readerState, cl *hub.Client, fr can.Frame, logger *slog.Logger) {
+	code, _ := cnl.ParseErrFrames(&fr)
+	if code == cnl.ErrFramesOn && !s.errFrames {
+		s.sendControl(ctx, cl, cnl.ErrFrames(cnl.ErrFramesUnavailable))
+		return
+	}
+	on := code == cnl.ErrFramesOn
+	if on != st.errFrames {
+		st.errFrames = on
+		cl.SetErrorFrames(on)
+		logger.Info("client_error_frames", "enabled", on)
+		s.publishSession(st)
+	}
+	reply := byte(cnl.ErrFramesOff)
+	if on {
+		reply = cnl.ErrFramesOn
+	}
+	s.sendControl(ctx, cl, cnl.ErrFrames(reply))
+}
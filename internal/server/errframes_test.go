@@ -0,0 +1,83 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/client"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+// nextData returns the next non-control frame c receives.
+func nextData(t *testing.T, ctx context.Context, c *client.Conn) can.Frame {
+	t.Helper()
+	for {
+		select {
+		case fr, ok := <-c.Frames():
+			if !ok {
+				t.Fatalf("connection ended: %v", c.Err())
+			}
+			if !cnl.IsControl(&fr) {
+				return fr
+			}
+		case <-ctx.Done():
+			t.Fatal("no frame received")
+		}
+	}
+}
+
+func TestErrorFramesOptIn(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		h := hub.New()
+		srv := server.NewServer(
+			server.WithHub(h),
+			server.WithCodec(&cnl.Codec{}),
+			server.WithSend(func(can.Frame) error { return nil }),
+			server.WithListenAddr("127.0.0.1:0"),
+			server.WithFlushInterval(time.Millisecond),
+			server.WithErrorFrames(enabled),
+		)
+		go func() { _ = srv.Serve(ctx) }()
+		<-srv.Ready()
+
+		sub, err := client.Dial(ctx, srv.Addr(), client.WithErrorFrames())
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := client.Dial(ctx, srv.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for len(srv.Clients()) < 2 && ctx.Err() == nil {
+			time.Sleep(5 * time.Millisecond)
+		}
+		// The answer to the subscription precedes any broadcast frame.
+		time.Sleep(50 * time.Millisecond)
+		if sub.ErrorFrames() != enabled {
+			t.Fatalf("enabled=%v: client subscribed=%v", enabled, sub.ErrorFrames())
+		}
+
+		errFr := can.Frame{CANID: can.CAN_ERR_FLAG | can.CAN_ERR_BUSOFF, Len: 8}
+		data := can.Frame{CANID: 0x123, Len: 1, Data: [64]byte{1}}
+		h.Broadcast(errFr)
+		h.Broadcast(data)
+		want := data
+		if enabled {
+			want = errFr
+		}
+		if got := nextData(t, ctx, sub); got != want {
+			t.Fatalf("enabled=%v: subscriber got %+v, want %+v", enabled, got, want)
+		}
+		if got := nextData(t, ctx, plain); got != data {
+			t.Fatalf("enabled=%v: plain client got %+v, want %+v", enabled, got, data)
+		}
+		sub.Close()
+		plain.Close()
+		cancel()
+	}
+}
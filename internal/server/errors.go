@@ -12,6 +12,7 @@ var (
 	ErrAccept    = errors.New("accept")
 	ErrHandshake = errors.New("handshake")
 	ErrConnRead  = errors.New("conn_read")
+	ErrLimit     = errors.New("conn_limit")
 	ErrConnWrite = errors.New("conn_write")
 	ErrBackendTx = errors.New("backend_tx")
 	ErrContext   = errors.New("context_cancelled")
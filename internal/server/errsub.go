@@ -0,0 +1,90 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultErrorBuffer is the subscription buffer used when Subscribe is
+// given none.
+const DefaultErrorBuffer = 16
+
+// ErrorEvent is one server error delivered to subscribers.
+type ErrorEvent struct {
+	Seq  uint64 // increases by one per server error; a gap means events were dropped
+	Time time.Time
+	Err  error // wraps one of the Err* sentinels; classify with errors.Is
+}
+
+// ErrorSubscription receives every server error published after Subscribe,
+// in order. A subscriber that falls behind loses the newest events instead
+// of blocking the server; Dropped counts them and Seq shows the gap.
+type ErrorSubscription struct {
+	C <-chan ErrorEvent
+
+	ch      chan ErrorEvent
+	subs    *errorSubs
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// Dropped returns the number of events lost because C was full.
+func (sub *ErrorSubscription) Dropped() uint64 { return sub.dropped.Load() }
+
+// Close ends the subscription and closes C. It is safe to call more than once.
+func (sub *ErrorSubscription) Close() {
+	sub.once.Do(func() {
+		sub.subs.remove(sub)
+		close(sub.ch)
+	})
+}
+
+// errorSubs fans server errors out to subscriptions.
+type errorSubs struct {
+	mu   sync.Mutex
+	seq  uint64
+	subs map[*ErrorSubscription]struct{}
+}
+
+func (e *errorSubs) add(buf int) *ErrorSubscription {
+	if buf <= 0 {
+		buf = DefaultErrorBuffer
+	}
+	ch := make(chan ErrorEvent, buf)
+	sub := &ErrorSubscription{C: ch, ch: ch, subs: e}
+	e.mu.Lock()
+	if e.subs == nil {
+		e.subs = make(map[*ErrorSubscription]struct{})
+	}
+	e.subs[sub] = struct{}{}
+	e.mu.Unlock()
+	return sub
+}
+
+func (e *errorSubs) remove(sub *ErrorSubscription) {
+	e.mu.Lock()
+	delete(e.subs, sub)
+	e.mu.Unlock()
+}
+
+// publish delivers err to every subscription without blocking. Holding the
+// lock keeps Seq in delivery order and Close from racing a send.
+func (e *errorSubs) publish(t time.Time, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.seq++
+	ev := ErrorEvent{Seq: e.seq, Time: t, Err: err}
+	for sub := range e.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// SubscribeErrors returns a subscription to the server errors published
+// from now on, buffering up to buf events (DefaultErrorBuffer when <= 0).
+// Close it when done.
+func (s *Server) SubscribeErrors(buf int) *ErrorSubscription { return s.errSubs.add(buf) }
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestSubscribeErrors(t *testing.T) {
+	s := NewServer()
+	all := s.SubscribeErrors(8)
+	small := s.SubscribeErrors(1)
+	defer all.Close()
+	for i := 0; i < 3; i++ {
+		s.setError(fmt.Errorf("read %d: %w", i, ErrConnRead))
+	}
+	for i := uint64(1); i <= 3; i++ {
+		ev := <-all.C
+		if ev.Seq != i || !errors.Is(ev.Err, ErrConnRead) || ev.Time.IsZero() {
+			t.Fatalf("event %d = %+v", i, ev)
+		}
+	}
+	if ev := <-small.C; ev.Seq != 1 {
+		t.Fatalf("small subscriber got seq %d first", ev.Seq)
+	}
+	if small.Dropped() != 2 || all.Dropped() != 0 {
+		t.Fatalf("dropped = %d/%d, want 2/0", small.Dropped(), all.Dropped())
+	}
+
+	small.Close()
+	small.Close()
+	if _, ok := <-small.C; ok {
+		t.Fatal("closed subscription still open")
+	}
+	s.setError(ErrAccept) // must not panic on the closed subscription
+	if ev := <-all.C; ev.Seq != 4 {
+		t.Fatalf("seq after close = %d", ev.Seq)
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+// WithFD lets clients negotiate CAN FD frames (OpFD). Set it when the
+// backend carries them; otherwise requests are answered FDUnavailable.
+// Clients that did not negotiate FD never receive FD frames, and a frame
+// with the FD length bit from them ends the connection unless the codec
+// masks the bit (cnl.Codec.MaskFD).
+func WithFD(on bool) ServerOption {
+	return func(s *Server) { s.fd = on }
+}
+
+// handleFD switches a client's stream to or from CAN FD frames and answers
+// with the state in force. Like compression, FD is a property of the
+// stream: sessions do not carry it over to the next connection.
+func (s *Server) handleFD(ctx context.Context, st *readerState, cl *hub.Client, fr can.Frame, logger *slog.Logger) {
+	code, _ := cnl.ParseFD(&fr)
+	on := code == cnl.FDOn
+	if on && (!s.fd || st.codec == nil) {
+		s.sendControl(ctx, cl, cnl.FD(cnl.FDUnavailable))
+		return
+	}
+	if st.codec == nil || on == st.codec.FD {
+		reply := byte(cnl.FDOff)
+		if on {
+			reply = cnl.FDOn
+		}
+		s.sendControl(ctx, cl, cnl.FD(reply))
+		return
+	}
+	st.codec.FD = on
+	logger.Info("client_fd", "enabled", on)
+	if on {
+		// The answer goes out before the first FD frame can be queued.
+		s.sendControl(ctx, cl, cnl.FD(cnl.FDOn))
+		cl.SetFD(true)
+		return
+	}
+	cl.SetFD(false)
+	s.sendControl(ctx, cl, cnl.FD(cnl.FDOff))
+}
@@ -0,0 +1,147 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/client"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+func startFDServer(t *testing.T, ctx context.Context, h *hub.Hub, codec *cnl.Codec, sent chan can.Frame, opts ...server.ServerOption) *server.Server {
+	t.Helper()
+	srv := server.NewServer(append([]server.ServerOption{
+		server.WithHub(h),
+		server.WithCodec(codec),
+		server.WithSend(func(fr can.Frame) error { sent <- fr; return nil }),
+		server.WithListenAddr("127.0.0.1:0"),
+		server.WithFlushInterval(time.Millisecond),
+	}, opts...)...)
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+	return srv
+}
+
+func TestFDNegotiated(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h := hub.New()
+	sent := make(chan can.Frame, 4)
+	srv := startFDServer(t, ctx, h, &cnl.Codec{}, sent, server.WithFD(true))
+
+	fd, err := client.Dial(ctx, srv.Addr(), client.WithFD())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	plain, err := client.Dial(ctx, srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	for (!fd.FD() || len(srv.Clients()) < 2) && ctx.Err() == nil {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The largest FD frame fits the default decode budget of an FD stream.
+	big := can.Frame{CANID: 0x123, Len: can.MaxFDLen, Flags: can.CANFD_FDF | can.CANFD_BRS}
+	for i := range big.Data {
+		big.Data[i] = byte(i)
+	}
+	if err := fd.Send(big); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-sent:
+		if got != big {
+			t.Fatalf("backend got %+v", got)
+		}
+	case <-ctx.Done():
+		t.Fatal("FD frame did not reach the backend")
+	}
+
+	// FD frames go to FD clients only.
+	classic := can.Frame{CANID: 0x10, Len: 1, Data: [64]byte{1}}
+	h.Broadcast(big)
+	h.Broadcast(classic)
+	if got := nextData(t, ctx, fd); got != big {
+		t.Fatalf("FD client got %+v", got)
+	}
+	if got := nextData(t, ctx, plain); got != classic {
+		t.Fatalf("plain client got %+v", got)
+	}
+	if err := plain.Send(big); !errors.Is(err, client.ErrFDUnavailable) {
+		t.Fatalf("plain client sent an FD frame: err=%v", err)
+	}
+}
+
+func TestFDUnavailable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := startFDServer(t, ctx, hub.New(), &cnl.Codec{}, make(chan can.Frame, 1))
+	c, err := client.Dial(ctx, srv.Addr(), client.WithFD())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for {
+		fr := <-c.Frames()
+		if code, ok := cnl.ParseFD(&fr); ok {
+			if code != cnl.FDUnavailable || c.FD() {
+				t.Fatalf("answer %d, FD=%v", code, c.FD())
+			}
+			return
+		}
+	}
+}
+
+// TestFDBitLegacy sends an FD frame on a stream that did not negotiate FD:
+// the server closes the connection, or masks the bit when told to.
+func TestFDBitLegacy(t *testing.T) {
+	fr := can.Frame{CANID: 0x123, Len: 2, Flags: can.CANFD_FDF, Data: [64]byte{0xAA, 0xBB}}
+	for _, mask := range []bool{false, true} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		sent := make(chan can.Frame, 4)
+		srv := startFDServer(t, ctx, hub.New(), &cnl.Codec{MaskFD: mask}, sent, server.WithFD(true))
+		conn, err := net.Dial("tcp", srv.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cnl.Handshake(ctx, conn, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		// The masked flags byte reads as the first payload byte.
+		if _, err := conn.Write((&cnl.Codec{}).AppendFrame(nil, &fr)); err != nil {
+			t.Fatal(err)
+		}
+		if mask {
+			select {
+			case got := <-sent:
+				if got.IsFD() || got.Len != 2 || got.Data[0] != 0 || got.Data[1] != 0xAA {
+					t.Fatalf("masked frame %+v", got)
+				}
+			case <-ctx.Done():
+				t.Fatal("masked frame not passed on")
+			}
+		} else {
+			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := io.ReadAll(conn); err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					t.Fatal("server kept the connection open")
+				}
+			}
+			if !errors.Is(srv.LastError(), server.ErrConnRead) {
+				t.Fatalf("last error %v", srv.LastError())
+			}
+		}
+		conn.Close()
+		cancel()
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// flowSample is how often the backend TX queue is sampled for a client
+// subscribed to flow-control hints.
+const flowSample = 10 * time.Millisecond
+
+// Flow level thresholds in percent of the TX queue capacity. A level is
+// entered at the first threshold and left only below the lower exit
+// threshold, so a queue hovering at one mark does not flood the client with
+// hints.
+const (
+	flowSlowAt   = 50
+	flowSlowExit = 25
+	flowStopAt   = 90
+	flowStopExit = 45
+)
+
+// WithTxQueue lets clients subscribe to flow-control hints (OpFlow) derived
+// from the backend TX queue that fn reports. Without it subscriptions are
+// answered FlowUnavailable.
+func WithTxQueue(fn func() (depth, capacity int)) ServerOption {
+	return func(s *Server) { s.txQueue = fn }
+}
+
+// flowLevel returns the flow level for a queue holding depth of capacity
+// frames, given the level last reported.
+func flowLevel(prev byte, depth, capacity int) byte {
+	if capacity <= 0 {
+		return cnl.FlowOK
+	}
+	pct := depth * 100 / capacity
+	switch {
+	case pct >= flowStopAt, prev == cnl.FlowStop && pct >= flowStopExit:
+		return cnl.FlowStop
+	case pct >= flowSlowAt, prev != cnl.FlowOK && pct >= flowSlowExit:
+		return cnl.FlowSlow
+	}
+	return cnl.FlowOK
+}
+
+func flowLevelName(level byte) string {
+	switch level {
+	case cnl.FlowSlow:
+		return metrics.FlowSlow
+	case cnl.FlowStop:
+		return metrics.FlowStop
+	}
+	return metrics.FlowOK
+}
+
+// handleFlow subscribes or unsubscribes a client to flow-control hints. A
+// subscription is answered with a hint carrying the current level, later
+// hints follow whenever the level changes; unsubscribing is answered
+// FlowOff once no further hint can follow.
+func (s *Server) handleFlow(ctx context.Context, st *readerState, cl *hub.Client, fr can.Frame, logger *slog.Logger) {
+	code, _, _, _, _ := cnl.ParseFlow(&fr)
+	if code == cnl.FlowOn && s.txQueue == nil {
+		s.sendControl(ctx, cl, cnl.Flow(cnl.FlowUnavailable))
+		return
+	}
+	on := code == cnl.FlowOn
+	if on != (st.flowStop != nil) {
+		logger.Info("client_flow_hints", "enabled", on)
+	}
+	// A repeated subscription restarts the sampler, which answers with the
+	// current level.
+	st.stopFlow()
+	if !on {
+		s.sendControl(ctx, cl, cnl.Flow(cnl.FlowOff))
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	st.flowStop = func() { close(stop); <-done }
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(done)
+		s.runFlow(ctx, cl, stop)
+	}()
+}
+
+// runFlow sends cl a hint at once and then on every level change until stop
+// is closed or the client goes away.
+func (s *Server) runFlow(ctx context.Context, cl *hub.Client, stop <-chan struct{}) {
+	t := time.NewTicker(flowSample)
+	defer t.Stop()
+	level, sent := byte(cnl.FlowOK), false
+	for {
+		depth, capacity := s.txQueue()
+		if next := flowLevel(level, depth, capacity); next != level || !sent {
+			level, sent = next, true
+			metrics.IncFlowHint(flowLevelName(level))
+			s.sendControl(ctx, cl, cnl.FlowHintMessage(level, depth, capacity))
+		}
+		select {
+		case <-stop:
+			return
+		case <-cl.Closed:
+			return
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// stopFlow stops the flow-hint sampler, if running, and waits for it.
+func (st *readerState) stopFlow() {
+	if st.flowStop != nil {
+		st.flowStop()
+		st.flowStop = nil
+	}
+}
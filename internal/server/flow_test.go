@@ -0,0 +1,128 @@
+package server_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/client"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+func TestFlowHints(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var depth atomic.Int64
+	sent := make(chan can.Frame, 1)
+	srv := server.NewServer(
+		server.WithHub(hub.New()),
+		server.WithCodec(&cnl.Codec{}),
+		server.WithSend(func(fr can.Frame) error { sent <- fr; return nil }),
+		server.WithListenAddr("127.0.0.1:0"),
+		server.WithFlushInterval(time.Millisecond),
+		server.WithTxQueue(func() (int, int) { return int(depth.Load()), 100 }),
+	)
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+
+	c, err := client.Dial(ctx, srv.Addr(), client.WithFlowControl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitFlow := func(want client.FlowLevel, wantDepth int) {
+		t.Helper()
+		for ctx.Err() == nil {
+			if st := c.Flow(); c.FlowControl() && st.Level == want && st.Depth == wantDepth {
+				if st.Capacity != 100 {
+					t.Fatalf("capacity %d", st.Capacity)
+				}
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("flow %+v, want level %v depth %d", c.Flow(), want, wantDepth)
+	}
+	waitFlow(client.FlowOK, 0)
+
+	// Levels change at 50% and 90% and fall back below 25% and 45%.
+	for _, step := range []struct {
+		depth, hintDepth int
+		level            client.FlowLevel
+	}{
+		{60, 60, client.FlowSlow},
+		{30, 60, client.FlowSlow},
+		{20, 20, client.FlowOK},
+		{95, 95, client.FlowStop},
+		{50, 95, client.FlowStop},
+		{40, 40, client.FlowSlow},
+		{95, 95, client.FlowStop},
+	} {
+		depth.Store(int64(step.depth))
+		time.Sleep(30 * time.Millisecond)
+		waitFlow(step.level, step.hintDepth)
+	}
+
+	// SendContext holds the frame back while the queue is nearly full.
+	res := make(chan error, 1)
+	go func() { res <- c.SendContext(ctx, can.Frame{CANID: 0x123, Len: 1}) }()
+	select {
+	case <-sent:
+		t.Fatal("frame sent while the server reported stop")
+	case <-time.After(50 * time.Millisecond):
+	}
+	depth.Store(0)
+	if err := <-res; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case fr := <-sent:
+		if fr.CANID != 0x123 {
+			t.Fatalf("sent %+v", fr)
+		}
+	case <-ctx.Done():
+		t.Fatal("frame not sent after the queue drained")
+	}
+
+	depth.Store(95)
+	waitFlow(client.FlowStop, 95)
+	short, cancelShort := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancelShort()
+	if err := c.SendContext(short, can.Frame{CANID: 0x124}); err != context.DeadlineExceeded {
+		t.Fatalf("SendContext at stop: %v", err)
+	}
+}
+
+func TestFlowUnavailable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := server.NewServer(
+		server.WithHub(hub.New()),
+		server.WithCodec(&cnl.Codec{}),
+		server.WithSend(func(can.Frame) error { return nil }),
+		server.WithListenAddr("127.0.0.1:0"),
+		server.WithFlushInterval(time.Millisecond),
+	)
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+
+	c, err := client.Dial(ctx, srv.Addr(), client.WithFlowControl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// The server answers FlowUnavailable; the client keeps sending freely.
+	if _, err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if c.FlowControl() {
+		t.Fatal("flow hints enabled without a TX queue")
+	}
+	if err := c.SendContext(ctx, can.Frame{CANID: 0x123}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,12 +2,20 @@ package server
 
 import (
 	"context"
+	"errors"
 	"net"
 
 	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
 )
 
-// CannelloniHandshake runs the required TCP hello exchange.
+// CannelloniHandshake runs the required TCP hello exchange, reading at most
+// Limits.MaxHandshakeBytes from the peer.
 func (s *Server) CannelloniHandshake(ctx context.Context, c net.Conn) error {
-	return cnl.Handshake(ctx, c, s.handshakeTimeout)
+	err := cnl.Handshake(ctx, newBudgetConn(c, s.limits.MaxHandshakeBytes), s.handshakeTimeout)
+	if errors.Is(err, ErrLimit) {
+		metrics.IncLimitHit(metrics.LimitHandshakeBytes)
+		return limitErr(metrics.LimitHandshakeBytes, s.limits.MaxHandshakeBytes)
+	}
+	return err
 }
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+func TestHistoryReplay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var asked time.Duration
+	srv := NewServer(
+		WithHub(hub.New()),
+		WithCodec(&cnl.Codec{}),
+		WithSend(func(can.Frame) error { return nil }),
+		WithHistory(func(d time.Duration) []can.Frame {
+			asked = d
+			return []can.Frame{{CANID: 0x10, Len: 1, Data: [64]byte{1}}, {CANID: 0x11}}
+		}),
+		WithFlushInterval(time.Millisecond),
+	)
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := cnl.Handshake(ctx, conn, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	codec := &cnl.Codec{}
+	r := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := codec.EncodeTo(conn, []can.Frame{cnl.HistoryRequest(30)}); err != nil {
+		t.Fatal(err)
+	}
+	var got []can.Frame
+	for i := 0; i < 4; i++ {
+		fr, err := codec.Decode(r)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		got = append(got, fr)
+	}
+	if op, st, n, ok := cnl.ParseHistoryMarker(&got[0]); !ok || op != cnl.OpHistoryBegin || st != cnl.HistoryOK || n != 2 {
+		t.Fatalf("begin marker: %+v", got[0])
+	}
+	if got[1].CANID != 0x10 || got[1].Data[0] != 1 || got[2].CANID != 0x11 {
+		t.Fatalf("replayed frames: %+v %+v", got[1], got[2])
+	}
+	if op, _, n, ok := cnl.ParseHistoryMarker(&got[3]); !ok || op != cnl.OpHistoryEnd || n != 2 {
+		t.Fatalf("end marker: %+v", got[3])
+	}
+	if asked != 30*time.Second {
+		t.Fatalf("history window = %v", asked)
+	}
+}
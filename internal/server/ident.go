@@ -0,0 +1,26 @@
+package server
+
+import (
+	"context"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+// WithIdent sets what the server answers OpIdent queries with, so clients
+// and bus tools can tell which gateway and bus they are connected to.
+func WithIdent(id cnl.Ident) ServerOption {
+	return func(s *Server) { s.ident = id }
+}
+
+// handleIdent answers an OpIdent query with the server identification.
+// Other OpIdent codes come from servers and are ignored.
+func (s *Server) handleIdent(ctx context.Context, cl *hub.Client, fr can.Frame) {
+	if code, _, _ := cnl.ParseIdent(&fr); code != cnl.IdentQuery {
+		return
+	}
+	for _, m := range cnl.IdentMessages(s.ident) {
+		s.sendControl(ctx, cl, m)
+	}
+}
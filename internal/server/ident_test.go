@@ -0,0 +1,34 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/client"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+func TestIdentify(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	id := cnl.Ident{Version: "v1.2.3", Backend: "socketcan", Bus: "living-room-bus"}
+	srv := startFDServer(t, ctx, hub.New(), &cnl.Codec{}, make(chan can.Frame, 1), server.WithIdent(id))
+	c, err := client.Dial(ctx, srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for range 2 { // the answer can be asked for again
+		got, err := c.Identify(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != (client.Identity{Version: id.Version, Backend: id.Backend, Bus: id.Bus}) {
+			t.Fatalf("got %+v", got)
+		}
+	}
+}
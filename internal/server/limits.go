@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+)
+
+// Limits bounds the work a single connection can cause, so a malformed or
+// malicious peer cannot make the server buffer or spin without bound. Zero
+// fields take the defaults.
+type Limits struct {
+	// MaxDecodeBytes is the most bytes one frame decode may consume.
+	MaxDecodeBytes int
+	// MaxBurstFrames is the most frames decoded per read burst before the
+	// reader yields.
+	MaxBurstFrames int
+	// MaxHandshakeBytes is the most bytes read before the handshake completes.
+	MaxHandshakeBytes int
+	// BurstYield is how long a reader pauses after a full burst, capping a
+	// streaming client at MaxBurstFrames per BurstYield so concurrent
+	// senders get their share of the backend queue. 0 only yields the CPU.
+	BurstYield time.Duration
+}
+
+const (
+	defaultMaxDecodeBytes    = cnl.MaxFrameSize
+	defaultMaxBurstFrames    = 16
+	defaultMaxHandshakeBytes = 64
+)
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxDecodeBytes <= 0 {
+		l.MaxDecodeBytes = defaultMaxDecodeBytes
+	}
+	if l.MaxBurstFrames <= 0 {
+		l.MaxBurstFrames = defaultMaxBurstFrames
+	}
+	if l.MaxHandshakeBytes <= 0 {
+		l.MaxHandshakeBytes = defaultMaxHandshakeBytes
+	}
+	return l
+}
+
+// WithLimits sets the per-connection protocol limits.
+func WithLimits(l Limits) ServerOption {
+	return func(s *Server) { s.limits = l.withDefaults() }
+}
+
+// budgetReader reads from r until left bytes have been consumed, then fails
+// with ErrLimit. The owner refills left at each protocol boundary.
+type budgetReader struct {
+	r    io.Reader
+	left int
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, ErrLimit
+	}
+	if len(p) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.r.Read(p)
+	b.left -= n
+	return n, err
+}
+
+// budgetConn is a net.Conn whose reads draw on a budget.
+type budgetConn struct {
+	net.Conn
+	budget *budgetReader
+}
+
+func newBudgetConn(c net.Conn, n int) *budgetConn {
+	return &budgetConn{Conn: c, budget: &budgetReader{r: c, left: n}}
+}
+
+func (c *budgetConn) Read(p []byte) (int, error) { return c.budget.Read(p) }
+
+// limitErr wraps a budget exhaustion for logging and error history.
+func limitErr(limit string, n int) error {
+	return fmt.Errorf("%w: %s %d exceeded", ErrLimit, limit, n)
+}
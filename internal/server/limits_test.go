@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+func startLimitServer(t *testing.T, ctx context.Context, l Limits, sent chan<- can.Frame) *Server {
+	t.Helper()
+	srv := NewServer(
+		WithHub(hub.New()),
+		WithCodec(&cnl.Codec{}),
+		WithSend(func(fr can.Frame) error { sent <- fr; return nil }),
+		WithLimits(l),
+	)
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+	return srv
+}
+
+func TestLimitDecodeBytes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sent := make(chan can.Frame, 4)
+	// Every cannelloni frame needs at least 5 bytes.
+	srv := startLimitServer(t, ctx, Limits{MaxDecodeBytes: 4}, sent)
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := cnl.Handshake(ctx, conn, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	before := metrics.Snap().LimitHits
+	if _, err := (&cnl.Codec{}).EncodeTo(conn, []can.Frame{{CANID: 0x123}}); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// EOF or reset, but not our read timeout.
+	if _, err := io.ReadAll(conn); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatal("server kept the connection open")
+		}
+	}
+	if metrics.Snap().LimitHits == before {
+		t.Fatal("decode limit hit not counted")
+	}
+	select {
+	case fr := <-sent:
+		t.Fatalf("frame %+v reached the backend", fr)
+	default:
+	}
+}
+
+func TestLimitHandshakeBytes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := startLimitServer(t, ctx, Limits{MaxHandshakeBytes: cnl.HelloSize - 1}, make(chan can.Frame, 1))
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := cnl.Handshake(ctx, conn, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.Stats().HandshakeFail == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("handshake not rejected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLimitBurstFrames(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sent := make(chan can.Frame, 8)
+	srv := startLimitServer(t, ctx, Limits{MaxBurstFrames: 2}, sent)
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := cnl.Handshake(ctx, conn, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	before := metrics.Snap().LimitHits
+	frames := []can.Frame{{CANID: 1}, {CANID: 2}, {CANID: 3}, {CANID: 4}, {CANID: 5}}
+	if _, err := (&cnl.Codec{}).EncodeTo(conn, frames); err != nil {
+		t.Fatal(err)
+	}
+	for i := range frames {
+		select {
+		case fr := <-sent:
+			if fr.CANID != frames[i].CANID {
+				t.Fatalf("frame %d: got 0x%X", i, fr.CANID)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("frame %d not delivered", i)
+		}
+	}
+	if metrics.Snap().LimitHits-before < 2 {
+		t.Fatal("burst limit hits not counted")
+	}
+}
+
+func TestBurstYieldThrottles(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sent := make(chan can.Frame, 8)
+	srv := startLimitServer(t, ctx, Limits{MaxBurstFrames: 2, BurstYield: 20 * time.Millisecond}, sent)
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := cnl.Handshake(ctx, conn, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	before := metrics.Snap().ReaderYields
+	start := time.Now()
+	if _, err := (&cnl.Codec{}).EncodeTo(conn, make([]can.Frame, 6)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		select {
+		case <-sent:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("frame %d not delivered", i)
+		}
+	}
+	// Three bursts of two frames: at least two pauses before the last one.
+	if el := time.Since(start); el < 40*time.Millisecond {
+		t.Fatalf("6 frames in %v, want throttling to 2 per 20ms", el)
+	}
+	if metrics.Snap().ReaderYields-before < 2 {
+		t.Fatal("yields not observed")
+	}
+}
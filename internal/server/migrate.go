@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// ErrSessionsDisabled reports a session import into a server without
+// sessions (WithSessions grace 0).
+var ErrSessionsDisabled = errors.New("sessions disabled")
+
+// SessionState is what a standby gateway needs to resume a client session
+// after a failover: the owning identity, the settings the client
+// negotiated and its receive filter with the last-value cache.
+type SessionState struct {
+	Token     uint64       `json:"token"`
+	Identity  string       `json:"identity"`
+	TxAck     bool         `json:"tx_ack,omitempty"`
+	AckSeq    uint16       `json:"ack_seq,omitempty"`
+	ErrFrames bool         `json:"error_frames,omitempty"`
+	Filter    *FilterState `json:"filter,omitempty"`
+}
+
+// FilterState is a receive filter pushed by a client (OpFilter). Last holds
+// the frames a change-only filter compares against.
+type FilterState struct {
+	IDs        string       `json:"ids"`
+	ChangeOnly bool         `json:"change_only,omitempty"`
+	Last       []StateFrame `json:"last,omitempty"`
+}
+
+// StateFrame is a frame of a last-value cache.
+type StateFrame struct {
+	ID   uint32 `json:"id"` // CAN ID with flag bits
+	Len  uint8  `json:"len"`
+	Data string `json:"data"` // hex payload
+}
+
+// ExportSessions returns the state of the sessions opened on this server,
+// bound or parked, ordered by token. Sessions imported from a peer are left
+// out, so two gateways syncing from each other do not keep stale sessions
+// alive. The TX acknowledgement sequence of a connected client is the one
+// of its last settings change.
+func (s *Server) ExportSessions() []SessionState {
+	ss := s.sessions
+	if ss == nil {
+		return nil
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	out := make([]SessionState, 0, len(ss.m))
+	for _, sess := range ss.m {
+		if sess.imported {
+			continue
+		}
+		st := SessionState{
+			Token:     sess.token,
+			Identity:  sess.identity,
+			TxAck:     sess.ackMode,
+			AckSeq:    sess.ackSeq,
+			ErrFrames: sess.errs,
+		}
+		if r := sess.spec; r != nil {
+			st.Filter = &FilterState{IDs: r.ids, ChangeOnly: r.changeOnly}
+			if r.changes != nil {
+				for _, fr := range r.changes.Frames() {
+					n := min(int(fr.Len), len(fr.Data))
+					st.Filter.Last = append(st.Filter.Last, StateFrame{ID: fr.CANID, Len: fr.Len, Data: hex.EncodeToString(fr.Data[:n])})
+				}
+				sort.Slice(st.Filter.Last, func(i, j int) bool { return st.Filter.Last[i].ID < st.Filter.Last[j].ID })
+			}
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Token < out[j].Token })
+	return out
+}
+
+// ImportSessions replaces the sessions held for a peer gateway with states,
+// typically the ExportSessions of the active peer of a hot-standby pair. A
+// client that fails over to this server and resumes one of them with the
+// same identity gets its settings and filter back; frames broadcast during
+// the failover are not replayed. Sessions opened here are never replaced.
+// Invalid states are skipped and reported in the error. It returns the
+// number of imported sessions now held.
+func (s *Server) ImportSessions(states []SessionState) (int, error) {
+	ss := s.sessions
+	if ss == nil {
+		return 0, ErrSessionsDisabled
+	}
+	var errs []error
+	imported := make(map[uint64]*session, len(states))
+	for _, st := range states {
+		sess, err := importSession(st)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("session %012x: %w", st.Token, err))
+			continue
+		}
+		imported[sess.token] = sess
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for token, sess := range ss.m {
+		if _, ok := imported[token]; sess.imported && !ok {
+			delete(ss.m, token)
+			ss.standbyN--
+		}
+	}
+	for token, sess := range imported {
+		cur := ss.m[token]
+		if cur != nil && !cur.imported {
+			continue
+		}
+		if cur == nil {
+			ss.standbyN++
+		}
+		ss.m[token] = sess
+	}
+	metrics.SetSessionsStandby(ss.standbyN)
+	return ss.standbyN, errors.Join(errs...)
+}
+
+// importSession builds an imported session from st.
+func importSession(st SessionState) (*session, error) {
+	if st.Token == 0 || st.Token&^cnl.SessionTokenMask != 0 {
+		return nil, fmt.Errorf("invalid token")
+	}
+	sess := &session{
+		token:    st.Token,
+		identity: st.Identity,
+		ackMode:  st.TxAck,
+		ackSeq:   st.AckSeq,
+		errs:     st.ErrFrames,
+		imported: true,
+	}
+	if st.Filter == nil {
+		return sess, nil
+	}
+	spec := &rxFilterSpec{ids: st.Filter.IDs, changeOnly: st.Filter.ChangeOnly}
+	if spec.changeOnly {
+		spec.changes = new(filter.Changes)
+		last := make([]can.Frame, 0, len(st.Filter.Last))
+		for _, sf := range st.Filter.Last {
+			b, err := hex.DecodeString(sf.Data)
+			if err != nil || len(b) != min(int(sf.Len), len(can.Frame{}.Data)) {
+				return nil, fmt.Errorf("invalid last frame 0x%X", sf.ID)
+			}
+			fr := can.Frame{CANID: sf.ID, Len: sf.Len}
+			copy(fr.Data[:], b)
+			last = append(last, fr)
+		}
+		spec.changes.Restore(last)
+	}
+	f, err := spec.compile()
+	if err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+	if f != nil {
+		sess.filter, sess.spec = f, spec
+	}
+	return sess, nil
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+func TestSessionMigration(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := func(h *hub.Hub) *Server {
+		srv := NewServer(
+			WithHub(h),
+			WithCodec(&cnl.Codec{}),
+			WithSend(func(can.Frame) error { return nil }),
+			WithFlushInterval(time.Millisecond),
+			WithSessions(time.Minute, 0),
+		)
+		go func() { _ = srv.Serve(ctx) }()
+		<-srv.Ready()
+		return srv
+	}
+	hA, hB := hub.New(), hub.New()
+	active, standby := start(hA), start(hB)
+	codec := &cnl.Codec{}
+
+	conn, r, _, token := sessionConn(t, ctx, active, 0)
+	defer conn.Close()
+	if _, err := codec.EncodeTo(conn, cnl.FilterMessages("0x100-0x1FF", cnl.FilterChangeOnly)); err != nil {
+		t.Fatal(err)
+	}
+	if fr, err := codec.Decode(r); err != nil || fr.Data[0] != cnl.OpFilter {
+		t.Fatalf("filter reply: %+v %v", fr, err)
+	}
+	seen := can.Frame{CANID: 0x100, Len: 1, Data: [64]byte{1}}
+	hA.Broadcast(seen)
+	if fr, err := codec.Decode(r); err != nil || fr != seen {
+		t.Fatalf("active frame: %+v %v", fr, err)
+	}
+
+	states := active.ExportSessions()
+	if len(states) != 1 || states[0].Token != token || states[0].Filter == nil ||
+		!states[0].Filter.ChangeOnly || len(states[0].Filter.Last) != 1 || states[0].Filter.Last[0].Data != "01" {
+		t.Fatalf("exported %+v", states)
+	}
+	if n, err := standby.ImportSessions(states); n != 1 || err != nil {
+		t.Fatalf("import: %d %v", n, err)
+	}
+	if got := standby.ExportSessions(); len(got) != 0 {
+		t.Fatalf("standby re-exports imported sessions: %+v", got)
+	}
+
+	// Failover: the client resumes its token on the standby.
+	conn2, r2, st, tok := sessionConn(t, ctx, standby, token)
+	defer conn2.Close()
+	if st != cnl.SessionResumed || tok != token {
+		t.Fatalf("migrated resume: status=%d token=%x want %x", st, tok, token)
+	}
+	for _, op := range []byte{cnl.OpHistoryBegin, cnl.OpHistoryEnd} {
+		fr, err := codec.Decode(r2)
+		if got, _, n, ok := cnl.ParseHistoryMarker(&fr); err != nil || !ok || got != op || n != 0 {
+			t.Fatalf("marker: %+v %v", fr, err)
+		}
+	}
+	for len(standby.Clients()) < 1 && ctx.Err() == nil {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// The filter and its last-value cache came along: the repeat and the
+	// ID outside the list are withheld.
+	changed := can.Frame{CANID: 0x100, Len: 1, Data: [64]byte{2}}
+	hB.Broadcast(seen)
+	hB.Broadcast(can.Frame{CANID: 0x200})
+	hB.Broadcast(changed)
+	if fr, err := codec.Decode(r2); err != nil || fr != changed {
+		t.Fatalf("standby frame: %+v %v", fr, err)
+	}
+	if n, _ := standby.ImportSessions(nil); n != 0 {
+		t.Fatalf("claimed session still counted as imported: %d", n)
+	}
+	if got := standby.ExportSessions(); len(got) != 1 || got[0].Token != token {
+		t.Fatalf("resumed session not exported by the new active: %+v", got)
+	}
+}
+
+func TestImportSessionsReplaces(t *testing.T) {
+	srv := NewServer(WithSessions(time.Minute, 0))
+	n, err := srv.ImportSessions([]SessionState{
+		{Token: 1, Identity: "a"},
+		{Token: 0},
+		{Token: 2, Filter: &FilterState{IDs: "0x100-"}},
+		{Token: 3, Filter: &FilterState{IDs: "0x100", ChangeOnly: true, Last: []StateFrame{{ID: 0x100, Len: 2, Data: "01"}}}},
+	})
+	if n != 1 || err == nil {
+		t.Fatalf("import: %d %v", n, err)
+	}
+	if n, err := srv.ImportSessions([]SessionState{{Token: 4}, {Token: 5}}); n != 2 || err != nil {
+		t.Fatalf("replace: %d %v", n, err)
+	}
+	srv.sessions.mu.Lock()
+	_, stale := srv.sessions.m[1]
+	srv.sessions.mu.Unlock()
+	if stale {
+		t.Fatal("session missing from the new import kept")
+	}
+	if _, err := NewServer().ImportSessions(nil); err != ErrSessionsDisabled {
+		t.Fatalf("disabled: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/client"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+func TestPacketFraming(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h := hub.New()
+	sent := make(chan can.Frame, 4)
+	srv := server.NewServer(
+		server.WithHub(h),
+		server.WithCodec(&cnl.Codec{}),
+		server.WithSend(func(fr can.Frame) error { sent <- fr; return nil }),
+		server.WithListenAddr("127.0.0.1:0"),
+		server.WithFlushInterval(time.Millisecond),
+		server.WithPacketFraming(true),
+	)
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+
+	c, err := client.Dial(ctx, srv.Addr(), client.WithPacketFraming())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// A full classic frame plus its packet header must fit the decode budget.
+	out := can.Frame{CANID: 0x1ABCDEF | can.CAN_EFF_FLAG, Len: 8, Data: [64]byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	if err := c.Send(out); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-sent:
+		if got != out {
+			t.Fatalf("server got %+v, want %+v", got, out)
+		}
+	case <-ctx.Done():
+		t.Fatalf("frame not received: %v", srv.LastError())
+	}
+
+	for len(srv.Clients()) < 1 && ctx.Err() == nil {
+		time.Sleep(5 * time.Millisecond)
+	}
+	in := can.Frame{CANID: 0x123, Len: 2, Data: [64]byte{9, 9}}
+	h.Broadcast(in)
+	h.Broadcast(in)
+	for range 2 {
+		if got := nextData(t, ctx, c); got != in {
+			t.Fatalf("client got %+v, want %+v", got, in)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	connRateWindow = time.Minute
+	// connRateSweep is the tracked address count above which idle entries
+	// are pruned.
+	connRateSweep = 1024
+)
+
+// WithConnRate limits each remote IP to max connection attempts per minute.
+// An address exceeding it is banned for ban: its connections are closed
+// right after accept, before the handshake. max 0 disables the limit; ban 0
+// bans for one minute.
+func WithConnRate(max int, ban time.Duration) ServerOption {
+	return func(s *Server) { _ = s.SetConnRate(max, ban) }
+}
+
+// ConnRate returns the per-IP connection limit (0: unlimited) and the ban
+// duration.
+func (s *Server) ConnRate() (max int, ban time.Duration) { return s.connRate.limits() }
+
+// SetConnRate changes the per-IP connection limit while the server runs
+// (see WithConnRate). Tracked addresses and running bans are kept while a
+// limit stays in place.
+func (s *Server) SetConnRate(max int, ban time.Duration) error {
+	if max < 0 || ban < 0 {
+		return fmt.Errorf("conn rate and ban must be >= 0 (got %d, %v)", max, ban)
+	}
+	if ban == 0 {
+		ban = connRateWindow
+	}
+	s.connRate.set(max, ban)
+	return nil
+}
+
+type ipRate struct {
+	start  time.Time // current window start
+	count  int
+	banned time.Time // banned until
+}
+
+// connLimiter counts connection attempts per remote IP in fixed windows;
+// max 0 lets every attempt through.
+type connLimiter struct {
+	mu  sync.Mutex
+	max int
+	ban time.Duration
+	m   map[netip.Addr]*ipRate
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{ban: connRateWindow, m: make(map[netip.Addr]*ipRate)}
+}
+
+func (l *connLimiter) limits() (int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.max, l.ban
+}
+
+// set changes the limits; turning the limit off forgets every address.
+func (l *connLimiter) set(max int, ban time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if max == 0 {
+		clear(l.m)
+	}
+	l.max, l.ban = max, ban
+}
+
+// allow records a connection attempt from addr at now. It reports whether
+// the attempt may proceed and whether it started a new ban.
+func (l *connLimiter) allow(addr net.Addr, now time.Time) (ok, banned bool) {
+	ip := remoteIP(addr)
+	if !ip.IsValid() {
+		return true, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max == 0 {
+		return true, false
+	}
+	r := l.m[ip]
+	if r == nil {
+		if len(l.m) >= connRateSweep {
+			l.sweep(now)
+		}
+		r = &ipRate{start: now}
+		l.m[ip] = r
+	}
+	if now.Before(r.banned) {
+		return false, false
+	}
+	if now.Sub(r.start) >= connRateWindow {
+		r.start, r.count = now, 0
+	}
+	r.count++
+	if r.count > l.max {
+		r.banned = now.Add(l.ban)
+		r.start, r.count = r.banned, 0
+		return false, true
+	}
+	return true, false
+}
+
+// sweep drops addresses whose window and ban have both run out. Callers hold mu.
+func (l *connLimiter) sweep(now time.Time) {
+	for ip, r := range l.m {
+		if now.Sub(r.start) >= connRateWindow && !now.Before(r.banned) {
+			delete(l.m, ip)
+		}
+	}
+}
+
+func remoteIP(a net.Addr) netip.Addr {
+	if ta, ok := a.(*net.TCPAddr); ok {
+		ip, _ := netip.AddrFromSlice(ta.IP)
+		return ip.Unmap()
+	}
+	if ap, err := netip.ParseAddrPort(a.String()); err == nil {
+		return ap.Addr().Unmap()
+	}
+	return netip.Addr{}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+func TestConnLimiterWindowAndBan(t *testing.T) {
+	l := &connLimiter{max: 2, ban: 5 * time.Minute, m: make(map[netip.Addr]*ipRate)}
+	a := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	other := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow(a, now); !ok {
+			t.Fatalf("attempt %d refused", i)
+		}
+	}
+	if ok, banned := l.allow(a, now); ok || !banned {
+		t.Fatalf("third attempt: ok=%v banned=%v", ok, banned)
+	}
+	if ok, banned := l.allow(a, now.Add(time.Minute)); ok || banned {
+		t.Fatalf("during ban: ok=%v banned=%v", ok, banned)
+	}
+	if ok, _ := l.allow(other, now); !ok {
+		t.Fatal("other address refused")
+	}
+	if ok, _ := l.allow(a, now.Add(5*time.Minute)); !ok {
+		t.Fatal("refused after ban expired")
+	}
+}
+
+func TestServerConnRate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := NewServer(WithHub(hub.New()), WithCodec(&cnl.Codec{}), WithConnRate(1, time.Minute))
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := cnl.Handshake(ctx, conn, time.Second); err != nil {
+		t.Fatalf("first connection: %v", err)
+	}
+	conn2, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	if err := cnl.Handshake(ctx, conn2, time.Second); err == nil {
+		t.Fatal("second connection completed the handshake")
+	}
+	if st := srv.Stats(); st.RateLimited != 1 || st.HandshakeFail != 0 {
+		t.Fatalf("stats: %+v", st)
+	}
+}
+
+func TestSetConnRate(t *testing.T) {
+	s := NewServer(WithConnRate(1, time.Minute))
+	a := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	now := time.Now()
+	s.connRate.allow(a, now)
+	if ok, _ := s.connRate.allow(a, now); ok {
+		t.Fatal("second attempt should be refused")
+	}
+	// Raising the limit keeps the running ban.
+	if err := s.SetConnRate(5, 0); err != nil {
+		t.Fatal(err)
+	}
+	if max, ban := s.ConnRate(); max != 5 || ban != connRateWindow {
+		t.Fatalf("ConnRate = %d, %v", max, ban)
+	}
+	if ok, _ := s.connRate.allow(a, now.Add(time.Second)); ok {
+		t.Fatal("ban should survive a limit change")
+	}
+	// Disabling forgets it.
+	_ = s.SetConnRate(0, time.Minute)
+	if ok, _ := s.connRate.allow(a, now.Add(time.Second)); !ok {
+		t.Fatal("unlimited server refused a connection")
+	}
+	if err := s.SetConnRate(-1, 0); err == nil {
+		t.Fatal("want error for a negative limit")
+	}
+}
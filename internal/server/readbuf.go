@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"sync"
+
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+const defaultReadBufferSize = 4096
+
+// WithReadBufferSize sets the per-connection read buffer size in bytes.
+// Frames sent in a burst are then decoded from memory instead of with
+// several small socket reads each.
+func WithReadBufferSize(n int) ServerOption {
+	return func(s *Server) {
+		if n > 0 {
+			s.readBufSize = n
+		}
+	}
+}
+
+// readBufPool recycles connection read buffers of one size.
+type readBufPool struct {
+	size int
+	pool sync.Pool
+}
+
+func (p *readBufPool) get(r io.Reader) *bufio.Reader {
+	if br, ok := p.pool.Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, p.size)
+}
+
+func (p *readBufPool) put(br *bufio.Reader) {
+	br.Reset(nil) // drop the connection reference
+	p.pool.Put(br)
+}
+
+// readCounter records the size of every socket read it passes through.
+type readCounter struct{ r io.Reader }
+
+func (c readCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		metrics.ObserveClientRead(n)
+	}
+	return n, err
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+func TestReaderBuffersBursts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sent := make(chan can.Frame, 64)
+	srv := startLimitServer(t, ctx, Limits{MaxBurstFrames: 64}, sent)
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := cnl.Handshake(ctx, conn, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	before := metrics.Snap()
+	frames := make([]can.Frame, 32)
+	for i := range frames {
+		frames[i] = can.Frame{CANID: uint32(i), Len: 8}
+	}
+	if _, err := conn.Write((&cnl.Codec{}).Encode(frames)); err != nil {
+		t.Fatal(err)
+	}
+	for i := range frames {
+		select {
+		case <-sent:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("frame %d not delivered", i)
+		}
+	}
+	after := metrics.Snap()
+	// Unbuffered decoding needs three reads per frame.
+	if reads := after.ClientReads - before.ClientReads; reads == 0 || reads >= uint64(len(frames)) {
+		t.Fatalf("%d socket reads for %d frames", reads, len(frames))
+	}
+	if after.ClientReadB-before.ClientReadB != uint64(len(frames)*cnl.MaxFrameSize) {
+		t.Fatalf("read %d bytes", after.ClientReadB-before.ClientReadB)
+	}
+}
+
+func TestReadBufPoolReuse(t *testing.T) {
+	p := &readBufPool{size: 128}
+	br := p.get(nil)
+	if br.Size() != 128 {
+		t.Fatalf("size %d", br.Size())
+	}
+	p.put(br)
+	if got := p.get(nil); got.Size() != 128 {
+		t.Fatalf("pooled size %d", got.Size())
+	}
+}
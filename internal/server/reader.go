@@ -1,97 +1,331 @@
 package server
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"runtime"
 	"time"
 
+	"github.com/kstaniek/go-ampio-server/internal/access"
 	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
 	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/inhibit"
 	"github.com/kstaniek/go-ampio-server/internal/metrics"
 	"github.com/kstaniek/go-ampio-server/internal/serial"
+	"github.com/kstaniek/go-ampio-server/internal/slcan"
 	"github.com/kstaniek/go-ampio-server/internal/socketcan"
+	"github.com/kstaniek/go-ampio-server/internal/transport"
+	"github.com/kstaniek/go-ampio-server/internal/validate"
+	"github.com/kstaniek/go-ampio-server/internal/vbus"
 )
 
-func (s *Server) startReader(ctxDone <-chan struct{}, conn net.Conn, cl *hub.Client, logger *slog.Logger) {
+// readerState is per-connection protocol state owned by the reader goroutine.
+type readerState struct {
+	ackMode   bool                  // client negotiated TX acknowledgements
+	ackSeq    uint16                // frames submitted since acks were enabled (wrapping)
+	compress  bool                  // client negotiated compression (OpCompress)
+	pushed    pushedFilter          // OpFilter messages before the commit
+	rxFilter  func(*can.Frame) bool // receive filter applied with OpFilter
+	rxSpec    *rxFilterSpec         // source of rxFilter, for session migration
+	errFrames bool                  // subscribed to error frames (OpErrFrames)
+	flowStop  func()                // stops the flow-hint sampler (OpFlow); nil when off
+	codec     *cnl.Codec            // the connection's frame decoder, switched by OpFD and OpRTR; nil for other codecs
+	conn      net.Conn
+	ident     access.Identity
+	session   *session // bound client session, if the client opened one
+}
+
+func (s *Server) startReader(ctx context.Context, conn net.Conn, cl *hub.Client, ident access.Identity, logger *slog.Logger) {
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
-		defer func() { _ = conn.Close() }()
+		st := readerState{conn: conn, ident: ident}
+		defer func() {
+			_ = conn.Close()
+			s.releaseSession(ctx, &st, logger)
+			cl.Close() // let the writer exit and unregister promptly
+			st.stopFlow()
+		}()
+		lim := s.limits
+		buf := s.readBufs.get(readCounter{conn})
+		defer s.readBufs.put(buf)
+		// Every frame decode draws on a fresh MaxDecodeBytes budget, plus
+		// the packet header that may precede the frame.
+		// A CAN FD frame may take the difference to the largest FD frame
+		// on top.
+		budget := lim.MaxDecodeBytes
+		var dec transport.FrameDecoder = s.Codec
+		if c, ok := s.Codec.(*cnl.Codec); ok {
+			st.codec = new(cnl.Codec)
+			*st.codec = *c
+			dec = st.codec
+		}
+		if s.packets {
+			pd := cnl.NewPacketDecoder(cnl.SourceTCP)
+			if st.codec != nil {
+				*pd.Codec() = *st.codec
+				pd.Codec().RTR = true // as stock cannelloni
+			}
+			st.codec = pd.Codec()
+			dec = pd
+			budget += cnl.UDPHeaderSize
+		}
+		frameBudget := func() int {
+			if st.codec != nil && st.codec.FD {
+				return budget + cnl.MaxFDFrameSize - cnl.MaxFrameSize
+			}
+			return budget
+		}
+		br := &budgetReader{r: buf}
+		onFrame := func(fr can.Frame) {
+			s.handleClientFrame(ctx, &st, cl, fr, logger)
+			br.left = frameBudget()
+		}
 		for {
 			_ = conn.SetReadDeadline(time.Now().Add(s.readDeadline))
+			br.left = frameBudget()
 			var count int
-			if mfd, ok := s.Codec.(interface {
+			var err error
+			if mfd, ok := dec.(interface {
 				DecodeN(io.Reader, int, func(can.Frame)) (int, error)
 			}); ok {
-				var err error
-				count, err = mfd.DecodeN(conn, 16, func(fr can.Frame) {
-					if s.frameFilter != nil && !s.frameFilter(&fr) {
-						return
-					}
-					metrics.IncTCPRx()
-					if err := s.Send(fr); err != nil {
-						if errors.Is(err, serial.ErrTxOverflow) || errors.Is(err, socketcan.ErrTxOverflow) {
-							s.totalBackendOverflow.Add(1)
-							logger.Debug("backend_overflow_drop", "can_id", fmt.Sprintf("0x%X", fr.CANID), "len", fr.Len)
-						} else {
-							s.totalBackendErrors.Add(1)
-							logger.Error("backend_tx_error", "error", err, "can_id", fmt.Sprintf("0x%X", fr.CANID))
-						}
-					}
-				})
-				if err != nil {
-					if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
-						return
-					}
-					if ne, ok := err.(net.Error); ok && ne.Timeout() {
-						continue
-					}
-					wrap := fmt.Errorf("%w: %v", ErrConnRead, err)
-					metrics.IncError(mapErrToMetric(wrap))
-					s.setError(wrap)
+				count, err = mfd.DecodeN(br, lim.MaxBurstFrames, onFrame)
+			} else {
+				var fr can.Frame
+				if fr, err = dec.Decode(br); err == nil {
+					onFrame(fr)
+					count = 1
+				}
+			}
+			if err != nil {
+				if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 					return
 				}
-			} else {
-				fr, err := s.Codec.Decode(conn)
-				if err != nil {
-					if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
-						return
-					}
-					if ne, ok := err.(net.Error); ok && ne.Timeout() {
-						continue
-					}
-					wrap := fmt.Errorf("%w: %v", ErrConnRead, err)
-					metrics.IncError(mapErrToMetric(wrap))
+				if errors.Is(err, ErrLimit) {
+					metrics.IncLimitHit(metrics.LimitDecodeBytes)
+					wrap := limitErr(metrics.LimitDecodeBytes, lim.MaxDecodeBytes)
 					s.setError(wrap)
+					logger.Warn("client_limit_exceeded", "limit", metrics.LimitDecodeBytes, "max", lim.MaxDecodeBytes)
 					return
 				}
-				if s.frameFilter == nil || s.frameFilter(&fr) {
-					metrics.IncTCPRx()
-					if err := s.Send(fr); err != nil {
-						if errors.Is(err, serial.ErrTxOverflow) || errors.Is(err, socketcan.ErrTxOverflow) {
-							s.totalBackendOverflow.Add(1)
-							logger.Debug("backend_overflow_drop", "can_id", fmt.Sprintf("0x%X", fr.CANID), "len", fr.Len)
-						} else {
-							wrap := fmt.Errorf("%w: %v", ErrBackendTx, err)
-							s.setError(wrap)
-							s.totalBackendErrors.Add(1)
-							logger.Error("backend_tx_error", "error", wrap, "can_id", fmt.Sprintf("0x%X", fr.CANID))
-						}
-					}
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					continue
+				}
+				if errors.Is(err, cnl.ErrFDNotNegotiated) {
+					logger.Warn("client_fd_not_negotiated", "error", err)
 				}
-				count = 1
+				wrap := fmt.Errorf("%w: %v", ErrConnRead, err)
+				metrics.IncError(mapErrToMetric(wrap))
+				s.setError(wrap)
+				return
+			}
+			if count > 0 {
+				metrics.ObserveReadBurst(count)
 			}
-			if count == 0 {
+			switch count {
+			case 0:
 				time.Sleep(100 * time.Microsecond)
+			case lim.MaxBurstFrames:
+				// A peer with more queued frames than one burst must not
+				// monopolise this CPU or the backend queue; let other
+				// connections run first.
+				metrics.IncLimitHit(metrics.LimitBurstFrames)
+				yieldBurst(lim.BurstYield)
 			}
 			select {
-			case <-ctxDone:
+			case <-ctx.Done():
 				return
 			default:
 			}
 		}
 	}()
 }
+
+// starvedAfter is how much longer than requested a yield may take before the
+// reader counts as starved (other goroutines kept the CPU).
+const starvedAfter = 10 * time.Millisecond
+
+// yieldBurst pauses a reader after a full burst: for d when set, otherwise
+// just until the scheduler has run other goroutines.
+func yieldBurst(d time.Duration) {
+	start := time.Now()
+	if d > 0 {
+		time.Sleep(d)
+	} else {
+		runtime.Gosched()
+	}
+	waited := time.Since(start)
+	metrics.ObserveReaderYield(waited)
+	if waited > d+starvedAfter {
+		metrics.IncReaderStarved()
+	}
+}
+
+// handleClientFrame processes one frame received from a client: control
+// messages are handled locally, bus frames are passed to the backend.
+func (s *Server) handleClientFrame(ctx context.Context, st *readerState, cl *hub.Client, fr can.Frame, logger *slog.Logger) {
+	if cnl.IsControl(&fr) {
+		s.handleControl(ctx, st, cl, fr, logger)
+		return
+	}
+	if s.frameFilter != nil && !s.frameFilter(&fr) {
+		logger.Debug("client_tx_filtered", "can_id", fmt.Sprintf("0x%X", fr.CANID))
+		s.ackTx(ctx, st, cl, cnl.AckDenied, fr.CANID)
+		return
+	}
+	metrics.IncTCPRx()
+	s.totalClientFrames.Add(1)
+	err := st.ident.Check(access.Send)
+	switch {
+	case err != nil:
+	case st.ackMode && s.SendWait != nil:
+		err = s.SendWait(ctx, fr)
+	default:
+		err = s.Send(fr)
+	}
+	status := byte(cnl.AckOK)
+	var denied *access.DeniedError
+	if err != nil {
+		switch {
+		case errors.As(err, &denied):
+			status = cnl.AckDenied
+			logger.Debug("client_tx_forbidden", "role", denied.ID.Role.String(), "can_id", fmt.Sprintf("0x%X", fr.CANID))
+		case isBackendOverflow(err):
+			status = cnl.AckOverflow
+			s.totalBackendOverflow.Add(1)
+			logger.Debug("backend_overflow_drop", "can_id", fmt.Sprintf("0x%X", fr.CANID), "len", fr.Len)
+		case errors.Is(err, validate.ErrInvalid):
+			status = cnl.AckDenied
+			s.totalBackendDenied.Add(1)
+			logger.Debug("backend_tx_invalid", "can_id", fmt.Sprintf("0x%X", fr.CANID), "len", fr.Len, "error", err)
+		case errors.Is(err, transport.ErrUnsupported):
+			status = cnl.AckDenied
+			s.totalBackendDenied.Add(1)
+			logger.Debug("backend_tx_unsupported", "can_id", fmt.Sprintf("0x%X", fr.CANID), "error", err)
+		case errors.Is(err, filter.ErrDenied):
+			status = cnl.AckDenied
+			s.totalBackendDenied.Add(1)
+			logger.Debug("backend_tx_denied", "can_id", fmt.Sprintf("0x%X", fr.CANID))
+		case errors.Is(err, vbus.ErrRateLimited):
+			status = cnl.AckOverflow // counted by the virtual bus
+			logger.Debug("vbus_tx_rate_limited", "can_id", fmt.Sprintf("0x%X", fr.CANID))
+		case errors.Is(err, inhibit.ErrInhibited):
+			status = cnl.AckInhibited
+			s.totalBackendInhibited.Add(1)
+			logger.Debug("backend_tx_inhibited", "can_id", fmt.Sprintf("0x%X", fr.CANID))
+		default:
+			status = cnl.AckError
+			wrap := fmt.Errorf("%w: %v", ErrBackendTx, err)
+			s.setError(wrap)
+			s.totalBackendErrors.Add(1)
+			logger.Error("backend_tx_error", "error", wrap, "can_id", fmt.Sprintf("0x%X", fr.CANID))
+		}
+	}
+	s.ackTx(ctx, st, cl, status, fr.CANID)
+}
+
+// ackTx reports the outcome of a client frame when the client negotiated
+// TX acknowledgements.
+func (s *Server) ackTx(ctx context.Context, st *readerState, cl *hub.Client, status byte, id uint32) {
+	if !st.ackMode {
+		return
+	}
+	st.ackSeq++
+	s.sendControl(ctx, cl, cnl.TxAck(st.ackSeq, status, id))
+	metrics.IncTxAck(status)
+}
+
+func (s *Server) handleControl(ctx context.Context, st *readerState, cl *hub.Client, fr can.Frame, logger *slog.Logger) {
+	switch op := fr.Data[0]; op {
+	case cnl.OpTxAckEnable:
+		if !st.ackMode {
+			st.ackMode = true
+			st.ackSeq = 0
+			logger.Info("client_tx_ack_enabled")
+			s.publishSession(st)
+		}
+		s.sendControl(ctx, cl, cnl.ControlFrame(cnl.OpTxAckEnable))
+	case cnl.OpSession:
+		_, token, _ := cnl.ParseSession(&fr)
+		s.handleSession(ctx, st, cl, token, logger)
+	case cnl.OpPing:
+		if _, rtt, ok := cnl.ParsePing(&fr); ok {
+			s.recordRTT(cl, rtt)
+		}
+		s.sendControl(ctx, cl, cnl.Pong(fr))
+	case cnl.OpCompress:
+		code, _ := cnl.ParseCompress(&fr)
+		s.handleCompress(ctx, st, cl, code, logger)
+	case cnl.OpFilter:
+		s.handleFilter(ctx, st, cl, fr, logger)
+	case cnl.OpErrFrames:
+		s.handleErrFrames(ctx, st, cl, fr, logger)
+	case cnl.OpFlow:
+		s.handleFlow(ctx, st, cl, fr, logger)
+	case cnl.OpFD:
+		s.handleFD(ctx, st, cl, fr, logger)
+	case cnl.OpIdent:
+		s.handleIdent(ctx, cl, fr)
+	case cnl.OpRTR:
+		s.handleRTR(ctx, st, cl, fr, logger)
+	case cnl.OpHistory:
+		s.replayHistory(ctx, cl, time.Duration(binary.BigEndian.Uint16(fr.Data[1:3]))*time.Second, logger)
+	default:
+		logger.Debug("client_control_unknown", "op", op)
+	}
+}
+
+// maxReplay is the most frames one history replay sends (the marker count is uint16).
+const maxReplay = 0xFFFF
+
+// replayHistory sends the captured frames of the last window to the client,
+// framed by OpHistoryBegin/OpHistoryEnd. Replayed frames share the client
+// queue with live traffic, so live frames may interleave with the replay.
+func (s *Server) replayHistory(ctx context.Context, cl *hub.Client, window time.Duration, logger *slog.Logger) {
+	if s.History == nil {
+		s.sendControl(ctx, cl, cnl.HistoryMarker(cnl.OpHistoryBegin, cnl.HistoryUnavailable, 0))
+		s.sendControl(ctx, cl, cnl.HistoryMarker(cnl.OpHistoryEnd, cnl.HistoryUnavailable, 0))
+		return
+	}
+	frames := s.History(window)
+	wanted := frames[:0:0]
+	for i := range frames {
+		if cl.Wants(&frames[i]) {
+			wanted = append(wanted, frames[i])
+		}
+	}
+	frames = wanted
+	if len(frames) > maxReplay {
+		frames = frames[len(frames)-maxReplay:]
+	}
+	n := uint16(len(frames))
+	logger.Info("client_history_replay", "window", window, "frames", n)
+	s.sendControl(ctx, cl, cnl.HistoryMarker(cnl.OpHistoryBegin, cnl.HistoryOK, n))
+	for _, fr := range frames {
+		s.sendControl(ctx, cl, fr)
+	}
+	s.sendControl(ctx, cl, cnl.HistoryMarker(cnl.OpHistoryEnd, cnl.HistoryOK, n))
+}
+
+// sendControl queues a control message to the client ahead of the writer's
+// next flush. Unlike hub broadcasts it is never dropped; it blocks until
+// there is room or the client goes away.
+func (s *Server) sendControl(ctx context.Context, cl *hub.Client, fr can.Frame) {
+	select {
+	case cl.Out <- fr:
+	case <-cl.Closed:
+	case <-ctx.Done():
+	}
+}
+
+// isBackendOverflow reports whether err means the backend TX queue was full.
+func isBackendOverflow(err error) bool {
+	return errors.Is(err, serial.ErrTxOverflow) || errors.Is(err, slcan.ErrTxOverflow) || errors.Is(err, socketcan.ErrTxOverflow) || errors.Is(err, transport.ErrTxOverflow)
+}
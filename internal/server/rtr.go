@@ -0,0 +1,29 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+// handleRTR switches a client's stream to or from remote requests without
+// payload (cnl.Codec.RTR) and answers with the state in force. The reader
+// decodes the new form from the request on; the writer encodes it after
+// the answer. Packet-framed streams always use it, as stock cannelloni
+// does, and streams of other codecs never. Like FD, it is a property of the
+// stream and not kept by sessions.
+func (s *Server) handleRTR(ctx context.Context, st *readerState, cl *hub.Client, fr can.Frame, logger *slog.Logger) {
+	code, _ := cnl.ParseRTR(&fr)
+	if on := code == cnl.RTROn; st.codec != nil && !s.packets && on != st.codec.RTR {
+		st.codec.RTR = on
+		logger.Info("client_rtr", "enabled", on)
+	}
+	reply := byte(cnl.RTROff)
+	if st.codec != nil && st.codec.RTR {
+		reply = cnl.RTROn
+	}
+	s.sendControl(ctx, cl, cnl.RTR(reply))
+}
@@ -0,0 +1,77 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+// TestRTRNegotiated checks both forms of remote requests on one stream:
+// with their payload bytes until OpRTR, without them after it.
+func TestRTRNegotiated(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h := hub.New()
+	sent := make(chan can.Frame, 4)
+	srv := startFDServer(t, ctx, h, &cnl.Codec{}, sent)
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := cnl.Handshake(ctx, conn, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for len(srv.Clients()) == 0 && ctx.Err() == nil {
+		time.Sleep(5 * time.Millisecond)
+	}
+	r := bufio.NewReader(conn)
+	rtr := can.Frame{CANID: 0x123 | can.CAN_RTR_FLAG, Len: 4}
+	data := can.Frame{CANID: 0x456, Len: 1, Data: [64]byte{7}}
+	for _, on := range []bool{false, true} {
+		codec := &cnl.Codec{RTR: on}
+		if on {
+			if _, err := conn.Write(codec.Encode([]can.Frame{cnl.RTR(cnl.RTROn)})); err != nil {
+				t.Fatal(err)
+			}
+			for {
+				fr, err := (&cnl.Codec{}).Decode(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if code, ok := cnl.ParseRTR(&fr); ok {
+					if code != cnl.RTROn {
+						t.Fatalf("answer %d", code)
+					}
+					break
+				}
+			}
+		}
+		if _, err := conn.Write(codec.Encode([]can.Frame{rtr, data})); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []can.Frame{rtr, data} {
+			if got := <-sent; got != want {
+				t.Fatalf("RTR=%v: backend got %+v, want %+v", on, got, want)
+			}
+		}
+		h.Broadcast(rtr)
+		h.Broadcast(data)
+		for _, want := range []can.Frame{rtr, data} {
+			got, err := codec.Decode(r)
+			if err != nil {
+				t.Fatalf("RTR=%v: %v", on, err)
+			}
+			if got != want {
+				t.Fatalf("RTR=%v: client got %+v, want %+v", on, got, want)
+			}
+		}
+	}
+}
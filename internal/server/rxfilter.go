@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+// pushedFilter collects a receive filter a client is pushing (OpFilter).
+type pushedFilter struct {
+	begun bool
+	flags byte
+	text  []byte
+}
+
+// rxFilterSpec is a pushed receive filter in source form, with the state
+// of its change-only stage, so it can be handed to a standby gateway.
+type rxFilterSpec struct {
+	ids        string
+	changeOnly bool
+	changes    *filter.Changes // nil unless changeOnly
+}
+
+// compile returns the filter function of r: the ID list, then the
+// change-only stage for the frames the list passes. It returns nil for a
+// filter that passes everything.
+func (r *rxFilterSpec) compile() (func(*can.Frame) bool, error) {
+	if len(r.ids) > cnl.MaxFilterText {
+		return nil, fmt.Errorf("list longer than %d bytes", cnl.MaxFilterText)
+	}
+	ids, err := filter.New(r.ids, "")
+	if err != nil {
+		return nil, err
+	}
+	if !r.changeOnly {
+		if ids == nil {
+			return nil, nil
+		}
+		return ids.Allow, nil
+	}
+	changes := r.changes
+	return func(fr *can.Frame) bool { return ids.Allow(fr) && changes.Allow(fr) }, nil
+}
+
+// build compiles the collected filter. The spec is nil for a filter that
+// passes everything.
+func (p *pushedFilter) build() (*rxFilterSpec, func(*can.Frame) bool, error) {
+	if !p.begun {
+		return nil, nil, fmt.Errorf("commit without begin")
+	}
+	spec := &rxFilterSpec{ids: string(p.text), changeOnly: p.flags&cnl.FilterChangeOnly != 0}
+	if spec.changeOnly {
+		spec.changes = new(filter.Changes)
+	}
+	f, err := spec.compile()
+	if err != nil || f == nil {
+		return nil, nil, err
+	}
+	return spec, f, nil
+}
+
+// handleFilter collects the OpFilter messages of a client and applies the
+// filter on commit. The hub then skips the frames it rejects, so they
+// never take queue space or bandwidth.
+func (s *Server) handleFilter(ctx context.Context, st *readerState, cl *hub.Client, fr can.Frame, logger *slog.Logger) {
+	code, payload, _ := cnl.ParseFilter(&fr)
+	p := &st.pushed
+	switch code {
+	case cnl.FilterBegin:
+		*p = pushedFilter{begun: true, flags: payload[0]}
+	case cnl.FilterText:
+		if len(p.text) <= cnl.MaxFilterText { // past it only the length matters
+			p.text = append(p.text, bytes.TrimRight(payload, "\x00")...)
+		}
+	case cnl.FilterCommit:
+		spec, f, err := p.build()
+		text, flags := string(p.text), p.flags
+		*p = pushedFilter{}
+		if err != nil {
+			logger.Warn("client_filter_invalid", "error", err)
+			s.sendControl(ctx, cl, cnl.ControlFrame(cnl.OpFilter, cnl.FilterInvalid))
+			return
+		}
+		st.rxFilter, st.rxSpec = f, spec
+		cl.SetFilter(f)
+		s.publishSession(st)
+		logger.Info("client_filter_set", "ids", text, "change_only", flags&cnl.FilterChangeOnly != 0)
+		s.sendControl(ctx, cl, cnl.ControlFrame(cnl.OpFilter, cnl.FilterOK))
+	default:
+		logger.Debug("client_filter_code_unknown", "code", code)
+	}
+}
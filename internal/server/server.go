@@ -2,15 +2,20 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/kstaniek/go-ampio-server/internal/access"
 	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/events"
 	"github.com/kstaniek/go-ampio-server/internal/hub"
 	"github.com/kstaniek/go-ampio-server/internal/logging"
 	"github.com/kstaniek/go-ampio-server/internal/metrics"
@@ -20,6 +25,13 @@ import (
 // SendFunc transmits a CAN frame to the selected backend device.
 type SendFunc func(can.Frame) error
 
+// SendWaitFunc transmits a CAN frame and blocks until the backend has
+// written it (used for connections with TX acknowledgements enabled).
+type SendWaitFunc func(context.Context, can.Frame) error
+
+// HistoryFunc returns the captured backend frames of the last d, oldest first.
+type HistoryFunc func(d time.Duration) []can.Frame
+
 // Server owns the TCP listener and coordinates client lifecycle.
 type Server struct {
 	mu    sync.RWMutex
@@ -27,31 +39,58 @@ type Server struct {
 	Hub   *hub.Hub
 	Codec transport.FrameDecoder // *cnl.Codec implements
 	Send  SendFunc
+	// SendWait is optional; without it acknowledged frames use Send and are
+	// acknowledged once accepted by the backend queue.
+	SendWait SendWaitFunc
+	// History, when set, returns the backend frames captured within the
+	// given window, oldest first (served to clients requesting a replay).
+	History HistoryFunc
 
 	frameFilter func(*can.Frame) bool
 
-	flushInterval        time.Duration
-	batchSize            int
-	readDeadline         time.Duration
-	handshakeTimeout     time.Duration
-	maxClients           int
-	readyOnce            sync.Once
-	readyCh              chan struct{}
-	lastErrMu            sync.Mutex
-	lastErr              error
-	errCh                chan error
-	listener             net.Listener
-	clientsMu            sync.RWMutex
-	clients              map[*hub.Client]net.Conn
-	wg                   sync.WaitGroup
-	logger               *slog.Logger
-	nextConnID           uint64
-	totalAccepted        atomic.Uint64
-	totalHandshakeFail   atomic.Uint64
-	totalConnected       atomic.Uint64
-	totalDisconnected    atomic.Uint64
-	totalBackendOverflow atomic.Uint64
-	totalBackendErrors   atomic.Uint64
+	flushInterval         atomic.Int64 // time.Duration; see SetFlushInterval
+	batchSize             atomic.Int64
+	readDeadline          time.Duration
+	handshakeTimeout      time.Duration
+	limits                Limits
+	readBufSize           int
+	readBufs              *readBufPool
+	sessions              *sessionStore
+	maxClients            int
+	connRate              *connLimiter
+	identify              func(net.Addr) access.Identity
+	protoHandlers         map[Protocol]func(net.Conn) // nil: cannelloni only, no sniffing
+	tlsConfig             *tls.Config
+	compressRatio         float64                      // 0: clients may not negotiate compression
+	errFrames             bool                         // clients may subscribe to error frames
+	fd                    bool                         // clients may negotiate CAN FD frames
+	ident                 cnl.Ident                    // OpIdent answer
+	txQueue               func() (depth, capacity int) // backend TX queue for flow hints; nil: unavailable
+	packets               bool                         // cannelloni DATA packet framing on the stream
+	encCache              encodeCache                  // frame encodings shared by the client writers
+	readyCh               chan struct{}                // closed while serving; replaced by Shutdown
+	ready                 bool
+	lastErrMu             sync.Mutex
+	lastErr               error
+	errHistory            *events.Ring
+	errSubs               errorSubs
+	listeners             map[net.Listener]struct{}
+	inherited             net.Listener // served by the next Serve instead of listening
+	clientsMu             sync.RWMutex
+	clients               map[*hub.Client]*clientConn
+	wg                    sync.WaitGroup
+	logger                *slog.Logger
+	nextConnID            uint64
+	totalAccepted         atomic.Uint64
+	totalHandshakeFail    atomic.Uint64
+	totalRateLimited      atomic.Uint64
+	totalConnected        atomic.Uint64
+	totalDisconnected     atomic.Uint64
+	totalClientFrames     atomic.Uint64
+	totalBackendOverflow  atomic.Uint64
+	totalBackendDenied    atomic.Uint64
+	totalBackendInhibited atomic.Uint64
+	totalBackendErrors    atomic.Uint64
 }
 
 const (
@@ -59,24 +98,32 @@ const (
 	defaultBatchSize        = 64
 	defaultReadDeadline     = 60 * time.Second
 	defaultHandshakeTimeout = 3 * time.Second
+	defaultErrorHistory     = 32
 )
 
 type ServerOption func(*Server)
 
 func NewServer(opts ...ServerOption) *Server {
 	s := &Server{
-		flushInterval:    defaultFlushInterval,
-		batchSize:        defaultBatchSize,
 		readDeadline:     defaultReadDeadline,
 		handshakeTimeout: defaultHandshakeTimeout,
+		limits:           Limits{}.withDefaults(),
+		readBufSize:      defaultReadBufferSize,
 		readyCh:          make(chan struct{}),
-		errCh:            make(chan error, 1),
-		clients:          make(map[*hub.Client]net.Conn),
+		clients:          make(map[*hub.Client]*clientConn),
+		listeners:        make(map[net.Listener]struct{}),
+		connRate:         newConnLimiter(),
 		logger:           logging.L(),
 	}
+	s.flushInterval.Store(int64(defaultFlushInterval))
+	s.batchSize.Store(defaultBatchSize)
 	for _, o := range opts {
 		o(s)
 	}
+	if s.errHistory == nil {
+		s.errHistory = events.NewRing(defaultErrorHistory)
+	}
+	s.readBufs = &readBufPool{size: s.readBufSize}
 	if s.addr == "" {
 		s.addr = ":0"
 	}
@@ -87,6 +134,22 @@ func WithListenAddr(a string) ServerOption            { return func(s *Server) {
 func WithHub(hb *hub.Hub) ServerOption                { return func(s *Server) { s.Hub = hb } }
 func WithCodec(c transport.FrameDecoder) ServerOption { return func(s *Server) { s.Codec = c } }
 func WithSend(send SendFunc) ServerOption             { return func(s *Server) { s.Send = send } }
+func WithSendWait(send SendWaitFunc) ServerOption {
+	return func(s *Server) { s.SendWait = send }
+}
+
+// WithPacketFraming frames the client streams as cannelloni DATA packets
+// (version, op, sequence number, frame count), as stock cannelloni builds
+// do over TCP, instead of bare frames. Gaps in the client's sequence
+// numbers are counted as lost packets.
+func WithPacketFraming(on bool) ServerOption {
+	return func(s *Server) { s.packets = on }
+}
+
+func WithHistory(fn HistoryFunc) ServerOption {
+	return func(s *Server) { s.History = fn }
+}
+
 func WithFrameFilter(fn func(*can.Frame) bool) ServerOption {
 	return func(s *Server) { s.frameFilter = fn }
 }
@@ -94,7 +157,7 @@ func WithFrameFilter(fn func(*can.Frame) bool) ServerOption {
 func WithFlushInterval(d time.Duration) ServerOption {
 	return func(s *Server) {
 		if d > 0 {
-			s.flushInterval = d
+			s.flushInterval.Store(int64(d))
 		}
 	}
 }
@@ -102,7 +165,7 @@ func WithFlushInterval(d time.Duration) ServerOption {
 func WithBatchSize(n int) ServerOption {
 	return func(s *Server) {
 		if n > 0 {
-			s.batchSize = n
+			s.batchSize.Store(int64(n))
 		}
 	}
 }
@@ -131,6 +194,15 @@ func WithMaxClients(n int) ServerOption {
 	}
 }
 
+// WithErrorHistory sets how many recent errors RecentErrors retains.
+func WithErrorHistory(n int) ServerOption {
+	return func(s *Server) {
+		if n > 0 {
+			s.errHistory = events.NewRing(n)
+		}
+	}
+}
+
 func WithLogger(l *slog.Logger) ServerOption {
 	return func(s *Server) {
 		if l != nil {
@@ -142,31 +214,59 @@ func WithLogger(l *slog.Logger) ServerOption {
 func (s *Server) Addr() string           { s.mu.RLock(); defer s.mu.RUnlock(); return s.addr }
 func (s *Server) setAddr(a string)       { s.mu.Lock(); s.addr = a; s.mu.Unlock() }
 func (s *Server) SetListenAddr(a string) { s.setAddr(a) }
-func (s *Server) Ready() <-chan struct{} { return s.readyCh }
-func (s *Server) Errors() <-chan error   { return s.errCh }
+
+// Ready is closed once the server accepts connections on a listener. After
+// Shutdown it returns a new channel for the next Serve.
+func (s *Server) Ready() <-chan struct{} { s.mu.RLock(); defer s.mu.RUnlock(); return s.readyCh }
+
+// Addrs lists the addresses of the listeners being served.
+func (s *Server) Addrs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]string, 0, len(s.listeners))
+	for ln := range s.listeners {
+		out = append(out, ln.Addr().String())
+	}
+	sort.Strings(out)
+	return out
+}
 
 func (s *Server) setError(err error) {
 	if err == nil {
 		return
 	}
+	now := time.Now()
 	s.lastErrMu.Lock()
 	s.lastErr = err
 	s.lastErrMu.Unlock()
-	select {
-	case s.errCh <- err:
-	default:
-	}
+	s.errHistory.Add(events.Event{Time: now, Level: slog.LevelError.String(), Msg: err.Error()})
+	s.errSubs.publish(now, err)
 }
 func (s *Server) LastError() error { s.lastErrMu.Lock(); defer s.lastErrMu.Unlock(); return s.lastErr }
 
-// Serve accepts TCP clients and spawns reader/writer goroutines.
+// RecentErrors returns the most recent server errors, oldest first.
+func (s *Server) RecentErrors() []events.Event { return s.errHistory.Snapshot() }
+
+// WithListener makes Serve accept clients on ln, e.g. a socket inherited
+// from systemd, instead of listening on the configured address. The first
+// Serve consumes ln; a restarted server listens on ln's address.
+func WithListener(ln net.Listener) ServerOption {
+	return func(s *Server) { s.inherited = ln }
+}
+
+// Serve listens on the configured address and accepts TCP clients until ctx
+// is cancelled or Shutdown is called. A stopped server can Serve again.
 func (s *Server) Serve(ctx context.Context) error {
 	s.mu.Lock()
-	addr := s.addr
+	addr, ln := s.addr, s.inherited
+	s.inherited = nil
 	if addr == "" {
 		addr = ":0"
 	}
 	s.mu.Unlock()
+	if ln != nil {
+		return s.ServeListener(ctx, ln)
+	}
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		wrap := fmt.Errorf("%w: %v", ErrListen, err)
@@ -174,17 +274,32 @@ func (s *Server) Serve(ctx context.Context) error {
 		s.setError(wrap)
 		return wrap
 	}
-	s.setAddr(ln.Addr().String())
-	s.listener = ln
-	if s.readyCh != nil {
-		s.readyOnce.Do(func() { close(s.readyCh) })
+	return s.ServeListener(ctx, ln)
+}
+
+// ServeListener accepts TCP clients on ln (e.g. a socket passed in by the
+// service manager) until ctx is cancelled or Shutdown is called, and closes
+// ln on return. Several listeners may be served concurrently; they share
+// the hub, client limits and counters.
+func (s *Server) ServeListener(ctx context.Context, ln net.Listener) error {
+	s.mu.Lock()
+	if len(s.listeners) == 0 {
+		s.addr = ln.Addr().String()
+	}
+	s.listeners[ln] = struct{}{}
+	if !s.ready {
+		s.ready = true
+		close(s.readyCh)
 	}
-	s.logger.Info("tcp_listen", "addr", s.Addr())
+	s.mu.Unlock()
+	defer s.removeListener(ln)
+	s.logger.Info("tcp_listen", "addr", ln.Addr().String())
 	s.logger.Info("ready")
-	go func() { <-ctx.Done(); _ = ln.Close() }()
+	stop := context.AfterFunc(ctx, func() { _ = ln.Close() })
+	defer stop()
 	for {
 		if err := s.acceptOnce(ctx, ln); err != nil {
-			if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, net.ErrClosed) || ctx.Err() != nil {
 				return nil
 			}
 			return err
@@ -192,6 +307,24 @@ func (s *Server) Serve(ctx context.Context) error {
 	}
 }
 
+// removeListener forgets ln once its accept loop is done; the server is no
+// longer ready when it was the last one.
+func (s *Server) removeListener(ln net.Listener) {
+	_ = ln.Close()
+	s.mu.Lock()
+	delete(s.listeners, ln)
+	s.resetReadyLocked()
+	s.mu.Unlock()
+}
+
+// resetReadyLocked arms a new Ready channel when no listener is served.
+func (s *Server) resetReadyLocked() {
+	if s.ready && len(s.listeners) == 0 {
+		s.ready = false
+		s.readyCh = make(chan struct{})
+	}
+}
+
 // acceptOnce accepts a single connection, performs handshake, registers client and spawns IO goroutines.
 // Returns nil on success; a wrapped error on fatal listener errors.
 func (s *Server) acceptOnce(ctx context.Context, ln net.Listener) error {
@@ -202,6 +335,9 @@ func (s *Server) acceptOnce(ctx context.Context, ln net.Listener) error {
 			return context.Canceled
 		default:
 		}
+		if errors.Is(err, net.ErrClosed) { // Shutdown
+			return err
+		}
 		if _, ok := err.(net.Error); ok { // transient
 			time.Sleep(200 * time.Millisecond)
 			return nil
@@ -214,6 +350,35 @@ func (s *Server) acceptOnce(ctx context.Context, ln net.Listener) error {
 	s.totalAccepted.Add(1)
 	connID := atomic.AddUint64(&s.nextConnID, 1)
 	connLogger := s.logger.With("conn_id", connID, "remote", conn.RemoteAddr().String())
+	// Rate-limited peers are dropped before the handshake: a client stuck
+	// in a reconnect loop costs an accept and a close, and one log line
+	// per ban.
+	if ok, banned := s.connRate.allow(conn.RemoteAddr(), time.Now()); !ok {
+		s.totalRateLimited.Add(1)
+		metrics.IncConnRateLimited(banned)
+		if banned {
+			max, ban := s.connRate.limits()
+			connLogger.Warn("client_rate_banned", "max_per_minute", max, "ban", ban)
+		}
+		_ = conn.Close()
+		return nil
+	}
+	var certName string
+	if s.protoHandlers != nil || s.tlsConfig != nil {
+		var ok bool
+		if conn, certName, ok = s.negotiate(ctx, conn, connLogger); !ok {
+			return nil
+		}
+	}
+	ident := s.identity(conn.RemoteAddr())
+	if certName != "" {
+		ident.Name = certName
+	}
+	if err := ident.Check(access.View); err != nil {
+		connLogger.Warn("client_forbidden", "identity", ident.Name, "role", ident.Role.String())
+		_ = conn.Close()
+		return nil
+	}
 	if tcp, ok := conn.(*net.TCPConn); ok {
 		_ = tcp.SetNoDelay(true)
 		_ = tcp.SetKeepAlive(true)
@@ -228,7 +393,9 @@ func (s *Server) acceptOnce(ctx context.Context, ln net.Listener) error {
 		_ = conn.Close()
 		return nil
 	}
-	if s.maxClients > 0 && s.Hub != nil && s.Hub.Count() >= s.maxClients {
+	// Count TCP connections only; in-process hub subscribers (bridges) do
+	// not take client slots.
+	if s.maxClients > 0 && s.clientCount() >= s.maxClients {
 		metrics.IncHubReject()
 		connLogger.Warn("client_reject_max", "max_clients", s.maxClients)
 		_ = conn.Close()
@@ -236,41 +403,48 @@ func (s *Server) acceptOnce(ctx context.Context, ln net.Listener) error {
 	}
 	client := s.newClient()
 	s.clientsMu.Lock()
-	s.clients[client] = conn
+	s.clients[client] = &clientConn{conn: conn, id: connID, remote: conn.RemoteAddr().String(), identity: ident.Name, role: ident.Role, since: time.Now()}
 	s.clientsMu.Unlock()
 	s.totalConnected.Add(1)
-	connLogger.Info("client_connected")
+	connLogger.Info("client_connected", "identity", ident.Name, "role", ident.Role.String())
 	s.startWriter(ctx.Done(), conn, client, connLogger)
-	s.startReader(ctx.Done(), conn, client, connLogger)
+	s.startReader(ctx, conn, client, ident, connLogger)
 	return nil
 }
 
 // newClient allocates a hub client with buffer size derived from hub config.
 func (s *Server) newClient() *hub.Client {
-	bufSize := 512
-	if s.Hub != nil && s.Hub.OutBufSize > 0 {
-		bufSize = s.Hub.OutBufSize
+	bufSize := hub.DefaultOutBufSize
+	if s.Hub != nil {
+		bufSize = s.Hub.OutBufSize()
 	}
 	cl := &hub.Client{Out: make(chan can.Frame, bufSize), Closed: make(chan struct{})}
 	if s.Hub != nil {
 		s.Hub.Add(cl)
-		metrics.SetHubClients(s.Hub.Count())
 	}
 	return cl
 }
 
-// Shutdown gracefully closes all resources.
+// clientCount returns the number of connected TCP clients.
+func (s *Server) clientCount() int {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+	return len(s.clients)
+}
+
+// Shutdown gracefully closes all listeners and clients. Serve and
+// ServeListener return nil, and the server can be started again with them.
 func (s *Server) Shutdown(ctx context.Context) error {
 	s.mu.Lock()
-	ln := s.listener
-	s.listener = nil
-	s.mu.Unlock()
-	if ln != nil {
+	for ln := range s.listeners {
 		_ = ln.Close()
+		delete(s.listeners, ln)
 	}
+	s.resetReadyLocked()
+	s.mu.Unlock()
 	s.clientsMu.Lock()
-	for cl, conn := range s.clients {
-		_ = conn.Close()
+	for cl, cc := range s.clients {
+		_ = cc.conn.Close()
 		if s.Hub != nil {
 			s.Hub.Remove(cl)
 		}
@@ -283,7 +457,7 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	case <-ctx.Done():
 		return fmt.Errorf("%w: shutdown timeout: %v", ErrContext, ctx.Err())
 	case <-done:
-		s.logger.Info("shutdown_summary", "accepted", s.totalAccepted.Load(), "handshake_fail", s.totalHandshakeFail.Load(), "connected", s.totalConnected.Load(), "disconnected", s.totalDisconnected.Load(), "backend_overflow", s.totalBackendOverflow.Load(), "backend_errors", s.totalBackendErrors.Load())
+		s.logger.Info("shutdown_summary", "accepted", s.totalAccepted.Load(), "handshake_fail", s.totalHandshakeFail.Load(), "connected", s.totalConnected.Load(), "disconnected", s.totalDisconnected.Load(), "backend_overflow", s.totalBackendOverflow.Load(), "backend_denied", s.totalBackendDenied.Load(), "backend_inhibited", s.totalBackendInhibited.Load(), "backend_errors", s.totalBackendErrors.Load())
 		return nil
 	}
 }
@@ -29,7 +29,6 @@ func startInMemoryServer(b *testing.B, h *hub.Hub) (*Server, context.CancelFunc)
 
 func BenchmarkServerWriterFlush(b *testing.B) {
 	h := hub.New()
-	h.OutBufSize = 0
 	srv, cancel := startInMemoryServer(b, h)
 	defer cancel()
 	// Dial the server
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+const (
+	defaultSessionReplay = 256
+	// takeoverWait bounds how long a resume waits for the previous
+	// connection of the session to shut down.
+	takeoverWait = 2 * time.Second
+)
+
+// WithSessions enables client session resumption: a client that opened a
+// session and reconnects within grace gets its connection state back and
+// the last (at most replay) frames broadcast while it was away. A grace of
+// 0 disables sessions.
+func WithSessions(grace time.Duration, replay int) ServerOption {
+	return func(s *Server) {
+		if grace <= 0 {
+			s.sessions = nil
+			return
+		}
+		if replay <= 0 || replay > maxReplay {
+			replay = defaultSessionReplay
+		}
+		s.sessions = &sessionStore{grace: grace, replay: replay, m: make(map[uint64]*session)}
+	}
+}
+
+// session is the state kept for a client across connections. It is bound
+// to a connection (conn set), parked (parked collecting broadcasts until
+// the timer expires it) or imported from a peer gateway (imported, waiting
+// for its client to fail over).
+type session struct {
+	token    uint64
+	identity string
+	conn     net.Conn
+	unbound  chan struct{} // closed when conn lets go of the session
+	ackMode  bool
+	ackSeq   uint16
+	filter   func(*can.Frame) bool // receive filter (OpFilter), kept while parked
+	spec     *rxFilterSpec         // source of filter
+	errs     bool                  // error frame subscription (OpErrFrames)
+	imported bool
+	parked   *hub.Client
+	timer    *time.Timer
+	gen      uint64 // park count; stale expiry timers compare it
+}
+
+// save copies the negotiated settings of st. Callers hold the store mu.
+func (sess *session) save(st *readerState) {
+	sess.ackMode, sess.ackSeq, sess.errs = st.ackMode, st.ackSeq, st.errFrames
+	sess.filter, sess.spec = st.rxFilter, st.rxSpec
+}
+
+type sessionStore struct {
+	grace    time.Duration
+	replay   int
+	mu       sync.Mutex
+	m        map[uint64]*session
+	parkedN  int
+	standbyN int // imported sessions
+}
+
+// newToken returns an unused non-zero 48-bit token. Callers hold mu.
+func (ss *sessionStore) newToken() uint64 {
+	for {
+		var b [8]byte
+		_, _ = rand.Read(b[:])
+		t := binary.BigEndian.Uint64(b[:]) & cnl.SessionTokenMask
+		if _, used := ss.m[t]; t != 0 && !used {
+			return t
+		}
+	}
+}
+
+// claim binds the session named by token to conn. A session still bound to
+// an older connection (the server has not noticed that connection drop yet)
+// is taken over by closing that connection. An imported session is only
+// handed to the identity that owned it on the peer. claim returns the
+// session and how it was found (metrics.SessionResumed|SessionMigrated), or
+// a new one (metrics.SessionNew) when the token is unknown or expired.
+func (ss *sessionStore) claim(ctx context.Context, token uint64, conn net.Conn, identity string) (sess *session, result string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if sess = ss.m[token]; sess != nil && sess.conn != nil {
+		old, unbound := sess.conn, sess.unbound
+		ss.mu.Unlock()
+		_ = old.Close()
+		select {
+		case <-unbound:
+		case <-time.After(takeoverWait):
+		case <-ctx.Done():
+		}
+		ss.mu.Lock()
+		sess = ss.m[token]
+	}
+	if sess != nil && sess.imported && sess.identity != identity {
+		sess = nil
+	}
+	switch {
+	case sess != nil && sess.imported:
+		sess.imported = false
+		ss.standbyN--
+		metrics.SetSessionsStandby(ss.standbyN)
+		result = metrics.SessionMigrated
+	case sess != nil && sess.conn == nil:
+		sess.timer.Stop()
+		ss.parkedN--
+		metrics.SetSessionsParked(ss.parkedN)
+		result = metrics.SessionResumed
+	default:
+		sess = &session{token: ss.newToken(), identity: identity}
+		ss.m[sess.token] = sess
+		result = metrics.SessionNew
+	}
+	sess.conn = conn
+	sess.unbound = make(chan struct{})
+	return sess, result
+}
+
+// publishSession copies the negotiated settings of st to its bound session,
+// so ExportSessions sees them while the client is connected.
+func (s *Server) publishSession(st *readerState) {
+	ss, sess := s.sessions, st.session
+	if ss == nil || sess == nil {
+		return
+	}
+	ss.mu.Lock()
+	sess.save(st)
+	ss.mu.Unlock()
+}
+
+// handleSession answers an OpSession request: it resumes the session named
+// by the token when it is still known, otherwise it opens a new one.
+func (s *Server) handleSession(ctx context.Context, st *readerState, cl *hub.Client, token uint64, logger *slog.Logger) {
+	if s.sessions == nil {
+		s.sendControl(ctx, cl, cnl.SessionMessage(cnl.SessionUnavailable, 0))
+		return
+	}
+	if st.session != nil { // already bound: repeat the current token
+		s.sendControl(ctx, cl, cnl.SessionMessage(cnl.SessionNew, st.session.token))
+		return
+	}
+	sess, result := s.sessions.claim(ctx, token, st.conn, st.ident.Name)
+	st.session = sess
+	metrics.IncSession(result)
+	if result == metrics.SessionNew {
+		s.publishSession(st)
+		logger.Info("client_session_new")
+		s.sendControl(ctx, cl, cnl.SessionMessage(cnl.SessionNew, sess.token))
+		return
+	}
+	var missed []can.Frame
+	if sess.parked != nil {
+		if s.Hub != nil {
+			s.Hub.Remove(sess.parked)
+		}
+		missed = sess.parked.Drain()
+		sess.parked = nil
+	}
+	st.ackMode, st.ackSeq = sess.ackMode, sess.ackSeq
+	st.rxFilter, st.rxSpec, st.errFrames = sess.filter, sess.spec, sess.errs
+	cl.SetFilter(sess.filter)
+	cl.SetErrorFrames(sess.errs)
+	logger.Info("client_session_resumed", "replayed", len(missed), "tx_ack", st.ackMode, "migrated", result == metrics.SessionMigrated)
+	n := uint16(len(missed))
+	s.sendControl(ctx, cl, cnl.SessionMessage(cnl.SessionResumed, sess.token))
+	s.sendControl(ctx, cl, cnl.HistoryMarker(cnl.OpHistoryBegin, cnl.HistoryOK, n))
+	for _, fr := range missed {
+		s.sendControl(ctx, cl, fr)
+	}
+	s.sendControl(ctx, cl, cnl.HistoryMarker(cnl.OpHistoryEnd, cnl.HistoryOK, n))
+}
+
+// releaseSession runs when a connection ends. Its session is parked for the
+// grace period, collecting broadcasts in a queue of the replay size (frames
+// beyond it are handled by the hub policy like for any slow client). On
+// server shutdown the session is dropped instead.
+func (s *Server) releaseSession(ctx context.Context, st *readerState, logger *slog.Logger) {
+	ss, sess := s.sessions, st.session
+	if ss == nil || sess == nil {
+		return
+	}
+	st.session = nil
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	defer close(sess.unbound)
+	sess.conn = nil
+	if ctx.Err() != nil {
+		delete(ss.m, sess.token)
+		return
+	}
+	sess.save(st)
+	sess.parked = &hub.Client{Out: make(chan can.Frame, ss.replay), Closed: make(chan struct{})}
+	sess.parked.SetFilter(st.rxFilter)
+	sess.parked.SetErrorFrames(st.errFrames)
+	if s.Hub != nil {
+		s.Hub.Add(sess.parked)
+	}
+	sess.gen++
+	gen := sess.gen
+	sess.timer = time.AfterFunc(ss.grace, func() { s.expireSession(sess, gen, logger) })
+	ss.parkedN++
+	metrics.SetSessionsParked(ss.parkedN)
+	logger.Debug("client_session_parked", "grace", ss.grace)
+}
+
+func (s *Server) expireSession(sess *session, gen uint64, logger *slog.Logger) {
+	ss := s.sessions
+	ss.mu.Lock()
+	if ss.m[sess.token] != sess || sess.conn != nil || sess.gen != gen { // resumed meanwhile
+		ss.mu.Unlock()
+		return
+	}
+	delete(ss.m, sess.token)
+	ss.parkedN--
+	metrics.SetSessionsParked(ss.parkedN)
+	ss.mu.Unlock()
+	if s.Hub != nil {
+		s.Hub.Remove(sess.parked)
+	}
+	metrics.IncSession(metrics.SessionExpired)
+	logger.Info("client_session_expired")
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+// sessionConn dials srv, completes the handshake and sends an OpSession
+// request for token, returning the reply.
+func sessionConn(t *testing.T, ctx context.Context, srv *Server, token uint64) (net.Conn, *bufio.Reader, byte, uint64) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cnl.Handshake(ctx, conn, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	codec := &cnl.Codec{}
+	if _, err := codec.EncodeTo(conn, []can.Frame{cnl.SessionMessage(0, token)}); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	fr, err := codec.Decode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, tok, ok := cnl.ParseSession(&fr)
+	if !ok {
+		t.Fatalf("expected session reply, got %+v", fr)
+	}
+	return conn, r, st, tok
+}
+
+func TestSessionResume(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h := hub.New()
+	srv := NewServer(
+		WithHub(h),
+		WithCodec(&cnl.Codec{}),
+		WithSend(func(can.Frame) error { return nil }),
+		WithFlushInterval(time.Millisecond),
+		WithSessions(time.Minute, 2),
+	)
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+	codec := &cnl.Codec{}
+
+	conn, r, st, token := sessionConn(t, ctx, srv, 0)
+	if st != cnl.SessionNew || token == 0 {
+		t.Fatalf("new session: status=%d token=%x", st, token)
+	}
+	if _, err := codec.EncodeTo(conn, []can.Frame{cnl.ControlFrame(cnl.OpTxAckEnable)}); err != nil {
+		t.Fatal(err)
+	}
+	if fr, err := codec.Decode(r); err != nil || fr.Data[0] != cnl.OpTxAckEnable {
+		t.Fatalf("ack enable: %+v %v", fr, err)
+	}
+	_ = conn.Close()
+
+	// Wait until the session is parked, then broadcast more than it keeps.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		srv.sessions.mu.Lock()
+		n := srv.sessions.parkedN
+		srv.sessions.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session not parked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for id := uint32(1); id <= 3; id++ {
+		h.Broadcast(can.Frame{CANID: id})
+	}
+
+	conn, r, st, tok := sessionConn(t, ctx, srv, token)
+	defer conn.Close()
+	if st != cnl.SessionResumed || tok != token {
+		t.Fatalf("resume: status=%d token=%x want %x", st, tok, token)
+	}
+	var got []can.Frame
+	for i := 0; i < 4; i++ {
+		fr, err := codec.Decode(r)
+		if err != nil {
+			t.Fatalf("replay frame %d: %v", i, err)
+		}
+		got = append(got, fr)
+	}
+	if _, _, n, ok := cnl.ParseHistoryMarker(&got[0]); !ok || n != 2 {
+		t.Fatalf("begin marker: %+v", got[0])
+	}
+	// The parked queue holds 2 frames; the hub drop policy discarded the third.
+	if got[1].CANID != 1 || got[2].CANID != 2 {
+		t.Fatalf("replayed: %+v %+v", got[1], got[2])
+	}
+	if op, _, _, ok := cnl.ParseHistoryMarker(&got[3]); !ok || op != cnl.OpHistoryEnd {
+		t.Fatalf("end marker: %+v", got[3])
+	}
+
+	// TX acks stay enabled on the resumed connection.
+	if _, err := codec.EncodeTo(conn, []can.Frame{{CANID: 0x10}}); err != nil {
+		t.Fatal(err)
+	}
+	fr, err := codec.Decode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq, status, id, ok := cnl.ParseTxAck(&fr); !ok || seq != 1 || status != cnl.AckOK || id != 0x10 {
+		t.Fatalf("ack after resume: %+v", fr)
+	}
+}
+
+func TestSessionUnknownTokenAndDisabled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, grace := range []time.Duration{0, time.Minute} {
+		srv := NewServer(WithHub(hub.New()), WithCodec(&cnl.Codec{}), WithSend(func(can.Frame) error { return nil }),
+			WithFlushInterval(time.Millisecond), WithSessions(grace, 0))
+		go func() { _ = srv.Serve(ctx) }()
+		<-srv.Ready()
+		conn, _, st, tok := sessionConn(t, ctx, srv, 0x123456)
+		_ = conn.Close()
+		switch {
+		case grace == 0 && (st != cnl.SessionUnavailable || tok != 0):
+			t.Fatalf("disabled: status=%d token=%x", st, tok)
+		case grace > 0 && (st != cnl.SessionNew || tok == 0x123456):
+			t.Fatalf("unknown token: status=%d token=%x", st, tok)
+		}
+	}
+}
+
+func TestSessionTakeover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := NewServer(WithHub(hub.New()), WithCodec(&cnl.Codec{}), WithSend(func(can.Frame) error { return nil }),
+		WithFlushInterval(time.Millisecond), WithSessions(time.Minute, 0))
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+	old, oldR, _, token := sessionConn(t, ctx, srv, 0)
+	defer old.Close()
+	// The old connection still looks alive to the server; resuming from a
+	// new one closes it and takes the session over.
+	conn, _, st, tok := sessionConn(t, ctx, srv, token)
+	defer conn.Close()
+	if st != cnl.SessionResumed || tok != token {
+		t.Fatalf("takeover: status=%d token=%x", st, tok)
+	}
+	if _, err := oldR.ReadByte(); err == nil {
+		t.Fatal("old connection still open")
+	}
+}
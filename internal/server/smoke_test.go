@@ -243,9 +243,7 @@ func TestSmokeBatch(t *testing.T) {
 func TestSmokeBackpressureDrop(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	h := hub.New()
-	h.OutBufSize = 1
-	h.Policy = hub.PolicyDrop
+	h, _ := hub.NewWithOptions(hub.WithOutBufSize(1), hub.WithPolicy(hub.PolicyDrop))
 	srv := NewServer(WithHub(h), WithCodec(&cnl.Codec{}), WithSend(dummySend))
 	go srv.Serve(ctx)
 	<-srv.Ready()
@@ -274,9 +272,7 @@ func TestSmokeBackpressureDrop(t *testing.T) {
 func TestSmokeBackpressureKick(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	h := hub.New()
-	h.OutBufSize = 1
-	h.Policy = hub.PolicyKick
+	h, _ := hub.NewWithOptions(hub.WithOutBufSize(1), hub.WithPolicy(hub.PolicyKick))
 	srv := NewServer(WithHub(h), WithCodec(&cnl.Codec{}), WithSend(dummySend))
 	go srv.Serve(ctx)
 	<-srv.Ready()
@@ -306,9 +302,7 @@ func TestSmokeBackpressureKick(t *testing.T) {
 func TestSmokeMetrics(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	h := hub.New()
-	h.OutBufSize = 1
-	h.Policy = hub.PolicyDrop
+	h, _ := hub.NewWithOptions(hub.WithOutBufSize(1), hub.WithPolicy(hub.PolicyDrop))
 	srv := NewServer(WithHub(h), WithCodec(&cnl.Codec{}), WithSend(dummySend))
 	go srv.Serve(ctx)
 	<-srv.Ready()
@@ -330,9 +324,13 @@ func TestSmokeMetrics(t *testing.T) {
 		}
 	}
 
+	// The client is added to the hub after the handshake reply; wait for it.
+	for wait := time.Now().Add(200 * time.Millisecond); h.Count() == 0 && time.Now().Before(wait); {
+		time.Sleep(2 * time.Millisecond)
+	}
 	// Server -> Client: broadcast 5 frames (some may drop due to tiny buffer)
 	for i := 0; i < 5; i++ {
-		srv.Hub.Broadcast(can.Frame{CANID: 0x800 + uint32(i), Len: 0})
+		srv.Hub.Broadcast(can.Frame{CANID: 0x700 + uint32(i), Len: 0})
 	}
 	// Ensure writer flushed by attempting to read at least one frame header.
 	readDeadline := time.Now().Add(200 * time.Millisecond)
@@ -597,6 +595,82 @@ func TestGracefulShutdown(t *testing.T) {
 	}
 }
 
+// TestServeRestart ensures a shut down server can Serve again on the same
+// address and accepts clients there.
+func TestServeRestart(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	h := hub.New()
+	srv := NewServer(WithHub(h), WithCodec(&cnl.Codec{}), WithSend(dummySend), WithListenAddr("127.0.0.1:0"))
+	for i := 0; i < 2; i++ {
+		done := make(chan error, 1)
+		go func() { done <- srv.Serve(ctx) }()
+		<-srv.Ready()
+		c := dialAndHandshake(t, ctx, srv.Addr())
+		sdCtx, sdCancel := context.WithTimeout(ctx, time.Second)
+		if err := srv.Shutdown(sdCtx); err != nil {
+			t.Fatalf("cycle %d: shutdown err: %v", i, err)
+		}
+		sdCancel()
+		if err := <-done; err != nil {
+			t.Fatalf("cycle %d: serve err: %v", i, err)
+		}
+		_ = c.Close()
+		select {
+		case <-srv.Ready():
+			t.Fatalf("cycle %d: ready after shutdown", i)
+		default:
+		}
+	}
+}
+
+// TestServeListeners ensures injected listeners are served concurrently and
+// all of them stop on Shutdown.
+func TestServeListeners(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	h := hub.New()
+	srv := NewServer(WithHub(h), WithCodec(&cnl.Codec{}), WithSend(dummySend))
+	done := make(chan error, 2)
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, ln.Addr().String())
+		go func() { done <- srv.ServeListener(ctx, ln) }()
+	}
+	<-srv.Ready()
+	for _, a := range addrs {
+		c := dialAndHandshake(t, ctx, a)
+		defer c.Close()
+	}
+	deadline := time.Now().Add(time.Second)
+	for h.Count() < 2 && time.Now().Before(deadline) {
+		time.Sleep(2 * time.Millisecond)
+	}
+	if n := h.Count(); n != 2 {
+		t.Fatalf("clients=%d want 2", n)
+	}
+	if got := srv.Addrs(); len(got) != 2 {
+		t.Fatalf("Addrs()=%v want 2 entries", got)
+	}
+	sdCtx, sdCancel := context.WithTimeout(ctx, time.Second)
+	defer sdCancel()
+	if err := srv.Shutdown(sdCtx); err != nil {
+		t.Fatalf("shutdown err: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("serve err: %v", err)
+		}
+	}
+	if got := srv.Addrs(); len(got) != 0 {
+		t.Fatalf("Addrs() after shutdown=%v", got)
+	}
+}
+
 // TestFrameFilter ensures frames failing predicate are dropped (not counted in TCPRx nor sent to backend).
 func TestFrameFilter(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+)
+
+// Protocol is what a client speaks on a shared listen port, told apart by
+// its first bytes (see WithProtocolHandlers).
+type Protocol int
+
+const (
+	ProtoUnknown Protocol = iota
+	ProtoCNL              // cannelloni hello
+	ProtoTLS              // TLS ClientHello record
+	ProtoHTTP             // HTTP/1.x request line
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtoCNL:
+		return "cannelloni"
+	case ProtoTLS:
+		return "tls"
+	case ProtoHTTP:
+		return "http"
+	default:
+		return "unknown"
+	}
+}
+
+// signatures are the leading bytes of each protocol. A TLS connection opens
+// with a handshake record (0x16) of version 3.x.
+var signatures = []struct {
+	prefix string
+	proto  Protocol
+}{
+	{cnl.Hello, ProtoCNL},
+	{"\x16\x03", ProtoTLS},
+	{"GET ", ProtoHTTP},
+	{"HEAD ", ProtoHTTP},
+	{"POST ", ProtoHTTP},
+	{"PUT ", ProtoHTTP},
+	{"DELETE ", ProtoHTTP},
+	{"OPTIONS ", ProtoHTTP},
+	{"PATCH ", ProtoHTTP},
+	{"CONNECT ", ProtoHTTP},
+}
+
+// maxSniffBytes is the longest signature.
+const maxSniffBytes = len(cnl.Hello)
+
+// classify returns the protocol b starts with. more reports that b is too
+// short to tell but still a prefix of some signature.
+func classify(b []byte) (p Protocol, more bool) {
+	for _, s := range signatures {
+		if bytes.HasPrefix(b, []byte(s.prefix)) {
+			return s.proto, false
+		}
+		if bytes.HasPrefix([]byte(s.prefix), b) {
+			more = true
+		}
+	}
+	return ProtoUnknown, more
+}
+
+// sniff reads from c until its protocol is known, waiting at most timeout.
+// The returned conn replays the bytes read.
+func sniff(c net.Conn, timeout time.Duration) (Protocol, net.Conn, error) {
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return ProtoUnknown, c, fmt.Errorf("set deadline: %w", err)
+	}
+	defer c.SetReadDeadline(time.Time{})
+	buf := make([]byte, maxSniffBytes)
+	n := 0
+	for {
+		m, err := c.Read(buf[n:])
+		n += m
+		if p, more := classify(buf[:n]); !more || n == len(buf) {
+			return p, &prefixConn{Conn: c, prefix: buf[:n]}, nil
+		}
+		if err != nil {
+			return ProtoUnknown, c, fmt.Errorf("sniff after %d bytes: %w", n, err)
+		}
+	}
+}
+
+// prefixConn returns the sniffed bytes before reading on from the socket.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// WithProtocolHandlers shares the listen port between protocols: the server
+// looks at the first bytes of every connection, serves cannelloni clients
+// itself and passes the others to the handler of their protocol, which
+// owns the connection from then on. Connections of a protocol without a
+// handler, or that cannot be recognised within the handshake timeout, are
+// closed. Cannelloni clients must then send their hello without waiting
+// for the server's.
+func WithProtocolHandlers(h map[Protocol]func(net.Conn)) ServerOption {
+	return func(s *Server) { s.protoHandlers = h }
+}
+
+// ErrListenerClosed is returned by ConnListener.Accept after Close.
+var ErrListenerClosed = errors.New("server: conn listener closed")
+
+// ConnListener is a net.Listener fed with connections by Deliver, so a
+// protocol handler can serve sniffed connections with a stock server such
+// as http.Server.
+type ConnListener struct {
+	ch   chan net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+// NewConnListener returns an open ConnListener.
+func NewConnListener() *ConnListener {
+	return &ConnListener{ch: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// Deliver hands c to the next Accept, or closes it when l is closed.
+func (l *ConnListener) Deliver(c net.Conn) {
+	select {
+	case l.ch <- c:
+	case <-l.done:
+		_ = c.Close()
+	}
+}
+
+func (l *ConnListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ch:
+		return c, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *ConnListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *ConnListener) Addr() net.Addr { return sniffAddr{} }
+
+type sniffAddr struct{}
+
+func (sniffAddr) Network() string { return "sniffed" }
+func (sniffAddr) String() string  { return "sniffed" }
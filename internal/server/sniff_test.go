@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Protocol
+		more bool
+	}{
+		{"CANNELLONIv1", ProtoCNL, false},
+		{"CANNEL", ProtoUnknown, true},
+		{"C", ProtoUnknown, true},
+		{"CONNECT host:443 HTTP/1.1", ProtoHTTP, false},
+		{"\x16\x03\x01\x02\x00", ProtoTLS, false},
+		{"\x16", ProtoUnknown, true},
+		{"GET / HTTP/1.1\r\n", ProtoHTTP, false},
+		{"GE", ProtoUnknown, true},
+		{"SSH-2.0-OpenSSH", ProtoUnknown, false},
+		{"CANNELLONIv2", ProtoUnknown, false},
+	} {
+		p, more := classify([]byte(tc.in))
+		if p != tc.want || more != tc.more {
+			t.Errorf("classify(%q) = %v, %v; want %v, %v", tc.in, p, more, tc.want, tc.more)
+		}
+	}
+}
+
+// TestPortSniffing serves cannelloni and HTTP clients on one port and
+// closes connections of unknown protocols.
+func TestPortSniffing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	httpLn := NewConnListener()
+	defer httpLn.Close()
+	go func() {
+		_ = http.Serve(httpLn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, "hello "+r.URL.Path)
+		}))
+	}()
+	srv := NewServer(
+		WithHub(hub.New()),
+		WithCodec(&cnl.Codec{}),
+		WithSend(dummySend),
+		WithHandshakeTimeout(time.Second),
+		WithProtocolHandlers(map[Protocol]func(net.Conn){ProtoHTTP: httpLn.Deliver}),
+	)
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+	addr := srv.Addr()
+
+	resp, err := http.Get("http://" + addr + "/ready")
+	if err != nil {
+		t.Fatalf("http: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello /ready" {
+		t.Fatalf("http body %q", body)
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := cnl.Handshake(ctx, c, time.Second); err != nil {
+		t.Fatalf("cannelloni handshake: %v", err)
+	}
+
+	u, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	_, _ = io.WriteString(u, "SSH-2.0-test\r\n")
+	_ = u.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if b, err := bufio.NewReader(u).ReadByte(); err == nil {
+		t.Fatalf("unknown protocol: read %#x, want the connection closed", b)
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("unknown protocol: connection left open")
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/access"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// clientConn tracks the connection and identity behind a registered hub client.
+type clientConn struct {
+	conn     net.Conn
+	id       uint64
+	remote   string
+	identity string // access rule or client certificate name
+	role     access.Role
+	since    time.Time
+	rtt      atomic.Int64 // last RTT reported by the client (OpPing), ns
+	// compress is the stream compression state; compressRaw and
+	// compressWire count the bytes sent while it was on.
+	compress     atomic.Int32
+	compressRaw  atomic.Uint64
+	compressWire atomic.Uint64
+}
+
+// ClientInfo is a point-in-time description of one connected client.
+type ClientInfo struct {
+	ID          uint64    `json:"id"`
+	Remote      string    `json:"remote"`
+	Identity    string    `json:"identity"`
+	Role        string    `json:"role"`
+	ConnectedAt time.Time `json:"connected_at"`
+	QueueLen    int       `json:"queue_len"`
+	QueueCap    int       `json:"queue_cap"`
+	// RTT is the last round-trip time the client reported in a ping (0 if
+	// it never pinged).
+	RTT time.Duration `json:"rtt_ns,omitempty"`
+	// Compression is "deflate" while the client's stream is compressed,
+	// "off" after it fell back for compressing poorly, and empty if the
+	// client never negotiated it. CompressRaw and CompressWire are the
+	// bytes sent while it was on, before and after compression.
+	Compression  string `json:"compression,omitempty"`
+	CompressRaw  uint64 `json:"compress_raw_bytes,omitempty"`
+	CompressWire uint64 `json:"compress_wire_bytes,omitempty"`
+}
+
+// Stats summarizes server lifetime counters.
+type Stats struct {
+	Accepted         uint64 `json:"accepted"`
+	HandshakeFail    uint64 `json:"handshake_fail"`
+	RateLimited      uint64 `json:"rate_limited"`
+	Connected        uint64 `json:"connected"`
+	Disconnected     uint64 `json:"disconnected"`
+	ClientFrames     uint64 `json:"client_frames"`
+	BackendOverflow  uint64 `json:"backend_overflow"`
+	BackendDenied    uint64 `json:"backend_denied"`
+	BackendInhibited uint64 `json:"backend_inhibited"`
+	BackendErrors    uint64 `json:"backend_errors"`
+	ActiveClients    int    `json:"active_clients"`
+}
+
+// Stats returns a snapshot of lifetime counters.
+func (s *Server) Stats() Stats {
+	s.clientsMu.RLock()
+	active := len(s.clients)
+	s.clientsMu.RUnlock()
+	return Stats{
+		Accepted:         s.totalAccepted.Load(),
+		HandshakeFail:    s.totalHandshakeFail.Load(),
+		RateLimited:      s.totalRateLimited.Load(),
+		Connected:        s.totalConnected.Load(),
+		Disconnected:     s.totalDisconnected.Load(),
+		ClientFrames:     s.totalClientFrames.Load(),
+		BackendOverflow:  s.totalBackendOverflow.Load(),
+		BackendDenied:    s.totalBackendDenied.Load(),
+		BackendInhibited: s.totalBackendInhibited.Load(),
+		BackendErrors:    s.totalBackendErrors.Load(),
+		ActiveClients:    active,
+	}
+}
+
+// Clients returns a snapshot of connected clients ordered by connection id.
+func (s *Server) Clients() []ClientInfo {
+	s.clientsMu.RLock()
+	out := make([]ClientInfo, 0, len(s.clients))
+	for cl, cc := range s.clients {
+		out = append(out, ClientInfo{
+			ID:           cc.id,
+			Remote:       cc.remote,
+			Identity:     cc.identity,
+			Role:         cc.role.String(),
+			ConnectedAt:  cc.since,
+			QueueLen:     cl.QueueLen(),
+			QueueCap:     cl.QueueCap(),
+			RTT:          time.Duration(cc.rtt.Load()),
+			Compression:  compressionName(cc.compress.Load()),
+			CompressRaw:  cc.compressRaw.Load(),
+			CompressWire: cc.compressWire.Load(),
+		})
+	}
+	s.clientsMu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// forgetClient drops bookkeeping for a disconnected client.
+func (s *Server) forgetClient(cl *hub.Client) {
+	s.clientsMu.Lock()
+	if cc := s.clients[cl]; cc != nil && cc.rtt.Load() != 0 {
+		metrics.ForgetClientRTT(cc.remote)
+	}
+	delete(s.clients, cl)
+	s.clientsMu.Unlock()
+}
+
+// recordRTT stores the round-trip time reported by a client's ping.
+func (s *Server) recordRTT(cl *hub.Client, d time.Duration) {
+	s.clientsMu.RLock()
+	cc := s.clients[cl]
+	s.clientsMu.RUnlock()
+	if cc == nil || d <= 0 {
+		return
+	}
+	cc.rtt.Store(int64(d))
+	metrics.SetClientRTT(cc.remote, cc.identity, d)
+}
+
+// setCompression records a client's compression state and returns its
+// bookkeeping (nil once the client was forgotten).
+func (s *Server) setCompression(cl *hub.Client, state int32) *clientConn {
+	s.clientsMu.RLock()
+	cc := s.clients[cl]
+	s.clientsMu.RUnlock()
+	if cc != nil {
+		cc.compress.Store(state)
+	}
+	return cc
+}
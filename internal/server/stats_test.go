@@ -0,0 +1,37 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+// TestServerClientsSnapshot verifies connected clients are listed and forgotten after disconnect.
+func TestServerClientsSnapshot(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	h := hub.New()
+	srv := NewServer(WithHub(h), WithCodec(&cnl.Codec{}), WithSend(dummySend))
+	go srv.Serve(ctx)
+	<-srv.Ready()
+	c := dialAndHandshake(t, ctx, srv.Addr())
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for time.Now().Before(deadline) && len(srv.Clients()) == 0 {
+		time.Sleep(2 * time.Millisecond)
+	}
+	cl := srv.Clients()
+	if len(cl) != 1 || cl[0].ID == 0 || cl[0].QueueCap == 0 {
+		t.Fatalf("unexpected clients snapshot %+v", cl)
+	}
+	_ = c.Close()
+	deadline = time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) && srv.Stats().ActiveClients != 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if st := srv.Stats(); st.ActiveClients != 0 || st.Connected != 1 {
+		t.Fatalf("unexpected stats after disconnect %+v", st)
+	}
+}
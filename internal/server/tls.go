@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"net"
+
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// WithTLS serves clients over TLS with cfg. With cfg.ClientAuth set to
+// tls.RequireAndVerifyClientCert, a connection without a valid client
+// certificate is closed before the cannelloni handshake, and a client's
+// identity is named after its certificate (see CertName); its role still
+// comes from WithAccess. Without WithProtocolHandlers every connection must
+// be TLS. With it, TLS connections are recognised by their ClientHello and
+// sniffed again once decrypted, and plain connections of any protocol are
+// refused when client certificates are required.
+func WithTLS(cfg *tls.Config) ServerOption {
+	return func(s *Server) { s.tlsConfig = cfg }
+}
+
+// CertName names a client by its certificate: the subject common name, or
+// else its first DNS, email or URI subject alternative name.
+func CertName(c *x509.Certificate) string {
+	switch {
+	case c.Subject.CommonName != "":
+		return c.Subject.CommonName
+	case len(c.DNSNames) > 0:
+		return c.DNSNames[0]
+	case len(c.EmailAddresses) > 0:
+		return c.EmailAddresses[0]
+	case len(c.URIs) > 0:
+		return c.URIs[0].String()
+	}
+	return ""
+}
+
+// clientCertRequired reports whether plain connections must be refused.
+func (s *Server) clientCertRequired() bool {
+	return s.tlsConfig != nil && s.tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert
+}
+
+// tlsHandshake terminates TLS on c within the handshake timeout and returns
+// the name of the verified client certificate ("" without one).
+func (s *Server) tlsHandshake(ctx context.Context, c net.Conn) (*tls.Conn, string, error) {
+	tc := tls.Server(c, s.tlsConfig)
+	hctx, cancel := context.WithTimeout(ctx, s.handshakeTimeout)
+	defer cancel()
+	if err := tc.HandshakeContext(hctx); err != nil {
+		return nil, "", err
+	}
+	var name string
+	if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+		name = CertName(certs[0])
+	}
+	return tc, name, nil
+}
+
+// negotiate runs the TLS and protocol sniffing steps configured for the
+// listener. It returns the connection to run the cannelloni handshake on
+// and the client certificate name, or ok=false when the connection was
+// passed to a protocol handler or closed.
+func (s *Server) negotiate(ctx context.Context, conn net.Conn, l *slog.Logger) (_ net.Conn, certName string, ok bool) {
+	secure := false
+	for {
+		p := ProtoCNL
+		if s.protoHandlers != nil {
+			var err error
+			if p, conn, err = sniff(conn, s.handshakeTimeout); err != nil {
+				l.Warn("protocol_sniff_failed", "error", err)
+				_ = conn.Close()
+				return nil, "", false
+			}
+			metrics.IncSniffed(p.String())
+		} else if s.tlsConfig != nil && !secure {
+			p = ProtoTLS // a TLS-only port
+		}
+		if p == ProtoTLS && s.tlsConfig != nil && !secure {
+			tc, name, err := s.tlsHandshake(ctx, conn)
+			if err != nil {
+				s.totalHandshakeFail.Add(1)
+				metrics.IncError(metrics.ErrTLSHandshake)
+				l.Warn("tls_handshake_failed", "error", err)
+				_ = conn.Close()
+				return nil, "", false
+			}
+			conn, certName, secure = tc, name, true
+			continue
+		}
+		if !secure && s.clientCertRequired() {
+			// Plain HTTP and the other sniffed protocols would skip the
+			// client certificate as well.
+			l.Warn("client_tls_required", "protocol", p.String())
+			_ = conn.Close()
+			return nil, "", false
+		}
+		if p == ProtoCNL {
+			return conn, certName, true
+		}
+		h := s.protoHandlers[p]
+		if h == nil {
+			l.Warn("client_protocol_unsupported", "protocol", p.String(), "tls", secure)
+			_ = conn.Close()
+			return nil, "", false
+		}
+		l.Debug("client_protocol", "protocol", p.String(), "tls", secure)
+		go h(conn)
+		return nil, "", false
+	}
+}
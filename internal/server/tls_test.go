@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+// testPKI is a CA with a server certificate for 127.0.0.1 and a client
+// certificate named "panel-1".
+type testPKI struct {
+	pool           *x509.CertPool
+	server, client tls.Certificate
+}
+
+func newTestPKI(t *testing.T) testPKI {
+	t.Helper()
+	key := func() *ecdsa.PrivateKey {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	caKey := key()
+	caTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test ca"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	issue := func(serial int64, tmpl *x509.Certificate) tls.Certificate {
+		k := key()
+		tmpl.SerialNumber = big.NewInt(serial)
+		tmpl.NotBefore, tmpl.NotAfter = caTmpl.NotBefore, caTmpl.NotAfter
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &k.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: k}
+	}
+	p := testPKI{pool: x509.NewCertPool()}
+	p.pool.AddCert(ca)
+	p.server = issue(2, &x509.Certificate{IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	p.client = issue(3, &x509.Certificate{Subject: pkix.Name{CommonName: "panel-1"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	return p
+}
+
+func startTLSServer(t *testing.T, ctx context.Context, pki testPKI, sniffing bool) *Server {
+	t.Helper()
+	opts := []ServerOption{
+		WithHub(hub.New()),
+		WithCodec(&cnl.Codec{}),
+		WithSend(dummySend),
+		WithHandshakeTimeout(time.Second),
+		WithListenAddr("127.0.0.1:0"),
+		WithTLS(&tls.Config{
+			Certificates: []tls.Certificate{pki.server},
+			ClientCAs:    pki.pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}),
+	}
+	if sniffing {
+		opts = append(opts, WithProtocolHandlers(map[Protocol]func(net.Conn){ProtoHTTP: func(c net.Conn) {
+			_, _ = io.WriteString(c, "HTTP/1.0 200 OK\r\nContent-Length: 0\r\n\r\n")
+			_ = c.Close()
+		}}))
+	}
+	srv := NewServer(opts...)
+	go func() { _ = srv.Serve(ctx) }()
+	<-srv.Ready()
+	return srv
+}
+
+// dialCNL opens a connection, over TLS when cfg is set, and runs the
+// cannelloni handshake.
+func dialCNL(ctx context.Context, addr string, cfg *tls.Config) (net.Conn, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg != nil {
+		c = tls.Client(c, cfg)
+	}
+	if err := cnl.Handshake(ctx, c, time.Second); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	for _, sniffing := range []bool{false, true} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		srv := startTLSServer(t, ctx, pki, sniffing)
+		addr := srv.Addr()
+
+		c, err := dialCNL(ctx, addr, &tls.Config{ServerName: "127.0.0.1", RootCAs: pki.pool, Certificates: []tls.Certificate{pki.client}})
+		if err != nil {
+			t.Fatalf("sniffing=%v: client with certificate: %v", sniffing, err)
+		}
+		deadline := time.Now().Add(time.Second)
+		for len(srv.Clients()) == 0 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if cl := srv.Clients(); len(cl) != 1 || cl[0].Identity != "panel-1" {
+			t.Fatalf("sniffing=%v: clients %+v, want identity panel-1", sniffing, cl)
+		}
+		c.Close()
+
+		if c, err := dialCNL(ctx, addr, &tls.Config{ServerName: "127.0.0.1", RootCAs: pki.pool}); err == nil {
+			c.Close()
+			t.Fatalf("sniffing=%v: client without certificate connected", sniffing)
+		}
+		if c, err := dialCNL(ctx, addr, nil); err == nil {
+			c.Close()
+			t.Fatalf("sniffing=%v: plain client connected", sniffing)
+		}
+		if resp, err := http.Get("http://" + addr + "/api/ws"); err == nil {
+			resp.Body.Close()
+			t.Fatalf("sniffing=%v: plain HTTP served without a client certificate", sniffing)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Bounds of the client writer settings that can be changed at runtime.
+const (
+	MaxFlushInterval = time.Second
+	MaxBatchSize     = 4096
+)
+
+// FlushInterval returns the longest time a client writer holds frames.
+func (s *Server) FlushInterval() time.Duration { return time.Duration(s.flushInterval.Load()) }
+
+// SetFlushInterval changes the flush interval while the server runs.
+// Connected clients pick it up at their next timer flush.
+func (s *Server) SetFlushInterval(d time.Duration) error {
+	if d <= 0 || d > MaxFlushInterval {
+		return fmt.Errorf("flush interval must be in (0, %v] (got %v)", MaxFlushInterval, d)
+	}
+	s.flushInterval.Store(int64(d))
+	return nil
+}
+
+// BatchSize returns the number of frames that triggers a client write.
+func (s *Server) BatchSize() int { return int(s.batchSize.Load()) }
+
+// SetBatchSize changes the batch size while the server runs; it applies to
+// connected clients from their next frame.
+func (s *Server) SetBatchSize(n int) error {
+	if n <= 0 || n > MaxBatchSize {
+		return fmt.Errorf("batch size must be in [1, %d] (got %d)", MaxBatchSize, n)
+	}
+	s.batchSize.Store(int64(n))
+	return nil
+}
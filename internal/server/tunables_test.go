@@ -0,0 +1,32 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetWriterTunables(t *testing.T) {
+	s := NewServer(WithFlushInterval(2*time.Millisecond), WithBatchSize(16))
+	if s.FlushInterval() != 2*time.Millisecond || s.BatchSize() != 16 {
+		t.Fatalf("options: %v/%d", s.FlushInterval(), s.BatchSize())
+	}
+	for _, d := range []time.Duration{0, -time.Millisecond, MaxFlushInterval + 1} {
+		if err := s.SetFlushInterval(d); err == nil {
+			t.Errorf("SetFlushInterval(%v): want error", d)
+		}
+	}
+	for _, n := range []int{0, -1, MaxBatchSize + 1} {
+		if err := s.SetBatchSize(n); err == nil {
+			t.Errorf("SetBatchSize(%d): want error", n)
+		}
+	}
+	if err := s.SetFlushInterval(20 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetBatchSize(256); err != nil {
+		t.Fatal(err)
+	}
+	if s.FlushInterval() != 20*time.Millisecond || s.BatchSize() != 256 {
+		t.Fatalf("after set: %v/%d", s.FlushInterval(), s.BatchSize())
+	}
+}
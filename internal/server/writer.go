@@ -2,12 +2,12 @@ package server
 
 import (
 	"fmt"
-	"io"
 	"log/slog"
 	"net"
 	"time"
 
 	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
 	"github.com/kstaniek/go-ampio-server/internal/hub"
 	"github.com/kstaniek/go-ampio-server/internal/metrics"
 )
@@ -22,63 +22,95 @@ func (s *Server) startWriter(ctxDone <-chan struct{}, conn net.Conn, cl *hub.Cli
 			if s.Hub != nil {
 				s.Hub.Remove(cl)
 			}
+			s.forgetClient(cl)
 			s.totalDisconnected.Add(1)
 			logger.Info("client_disconnected")
 		}()
-		t := time.NewTicker(s.flushInterval)
+		every := s.FlushInterval()
+		t := time.NewTicker(every)
 		defer t.Stop()
-		batch := make([]can.Frame, 0, s.batchSize)
-		flush := func() error {
+		batch := make([]can.Frame, 0, s.BatchSize())
+		encode := s.encoder(false)
+		if s.packets {
+			encode = (&cnl.PacketEncoder{}).EncodeTo
+		}
+		var z *compressor // set while the client's stream is compressed
+		flush := func(trigger string) error {
 			if len(batch) == 0 {
 				return nil
 			}
 			n := len(batch)
-			if beTo, ok := s.Codec.(interface {
-				EncodeTo(io.Writer, []can.Frame) (int, error)
-			}); ok {
-				_, err := beTo.EncodeTo(conn, batch)
-				batch = batch[:0]
-				if err != nil {
-					wrap := fmt.Errorf("%w: %v", ErrConnWrite, err)
-					metrics.IncError(mapErrToMetric(wrap))
-					s.setError(wrap)
-					return wrap
-				}
-				metrics.AddTCPTx(n)
-				return nil
-			}
-			var payload []byte
-			if be, ok := s.Codec.(interface{ Encode([]can.Frame) []byte }); ok {
-				payload = be.Encode(batch)
+			start := time.Now()
+			var err error
+			if z != nil {
+				err = z.write(batch)
+			} else {
+				_, err = encode(conn, batch)
 			}
 			batch = batch[:0]
-			if _, err := conn.Write(payload); err != nil {
+			if err == nil && z != nil {
+				if ratio, poor := z.poor(s.compressRatio); poor {
+					err = z.close()
+					z = nil
+					s.setCompression(cl, compressFellBack)
+					metrics.IncCompressFallback()
+					logger.Info("client_compression_disabled", "ratio", ratio, "max_ratio", s.compressRatio)
+				}
+			}
+			if err != nil {
 				wrap := fmt.Errorf("%w: %v", ErrConnWrite, err)
 				metrics.IncError(mapErrToMetric(wrap))
 				s.setError(wrap)
 				return wrap
 			}
 			metrics.AddTCPTx(n)
+			metrics.ObserveFlush(n, time.Since(start), trigger)
 			return nil
 		}
 		for {
 			select {
 			case fr := <-cl.Out:
 				batch = append(batch, fr)
-				if len(batch) >= s.batchSize {
-					if err := flush(); err != nil {
+				switch {
+				case z == nil && fr.CANID == cnl.ControlID && fr.Data[0] == cnl.OpCompress && fr.Data[1] == cnl.CompressDeflate:
+					// The answer goes out plain; everything after it is compressed.
+					if err := flush(metrics.FlushCompress); err != nil {
+						return
+					}
+					z = newCompressor(conn, s.setCompression(cl, compressOn), encode)
+					logger.Info("client_compression_enabled")
+				case !s.packets && fr.CANID == cnl.ControlID && fr.Data[0] == cnl.OpRTR:
+					// Remote requests take the negotiated form after the answer.
+					if err := flush(metrics.FlushRTR); err != nil {
+						return
+					}
+					encode = s.encoder(fr.Data[1] == cnl.RTROn)
+					if z != nil {
+						z.encode = encode
+					}
+				case len(batch) >= s.BatchSize():
+					if err := flush(metrics.FlushSize); err != nil {
+						return
+					}
+				case fr.CANID == cnl.ControlID && fr.Data[0] == cnl.OpPong:
+					// Pongs measure the link, not the flush interval.
+					if err := flush(metrics.FlushPong); err != nil {
 						return
 					}
 				}
 			case <-t.C:
-				if err := flush(); err != nil {
+				if err := flush(metrics.FlushTimer); err != nil {
 					return
 				}
+				if d := s.FlushInterval(); d != every {
+					every = d
+					t.Reset(every)
+				}
 			case <-cl.Closed:
-				_ = flush()
+				_ = flush(metrics.FlushClose)
 				return
 			case <-ctxDone:
-				_ = flush()
+				_ = flush(metrics.FlushClose)
 				return
 			}
 		}
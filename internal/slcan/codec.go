@@ -0,0 +1,171 @@
+// Package slcan speaks the LAWICEL ASCII serial protocol (SLCAN) used by
+// CANable, USBtin and similar USB adapters. Each frame is one line closed by
+// a carriage return:
+//
+//	t<iii><l><dd...>   standard data frame (3 hex ID digits, DLC, payload)
+//	T<iiiiiiii><l><dd...>  extended data frame (8 hex ID digits)
+//	r<iii><l>          standard remote request
+//	R<iiiiiiii><l>     extended remote request
+//
+// Adapters with timestamps enabled (Z1) append 4 hex digits, which are
+// ignored. Commands are answered with a carriage return (OK) or BEL (error).
+package slcan
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/validate"
+)
+
+const (
+	cr  = '\r'
+	bel = '\a'
+	// maxLine bounds a received line: T, 8 ID digits, DLC, 16 data digits
+	// and a 4-digit timestamp. Longer runs without a CR are garbage.
+	maxLine = 1 + 8 + 1 + 2*validate.MaxDLC + 4
+)
+
+// bitrates maps the bitrates of the S command to their codes.
+var bitrates = map[int]byte{
+	10000: '0', 20000: '1', 50000: '2', 100000: '3', 125000: '4',
+	250000: '5', 500000: '6', 800000: '7', 1000000: '8',
+}
+
+// CheckBitrate reports whether bitrate is one of the standard SLCAN rates
+// (S0-S8). 0 means keeping the adapter setting.
+func CheckBitrate(bitrate int) error {
+	if _, ok := bitrates[bitrate]; !ok && bitrate != 0 {
+		return fmt.Errorf("slcan bitrate %d: want 10000, 20000, 50000, 100000, 125000, 250000, 500000, 800000 or 1000000", bitrate)
+	}
+	return nil
+}
+
+// Open closes the channel in case a previous run left it open, sets the
+// bitrate (unless 0) and opens the channel. Leading CRs flush any partial
+// command in the adapter. Replies are read by the RX loop.
+func Open(w io.Writer, bitrate int) error {
+	if err := CheckBitrate(bitrate); err != nil {
+		return err
+	}
+	cmd := []byte("\r\r\rC\r")
+	if bitrate != 0 {
+		cmd = append(cmd, 'S', bitrates[bitrate], cr)
+	}
+	cmd = append(cmd, 'O', cr)
+	_, err := w.Write(cmd)
+	return err
+}
+
+// Close closes the CAN channel of the adapter.
+func Close(w io.Writer) error {
+	_, err := w.Write([]byte{'C', cr})
+	return err
+}
+
+// Encode returns the SLCAN line transmitting f. Flags other than EFF and
+// RTR are dropped; the caller rejects payloads over 8 bytes.
+func Encode(f can.Frame) []byte {
+	b := make([]byte, 0, maxLine)
+	rtr := f.CANID&can.CAN_RTR_FLAG != 0
+	if f.CANID&can.CAN_EFF_FLAG != 0 {
+		b = append(b, "TR"[btoi(rtr)])
+		b = fmt.Appendf(b, "%08X", f.CANID&can.CAN_EFF_MASK)
+	} else {
+		b = append(b, "tr"[btoi(rtr)])
+		b = fmt.Appendf(b, "%03X", f.CANID&can.CAN_SFF_MASK)
+	}
+	b = append(b, '0'+f.Len)
+	if !rtr {
+		b = fmt.Appendf(b, "%X", f.Data[:f.Len])
+	}
+	return append(b, cr)
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// DecodeStream emits the frames of the complete lines in in and leaves a
+// trailing partial line for the next call. Command replies and other
+// adapter output are skipped; BEL replies count as slcan_error_reply
+// errors and malformed frame lines as malformed frames.
+func DecodeStream(in *bytes.Buffer, out func(can.Frame)) error {
+	for {
+		data := in.Bytes()
+		i := bytes.IndexAny(data, "\r\a")
+		if i < 0 {
+			if len(data) > maxLine {
+				metrics.IncMalformed()
+				in.Reset()
+			}
+			return nil
+		}
+		line, term := data[:i], data[i]
+		if term == bel {
+			metrics.IncError(metrics.ErrSLCANReply)
+		}
+		if line = bytes.TrimLeft(line, "\n"); len(line) > 0 { // CRLF adapters
+			if f, ok, err := parseLine(line); err != nil {
+				metrics.IncMalformed()
+			} else if ok {
+				out(f)
+				metrics.IncSerialRx()
+			}
+		}
+		in.Next(i + 1)
+	}
+}
+
+// parseLine decodes a frame line; ok is false for lines that are not
+// frames (command replies such as z, V or F).
+func parseLine(line []byte) (f can.Frame, ok bool, err error) {
+	idLen := 3
+	switch line[0] {
+	case 't':
+	case 'r':
+		f.CANID = can.CAN_RTR_FLAG
+	case 'T':
+		idLen, f.CANID = 8, can.CAN_EFF_FLAG
+	case 'R':
+		idLen, f.CANID = 8, can.CAN_EFF_FLAG|can.CAN_RTR_FLAG
+	default:
+		return f, false, nil
+	}
+	if len(line) < 1+idLen+1 {
+		return f, false, fmt.Errorf("short line %q", line)
+	}
+	id, err := strconv.ParseUint(string(line[1:1+idLen]), 16, 32)
+	if err != nil || (idLen == 3 && id > can.CAN_SFF_MASK) || id > can.CAN_EFF_MASK {
+		return f, false, fmt.Errorf("bad id in %q", line)
+	}
+	dlc := line[1+idLen] - '0'
+	if dlc > validate.MaxDLC {
+		return f, false, fmt.Errorf("bad dlc in %q", line)
+	}
+	f.CANID |= uint32(id)
+	f.Len = dlc
+	rest := line[2+idLen:]
+	if f.CANID&can.CAN_RTR_FLAG == 0 {
+		n := 2 * int(dlc)
+		if len(rest) < n {
+			return f, false, fmt.Errorf("short payload in %q", line)
+		}
+		if _, err := hex.Decode(f.Data[:dlc], rest[:n]); err != nil {
+			return f, false, fmt.Errorf("bad payload in %q", line)
+		}
+		rest = rest[n:]
+	}
+	if len(rest) != 0 && len(rest) != 4 { // optional timestamp
+		return f, false, fmt.Errorf("trailing bytes in %q", line)
+	}
+	return f, true, nil
+}
@@ -0,0 +1,79 @@
+package slcan
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestEncode(t *testing.T) {
+	cases := []struct {
+		fr   can.Frame
+		want string
+	}{
+		{can.Frame{CANID: 0x123, Len: 2, Data: [64]byte{0xAB, 0x01}}, "t1232AB01\r"},
+		{can.Frame{CANID: 0x1ABCDEF0 | can.CAN_EFF_FLAG, Len: 1, Data: [64]byte{0xFF}}, "T1ABCDEF01FF\r"},
+		{can.Frame{CANID: 0x7FF | can.CAN_RTR_FLAG, Len: 8}, "r7FF8\r"},
+		{can.Frame{CANID: 0x1 | can.CAN_EFF_FLAG | can.CAN_RTR_FLAG}, "R000000010\r"},
+		{can.Frame{CANID: 0x10}, "t0100\r"},
+	}
+	for _, c := range cases {
+		if got := string(Encode(c.fr)); got != c.want {
+			t.Errorf("Encode(%v) = %q, want %q", c.fr, got, c.want)
+		}
+	}
+}
+
+func TestDecodeStreamChunked(t *testing.T) {
+	want := []can.Frame{
+		{CANID: 0x123, Len: 2, Data: [64]byte{0xAB, 0x01}},
+		{CANID: 0x1ABCDEF0 | can.CAN_EFF_FLAG, Len: 8, Data: [64]byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		{CANID: 0x7FF | can.CAN_RTR_FLAG, Len: 3},
+		{CANID: 0x100, Len: 1, Data: [64]byte{0xee}},
+	}
+	// Replies (OK, BEL, z), a malformed line, a timestamped frame and a
+	// CRLF line mixed in.
+	stream := "\r\az\rt1232AB01\rT1ABCDEF080102030405060708\rtXYZ0\rr7FF3\r\nt1001ee1234\r"
+	var got []can.Frame
+	var buf bytes.Buffer
+	for i := 0; i < len(stream); i += 5 {
+		buf.WriteString(stream[i:min(i+5, len(stream))])
+		if err := DecodeStream(&buf, func(f can.Frame) { got = append(got, f) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d frames %+v, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("frame %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("leftover %q", buf.String())
+	}
+}
+
+func TestDecodeStreamGarbage(t *testing.T) {
+	buf := bytes.NewBufferString(string(bytes.Repeat([]byte{'x'}, maxLine+1)))
+	_ = DecodeStream(buf, func(can.Frame) { t.Fatal("frame from garbage") })
+	if buf.Len() != 0 {
+		t.Fatalf("garbage kept: %d bytes", buf.Len())
+	}
+}
+
+func TestOpen(t *testing.T) {
+	var b bytes.Buffer
+	if err := Open(&b, 125000); err != nil || b.String() != "\r\r\rC\rS4\rO\r" {
+		t.Fatalf("open: %q %v", b.String(), err)
+	}
+	b.Reset()
+	if err := Open(&b, 0); err != nil || b.String() != "\r\r\rC\rO\r" {
+		t.Fatalf("open keeping bitrate: %q %v", b.String(), err)
+	}
+	if err := Open(&b, 33000); err == nil {
+		t.Fatal("odd bitrate accepted")
+	}
+}
@@ -0,0 +1,67 @@
+package slcan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/logging"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/transport"
+	"github.com/kstaniek/go-ampio-server/internal/validate"
+)
+
+var ErrTxOverflow = errors.New("slcan tx overflow")
+
+// ErrFDUnsupported is returned for payloads over 8 bytes: SLCAN carries
+// classic CAN frames only.
+var ErrFDUnsupported = fmt.Errorf("slcan: payload over %d bytes: %w", validate.MaxDLC, transport.ErrUnsupported)
+
+// TXWriter funnels all SLCAN writes through one goroutine.
+type TXWriter struct{ base *transport.AsyncTx }
+
+// NewTXWriter creates an SLCAN TXWriter with a buffered channel of size buf.
+// opts configure the underlying AsyncTx (e.g. a priority queue).
+func NewTXWriter(parent context.Context, w io.Writer, buf int, opts ...transport.Option) *TXWriter {
+	send := func(fr can.Frame) error {
+		_, err := w.Write(Encode(fr))
+		return err
+	}
+	hooks := transport.Hooks{
+		OnError: func(err error) {
+			metrics.IncError(metrics.ErrSLCANWrite)
+			logging.L().Error("slcan_write_error", "error", err)
+		},
+		OnAfter: func() { metrics.IncSerialTx() },
+		OnDrop: func() error {
+			metrics.IncError(metrics.ErrSLCANOverflow)
+			return ErrTxOverflow
+		},
+	}
+	return &TXWriter{base: transport.NewAsyncTx(parent, buf, send, hooks, opts...)}
+}
+
+// SendFrame queues a frame for asynchronous write (drops with ErrTxOverflow if
+// buffer full, rejects CAN FD payloads with ErrFDUnsupported).
+func (w *TXWriter) SendFrame(fr can.Frame) error {
+	if fr.Len > validate.MaxDLC {
+		return ErrFDUnsupported
+	}
+	return w.base.SendFrame(fr)
+}
+
+// SendFrameWait queues a frame and blocks until it has been written (or failed).
+func (w *TXWriter) SendFrameWait(ctx context.Context, fr can.Frame) error {
+	if fr.Len > validate.MaxDLC {
+		return ErrFDUnsupported
+	}
+	return w.base.SendFrameWait(ctx, fr)
+}
+
+// Queue reports the TX queue depth and capacity.
+func (w *TXWriter) Queue() (depth, capacity int) { return w.base.Queue() }
+
+// Close stops the writer and waits for pending goroutine exit.
+func (w *TXWriter) Close() { w.base.Close() }
@@ -0,0 +1,308 @@
+// Package soak qualifies a build on target hardware: synthetic clients keep
+// connecting, sending and receiving through the running gateway while the
+// process resources are sampled. A resource that only ever grows over a
+// window of samples (goroutines, live heap, open file descriptors) is
+// flagged as a likely leak.
+package soak
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+)
+
+// CANID tags the frames synthetic clients send, so they are easy to tell
+// apart (and to filter out) on a real bus.
+const CANID = 0x0BE5A000 | can.CAN_EFF_FLAG
+
+// DefaultWindow is the number of samples a resource must grow over before
+// it is flagged.
+const DefaultWindow = 10
+
+// minHeapGrowth is the share the live heap must grow by over a window;
+// smaller changes are allocator noise.
+const minHeapGrowth = 0.01
+
+const dialTimeout = 3 * time.Second
+
+// Sample is one reading of the process resources.
+type Sample struct {
+	Time        time.Time
+	Goroutines  int
+	HeapAlloc   uint64 // live heap after a forced GC
+	HeapObjects uint64
+	FDs         int // open file descriptors, -1 where unknown
+}
+
+// Read samples the process. It forces a garbage collection first, so the
+// heap figures are live memory rather than GC timing.
+func Read() Sample {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return Sample{
+		Time:        time.Now(),
+		Goroutines:  runtime.NumGoroutine(),
+		HeapAlloc:   ms.HeapAlloc,
+		HeapObjects: ms.HeapObjects,
+		FDs:         openFDs(),
+	}
+}
+
+// openFDs counts the entries of /proc/self/fd (Linux); -1 elsewhere.
+func openFDs() int {
+	ents, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(ents) - 1 // the directory read itself holds one
+}
+
+// Growth is a resource that grew over every step of a window.
+type Growth struct {
+	Resource string // goroutines|heap_alloc|heap_objects|fds
+	From, To uint64
+	Window   time.Duration
+}
+
+// Detector keeps the last samples and reports monotonic growth.
+type Detector struct {
+	window  int
+	samples []Sample
+}
+
+// NewDetector returns a Detector over window samples (DefaultWindow if
+// below 2).
+func NewDetector(window int) *Detector {
+	if window < 2 {
+		window = DefaultWindow
+	}
+	return &Detector{window: window}
+}
+
+// Add records s and returns the resources that never decreased over the
+// last window samples while growing overall. A flagged resource is
+// reported again only after a full window of new samples.
+func (d *Detector) Add(s Sample) []Growth {
+	d.samples = append(d.samples, s)
+	if len(d.samples) < d.window {
+		return nil
+	}
+	win := d.samples[len(d.samples)-d.window:]
+	var out []Growth
+	for _, r := range []struct {
+		name string
+		val  func(Sample) int64
+		min  func(first int64) int64 // smallest overall growth to report
+	}{
+		{"goroutines", func(s Sample) int64 { return int64(s.Goroutines) }, nil},
+		{"heap_alloc", func(s Sample) int64 { return int64(s.HeapAlloc) }, heapMin},
+		{"heap_objects", func(s Sample) int64 { return int64(s.HeapObjects) }, heapMin},
+		{"fds", func(s Sample) int64 { return int64(s.FDs) }, nil},
+	} {
+		first, last := r.val(win[0]), r.val(win[len(win)-1])
+		if first < 0 || last <= first {
+			continue
+		}
+		if r.min != nil && last-first < r.min(first) {
+			continue
+		}
+		grew := true
+		for i := 1; i < len(win) && grew; i++ {
+			grew = r.val(win[i]) >= r.val(win[i-1])
+		}
+		if grew {
+			out = append(out, Growth{Resource: r.name, From: uint64(first), To: uint64(last), Window: win[len(win)-1].Time.Sub(win[0].Time)})
+		}
+	}
+	if len(out) > 0 {
+		d.samples = d.samples[:0]
+	} else {
+		d.samples = append(d.samples[:0], win[1:]...)
+	}
+	return out
+}
+
+func heapMin(first int64) int64 { return max(1, int64(float64(first)*minHeapGrowth)) }
+
+// Config configures a soak run.
+type Config struct {
+	Addrs    []string      // gateway listen addresses; clients spread over them
+	Clients  int           // synthetic clients
+	Rate     int           // frames per second, all clients together
+	Lifetime time.Duration // a client reconnects after this long (0 keeps it)
+	Interval time.Duration // resource sampling interval
+	Window   int           // samples a resource must grow over (0: DefaultWindow)
+	Logger   *slog.Logger
+}
+
+// Report is the outcome of a soak run.
+type Report struct {
+	Samples    int
+	First      Sample
+	Last       Sample
+	Growth     []Growth
+	Sent       uint64
+	Received   uint64
+	Reconnects uint64
+	Errors     uint64
+}
+
+type counters struct {
+	sent, received, reconnects, errors atomic.Uint64
+}
+
+// Run drives the clients and samples resources until ctx ends. The
+// baseline sample is taken once all clients had one interval to connect.
+func Run(ctx context.Context, cfg Config) Report {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	var (
+		c  counters
+		wg sync.WaitGroup
+	)
+	// Clients outlive ctx until the last sample is taken.
+	cctx, stop := context.WithCancel(context.WithoutCancel(ctx))
+	defer stop()
+	for i := range cfg.Clients {
+		per := float64(cfg.Rate) / float64(cfg.Clients)
+		addr := cfg.Addrs[i%len(cfg.Addrs)]
+		// Stagger the first reconnects so the clients do not churn in step.
+		first := cfg.Lifetime * time.Duration(i+1) / time.Duration(cfg.Clients)
+		wg.Add(1)
+		go func() { defer wg.Done(); client(cctx, addr, per, first, cfg.Lifetime, &c) }()
+	}
+	det := NewDetector(cfg.Window)
+	var rep Report
+	t := time.NewTicker(cfg.Interval)
+	defer t.Stop()
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-t.C:
+			s := Read()
+			if rep.Samples == 0 {
+				rep.First = s
+			}
+			rep.Last = s
+			rep.Samples++
+			cfg.Logger.Info("soak_sample", "goroutines", s.Goroutines, "heap_alloc", s.HeapAlloc, "heap_objects", s.HeapObjects,
+				"fds", s.FDs, "sent", c.sent.Load(), "received", c.received.Load(), "reconnects", c.reconnects.Load(), "errors", c.errors.Load())
+			for _, g := range det.Add(s) {
+				cfg.Logger.Warn("soak_growth", "resource", g.Resource, "from", g.From, "to", g.To, "window", g.Window)
+				rep.Growth = append(rep.Growth, g)
+			}
+		}
+	}
+	stop()
+	wg.Wait()
+	rep.Sent, rep.Received, rep.Reconnects, rep.Errors = c.sent.Load(), c.received.Load(), c.reconnects.Load(), c.errors.Load()
+	return rep
+}
+
+// client connects to addr and sends rate frames per second while draining
+// what the gateway sends back, reconnecting after lifetime (first for the
+// first connection) or an error.
+func client(ctx context.Context, addr string, rate float64, first, lifetime time.Duration, c *counters) {
+	for n := 0; ctx.Err() == nil; n++ {
+		life := lifetime
+		if n == 0 {
+			life = first
+		} else {
+			c.reconnects.Add(1)
+		}
+		err := session(ctx, addr, rate, life, c)
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		c.errors.Add(1)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// session runs one client connection; it returns nil when lifetime ended
+// it.
+func session(ctx context.Context, addr string, rate float64, lifetime time.Duration, c *counters) error {
+	d := net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := cnl.Handshake(ctx, conn, dialTimeout); err != nil {
+		return err
+	}
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if lifetime > 0 {
+		sctx, cancel = context.WithTimeout(sctx, lifetime)
+		defer cancel()
+	}
+	go func() {
+		<-sctx.Done()
+		_ = conn.Close() // unblocks the reader
+	}()
+	rerr := make(chan error, 1)
+	go func() {
+		codec := &cnl.Codec{}
+		r := bufio.NewReader(conn)
+		for {
+			if _, err := codec.Decode(r); err != nil {
+				rerr <- err
+				return
+			}
+			c.received.Add(1)
+		}
+	}()
+	codec := &cnl.Codec{}
+	var (
+		t    *time.Ticker
+		tick <-chan time.Time
+	)
+	if rate > 0 {
+		t = time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer t.Stop()
+		tick = t.C
+	}
+	var seq uint64
+	for {
+		select {
+		case <-sctx.Done():
+			<-rerr
+			return ctx.Err() // nil when lifetime ended the session
+		case err := <-rerr:
+			if sctx.Err() != nil {
+				return ctx.Err() // conn closed at the end of the session
+			}
+			return fmt.Errorf("read: %w", err)
+		case <-tick:
+			seq++
+			fr := can.Frame{CANID: CANID, Len: 8}
+			for i := range 8 {
+				fr.Data[i] = byte(seq >> (8 * i))
+			}
+			if _, err := codec.EncodeTo(conn, []can.Frame{fr}); err != nil {
+				if sctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("write: %w", err)
+			}
+			c.sent.Add(1)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package soak
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/server"
+)
+
+func TestDetector(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	d := NewDetector(3)
+	add := func(g, fds int, heap uint64) []Growth {
+		now = now.Add(time.Minute)
+		return d.Add(Sample{Time: now, Goroutines: g, FDs: fds, HeapAlloc: heap, HeapObjects: 1000})
+	}
+	if out := add(10, -1, 1000); out != nil {
+		t.Fatalf("first sample: %+v", out)
+	}
+	if out := add(11, -1, 1000); out != nil {
+		t.Fatalf("below window: %+v", out)
+	}
+	// Goroutines rose without a dip; the flat heap and unknown fds are fine.
+	out := add(11, -1, 1000)
+	if len(out) != 1 || out[0].Resource != "goroutines" || out[0].From != 10 || out[0].To != 11 || out[0].Window != 2*time.Minute {
+		t.Fatalf("growth: %+v", out)
+	}
+	// A reported resource needs a new full window.
+	if out := add(12, -1, 1000); out != nil {
+		t.Fatalf("after report: %+v", out)
+	}
+	if out := add(11, -1, 1000); out != nil {
+		t.Fatalf("dip: %+v", out)
+	}
+	// Heap noise below 1% is not growth; more is.
+	if out := add(11, -1, 1005); out != nil {
+		t.Fatalf("heap noise: %+v", out)
+	}
+	if out := add(11, -1, 1020); len(out) != 1 || out[0].Resource != "heap_alloc" {
+		t.Fatalf("heap growth: %+v", out)
+	}
+}
+
+func TestRead(t *testing.T) {
+	s := Read()
+	if s.Goroutines <= 0 || s.HeapAlloc == 0 || s.FDs == 0 {
+		t.Fatalf("sample: %+v", s)
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := hub.New()
+	srv := server.NewServer(
+		server.WithHub(h),
+		server.WithCodec(&cnl.Codec{}),
+		server.WithSend(func(fr can.Frame) error { h.Broadcast(fr); return nil }),
+		server.WithListenAddr("127.0.0.1:0"),
+	)
+	go func() { _ = srv.Serve(ctx) }()
+	select {
+	case <-srv.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("server not ready")
+	}
+	rctx, rcancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer rcancel()
+	rep := Run(rctx, Config{
+		Addrs:    []string{srv.Addr()},
+		Clients:  2,
+		Rate:     200,
+		Lifetime: 100 * time.Millisecond,
+		Interval: 50 * time.Millisecond,
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if rep.Samples == 0 || rep.Sent == 0 || rep.Received == 0 || rep.Reconnects == 0 || rep.Errors != 0 {
+		t.Fatalf("report: %+v", rep)
+	}
+}
@@ -4,23 +4,105 @@ package socketcan
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"time"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 
 	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+	"github.com/kstaniek/go-ampio-server/internal/validate"
 )
 
+// DefaultTxWait is how long WriteFrame waits for room in a full kernel TX
+// queue by default.
+const DefaultTxWait = 10 * time.Millisecond
+
+// txRetry bounds one wait for writability while the kernel queue is full.
+const txRetry = time.Millisecond
+
+// ErrNoBuffers reports a frame dropped because the kernel TX queue (the
+// interface txqueuelen) stayed full for the whole TX wait. It is a
+// socketcan TX overflow.
+var ErrNoBuffers = fmt.Errorf("%w: kernel tx queue full (ENOBUFS)", ErrTxOverflow)
+
+// ErrReadTimeout reports a read that saw no frame within the read timeout.
+var ErrReadTimeout = errors.New("socketcan: read timeout")
+
 type Device struct {
-	fd int
+	fd      int
+	spin    time.Duration
+	readTO  time.Duration
+	txWait  time.Duration
+	oob     []byte
+	latency time.Duration // moving average of kernel-to-user RX latency
 }
 
-func Open(iface string) (*Device, error) {
+type options struct {
+	loopback    bool
+	recvOwnMsgs bool
+	busyPoll    time.Duration
+	spin        time.Duration
+	readTimeout time.Duration
+	txWait      time.Duration
+	errMask     uint32
+}
+
+// Option configures a Device at Open.
+type Option func(*options)
+
+// WithLoopback sets CAN_RAW_LOOPBACK: when on (the kernel default), frames
+// written by this host are echoed to other CAN_RAW sockets on the interface.
+func WithLoopback(on bool) Option { return func(o *options) { o.loopback = on } }
+
+// WithRecvOwnMsgs sets CAN_RAW_RECV_OWN_MSGS: when on, frames written through
+// this socket are also received on it (requires loopback). Off by default.
+func WithRecvOwnMsgs(on bool) Option { return func(o *options) { o.recvOwnMsgs = on } }
+
+// WithBusyPoll sets SO_BUSY_POLL: the kernel busy-polls the device queue for
+// up to d before sleeping on a blocking read. Raising it above the
+// net.core.busy_read sysctl needs CAP_NET_ADMIN. 0 leaves the default.
+func WithBusyPoll(d time.Duration) Option { return func(o *options) { o.busyPoll = d } }
+
+// WithSpin makes reads spin with non-blocking receives for up to d after
+// each frame before blocking, trading one busy CPU for wake-up latency.
+func WithSpin(d time.Duration) Option { return func(o *options) { o.spin = d } }
+
+// WithReadTimeout makes a read that sees no frame for d return
+// ErrReadTimeout instead of blocking on a quiet bus. 0, the default,
+// blocks.
+func WithReadTimeout(d time.Duration) Option { return func(o *options) { o.readTimeout = d } }
+
+// WithTxWait sets how long WriteFrame waits for the kernel TX queue to
+// drain when a write fails with ENOBUFS before dropping the frame (0 drops
+// at once). The default is DefaultTxWait.
+func WithTxWait(d time.Duration) Option { return func(o *options) { o.txWait = d } }
+
+// WithErrFilter sets CAN_RAW_ERR_FILTER: error frames of the classes in
+// mask (see can.ParseErrMask) are received with CAN_ERR_FLAG set. 0, the
+// kernel default, receives none.
+func WithErrFilter(mask uint32) Option { return func(o *options) { o.errMask = mask } }
+
+func Open(iface string, opts ...Option) (*Device, error) {
+	o := options{loopback: true, txWait: DefaultTxWait}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	fd, err := unix.Socket(unix.AF_CAN, unix.SOCK_RAW, unix.CAN_RAW)
 	if err != nil {
 		return nil, fmt.Errorf("socket(AF_CAN): %w", err)
 	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_CAN_RAW, unix.CAN_RAW_LOOPBACK, boolInt(o.loopback)); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("set CAN_RAW_LOOPBACK: %w", err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_CAN_RAW, unix.CAN_RAW_RECV_OWN_MSGS, boolInt(o.recvOwnMsgs)); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("set CAN_RAW_RECV_OWN_MSGS: %w", err)
+	}
 	if err := unix.SetsockoptInt(fd, unix.SOL_CAN_RAW, unix.CAN_RAW_FD_FRAMES, 0); err != nil {
 		// Older kernels may not know this option; ignore ENOPROTOOPT
 		if err != unix.ENOPROTOOPT {
@@ -28,6 +110,23 @@ func Open(iface string) (*Device, error) {
 			return nil, fmt.Errorf("disable CAN FD: %w", err)
 		}
 	}
+	if o.errMask != 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_CAN_RAW, unix.CAN_RAW_ERR_FILTER, int(o.errMask)); err != nil {
+			_ = unix.Close(fd)
+			return nil, fmt.Errorf("set CAN_RAW_ERR_FILTER: %w", err)
+		}
+	}
+	if o.busyPoll > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_BUSY_POLL, int(o.busyPoll/time.Microsecond)); err != nil {
+			_ = unix.Close(fd)
+			return nil, fmt.Errorf("set SO_BUSY_POLL: %w", err)
+		}
+	}
+	// Kernel receive timestamps feed the RX latency gauge.
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("set SO_TIMESTAMPNS: %w", err)
+	}
 	ifi, err := net.InterfaceByName(iface)
 	if err != nil {
 		_ = unix.Close(fd)
@@ -38,20 +137,36 @@ func Open(iface string) (*Device, error) {
 		_ = unix.Close(fd)
 		return nil, fmt.Errorf("bind(can@%s): %w", iface, err)
 	}
-	return &Device{fd: fd}, nil
+	return &Device{fd: fd, spin: o.spin, readTO: o.readTimeout, txWait: o.txWait, oob: make([]byte, unix.CmsgSpace(int(unsafe.Sizeof(unix.Timespec{}))))}, nil
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 func (d *Device) Close() error { return unix.Close(d.fd) }
 
 // ReadFrame reads one classic CAN frame from the raw CAN socket.
 func (d *Device) ReadFrame(fr *can.Frame) error {
+	_, err := d.ReadFrameOwn(fr)
+	return err
+}
+
+// ReadFrameOwn reads one classic CAN frame and reports whether it was
+// transmitted through this socket (looped back by CAN_RAW_RECV_OWN_MSGS; the
+// kernel marks such frames with MSG_CONFIRM).
+func (d *Device) ReadFrameOwn(fr *can.Frame) (own bool, err error) {
 	var buf [unix.CAN_MTU]byte // classic CAN MTU = 16 bytes
-	n, err := unix.Read(d.fd, buf[:])
+	n, oobn, flags, err := d.recv(buf[:])
 	if err != nil {
-		return err
+		return false, err
 	}
+	d.observeLatency(d.oob[:oobn])
 	if n != unix.CAN_MTU {
-		return fmt.Errorf("short read: %d", n)
+		return false, fmt.Errorf("short read: %d", n)
 	}
 
 	// struct can_frame (linux/can.h):
@@ -64,23 +179,110 @@ func (d *Device) ReadFrame(fr *can.Frame) error {
 	// archs (little-endian) this matches binary.LittleEndian. If you ever
 	// target big-endian, switch to BigEndian here.
 	id := binary.LittleEndian.Uint32(buf[0:4])
-	dlc := int(buf[4])
-	if dlc < 0 || dlc > 8 {
-		dlc = 8
+	// A DLC above 8 is passed on for the hub to validate; only the 8 data
+	// bytes of the struct exist.
+	dlc := buf[4]
+	fr.CANID = id
+	fr.Len = dlc
+	if id&can.CAN_RTR_FLAG == 0 { // a remote request's DLC is the length asked for
+		copy(fr.Data[:], buf[8:8+min(dlc, validate.MaxDLC)])
 	}
+	return flags&unix.MSG_CONFIRM != 0, nil
+}
 
-	fr.CANID = id
-	fr.Len = uint8(dlc)
-	copy(fr.Data[:], buf[8:8+dlc])
-	return nil
+// recv reads one datagram. In spin mode it polls with MSG_DONTWAIT in a
+// tight loop for up to d.spin, then falls back to a blocking read. With a
+// read timeout it first waits for the socket to become readable. The
+// socket itself stays blocking, so writes and other users of the fd are
+// unaffected.
+func (d *Device) recv(p []byte) (n, oobn, flags int, err error) {
+	if d.spin > 0 {
+		start := time.Now()
+		for {
+			n, oobn, flags, _, err = unix.Recvmsg(d.fd, p, d.oob, unix.MSG_DONTWAIT)
+			if err != unix.EAGAIN || time.Since(start) >= d.spin {
+				break
+			}
+		}
+		if err != unix.EAGAIN {
+			return n, oobn, flags, err
+		}
+	}
+	if d.readTO > 0 {
+		pfd := []unix.PollFd{{Fd: int32(d.fd), Events: unix.POLLIN}}
+		ms := int((d.readTO + time.Millisecond - 1) / time.Millisecond)
+		switch n, err := unix.Poll(pfd, ms); {
+		case err == unix.EINTR || n == 0:
+			return 0, 0, 0, ErrReadTimeout
+		case err != nil:
+			return 0, 0, 0, err
+		}
+	}
+	n, oobn, flags, _, err = unix.Recvmsg(d.fd, p, d.oob, 0)
+	return n, oobn, flags, err
 }
 
-// WriteFrame writes one classic CAN frame to the raw CAN socket.
+// observeLatency folds the kernel receive timestamp in oob into the RX
+// latency gauge (moving average over ~16 frames).
+func (d *Device) observeLatency(oob []byte) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+	for _, m := range msgs {
+		if m.Header.Level != unix.SOL_SOCKET || m.Header.Type != unix.SCM_TIMESTAMPNS || len(m.Data) < int(unsafe.Sizeof(unix.Timespec{})) {
+			continue
+		}
+		ts := *(*unix.Timespec)(unsafe.Pointer(&m.Data[0]))
+		lat := time.Since(time.Unix(ts.Unix()))
+		if lat < 0 {
+			lat = 0
+		}
+		d.latency += (lat - d.latency) / 16
+		metrics.SetSocketCANLatency(d.latency)
+	}
+}
+
+// WriteFrame writes one classic CAN frame to the raw CAN socket. While the
+// kernel TX queue is full (ENOBUFS, or EAGAIN on a non-blocking socket) it
+// waits up to the TX wait for room, then drops the frame with ErrNoBuffers.
 func (d *Device) WriteFrame(fr can.Frame) error {
 	var buf [unix.CAN_MTU]byte
 	binary.LittleEndian.PutUint32(buf[0:4], fr.CANID)
 	buf[4] = fr.Len
-	copy(buf[8:], fr.Data[:fr.Len])
-	_, err := unix.Write(d.fd, buf[:])
-	return err
+	if fr.CANID&can.CAN_RTR_FLAG == 0 {
+		copy(buf[8:], fr.Data[:fr.Len])
+	}
+	var deadline time.Time
+	for {
+		_, err := unix.Write(d.fd, buf[:])
+		if err != unix.ENOBUFS && err != unix.EAGAIN {
+			return err
+		}
+		now := time.Now()
+		if deadline.IsZero() {
+			deadline = now.Add(d.txWait)
+		}
+		left := deadline.Sub(now)
+		if left <= 0 {
+			return fmt.Errorf("%w: waited %s", ErrNoBuffers, d.txWait)
+		}
+		d.waitWritable(min(left, txRetry))
+	}
+}
+
+// waitWritable waits up to max for the socket to become writable. A CAN
+// socket may report POLLOUT while the device queue is still full, so a
+// poll that returns early sleeps out the rest of max instead of letting
+// the caller spin on write.
+func (d *Device) waitWritable(max time.Duration) {
+	start := time.Now()
+	pfd := []unix.PollFd{{Fd: int32(d.fd), Events: unix.POLLOUT}}
+	ms := int((max + time.Millisecond - 1) / time.Millisecond)
+	if _, err := unix.Poll(pfd, ms); err != nil && err != unix.EINTR {
+		return
+	}
+	if rest := max - time.Since(start); rest > 0 {
+		time.Sleep(rest)
+	}
 }
@@ -0,0 +1,111 @@
+//go:build linux
+
+package socketcan
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+func TestObserveLatency(t *testing.T) {
+	size := int(unsafe.Sizeof(unix.Timespec{}))
+	oob := make([]byte, unix.CmsgSpace(size))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.SOL_SOCKET
+	h.Type = unix.SCM_TIMESTAMPNS
+	h.SetLen(unix.CmsgLen(size))
+	ts := unix.NsecToTimespec(time.Now().Add(-32 * time.Millisecond).UnixNano())
+	*(*unix.Timespec)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = ts
+
+	var d Device
+	for i := 0; i < 200; i++ {
+		d.observeLatency(oob)
+	}
+	if d.latency < 30*time.Millisecond || d.latency > time.Second {
+		t.Fatalf("latency %v, want about 32ms", d.latency)
+	}
+	if metrics.Snap().SocketCANLatency == 0 {
+		t.Fatal("latency gauge not set")
+	}
+}
+
+// fullSocket returns a non-blocking datagram socket whose send buffer is
+// full (writes fail with EAGAIN, like a CAN socket with a full TX queue)
+// and the peer to drain it from.
+func fullSocket(t *testing.T) (fd, peer int) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fds[0]); unix.Close(fds[1]) })
+	if err := unix.SetNonblock(fds[0], true); err != nil {
+		t.Fatal(err)
+	}
+	var buf [unix.CAN_MTU]byte
+	for {
+		if _, err := unix.Write(fds[0], buf[:]); err != nil {
+			if err != unix.EAGAIN {
+				t.Fatal(err)
+			}
+			return fds[0], fds[1]
+		}
+	}
+}
+
+func TestWriteFrameTxWait(t *testing.T) {
+	fd, peer := fullSocket(t)
+	d := Device{fd: fd, txWait: 20 * time.Millisecond}
+	start := time.Now()
+	err := d.WriteFrame(can.Frame{CANID: 0x123})
+	if !errors.Is(err, ErrNoBuffers) || !errors.Is(err, ErrTxOverflow) {
+		t.Fatalf("got %v, want ErrNoBuffers", err)
+	}
+	if el := time.Since(start); el < 20*time.Millisecond || el > time.Second {
+		t.Fatalf("gave up after %v, want about 20ms", el)
+	}
+
+	// Room appearing within the wait lets the write through.
+	d.txWait = time.Second
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		var buf [unix.CAN_MTU]byte
+		_, _ = unix.Read(peer, buf[:])
+	}()
+	if err := d.WriteFrame(can.Frame{CANID: 0x123}); err != nil {
+		t.Fatalf("write after drain: %v", err)
+	}
+}
+
+func TestRecvSpinKeepsSocketBlocking(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fds[0]); unix.Close(fds[1]) })
+	d := Device{fd: fds[0], spin: time.Millisecond, oob: make([]byte, 64)}
+	// The frame arrives after the spin window, so recv has to block.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		var buf [unix.CAN_MTU]byte
+		_, _ = unix.Write(fds[1], buf[:])
+	}()
+	var buf [unix.CAN_MTU]byte
+	if n, _, _, err := d.recv(buf[:]); err != nil || n != unix.CAN_MTU {
+		t.Fatalf("recv: n=%d err=%v", n, err)
+	}
+	fl, err := unix.FcntlInt(uintptr(fds[0]), unix.F_GETFL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fl&unix.O_NONBLOCK != 0 {
+		t.Fatal("spin mode left the socket non-blocking")
+	}
+}
@@ -0,0 +1,65 @@
+//go:build linux
+
+package socketcan
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// sysClassNet is the sysfs directory of network interfaces (a var for tests).
+var sysClassNet = "/sys/class/net"
+
+// TxQueueLen returns the length of the kernel TX queue of iface (the
+// txqueuelen of `ip link`), in frames.
+func TxQueueLen(iface string) (int, error) {
+	v, err := readLinkUint(iface, "tx_queue_len")
+	return int(v), err
+}
+
+// SetTxQueueLen sets the kernel TX queue length of iface to n frames. It
+// needs CAP_NET_ADMIN.
+func SetTxQueueLen(iface string, n int) error {
+	if n <= 0 {
+		return fmt.Errorf("txqueuelen %d: must be > 0", n)
+	}
+	ifr, err := unix.NewIfreq(iface)
+	if err != nil {
+		return fmt.Errorf("if %q: %w", iface, err)
+	}
+	ifr.SetUint32(uint32(n))
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("socket: %w", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFTXQLEN, ifr); err != nil {
+		return fmt.Errorf("set txqueuelen of %s: %w", iface, err)
+	}
+	return nil
+}
+
+// TxDropped returns the interface counter of frames dropped on the TX path
+// below the socket (driver and controller drops, statistics/tx_dropped).
+// Frames refused by a full queue are not included: those fail the write
+// with ENOBUFS and are counted by the writer.
+func TxDropped(iface string) (uint64, error) {
+	return readLinkUint(iface, filepath.Join("statistics", "tx_dropped"))
+}
+
+func readLinkUint(iface, attr string) (uint64, error) {
+	b, err := os.ReadFile(filepath.Join(sysClassNet, iface, attr))
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s/%s: %w", iface, attr, err)
+	}
+	return v, nil
+}
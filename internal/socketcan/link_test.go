@@ -0,0 +1,40 @@
+//go:build linux
+
+package socketcan
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkCounters(t *testing.T) {
+	root := t.TempDir()
+	old := sysClassNet
+	sysClassNet = root
+	defer func() { sysClassNet = old }()
+	if err := os.MkdirAll(filepath.Join(root, "can0", "statistics"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.WriteFile(filepath.Join(root, "can0", "tx_queue_len"), []byte("10\n"), 0o644)
+	_ = os.WriteFile(filepath.Join(root, "can0", "statistics", "tx_dropped"), []byte("42\n"), 0o644)
+
+	if n, err := TxQueueLen("can0"); err != nil || n != 10 {
+		t.Fatalf("TxQueueLen = %d, %v", n, err)
+	}
+	if n, err := TxDropped("can0"); err != nil || n != 42 {
+		t.Fatalf("TxDropped = %d, %v", n, err)
+	}
+	if _, err := TxDropped("can1"); err == nil {
+		t.Fatal("want error for a missing interface")
+	}
+}
+
+func TestSetTxQueueLenInvalid(t *testing.T) {
+	if err := SetTxQueueLen("lo", 0); err == nil {
+		t.Fatal("want error for length 0")
+	}
+	if err := SetTxQueueLen("no-such-if0", 10); err == nil {
+		t.Fatal("want error for a missing interface")
+	}
+}
@@ -2,7 +2,13 @@
 
 package socketcan
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 // ErrTxOverflow is provided for non-linux builds so server code can compile.
 var ErrTxOverflow = errors.New("socketcan tx overflow (stub)")
+
+// DefaultTxWait mirrors the Linux default so configuration code can compile.
+const DefaultTxWait = 10 * time.Millisecond
@@ -26,21 +26,36 @@ type Dev interface {
 type TXWriter struct{ base *transport.AsyncTx }
 
 // NewTXWriter creates a SocketCAN TXWriter with a buffered channel of size buf.
-func NewTXWriter(parent context.Context, dev Dev, buf int) *TXWriter {
+// opts configure the underlying AsyncTx (e.g. a priority queue).
+func NewTXWriter(parent context.Context, dev Dev, buf int, opts ...transport.Option) *TXWriter {
 	send := func(fr can.Frame) error { return dev.WriteFrame(fr) }
 	hooks := transport.Hooks{
-		OnError: func(err error) { metrics.IncError(metrics.ErrSocketCANWrite) },
+		OnError: func(err error) {
+			if errors.Is(err, ErrNoBuffers) {
+				metrics.IncError(metrics.ErrSocketCANNoBuf)
+				return
+			}
+			metrics.IncError(metrics.ErrSocketCANWrite)
+		},
 		OnAfter: func() { metrics.IncSocketCANTx() },
 		OnDrop: func() error {
 			metrics.IncError(metrics.ErrSocketCANOver)
 			return ErrTxOverflow
 		},
 	}
-	return &TXWriter{base: transport.NewAsyncTx(parent, buf, send, hooks)}
+	return &TXWriter{base: transport.NewAsyncTx(parent, buf, send, hooks, opts...)}
 }
 
 // SendFrame queues a frame for asynchronous device write (drops with ErrTxOverflow if buffer full).
 func (w *TXWriter) SendFrame(fr can.Frame) error { return w.base.SendFrame(fr) }
 
+// SendFrameWait queues a frame and blocks until it has been written (or failed).
+func (w *TXWriter) SendFrameWait(ctx context.Context, fr can.Frame) error {
+	return w.base.SendFrameWait(ctx, fr)
+}
+
+// Queue reports the TX queue depth and capacity.
+func (w *TXWriter) Queue() (depth, capacity int) { return w.base.Queue() }
+
 // Close stops the writer and waits for the worker goroutine to finish.
 func (w *TXWriter) Close() { w.base.Close() }
@@ -0,0 +1,291 @@
+package store
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/capture"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+)
+
+// Query limits of the HTTP API.
+const (
+	DefaultLimit = 1000
+	MaxLimit     = 100000
+)
+
+type frameJSON struct {
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance,omitempty"`
+	ID       string    `json:"id"`
+	Extended bool      `json:"extended,omitempty"`
+	RTR      bool      `json:"rtr,omitempty"`
+	Data     string    `json:"data"`
+}
+
+type stateJSON struct {
+	Instance  string    `json:"instance,omitempty"`
+	ID        string    `json:"id"`
+	Extended  bool      `json:"extended,omitempty"`
+	Data      string    `json:"data"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     uint64    `json:"count"`
+}
+
+type presenceJSON struct {
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance,omitempty"`
+	ID       string    `json:"id"`
+	Extended bool      `json:"extended,omitempty"`
+	Online   bool      `json:"online"`
+}
+
+func idString(canid uint32) (string, bool) {
+	if canid&can.CAN_EFF_FLAG != 0 {
+		return fmt.Sprintf("0x%08X", canid&can.CAN_EFF_MASK), true
+	}
+	return fmt.Sprintf("0x%03X", canid&can.CAN_SFF_MASK), false
+}
+
+// historyJSON is the answer of the history query: the frames of the window
+// and whether the store still holds all of it.
+type historyJSON struct {
+	From      *time.Time  `json:"from,omitempty"`
+	To        *time.Time  `json:"to,omitempty"`
+	Oldest    *time.Time  `json:"oldest,omitempty"`    // oldest frame still stored
+	Retention string      `json:"retention,omitempty"` // -store-retention, when set
+	Complete  bool        `json:"complete"`            // no frame of the window was deleted yet
+	Truncated bool        `json:"truncated"`           // more frames matched than the limit, the oldest were left out
+	Frames    []frameJSON `json:"frames"`
+}
+
+func toFrameJSON(frames []Frame) []frameJSON {
+	list := make([]frameJSON, 0, len(frames))
+	for _, f := range frames {
+		id, ext := idString(f.Frame.CANID)
+		list = append(list, frameJSON{Time: f.Time, Instance: f.Instance, ID: id, Extended: ext,
+			RTR: f.Frame.CANID&can.CAN_RTR_FLAG != 0, Data: hex.EncodeToString(f.Frame.Data[:f.Frame.Len])})
+	}
+	return list
+}
+
+func timeRef(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Handler serves the stored history under prefix (e.g. "/api/history"):
+//
+//	GET <prefix>           frames of a window with its retention status,
+//	                       JSON or candump text
+//	GET <prefix>/frames    stored frames, JSON or ?format=candump
+//	GET <prefix>/state     last frame of every ID
+//	GET <prefix>/presence  IDs appearing and going silent
+//
+// Common parameters: ?instance=, ?id= or ?ids= (filter list syntax),
+// ?from=/?since= and ?to=/?until= (RFC 3339 or a duration back from now,
+// e.g. 1h) and ?limit= (default DefaultLimit, at most MaxLimit).
+// retention is the age beyond which the store deletes history (0 = kept).
+func Handler(s Store, prefix string, retention time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q, err := parseQuery(r, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var out any
+		switch strings.TrimPrefix(r.URL.Path, prefix) {
+		case "", "/":
+			serveWindow(w, r, s, q, retention)
+			return
+		case "/frames":
+			frames, err := s.Frames(r.Context(), q)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if wantCandump(r) {
+				writeCandump(w, frames)
+				return
+			}
+			out = toFrameJSON(frames)
+		case "/state":
+			states, err := s.States(r.Context(), q)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			list := make([]stateJSON, 0, len(states))
+			for _, st := range states {
+				id, ext := idString(st.Frame.CANID)
+				list = append(list, stateJSON{Instance: st.Instance, ID: id, Extended: ext, Data: hex.EncodeToString(st.Frame.Data[:st.Frame.Len]),
+					FirstSeen: st.FirstSeen, LastSeen: st.LastSeen, Count: st.Count})
+			}
+			out = list
+		case "/presence":
+			changes, err := s.Presence(r.Context(), q)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			list := make([]presenceJSON, 0, len(changes))
+			for _, p := range changes {
+				id, ext := idString(p.CANID)
+				list = append(list, presenceJSON{Time: p.Time, Instance: p.Instance, ID: id, Extended: ext, Online: p.Online})
+			}
+			out = list
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	})
+}
+
+// serveWindow answers the history query: the frames of q and whether the
+// store still holds the whole window.
+func serveWindow(w http.ResponseWriter, r *http.Request, s Store, q Query, retention time.Duration) {
+	limit := q.Limit
+	q.Limit++ // one more tells whether the result was cut
+	frames, err := s.Frames(r.Context(), q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	oldest, haveOldest, err := s.Oldest(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pruned, err := s.Pruned(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out := historyJSON{From: timeRef(q.Since), To: timeRef(q.Until), Complete: true}
+	if len(frames) > limit {
+		frames, out.Truncated = frames[len(frames)-limit:], true
+	}
+	if haveOldest {
+		out.Oldest = &oldest
+	}
+	if retention > 0 {
+		out.Retention = retention.String()
+		out.Complete = !q.Since.IsZero() && !q.Since.Before(time.Now().Add(-retention))
+	}
+	if !pruned.IsZero() && !q.Since.After(pruned) {
+		out.Complete = false // the frame cap deleted part of the window
+	}
+	if wantCandump(r) {
+		if out.Oldest != nil {
+			w.Header().Set("X-History-Oldest", out.Oldest.UTC().Format(time.RFC3339Nano))
+		}
+		w.Header().Set("X-History-Complete", strconv.FormatBool(out.Complete))
+		w.Header().Set("X-History-Truncated", strconv.FormatBool(out.Truncated))
+		writeCandump(w, frames)
+		return
+	}
+	out.Frames = toFrameJSON(frames)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// wantCandump reports whether the client asked for candump text, with
+// ?format=candump or an Accept header preferring text/plain.
+func wantCandump(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "candump"
+	}
+	return strings.HasPrefix(r.Header.Get("Accept"), "text/plain")
+}
+
+// param returns the first non-empty of the query parameters names.
+func param(v url.Values, names ...string) (string, string) {
+	for _, n := range names {
+		if s := v.Get(n); s != "" {
+			return n, s
+		}
+	}
+	return names[0], ""
+}
+
+func parseQuery(r *http.Request, now time.Time) (Query, error) {
+	v := r.URL.Query()
+	q := Query{Instance: v.Get("instance"), Limit: DefaultLimit}
+	var err error
+	name, s := param(v, "from", "since")
+	if q.Since, err = parseTime(s, now); err != nil {
+		return q, fmt.Errorf("%s: %w", name, err)
+	}
+	name, s = param(v, "to", "until")
+	if q.Until, err = parseTime(s, now); err != nil {
+		return q, fmt.Errorf("%s: %w", name, err)
+	}
+	if _, s := param(v, "id", "ids"); s != "" {
+		f, err := filter.New(s, "")
+		if err != nil {
+			return q, fmt.Errorf("ids: %w", err)
+		}
+		q.Match = f.Allow
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > MaxLimit {
+			return q, fmt.Errorf("limit must be in [1, %d]", MaxLimit)
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+// parseTime accepts RFC 3339 or a duration back from now ("" is zero).
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// writeCandump writes frames as a candump log; the interface column is the
+// instance name ("can" for the unnamed single instance).
+func writeCandump(w http.ResponseWriter, frames []Frame) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-History-Frames", strconv.Itoa(len(frames)))
+	for i := 0; i < len(frames); {
+		j := i
+		for j < len(frames) && frames[j].Instance == frames[i].Instance {
+			j++
+		}
+		recs := make([]capture.Record, 0, j-i)
+		for _, f := range frames[i:j] {
+			recs = append(recs, capture.Record{Time: f.Time, Frame: f.Frame})
+		}
+		iface := frames[i].Instance
+		if iface == "" {
+			iface = "can"
+		}
+		if err := capture.WriteCandump(w, iface, recs); err != nil {
+			return
+		}
+		i = j
+	}
+}
@@ -0,0 +1,164 @@
+package store
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/clock"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// Recorder defaults.
+const (
+	DefaultFlushInterval = time.Second
+	DefaultBatch         = 1024
+	// MaxPending bounds the frames waiting for a write; a store that falls
+	// further behind loses frames rather than gateway memory.
+	MaxPending = 64 * 1024
+	// pruneInterval is how often retention is enforced.
+	pruneInterval = time.Minute
+)
+
+// RecorderConfig configures a Recorder. Zero durations disable the
+// corresponding policy.
+type RecorderConfig struct {
+	Retention       time.Duration // delete history older than this
+	MaxFrames       int           // keep at most this many frames
+	PresenceTimeout time.Duration // an ID silent this long is recorded offline
+	FlushInterval   time.Duration // default DefaultFlushInterval
+	Logger          *slog.Logger
+}
+
+type presenceKey struct {
+	instance string
+	canid    uint32
+}
+
+// Recorder batches frames into a Store, tracks ID presence and enforces
+// the retention policies.
+type Recorder struct {
+	store Store
+	cfg   RecorderConfig
+	now   func() time.Time
+	kick  chan struct{}
+
+	mu       sync.Mutex
+	frames   []Frame
+	presence []Presence
+	seen     map[presenceKey]time.Time
+}
+
+// NewRecorder returns a recorder writing to s once Run is started.
+func NewRecorder(s Store, cfg RecorderConfig) *Recorder {
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return &Recorder{store: s, cfg: cfg, now: clock.Now, kick: make(chan struct{}, 1), seen: make(map[presenceKey]time.Time)}
+}
+
+// Add queues fr, seen on instance, for the next write.
+func (r *Recorder) Add(instance string, fr can.Frame) {
+	now := r.now()
+	r.mu.Lock()
+	if len(r.frames) >= MaxPending {
+		r.mu.Unlock()
+		metrics.IncStoreDropped()
+		return
+	}
+	r.frames = append(r.frames, Frame{Instance: instance, Time: now, Frame: fr})
+	if r.cfg.PresenceTimeout > 0 {
+		k := presenceKey{instance, fr.CANID}
+		if _, ok := r.seen[k]; !ok {
+			r.presence = append(r.presence, Presence{Instance: instance, CANID: fr.CANID, Time: now, Online: true})
+		}
+		r.seen[k] = now
+	}
+	full := len(r.frames) >= DefaultBatch
+	r.mu.Unlock()
+	if full {
+		select {
+		case r.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run writes queued history every flush interval (or once a batch is
+// full) and prunes it every minute until ctx is done. Queued frames are
+// written before it returns.
+func (r *Recorder) Run(ctx context.Context) {
+	flush := time.NewTicker(r.cfg.FlushInterval)
+	defer flush.Stop()
+	prune := time.NewTicker(pruneInterval)
+	defer prune.Stop()
+	r.prune(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			// Shutdown: the run context is gone, give the last write its own.
+			wctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			r.flush(wctx)
+			cancel()
+			return
+		case <-r.kick:
+			r.flush(ctx)
+		case <-flush.C:
+			r.flush(ctx)
+		case <-prune.C:
+			r.prune(ctx)
+		}
+	}
+}
+
+// flush writes the queued frames and presence changes, first recording
+// IDs silent for longer than the presence timeout as offline.
+func (r *Recorder) flush(ctx context.Context) {
+	now := r.now()
+	r.mu.Lock()
+	if r.cfg.PresenceTimeout > 0 {
+		for k, last := range r.seen {
+			if now.Sub(last) >= r.cfg.PresenceTimeout {
+				r.presence = append(r.presence, Presence{Instance: k.instance, CANID: k.canid, Time: now, Online: false})
+				delete(r.seen, k)
+			}
+		}
+	}
+	frames, presence := r.frames, r.presence
+	r.frames, r.presence = nil, nil
+	r.mu.Unlock()
+	if len(frames) == 0 && len(presence) == 0 {
+		return
+	}
+	if err := r.store.Write(ctx, frames, presence); err != nil {
+		metrics.IncError(metrics.ErrStore)
+		metrics.AddStoreDropped(len(frames))
+		r.cfg.Logger.Warn("store_write_error", "frames", len(frames), "error", err)
+		return
+	}
+	metrics.AddStoreWritten(len(frames))
+}
+
+func (r *Recorder) prune(ctx context.Context) {
+	if r.cfg.Retention <= 0 && r.cfg.MaxFrames <= 0 {
+		return
+	}
+	var before time.Time
+	if r.cfg.Retention > 0 {
+		before = r.now().Add(-r.cfg.Retention)
+	}
+	n, err := r.store.Prune(ctx, before, r.cfg.MaxFrames)
+	if err != nil {
+		metrics.IncError(metrics.ErrStore)
+		r.cfg.Logger.Warn("store_prune_error", "error", err)
+		return
+	}
+	if n > 0 {
+		r.cfg.Logger.Debug("store_pruned", "frames", n)
+	}
+}
@@ -0,0 +1,303 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+
+	_ "modernc.org/sqlite" // pure Go driver: no cgo, cross-compiles for the gateways
+)
+
+func init() {
+	Register("sqlite", func(path string) (Store, error) {
+		if path == "" {
+			return nil, errors.New("want sqlite:<file>")
+		}
+		return OpenSQLite(path)
+	})
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS frames (
+	ts       INTEGER NOT NULL,
+	instance TEXT    NOT NULL,
+	canid    INTEGER NOT NULL,
+	data     BLOB    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS frames_ts ON frames (ts);
+CREATE INDEX IF NOT EXISTS frames_instance_ts ON frames (instance, ts);
+CREATE TABLE IF NOT EXISTS state (
+	instance   TEXT    NOT NULL,
+	canid      INTEGER NOT NULL,
+	data       BLOB    NOT NULL,
+	first_seen INTEGER NOT NULL,
+	last_seen  INTEGER NOT NULL,
+	count      INTEGER NOT NULL,
+	PRIMARY KEY (instance, canid)
+);
+CREATE TABLE IF NOT EXISTS presence (
+	ts       INTEGER NOT NULL,
+	instance TEXT    NOT NULL,
+	canid    INTEGER NOT NULL,
+	online   INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS presence_ts ON presence (ts);
+CREATE TABLE IF NOT EXISTS pruned (
+	id    INTEGER PRIMARY KEY CHECK (id = 0),
+	until INTEGER NOT NULL
+);
+`
+
+// SQLite is a Store in an embedded SQLite database file. Times are stored
+// as Unix nanoseconds and CAN IDs with their flag bits.
+type SQLite struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens (creating when needed) the database at path.
+func OpenSQLite(path string) (*SQLite, error) {
+	// WAL keeps readers off the writer; NORMAL sync only risks the last
+	// transactions on power loss, never corruption.
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// The recorder is the only writer; WAL lets queries run alongside it.
+	db.SetMaxOpenConns(4)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &SQLite{db: db}, nil
+}
+
+func (s *SQLite) Write(ctx context.Context, frames []Frame, presence []Presence) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	insFrame, err := tx.PrepareContext(ctx, `INSERT INTO frames (ts, instance, canid, data) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	upState, err := tx.PrepareContext(ctx, `INSERT INTO state (instance, canid, data, first_seen, last_seen, count) VALUES (?, ?, ?, ?, ?, 1)
+		ON CONFLICT (instance, canid) DO UPDATE SET data = excluded.data, last_seen = excluded.last_seen, count = count + 1`)
+	if err != nil {
+		return err
+	}
+	for _, f := range frames {
+		ts, data := f.Time.UnixNano(), f.Frame.Data[:f.Frame.Len]
+		if _, err := insFrame.ExecContext(ctx, ts, f.Instance, int64(f.Frame.CANID), data); err != nil {
+			return err
+		}
+		if _, err := upState.ExecContext(ctx, f.Instance, int64(f.Frame.CANID), data, ts, ts); err != nil {
+			return err
+		}
+	}
+	for _, p := range presence {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO presence (ts, instance, canid, online) VALUES (?, ?, ?, ?)`,
+			p.Time.UnixNano(), p.Instance, int64(p.CANID), p.Online); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// where builds the instance and time conditions of q for a table with a
+// "ts" column.
+func (q Query) where() (string, []any) {
+	cond, args := "1=1", []any(nil)
+	if q.Instance != "" {
+		cond += " AND instance = ?"
+		args = append(args, q.Instance)
+	}
+	if !q.Since.IsZero() {
+		cond += " AND ts >= ?"
+		args = append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		cond += " AND ts < ?"
+		args = append(args, q.Until.UnixNano())
+	}
+	return cond, args
+}
+
+func (q Query) match(fr *can.Frame) bool { return q.Match == nil || q.Match(fr) }
+
+func (q Query) full(n int) bool { return q.Limit > 0 && n >= q.Limit }
+
+// order is the ORDER BY of a time-ordered table: a limited query scans
+// newest first so it keeps the newest rows, and reverses them afterwards.
+func (q Query) order() string {
+	if q.Limit > 0 {
+		return " ORDER BY ts DESC, rowid DESC"
+	}
+	return " ORDER BY ts, rowid"
+}
+
+// chronological puts rows read in q.order() oldest first.
+func chronological[T any](q Query, rows []T) []T {
+	if q.Limit > 0 {
+		slices.Reverse(rows)
+	}
+	return rows
+}
+
+func (s *SQLite) Frames(ctx context.Context, q Query) ([]Frame, error) {
+	cond, args := q.where()
+	rows, err := s.db.QueryContext(ctx, `SELECT ts, instance, canid, data FROM frames WHERE `+cond+q.order(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Frame
+	for rows.Next() && !q.full(len(out)) {
+		var (
+			f     Frame
+			ts    int64
+			canid int64
+			data  []byte
+		)
+		if err := rows.Scan(&ts, &f.Instance, &canid, &data); err != nil {
+			return nil, err
+		}
+		f.Time, f.Frame = time.Unix(0, ts), makeFrame(canid, data)
+		if q.match(&f.Frame) {
+			out = append(out, f)
+		}
+	}
+	return chronological(q, out), rows.Err()
+}
+
+func (s *SQLite) States(ctx context.Context, q Query) ([]State, error) {
+	cond, args := "1=1", []any(nil)
+	if q.Instance != "" {
+		cond, args = "instance = ?", []any{q.Instance}
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT instance, canid, data, first_seen, last_seen, count FROM state WHERE `+cond+` ORDER BY instance, canid`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []State
+	for rows.Next() && !q.full(len(out)) {
+		var (
+			st          State
+			canid       int64
+			data        []byte
+			first, last int64
+		)
+		if err := rows.Scan(&st.Instance, &canid, &data, &first, &last, &st.Count); err != nil {
+			return nil, err
+		}
+		st.Frame, st.FirstSeen, st.LastSeen = makeFrame(canid, data), time.Unix(0, first), time.Unix(0, last)
+		if q.match(&st.Frame) {
+			out = append(out, st)
+		}
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLite) Presence(ctx context.Context, q Query) ([]Presence, error) {
+	cond, args := q.where()
+	rows, err := s.db.QueryContext(ctx, `SELECT ts, instance, canid, online FROM presence WHERE `+cond+q.order(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Presence
+	for rows.Next() && !q.full(len(out)) {
+		var (
+			p     Presence
+			ts    int64
+			canid int64
+		)
+		if err := rows.Scan(&ts, &p.Instance, &canid, &p.Online); err != nil {
+			return nil, err
+		}
+		p.Time, p.CANID = time.Unix(0, ts), uint32(canid)
+		if q.match(&can.Frame{CANID: p.CANID}) {
+			out = append(out, p)
+		}
+	}
+	return chronological(q, out), rows.Err()
+}
+
+func (s *SQLite) Oldest(ctx context.Context) (time.Time, bool, error) {
+	var ts sql.NullInt64
+	if err := s.db.QueryRowContext(ctx, `SELECT MIN(ts) FROM frames`).Scan(&ts); err != nil || !ts.Valid {
+		return time.Time{}, false, err
+	}
+	return time.Unix(0, ts.Int64), true, nil
+}
+
+func (s *SQLite) Pruned(ctx context.Context) (time.Time, error) {
+	var ts int64
+	err := s.db.QueryRowContext(ctx, `SELECT until FROM pruned WHERE id = 0`).Scan(&ts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ts), nil
+}
+
+func (s *SQLite) Prune(ctx context.Context, before time.Time, maxFrames int) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var n int64
+	if !before.IsZero() {
+		cut := before.UnixNano()
+		res, err := tx.ExecContext(ctx, `DELETE FROM frames WHERE ts < ?`, cut)
+		if err != nil {
+			return 0, err
+		}
+		n, _ = res.RowsAffected()
+		if _, err := tx.ExecContext(ctx, `DELETE FROM presence WHERE ts < ?`, cut); err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM state WHERE last_seen < ?`, cut); err != nil {
+			return 0, err
+		}
+	}
+	if maxFrames > 0 {
+		// Remember the newest frame cut by the cap: history windows reaching
+		// back to it are no longer complete.
+		var cut int64
+		err := tx.QueryRowContext(ctx, `SELECT ts FROM frames ORDER BY ts DESC, rowid DESC LIMIT 1 OFFSET ?`, maxFrames).Scan(&cut)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			return 0, err
+		default:
+			if _, err := tx.ExecContext(ctx, `INSERT INTO pruned (id, until) VALUES (0, ?) ON CONFLICT (id) DO UPDATE SET until = max(until, excluded.until)`, cut); err != nil {
+				return 0, err
+			}
+		}
+		res, err := tx.ExecContext(ctx, `DELETE FROM frames WHERE rowid IN (SELECT rowid FROM frames ORDER BY ts DESC, rowid DESC LIMIT -1 OFFSET ?)`, maxFrames)
+		if err != nil {
+			return 0, err
+		}
+		m, _ := res.RowsAffected()
+		n += m
+	}
+	return n, tx.Commit()
+}
+
+func (s *SQLite) Close() error { return s.db.Close() }
+
+func makeFrame(canid int64, data []byte) can.Frame {
+	fr := can.Frame{CANID: uint32(canid), Len: uint8(min(len(data), len(can.Frame{}.Data)))}
+	copy(fr.Data[:], data)
+	return fr
+}
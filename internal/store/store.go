@@ -0,0 +1,125 @@
+// Package store persists bus history on the gateway itself: captured
+// frames, the last frame of every CAN ID and when IDs appeared or went
+// silent, so short-term history survives restarts. Backends are registered
+// by name and opened from a "name:arg" spec (e.g.
+// "sqlite:/var/lib/can-server/history.db").
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+// Frame is one stored bus frame.
+type Frame struct {
+	Instance string
+	Time     time.Time
+	Frame    can.Frame
+}
+
+// State is the last frame seen with one CAN ID.
+type State struct {
+	Instance  string
+	Frame     can.Frame // the last frame; Frame.CANID identifies the row
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Count     uint64
+}
+
+// Presence records a CAN ID appearing on a bus or going silent.
+type Presence struct {
+	Instance string
+	CANID    uint32
+	Time     time.Time
+	Online   bool
+}
+
+// Query selects stored history. Zero fields do not restrict the result.
+type Query struct {
+	Instance string
+	Since    time.Time
+	Until    time.Time
+	Match    func(*can.Frame) bool // CAN ID selection, applied to frames and presence
+	Limit    int
+}
+
+// Store is a persistent history backend. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	// Write stores frames (updating the per-ID state) and presence changes
+	// in one transaction.
+	Write(ctx context.Context, frames []Frame, presence []Presence) error
+	// Frames returns stored frames, oldest first. With q.Limit it returns
+	// the newest q.Limit frames.
+	Frames(ctx context.Context, q Query) ([]Frame, error)
+	// Oldest returns the time of the oldest stored frame, false when there
+	// is none.
+	Oldest(ctx context.Context) (time.Time, bool, error)
+	// States returns the last state of every ID of q.Instance (all
+	// instances when empty), ordered by instance and ID.
+	States(ctx context.Context, q Query) ([]State, error)
+	// Presence returns presence changes, oldest first. With q.Limit it
+	// returns the newest q.Limit changes.
+	Presence(ctx context.Context, q Query) ([]Presence, error)
+	// Pruned returns the time of the newest frame deleted by the maxFrames
+	// cap of Prune, zero when the cap never deleted any.
+	Pruned(ctx context.Context) (time.Time, error)
+	// Prune deletes frames, presence changes and states older than before
+	// (unless zero) and, when maxFrames > 0, the oldest frames beyond maxFrames. It
+	// returns the number of deleted frames.
+	Prune(ctx context.Context, before time.Time, maxFrames int) (int64, error)
+	Close() error
+}
+
+// Factory opens a store from the argument after "name:" in a spec.
+type Factory func(arg string) (Store, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a backend available to Open under name. It panics on a
+// duplicate name.
+func Register(name string, f Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, dup := registry[name]; dup {
+		panic("store: backend " + name + " registered twice")
+	}
+	registry[name] = f
+}
+
+// Available lists the registered backend names.
+func Available() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for n := range registry {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open opens the store described by spec, "name:arg".
+func Open(spec string) (Store, error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	registryMu.RLock()
+	f := registry[name]
+	registryMu.RUnlock()
+	if f == nil {
+		return nil, fmt.Errorf("unknown store %q (have %s)", name, strings.Join(Available(), ", "))
+	}
+	s, err := f(arg)
+	if err != nil {
+		return nil, fmt.Errorf("store %s: %w", name, err)
+	}
+	return s, nil
+}
@@ -0,0 +1,227 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func openTest(t *testing.T) *SQLite {
+	t.Helper()
+	s, err := OpenSQLite(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func fr(id uint32, data ...byte) can.Frame {
+	f := can.Frame{CANID: id, Len: uint8(len(data))}
+	copy(f.Data[:], data)
+	return f
+}
+
+func TestOpenUnknown(t *testing.T) {
+	if _, err := Open("nope:x"); err == nil || !strings.Contains(err.Error(), "sqlite") {
+		t.Fatalf("err = %v, want the available backends listed", err)
+	}
+	if _, err := Open("sqlite"); err == nil {
+		t.Fatal("sqlite without a path accepted")
+	}
+}
+
+func TestSQLiteHistory(t *testing.T) {
+	ctx := context.Background()
+	s := openTest(t)
+	t0 := time.Unix(1000, 0)
+	frames := []Frame{
+		{Instance: "a", Time: t0, Frame: fr(0x100, 1)},
+		{Instance: "a", Time: t0.Add(time.Second), Frame: fr(0x100, 2)},
+		{Instance: "b", Time: t0.Add(2 * time.Second), Frame: fr(0x1D000123|can.CAN_EFF_FLAG, 0xAA, 0xBB)},
+	}
+	presence := []Presence{{Instance: "a", CANID: 0x100, Time: t0, Online: true}}
+	if err := s.Write(ctx, frames, presence); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	got, err := s.Frames(ctx, Query{Since: t0.Add(time.Second)})
+	if err != nil || len(got) != 2 || got[0].Frame.Data[0] != 2 || got[1].Frame.CANID != 0x1D000123|can.CAN_EFF_FLAG || got[1].Frame.Len != 2 {
+		t.Fatalf("frames since = %+v, %v", got, err)
+	}
+	if got, _ := s.Frames(ctx, Query{Limit: 2}); len(got) != 2 || got[0].Frame.Data[0] != 2 || got[1].Frame.Data[0] != 0xAA {
+		t.Fatalf("limited frames = %+v, want the newest two, oldest first", got)
+	}
+	if ts, ok, err := s.Oldest(ctx); err != nil || !ok || !ts.Equal(t0) {
+		t.Fatalf("oldest = %v, %v, %v", ts, ok, err)
+	}
+	states, err := s.States(ctx, Query{Instance: "a"})
+	if err != nil || len(states) != 1 {
+		t.Fatalf("states = %+v, %v", states, err)
+	}
+	if st := states[0]; st.Frame.Data[0] != 2 || st.Count != 2 || !st.FirstSeen.Equal(t0) || !st.LastSeen.Equal(t0.Add(time.Second)) {
+		t.Fatalf("state = %+v", st)
+	}
+	if p, _ := s.Presence(ctx, Query{}); len(p) != 1 || !p[0].Online || p[0].CANID != 0x100 {
+		t.Fatalf("presence = %+v", p)
+	}
+
+	n, err := s.Prune(ctx, t0.Add(1500*time.Millisecond), 0)
+	if err != nil || n != 2 {
+		t.Fatalf("prune by age = %d, %v; want 2", n, err)
+	}
+	if states, _ := s.States(ctx, Query{}); len(states) != 1 || states[0].Instance != "b" {
+		t.Fatalf("states after prune = %+v", states)
+	}
+	if p, _ := s.Presence(ctx, Query{}); len(p) != 0 {
+		t.Fatalf("presence after prune = %+v", p)
+	}
+	_ = s.Write(ctx, []Frame{{Instance: "b", Time: t0.Add(3 * time.Second), Frame: fr(0x200)}}, nil)
+	if n, err := s.Prune(ctx, time.Time{}, 1); err != nil || n != 1 {
+		t.Fatalf("prune by count = %d, %v; want 1", n, err)
+	}
+	if got, _ := s.Frames(ctx, Query{}); len(got) != 1 || got[0].Frame.CANID != 0x200 {
+		t.Fatalf("frames after count prune = %+v", got)
+	}
+	if ts, err := s.Pruned(ctx); err != nil || !ts.Equal(t0.Add(2*time.Second)) {
+		t.Fatalf("pruned = %v, %v; want the newest deleted frame", ts, err)
+	}
+}
+
+func TestRecorderPresence(t *testing.T) {
+	ctx := context.Background()
+	s := openTest(t)
+	rec := NewRecorder(s, RecorderConfig{PresenceTimeout: time.Minute})
+	now := time.Unix(1000, 0)
+	rec.now = func() time.Time { return now }
+	rec.Add("", fr(0x100, 1))
+	rec.Add("", fr(0x100, 2))
+	rec.flush(ctx)
+	now = now.Add(2 * time.Minute)
+	rec.Add("", fr(0x200))
+	rec.flush(ctx) // 0x100 has been silent for the timeout
+	p, err := s.Presence(ctx, Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range p {
+		id, _ := idString(c.CANID)
+		got = append(got, fmt.Sprintf("%s=%t", id, c.Online))
+	}
+	if want := "0x100=true,0x200=true,0x100=false"; strings.Join(got, ",") != want {
+		t.Fatalf("presence = %v, want %s", got, want)
+	}
+	if f, _ := s.Frames(ctx, Query{}); len(f) != 3 {
+		t.Fatalf("stored %d frames, want 3", len(f))
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s := openTest(t)
+	now := time.Now()
+	_ = s.Write(context.Background(), []Frame{
+		{Time: now.Add(-2 * time.Hour), Frame: fr(0x100, 1)},
+		{Time: now.Add(-time.Minute), Frame: fr(0x101, 2)},
+		{Time: now.Add(-time.Minute), Frame: fr(0x300, 3)},
+	}, nil)
+	srv := httptest.NewServer(Handler(s, "/api/history", 0))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/history/frames?since=1h&ids=0x100-0x1FF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []frameJSON
+	_ = json.NewDecoder(resp.Body).Decode(&frames)
+	resp.Body.Close()
+	if len(frames) != 1 || frames[0].ID != "0x101" || frames[0].Data != "02" {
+		t.Fatalf("frames = %+v", frames)
+	}
+
+	resp, _ = http.Get(srv.URL + "/api/history/state")
+	var states []stateJSON
+	_ = json.NewDecoder(resp.Body).Decode(&states)
+	resp.Body.Close()
+	if len(states) != 3 || states[2].ID != "0x300" || states[2].Count != 1 {
+		t.Fatalf("states = %+v", states)
+	}
+
+	for _, u := range []string{"/api/history/frames?limit=0", "/api/history/frames?since=yesterday", "/api/history/frames?ids=zz"} {
+		resp, _ := http.Get(srv.URL + u)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", u, resp.StatusCode)
+		}
+	}
+	resp, _ = http.Get(srv.URL + "/api/history/nope")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown path: status %d", resp.StatusCode)
+	}
+}
+
+func TestHandlerWindow(t *testing.T) {
+	s := openTest(t)
+	now := time.Now()
+	_ = s.Write(context.Background(), []Frame{
+		{Time: now.Add(-30 * time.Minute), Frame: fr(0x1E5A, 1)},
+		{Time: now.Add(-20 * time.Minute), Frame: fr(0x1E5A, 2)},
+		{Time: now.Add(-10 * time.Minute), Frame: fr(0x1E5A, 3)},
+		{Time: now.Add(-10 * time.Minute), Frame: fr(0x100, 4)},
+	}, nil)
+	srv := httptest.NewServer(Handler(s, "/api/history", time.Hour))
+	defer srv.Close()
+
+	get := func(query string) historyJSON {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/api/history?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var h historyJSON
+		if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return h
+	}
+	h := get("id=0x1E5A&from=25m&to=5m")
+	if len(h.Frames) != 2 || h.Frames[0].Data != "02" || !h.Complete || h.Truncated || h.Retention != "1h0m0s" {
+		t.Fatalf("window = %+v", h)
+	}
+	if h.Oldest == nil || !h.Oldest.Equal(now.Add(-30*time.Minute)) {
+		t.Fatalf("oldest = %v", h.Oldest)
+	}
+	if h := get("id=0x1E5A&from=2h&limit=2"); h.Complete || !h.Truncated || len(h.Frames) != 2 || h.Frames[0].Data != "02" {
+		t.Fatalf("window beyond retention = %+v", h)
+	}
+	_, _ = s.Prune(context.Background(), time.Time{}, 3) // the cap deletes frame 1
+	if h := get("id=0x1E5A&from=25m&to=5m"); !h.Complete {
+		t.Fatalf("window after the cut frame = %+v", h)
+	}
+	if h := get("id=0x1E5A&from=35m&to=5m"); h.Complete {
+		t.Fatalf("window reaching a frame deleted by the cap = %+v", h)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/history?id=0x100", nil)
+	req.Header.Set("Accept", "text/plain")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasSuffix(strings.TrimSpace(string(body)), "can 100#04") || resp.Header.Get("X-History-Complete") != "false" {
+		t.Fatalf("candump = %q (complete %q)", body, resp.Header.Get("X-History-Complete"))
+	}
+}
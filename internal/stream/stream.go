@@ -0,0 +1,126 @@
+// Package stream serves live bus frames over HTTP as server-sent events,
+// optionally annotated by the decoders a subscriber asks for.
+package stream
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/annotate"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/clock"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/instances"
+)
+
+// Buffer is the per-subscriber hub buffer; a subscriber that cannot keep up
+// loses frames (or is closed) by the hub backpressure policy like any client.
+const Buffer = 512
+
+// keepAlive is the interval of comment lines keeping idle streams open
+// through proxies.
+const keepAlive = 15 * time.Second
+
+// Event is one frame of the stream, sent as the JSON data of an SSE event.
+type Event struct {
+	Time     time.Time `json:"time"`
+	ID       string    `json:"id"`
+	Extended bool      `json:"extended,omitempty"`
+	RTR      bool      `json:"rtr,omitempty"`
+	Data     string    `json:"data"`
+	Note     string    `json:"note,omitempty"`
+	// ClockStep is the wall clock step in seconds detected since the
+	// previous event, set on the first event after it.
+	ClockStep float64 `json:"clock_step,omitempty"`
+}
+
+// Handler streams the frames of an instance hub as text/event-stream.
+// ?instance= selects the hub (optional with a single instance) and
+// ?annotate=<decoders|all> picks the annotations of ann for this subscriber.
+func Handler(hubs map[string]*hub.Hub, ann *annotate.Pipeline) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h, err := instances.Pick(hubs, r.URL.Query().Get("instance"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		notes, err := ann.Select(r.URL.Query().Get("annotate"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fl, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		cl := &hub.Client{Out: make(chan can.Frame, Buffer), Closed: make(chan struct{})}
+		h.Add(cl)
+		defer h.Remove(cl)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		fl.Flush()
+		tick := time.NewTicker(keepAlive)
+		defer tick.Stop()
+		steps := newStepFlag()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-cl.Closed:
+				return
+			case <-tick.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			case fr := <-cl.Out:
+				ev := newEvent(&fr, notes)
+				steps.mark(&ev)
+				b, _ := json.Marshal(ev)
+				if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+					return
+				}
+			}
+			fl.Flush()
+		}
+	})
+}
+
+func newEvent(fr *can.Frame, notes *annotate.Pipeline) Event {
+	ev := Event{
+		Time:     clock.Now().UTC(),
+		Extended: fr.CANID&can.CAN_EFF_FLAG != 0,
+		RTR:      fr.CANID&can.CAN_RTR_FLAG != 0,
+		Data:     hex.EncodeToString(fr.Data[:min(int(fr.Len), len(fr.Data))]),
+		Note:     notes.Annotate(fr),
+	}
+	if ev.Extended {
+		ev.ID = fmt.Sprintf("0x%08X", fr.CANID&can.CAN_EFF_MASK)
+	} else {
+		ev.ID = fmt.Sprintf("0x%03X", fr.CANID&can.CAN_SFF_MASK)
+	}
+	return ev
+}
+
+// stepFlag flags the first event a subscriber receives after a clock step.
+type stepFlag uint64
+
+func newStepFlag() stepFlag {
+	n, _ := clock.Steps()
+	return stepFlag(n)
+}
+
+func (s *stepFlag) mark(ev *Event) {
+	if n, step := clock.Steps(); uint64(*s) != n {
+		*s, ev.ClockStep = stepFlag(n), step.Seconds()
+	}
+}
@@ -0,0 +1,69 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/annotate"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+func TestHandlerStreamsAnnotatedFrames(t *testing.T) {
+	h := hub.New()
+	ann, err := annotate.New("ampio,j1939")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(Handler(map[string]*hub.Hub{"": h}, ann))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"?annotate=ampio", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+	h.Broadcast(can.Frame{CANID: 0x1D0000AB | can.CAN_EFF_FLAG, Len: 2, Data: [64]byte{0x05, 0xFF}})
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line, ok := strings.CutPrefix(sc.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var ev Event
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.ID != "0x1D0000AB" || !ev.Extended || ev.Data != "05ff" || ev.Note != "ampio module=0000AB type=0x05" {
+			t.Fatalf("event = %+v", ev)
+		}
+		return
+	}
+	t.Fatalf("stream ended: %v", sc.Err())
+}
+
+func TestHandlerErrors(t *testing.T) {
+	ann, _ := annotate.New("j1939")
+	h := Handler(map[string]*hub.Hub{"a": hub.New(), "b": hub.New()}, ann)
+	for q, want := range map[string]int{
+		"":                        http.StatusNotFound,
+		"instance=a&annotate=dbc": http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/stream?"+q, nil))
+		if rec.Code != want {
+			t.Fatalf("%q: status %d, want %d", q, rec.Code, want)
+		}
+	}
+}
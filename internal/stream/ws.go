@@ -0,0 +1,246 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/kstaniek/go-ampio-server/internal/access"
+	"github.com/kstaniek/go-ampio-server/internal/annotate"
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/instances"
+	"github.com/kstaniek/go-ampio-server/internal/logging"
+)
+
+// Target is an instance WebSocket clients attach to.
+type Target struct {
+	Hub *hub.Hub
+	// Send transmits a client frame; nil makes the instance receive-only.
+	Send func(can.Frame) error
+}
+
+// WebSocket serves the frames of an instance hub over a WebSocket in both
+// directions, as a hub client like any TCP client. ?instance= selects the
+// target as for Handler and ?format= the messages:
+//
+//   - json (default): one text message per frame, an Event as sent by
+//     Handler (?annotate= applies). Clients send frames as the same objects;
+//     only id, extended, rtr and data are read. Rejected frames are answered
+//     with {"error": "..."}.
+//   - binary: one binary message per received frame in cannelloni wire
+//     encoding. Clients may pack several frames into one message; rejected
+//     frames are dropped.
+//
+// Sending requires the access.Send permission when the API has tokens.
+// Browsers may only connect from the server's own origin or one listed in
+// origins (see ParseOrigins).
+func WebSocket(targets map[string]Target, ann *annotate.Pipeline, origins []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		t, err := instances.Pick(targets, q.Get("instance"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		binary := false
+		switch f := q.Get("format"); f {
+		case "", "json":
+		case "binary":
+			binary = true
+		default:
+			http.Error(w, fmt.Sprintf("unknown format %q (have json, binary)", f), http.StatusBadRequest)
+			return
+		}
+		notes, err := ann.Select(q.Get("annotate"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c := &wsClient{target: t, binary: binary, notes: notes}
+		c.id, c.authed = access.FromContext(r.Context())
+		websocket.Server{
+			Handshake: func(_ *websocket.Config, r *http.Request) error { return checkOrigin(r, origins) },
+			Handler:   c.serve,
+		}.ServeHTTP(w, r)
+	})
+}
+
+// ParseOrigins parses a comma-separated list of browser origins such as
+// https://dash.lan:8443; "*" allows every origin.
+func ParseOrigins(s string) ([]string, error) {
+	var out []string
+	for _, o := range strings.Split(s, ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		if o != "*" {
+			u, err := url.Parse(o)
+			if err != nil || u.Scheme == "" || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+				return nil, fmt.Errorf("invalid origin %q (want scheme://host[:port])", o)
+			}
+			o = u.Scheme + "://" + u.Host
+		}
+		out = append(out, o)
+	}
+	return out, nil
+}
+
+// checkOrigin refuses the handshake of a browser page from another site,
+// which would otherwise use the socket with the browser's access (cross-site
+// WebSocket hijacking). Requests without Origin come from non-browser
+// clients and pass.
+func checkOrigin(r *http.Request, allowed []string) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return nil
+	}
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return nil
+		}
+	}
+	logging.L().Warn("ws_origin_denied", "origin", origin, "remote", r.RemoteAddr)
+	return fmt.Errorf("origin %q not allowed", origin)
+}
+
+// wsClient is one WebSocket connection.
+type wsClient struct {
+	target Target
+	binary bool
+	notes  *annotate.Pipeline
+	id     access.Identity
+	authed bool // id is set (the API has tokens)
+	codec  cnl.Codec
+}
+
+func (c *wsClient) serve(ws *websocket.Conn) {
+	l := logging.L().With("remote", ws.Request().RemoteAddr)
+	format := "json"
+	if c.binary {
+		format = "binary"
+		ws.PayloadType = websocket.BinaryFrame
+	}
+	l.Info("ws_client_connected", "format", format)
+	defer l.Info("ws_client_disconnected")
+	cl := &hub.Client{Out: make(chan can.Frame, Buffer), Closed: make(chan struct{})}
+	c.target.Hub.Add(cl)
+	defer c.target.Hub.Remove(cl)
+	steps := newStepFlag()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.receive(ws)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case <-cl.Closed:
+			return
+		case fr := <-cl.Out:
+			var err error
+			if c.binary {
+				err = websocket.Message.Send(ws, c.codec.Encode([]can.Frame{fr}))
+			} else {
+				ev := newEvent(&fr, c.notes)
+				steps.mark(&ev)
+				err = websocket.JSON.Send(ws, ev)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// receive transmits the frames the client sends until the connection ends.
+func (c *wsClient) receive(ws *websocket.Conn) {
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			return
+		}
+		frames, err := c.parse(msg)
+		for _, fr := range frames {
+			if err = c.send(fr); err != nil {
+				break
+			}
+		}
+		if err != nil && !c.binary {
+			_ = websocket.JSON.Send(ws, map[string]string{"error": err.Error()})
+		}
+	}
+}
+
+func (c *wsClient) send(fr can.Frame) error {
+	if c.authed {
+		if err := c.id.Check(access.Send); err != nil {
+			return err
+		}
+	}
+	if c.target.Send == nil {
+		return errors.New("instance is receive-only")
+	}
+	return c.target.Send(fr)
+}
+
+// parse decodes one client message.
+func (c *wsClient) parse(msg []byte) ([]can.Frame, error) {
+	if !c.binary {
+		var ev Event
+		if err := json.Unmarshal(msg, &ev); err != nil {
+			return nil, fmt.Errorf("invalid message: %w", err)
+		}
+		fr, err := ev.frame()
+		if err != nil {
+			return nil, err
+		}
+		return []can.Frame{fr}, nil
+	}
+	var frames []can.Frame
+	_, err := c.codec.DecodeN(bytes.NewReader(msg), 0, func(fr can.Frame) {
+		frames = append(frames, fr)
+	})
+	if err != nil && !errors.Is(err, io.EOF) {
+		return frames, err
+	}
+	return frames, nil
+}
+
+// frame converts an event sent by a client to a CAN frame. IDs above the
+// standard range are extended even without the flag.
+func (ev *Event) frame() (can.Frame, error) {
+	var fr can.Frame
+	id, err := strconv.ParseUint(ev.ID, 0, 32)
+	if err != nil || id > can.CAN_EFF_MASK {
+		return fr, fmt.Errorf("invalid id %q", ev.ID)
+	}
+	data, err := hex.DecodeString(ev.Data)
+	if err != nil || len(data) > len(fr.Data) {
+		return fr, fmt.Errorf("invalid data %q", ev.Data)
+	}
+	fr.CANID = uint32(id)
+	if ev.Extended || id > can.CAN_SFF_MASK {
+		fr.CANID |= can.CAN_EFF_FLAG
+	}
+	if ev.RTR {
+		fr.CANID |= can.CAN_RTR_FLAG
+	}
+	fr.Len = uint8(copy(fr.Data[:], data))
+	return fr, nil
+}
@@ -0,0 +1,126 @@
+package stream
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/cnl"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+// startWS serves one instance and returns a dial function and the frames
+// its clients sent.
+func startWS(t *testing.T) (*hub.Hub, func(query string) *websocket.Conn, <-chan can.Frame) {
+	t.Helper()
+	h := hub.New()
+	sent := make(chan can.Frame, 8)
+	srv := httptest.NewServer(WebSocket(map[string]Target{"": {Hub: h, Send: func(fr can.Frame) error { sent <- fr; return nil }}}, nil, nil))
+	t.Cleanup(srv.Close)
+	dial := func(query string) *websocket.Conn {
+		url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/ws" + query
+		ws, err := websocket.Dial(url, "", srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		_ = ws.SetDeadline(time.Now().Add(5 * time.Second))
+		// Wait until the connection is a hub client.
+		for h.Count() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		return ws
+	}
+	return h, dial, sent
+}
+
+func TestWebSocketJSON(t *testing.T) {
+	h, dial, sent := startWS(t)
+	ws := dial("")
+	h.Broadcast(can.Frame{CANID: 0x1D0000AB | can.CAN_EFF_FLAG, Len: 2, Data: [64]byte{0x05, 0xFF}})
+	var ev Event
+	if err := websocket.JSON.Receive(ws, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.ID != "0x1D0000AB" || !ev.Extended || ev.Data != "05ff" {
+		t.Fatalf("event %+v", ev)
+	}
+
+	if err := websocket.Message.Send(ws, `{"id":"0x123","data":"0102"}`); err != nil {
+		t.Fatal(err)
+	}
+	if fr := <-sent; fr.CANID != 0x123 || fr.Len != 2 || fr.Data[1] != 0x02 {
+		t.Fatalf("sent %+v", fr)
+	}
+	if err := websocket.Message.Send(ws, `{"id":"0x123","data":"zz"}`); err != nil {
+		t.Fatal(err)
+	}
+	var reply map[string]string
+	if err := websocket.JSON.Receive(ws, &reply); err != nil || !strings.Contains(reply["error"], "invalid data") {
+		t.Fatalf("reply %v, %v", reply, err)
+	}
+}
+
+func TestWebSocketBinary(t *testing.T) {
+	h, dial, sent := startWS(t)
+	ws := dial("?format=binary")
+	var codec cnl.Codec
+	want := can.Frame{CANID: 0x321, Len: 1, Data: [64]byte{7}}
+	h.Broadcast(want)
+	var msg []byte
+	if err := websocket.Message.Receive(ws, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := codec.Decode(bytes.NewReader(msg)); err != nil || got != want {
+		t.Fatalf("received %+v, %v", got, err)
+	}
+
+	if err := websocket.Message.Send(ws, codec.Encode([]can.Frame{{CANID: 0x10, Len: 0}, {CANID: 0x11, Len: 1}})); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint32{0x10, 0x11} {
+		if fr := <-sent; fr.CANID != id {
+			t.Fatalf("sent %+v, want id %#x", fr, id)
+		}
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	srv := httptest.NewServer(WebSocket(map[string]Target{"": {Hub: hub.New()}}, nil, []string{"https://dash.lan"}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/ws"
+	for _, tc := range []struct {
+		origin string
+		ok     bool
+	}{
+		{srv.URL, true},
+		{"https://dash.lan", true},
+		{"https://evil.example", false},
+		{"http://dash.lan", false},
+	} {
+		ws, err := websocket.Dial(url, "", tc.origin)
+		if (err == nil) != tc.ok {
+			t.Errorf("origin %s: err %v, want ok=%v", tc.origin, err, tc.ok)
+		}
+		if err == nil {
+			ws.Close()
+		}
+	}
+}
+
+func TestParseOrigins(t *testing.T) {
+	got, err := ParseOrigins(" https://dash.lan:8443/ ,*")
+	if err != nil || len(got) != 2 || got[0] != "https://dash.lan:8443" || got[1] != "*" {
+		t.Fatalf("ParseOrigins = %q, %v", got, err)
+	}
+	for _, bad := range []string{"dash.lan", "https://dash.lan/app"} {
+		if _, err := ParseOrigins(bad); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Package transform rewrites CAN payloads per ID so devices expecting
+// different payload layouts can talk through the gateway without firmware
+// changes.
+//
+// A spec is a ";" separated list of rules "<ids> = <op>[, <op>...]". <ids>
+// uses the filter list syntax (0x123, 0x100-0x1FF, id/mask, comma
+// separated); the first rule matching a frame applies. Ops run in order on
+// the payload:
+//
+//	swap <off> <n>           reverse n bytes starting at byte off (endianness)
+//	bits <src> <n> <dst>     copy n bits from bit src to bit dst
+//	set <off> <hex>          overwrite bytes from off with constant hex bytes
+//
+// Bits are numbered LSB first over the little-endian payload (bit 0 is the
+// low bit of byte 0, bit 8 the low bit of byte 1), as Intel signals in DBC
+// files. Ops writing past the frame length extend it (up to 8 bytes).
+package transform
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+)
+
+// ErrBadSpec reports an unparsable transform rule.
+var ErrBadSpec = errors.New("bad transform")
+
+type opKind int
+
+const (
+	opSwap opKind = iota
+	opBits
+	opSet
+)
+
+type op struct {
+	kind     opKind
+	off, n   int // swap: bytes; bits: src bit and width
+	dst      int // bits: destination bit
+	data     []byte
+	writeEnd int // payload length the op needs (bytes)
+}
+
+type rule struct {
+	ids *filter.Filter
+	ops []op
+}
+
+// Set is an immutable list of transform rules. A nil *Set changes nothing.
+type Set struct {
+	rules []rule
+	spec  string
+}
+
+// Parse parses spec. It returns nil when spec is empty.
+func Parse(spec string) (*Set, error) {
+	s := &Set{spec: spec}
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		ids, ops, ok := strings.Cut(part, "=")
+		if !ok || strings.TrimSpace(ids) == "" {
+			return nil, fmt.Errorf("%w %q: want <ids> = <op>[, <op>...]", ErrBadSpec, part)
+		}
+		f, err := filter.New(ids, "")
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %v", ErrBadSpec, part, err)
+		}
+		r := rule{ids: f}
+		for _, o := range strings.Split(ops, ",") {
+			p, err := parseOp(strings.Fields(o))
+			if err != nil {
+				return nil, fmt.Errorf("%w %q: %v", ErrBadSpec, part, err)
+			}
+			r.ops = append(r.ops, p)
+		}
+		s.rules = append(s.rules, r)
+	}
+	if len(s.rules) == 0 {
+		return nil, nil
+	}
+	return s, nil
+}
+
+func parseOp(f []string) (op, error) {
+	var o op
+	if len(f) == 0 {
+		return o, errors.New("empty op")
+	}
+	ints := func(args []string) ([]int, error) {
+		out := make([]int, len(args))
+		for i, a := range args {
+			v, err := strconv.ParseUint(a, 0, 8)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad number %q", f[0], a)
+			}
+			out[i] = int(v)
+		}
+		return out, nil
+	}
+	switch f[0] {
+	case "swap":
+		if len(f) != 3 {
+			return o, errors.New("swap wants <off> <n>")
+		}
+		v, err := ints(f[1:])
+		if err != nil {
+			return o, err
+		}
+		o = op{kind: opSwap, off: v[0], n: v[1], writeEnd: v[0] + v[1]}
+		if o.n < 2 || o.writeEnd > 8 {
+			return o, errors.New("swap must cover 2..8 bytes within the payload")
+		}
+	case "bits":
+		if len(f) != 4 {
+			return o, errors.New("bits wants <src> <n> <dst>")
+		}
+		v, err := ints(f[1:])
+		if err != nil {
+			return o, err
+		}
+		o = op{kind: opBits, off: v[0], n: v[1], dst: v[2], writeEnd: (v[2] + v[1] + 7) / 8}
+		if o.n < 1 || o.off+o.n > 64 || o.dst+o.n > 64 {
+			return o, errors.New("bits fields must lie within 64 bits")
+		}
+	case "set":
+		if len(f) != 3 {
+			return o, errors.New("set wants <off> <hex>")
+		}
+		v, err := ints(f[1:2])
+		if err != nil {
+			return o, err
+		}
+		data, err := hex.DecodeString(strings.ReplaceAll(f[2], ".", ""))
+		if err != nil || len(data) == 0 {
+			return o, fmt.Errorf("set: bad hex bytes %q", f[2])
+		}
+		o = op{kind: opSet, off: v[0], data: data, writeEnd: v[0] + len(data)}
+		if o.writeEnd > 8 {
+			return o, errors.New("set must stay within 8 bytes")
+		}
+	default:
+		return o, fmt.Errorf("unknown op %q (want swap|bits|set)", f[0])
+	}
+	return o, nil
+}
+
+// Apply rewrites fr with the first rule matching its ID and reports whether
+// one did. Remote and error frames are left alone.
+func (s *Set) Apply(fr *can.Frame) bool {
+	if s == nil || fr.CANID&(can.CAN_RTR_FLAG|can.CAN_ERR_FLAG) != 0 {
+		return false
+	}
+	for i := range s.rules {
+		r := &s.rules[i]
+		if !r.ids.Allow(fr) {
+			continue
+		}
+		for _, o := range r.ops {
+			o.apply(fr)
+		}
+		return true
+	}
+	return false
+}
+
+func (o *op) apply(fr *can.Frame) {
+	if int(fr.Len) < o.writeEnd {
+		fr.Len = uint8(o.writeEnd)
+	}
+	switch o.kind {
+	case opSwap:
+		b := fr.Data[o.off : o.off+o.n]
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+	case opBits:
+		word := binary.LittleEndian.Uint64(fr.Data[:8])
+		mask := uint64(1)<<o.n - 1
+		if o.n == 64 {
+			mask = ^uint64(0)
+		}
+		v := (word >> o.off) & mask
+		word = word&^(mask<<o.dst) | v<<o.dst
+		binary.LittleEndian.PutUint64(fr.Data[:8], word)
+	case opSet:
+		copy(fr.Data[o.off:], o.data)
+	}
+}
+
+// String returns the source spec (for logs).
+func (s *Set) String() string {
+	if s == nil {
+		return ""
+	}
+	return s.spec
+}
@@ -0,0 +1,60 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestApply(t *testing.T) {
+	s, err := Parse("0x100 = swap 0 2, swap 2 4; 0x200-0x2FF = bits 0 4 12, set 0 00; 0x18FF0000/0x1FFF0000 = set 6 AA.BB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		in, want string
+		applied  bool
+	}{
+		{"100#01020304050607", "100#02010605040307", true}, // 16-bit and 32-bit endianness
+		{"200#0F00", "200#00F0", true},                     // low nibble of byte 0 moved to the high nibble of byte 1
+		{"201#05", "201#0050", true},                       // writing past the length extends the frame
+		{"18FF1234#01", "18FF1234#010000000000AABB", true},
+		{"300#0102", "300#0102", false}, // no rule
+		{"100#R", "100#R", false},
+	}
+	for _, tc := range tests {
+		fr, err := can.ParseFrame(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applied := s.Apply(&fr); fr.String() != tc.want || applied != tc.applied {
+			t.Fatalf("%s -> %s (applied %v), want %s (%v)", tc.in, fr, applied, tc.want, tc.applied)
+		}
+	}
+	var none *Set
+	fr := can.Frame{CANID: 0x100, Len: 1}
+	if none.Apply(&fr) {
+		t.Fatal("nil set applied")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	if s, err := Parse(" ; "); s != nil || err != nil {
+		t.Fatalf("empty spec = %v, %v", s, err)
+	}
+	for _, spec := range []string{
+		"swap 0 2",
+		"0x100 = ",
+		"0x100 = swap 7 2",
+		"0x100 = swap 0 1",
+		"0x100 = bits 60 8 0",
+		"0x100 = set 7 AABB",
+		"0x100 = set 0 xyz",
+		"0x100 = rot 1",
+		"nope = set 0 00",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Fatalf("%q: expected error", spec)
+		}
+	}
+}
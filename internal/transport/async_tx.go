@@ -7,6 +7,19 @@ import (
 	"sync/atomic"
 
 	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/memguard"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+var (
+	// ErrTxOverflow is a generic backend TX overflow sentinel for backends
+	// that do not define their own; OnDrop hooks may wrap it.
+	ErrTxOverflow = errors.New("tx overflow")
+	// ErrAsyncTxClosed is returned for frames sent after Close.
+	ErrAsyncTxClosed = errors.New("async tx closed")
+	// ErrUnsupported is wrapped by backends rejecting a frame their link
+	// cannot express, such as a remote request on a link without RTR.
+	ErrUnsupported = errors.New("frame not supported by the backend")
 )
 
 // AsyncTx is a reusable asynchronous frame transmitter that funnels frame
@@ -32,13 +45,23 @@ import (
 // the goroutine + buffer plumbing.
 type AsyncTx struct {
 	mu     sync.Mutex
-	ch     chan can.Frame
+	ch     chan txItem
+	prio   chan txItem // nil unless WithPriority is set
+	isPrio func(*can.Frame) bool
 	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
 	send   func(can.Frame) error
 	hooks  Hooks
 	closed atomic.Bool // set when Close is called; prevents enqueue after shutdown
+	// unregister removes the queue from memory accounting.
+	unregister func()
+}
+
+// txItem is one queued frame; done (optional, buffered) receives the send result.
+type txItem struct {
+	fr   can.Frame
+	done chan error
 }
 
 // Hooks customize AsyncTx behavior.
@@ -52,16 +75,40 @@ type Hooks struct {
 	OnDrop func() error
 }
 
+// PriorityQueueSize is the capacity of the priority queue enabled by
+// WithPriority. It only has to absorb a few user commands.
+const PriorityQueueSize = 64
+
+// Option configures an AsyncTx.
+type Option func(*AsyncTx)
+
+// WithPriority routes frames matching match to a small separate queue that
+// the worker always drains before the bulk queue, so interactive commands
+// are not stuck behind a client streaming a large replay. Priority frames
+// are exempt from memory-pressure shedding. A nil match disables it.
+func WithPriority(match func(*can.Frame) bool) Option {
+	return func(a *AsyncTx) {
+		if match != nil {
+			a.isPrio = match
+			a.prio = make(chan txItem, PriorityQueueSize)
+		}
+	}
+}
+
 // NewAsyncTx constructs an AsyncTx with a buffered channel of size buf.
-func NewAsyncTx(parent context.Context, buf int, send func(can.Frame) error, hooks Hooks) *AsyncTx {
+func NewAsyncTx(parent context.Context, buf int, send func(can.Frame) error, hooks Hooks, opts ...Option) *AsyncTx {
 	ctx, cancel := context.WithCancel(parent)
 	a := &AsyncTx{
-		ch:     make(chan can.Frame, buf),
+		ch:     make(chan txItem, buf),
 		ctx:    ctx,
 		cancel: cancel,
 		send:   send,
 		hooks:  hooks,
 	}
+	for _, o := range opts {
+		o(a)
+	}
+	a.unregister = memguard.RegisterBackend(func() int { return len(a.ch) + len(a.prio) })
 	a.wg.Add(1)
 	go a.loop()
 	return a
@@ -70,31 +117,81 @@ func NewAsyncTx(parent context.Context, buf int, send func(can.Frame) error, hoo
 func (a *AsyncTx) loop() {
 	defer a.wg.Done()
 	for {
+		// Drain pending priority frames first; the select below picks
+		// randomly among ready channels.
 		select {
-		case fr, ok := <-a.ch:
-			if !ok { // channel closed
+		case it, ok := <-a.prio:
+			if !ok {
 				return
 			}
-			if err := a.send(fr); err != nil {
-				if a.hooks.OnError != nil {
-					a.hooks.OnError(err)
-				}
-				continue
+			a.write(it)
+			continue
+		default:
+		}
+		select {
+		case it, ok := <-a.prio:
+			if !ok {
+				return
 			}
-			if a.hooks.OnAfter != nil {
-				a.hooks.OnAfter()
+			a.write(it)
+		case it, ok := <-a.ch:
+			if !ok { // channel closed
+				return
 			}
+			a.write(it)
 		case <-a.ctx.Done():
 			return
 		}
 	}
 }
 
+func (a *AsyncTx) write(it txItem) {
+	err := a.send(it.fr)
+	if it.done != nil {
+		it.done <- err
+	}
+	if err != nil {
+		if a.hooks.OnError != nil {
+			a.hooks.OnError(err)
+		}
+		return
+	}
+	if a.hooks.OnAfter != nil {
+		a.hooks.OnAfter()
+	}
+}
+
 // SendFrame queues a frame for asynchronous transmission or returns the drop
 // error if the buffer is full.
-var ErrAsyncTxClosed = errors.New("async tx closed")
-
 func (a *AsyncTx) SendFrame(fr can.Frame) error {
+	return a.enqueue(txItem{fr: fr})
+}
+
+// SendFrameWait queues a frame like SendFrame and then blocks until the
+// worker has written it, returning the write error. Overflow is reported
+// immediately. Used when a caller must know the frame reached the device.
+func (a *AsyncTx) SendFrameWait(ctx context.Context, fr can.Frame) error {
+	done := make(chan error, 1)
+	if err := a.enqueue(txItem{fr: fr, done: done}); err != nil {
+		return err
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-a.ctx.Done():
+		// The worker may have written the frame just before stopping.
+		select {
+		case err := <-done:
+			return err
+		default:
+			return ErrAsyncTxClosed
+		}
+	}
+}
+
+func (a *AsyncTx) enqueue(it txItem) error {
 	// Fast-path check so steady-state sends avoid taking the lock when already shut down.
 	if a.closed.Load() {
 		return ErrAsyncTxClosed
@@ -104,8 +201,23 @@ func (a *AsyncTx) SendFrame(fr can.Frame) error {
 	if a.closed.Load() {
 		return ErrAsyncTxClosed
 	}
+	if a.isPrio != nil && a.isPrio(&it.fr) {
+		select {
+		case a.prio <- it:
+			metrics.IncTxPriority()
+			return nil
+		default:
+			// Priority queue full: fall back to the bulk queue.
+		}
+	}
+	if memguard.Shed(len(a.ch), cap(a.ch)) {
+		if a.hooks.OnDrop != nil {
+			return a.hooks.OnDrop()
+		}
+		return nil
+	}
 	select {
-	case a.ch <- fr:
+	case a.ch <- it:
 		return nil
 	default:
 		if a.hooks.OnDrop != nil {
@@ -115,6 +227,10 @@ func (a *AsyncTx) SendFrame(fr can.Frame) error {
 	}
 }
 
+// Queue reports the frames waiting in the regular queue and its capacity.
+// The priority queue is left out: it is small and drains first.
+func (a *AsyncTx) Queue() (depth, capacity int) { return len(a.ch), cap(a.ch) }
+
 // Close stops the worker and waits for all pending operations to finish.
 func (a *AsyncTx) Close() {
 	if a.closed.Swap(true) { // already closed
@@ -124,6 +240,10 @@ func (a *AsyncTx) Close() {
 	a.cancel()
 	a.mu.Lock()
 	close(a.ch)
+	if a.prio != nil {
+		close(a.prio)
+	}
 	a.mu.Unlock()
 	a.wg.Wait()
+	a.unregister()
 }
@@ -120,3 +120,70 @@ func TestAsyncTxCloseConcurrentSend(t *testing.T) {
 		}
 	}
 }
+
+// TestAsyncTxSendFrameWait verifies the write result is reported to the caller.
+func TestAsyncTxSendFrameWait(t *testing.T) {
+	ax := NewAsyncTx(context.Background(), 4, func(fr can.Frame) error {
+		if fr.CANID == 2 {
+			return errSendFail
+		}
+		return nil
+	}, Hooks{})
+	defer ax.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ax.SendFrameWait(ctx, can.Frame{CANID: 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ax.SendFrameWait(ctx, can.Frame{CANID: 2}); !errors.Is(err, errSendFail) {
+		t.Fatalf("expected send failure, got %v", err)
+	}
+}
+
+// TestAsyncTxSendFrameWaitCancel verifies a blocked waiter honors its context.
+func TestAsyncTxSendFrameWaitCancel(t *testing.T) {
+	release := make(chan struct{})
+	ax := NewAsyncTx(context.Background(), 4, func(fr can.Frame) error { <-release; return nil }, Hooks{})
+	defer func() { close(release); ax.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := ax.SendFrameWait(ctx, can.Frame{CANID: 1}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+// TestAsyncTxPriority verifies priority frames overtake queued bulk frames.
+func TestAsyncTxPriority(t *testing.T) {
+	gate := make(chan struct{})
+	order := make(chan uint32, 16)
+	ax := NewAsyncTx(context.Background(), 16, func(fr can.Frame) error {
+		if fr.CANID == 0x500 && len(order) == 0 {
+			<-gate // hold the worker on the first bulk frame
+		}
+		order <- fr.CANID
+		return nil
+	}, Hooks{}, WithPriority(func(fr *can.Frame) bool { return fr.CANID == 0x100 }))
+	defer ax.Close()
+	for i := 0; i < 5; i++ {
+		if err := ax.SendFrame(can.Frame{CANID: 0x500}); err != nil {
+			t.Fatalf("bulk send: %v", err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond) // worker is now blocked on frame 1
+	if err := ax.SendFrame(can.Frame{CANID: 0x100}); err != nil {
+		t.Fatalf("priority send: %v", err)
+	}
+	close(gate)
+	var got []uint32
+	for len(got) < 6 {
+		select {
+		case id := <-order:
+			got = append(got, id)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout, got %x", got)
+		}
+	}
+	if got[0] != 0x500 || got[1] != 0x100 {
+		t.Fatalf("priority frame not sent next: %x", got)
+	}
+}
@@ -0,0 +1,197 @@
+// Package validate checks CAN frames against the rules every codec and
+// backend relies on (payload length, ID range, flag bits) in one place. The
+// hub validates frames received from backends and the backend transmit path
+// validates frames from clients, so codecs only deal with their framing.
+// Each rule violation is counted by rule name; the process-wide mode
+// decides whether invalid frames are dropped, repaired or let through.
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/metrics"
+)
+
+// MaxDLC is the payload size limit of classic CAN frames.
+const MaxDLC = 8
+
+// ErrInvalid is returned for frames rejected in strict mode.
+var ErrInvalid = errors.New("invalid frame")
+
+// Direction selects the path a rule applies to.
+type Direction uint8
+
+const (
+	RX   Direction = 1 << iota // backend to clients
+	TX                         // clients to backend
+	Both = RX | TX
+)
+
+func (d Direction) String() string {
+	switch d {
+	case RX:
+		return "rx"
+	case TX:
+		return "tx"
+	case Both:
+		return "rx,tx"
+	}
+	return fmt.Sprintf("direction(%d)", uint8(d))
+}
+
+// Mode is the strictness of Frame.
+type Mode int32
+
+const (
+	Strict  Mode = iota // drop invalid frames
+	Lenient             // repair what a rule can repair, count and pass the rest
+	Off                 // no checks
+)
+
+var modeNames = [...]string{Strict: "strict", Lenient: "lenient", Off: "off"}
+
+func (m Mode) String() string {
+	if m >= 0 && int(m) < len(modeNames) {
+		return modeNames[m]
+	}
+	return fmt.Sprintf("mode(%d)", int32(m))
+}
+
+// ParseMode converts "strict", "lenient" or "off" to a Mode.
+func ParseMode(s string) (Mode, error) {
+	for m, n := range modeNames {
+		if s == n {
+			return Mode(m), nil
+		}
+	}
+	return Strict, fmt.Errorf("unknown validation mode %q (want strict|lenient|off)", s)
+}
+
+// Rule is one frame check. Invalid reports a violation; Repair, when set,
+// fixes the frame in lenient mode (a frame without a repair passes as is).
+type Rule struct {
+	Name    string // metric label, snake_case
+	Dir     Direction
+	Invalid func(*can.Frame) bool
+	Repair  func(*can.Frame)
+}
+
+var (
+	mode    atomic.Int32
+	rulesMu sync.RWMutex
+	rules   []Rule
+)
+
+func init() {
+	// CAN FD frames take the FD payload sizes up to can.MaxFDLen; a repair
+	// pads the payload to the next one.
+	Register(Rule{
+		Name: "dlc",
+		Dir:  Both,
+		Invalid: func(fr *can.Frame) bool {
+			if fr.IsFD() {
+				return fr.Len != can.FDLen(int(fr.Len))
+			}
+			return fr.Len > MaxDLC
+		},
+		Repair: func(fr *can.Frame) {
+			if fr.IsFD() {
+				n := can.FDLen(int(fr.Len))
+				if fr.Len < n {
+					clear(fr.Data[fr.Len:n])
+				}
+				fr.Len = n
+				return
+			}
+			fr.Len = MaxDLC
+		},
+	})
+	Register(Rule{
+		Name: "sff_id",
+		Dir:  Both,
+		Invalid: func(fr *can.Frame) bool {
+			return fr.CANID&can.CAN_EFF_FLAG == 0 && fr.CANID&can.CAN_EFF_MASK > can.CAN_SFF_MASK
+		},
+	})
+	// Error frames are reported by the controller; they cannot be sent.
+	Register(Rule{
+		Name:    "err_flag",
+		Dir:     TX,
+		Invalid: func(fr *can.Frame) bool { return fr.CANID&can.CAN_ERR_FLAG != 0 },
+	})
+}
+
+// Register adds a rule, checked after the ones registered before it. It
+// panics on a duplicate name, like other registration-at-init APIs.
+func Register(r Rule) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	for _, x := range rules {
+		if x.Name == r.Name {
+			panic("validate: rule " + r.Name + " registered twice")
+		}
+	}
+	rules = append(rules, r)
+}
+
+// Rules lists the registered rule names.
+func Rules() []string {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	names := make([]string, 0, len(rules))
+	for _, r := range rules {
+		names = append(names, r.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetMode sets the process-wide strictness.
+func SetMode(m Mode) { mode.Store(int32(m)) }
+
+// CurrentMode returns the process-wide strictness.
+func CurrentMode() Mode { return Mode(mode.Load()) }
+
+// Check returns the name of the first rule fr violates on path dir, or ""
+// when it is valid. It neither counts nor repairs.
+func Check(dir Direction, fr *can.Frame) string {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	for _, r := range rules {
+		if r.Dir&dir != 0 && r.Invalid(fr) {
+			return r.Name
+		}
+	}
+	return ""
+}
+
+// Frame validates fr on path dir according to the current mode and counts
+// every violated rule in invalid_frames_total. In strict mode it returns an
+// error wrapping ErrInvalid for an invalid frame; in lenient mode it repairs
+// fr where possible and returns nil.
+func Frame(dir Direction, fr *can.Frame) error {
+	m := CurrentMode()
+	if m == Off {
+		return nil
+	}
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	for _, r := range rules {
+		if r.Dir&dir == 0 || !r.Invalid(fr) {
+			continue
+		}
+		metrics.IncInvalidFrame(r.Name)
+		if m == Strict {
+			return fmt.Errorf("%w: %s", ErrInvalid, r.Name)
+		}
+		if r.Repair != nil {
+			r.Repair(fr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package validate
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+)
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		dir  Direction
+		fr   can.Frame
+		want string
+	}{
+		{TX, can.Frame{CANID: 0x7FF, Len: 8}, ""},
+		{RX, can.Frame{CANID: 0x1FFFFFFF | can.CAN_EFF_FLAG, Len: 0}, ""},
+		{TX, can.Frame{CANID: 0x100, Len: 9}, "dlc"},
+		{TX, can.Frame{CANID: 0x100, Len: 12, Flags: can.CANFD_FDF}, ""},
+		{RX, can.Frame{CANID: 0x100, Len: 9, Flags: can.CANFD_FDF | can.CANFD_BRS}, "dlc"},
+		{RX, can.Frame{CANID: 0x100, Len: 65, Flags: can.CANFD_FDF}, "dlc"},
+		{RX, can.Frame{CANID: 0x800}, "sff_id"},
+		{RX, can.Frame{CANID: 0x800 | can.CAN_EFF_FLAG}, ""},
+		{TX, can.Frame{CANID: can.CAN_ERR_FLAG | 0x4, Len: 8}, "err_flag"},
+		{RX, can.Frame{CANID: can.CAN_ERR_FLAG | 0x4, Len: 8}, ""},
+	}
+	for _, tc := range cases {
+		if got := Check(tc.dir, &tc.fr); got != tc.want {
+			t.Fatalf("%s %08X/%d: got %q want %q", tc.dir, tc.fr.CANID, tc.fr.Len, got, tc.want)
+		}
+	}
+}
+
+func TestFrameModes(t *testing.T) {
+	defer SetMode(CurrentMode())
+	bad := can.Frame{CANID: 0x123, Len: 12}
+
+	SetMode(Strict)
+	fr := bad
+	if err := Frame(TX, &fr); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("strict: got %v", err)
+	}
+
+	SetMode(Lenient)
+	fr = bad
+	if err := Frame(TX, &fr); err != nil || fr.Len != MaxDLC {
+		t.Fatalf("lenient: err=%v len=%d", err, fr.Len)
+	}
+	fr = can.Frame{CANID: 0x123, Len: 10, Flags: can.CANFD_FDF}
+	fr.Data[11] = 0xFF
+	if err := Frame(TX, &fr); err != nil || fr.Len != 12 || fr.Data[11] != 0 {
+		t.Fatalf("lenient fd: err=%v len=%d padding %X", err, fr.Len, fr.Data[10:12])
+	}
+	fr = can.Frame{CANID: 0x800}
+	if err := Frame(RX, &fr); err != nil || fr.CANID != 0x800 {
+		t.Fatalf("lenient without repair: err=%v id=%X", err, fr.CANID)
+	}
+
+	SetMode(Off)
+	fr = bad
+	if err := Frame(TX, &fr); err != nil || fr.Len != 12 {
+		t.Fatalf("off: err=%v len=%d", err, fr.Len)
+	}
+}
+
+func TestRegisterHook(t *testing.T) {
+	defer SetMode(CurrentMode())
+	SetMode(Strict)
+	Register(Rule{Name: "test_no_0x42", Dir: TX, Invalid: func(fr *can.Frame) bool { return fr.CANID == 0x42 }})
+	fr := can.Frame{CANID: 0x42}
+	if err := Frame(TX, &fr); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("custom rule not applied: %v", err)
+	}
+	if err := Frame(RX, &fr); err != nil {
+		t.Fatalf("TX rule applied on RX: %v", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("duplicate rule did not panic")
+		}
+	}()
+	Register(Rule{Name: "dlc", Dir: TX, Invalid: func(*can.Frame) bool { return false }})
+}
+
+func TestParseMode(t *testing.T) {
+	for _, m := range []Mode{Strict, Lenient, Off} {
+		if got, err := ParseMode(m.String()); err != nil || got != m {
+			t.Fatalf("ParseMode(%s)=%v,%v", m, got, err)
+		}
+	}
+	if _, err := ParseMode("loose"); err == nil {
+		t.Fatal("ParseMode(loose) accepted")
+	}
+}
@@ -0,0 +1,165 @@
+// Package vbus carves named virtual buses out of one physical bus so that
+// several tenants (teams, integrations) can share a gateway in isolation.
+//
+// A virtual bus owns a hub, and so its own clients, fed from the physical
+// instance hub with only the frames whose IDs belong to it. Frames its
+// clients send must fall inside its TX ID set and within its TX rate before
+// they reach the physical backend. Every bus counts its own traffic and
+// rejections, so tenants are accounted separately.
+package vbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+	"github.com/kstaniek/go-ampio-server/internal/logging"
+)
+
+var (
+	// ErrOutOfRange rejects a client frame whose ID is outside the bus TX
+	// set. It is a filter denial.
+	ErrOutOfRange = fmt.Errorf("%w: outside the virtual bus", filter.ErrDenied)
+	// ErrRateLimited rejects a client frame sent above the bus TX rate.
+	ErrRateLimited = errors.New("virtual bus tx rate exceeded")
+)
+
+// Config describes one virtual bus.
+type Config struct {
+	Name string
+	RX   *filter.Filter // physical IDs delivered to the bus clients; nil: all
+	TX   *filter.Filter // IDs the bus clients may send; nil: all
+	// TxRate caps client frames per second across the bus (0: unlimited);
+	// TxBurst is how many may be sent back to back (<= 0: one second's worth).
+	TxRate  float64
+	TxBurst int
+}
+
+// Stats is a snapshot of the bus counters.
+type Stats struct {
+	RxFrames  uint64 `json:"rx_frames"`  // physical frames delivered to the bus hub
+	TxFrames  uint64 `json:"tx_frames"`  // client frames passed to the backend
+	TxDenied  uint64 `json:"tx_denied"`  // client frames outside the TX set
+	TxLimited uint64 `json:"tx_limited"` // client frames above the TX rate
+}
+
+// Bus is one running virtual bus.
+type Bus struct {
+	cfg    Config
+	hub    *hub.Hub
+	now    func() time.Time
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	rx, tx, denied, limited atomic.Uint64
+}
+
+// New returns the bus described by cfg, delivering to h.
+func New(cfg Config, h *hub.Hub) *Bus {
+	if cfg.TxRate > 0 && cfg.TxBurst <= 0 {
+		cfg.TxBurst = max(1, int(cfg.TxRate))
+	}
+	return &Bus{cfg: cfg, hub: h, now: time.Now, logger: logging.L(), tokens: float64(cfg.TxBurst)}
+}
+
+// Name returns the bus name.
+func (b *Bus) Name() string { return b.cfg.Name }
+
+// Hub returns the hub of the bus clients.
+func (b *Bus) Hub() *hub.Hub { return b.hub }
+
+// Stats returns the bus counters.
+func (b *Bus) Stats() Stats {
+	return Stats{RxFrames: b.rx.Load(), TxFrames: b.tx.Load(), TxDenied: b.denied.Load(), TxLimited: b.limited.Load()}
+}
+
+// Run feeds the bus from the physical hub until ctx is cancelled. If the
+// physical hub kicks the feed (kick policy), it re-subscribes; frames missed
+// meanwhile are lost to this bus only.
+func (b *Bus) Run(ctx context.Context, phys *hub.Hub) {
+	size := phys.OutBufSize()
+	for {
+		cl := &hub.Client{Out: make(chan can.Frame, size), Closed: make(chan struct{})}
+		phys.Add(cl)
+		closed := false
+		for !closed {
+			select {
+			case fr := <-cl.Out:
+				if b.cfg.RX.Allow(&fr) {
+					b.rx.Add(1)
+					b.hub.Broadcast(fr)
+				}
+			case <-cl.Closed:
+				closed = true
+			case <-ctx.Done():
+				phys.Remove(cl)
+				return
+			}
+		}
+		phys.Remove(cl)
+		b.logger.Warn("vbus_resubscribe", "vbus", b.cfg.Name)
+	}
+}
+
+// admit checks a client frame against the TX set and rate.
+func (b *Bus) admit(fr *can.Frame) error {
+	if !b.cfg.TX.Allow(fr) {
+		b.denied.Add(1)
+		return ErrOutOfRange
+	}
+	if b.cfg.TxRate <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens = min(float64(b.cfg.TxBurst), b.tokens+now.Sub(b.last).Seconds()*b.cfg.TxRate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		b.limited.Add(1)
+		return ErrRateLimited
+	}
+	b.tokens--
+	return nil
+}
+
+// Send wraps the physical transmit path: frames the bus admits are passed
+// to send.
+func (b *Bus) Send(send func(can.Frame) error) func(can.Frame) error {
+	return func(fr can.Frame) error {
+		if err := b.admit(&fr); err != nil {
+			return err
+		}
+		if err := send(fr); err != nil {
+			return err
+		}
+		b.tx.Add(1)
+		return nil
+	}
+}
+
+// SendWait is Send for the waiting transmit path.
+func (b *Bus) SendWait(send func(context.Context, can.Frame) error) func(context.Context, can.Frame) error {
+	return func(ctx context.Context, fr can.Frame) error {
+		if err := b.admit(&fr); err != nil {
+			return err
+		}
+		if err := send(ctx, fr); err != nil {
+			return err
+		}
+		b.tx.Add(1)
+		return nil
+	}
+}
@@ -0,0 +1,90 @@
+package vbus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kstaniek/go-ampio-server/internal/can"
+	"github.com/kstaniek/go-ampio-server/internal/filter"
+	"github.com/kstaniek/go-ampio-server/internal/hub"
+)
+
+func mustFilter(t *testing.T, allow string) *filter.Filter {
+	t.Helper()
+	f, err := filter.New(allow, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestRunDeliversOwnRange(t *testing.T) {
+	phys := hub.New()
+	b := New(Config{Name: "a", RX: mustFilter(t, "0x100-0x1FF")}, hub.New())
+	cl := &hub.Client{Out: make(chan can.Frame, 4), Closed: make(chan struct{})}
+	b.Hub().Add(cl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx, phys)
+	for deadline := time.Now().Add(time.Second); phys.Count() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("bus did not subscribe to the physical hub")
+		}
+	}
+
+	phys.Broadcast(can.Frame{CANID: 0x300, Len: 1})
+	phys.Broadcast(can.Frame{CANID: 0x150, Len: 1})
+	select {
+	case fr := <-cl.Out:
+		if fr.CANID != 0x150 {
+			t.Fatalf("got ID 0x%X, want 0x150", fr.CANID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for in-range frame")
+	}
+	if s := b.Stats(); s.RxFrames != 1 {
+		t.Fatalf("rx frames = %d, want 1", s.RxFrames)
+	}
+}
+
+func TestSendChecksRangeAndRate(t *testing.T) {
+	b := New(Config{Name: "a", TX: mustFilter(t, "0x100-0x1FF"), TxRate: 10, TxBurst: 2}, hub.New())
+	now := time.Unix(0, 0)
+	b.now = func() time.Time { return now }
+	var sent []uint32
+	send := b.Send(func(fr can.Frame) error { sent = append(sent, fr.CANID); return nil })
+
+	if err := send(can.Frame{CANID: 0x200}); !errors.Is(err, ErrOutOfRange) || !errors.Is(err, filter.ErrDenied) {
+		t.Fatalf("out of range: err = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := send(can.Frame{CANID: 0x101}); err != nil {
+			t.Fatalf("burst frame %d: %v", i, err)
+		}
+	}
+	if err := send(can.Frame{CANID: 0x101}); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("over rate: err = %v", err)
+	}
+	now = now.Add(100 * time.Millisecond) // one token at 10/s
+	if err := send(can.Frame{CANID: 0x101}); err != nil {
+		t.Fatalf("after refill: %v", err)
+	}
+	want := Stats{TxFrames: 3, TxDenied: 1, TxLimited: 1}
+	if s := b.Stats(); s != want || len(sent) != 3 {
+		t.Fatalf("stats = %+v (sent %d), want %+v", s, len(sent), want)
+	}
+}
+
+func TestSendWaitUnlimited(t *testing.T) {
+	b := New(Config{Name: "a"}, hub.New())
+	fail := errors.New("backend down")
+	send := b.SendWait(func(context.Context, can.Frame) error { return fail })
+	if err := send(context.Background(), can.Frame{CANID: 0x7FF}); !errors.Is(err, fail) {
+		t.Fatalf("err = %v, want backend error", err)
+	}
+	if s := b.Stats(); s.TxFrames != 0 {
+		t.Fatalf("failed send counted: %+v", s)
+	}
+}